@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/pmkol/mosdns-x/pkg/server"
+)
+
+const defaultACMEDir = "acme"
+
+// newACMEManager creates a certificate manager of cfg. If cfg.DNSHook
+// is set, certificates are obtained by dns-01 challenges. Otherwise,
+// if cfg.HTTPAddr is set, a http server is started to solve http-01
+// challenges.
+func (m *Mosdns) newACMEManager(cfg *ACMEConfig) (server.CertManager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme needs domains")
+	}
+	dir := cfg.Dir
+	if len(dir) == 0 {
+		dir = defaultACMEDir
+	}
+	client := &acme.Client{DirectoryURL: cfg.CA}
+	if len(cfg.CA) == 0 {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if len(cfg.DNSHook) > 0 {
+		if len(cfg.HTTPAddr) > 0 {
+			return nil, errors.New("dns_hook and http_addr cannot be used together")
+		}
+		dm := newDNS01Manager(client, cfg.Domains, cfg.Email, cfg.DNSHook, autocert.DirCache(dir), m.logger.Named("acme"))
+		m.sc.Attach(dm.run)
+		return dm, nil
+	}
+
+	am := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+		Client:     client,
+	}
+	if httpAddr := cfg.HTTPAddr; len(httpAddr) > 0 {
+		m.addACMEHTTPHandler(httpAddr, am)
+	}
+	return am, nil
+}
+
+// acmeHTTPHandler solves http-01 challenges of all managers that use
+// the same http_addr.
+type acmeHTTPHandler struct {
+	m sync.Mutex
+	h http.Handler
+}
+
+func (h *acmeHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.m.Lock()
+	next := h.h
+	h.m.Unlock()
+	next.ServeHTTP(w, r)
+}
+
+// addACMEHTTPHandler serves http-01 challenges of am on httpAddr. Only
+// one http server is started for an address.
+func (m *Mosdns) addACMEHTTPHandler(httpAddr string, am *autocert.Manager) {
+	m.acmeHTTPMu.Lock()
+	defer m.acmeHTTPMu.Unlock()
+	if h := m.acmeHTTP[httpAddr]; h != nil {
+		h.m.Lock()
+		// am handles its own tokens and passes others to the
+		// previous managers.
+		h.h = am.HTTPHandler(h.h)
+		h.m.Unlock()
+		return
+	}
+	h := &acmeHTTPHandler{h: am.HTTPHandler(nil)}
+	if m.acmeHTTP == nil {
+		m.acmeHTTP = make(map[string]*acmeHTTPHandler)
+	}
+	m.acmeHTTP[httpAddr] = h
+
+	httpServer := &http.Server{
+		Addr:    httpAddr,
+		Handler: h,
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		errChan := make(chan error, 1)
+		go func() {
+			m.logger.Info("starting acme http server", zap.String("addr", httpAddr))
+			errChan <- httpServer.ListenAndServe()
+		}()
+		select {
+		case err := <-errChan:
+			m.sc.SendCloseSignal(err)
+		case <-closeSignal:
+			httpServer.Close()
+		}
+	})
+}
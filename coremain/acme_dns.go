@@ -0,0 +1,333 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	dns01RenewBefore    = time.Hour * 24 * 30
+	dns01CheckInterval  = time.Hour * 12
+	dns01RetryInterval  = time.Hour
+	dns01ObtainTimeout  = time.Minute * 10
+	dns01CleanupTimeout = time.Minute
+	acmeAccountKeyName  = "acme_account+key" // same as autocert
+)
+
+// dns01Manager obtains one certificate for all domains by dns-01
+// challenges, which are solved by an external hook command. It keeps
+// the certificate in cache and renews it 30 days before it expires.
+type dns01Manager struct {
+	client  *acme.Client
+	domains []string
+	email   string
+	hook    []string
+	cache   autocert.Cache
+	logger  *zap.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func newDNS01Manager(client *acme.Client, domains []string, email, hook string, cache autocert.Cache, lg *zap.Logger) *dns01Manager {
+	return &dns01Manager{
+		client:  client,
+		domains: domains,
+		email:   email,
+		hook:    strings.Fields(hook),
+		cache:   cache,
+		logger:  lg,
+	}
+}
+
+// GetCertificate implements server.CertManager.
+func (d *dns01Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := d.cert.Load(); c != nil {
+		return c, nil
+	}
+	return nil, errors.New("acme certificate is not ready")
+}
+
+// run loads the cached certificate and renews it until closeSignal is
+// closed. It is compatible with safe_close.
+func (d *dns01Manager) run(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closeSignal:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := d.loadCache(ctx); err != nil && !errors.Is(err, autocert.ErrCacheMiss) {
+		d.logger.Warn("failed to load cached certificate", zap.Error(err))
+	}
+	for {
+		wait := dns01CheckInterval
+		if err := d.renewIfNeeded(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			d.logger.Error("failed to obtain certificate", zap.Strings("domains", d.domains), zap.Error(err))
+			wait = dns01RetryInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-closeSignal:
+			return
+		}
+	}
+}
+
+func (d *dns01Manager) renewIfNeeded(ctx context.Context) error {
+	if c := d.cert.Load(); c != nil && time.Until(c.Leaf.NotAfter) > dns01RenewBefore {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dns01ObtainTimeout)
+	defer cancel()
+	c, err := d.obtain(ctx)
+	if err != nil {
+		return err
+	}
+	d.cert.Store(c)
+	d.logger.Info("certificate obtained", zap.Strings("domains", d.domains), zap.Time("not_after", c.Leaf.NotAfter))
+	b, err := encodeCert(c)
+	if err != nil {
+		return err
+	}
+	return d.cache.Put(ctx, d.cacheKey(), b)
+}
+
+func (d *dns01Manager) cacheKey() string {
+	// '*' is not allowed in file names on some systems.
+	return "dns01+" + strings.ReplaceAll(strings.Join(d.domains, "+"), "*", "_")
+}
+
+func (d *dns01Manager) loadCache(ctx context.Context) error {
+	b, err := d.cache.Get(ctx, d.cacheKey())
+	if err != nil {
+		return err
+	}
+	c, err := decodeCert(b)
+	if err != nil {
+		return err
+	}
+	d.cert.Store(c)
+	return nil
+}
+
+func (d *dns01Manager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	if d.client.Key == nil {
+		key, err := d.accountKey(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load account key, %w", err)
+		}
+		d.client.Key = key
+		a := new(acme.Account)
+		if len(d.email) > 0 {
+			a.Contact = []string{"mailto:" + d.email}
+		}
+		if _, err := d.client.Register(ctx, a, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			d.client.Key = nil
+			return nil, fmt.Errorf("failed to register account, %w", err)
+		}
+	}
+
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(d.domains...))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := d.authorize(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = d.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: d.domains}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize solves the dns-01 challenge of the authorization u.
+func (d *dns01Manager) authorize(ctx context.Context, u string) error {
+	z, err := d.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+	if err := d.runHook(ctx, "present", fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dns01CleanupTimeout)
+		defer cancel()
+		if err := d.runHook(ctx, "cleanup", fqdn, value); err != nil {
+			d.logger.Warn("failed to clean up dns-01 challenge", zap.Error(err))
+		}
+	}()
+	if _, err := d.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = d.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+func (d *dns01Manager) runHook(ctx context.Context, action, fqdn, value string) error {
+	args := append(d.hook[1:len(d.hook):len(d.hook)], action, fqdn, value)
+	out, err := exec.CommandContext(ctx, d.hook[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns hook %s %s failed, %w, output: %s", action, fqdn, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (d *dns01Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	b, err := d.cache.Get(ctx, acmeAccountKeyName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.cache.Put(ctx, acmeAccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePEMKey(b)
+}
+
+func parsePEMKey(b []byte) (crypto.Signer, error) {
+	p, _ := pem.Decode(b)
+	if p == nil || !strings.Contains(p.Type, "PRIVATE") {
+		return nil, errors.New("invalid private key")
+	}
+	if key, err := x509.ParseECPrivateKey(p.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return s, nil
+}
+
+// encodeCert encodes c as a private key followed by the certificate
+// chain, in PEM.
+func encodeCert(c *tls.Certificate) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, cert := range c.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	return b, nil
+}
+
+func decodeCert(b []byte) (*tls.Certificate, error) {
+	key, err := parsePEMKey(b)
+	if err != nil {
+		return nil, err
+	}
+	_, rest := pem.Decode(b)
+	c := &tls.Certificate{PrivateKey: key}
+	for {
+		var p *pem.Block
+		p, rest = pem.Decode(rest)
+		if p == nil {
+			break
+		}
+		c.Certificate = append(c.Certificate, p.Bytes)
+	}
+	if len(c.Certificate) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/pmkol/mosdns-x/pkg/safe_close"
+)
+
+func Test_dns01Manager_hookAndCache(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d := newDNS01Manager(nil, []string{"example.com", "*.example.com"}, "", hook+" --flag", autocert.DirCache(dir), zap.NewNop())
+	ctx := context.Background()
+	if err := d.runHook(ctx, "present", "_acme-challenge.example.com.", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(out); string(b) != "--flag present _acme-challenge.example.com. v\n" {
+		t.Fatalf("unexpected hook args %q", b)
+	}
+	if _, err := d.GetCertificate(nil); err == nil {
+		t.Fatal("GetCertificate should fail without a certificate")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: d.domains, NotAfter: time.Now().Add(time.Hour * 24 * 90)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encodeCert(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.cache.Put(ctx, d.cacheKey(), b); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.loadCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.GetCertificate(nil)
+	if err != nil || c.Leaf.DNSNames[1] != "*.example.com" {
+		t.Fatalf("unexpected cached certificate, %v", err)
+	}
+	// The cached certificate is not renewed yet.
+	if err := d.renewIfNeeded(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_addACMEHTTPHandler(t *testing.T) {
+	m := &Mosdns{logger: zap.NewNop(), sc: safe_close.NewSafeClose()}
+	defer func() {
+		m.sc.Done()
+		m.sc.CloseWait()
+	}()
+	m.addACMEHTTPHandler("127.0.0.1:0", new(autocert.Manager))
+	m.addACMEHTTPHandler("127.0.0.1:0", new(autocert.Manager))
+	m.addACMEHTTPHandler("127.0.0.2:0", new(autocert.Manager))
+	if len(m.acmeHTTP) != 2 {
+		t.Fatalf("want 2 acme http servers, got %d", len(m.acmeHTTP))
+	}
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const resolveTimeout = time.Second * 5
+
+// apiAuth requires token in requests to h. Cluster requests are
+// authenticated by the cluster secret. The dashboard is a static page,
+// it sends the token itself.
+// Only bearer tokens are accepted. Browsers don't attach them to
+// cross-site requests, unlike cached basic auth credentials.
+func apiAuth(h http.Handler, token string) http.Handler {
+	if len(token) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := req.URL.Path
+		if strings.HasPrefix(p, "/cluster/") || strings.HasPrefix(p, "/dashboard/") || checkToken(req, token) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func checkToken(req *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handleCacheFlush flushes caches of plugins that implement Flusher.
+// The optional query parameter "tag" selects a plugin.
+func (m *Mosdns) handleCacheFlush(w http.ResponseWriter, req *http.Request) {
+	tag := req.URL.Query().Get("tag")
+	g := m.acquireGraph()
+	defer g.release()
+	var flushed []string
+	for t, p := range g.plugins {
+		if len(tag) > 0 && t != tag {
+			continue
+		}
+		f, ok := p.(Flusher)
+		if !ok || isPreset(p) {
+			continue
+		}
+		if err := f.Flush(); err != nil {
+			http.Error(w, t+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flushed = append(flushed, t)
+	}
+	if len(tag) > 0 && len(flushed) == 0 {
+		http.Error(w, "plugin not found or it has no cache", http.StatusNotFound)
+		return
+	}
+	sort.Strings(flushed)
+	m.logger.Info("caches flushed", zap.Strings("plugins", flushed))
+	writeJSON(w, m.logger, flushed)
+}
+
+// handleDataReload reloads the data provider {tag}, or all data providers
+// if there is no tag, and pushes the data to plugins.
+func (m *Mosdns) handleDataReload(w http.ResponseWriter, req *http.Request) {
+	dm := m.graph.Load().dataManager
+	tag := req.PathValue("tag")
+	if len(tag) > 0 {
+		dp := dm.GetDataProvider(tag)
+		if dp == nil {
+			http.Error(w, "data provider not found", http.StatusNotFound)
+			return
+		}
+		if err := dp.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.logger.Info("data provider reloaded", zap.String("tag", tag))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	errs := make(map[string]string)
+	for tag, dp := range dm.GetDataProviders() {
+		if err := dp.Reload(); err != nil {
+			errs[tag] = err.Error()
+		}
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, m.logger, errs)
+		return
+	}
+	m.logger.Info("data providers reloaded")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type metricSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+	Count  uint64            `json:"count,omitempty"` // of histograms and summaries
+}
+
+// handleStats reports metrics of plugins as json, by plugin tag and
+// metric name. The optional path value {tag} selects a plugin.
+func (m *Mosdns) handleStats(w http.ResponseWriter, req *http.Request) {
+	g := m.graph.Load()
+	tags := make([]string, 0, len(g.plugins))
+	for t := range g.plugins {
+		tags = append(tags, t)
+	}
+	// Longer tags first, so "a_b" is not taken as "a".
+	sort.Slice(tags, func(i, j int) bool { return len(tags[i]) > len(tags[j]) })
+
+	mfs, err := g.metricsReg.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats := make(map[string]map[string][]metricSample)
+	for _, mf := range mfs {
+		name, ok := strings.CutPrefix(mf.GetName(), "mosdns_plugin_")
+		if !ok {
+			continue
+		}
+		for _, t := range tags {
+			metric, ok := strings.CutPrefix(name, t+"_")
+			if !ok {
+				continue
+			}
+			if stats[t] == nil {
+				stats[t] = make(map[string][]metricSample)
+			}
+			for _, mt := range mf.GetMetric() {
+				stats[t][metric] = append(stats[t][metric], newMetricSample(mt))
+			}
+			break
+		}
+	}
+
+	if tag := req.PathValue("tag"); len(tag) > 0 {
+		if _, ok := g.plugins[tag]; !ok {
+			http.Error(w, "plugin not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, m.logger, stats[tag])
+		return
+	}
+	writeJSON(w, m.logger, stats)
+}
+
+func newMetricSample(mt *dto.Metric) metricSample {
+	var s metricSample
+	if lps := mt.GetLabel(); len(lps) > 0 {
+		s.Labels = make(map[string]string, len(lps))
+		for _, lp := range lps {
+			s.Labels[lp.GetName()] = lp.GetValue()
+		}
+	}
+	switch {
+	case mt.Counter != nil:
+		s.Value = mt.GetCounter().GetValue()
+	case mt.Gauge != nil:
+		s.Value = mt.GetGauge().GetValue()
+	case mt.Untyped != nil:
+		s.Value = mt.GetUntyped().GetValue()
+	case mt.Histogram != nil:
+		s.Value = mt.GetHistogram().GetSampleSum()
+		s.Count = mt.GetHistogram().GetSampleCount()
+	case mt.Summary != nil:
+		s.Value = mt.GetSummary().GetSampleSum()
+		s.Count = mt.GetSummary().GetSampleCount()
+	}
+	return s
+}
+
+type resolveResult struct {
+	Entry     string       `json:"entry"`
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Rcode     string       `json:"rcode,omitempty"`
+	Answer    []string     `json:"answer,omitempty"`
+	Authority []string     `json:"authority,omitempty"`
+	Upstream  string       `json:"upstream,omitempty"`
+	Elapsed   float64      `json:"elapsed_ms"`
+	Err       string       `json:"error,omitempty"`
+	Trace     []traceEvent `json:"trace,omitempty"`
+}
+
+// handleResolve resolves a name through an entry and returns the result
+// with the trace of plugins.
+// Query params: "name" (required), "type" (default A), "entry" (required
+// if there are multiple entries), "client" (default the api client).
+func (m *Mosdns) handleResolve(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	name := query.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	qType := dns.TypeA
+	if s := query.Get("type"); len(s) > 0 {
+		t, err := dnsutils.ParseQtype(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		qType = t
+	}
+	entry, ok := m.apiEntry(query.Get("entry"))
+	if !ok {
+		http.Error(w, "missing or unknown entry", http.StatusBadRequest)
+		return
+	}
+	client, ok := apiClient(req, query.Get("client"))
+	if !ok {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, m.logger, m.resolve(req.Context(), entry, client, name, qType, true))
+}
+
+const (
+	maxBatchQueries          = 10000
+	defaultBatchConcurrency  = 16
+	maxBatchConcurrency      = 256
+	maxBatchResolveBodyBytes = 4 << 20
+)
+
+type batchResolveRequest struct {
+	Entry  string `json:"entry"`
+	Client string `json:"client"`
+	// Concurrency limits the number of queries that are resolved at the
+	// same time. Default is defaultBatchConcurrency.
+	Concurrency int  `json:"concurrency"`
+	Trace       bool `json:"trace"`
+
+	Queries []struct {
+		Name string `json:"name"`
+		Type string `json:"type"` // default A
+	} `json:"queries"`
+}
+
+// handleBatchResolve resolves a list of names through an entry, see
+// batchResolveRequest, and returns their results in the same order.
+// A name that can't be resolved has an error in its result instead of
+// failing the request. For blocklist checks and cache warm-up scripts.
+func (m *Mosdns) handleBatchResolve(w http.ResponseWriter, req *http.Request) {
+	br := new(batchResolveRequest)
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBatchResolveBodyBytes)).Decode(br); err != nil {
+		http.Error(w, "invalid request body, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(br.Queries) > maxBatchQueries {
+		http.Error(w, fmt.Sprintf("too many queries, max is %d", maxBatchQueries), http.StatusBadRequest)
+		return
+	}
+	if br.Concurrency < 0 || br.Concurrency > maxBatchConcurrency {
+		http.Error(w, fmt.Sprintf("invalid concurrency, max is %d", maxBatchConcurrency), http.StatusBadRequest)
+		return
+	}
+	if br.Concurrency == 0 {
+		br.Concurrency = defaultBatchConcurrency
+	}
+	entry, ok := m.apiEntry(br.Entry)
+	if !ok {
+		http.Error(w, "missing or unknown entry", http.StatusBadRequest)
+		return
+	}
+	client, ok := apiClient(req, br.Client)
+	if !ok {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	results := make([]*resolveResult, len(br.Queries))
+	sem := make(chan struct{}, br.Concurrency)
+	wg := new(sync.WaitGroup)
+	for i, q := range br.Queries {
+		qType := dns.TypeA
+		var err error
+		if len(q.Type) > 0 {
+			qType, err = dnsutils.ParseQtype(q.Type)
+		}
+		_, validName := dns.IsDomainName(q.Name)
+		if err != nil || !validName || len(q.Name) == 0 {
+			results[i] = &resolveResult{Entry: entry, Name: q.Name, Type: q.Type, Err: "invalid name or type"}
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil { // the client is gone, stop dispatching
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = m.resolve(ctx, entry, client, q.Name, qType, br.Trace)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	writeJSON(w, m.logger, results)
+}
+
+// resolve resolves name through entry with a timeout of resolveTimeout.
+func (m *Mosdns) resolve(ctx context.Context, entry string, client netip.Addr, name string, qType uint16, trace bool) *resolveResult {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qType)
+	qCtx := query_context.NewContext(q, query_context.NewRequestMeta(client))
+	if trace {
+		qCtx.EnableTrace()
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	err := (&graphEntry{m: m, tag: entry}).Exec(ctx, qCtx, nil)
+
+	res := &resolveResult{
+		Entry:   entry,
+		Name:    q.Question[0].Name,
+		Type:    dns.TypeToString[qType],
+		Elapsed: toMs(time.Since(qCtx.StartTime())),
+	}
+	if trace {
+		res.Trace = newTraceEvents(qCtx)
+	}
+	res.Upstream, _ = query_context.GetValue(qCtx, bundled_upstream.KeyUpstream)
+	if err != nil {
+		res.Err = err.Error()
+	}
+	if r := qCtx.R(); r != nil {
+		res.Rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			res.Answer = append(res.Answer, rr.String())
+		}
+		for _, rr := range r.Ns {
+			res.Authority = append(res.Authority, rr.String())
+		}
+	}
+	return res
+}
+
+// apiEntry returns entry if it is a server entry. If entry is empty and
+// there is only one entry, it returns that one.
+func (m *Mosdns) apiEntry(entry string) (string, bool) {
+	if len(entry) == 0 && len(m.entries) == 1 {
+		for e := range m.entries {
+			entry = e
+		}
+	}
+	_, ok := m.entries[entry]
+	return entry, ok
+}
+
+// apiClient parses s as the client address of api queries. If s is
+// empty, it is the address of the api client.
+func apiClient(req *http.Request, s string) (netip.Addr, bool) {
+	if len(s) > 0 {
+		addr, err := netip.ParseAddr(s)
+		return addr, err == nil
+	}
+	var client netip.Addr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		client, _ = netip.ParseAddr(host)
+	}
+	return client, true
+}
+
+func writeJSON(w http.ResponseWriter, lg *zap.Logger, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		lg.Warn("failed to write api response", zap.Error(err))
+	}
+}
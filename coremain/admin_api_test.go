@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type execFunc func(ctx context.Context, qCtx *query_context.Context) error
+
+func (f execFunc) Exec(ctx context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	return f(ctx, qCtx)
+}
+
+func newTestAPIMosdns(entry execFunc) *Mosdns {
+	m := &Mosdns{logger: zap.NewNop(), entries: map[string]struct{}{"e": {}}}
+	g := newPluginGraph()
+	g.execs["e"] = entry
+	m.graph.Store(g)
+	return m
+}
+
+func Test_handleBatchResolve(t *testing.T) {
+	m := newTestAPIMosdns(func(ctx context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		qCtx.SetResponse(r)
+		return nil
+	})
+	body := `{"queries":[{"name":"a.test"},{"name":"b.test","type":"TYPE65"},{"name":"c.test","type":"28"},{"name":"d.test","type":"x"}]}`
+	w := httptest.NewRecorder()
+	m.handleBatchResolve(w, httptest.NewRequest(http.MethodPost, "/resolve", strings.NewReader(body)))
+	var rs []resolveResult
+	if err := json.NewDecoder(w.Body).Decode(&rs); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"A", "HTTPS", "AAAA", ""}
+	for i, r := range rs {
+		if i < 3 && (r.Type != want[i] || len(r.Err) > 0) {
+			t.Errorf("#%d: unexpected result %+v", i, r)
+		}
+	}
+	if len(rs) != 4 || len(rs[3].Err) == 0 {
+		t.Fatalf("invalid type should fail, %+v", rs)
+	}
+}
+
+func Test_handleBatchResolve_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls atomic.Int32
+	m := newTestAPIMosdns(func(context.Context, *query_context.Context) error {
+		calls.Add(1)
+		cancel() // the client leaves
+		return nil
+	})
+	body := `{"concurrency":1,"queries":[{"name":"a.test"},{"name":"b.test"},{"name":"c.test"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/resolve", strings.NewReader(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	m.handleBatchResolve(w, req)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("want 1 query, got %d", n)
+	}
+}
+
+func Test_apiAuth(t *testing.T) {
+	h := apiAuth(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), "secret")
+	tests := []struct {
+		name string
+		path string
+		set  func(req *http.Request)
+		want int
+	}{
+		{"no token", "/reload", func(*http.Request) {}, http.StatusUnauthorized},
+		{"bearer", "/reload", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"wrong bearer", "/reload", func(req *http.Request) { req.Header.Set("Authorization", "Bearer x") }, http.StatusUnauthorized},
+		{"basic", "/reload", func(req *http.Request) { req.SetBasicAuth("", "secret") }, http.StatusUnauthorized},
+		{"dashboard", "/dashboard/", func(*http.Request) {}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			tt.set(req)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("want %d, got %d", tt.want, w.Code)
+			}
+			if len(w.Header().Get("WWW-Authenticate")) > 0 {
+				t.Fatal("browsers should not be asked for basic auth")
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/safe_close"
+)
+
+func newCheckCmd() *cobra.Command {
+	var c, dir string
+	cmd := &cobra.Command{
+		Use:   "check [-c config_file] [-d working_dir]",
+		Short: "Check the config without starting servers.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(dir) > 0 {
+				if err := os.Chdir(dir); err != nil {
+					return fmt.Errorf("failed to change the current working directory, %w", err)
+				}
+			}
+			cfg, err := loadConfigWithInclude(c)
+			if err != nil {
+				return err
+			}
+			if err := CheckConfig(cfg); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "config is ok")
+			return nil
+		},
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	fs := cmd.Flags()
+	fs.StringVarP(&c, "config", "c", "", "config file")
+	fs.StringVarP(&dir, "dir", "d", "", "working dir")
+	return cmd
+}
+
+// CheckConfig loads data providers and plugins of cfg, then closes them.
+// No socket of servers is bound, and goroutines that plugins attach to
+// the SafeClose are not started. Some plugins, e.g. kubernetes, mqtt,
+// querylog and client_limiter, start goroutines in Init anyway. They are
+// stopped when the plugins are closed. It reports missing or circular references of plugin tags,
+// invalid args of plugins and missing entries of servers.
+func CheckConfig(cfg *Config) error {
+	pcs, err := expandPipelinePresets(cfg.Plugins)
+	if err != nil {
+		return err
+	}
+	if err := checkPluginRefs(pcs); err != nil {
+		return err
+	}
+
+	lg, err := mlog.NewLogger(&mlog.LogConfig{Level: "error"})
+	if err != nil {
+		return err
+	}
+	m := &Mosdns{
+		logger:     lg,
+		entries:    make(map[string]struct{}),
+		metricsReg: newMetricsReg(),
+		sc:         safe_close.NewSafeClose(),
+	}
+	g := newPluginGraph()
+	// Attach won't run anything on a closed SafeClose.
+	g.sc.SendCloseSignal(nil)
+	m.loading.Store(g)
+	defer g.close()
+	if err := m.initGraph(g, cfg); err != nil {
+		return err
+	}
+	m.loading.Store(nil)
+
+	if len(cfg.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	for i, sc := range cfg.Servers {
+		if err := checkServer(g, &sc); err != nil {
+			return fmt.Errorf("invalid server #%d, %w", i, err)
+		}
+	}
+	return nil
+}
+
+func checkServer(g *pluginGraph, cfg *ServerConfig) error {
+	if len(cfg.Listeners) == 0 {
+		return errors.New("no server listener is configured")
+	}
+	entries := []string{cfg.Exec}
+	for _, lc := range cfg.Listeners {
+		for _, c := range lc.SNI {
+			if len(c.Names) == 0 {
+				return errors.New("sni policy has no names")
+			}
+			if len(c.Exec) > 0 {
+				entries = append(entries, c.Exec)
+			}
+		}
+	}
+	for _, e := range entries {
+		if len(e) == 0 {
+			return errors.New("empty entry")
+		}
+		if g.execs[e] == nil {
+			return fmt.Errorf("cannot find entry %s", e)
+		}
+	}
+	return nil
+}
+
+// checkPluginRefs finds references of plugin tags in args of plugins,
+// and reports the first cycle. See refKeys for the args that are
+// references.
+func checkPluginRefs(pcs []PluginConfig) error {
+	tags := make(map[string]struct{})
+	for _, pc := range pcs {
+		if len(pc.Tag) > 0 {
+			tags[pc.Tag] = struct{}{}
+		}
+	}
+	refs := make(map[string][]string)
+	for _, pc := range pcs {
+		if len(pc.Tag) > 0 {
+			delete(tags, pc.Tag)
+			refs[pc.Tag] = collectRefs(pc.Args, tags, nil)
+			tags[pc.Tag] = struct{}{}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(tag string) error
+	visit = func(tag string) error {
+		switch state[tag] {
+		case visiting:
+			cycle := append(path[slices.Index(path, tag):], tag)
+			return fmt.Errorf("circular reference of plugins: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[tag] = visiting
+		path = append(path, tag)
+		for _, ref := range refs[tag] {
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[tag] = visited
+		return nil
+	}
+	for _, pc := range pcs {
+		if len(pc.Tag) > 0 {
+			if err := visit(pc.Tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refKeys are keys of args whose values refer to plugins. Values are
+// tags, exec trees of executable_seq or if expressions, so every word of
+// a string in them can be a tag.
+var refKeys = map[string]struct{}{
+	"exec":         {},
+	"else_exec":    {},
+	"if":           {},
+	"if_and":       {},
+	"primary":      {},
+	"secondary":    {},
+	"parallel":     {},
+	"load_balance": {},
+	"reroute":      {}, // ip_router
+	"default":      {}, // qtype_router
+	"when_hit":     {}, // cache
+	"sources":      {}, // client_names, local_ptr
+	"dnstap":       {}, // fast_forward
+}
+
+// refPrefixKeys are keys of args whose values refer to plugins only if
+// they have the prefix.
+var refPrefixKeys = map[string]string{
+	"clients": "tag:", // client_profile
+}
+
+// collectRefs appends tags in v that are referred by refKeys or
+// refPrefixKeys to refs. Strings under other keys are not references,
+// even if they are equal to a tag.
+func collectRefs(v any, tags map[string]struct{}, refs []string) []string {
+	return collectRefsOf(v, tags, refs, false, "")
+}
+
+// If isRef, strings in v are references if they have the prefix.
+func collectRefsOf(v any, tags map[string]struct{}, refs []string, isRef bool, prefix string) []string {
+	switch v := v.(type) {
+	case string:
+		if !isRef || !strings.HasPrefix(v, prefix) {
+			return refs
+		}
+		words := strings.FieldsFunc(v[len(prefix):], func(r rune) bool {
+			return strings.ContainsRune(" \t\n!&|()", r)
+		})
+		for _, w := range words {
+			if _, ok := tags[w]; ok && !slices.Contains(refs, w) {
+				refs = append(refs, w)
+			}
+		}
+	case []any:
+		for _, e := range v {
+			refs = collectRefsOf(e, tags, refs, isRef, prefix)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			ref, pfx := isRef, prefix
+			if _, ok := refKeys[k]; ok {
+				ref, pfx = true, ""
+			} else if p, ok := refPrefixKeys[k]; ok {
+				ref, pfx = true, p
+			}
+			refs = collectRefsOf(v[k], tags, refs, ref, pfx)
+		}
+	}
+	return refs
+}
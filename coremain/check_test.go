@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func Test_collectRefs(t *testing.T) {
+	tags := map[string]struct{}{"forward": {}, "cache": {}, "is_ads": {}, "google": {}, "tap": {}}
+	tests := []struct {
+		name string
+		args string
+		want []string
+	}{
+		{"sequence", "exec: [cache, {if: '!is_ads && google', exec: forward, else_exec: [cache]}]", []string{"cache", "forward", "is_ads", "google"}},
+		{"fallback", "exec: [{primary: forward, secondary: [cache], threshold: 500}]", []string{"forward", "cache"}},
+		{"direct fields", "{when_hit: cache, dnstap: tap, sources: [forward]}", []string{"tap", "forward", "cache"}},
+		{"nested exec", "routes: [{qtype: [A], exec: forward}]", []string{"forward"}},
+		{"prefixed clients", "profiles: [{clients: ['tag:is_ads', google, 'mac:aa'], block: [google]}]", []string{"is_ads"}},
+		{"not a ref field", "{upstream: [{addr: google}], domain: [forward], file: cache}", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args any
+			if err := yaml.Unmarshal([]byte(tt.args), &args); err != nil {
+				t.Fatal(err)
+			}
+			if got := collectRefs(args, tags, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkPluginRefs(t *testing.T) {
+	parse := func(s string) []PluginConfig {
+		var pcs []PluginConfig
+		if err := yaml.Unmarshal([]byte(s), &pcs); err != nil {
+			t.Fatal(err)
+		}
+		return pcs
+	}
+	ok := parse(`
+- {tag: google, type: domain_set, args: {exps: [forward]}}
+- {tag: forward, type: fast_forward, args: {upstream: [{addr: google}]}}
+- {tag: main, type: sequence, args: {exec: [{if: google, exec: forward}]}}
+`)
+	if err := checkPluginRefs(ok); err != nil {
+		t.Fatalf("names equal to tags outside ref fields are not refs, %v", err)
+	}
+	cycle := parse(`
+- {tag: a, type: sequence, args: {exec: [b]}}
+- {tag: b, type: sequence, args: {exec: [{if: c, exec: a}]}}
+- {tag: c, type: domain_set}
+`)
+	err := checkPluginRefs(cycle)
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+)
+
+func (m *Mosdns) initCluster(cfg *ClusterConfig, api *APIConfig) error {
+	if len(cfg.Peers) == 0 {
+		return nil
+	}
+	if len(api.HTTP) == 0 {
+		return errors.New("cluster requires the http api")
+	}
+	name := cfg.NodeName
+	if len(name) == 0 {
+		name, _ = os.Hostname()
+	}
+	c, err := cluster.New(cluster.Opts{
+		NodeName:      name,
+		Peers:         cfg.Peers,
+		Secret:        cfg.Secret,
+		FlushInterval: time.Duration(cfg.FlushInterval) * time.Millisecond,
+		Logger:        m.logger.Named("cluster"),
+	})
+	if err != nil {
+		return err
+	}
+	m.cluster = c
+	m.httpAPIMux.Handle("/cluster/", c)
+	return nil
+}
+
+// GetCluster returns the cluster, or an error if cluster is not configured.
+// Plugins should register their channels during initialization.
+func (m *Mosdns) GetCluster() (*cluster.Cluster, error) {
+	if m.cluster == nil {
+		return nil, fmt.Errorf("cluster is not configured")
+	}
+	return m.cluster, nil
+}
@@ -27,14 +27,26 @@ import (
 
 type Config struct {
 	Log           mlog.LogConfig                     `yaml:"log"`
-	Include       []string                           `yaml:"include"`
+	Include       []string                           `yaml:"include"` // files, kv urls, glob patterns or dirs of yaml files
 	DataProviders []data_provider.DataProviderConfig `yaml:"data_providers"`
 	Plugins       []PluginConfig                     `yaml:"plugins"`
 	Servers       []ServerConfig                     `yaml:"servers"`
 	API           APIConfig                          `yaml:"api"`
+	Memory        MemoryConfig                       `yaml:"memory"`
+	Tailscale     TailscaleConfig                    `yaml:"tailscale"`
+	Cluster       ClusterConfig                      `yaml:"cluster"`
+	Maintenance   MaintenanceConfig                  `yaml:"maintenance"`
 
 	// Experimental
 	Security SecurityConfig `yaml:"security"`
+
+	kvIncludes []kvInclude // set by mergeInclude
+}
+
+// kvInclude is an included kv key and its modify index when it was read.
+type kvInclude struct {
+	url   string
+	index uint64
 }
 
 // PluginConfig represents a plugin config
@@ -55,6 +67,44 @@ type ServerConfig struct {
 	Exec      string                  `yaml:"exec"`
 	Timeout   uint                    `yaml:"timeout"` // (sec) query timeout.
 	Listeners []*ServerListenerConfig `yaml:"listeners"`
+	Trace     TraceConfig             `yaml:"trace"`
+	Malformed MalformedConfig         `yaml:"malformed"`
+
+	// OnCancel is what happens to a query when its client goes away,
+	// e.g. a tcp/dot/doh connection is closed before the response is sent.
+	// "abort" (default) stops the query. "complete" keeps it running until
+	// the timeout, so its response is still cached and retransmit storms
+	// warm the cache instead of wasting upstream queries. Udp queries are
+	// never canceled.
+	OnCancel string `yaml:"on_cancel"`
+}
+
+// MalformedConfig handles malformed queries, which can't be unpacked,
+// have no or multiple questions, invalid names or an opcode other than
+// QUERY. By default, queries without questions or with invalid names get
+// FORMERR, queries that can't be unpacked are dropped (udp) or close the
+// connection (tcp, dot), others are passed to the entry.
+type MalformedConfig struct {
+	// Action can be "formerr", "drop", "refused", "notimp" or "forward".
+	Action string `yaml:"action"`
+	// Upstream is the "host:port" of an udp upstream that receives
+	// malformed queries as is, for "forward".
+	Upstream string `yaml:"upstream"`
+}
+
+// TraceConfig appends the execution trace (plugins, conditions and
+// upstreams) of queries to their responses as a TXT record of
+// "trace.mosdns." in the additional section. For debugging.
+type TraceConfig struct {
+	// All traces all queries.
+	All bool `yaml:"all"`
+	// Clients can request traces by the EDNS0 option 65010,
+	// e.g. "dig +ednsopt=65010 example.com". IP, CIDR or "provider:".
+	// Loopback clients can always request traces. Note that clients of
+	// a reverse proxy or a port forwarder on the same host are loopback
+	// clients, unless it passes their addresses on, e.g. by client ip
+	// headers or proxy_protocol.
+	Clients []string `yaml:"clients"`
 }
 
 type ServerListenerConfig struct {
@@ -68,27 +118,138 @@ type ServerListenerConfig struct {
 	// "doh3", "h3" -> dns over http3 (rfc 9114 && rfc 8844)
 	Protocol string `yaml:"protocol"`
 
+	// Tag names the listener for matchers, see query_matcher's listener.
+	Tag string `yaml:"tag"`
+
 	// Addr: server "host:port" addr.
 	// When uds enabled must be "path"
+	// "fd://3" listens on the inherited socket fd 3, and "fd://name" on
+	// the socket named name by systemd socket activation (LISTEN_FDNAMES).
 	// Addr cannot be empty.
 	Addr string `yaml:"addr"`
 
 	// UnixDomainSocket: server addr is uds.
 	UnixDomainSocket bool `yaml:"uds"`
 
-	Cert                string `yaml:"cert"`                    // certificate path, used by dot, doh, doq
-	Key                 string `yaml:"key"`                     // certificate key path, used by dot, doh, doq
-	KernelTX            bool   `yaml:"kernel_tx"`               // use kernel tls to send data
-	KernelRX            bool   `yaml:"kernel_rx"`               // use kernel tls to receive data
-	URLPath             string `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled.
-	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http, except "True-Client-IP" "X-Real-IP" "X-Forwarded-For".
-	ProxyProtocol       bool   `yaml:"proxy_protocol"`          // accepting the PROXYProtocol
+	// Tailscale: listen on the tailnet instead of the host network.
+	// Host of Addr can be omitted.
+	Tailscale bool `yaml:"tailscale"`
+
+	Cert                string   `yaml:"cert"`                    // certificate path, used by dot, doh, doq
+	Key                 string   `yaml:"key"`                     // certificate key path, used by dot, doh, doq
+	KernelTX            bool     `yaml:"kernel_tx"`               // use kernel tls to send data
+	KernelRX            bool     `yaml:"kernel_rx"`               // use kernel tls to receive data
+	ClientCA            []string `yaml:"client_ca"`               // used by dot, doh, doq. CA files to verify client certificates.
+	RequireClientCert   bool     `yaml:"require_client_cert"`     // used by dot, doh, doq. Reject clients without a valid certificate.
+	URLPath             string   `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled.
+	JSONPath            string   `yaml:"json_path"`               // used by doh, http. Path of the json api (application/dns-json), e.g. "/resolve".
+	GetUserIPFromHeader string   `yaml:"get_user_ip_from_header"` // used by doh, http, except "True-Client-IP" "X-Real-IP" "X-Forwarded-For".
+	ProxyProtocol       bool     `yaml:"proxy_protocol"`          // accepting the PROXYProtocol
+
+	// ACME obtains and renews the certificate of dot, doh, doq, doh3
+	// listeners automatically. Cert and Key are not used if it is set.
+	ACME *ACMEConfig `yaml:"acme"`
+
+	// TrustedProxies are ips/cidrs of reverse proxies and load balancers.
+	// If set, client ip headers of doh, http listeners and proxy protocol
+	// headers from other peers are not accepted.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 
 	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh as connection idle timeout.
+
+	// SNI serves server names with their own certificates and entries.
+	// Names are matched against the SNI, or the Host header of doh
+	// requests without SNI. Used by dot, doh, http, doq, doh3.
+	SNI []*SNIConfig `yaml:"sni"`
+}
+
+// ACMEConfig obtains certificates from an ACME CA, e.g. Let's Encrypt.
+// Challenges are solved by tls-alpn-01 on dot/doh listeners on port 443,
+// by http-01 if HTTPAddr is set, or by dns-01 if DNSHook is set.
+type ACMEConfig struct {
+	Domains  []string `yaml:"domains"`   // Names of the certificate. Required.
+	Email    string   `yaml:"email"`     // Contact email of the account, optional.
+	Dir      string   `yaml:"dir"`       // Where accounts and certificates are stored. Default is "acme".
+	CA       string   `yaml:"ca"`        // Directory url of the CA. Default is Let's Encrypt.
+	HTTPAddr string   `yaml:"http_addr"` // Address to solve http-01 challenges, e.g. ":80".
+
+	// DNSHook is a command that solves dns-01 challenges. It is run as
+	// "<dns_hook> present <fqdn> <value>" and should return once the TXT
+	// record is visible, and as "<dns_hook> cleanup <fqdn> <value>" after
+	// the challenge. Domains can have wildcards if it is set.
+	DNSHook string `yaml:"dns_hook"`
+}
+
+// SNIConfig is the policy of a group of server names.
+type SNIConfig struct {
+	Names []string `yaml:"names"` // e.g. "family.example.com", "*.example.com"
+	Cert  string   `yaml:"cert"`  // Default is the cert of the listener.
+	Key   string   `yaml:"key"`
+	Exec  string   `yaml:"exec"` // Default is the exec of the server.
 }
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+	// Token is required by all api requests if it is set, as a bearer
+	// token. The dashboard asks for it. The cluster api has its own
+	// secret and is not affected.
+	Token string `yaml:"token"`
+	// Dashboard enables the embedded web dashboard at "/dashboard/".
+	Dashboard bool `yaml:"dashboard"`
+}
+
+// ClusterConfig configures the state replication between instances.
+// It requires the http api. Plugins that support it have a "cluster" arg.
+type ClusterConfig struct {
+	NodeName      string   `yaml:"node_name"`      // Default is the hostname.
+	Peers         []string `yaml:"peers"`          // Api urls of other nodes, e.g. "http://192.168.1.2:8080".
+	Secret        string   `yaml:"secret"`         // Required, shared by all nodes.
+	FlushInterval int      `yaml:"flush_interval"` // (ms) Default is 1000.
+}
+
+// TailscaleConfig configures the in-process tailnet node. It is started
+// when a listener or a plugin uses it. The node is only compiled in with
+// the build tag "tailscale", it adds ~40MB to the binary.
+type TailscaleConfig struct {
+	Hostname   string `yaml:"hostname"`    // Default is "mosdns".
+	AuthKey    string `yaml:"auth_key"`    // Default is $TS_AUTHKEY.
+	StateDir   string `yaml:"state_dir"`   // Default is a dir in the user config dir.
+	ControlURL string `yaml:"control_url"` // Default is the tailscale coordination server.
+	Ephemeral  bool   `yaml:"ephemeral"`
+}
+
+type MemoryConfig struct {
+	// Budget is the total memory that mosdns is allowed to use, e.g. "128M".
+	// Empty Budget disables the memory management.
+	Budget string `yaml:"budget"`
+	// GCPercent overwrites the GOGC value derived from Budget.
+	GCPercent int `yaml:"gc_percent"`
+	// ShrinkThreshold is the percentage of Budget that triggers cache shrinking.
+	// Default is 90.
+	ShrinkThreshold int `yaml:"shrink_threshold"`
+	CheckInterval   int `yaml:"check_interval"` // (sec) Default is 5.
+}
+
+func (c *MemoryConfig) Init() {
+	utils.SetDefaultNum(&c.ShrinkThreshold, 90)
+	utils.SetDefaultNum(&c.CheckInterval, 5)
+}
+
+// MaintenanceConfig schedules the maintenance of plugins that implement
+// Maintainer, e.g. compacting fake_ip persist files.
+type MaintenanceConfig struct {
+	// Start and End are "hh:mm" in local time, the quiet hours when the
+	// maintenance runs. If End is earlier than Start, the window ends on
+	// the next day. Plugins that are not started before End are skipped.
+	// Empty Start disables the maintenance. Empty End means no deadline.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Days are the days when the maintenance runs, e.g. "mon", "tue".
+	// Empty means every day.
+	Days []string `yaml:"days"`
+	// Plugins are tags of plugins to maintain, in order. Default is all
+	// plugins that implement Maintainer, ordered by tag.
+	Plugins []string `yaml:"plugins"`
 }
 
 type SecurityConfig struct {
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// dashboardHandler serves the embedded web dashboard. The dashboard
+// is a static page that only uses the http api.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err) // embedded dir always exists
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(sub)))
+}
+
+type pluginInfo struct {
+	Tag  string `json:"tag"`
+	Type string `json:"type"`
+	// API is true if the plugin has an api at "/plugins/<tag>/".
+	API bool `json:"api"`
+}
+
+func (m *Mosdns) handlePluginList(w http.ResponseWriter, _ *http.Request) {
+	plugins := m.graph.Load().plugins
+	ps := make([]pluginInfo, 0, len(plugins))
+	for tag, p := range plugins {
+		_, isHandler := p.(http.Handler)
+		ps = append(ps, pluginInfo{Tag: tag, Type: p.Type(), API: isHandler && !isPreset(p)})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Tag < ps[j].Tag })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ps); err != nil {
+		m.logger.Warn("failed to write plugin list", zap.Error(err))
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+)
+
+type entriesRequest struct {
+	Entries []string `json:"entries"`
+	TTL     int      `json:"ttl"` // (sec) Only for adding. Zero means never expire.
+	Persist bool     `json:"persist"`
+}
+
+// handleDataEntries manages runtime entries of the data provider {tag}.
+//
+//	GET    lists runtime entries.
+//	POST   adds entries. Body: {"entries": [...], "ttl": 0, "persist": false}
+//	DELETE removes entries. Body: {"entries": [...], "persist": false}
+//
+// Bodies must be sent as application/json, and persist requires a bearer
+// token. Browsers send neither cross-site without a CORS preflight, so a
+// web page can't change the rules.
+func (m *Mosdns) handleDataEntries(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	dp := m.graph.Load().dataManager.GetDataProvider(tag)
+	if dp == nil {
+		http.Error(w, "data provider not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dp.GetRuntimeEntries()); err != nil {
+			m.logger.Warn("failed to write runtime entries", zap.Error(err))
+		}
+		return
+	}
+
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	req := new(entriesRequest)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req); err != nil {
+		http.Error(w, "invalid request body, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.TTL < 0 {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+	if req.Persist && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		http.Error(w, "persist requires a bearer token", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = dp.AddEntries(req.Entries, time.Duration(req.TTL)*time.Second, req.Persist)
+	case http.MethodDelete:
+		err = dp.RemoveEntries(req.Entries, req.Persist)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, data_provider.ErrPersistNotSupported) {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	m.logger.Info(
+		"data provider entries updated",
+		zap.String("tag", tag),
+		zap.String("method", r.Method),
+		zap.Strings("entries", req.Entries),
+		zap.Bool("persist", req.Persist),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type dataProviderInfo struct {
+	File      string `json:"file"`
+	DataSize  int64  `json:"data_size"`
+	Listeners int    `json:"listeners"`
+	data_provider.Stats
+}
+
+// handleDataProviderList reports rule counts, digests and load times of
+// all data providers.
+func (m *Mosdns) handleDataProviderList(w http.ResponseWriter, _ *http.Request) {
+	ps := make(map[string]dataProviderInfo)
+	for tag, dp := range m.graph.Load().dataManager.GetDataProviders() {
+		ps[tag] = dataProviderInfo{
+			File:      dp.File(),
+			DataSize:  dp.DataSize(),
+			Listeners: dp.ListenerNum(),
+			Stats:     dp.Stats(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ps); err != nil {
+		m.logger.Warn("failed to write data provider list", zap.Error(err))
+	}
+}
+
+// handleDataExport exports entries of the data provider {tag} as plain
+// text. The optional query parameter "filter" keeps entries that contain it.
+func (m *Mosdns) handleDataExport(w http.ResponseWriter, r *http.Request) {
+	dp := m.graph.Load().dataManager.GetDataProvider(r.PathValue("tag"))
+	if dp == nil {
+		http.Error(w, "data provider not found", http.StatusNotFound)
+		return
+	}
+	b := new(bytes.Buffer)
+	if err := dp.Export(b, r.URL.Query().Get("filter")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Loaded-Digest", dp.Stats().Digest)
+	w.Write(b.Bytes())
+}
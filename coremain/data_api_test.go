@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+)
+
+func Test_handleDataEntries_csrf(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(file, []byte("domain:a.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := data_provider.NewDataProvider(zap.NewNop(), data_provider.DataProviderConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	m := newTestAPIMosdns(nil)
+	m.graph.Load().dataManager.AddDataProvider("rules", dp)
+
+	tests := []struct {
+		name   string
+		ct     string
+		bearer bool
+		body   string
+		want   int
+	}{
+		{"form post", "text/plain", false, `{"entries":["domain:b.test"]}`, http.StatusUnsupportedMediaType},
+		{"persist without bearer", "application/json", false, `{"entries":["domain:b.test"],"persist":true}`, http.StatusForbidden},
+		{"runtime", "application/json; charset=utf-8", false, `{"entries":["domain:b.test"]}`, http.StatusNoContent},
+		{"persist", "application/json", true, `{"entries":["domain:c.test"],"persist":true}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/data_providers/rules/entries", strings.NewReader(tt.body))
+			req.SetPathValue("tag", "rules")
+			req.Header.Set("Content-Type", tt.ct)
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			w := httptest.NewRecorder()
+			m.handleDataEntries(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("want %d, got %d %s", tt.want, w.Code, w.Body)
+			}
+		})
+	}
+}
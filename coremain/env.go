@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv expands "${NAME}" and "${NAME:-default}" in s with the
+// environment variable NAME, and "${file:path}" with the content of the
+// file, e.g. a container secret, without trailing newlines. "$${" is an
+// escaped "${".
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	b := new(strings.Builder)
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' { // escaped
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed ${ in %q", s)
+		}
+		b.WriteString(s[:i])
+		v, err := lookupRef(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		s = s[i+end+1:]
+	}
+}
+
+func lookupRef(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s, %w", path, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	name, def, hasDef := strings.Cut(ref, ":-")
+	if v, ok := os.LookupEnv(name); ok && (len(v) > 0 || !hasDef) {
+		return v, nil
+	}
+	if !hasDef {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return def, nil
+}
+
+// expandEnvValues expands strings in v, which is a value decoded from
+// the config, see expandEnv.
+func expandEnvValues(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v)
+	case map[string]any:
+		for k, e := range v {
+			ne, err := expandEnvValues(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			v[k] = ne
+		}
+	case []any:
+		for i, e := range v {
+			ne, err := expandEnvValues(e)
+			if err != nil {
+				return nil, fmt.Errorf("#%d: %w", i, err)
+			}
+			v[i] = ne
+		}
+	}
+	return v, nil
+}
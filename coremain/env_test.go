@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func Test_expandEnv(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_SET", "v")
+	t.Setenv("MOSDNS_TEST_EMPTY", "")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "plain", want: "plain"},
+		{s: "${MOSDNS_TEST_SET}", want: "v"},
+		{s: "a-${MOSDNS_TEST_SET}-${MOSDNS_TEST_SET}-b", want: "a-v-v-b"},
+		{s: "${MOSDNS_TEST_UNSET:-def}", want: "def"},
+		{s: "${MOSDNS_TEST_EMPTY:-def}", want: "def"},
+		{s: "${MOSDNS_TEST_EMPTY}", want: ""},
+		{s: "${MOSDNS_TEST_UNSET}", wantErr: true},
+		{s: "$${MOSDNS_TEST_SET}", want: "${MOSDNS_TEST_SET}"},
+		{s: "a$${x}${MOSDNS_TEST_SET}", want: "a${x}v"},
+		{s: "${MOSDNS_TEST_SET", wantErr: true},
+		{s: "${file:" + secret + "}", want: "s3cret"},
+		{s: "${file:/nonexistent/mosdns}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandEnv(%q) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_expandEnvValues(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_SET", "v")
+	v := map[string]any{"a": []any{"${MOSDNS_TEST_SET}", 1}, "b": map[string]any{"c": "x${MOSDNS_TEST_SET}"}}
+	got, err := expandEnvValues(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := got.(map[string]any)
+	if m["a"].([]any)[0] != "v" || m["a"].([]any)[1] != 1 || m["b"].(map[string]any)["c"] != "xv" {
+		t.Fatalf("unexpected result %v", got)
+	}
+	if _, err := expandEnvValues(map[string]any{"a": []any{"${MOSDNS_TEST_UNSET}"}}); err == nil || err.Error() != "a: #0: environment variable MOSDNS_TEST_UNSET is not set" {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
+
+func Test_decodeConfig_remote(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_SET", "v")
+	for _, remote := range []bool{false, true} {
+		v := viper.New()
+		v.Set("api", map[string]any{"token": "${MOSDNS_TEST_SET}"})
+		cfg, err := decodeConfig(v, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "v"
+		if remote { // remote configs can't read env vars
+			want = "${MOSDNS_TEST_SET}"
+		}
+		if cfg.API.Token != want {
+			t.Fatalf("remote %v: want %q, got %q", remote, want, cfg.API.Token)
+		}
+	}
+}
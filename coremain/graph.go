@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/safe_close"
+)
+
+// drainTimeout limits how long a replaced graph waits for its in-flight
+// queries before its plugins are closed.
+const drainTimeout = time.Second * 10
+
+// pluginGraph is the data providers and plugins loaded from a config.
+// Servers run queries on the latest graph. A reload loads a new graph,
+// then closes the old one once its in-flight queries are finished.
+type pluginGraph struct {
+	dataManager *data_provider.DataManager
+	plugins     map[string]Plugin
+	execs       map[string]executable_seq.Executable
+	matchers    map[string]executable_seq.Matcher
+	metricsReg  *prometheus.Registry
+	sc          *safe_close.SafeClose // for goroutines of plugins
+
+	// traceClientsMu protects traceClients, the client matchers of
+	// server trace configs. They are loaded from the data providers of
+	// this graph when they are first used.
+	traceClientsMu sync.Mutex
+	traceClients   map[*TraceConfig]*netlist.MatcherGroup
+
+	inflight atomic.Int64
+	closed   atomic.Bool
+}
+
+func newPluginGraph() *pluginGraph {
+	return &pluginGraph{
+		dataManager: data_provider.NewDataManager(),
+		plugins:     make(map[string]Plugin),
+		execs:       make(map[string]executable_seq.Executable),
+		matchers:    make(map[string]executable_seq.Matcher),
+		metricsReg:  prometheus.NewRegistry(),
+		sc:          safe_close.NewSafeClose(),
+	}
+}
+
+func (g *pluginGraph) addPlugin(p Plugin) {
+	t := p.Tag()
+	g.plugins[t] = p
+	if p, ok := p.(ExecutablePlugin); ok {
+		g.execs[t] = p
+	}
+	if p, ok := p.(MatcherPlugin); ok {
+		g.matchers[t] = p
+	}
+}
+
+func (g *pluginGraph) loadTraceClients(cfg *TraceConfig) (*netlist.MatcherGroup, error) {
+	g.traceClientsMu.Lock()
+	defer g.traceClientsMu.Unlock()
+	if mg := g.traceClients[cfg]; mg != nil {
+		return mg, nil
+	}
+	mg, err := netlist.BatchLoadProvider(cfg.Clients, g.dataManager)
+	if err != nil {
+		return nil, err
+	}
+	if g.traceClients == nil {
+		g.traceClients = make(map[*TraceConfig]*netlist.MatcherGroup)
+	}
+	g.traceClients[cfg] = mg
+	return mg, nil
+}
+
+func (g *pluginGraph) release() {
+	g.inflight.Add(-1)
+}
+
+// close waits for in-flight queries of g for up to drainTimeout, then
+// stops goroutines of plugins and closes plugins and data providers.
+func (g *pluginGraph) close() {
+	g.closed.Store(true)
+	deadline := time.Now().Add(drainTimeout)
+	for g.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	g.sc.Done()
+	g.sc.CloseWait()
+	for _, p := range g.plugins {
+		_ = p.Close()
+	}
+	for _, dp := range g.dataManager.GetDataProviders() {
+		dp.Close()
+	}
+}
+
+// loadGraph loads data providers and plugins of cfg.
+func (m *Mosdns) loadGraph(cfg *Config) (*pluginGraph, error) {
+	g := newPluginGraph()
+	m.loading.Store(g)
+	defer m.loading.Store(nil)
+
+	if err := m.initGraph(g, cfg); err != nil {
+		g.close()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (m *Mosdns) initGraph(g *pluginGraph, cfg *Config) error {
+	// Init data manager
+	dupTag := make(map[string]struct{})
+	for _, dpc := range cfg.DataProviders {
+		if len(dpc.Tag) == 0 {
+			continue
+		}
+		if _, ok := dupTag[dpc.Tag]; ok {
+			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
+		}
+		dupTag[dpc.Tag] = struct{}{}
+
+		dp, err := data_provider.NewDataProvider(m.logger, dpc)
+		if err != nil {
+			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
+		}
+		g.dataManager.AddDataProvider(dpc.Tag, dp)
+	}
+
+	// Init preset plugins
+	for tag, f := range LoadNewPersetPluginFuncs() {
+		p, err := f(newPresetBP(tag, m.logger, m))
+		if err != nil {
+			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
+		}
+		g.addPlugin(p)
+	}
+
+	// Init plugins
+	pcs, err := expandPipelinePresets(cfg.Plugins)
+	if err != nil {
+		return err
+	}
+	dupTag = make(map[string]struct{})
+	for i, pc := range pcs {
+		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
+			continue
+		}
+		if _, dup := dupTag[pc.Tag]; dup {
+			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
+		}
+		dupTag[pc.Tag] = struct{}{}
+
+		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
+		p, err := NewPlugin(&pc, m.logger, m)
+		if err != nil {
+			return fmt.Errorf("failed to init plugin #%d, %w", i, err)
+		}
+		g.addPlugin(p)
+	}
+	return nil
+}
+
+// serveGraph makes g the latest graph and returns the replaced one,
+// which maybe nil.
+func (m *Mosdns) serveGraph(g *pluginGraph) *pluginGraph {
+	old := m.graph.Swap(g)
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		select {
+		case <-g.sc.ReceiveCloseSignal():
+			// A fatal error of a plugin, unless g is replaced.
+			if err := g.sc.Err(); err != nil && !g.closed.Load() {
+				m.sc.SendCloseSignal(err)
+			}
+		case <-closeSignal:
+			g.sc.Done()
+			g.sc.CloseWait()
+		}
+	})
+	return old
+}
+
+// loadingGraph returns the graph being loaded, or the latest graph.
+func (m *Mosdns) loadingGraph() *pluginGraph {
+	if g := m.loading.Load(); g != nil {
+		return g
+	}
+	if g := m.graph.Load(); g != nil {
+		return g
+	}
+	return newPluginGraph() // zero Mosdns in tests
+}
+
+// acquireGraph returns the latest graph. It won't be closed until it
+// is released.
+func (m *Mosdns) acquireGraph() *pluginGraph {
+	for {
+		g := m.graph.Load()
+		g.inflight.Add(1)
+		if !g.closed.Load() {
+			return g
+		}
+		g.release() // replaced, load again
+	}
+}
+
+// graphEntry runs the entry of the latest graph, so servers follow
+// reloads.
+type graphEntry struct {
+	m   *Mosdns
+	tag string
+}
+
+func (e *graphEntry) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	g := e.m.acquireGraph()
+	defer g.release()
+	entry := g.execs[e.tag]
+	if entry == nil {
+		return fmt.Errorf("cannot find entry %s", e.tag)
+	}
+	return entry.Exec(ctx, qCtx, next)
+}
+
+// handlePluginAPI serves "/plugins/{tag}/" by the plugin of the latest
+// graph if it implements http.Handler.
+func (m *Mosdns) handlePluginAPI(w http.ResponseWriter, req *http.Request) {
+	g := m.acquireGraph()
+	defer g.release()
+	p := g.plugins[req.PathValue("tag")]
+	h, ok := p.(http.Handler)
+	if !ok || isPreset(p) {
+		http.NotFound(w, req)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// handleMetrics serves metrics of mosdns and plugins of the latest graph.
+func (m *Mosdns) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	gs := prometheus.Gatherers{m.metricsReg, m.graph.Load().metricsReg}
+	promhttp.HandlerFor(gs, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
@@ -20,6 +20,7 @@
 package coremain
 
 import (
+	"context"
 	"io"
 
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
@@ -43,3 +44,30 @@ type MatcherPlugin interface {
 	Plugin
 	executable_seq.Matcher
 }
+
+// MemoryReporter is an optional interface that a Plugin can implement
+// to report its approximate memory usage in bytes.
+type MemoryReporter interface {
+	MemoryUsage() int64
+}
+
+// MemoryShrinker is an optional interface that a Plugin can implement
+// to release memory (e.g. drop cached entries) when mosdns is
+// running out of its memory budget.
+type MemoryShrinker interface {
+	ShrinkMemory()
+}
+
+// Flusher is an optional interface that a Plugin can implement to
+// drop all cached responses. It is called by the "/cache/flush" api.
+type Flusher interface {
+	Flush() error
+}
+
+// Maintainer is an optional interface that a Plugin can implement to
+// keep its persistent state healthy over long runs, e.g. compact files
+// and drop stale records. Maintain is called at the quiet hours of
+// MaintenanceConfig and should return early if ctx is done.
+type Maintainer interface {
+	Maintain(ctx context.Context) error
+}
@@ -0,0 +1,119 @@
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first fd passed by systemd socket activation.
+const listenFdsStart = 3
+
+// inheritedFiles keeps files of inherited fds. Servers are started
+// again on reloads with the same fds, so the originals are never closed.
+// Listeners and conns use dups of them.
+var inheritedFiles struct {
+	sync.Mutex
+	m map[int]*os.File
+}
+
+// inheritedFile returns the file of an inherited socket. s is a fd
+// number, or a name in LISTEN_FDNAMES of systemd socket activation.
+func inheritedFile(s string) (*os.File, error) {
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		if fd, err = systemdFd(s); err != nil {
+			return nil, err
+		}
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid fd %d", fd)
+	}
+
+	inheritedFiles.Lock()
+	defer inheritedFiles.Unlock()
+	f, ok := inheritedFiles.m[fd]
+	if !ok {
+		if inheritedFiles.m == nil {
+			inheritedFiles.m = make(map[int]*os.File)
+		}
+		f = os.NewFile(uintptr(fd), "fd://"+s)
+		inheritedFiles.m[fd] = f
+	}
+	return f, nil
+}
+
+// systemdFd returns the fd of name that is passed by systemd.
+func systemdFd(name string) (int, error) {
+	fds, ok := systemdFds()
+	if !ok {
+		return 0, fmt.Errorf("no socket is passed by systemd")
+	}
+	fd, ok := fds[name]
+	if !ok {
+		return 0, fmt.Errorf("socket %s is not passed by systemd", name)
+	}
+	return fd, nil
+}
+
+var systemdEnv struct {
+	once sync.Once
+	ok   bool
+	fds  map[string]int
+}
+
+// systemdFds returns the named fds passed by systemd. The LISTEN_*
+// env vars are read once and then unset, so child processes don't take
+// the sockets as their own. Servers are started again on reloads, so
+// the result is kept.
+func systemdFds() (map[string]int, bool) {
+	e := &systemdEnv
+	e.once.Do(func() {
+		e.fds, e.ok = parseSystemdEnv(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return e.fds, e.ok
+}
+
+// parseSystemdEnv returns the fds of names from the values of LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES. ok is false if the sockets are not
+// passed to this process.
+func parseSystemdEnv(pid, n, names string) (fds map[string]int, ok bool) {
+	if p, _ := strconv.Atoi(pid); p != os.Getpid() {
+		return nil, false
+	}
+	num, _ := strconv.Atoi(n)
+	fds = make(map[string]int)
+	for i, name := range strings.Split(names, ":") {
+		if _, dup := fds[name]; !dup && i < num {
+			fds[name] = listenFdsStart + i
+		}
+	}
+	return fds, true
+}
+
+// InheritedListener returns the listener of an inherited stream socket.
+// See inheritedFile for s. Closing the listener doesn't close the
+// inherited fd.
+func InheritedListener(s string) (net.Listener, error) {
+	f, err := inheritedFile(s)
+	if err != nil {
+		return nil, err
+	}
+	return net.FileListener(f) // dups the fd
+}
+
+// InheritedPacketConn returns the conn of an inherited datagram socket.
+// See InheritedListener.
+func InheritedPacketConn(s string) (net.PacketConn, error) {
+	f, err := inheritedFile(s)
+	if err != nil {
+		return nil, err
+	}
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,50 @@
+package listen
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func Test_parseSystemdEnv(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	fds, ok := parseSystemdEnv(pid, "2", "dns-udp:dns-tcp:extra")
+	if want := map[string]int{"dns-udp": 3, "dns-tcp": 4}; !ok || !reflect.DeepEqual(fds, want) {
+		t.Fatalf("want %v, got %v %v", want, fds, ok)
+	}
+	if _, ok := parseSystemdEnv("1", "2", "dns-udp:dns-tcp"); ok {
+		t.Fatal("sockets of another process should be ignored")
+	}
+}
+
+func Test_InheritedListener_reload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inherited sockets are not supported on windows")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := strconv.Itoa(int(f.Fd()))
+
+	// Servers listen on the same fd again after a reload.
+	for i := 0; i < 2; i++ {
+		il, err := InheritedListener(fd)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if il.Addr().String() != l.Addr().String() {
+			t.Fatalf("#%d: listening on %s, want %s", i, il.Addr(), l.Addr())
+		}
+		il.Close()
+	}
+}
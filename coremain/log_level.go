@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/pmkol/mosdns-x/mlog"
+)
+
+// logLevel returns the level override of plugin tag. Overrides are kept
+// by tags, so they survive reloads.
+func (m *Mosdns) logLevel(tag string) *mlog.LevelOverride {
+	o, _ := m.logLevels.LoadOrStore(tag, new(mlog.LevelOverride))
+	return o.(*mlog.LevelOverride)
+}
+
+// handleLogLevelList reports overridden log levels of plugins.
+func (m *Mosdns) handleLogLevelList(w http.ResponseWriter, _ *http.Request) {
+	levels := make(map[string]string)
+	m.logLevels.Range(func(k, v any) bool {
+		if l, ok := v.(*mlog.LevelOverride).Get(); ok {
+			levels[k.(string)] = l.String()
+		}
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(levels); err != nil {
+		m.logger.Warn("failed to write log levels", zap.Error(err))
+	}
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// handleLogLevel changes the log level of the plugin {tag}.
+//
+//	PUT    overrides the level. Body: {"level": "debug"}
+//	DELETE restores the level of the config.
+func (m *Mosdns) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	if _, ok := m.graph.Load().plugins[tag]; !ok {
+		http.Error(w, "plugin not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		req := new(logLevelRequest)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(req); err != nil {
+			http.Error(w, "invalid request body, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		l, err := zapcore.ParseLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.logLevel(tag).Set(l)
+		m.logger.Info("plugin log level changed", zap.String("tag", tag), zap.Stringer("level", l))
+	case http.MethodDelete:
+		m.logLevel(tag).Reset()
+		m.logger.Info("plugin log level restored", zap.String("tag", tag))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
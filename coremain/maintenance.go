@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// maintenance runs Maintainer plugins at quiet hours.
+type maintenance struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes of the day, end < 0 means no deadline
+	plugins    []string
+
+	running sync.Mutex // maintenance runs one at a time
+}
+
+// initMaintenance checks cfg and starts the maintenance scheduler.
+// It must be called after plugins are loaded.
+func (m *Mosdns) initMaintenance(cfg *MaintenanceConfig) error {
+	if len(cfg.Start) == 0 {
+		return nil
+	}
+	mt := &maintenance{end: -1}
+	var err error
+	if mt.days, err = utils.ParseWeekdays(cfg.Days); err != nil {
+		return err
+	}
+	if mt.start, err = utils.ParseClock(cfg.Start); err != nil {
+		return fmt.Errorf("invalid start, %w", err)
+	}
+	if len(cfg.End) > 0 {
+		if mt.end, err = utils.ParseClock(cfg.End); err != nil {
+			return fmt.Errorf("invalid end, %w", err)
+		}
+	}
+
+	for _, tag := range cfg.Plugins {
+		p, ok := m.graph.Load().plugins[tag]
+		if !ok {
+			return fmt.Errorf("plugin %s does not exist", tag)
+		}
+		if _, ok := p.(Maintainer); !ok {
+			return fmt.Errorf("plugin %s does not support maintenance", tag)
+		}
+	}
+	mt.plugins = cfg.Plugins
+	m.maintenance = mt
+	m.sc.Attach(m.maintenanceLoop)
+	return nil
+}
+
+// next returns the next start time after now and the deadline of that
+// run, which is zero if the maintenance has no end.
+func (mt *maintenance) next(now time.Time) (start, deadline time.Time) {
+	for i := 0; i <= 7; i++ {
+		d := now.AddDate(0, 0, i)
+		start = time.Date(d.Year(), d.Month(), d.Day(), mt.start/60, mt.start%60, 0, 0, now.Location())
+		if mt.days[start.Weekday()] && start.After(now) {
+			break
+		}
+	}
+	if mt.end >= 0 {
+		window := mt.end - mt.start
+		if window <= 0 { // overnight
+			window += 24 * 60
+		}
+		deadline = start.Add(time.Duration(window) * time.Minute)
+	}
+	return start, deadline
+}
+
+func (m *Mosdns) maintenanceLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	for {
+		start, deadline := m.maintenance.next(time.Now())
+		m.logger.Info("next maintenance scheduled", zap.Time("start", start))
+		t := time.NewTimer(time.Until(start))
+		select {
+		case <-t.C:
+		case <-closeSignal:
+			t.Stop()
+			return
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if deadline.IsZero() {
+			ctx, cancel = context.WithCancel(context.Background())
+		} else {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+		go func() {
+			select {
+			case <-closeSignal:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		m.maintain(ctx)
+		cancel()
+	}
+}
+
+// maintain calls Maintain of plugins in order. Remaining plugins are
+// skipped once ctx is done.
+func (m *Mosdns) maintain(ctx context.Context) {
+	m.maintenance.running.Lock()
+	defer m.maintenance.running.Unlock()
+
+	g := m.acquireGraph()
+	defer g.release()
+	tags := m.maintenance.plugins
+	if len(tags) == 0 {
+		for tag, p := range g.plugins {
+			if _, ok := p.(Maintainer); ok {
+				tags = append(tags, tag)
+			}
+		}
+		slices.Sort(tags)
+	}
+
+	m.logger.Info("maintenance started", zap.Strings("plugins", tags))
+	for i, tag := range tags {
+		if ctx.Err() != nil {
+			m.logger.Warn("maintenance window ended, remaining plugins are skipped", zap.Strings("skipped", tags[i:]))
+			return
+		}
+		p, ok := g.plugins[tag].(Maintainer)
+		if !ok { // removed by a reload
+			m.logger.Warn("plugin to maintain does not exist", zap.String("tag", tag))
+			continue
+		}
+		start := time.Now()
+		if err := p.Maintain(ctx); err != nil {
+			m.logger.Warn("plugin maintenance failed", zap.String("tag", tag), zap.Error(err))
+			continue
+		}
+		m.logger.Info("plugin maintained", zap.String("tag", tag), zap.Duration("elapsed", time.Since(start)))
+	}
+	m.logger.Info("maintenance finished")
+}
+
+// handleMaintenance runs the maintenance now, ignoring the schedule.
+func (m *Mosdns) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	if m.maintenance == nil {
+		http.Error(w, "maintenance is not configured", http.StatusNotFound)
+		return
+	}
+	m.maintain(req.Context())
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"go.uber.org/zap"
+)
+
+type memoryReport struct {
+	Runtime       runtimeMemory                 `json:"runtime"`
+	DataProviders map[string]dataProviderMemory `json:"data_providers"`
+	Plugins       map[string]pluginMemory       `json:"plugins"`
+}
+
+type runtimeMemory struct {
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"num_gc"`
+}
+
+type dataProviderMemory struct {
+	File      string `json:"file"`
+	DataSize  int64  `json:"data_size"`
+	Listeners int    `json:"listeners"`
+}
+
+type pluginMemory struct {
+	Type        string `json:"type"`
+	MemoryUsage int64  `json:"memory_usage"`
+}
+
+// memoryReport collects approximate memory usage of data providers and
+// plugins that implement MemoryReporter. All sizes are in bytes.
+func (m *Mosdns) memoryReport() *memoryReport {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r := &memoryReport{
+		Runtime: runtimeMemory{
+			HeapAlloc:   ms.HeapAlloc,
+			HeapInuse:   ms.HeapInuse,
+			HeapObjects: ms.HeapObjects,
+			Sys:         ms.Sys,
+			NumGC:       ms.NumGC,
+		},
+		DataProviders: make(map[string]dataProviderMemory),
+		Plugins:       make(map[string]pluginMemory),
+	}
+
+	g := m.graph.Load()
+	for tag, dp := range g.dataManager.GetDataProviders() {
+		r.DataProviders[tag] = dataProviderMemory{
+			File:      dp.File(),
+			DataSize:  dp.DataSize(),
+			Listeners: dp.ListenerNum(),
+		}
+	}
+
+	for tag, p := range g.plugins {
+		mr, ok := p.(MemoryReporter)
+		if !ok {
+			continue
+		}
+		r.Plugins[tag] = pluginMemory{
+			Type:        p.Type(),
+			MemoryUsage: mr.MemoryUsage(),
+		}
+	}
+	return r
+}
+
+func (m *Mosdns) handleMemoryReport(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.memoryReport()); err != nil {
+		m.logger.Warn("failed to write memory report", zap.Error(err))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const minMemoryBudget = 16 << 20
+
+// initMemoryBudget sets the go runtime soft memory limit and GOGC from
+// cfg.Budget, and starts a watcher that asks plugins to shrink their
+// memory when the usage is reaching the budget.
+// Environment variables GOMEMLIMIT and GOGC have higher priority.
+func (m *Mosdns) initMemoryBudget(cfg *MemoryConfig) error {
+	if len(cfg.Budget) == 0 {
+		return nil
+	}
+	cfg.Init()
+	budget, err := utils.ParseByteSize(cfg.Budget)
+	if err != nil {
+		return fmt.Errorf("invalid memory budget, %w", err)
+	}
+	if budget < minMemoryBudget {
+		return fmt.Errorf("memory budget %d is too small, minimum is %d", budget, minMemoryBudget)
+	}
+	if !utils.CheckNumRange(cfg.ShrinkThreshold, 1, 100) {
+		return fmt.Errorf("invalid shrink threshold %d, should between 1~100", cfg.ShrinkThreshold)
+	}
+
+	// The go runtime is not the only memory user. Leave some
+	// headroom for stacks, cgo and kernel buffers.
+	limit := budget / 10 * 9
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); ok {
+		m.logger.Info("GOMEMLIMIT is set, memory limit from budget is ignored")
+	} else {
+		debug.SetMemoryLimit(limit)
+	}
+
+	gcPercent := cfg.GCPercent
+	if gcPercent == 0 {
+		gcPercent = defaultGCPercent(budget)
+	}
+	if _, ok := os.LookupEnv("GOGC"); ok {
+		m.logger.Info("GOGC is set, gc percent from budget is ignored")
+	} else {
+		debug.SetGCPercent(gcPercent)
+	}
+
+	shrinkAt := uint64(budget) * uint64(cfg.ShrinkThreshold) / 100
+	m.logger.Info(
+		"memory budget applied",
+		zap.Int64("budget", budget),
+		zap.Int64("memory_limit", limit),
+		zap.Int("gc_percent", gcPercent),
+		zap.Uint64("shrink_at", shrinkAt),
+	)
+	m.startMemoryWatcher(shrinkAt, time.Duration(cfg.CheckInterval)*time.Second)
+	return nil
+}
+
+// defaultGCPercent returns a lower GOGC for small budgets so that
+// the heap does not grow to double of the live data.
+func defaultGCPercent(budget int64) int {
+	switch {
+	case budget <= 128<<20:
+		return 30
+	case budget <= 512<<20:
+		return 50
+	default:
+		return 100
+	}
+}
+
+func (m *Mosdns) startMemoryWatcher(shrinkAt uint64, interval time.Duration) {
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if usage := runtimeMemoryUsage(); usage > shrinkAt {
+					m.shrinkMemory(usage)
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+func (m *Mosdns) shrinkMemory(usage uint64) {
+	m.logger.Warn("memory usage is reaching the budget, shrinking caches", zap.Uint64("usage", usage))
+	// The watcher starts before the first graph is loaded.
+	if g := m.graph.Load(); g != nil {
+		for _, p := range g.plugins {
+			if s, ok := p.(MemoryShrinker); ok {
+				s.ShrinkMemory()
+			}
+		}
+	}
+	debug.FreeOSMemory()
+	m.logger.Info("caches shrunk", zap.Uint64("usage", runtimeMemoryUsage()))
+}
+
+// runtimeMemoryUsage returns the memory that is counted by the
+// go runtime soft memory limit.
+func runtimeMemoryUsage() uint64 {
+	s := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 || s[1].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64() - s[1].Value.Uint64()
+}
@@ -20,115 +20,137 @@
 package coremain
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
 	"runtime"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
 	"github.com/pmkol/mosdns-x/pkg/data_provider"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/safe_close"
+	"github.com/pmkol/mosdns-x/pkg/server"
 )
 
 type Mosdns struct {
 	logger *zap.Logger
 
-	// Data
-	dataManager *data_provider.DataManager
+	// Data providers and plugins
+	graph      atomic.Pointer[pluginGraph] // the latest graph
+	loading    atomic.Pointer[pluginGraph] // nil if no graph is being loaded
+	entries    map[string]struct{}         // entry tags of servers
+	reloadMu   sync.Mutex
+	loadConfig func() (*Config, error) // nil if reload is not supported
 
-	// Plugins
-	execs    map[string]executable_seq.Executable
-	matchers map[string]executable_seq.Matcher
+	kvWatchCancel context.CancelFunc // stops watchers of kv includes, guarded by reloadMu
+
+	logLevels sync.Map // plugin tag -> *mlog.LevelOverride
 
 	httpAPIMux    *http.ServeMux
 	httpAPIServer *http.Server
 
-	metricsReg *prometheus.Registry
+	metricsReg    *prometheus.Registry
+	serverMetrics *serverMetrics
+
+	tailscale tailscaleNode
+	cluster   *cluster.Cluster
+
+	maintenance *maintenance // nil if not configured
+	traces      traceCapture
+
+	servers []*server.Server
+
+	acmeHTTPMu sync.Mutex
+	acmeHTTP   map[string]*acmeHTTPHandler // http_addr -> handler
 
 	sc *safe_close.SafeClose
 }
 
 func RunMosdns(cfg *Config) error {
+	return runMosdns(cfg, nil)
+}
+
+// runMosdns runs mosdns with cfg. loadConfig loads the config again for
+// reloads, it can be nil.
+func runMosdns(cfg *Config, loadConfig func() (*Config, error)) error {
 	lg, err := mlog.NewLogger(&cfg.Log)
 	if err != nil {
 		return fmt.Errorf("failed to init logger: %w", err)
 	}
 
 	m := &Mosdns{
-		logger:      lg,
-		dataManager: data_provider.NewDataManager(),
-		execs:       make(map[string]executable_seq.Executable),
-		matchers:    make(map[string]executable_seq.Matcher),
-		httpAPIMux:  http.NewServeMux(),
-		metricsReg:  newMetricsReg(),
-		sc:          safe_close.NewSafeClose(),
+		logger:     lg,
+		entries:    make(map[string]struct{}),
+		loadConfig: loadConfig,
+		httpAPIMux: http.NewServeMux(),
+		metricsReg: newMetricsReg(),
+		sc:         safe_close.NewSafeClose(),
+	}
+	m.tailscale.cfg = &cfg.Tailscale
+	m.serverMetrics = newServerMetrics(prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg))
+
+	m.httpAPIMux.HandleFunc("/metrics", m.handleMetrics)
+	m.httpAPIMux.HandleFunc("/memory", m.handleMemoryReport)
+	m.httpAPIMux.HandleFunc("GET /data_providers", m.handleDataProviderList)
+	m.httpAPIMux.HandleFunc("/data_providers/{tag}/entries", m.handleDataEntries)
+	m.httpAPIMux.HandleFunc("GET /data_providers/{tag}/export", m.handleDataExport)
+	m.httpAPIMux.HandleFunc("/plugins", m.handlePluginList)
+	m.httpAPIMux.HandleFunc("/plugins/{tag}/", m.handlePluginAPI)
+	m.httpAPIMux.HandleFunc("POST /maintenance", m.handleMaintenance)
+	m.httpAPIMux.HandleFunc("POST /certs/reload", m.handleReloadCerts)
+	m.httpAPIMux.HandleFunc("POST /reload", m.handleReload)
+	m.httpAPIMux.HandleFunc("POST /data_providers/reload", m.handleDataReload)
+	m.httpAPIMux.HandleFunc("POST /data_providers/{tag}/reload", m.handleDataReload)
+	m.httpAPIMux.HandleFunc("POST /cache/flush", m.handleCacheFlush)
+	m.httpAPIMux.HandleFunc("GET /stats", m.handleStats)
+	m.httpAPIMux.HandleFunc("GET /stats/{tag}", m.handleStats)
+	m.httpAPIMux.HandleFunc("GET /resolve", m.handleResolve)
+	m.httpAPIMux.HandleFunc("POST /resolve", m.handleBatchResolve)
+	m.httpAPIMux.HandleFunc("POST /trace", m.handleTraceStart)
+	m.httpAPIMux.HandleFunc("GET /trace", m.handleTraceStatus)
+	m.httpAPIMux.HandleFunc("DELETE /trace", m.handleTraceStop)
+	m.httpAPIMux.HandleFunc("GET /log_levels", m.handleLogLevelList)
+	m.httpAPIMux.HandleFunc("/log_levels/{tag}", m.handleLogLevel)
+	if cfg.API.Dashboard {
+		m.httpAPIMux.Handle("/dashboard/", dashboardHandler())
 	}
-
-	m.httpAPIMux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
 	m.httpAPIMux.HandleFunc("/debug/pprof/", pprof.Index)
 	m.httpAPIMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	m.httpAPIMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	m.httpAPIMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	m.httpAPIMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	// Init data manager
-	dupTag := make(map[string]struct{})
-	for _, dpc := range cfg.DataProviders {
-		if len(dpc.Tag) == 0 {
-			continue
-		}
-		if _, ok := dupTag[dpc.Tag]; ok {
-			return fmt.Errorf("duplicated provider tag %s", dpc.Tag)
-		}
-		dupTag[dpc.Tag] = struct{}{}
-
-		dp, err := data_provider.NewDataProvider(lg, dpc)
-		if err != nil {
-			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
-		}
-		m.dataManager.AddDataProvider(dpc.Tag, dp)
+	if err := m.initMemoryBudget(&cfg.Memory); err != nil {
+		return fmt.Errorf("failed to init memory budget, %w", err)
 	}
-
-	// Init preset plugins
-	for tag, f := range LoadNewPersetPluginFuncs() {
-		p, err := f(NewBP(tag, "preset", m.logger, m))
-		if err != nil {
-			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
-		}
-		m.addPlugin(p)
+	if err := m.initCluster(&cfg.Cluster, &cfg.API); err != nil {
+		return fmt.Errorf("failed to init cluster, %w", err)
 	}
 
-	// Init plugins
-	dupTag = make(map[string]struct{})
-	for i, pc := range cfg.Plugins {
-		if len(pc.Type) == 0 || len(pc.Tag) == 0 {
-			continue
-		}
-		if _, dup := dupTag[pc.Tag]; dup {
-			return fmt.Errorf("duplicated plugin tag %s", pc.Tag)
-		}
-		dupTag[pc.Tag] = struct{}{}
+	g, err := m.loadGraph(cfg)
+	if err != nil {
+		return err
+	}
+	m.serveGraph(g)
 
-		m.logger.Info("loading plugin", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
-		p, err := NewPlugin(&pc, m.logger, m)
-		if err != nil {
-			return fmt.Errorf("failed to init plugin #%d, %w", i, err)
-		}
+	if err := m.initMaintenance(&cfg.Maintenance); err != nil {
+		return fmt.Errorf("failed to init maintenance, %w", err)
+	}
 
-		m.addPlugin(p)
-		// Also add it to api mux if plugin implements http.Handler.
-		if h, ok := p.(http.Handler); ok {
-			m.httpAPIMux.Handle(fmt.Sprintf("/plugins/%s/", p.Tag()), h)
-		}
+	// Channels of plugins are registered, start syncing.
+	if m.cluster != nil {
+		m.sc.Attach(m.cluster.Run)
 	}
 
 	if len(cfg.Servers) == 0 {
@@ -140,11 +162,15 @@ func RunMosdns(cfg *Config) error {
 		}
 	}
 
+	m.watchReloadSignal()
+	m.watchExitSignal()
+	m.watchKVIncludes(cfg.kvIncludes)
+
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
 		httpServer := &http.Server{
 			Addr:    httpAddr,
-			Handler: m.httpAPIMux,
+			Handler: apiAuth(m.httpAPIMux, cfg.API.Token),
 		}
 		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
@@ -172,35 +198,31 @@ func RunMosdns(cfg *Config) error {
 	return m.sc.Err()
 }
 
-func (m *Mosdns) addPlugin(p Plugin) {
-	t := p.Tag()
-	if p, ok := p.(ExecutablePlugin); ok {
-		m.execs[t] = p
-	}
-	if p, ok := p.(MatcherPlugin); ok {
-		m.matchers[p.Tag()] = p
-	}
-}
-
+// GetDataManager, GetExecutables and GetMatchers return data providers
+// and plugins that are loaded before the calling plugin. They are for
+// plugin initialization only.
 func (m *Mosdns) GetDataManager() *data_provider.DataManager {
-	return m.dataManager
+	return m.loadingGraph().dataManager
 }
 
+// GetSafeClose returns the SafeClose for goroutines of the plugins being
+// loaded. It's closed when the plugins are replaced or mosdns exits.
 func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
-	return m.sc
+	return m.loadingGraph().sc
 }
 
 func (m *Mosdns) GetExecutables() map[string]executable_seq.Executable {
-	return m.execs
+	return m.loadingGraph().execs
 }
 
 func (m *Mosdns) GetMatchers() map[string]executable_seq.Matcher {
-	return m.matchers
+	return m.loadingGraph().matchers
 }
 
 // GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
+// for the plugins being loaded. Metrics of replaced plugins are dropped.
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
-	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
+	return prometheus.WrapRegistererWithPrefix("mosdns_", m.loadingGraph().metricsReg)
 }
 
 // GetHTTPAPIMux returns the api http.ServeMux.
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PipelinePresetFunc expands a pipeline preset into plugins. args is the
+// object created by NewPluginArgsFunc. The returned plugin that has the
+// tag is the entry of the preset, others should have tags prefixed by
+// the tag.
+type PipelinePresetFunc func(tag string, args interface{}) ([]PluginConfig, error)
+
+type pipelinePreset struct {
+	expand  PipelinePresetFunc
+	newArgs NewPluginArgsFunc
+}
+
+var pipelinePresetReg struct {
+	sync.RWMutex
+	m map[string]pipelinePreset
+}
+
+// RegPipelinePreset registers a pipeline preset as a plugin type. Plugins
+// of the type are replaced by the plugins from f when the config is
+// loaded. It panics if the type has been registered.
+func RegPipelinePreset(typ string, f PipelinePresetFunc, newArgs NewPluginArgsFunc) {
+	pipelinePresetReg.Lock()
+	defer pipelinePresetReg.Unlock()
+	if _, ok := pipelinePresetReg.m[typ]; ok {
+		panic(fmt.Sprintf("duplicate pipeline preset [%s]", typ))
+	}
+	if _, ok := GetPluginType(typ); ok {
+		panic(fmt.Sprintf("pipeline preset [%s] conflicts with a plugin type", typ))
+	}
+	if pipelinePresetReg.m == nil {
+		pipelinePresetReg.m = make(map[string]pipelinePreset)
+	}
+	pipelinePresetReg.m[typ] = pipelinePreset{expand: f, newArgs: newArgs}
+}
+
+func getPipelinePreset(typ string) (pipelinePreset, bool) {
+	pipelinePresetReg.RLock()
+	defer pipelinePresetReg.RUnlock()
+	p, ok := pipelinePresetReg.m[typ]
+	return p, ok
+}
+
+// expandPipelinePresets replaces plugins of pipeline presets in pcs by
+// their plugins.
+func expandPipelinePresets(pcs []PluginConfig) ([]PluginConfig, error) {
+	out := make([]PluginConfig, 0, len(pcs))
+	for _, pc := range pcs {
+		p, ok := getPipelinePreset(pc.Type)
+		if !ok || len(pc.Tag) == 0 {
+			out = append(out, pc)
+			continue
+		}
+		args, err := decodeArgs(pc.Args, p.newArgs)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s, %w", pc.Tag, err)
+		}
+		expanded, err := p.expand(pc.Tag, args)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s, %w", pc.Tag, err)
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
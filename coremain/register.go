@@ -27,6 +27,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -93,28 +94,33 @@ func NewPlugin(c *PluginConfig, lg *zap.Logger, m *Mosdns) (p Plugin, err error)
 	}
 
 	bp := NewBP(c.Tag, c.Type, lg, m)
+	args, err := decodeArgs(c.Args, typeInfo.NewArgs)
+	if err != nil {
+		return nil, err
+	}
+	return typeInfo.NewPlugin(bp, args)
+}
 
-	// parse args
-	if typeInfo.NewArgs != nil {
-		args := typeInfo.NewArgs()
-		if m, ok := c.Args.(map[string]interface{}); ok {
-			if err = utils.WeakDecode(m, args); err != nil {
-				return nil, fmt.Errorf("unable to decode plugin args: %w", err)
-			}
-		} else if c.Args != nil {
-			tc := reflect.TypeOf(c.Args) // args type from config
-			tp := reflect.TypeOf(args)   // args type from plugin init func
-			if tc == tp {
-				args = c.Args
-			} else {
-				return nil, fmt.Errorf("invalid plugin args type, want %s, got %s", tp.String(), tc.String())
-			}
+// decodeArgs decodes args from the config to the object created by
+// newArgs. If newArgs is nil, args is returned as is.
+func decodeArgs(in interface{}, newArgs NewPluginArgsFunc) (interface{}, error) {
+	if newArgs == nil {
+		return in, nil
+	}
+	args := newArgs()
+	if m, ok := in.(map[string]interface{}); ok {
+		if err := utils.WeakDecode(m, args); err != nil {
+			return nil, fmt.Errorf("unable to decode plugin args: %w", err)
 		}
-
-		return typeInfo.NewPlugin(bp, args)
+	} else if in != nil {
+		tc := reflect.TypeOf(in)   // args type from config
+		tp := reflect.TypeOf(args) // args type from plugin init func
+		if tc != tp {
+			return nil, fmt.Errorf("invalid plugin args type, want %s, got %s", tp.String(), tc.String())
+		}
+		args = in
 	}
-
-	return typeInfo.NewPlugin(bp, c.Args)
+	return args, nil
 }
 
 // GetAllPluginTypes returns all plugin types which are configurable.
@@ -162,6 +168,7 @@ func LoadNewPersetPluginFuncs() map[string]NewPersetPluginFunc {
 // It also has an internal logger, for convenience.
 type BP struct {
 	tag, typ string
+	preset   bool
 
 	l *zap.Logger
 	s *zap.SugaredLogger
@@ -175,9 +182,36 @@ func NewBP(tag string, typ string, lg *zap.Logger, m *Mosdns) *BP {
 		lg = zap.NewNop()
 	}
 	lg = lg.Named(tag)
+	if m != nil {
+		lg = mlog.WithLevelOverride(lg, m.logLevel(tag))
+	}
 	return &BP{tag: tag, typ: typ, l: lg, s: lg.Sugar(), m: m}
 }
 
+// newPresetBP creates a BP of a preset plugin.
+func newPresetBP(tag string, lg *zap.Logger, m *Mosdns) *BP {
+	bp := NewBP(tag, "preset", lg, m)
+	bp.preset = true
+	return bp
+}
+
+// IsPreset implements presetMarker.
+func (p *BP) IsPreset() bool {
+	return p.preset
+}
+
+// presetMarker is implemented by plugins that embed a BP. Preset plugins
+// are built in, their apis are not exposed.
+type presetMarker interface {
+	IsPreset() bool
+}
+
+// isPreset returns true if p is a preset plugin.
+func isPreset(p Plugin) bool {
+	pm, ok := p.(presetMarker)
+	return ok && pm.IsPreset()
+}
+
 func (p *BP) Tag() string {
 	return p.tag
 }
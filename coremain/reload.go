@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/remote_kv"
+)
+
+const kvIncludeRetryDelay = time.Second * 5
+
+// reloadCerts reloads certificates of all servers.
+func (m *Mosdns) reloadCerts() error {
+	var errs []error
+	for _, s := range m.servers {
+		if err := s.ReloadCerts(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reload loads data providers and plugins from the config again, and
+// replaces the running ones. Old plugins are closed after their
+// in-flight queries are finished. Other settings, e.g. servers and the
+// api, are not reloaded. If the new config fails, old plugins are kept.
+func (m *Mosdns) reload() error {
+	if m.loadConfig == nil {
+		return errors.New("config reload is not supported")
+	}
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	cfg, err := m.loadConfig()
+	if err != nil {
+		return err
+	}
+	g, err := m.loadGraph(cfg)
+	if err != nil {
+		return err
+	}
+	for tag := range m.entries {
+		if g.execs[tag] == nil {
+			g.close()
+			return fmt.Errorf("cannot find entry %s", tag)
+		}
+	}
+	old := m.serveGraph(g)
+	go func() {
+		old.close()
+		m.logger.Info("old plugins closed")
+	}()
+	m.watchKVIncludes(cfg.kvIncludes)
+	return nil
+}
+
+// watchKVIncludes reloads the config when one of the included kv keys
+// is modified. Watchers of the previous config are stopped. Caller must
+// hold reloadMu, unless m is not serving yet.
+func (m *Mosdns) watchKVIncludes(incs []kvInclude) {
+	if m.kvWatchCancel != nil {
+		m.kvWatchCancel()
+		m.kvWatchCancel = nil
+	}
+	if m.loadConfig == nil || len(incs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.kvWatchCancel = cancel
+	for _, inc := range incs {
+		c, err := remote_kv.NewClient(inc.url)
+		if err != nil { // Should not happen, the url was loaded.
+			m.logger.Error("invalid kv include", zap.String("url", inc.url), zap.Error(err))
+			continue
+		}
+		index := inc.index
+		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				select {
+				case <-closeSignal:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			remote_kv.Watch(ctx, c, index, kvIncludeRetryDelay,
+				func([]byte) {
+					m.logger.Info("included kv config updated", zap.String("key", c.Key()))
+					if err := m.reload(); err != nil {
+						m.logger.Error("failed to reload config", zap.Error(err))
+					} else {
+						m.logger.Info("config reloaded")
+					}
+				},
+				func(err error) {
+					m.logger.Error("failed to watch kv include", zap.String("key", c.Key()), zap.Error(err))
+				},
+			)
+		})
+	}
+}
+
+// watchReloadSignal reloads the config and certificates on SIGHUP.
+func (m *Mosdns) watchReloadSignal() {
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				if m.loadConfig != nil {
+					if err := m.reload(); err != nil {
+						m.logger.Error("failed to reload config", zap.Error(err))
+					} else {
+						m.logger.Info("config reloaded")
+					}
+				}
+				if err := m.reloadCerts(); err != nil {
+					m.logger.Error("failed to reload certificates", zap.Error(err))
+				} else {
+					m.logger.Info("certificates reloaded")
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+// watchExitSignal exits mosdns gracefully on SIGINT and SIGTERM, so
+// plugins can save their states. A second signal kills mosdns.
+func (m *Mosdns) watchExitSignal() {
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			m.logger.Info("exiting", zap.Stringer("signal", sig))
+			m.sc.SendCloseSignal(nil)
+		case <-closeSignal:
+		}
+	})
+}
+
+func (m *Mosdns) handleReloadCerts(w http.ResponseWriter, req *http.Request) {
+	if err := m.reloadCerts(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (m *Mosdns) handleReload(w http.ResponseWriter, req *http.Request) {
+	if err := m.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.logger.Info("config reloaded")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/safe_close"
+)
+
+func Test_watchKVIncludes(t *testing.T) {
+	var index atomic.Uint64
+	index.Store(1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/mosdns/sub" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Has("index") {
+			time.Sleep(time.Millisecond * 20) // blocking query
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index.Load(), 10))
+		w.Write([]byte("plugins:\n  - tag: p\n    type: sequence\n"))
+	}))
+	defer s.Close()
+
+	url := "consul://" + strings.TrimPrefix(s.URL, "http://") + "/mosdns/sub"
+	dir := t.TempDir()
+	f := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(f, []byte("include:\n  - "+url+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfigWithInclude(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.kvIncludes) != 1 || cfg.kvIncludes[0] != (kvInclude{url: url, index: 1}) {
+		t.Fatalf("unexpected kv includes %+v", cfg.kvIncludes)
+	}
+	if len(cfg.Plugins) != 1 || cfg.Plugins[0].Tag != "p" {
+		t.Fatalf("unexpected plugins %+v", cfg.Plugins)
+	}
+
+	reloaded := make(chan struct{}, 1)
+	m := &Mosdns{
+		logger: zap.NewNop(),
+		loadConfig: func() (*Config, error) {
+			select {
+			case reloaded <- struct{}{}:
+			default:
+			}
+			return nil, errors.New("test")
+		},
+		sc: safe_close.NewSafeClose(),
+	}
+	defer func() {
+		m.sc.SendCloseSignal(nil)
+		m.sc.Done()
+		m.sc.CloseWait()
+	}()
+	m.watchKVIncludes(cfg.kvIncludes)
+
+	select {
+	case <-reloaded:
+		t.Fatal("config reloaded without kv modification")
+	case <-time.After(time.Millisecond * 100):
+	}
+	index.Store(2)
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second * 5):
+		t.Fatal("config is not reloaded after kv modification")
+	}
+}
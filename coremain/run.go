@@ -20,10 +20,15 @@
 package coremain
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/go-viper/mapstructure/v2"
 	"github.com/kardianos/service"
@@ -32,6 +37,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/remote_kv"
 )
 
 type serverFlags struct {
@@ -70,6 +76,7 @@ func init() {
 	fs.IntVar(&sf.cpu, "cpu", 0, "set runtime.GOMAXPROCS")
 	fs.BoolVar(&sf.asService, "as-service", false, "start as a service")
 	fs.MarkHidden("as-service")
+	rootCmd.AddCommand(newCheckCmd())
 
 	serviceCmd := &cobra.Command{
 		Use:   "service",
@@ -108,21 +115,31 @@ func StartServer(sf *serverFlags) error {
 		mlog.L().Info("working directory changed", zap.String("path", sf.dir))
 	}
 
-	cfg, fileUsed, err := loadConfig(sf.c)
+	load := func() (*Config, error) { return loadConfigWithInclude(sf.c) }
+	cfg, err := load()
 	if err != nil {
-		return fmt.Errorf("fail to load config, %w", err)
+		return err
 	}
 
-	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
-		return fmt.Errorf("failed to load sub config file, %w", err)
-	}
-
-	if err := RunMosdns(cfg); err != nil {
+	if err := runMosdns(cfg, load); err != nil {
 		return fmt.Errorf("mosdns exited, %w", err)
 	}
 	return nil
 }
 
+// loadConfigWithInclude loads a config from a file and merges its
+// included configs.
+func loadConfigWithInclude(filePath string) (*Config, error) {
+	cfg, fileUsed, err := loadConfig(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load config, %w", err)
+	}
+	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+		return nil, fmt.Errorf("failed to load sub config file, %w", err)
+	}
+	return cfg, nil
+}
+
 // loadConfig load a config from a file. If filePath is empty, it will
 // automatically search and load a file which name start with "config".
 func loadConfig(filePath string) (*Config, string, error) {
@@ -139,17 +156,66 @@ func loadConfig(filePath string) (*Config, string, error) {
 		return nil, "", fmt.Errorf("failed to read config: %w", err)
 	}
 
+	cfg, err := decodeConfig(v, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, v.ConfigFileUsed(), nil
+}
+
+// loadConfigFromKV loads a yaml config from a Consul or etcd key.
+// It also returns the modify index of the key.
+func loadConfigFromKV(s string) (*Config, uint64, error) {
+	c, err := remote_kv.NewClient(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid kv url, %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	b, index, err := c.Get(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read config from kv: %w", err)
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read config: %w", err)
+	}
+	cfg, err := decodeConfig(v, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cfg, index, nil
+}
+
+// decodeConfig expands v and decodes it, see expandEnv. Configs from
+// remote sources are not expanded, so they can't read local files or
+// env vars, e.g. secrets, and send them out through upstream urls.
+func decodeConfig(v *viper.Viper, remote bool) (*Config, error) {
 	decoderOpt := func(cfg *mapstructure.DecoderConfig) {
 		cfg.ErrorUnused = true
 		cfg.TagName = "yaml"
 		cfg.WeaklyTypedInput = true
 	}
 
+	var settings any = v.AllSettings()
+	if !remote {
+		var err error
+		if settings, err = expandEnvValues(settings); err != nil {
+			return nil, fmt.Errorf("failed to expand config: %w", err)
+		}
+	}
+	ev := viper.New()
+	if err := ev.MergeConfigMap(settings.(map[string]any)); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
 	cfg := new(Config)
-	if err := v.Unmarshal(cfg, decoderOpt); err != nil {
-		return nil, "", fmt.Errorf("failed to unmarshal config: %w", err)
+	if err := ev.Unmarshal(cfg, decoderOpt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
-	return cfg, v.ConfigFileUsed(), nil
+	return cfg, nil
 }
 
 func mergeInclude(cfg *Config, depth int, paths []string) error {
@@ -158,17 +224,37 @@ func mergeInclude(cfg *Config, depth int, paths []string) error {
 		return fmt.Errorf("maximun include depth reached, include path is %s", strings.Join(paths, " -> "))
 	}
 
+	var files []string
+	for _, s := range cfg.Include {
+		fs, err := expandInclude(s)
+		if err != nil {
+			return fmt.Errorf("invalid include %s, %w", s, err)
+		}
+		files = append(files, fs...)
+	}
+
 	includedCfg := new(Config)
-	for _, subCfgFile := range cfg.Include {
+	for _, subCfgFile := range files {
 		subPaths := append(paths, subCfgFile)
 		mlog.L().Info("reading sub config", zap.String("file", subCfgFile))
-		subCfg, _, err := loadConfig(subCfgFile)
+		var subCfg *Config
+		var err error
+		if remote_kv.IsKVURL(subCfgFile) {
+			var index uint64
+			subCfg, index, err = loadConfigFromKV(subCfgFile)
+			if err == nil {
+				cfg.kvIncludes = append(cfg.kvIncludes, kvInclude{url: subCfgFile, index: index})
+			}
+		} else {
+			subCfg, _, err = loadConfig(subCfgFile)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to load sub config, %w", err)
 		}
 		if err := mergeInclude(subCfg, depth, subPaths); err != nil {
 			return err
 		}
+		cfg.kvIncludes = append(cfg.kvIncludes, subCfg.kvIncludes...)
 
 		includedCfg.DataProviders = append(includedCfg.DataProviders, subCfg.DataProviders...)
 		includedCfg.Plugins = append(includedCfg.Plugins, subCfg.Plugins...)
@@ -180,3 +266,43 @@ func mergeInclude(cfg *Config, depth int, paths []string) error {
 	cfg.Servers = append(includedCfg.Servers, cfg.Servers...)
 	return nil
 }
+
+// expandInclude returns the config files of an include entry. Glob
+// patterns and directories only include regular .yaml and .yml files,
+// sorted.
+func expandInclude(s string) ([]string, error) {
+	if remote_kv.IsKVURL(s) {
+		return []string{s}, nil
+	}
+	var matches []string
+	if strings.ContainsAny(s, "*?[") {
+		var err error
+		if matches, err = filepath.Glob(s); err != nil {
+			return nil, err
+		}
+	} else if fi, err := os.Stat(s); err == nil && fi.IsDir() {
+		entries, err := os.ReadDir(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			matches = append(matches, filepath.Join(s, e.Name()))
+		}
+	} else {
+		return []string{s}, nil
+	}
+
+	var files []string
+	for _, f := range matches {
+		switch filepath.Ext(f) {
+		case ".yaml", ".yml":
+		default:
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.Mode().IsRegular() { // follows symlinks
+			files = append(files, f)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
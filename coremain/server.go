@@ -28,13 +28,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/pires/go-proxyproto"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain/listen"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/server"
 	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 const defaultQueryTimeout = time.Second * 5
@@ -47,38 +51,176 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 		return errors.New("empty entry")
 	}
 
-	entry := m.execs[cfg.Exec]
-	if entry == nil {
-		return fmt.Errorf("cannot find entry %s", cfg.Exec)
-	}
-
 	queryTimeout := defaultQueryTimeout
 	if cfg.Timeout > 0 {
 		queryTimeout = time.Duration(cfg.Timeout) * time.Second
 	}
 
-	dnsHandler, err := D.NewEntryHandler(D.EntryHandlerOpts{
-		Logger:             m.logger,
-		Entry:              entry,
-		QueryTimeout:       queryTimeout,
-		RecursionAvailable: true,
-	})
+	var completeCanceled bool
+	switch cfg.OnCancel {
+	case "", "abort":
+	case "complete":
+		completeCanceled = true
+	default:
+		return fmt.Errorf("invalid on_cancel %s", cfg.OnCancel)
+	}
+
+	trace, err := m.newTraceFilter(&cfg.Trace)
+	if err != nil {
+		return fmt.Errorf("invalid trace config, %w", err)
+	}
+	var malformed *D.MalformedPolicy
+	if len(cfg.Malformed.Action) > 0 {
+		if malformed, err = D.NewMalformedPolicy(cfg.Malformed.Action, cfg.Malformed.Upstream); err != nil {
+			return err
+		}
+	}
+
+	// Entry handlers of sni policies are shared by listeners.
+	handlers := make(map[string]D.Handler)
+	getHandler := func(exec string) (D.Handler, error) {
+		if h := handlers[exec]; h != nil {
+			return h, nil
+		}
+		if m.graph.Load().execs[exec] == nil {
+			return nil, fmt.Errorf("cannot find entry %s", exec)
+		}
+		h, err := D.NewEntryHandler(D.EntryHandlerOpts{
+			Logger:             m.logger,
+			Entry:              &graphEntry{m: m, tag: exec},
+			QueryTimeout:       queryTimeout,
+			RecursionAvailable: true,
+			CompleteCanceled:   completeCanceled,
+			Trace:              trace,
+			Capture:            m.traces.forEntry(exec),
+			Malformed:          malformed,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init entry handler, %w", err)
+		}
+		mh := m.serverMetrics.wrap(h, exec)
+		handlers[exec] = mh
+		m.entries[exec] = struct{}{}
+		return mh, nil
+	}
+
+	dnsHandler, err := getHandler(cfg.Exec)
 	if err != nil {
-		return fmt.Errorf("failed to init entry handler, %w", err)
+		return err
 	}
 
 	for _, lc := range cfg.Listeners {
-		if err := m.startServerListener(lc, dnsHandler); err != nil {
+		h := dnsHandler
+		if len(lc.SNI) > 0 {
+			if h, err = newSNIHandler(lc.SNI, dnsHandler, getHandler); err != nil {
+				return err
+			}
+		}
+		if err := m.startServerListener(lc, h); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// sniHandler sends queries to the entry of their server names.
+type sniHandler struct {
+	routes []sniRoute
+	def    D.Handler
+}
+
+type sniRoute struct {
+	names []string
+	h     D.Handler
+}
+
+func newSNIHandler(cfgs []*SNIConfig, def D.Handler, getHandler func(exec string) (D.Handler, error)) (*sniHandler, error) {
+	sh := &sniHandler{def: def}
+	for _, c := range cfgs {
+		if len(c.Names) == 0 {
+			return nil, errors.New("sni policy has no names")
+		}
+		h := def
+		if len(c.Exec) > 0 {
+			var err error
+			if h, err = getHandler(c.Exec); err != nil {
+				return nil, fmt.Errorf("invalid sni policy %v, %w", c.Names, err)
+			}
+		}
+		sh.routes = append(sh.routes, sniRoute{names: c.Names, h: h})
+	}
+	return sh, nil
+}
+
+func (sh *sniHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	if sn := meta.GetServerName(); len(sn) > 0 {
+		for _, r := range sh.routes {
+			if server.MatchServerName(r.names, sn) {
+				return r.h.ServeDNS(ctx, req, meta)
+			}
+		}
+	}
+	return sh.def.ServeDNS(ctx, req, meta)
+}
+
+// ServeRaw implements D.RawHandler.
+func (sh *sniHandler) ServeRaw(ctx context.Context, b []byte, meta *query_context.RequestMeta) ([]byte, error) {
+	h := sh.def
+	if sn := meta.GetServerName(); len(sn) > 0 {
+		for _, r := range sh.routes {
+			if server.MatchServerName(r.names, sn) {
+				h = r.h
+				break
+			}
+		}
+	}
+	if rh, ok := h.(D.RawHandler); ok {
+		return rh.ServeRaw(ctx, b, meta)
+	}
+	return nil, D.ErrDropped
+}
+
+func (m *Mosdns) newTraceFilter(cfg *TraceConfig) (func(*dns.Msg, *query_context.RequestMeta) bool, error) {
+	if cfg.All {
+		return func(*dns.Msg, *query_context.RequestMeta) bool { return true }, nil
+	}
+	if len(cfg.Clients) > 0 {
+		// Check the clients now, reloads only log their errors.
+		if _, err := m.graph.Load().loadTraceClients(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return func(req *dns.Msg, meta *query_context.RequestMeta) bool {
+		if !D.HasTraceOption(req) {
+			return false
+		}
+		addr := meta.GetClientAddr().Unmap()
+		if !addr.IsValid() {
+			return false
+		}
+		if addr.IsLoopback() {
+			return true
+		}
+		if len(cfg.Clients) == 0 {
+			return false
+		}
+		clients, err := m.graph.Load().loadTraceClients(cfg)
+		if err != nil {
+			m.logger.Warn("failed to load trace clients", zap.Error(err))
+			return false
+		}
+		ok, _ := clients.Match(addr)
+		return ok
+	}, nil
+}
+
 func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Handler) error {
 	if len(cfg.Addr) == 0 {
 		return errors.New("no address to bind")
 	}
+	if cfg.Tailscale && cfg.UnixDomainSocket {
+		return errors.New("tailscale listener cannot be a unix domain socket")
+	}
 
 	m.logger.Info("starting server", zap.String("proto", cfg.Protocol), zap.String("addr", cfg.Addr))
 
@@ -87,31 +229,78 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 		idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
 	}
 
+	var trustedProxies *netlist.List
+	if len(cfg.TrustedProxies) > 0 {
+		trustedProxies = netlist.NewList()
+		for _, s := range cfg.TrustedProxies {
+			if err := netlist.LoadFromText(trustedProxies, s); err != nil {
+				return fmt.Errorf("invalid trusted proxy %s, %w", s, err)
+			}
+		}
+		trustedProxies.Sort()
+	}
+
 	httpHandler, err := H.NewHandler(H.HandlerOpts{
-		DNSHandler:  dnsHandler,
-		Path:        cfg.URLPath,
-		SrcIPHeader: cfg.GetUserIPFromHeader,
-		Logger:      m.logger,
+		DNSHandler:     dnsHandler,
+		Path:           cfg.URLPath,
+		JSONPath:       cfg.JSONPath,
+		SrcIPHeader:    cfg.GetUserIPFromHeader,
+		TrustedProxies: trustedProxies,
+		Logger:         m.logger,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to init http handler, %w", err)
 	}
 
 	opts := server.ServerOpts{
-		DNSHandler:  dnsHandler,
-		HttpHandler: httpHandler,
-		Cert:        cfg.Cert,
-		Key:         cfg.Key,
-		KernelTX:    cfg.KernelTX,
-		KernelRX:    cfg.KernelRX,
-		IdleTimeout: idleTimeout,
-		Logger:      m.logger,
+		DNSHandler:        dnsHandler,
+		HttpHandler:       httpHandler,
+		Cert:              cfg.Cert,
+		Key:               cfg.Key,
+		Listener:          cfg.Tag,
+		NeedServerName:    len(cfg.SNI) > 0,
+		RequireClientCert: cfg.RequireClientCert,
+		KernelTX:          cfg.KernelTX,
+		KernelRX:          cfg.KernelRX,
+		IdleTimeout:       idleTimeout,
+		Logger:            m.logger,
+	}
+	if cfg.ACME != nil {
+		if opts.ACME, err = m.newACMEManager(cfg.ACME); err != nil {
+			return fmt.Errorf("failed to init acme, %w", err)
+		}
+	}
+	for _, c := range cfg.SNI {
+		if len(c.Cert) > 0 || len(c.Key) > 0 {
+			opts.SNICerts = append(opts.SNICerts, server.SNICert{Names: c.Names, Cert: c.Cert, Key: c.Key})
+		}
+	}
+	if len(cfg.ClientCA) > 0 {
+		opts.ClientCAs, err = utils.LoadCertPool(cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to load client ca, %w", err)
+		}
+	} else if cfg.RequireClientCert {
+		return errors.New("require_client_cert needs client_ca")
 	}
 	s := server.NewServer(opts)
+	m.servers = append(m.servers, s)
 
-	// helper func for proxy protocol listener
-	requirePP := func(_ net.Addr) (proxyproto.Policy, error) {
-		return proxyproto.REQUIRE, nil
+	// Proxy protocol headers are required from trusted proxies, and
+	// rejected from others. All peers are trusted if trusted proxies are
+	// not configured.
+	ppPolicy := func(addr net.Addr) (proxyproto.Policy, error) {
+		if trustedProxies == nil {
+			return proxyproto.REQUIRE, nil
+		}
+		ip := utils.GetAddrFromAddr(addr)
+		if !ip.IsValid() { // unix socket peers are trusted
+			return proxyproto.REQUIRE, nil
+		}
+		if ok, _ := trustedProxies.Contains(ip); ok {
+			return proxyproto.REQUIRE, nil
+		}
+		return proxyproto.REJECT, nil
 	}
 
 	config := listen.CreateListenConfig()
@@ -122,7 +311,11 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 	case "", "udp", "quic", "doq", "h3", "doh3":
 		var conn net.PacketConn
 		var err error
-		if cfg.UnixDomainSocket {
+		if fd, ok := strings.CutPrefix(cfg.Addr, "fd://"); ok {
+			conn, err = listen.InheritedPacketConn(fd)
+		} else if cfg.Tailscale {
+			conn, err = m.listenPacketTailscale("udp", cfg.Addr)
+		} else if cfg.UnixDomainSocket {
 			if !abstract {
 				os.Remove(cfg.Addr)
 			}
@@ -155,7 +348,11 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 	case "tcp", "tls", "dot", "http", "https", "doh":
 		var l net.Listener
 		var err error
-		if cfg.UnixDomainSocket {
+		if fd, ok := strings.CutPrefix(cfg.Addr, "fd://"); ok {
+			l, err = listen.InheritedListener(fd)
+		} else if cfg.Tailscale {
+			l, err = m.listenTailscale("tcp", cfg.Addr)
+		} else if cfg.UnixDomainSocket {
 			if !abstract {
 				os.Remove(cfg.Addr)
 			}
@@ -170,7 +367,7 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 			return err
 		}
 		if cfg.ProxyProtocol {
-			l = &proxyproto.Listener{Listener: l, Policy: requirePP}
+			l = &proxyproto.Listener{Listener: l, Policy: ppPolicy}
 		}
 		switch cfg.Protocol {
 		case "tcp":
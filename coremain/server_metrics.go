@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+// serverMetrics are metrics of queries of servers, labeled by the entry
+// of the server. They are kept across reloads.
+type serverMetrics struct {
+	queryTotal *prometheus.CounterVec
+	errTotal   *prometheus.CounterVec
+	rcodeTotal *prometheus.CounterVec
+	inflight   *prometheus.GaugeVec
+	latency    *prometheus.HistogramVec
+}
+
+func newServerMetrics(reg prometheus.Registerer) *serverMetrics {
+	sm := &serverMetrics{
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "server_query_total",
+			Help: "The total number of queries received by servers",
+		}, []string{"entry"}),
+		errTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "server_err_total",
+			Help: "The total number of queries that servers failed to answer",
+		}, []string{"entry"}),
+		rcodeTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "server_response_total",
+			Help: "The total number of responses by rcode",
+		}, []string{"entry", "rcode"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "server_inflight",
+			Help: "The number of queries being processed",
+		}, []string{"entry"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "server_response_latency_millisecond",
+			Help:    "The response latency in millisecond",
+			Buckets: []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+		}, []string{"entry"}),
+	}
+	reg.MustRegister(sm.queryTotal, sm.errTotal, sm.rcodeTotal, sm.inflight, sm.latency)
+	return sm
+}
+
+// metricsHandler records metrics of queries of an entry.
+type metricsHandler struct {
+	h          D.Handler
+	entry      string
+	queryTotal prometheus.Counter
+	errTotal   prometheus.Counter
+	rcodeTotal *prometheus.CounterVec
+	inflight   prometheus.Gauge
+	latency    prometheus.Observer
+}
+
+func (sm *serverMetrics) wrap(h D.Handler, entry string) *metricsHandler {
+	return &metricsHandler{
+		h:          h,
+		entry:      entry,
+		queryTotal: sm.queryTotal.WithLabelValues(entry),
+		errTotal:   sm.errTotal.WithLabelValues(entry),
+		rcodeTotal: sm.rcodeTotal,
+		inflight:   sm.inflight.WithLabelValues(entry),
+		latency:    sm.latency.WithLabelValues(entry),
+	}
+}
+
+func (h *metricsHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.queryTotal.Inc()
+	h.inflight.Inc()
+	defer h.inflight.Dec()
+	start := time.Now()
+	r, err := h.h.ServeDNS(ctx, req, meta)
+	if err != nil || r == nil {
+		h.errTotal.Inc()
+		return r, err
+	}
+	h.latency.Observe(float64(time.Since(start).Milliseconds()))
+	h.rcodeTotal.WithLabelValues(h.entry, dns.RcodeToString[r.Rcode]).Inc()
+	return r, err
+}
+
+// ServeRaw implements D.RawHandler.
+func (h *metricsHandler) ServeRaw(ctx context.Context, b []byte, meta *query_context.RequestMeta) ([]byte, error) {
+	rh, ok := h.h.(D.RawHandler)
+	if !ok {
+		return nil, D.ErrDropped
+	}
+	h.queryTotal.Inc()
+	h.inflight.Inc()
+	defer h.inflight.Dec()
+	r, err := rh.ServeRaw(ctx, b, meta)
+	if err != nil {
+		h.errTotal.Inc()
+	}
+	return r, err
+}
@@ -0,0 +1,154 @@
+//go:build tailscale
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/tsnet"
+)
+
+const (
+	tailscaleUpTimeout  = time.Minute * 5
+	tailscaleMinBackoff = time.Second * 10
+	tailscaleMaxBackoff = time.Minute * 10
+)
+
+type tailscaleNode struct {
+	cfg *TailscaleConfig
+
+	m       sync.Mutex
+	s       *tsnet.Server
+	ips     []netip.Addr
+	err     error     // error of the last start
+	retryAt time.Time // next start is not tried before it
+	backoff time.Duration
+}
+
+// get returns the started node, or calls start if it has not been
+// started. After a failure, the error is returned until the backoff
+// is over, so a broken config does not block every caller.
+func (t *tailscaleNode) get(start func() (*tsnet.Server, []netip.Addr, error)) (*tsnet.Server, []netip.Addr, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.s != nil {
+		return t.s, t.ips, nil
+	}
+	if t.err != nil && time.Now().Before(t.retryAt) {
+		return nil, nil, t.err
+	}
+	s, ips, err := start()
+	if err != nil {
+		t.backoff = min(max(t.backoff*2, tailscaleMinBackoff), tailscaleMaxBackoff)
+		t.err, t.retryAt = err, time.Now().Add(t.backoff)
+		return nil, nil, err
+	}
+	t.s, t.ips, t.err = s, ips, nil
+	return s, ips, nil
+}
+
+// TailscaleDialer returns the dial func of the in-process tailnet node.
+// The node is started and joins the tailnet at the first call. If it
+// fails, later calls start it again after a backoff.
+func (m *Mosdns) TailscaleDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	s, _, err := m.getTailscale()
+	if err != nil {
+		return nil, err
+	}
+	return s.Dial, nil
+}
+
+// getTailscale returns the started node and its ips.
+func (m *Mosdns) getTailscale() (*tsnet.Server, []netip.Addr, error) {
+	return m.tailscale.get(func() (*tsnet.Server, []netip.Addr, error) {
+		return m.startTailscale(m.tailscale.cfg)
+	})
+}
+
+func (m *Mosdns) startTailscale(cfg *TailscaleConfig) (*tsnet.Server, []netip.Addr, error) {
+	hostname := cfg.Hostname
+	if len(hostname) == 0 {
+		hostname = "mosdns"
+	}
+	lg := m.logger.Named("tailscale")
+	s := &tsnet.Server{
+		Hostname:   hostname,
+		AuthKey:    cfg.AuthKey,
+		Dir:        cfg.StateDir,
+		ControlURL: cfg.ControlURL,
+		Ephemeral:  cfg.Ephemeral,
+		Logf:       lg.Sugar().Debugf,
+		UserLogf:   lg.Sugar().Infof, // login url
+	}
+
+	lg.Info("joining tailnet", zap.String("hostname", hostname))
+	ctx, cancel := context.WithTimeout(context.Background(), tailscaleUpTimeout)
+	defer cancel()
+	st, err := s.Up(ctx)
+	if err != nil {
+		s.Close()
+		return nil, nil, fmt.Errorf("failed to join tailnet, %w", err)
+	}
+	lg.Info("tailnet joined", zap.Any("ips", st.TailscaleIPs))
+
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		<-closeSignal
+		s.Close()
+	})
+	return s, st.TailscaleIPs, nil
+}
+
+func (m *Mosdns) listenTailscale(network, addr string) (net.Listener, error) {
+	s, _, err := m.getTailscale()
+	if err != nil {
+		return nil, err
+	}
+	return s.Listen(network, addr)
+}
+
+// listenPacketTailscale listens on addr. tsnet requires an ip for udp,
+// so the first tailscale ip will be used if the host of addr is omitted.
+func (m *Mosdns) listenPacketTailscale(network, addr string) (net.PacketConn, error) {
+	s, ips, err := m.getTailscale()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || ip.IsUnspecified() {
+		if len(ips) == 0 {
+			return nil, errors.New("node has no tailscale ip")
+		}
+		addr = net.JoinHostPort(ips[0].String(), port)
+	}
+	return s.ListenPacket(network, addr)
+}
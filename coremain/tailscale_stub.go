@@ -0,0 +1,49 @@
+//go:build !tailscale
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errNoTailscale is returned by tailscale listeners and dialers if the
+// tailnet node is not compiled in.
+var errNoTailscale = errors.New("tailscale is not compiled in, build with -tags tailscale")
+
+type tailscaleNode struct {
+	cfg *TailscaleConfig
+}
+
+// TailscaleDialer always returns errNoTailscale.
+func (m *Mosdns) TailscaleDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	return nil, errNoTailscale
+}
+
+func (m *Mosdns) listenTailscale(string, string) (net.Listener, error) {
+	return nil, errNoTailscale
+}
+
+func (m *Mosdns) listenPacketTailscale(string, string) (net.PacketConn, error) {
+	return nil, errNoTailscale
+}
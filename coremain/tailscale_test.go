@@ -0,0 +1,73 @@
+//go:build tailscale
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+func Test_tailscaleNode_get(t *testing.T) {
+	var calls int
+	failing := func() (*tsnet.Server, []netip.Addr, error) {
+		calls++
+		return nil, nil, errors.New("test")
+	}
+	n := new(tailscaleNode)
+	for i := 0; i < 2; i++ {
+		if _, _, err := n.get(failing); err == nil {
+			t.Fatal("get should fail")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("start should not be retried during the backoff, %d calls", calls)
+	}
+	if n.backoff != tailscaleMinBackoff {
+		t.Fatalf("unexpected backoff %s", n.backoff)
+	}
+
+	n.retryAt = time.Now().Add(-time.Second)
+	if _, _, err := n.get(failing); err == nil || calls != 2 || n.backoff != tailscaleMinBackoff*2 {
+		t.Fatalf("start is not retried after the backoff, err %v, %d calls, backoff %s", err, calls, n.backoff)
+	}
+
+	n.retryAt = time.Now().Add(-time.Second)
+	s := new(tsnet.Server)
+	ip := netip.MustParseAddr("100.64.0.1")
+	ok := func() (*tsnet.Server, []netip.Addr, error) {
+		calls++
+		return s, []netip.Addr{ip}, nil
+	}
+	for i := 0; i < 2; i++ {
+		gs, ips, err := n.get(ok)
+		if err != nil || gs != s || ips[0] != ip {
+			t.Fatalf("unexpected result %v %v %v", gs, ips, err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("started node should be reused, %d calls", calls)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const (
+	maxCapturedTraces      = 64
+	defaultCaptureCount    = 10
+	defaultCaptureDuration = time.Minute * 5
+)
+
+// traceEvent is a trace event in api responses.
+type traceEvent struct {
+	At    float64 `json:"at_ms"` // since the query arrived
+	Event string  `json:"event"`
+}
+
+func newTraceEvents(qCtx *query_context.Context) []traceEvent {
+	events := qCtx.TraceEvents()
+	out := make([]traceEvent, 0, len(events))
+	for _, e := range events {
+		out = append(out, traceEvent{At: toMs(e.Elapsed), Event: e.Msg})
+	}
+	return out
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceReport is a query captured by the trace api.
+type traceReport struct {
+	Time     time.Time    `json:"time"`
+	Entry    string       `json:"entry"`
+	Client   string       `json:"client,omitempty"`
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Rcode    string       `json:"rcode,omitempty"`
+	Upstream string       `json:"upstream,omitempty"`
+	Elapsed  float64      `json:"elapsed_ms"`
+	Err      string       `json:"error,omitempty"`
+	Trace    []traceEvent `json:"trace"`
+}
+
+func newTraceReport(entry string, qCtx *query_context.Context, err error) *traceReport {
+	q := qCtx.Q().Question[0]
+	r := &traceReport{
+		Time:    qCtx.StartTime(),
+		Entry:   entry,
+		Name:    q.Name,
+		Type:    dns.TypeToString[q.Qtype],
+		Elapsed: toMs(time.Since(qCtx.StartTime())),
+		Trace:   newTraceEvents(qCtx),
+	}
+	if addr := qCtx.ReqMeta().GetClientAddr(); addr.IsValid() {
+		r.Client = addr.String()
+	}
+	if resp := qCtx.R(); resp != nil {
+		r.Rcode = dns.RcodeToString[resp.Rcode]
+	}
+	r.Upstream, _ = query_context.GetValue(qCtx, bundled_upstream.KeyUpstream)
+	if err != nil {
+		r.Err = err.Error()
+	}
+	return r
+}
+
+// traceCapture traces queries that match the filter set by the trace
+// api, and keeps their reports.
+type traceCapture struct {
+	m         sync.Mutex
+	name      string       // fqdn, also matches subdomains. Empty matches all.
+	client    netip.Prefix // invalid matches all
+	remaining int
+	expire    time.Time
+	reports   []*traceReport
+}
+
+func (c *traceCapture) start(name string, client netip.Prefix, count int, d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.name = name
+	c.client = client
+	c.remaining = count
+	c.expire = time.Now().Add(d)
+	c.reports = nil
+}
+
+func (c *traceCapture) stop() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.remaining = 0
+	c.reports = nil
+}
+
+// forEntry returns a dns_handler.EntryHandlerOpts.Capture func of entry.
+func (c *traceCapture) forEntry(entry string) func(*dns.Msg, *query_context.RequestMeta) func(*query_context.Context, error) {
+	return func(req *dns.Msg, meta *query_context.RequestMeta) func(*query_context.Context, error) {
+		if !c.match(req, meta) {
+			return nil
+		}
+		return func(qCtx *query_context.Context, err error) {
+			r := newTraceReport(entry, qCtx, err)
+			c.m.Lock()
+			defer c.m.Unlock()
+			if len(c.reports) >= maxCapturedTraces {
+				c.reports = c.reports[1:]
+			}
+			c.reports = append(c.reports, r)
+		}
+	}
+}
+
+// match reports whether req should be captured, and counts it.
+func (c *traceCapture) match(req *dns.Msg, meta *query_context.RequestMeta) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.remaining <= 0 || time.Now().After(c.expire) || len(req.Question) == 0 {
+		return false
+	}
+	if len(c.name) > 0 && !dns.IsSubDomain(c.name, strings.ToLower(req.Question[0].Name)) {
+		return false
+	}
+	if c.client.IsValid() && !c.client.Contains(meta.GetClientAddr().Unmap()) {
+		return false
+	}
+	c.remaining--
+	return true
+}
+
+type traceStatus struct {
+	Active    bool           `json:"active"`
+	Remaining int            `json:"remaining"`
+	Reports   []*traceReport `json:"reports"`
+}
+
+func (c *traceCapture) status() *traceStatus {
+	c.m.Lock()
+	defer c.m.Unlock()
+	s := &traceStatus{Reports: append([]*traceReport(nil), c.reports...)}
+	if c.remaining > 0 && time.Now().Before(c.expire) {
+		s.Active = true
+		s.Remaining = c.remaining
+	}
+	return s
+}
+
+// handleTraceStart starts capturing traces of live queries. It replaces
+// the previous capture and its reports.
+// Query params: "name" (the domain and its subdomains, default all),
+// "client" (IP or CIDR, default all), "count" (default 10),
+// "duration" (seconds, default 300).
+func (m *Mosdns) handleTraceStart(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var name string
+	if s := query.Get("name"); len(s) > 0 {
+		if _, ok := dns.IsDomainName(s); !ok {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		name = dns.Fqdn(strings.ToLower(s))
+	}
+	var client netip.Prefix
+	if s := query.Get("client"); len(s) > 0 {
+		var err error
+		if strings.Contains(s, "/") {
+			client, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			client = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		client = client.Masked()
+	}
+	count, ok := queryInt(query.Get("count"), defaultCaptureCount)
+	if !ok || count > maxCapturedTraces {
+		http.Error(w, "invalid count", http.StatusBadRequest)
+		return
+	}
+	sec, ok := queryInt(query.Get("duration"), int(defaultCaptureDuration/time.Second))
+	if !ok {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return
+	}
+	m.traces.start(name, client, count, time.Duration(sec)*time.Second)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryInt parses a positive int query param, or returns def if s is empty.
+func queryInt(s string, def int) (int, bool) {
+	if len(s) == 0 {
+		return def, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n > 0
+}
+
+func (m *Mosdns) handleTraceStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, m.logger, m.traces.status())
+}
+
+func (m *Mosdns) handleTraceStop(w http.ResponseWriter, _ *http.Request) {
+	m.traces.stop()
+	w.WriteHeader(http.StatusNoContent)
+}
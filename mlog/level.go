@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// levelCore filters entries by enab. The wrapped core accepts all
+// levels, so loggers can be more verbose than the configured level.
+type levelCore struct {
+	zapcore.Core
+	enab zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.enab.Enabled(l)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), enab: c.enab}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+// LevelOverride overrides the level of loggers. The zero value overrides
+// nothing.
+type LevelOverride struct {
+	set atomic.Bool
+	lvl atomic.Int32
+}
+
+// Set overrides the level with l.
+func (o *LevelOverride) Set(l zapcore.Level) {
+	o.lvl.Store(int32(l))
+	o.set.Store(true)
+}
+
+// Reset removes the override.
+func (o *LevelOverride) Reset() {
+	o.set.Store(false)
+}
+
+// Get returns the overriding level, ok is false if it's not set.
+func (o *LevelOverride) Get() (l zapcore.Level, ok bool) {
+	return zapcore.Level(o.lvl.Load()), o.set.Load()
+}
+
+type overrideEnabler struct {
+	o    *LevelOverride
+	base zapcore.LevelEnabler
+}
+
+func (e overrideEnabler) Enabled(l zapcore.Level) bool {
+	if lvl, ok := e.o.Get(); ok {
+		return lvl.Enabled(l)
+	}
+	return e.base.Enabled(l)
+}
+
+// WithLevelOverride returns a logger of lg, whose level is o if it's set.
+// It's a noop if lg is not created by this package.
+func WithLevelOverride(lg *zap.Logger, o *LevelOverride) *zap.Logger {
+	return lg.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		lc, ok := c.(*levelCore)
+		if !ok {
+			return c
+		}
+		return &levelCore{Core: lc.Core, enab: overrideEnabler{o: o, base: lc.enab}}
+	}))
+}
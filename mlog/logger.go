@@ -92,8 +92,8 @@ func newLogger(
 	lvl zapcore.LevelEnabler,
 	out zapcore.WriteSyncer,
 ) *zap.Logger {
-	core := zapcore.NewCore(encoderFactory(encoderCfg), out, lvl)
-	return zap.New(core)
+	core := zapcore.NewCore(encoderFactory(encoderCfg), out, zapcore.DebugLevel)
+	return zap.New(&levelCore{Core: core, enab: lvl})
 }
 
 func L() *zap.Logger {
@@ -22,6 +22,7 @@ package bundled_upstream
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -52,6 +53,9 @@ var nopLogger = zap.NewNop()
 
 var ErrAllFailed = errors.New("all upstreams failed")
 
+// KeyUpstream is the address of the upstream that answered the query.
+var KeyUpstream = query_context.NewKey[string]("bundled_upstream.upstream")
+
 func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstreams []Upstream, logger *zap.Logger) (*dns.Msg, error) {
 	if logger == nil {
 		logger = nopLogger
@@ -60,11 +64,18 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	q := qCtx.Q()
 	t := len(upstreams)
 	if t == 1 {
-		return upstreams[0].Exchange(ctx, q)
+		start := time.Now()
+		r, err := upstreams[0].Exchange(ctx, q)
+		traceExchange(qCtx, upstreams[0], r, err, start)
+		if err == nil {
+			query_context.SetValue(qCtx, KeyUpstream, upstreams[0].Address())
+		}
+		return r, err
 	}
 
 	c := make(chan *parallelResult, t) // use buf chan to avoid blocking.
 	qCopy := q.Copy()                  // qCtx is not safe for concurrent use.
+	start := time.Now()
 	for _, u := range upstreams {
 		u := u
 		go func() {
@@ -80,6 +91,7 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	for i := 0; i < t; i++ {
 		select {
 		case res := <-c:
+			traceExchange(qCtx, res.from, res.r, res.err, start)
 			if res.err != nil {
 				logger.Warn("upstream err", qCtx.InfoField(), zap.String("addr", res.from.Address()))
 				continue
@@ -90,6 +102,7 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 			}
 
 			if res.from.Trusted() || res.r.Rcode == dns.RcodeSuccess {
+				query_context.SetValue(qCtx, KeyUpstream, res.from.Address())
 				return res.r, nil
 			}
 			continue
@@ -100,3 +113,70 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 	}
 	return nil, ErrAllFailed
 }
+
+// ExchangeSequential sends the query to upstreams one by one until
+// it gets a response from a trusted upstream or a response with
+// NOERROR rcode. If there is no such response, the last response
+// from untrusted upstreams will be returned.
+// If ctx has a deadline, each attempt gets an equal share of the time
+// that remains, so a stalled upstream cannot use up the whole deadline.
+func ExchangeSequential(ctx context.Context, qCtx *query_context.Context, upstreams []Upstream, logger *zap.Logger) (*dns.Msg, error) {
+	if logger == nil {
+		logger = nopLogger
+	}
+
+	q := qCtx.Q()
+	var fallback *dns.Msg
+	var fallbackFrom Upstream
+	for i, u := range upstreams {
+		start := time.Now()
+		r, err := exchangeAttempt(ctx, u, q, len(upstreams)-i)
+		traceExchange(qCtx, u, r, err, start)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logger.Warn("upstream err", qCtx.InfoField(), zap.String("addr", u.Address()))
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if u.Trusted() || r.Rcode == dns.RcodeSuccess {
+			query_context.SetValue(qCtx, KeyUpstream, u.Address())
+			return r, nil
+		}
+		fallback, fallbackFrom = r, u
+	}
+	if fallback != nil {
+		query_context.SetValue(qCtx, KeyUpstream, fallbackFrom.Address())
+		return fallback, nil
+	}
+	return nil, ErrAllFailed
+}
+
+// exchangeAttempt calls u.Exchange with 1/left of the time remaining
+// before the deadline of ctx.
+func exchangeAttempt(ctx context.Context, u Upstream, q *dns.Msg, left int) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || left <= 1 {
+		return u.Exchange(ctx, q)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(left))
+	defer cancel()
+	return u.Exchange(attemptCtx, q)
+}
+
+// traceExchange records the result and rtt of an exchange started at start.
+func traceExchange(qCtx *query_context.Context, u Upstream, r *dns.Msg, err error, start time.Time) {
+	if !qCtx.Tracing() {
+		return
+	}
+	rtt := float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case err != nil:
+		qCtx.Tracef("upstream %s: %s in %.3fms", u.Address(), err, rtt)
+	case r != nil:
+		qCtx.Tracef("upstream %s: %s in %.3fms", u.Address(), dns.RcodeToString[r.Rcode], rtt)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bundled_upstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type testUpstream struct {
+	addr  string
+	stall bool
+}
+
+func (u *testUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func (u *testUpstream) Trusted() bool   { return false }
+func (u *testUpstream) Address() string { return u.addr }
+
+func TestExchangeSequential_stalledUpstream(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, query_context.NewRequestMeta(netip.MustParseAddr("127.0.0.1")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	us := []Upstream{&testUpstream{addr: "stall", stall: true}, &testUpstream{addr: "ok"}}
+	r, err := ExchangeSequential(ctx, qCtx, us, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if got, _ := query_context.GetValue(qCtx, KeyUpstream); got != "ok" {
+		t.Fatalf("answered by %q, want ok", got)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layered_cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+)
+
+// LayeredCache is a fast in-memory L1 cache in front of a shared L2
+// cache, e.g. a redis that is shared by multiple instances.
+// Values are stored in both layers. L2 hits are copied to L1.
+// L1 values are prefixed with their expiration time, because their
+// expiration time in L1 is capped by l1TTL.
+type LayeredCache struct {
+	l1    *mem_cache.MemCache
+	l2    cache.Backend
+	l1TTL time.Duration
+}
+
+// NewLayeredCache returns a LayeredCache. Values are kept in l1 for at
+// most l1TTL, so updates from other instances that share l2 are seen.
+// l1TTL <= 0 means no limit.
+func NewLayeredCache(l1 *mem_cache.MemCache, l2 cache.Backend, l1TTL time.Duration) *LayeredCache {
+	return &LayeredCache{l1: l1, l2: l2, l1TTL: l1TTL}
+}
+
+func (c *LayeredCache) Get(key string) (v []byte, storedTime, expirationTime time.Time) {
+	// l1 may return expired values that are not cleaned yet.
+	if v, storedTime, l1Expiration := c.l1.Get(key); len(v) >= 8 && l1Expiration.After(time.Now()) {
+		return v[8:], storedTime, time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	v, storedTime, expirationTime = c.l2.Get(key)
+	if v != nil {
+		c.storeL1(key, v, storedTime, expirationTime)
+	}
+	return v, storedTime, expirationTime
+}
+
+func (c *LayeredCache) Store(key string, v []byte, storedTime, expirationTime time.Time) {
+	c.storeL1(key, v, storedTime, expirationTime)
+	c.l2.Store(key, v, storedTime, expirationTime)
+}
+
+func (c *LayeredCache) storeL1(key string, v []byte, storedTime, expirationTime time.Time) {
+	b := make([]byte, 8+len(v))
+	binary.BigEndian.PutUint64(b, uint64(expirationTime.UnixNano()))
+	copy(b[8:], v)
+	l1Expiration := expirationTime
+	if c.l1TTL > 0 {
+		if ddl := time.Now().Add(c.l1TTL); ddl.Before(l1Expiration) {
+			l1Expiration = ddl
+		}
+	}
+	c.l1.Store(key, b, storedTime, l1Expiration)
+}
+
+// Len returns the length of l2.
+func (c *LayeredCache) Len() int {
+	return c.l2.Len()
+}
+
+// MemoryUsage returns the memory usage of l1.
+func (c *LayeredCache) MemoryUsage() int64 {
+	return c.l1.MemoryUsage()
+}
+
+// Shrink shrinks l1.
+func (c *LayeredCache) Shrink(keep float64) {
+	c.l1.Shrink(keep)
+}
+
+// Flush flushes l1. l2 is shared and is not flushed.
+func (c *LayeredCache) Flush() {
+	c.l1.Flush()
+}
+
+func (c *LayeredCache) Close() error {
+	return errors.Join(c.l1.Close(), c.l2.Close())
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layered_cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+)
+
+func TestLayeredCache(t *testing.T) {
+	l1 := mem_cache.NewMemCache(1024, 0)
+	l2 := mem_cache.NewMemCache(1024, 0)
+	c := NewLayeredCache(l1, l2, time.Minute)
+	defer c.Close()
+
+	now := time.Now()
+	exp := now.Add(time.Hour)
+	c.Store("a", []byte("1"), now, exp)
+	if v, _, e := l1.Get("a"); len(v) != 9 || e.After(now.Add(time.Minute+time.Second)) {
+		t.Fatalf("unexpected l1 value %s, expiration %v", v, e)
+	}
+	// The expiration time of l1 is capped, but not the returned one.
+	if v, _, e := c.Get("a"); string(v) != "1" || !e.Equal(exp) {
+		t.Fatalf("unexpected value %s, expiration %v", v, e)
+	}
+	if v, _, e := l2.Get("a"); string(v) != "1" || !e.Equal(exp) {
+		t.Fatalf("unexpected l2 value %s, expiration %v", v, e)
+	}
+
+	// Values from another instance are copied to l1.
+	l2.Store("b", []byte("2"), now, exp)
+	if v, _, _ := c.Get("b"); string(v) != "2" {
+		t.Fatalf("want 2 from l2, got %s", v)
+	}
+	if v, _, _ := l1.Get("b"); len(v) != 9 {
+		t.Fatal("l2 hit should be copied to l1")
+	}
+
+	c.Flush()
+	if l1.Len() != 0 || l2.Len() != 2 {
+		t.Fatalf("flush should only flush l1, l1 %d, l2 %d", l1.Len(), l2.Len())
+	}
+}
+
+func TestLayeredCache_l1Expired(t *testing.T) {
+	l1 := mem_cache.NewMemCache(1024, 0)
+	l2 := mem_cache.NewMemCache(1024, 0)
+	c := NewLayeredCache(l1, l2, time.Millisecond*50)
+	defer c.Close()
+
+	now := time.Now()
+	exp := now.Add(time.Hour)
+	c.Store("a", []byte("1"), now, exp)
+	l2.Store("a", []byte("2"), now, exp) // updated by another instance
+	time.Sleep(time.Millisecond * 100)
+
+	// The l1 value expired but was not cleaned, l2 is read.
+	if v, _, e := c.Get("a"); string(v) != "2" || !e.Equal(exp) {
+		t.Fatalf("want 2 from l2, got %s, expiration %v", v, e)
+	}
+}
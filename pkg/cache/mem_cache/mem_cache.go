@@ -137,3 +137,43 @@ func (c *MemCache) cleanFunc() func(_ string, v *elem) bool {
 func (c *MemCache) Len() int {
 	return c.lru.Len()
 }
+
+// elemOverhead is a rough estimation of the memory used by an elem and
+// its lru node besides the key and value bytes.
+const elemOverhead = 128
+
+// MemoryUsage returns the approximate memory usage of all cached
+// entries in bytes. It scans the whole cache, so it should not be
+// called frequently.
+func (c *MemCache) MemoryUsage() int64 {
+	var n int64
+	c.lru.Clean(func(key string, v *elem) bool {
+		n += int64(len(key)+len(v.v)) + elemOverhead
+		return false
+	})
+	return n
+}
+
+// Shrink discards expired entries and then the least recently used
+// entries, keeping approximately keep (0~1) of the cache.
+func (c *MemCache) Shrink(keep float64) {
+	c.lru.Clean(c.cleanFunc())
+	c.lru.Shrink(keep)
+}
+
+// Flush removes all entries.
+func (c *MemCache) Flush() {
+	c.lru.Clean(func(string, *elem) bool { return true })
+}
+
+// Range calls f for every entry that is not expired. The caller
+// should not modify v.
+func (c *MemCache) Range(f func(key string, v []byte, storedTime, expirationTime time.Time)) {
+	now := time.Now()
+	c.lru.Clean(func(key string, e *elem) bool {
+		if e.expirationTime.After(now) {
+			f(key, e.v, e.storedTime, e.expirationTime)
+		}
+		return false
+	})
+}
@@ -80,3 +80,27 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func Test_memCache_MemoryUsage(t *testing.T) {
+	c := NewMemCache(1024, -1)
+	defer c.Close()
+	if n := c.MemoryUsage(); n != 0 {
+		t.Fatalf("empty cache should have 0 usage, got %d", n)
+	}
+	c.Store("key", make([]byte, 100), time.Now(), time.Now().Add(time.Minute))
+	if n, want := c.MemoryUsage(), int64(3+100+elemOverhead); n != want {
+		t.Fatalf("want %d, got %d", want, n)
+	}
+}
+
+func Test_memCache_Flush(t *testing.T) {
+	c := NewMemCache(1024, -1)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		c.Store(strconv.Itoa(i), []byte{1}, time.Now(), time.Now().Add(time.Minute))
+	}
+	c.Flush()
+	if n := c.Len(); n != 0 {
+		t.Fatalf("want empty cache, got %d entries", n)
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cluster replicates plugin states between mosdns instances,
+// e.g. a pair of routers behind VRRP, so the standby does not start
+// cold after a failover. Updates are pushed to peers over http in
+// batches. A node pulls snapshots from its peers when it starts.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	syncPath     = "/cluster/sync"
+	snapshotPath = "/cluster/snapshot"
+
+	defaultFlushInterval = time.Second
+	defaultMaxPending    = 65536
+	requestTimeout       = time.Second * 10
+	maxBodySize          = 256 << 20
+)
+
+var nopLogger = zap.NewNop()
+
+// Channel is a replicated state of a plugin.
+type Channel interface {
+	// Snapshot returns the full state. It can return nil if the
+	// channel does not support snapshots.
+	Snapshot() ([]byte, error)
+
+	// Apply applies an update or a snapshot from a peer. Apply must
+	// not publish the changes it made again.
+	Apply(b []byte) error
+}
+
+type Opts struct {
+	// NodeName identifies this node in logs of peers.
+	NodeName string
+
+	// Peers are base urls of the api of other nodes.
+	// e.g. "http://192.168.1.2:8080".
+	Peers []string
+
+	// Secret is required by requests between nodes.
+	Secret string
+
+	// FlushInterval is the interval to push updates. Default is 1s.
+	FlushInterval time.Duration
+
+	// MaxPending is the maximum number of updates waiting to be pushed.
+	// New updates are dropped if it is reached. Default is 65536.
+	MaxPending int
+
+	Logger     *zap.Logger
+	HTTPClient *http.Client
+}
+
+type Cluster struct {
+	opts Opts
+
+	cm       sync.RWMutex
+	channels map[string]Channel
+
+	pm      sync.Mutex
+	pending []Update
+	dropped int
+}
+
+// Update is an update of a channel.
+type Update struct {
+	Channel string `json:"channel"`
+	Data    []byte `json:"data"`
+}
+
+type batch struct {
+	Node    string   `json:"node"`
+	Updates []Update `json:"updates"`
+}
+
+func New(opts Opts) (*Cluster, error) {
+	if len(opts.Peers) == 0 {
+		return nil, errors.New("no peer is configured")
+	}
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("secret is required")
+	}
+	opts.Peers = append([]string(nil), opts.Peers...)
+	for i, p := range opts.Peers {
+		u, err := url.Parse(p)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid peer url %s", p)
+		}
+		opts.Peers[i] = strings.TrimSuffix(p, "/")
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultMaxPending
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: requestTimeout}
+	}
+	return &Cluster{opts: opts, channels: make(map[string]Channel)}, nil
+}
+
+// Register registers a channel. Plugins usually use their tags as names.
+// A channel replaces the one of the same name, which is registered by
+// the old plugin before a config reload.
+func (c *Cluster) Register(name string, ch Channel) error {
+	c.cm.Lock()
+	defer c.cm.Unlock()
+	c.channels[name] = ch
+	return nil
+}
+
+func (c *Cluster) getChannel(name string) Channel {
+	c.cm.RLock()
+	defer c.cm.RUnlock()
+	return c.channels[name]
+}
+
+// Publish queues an update of the channel. It never blocks. b must not
+// be modified after the call.
+func (c *Cluster) Publish(channel string, b []byte) {
+	c.pm.Lock()
+	defer c.pm.Unlock()
+	if len(c.pending) >= c.opts.MaxPending {
+		c.dropped++
+		return
+	}
+	c.pending = append(c.pending, Update{Channel: channel, Data: b})
+}
+
+// Run pulls snapshots from peers and then pushes updates periodically
+// until closeSignal is closed. It is compatible with safe_close.
+func (c *Cluster) Run(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-closeSignal
+		cancel()
+	}()
+
+	c.pullSnapshots(ctx)
+
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cluster) flush(ctx context.Context) {
+	c.pm.Lock()
+	updates, dropped := c.pending, c.dropped
+	c.pending, c.dropped = nil, 0
+	c.pm.Unlock()
+	if dropped > 0 {
+		c.opts.Logger.Warn("too many pending updates, some were dropped", zap.Int("dropped", dropped))
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(batch{Node: c.opts.NodeName, Updates: updates})
+	if err != nil {
+		c.opts.Logger.Error("failed to marshal updates", zap.Error(err))
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range c.opts.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.push(ctx, peer, b); err != nil && ctx.Err() == nil {
+				c.opts.Logger.Warn("failed to push updates", zap.String("peer", peer), zap.Int("updates", len(updates)), zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) push(ctx context.Context, peer string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+syncPath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do(req)
+	return err
+}
+
+func (c *Cluster) do(req *http.Request) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+c.opts.Secret)
+	res, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+// pullSnapshots applies the snapshot of every channel from the first
+// peer that has it.
+func (c *Cluster) pullSnapshots(ctx context.Context) {
+	c.cm.RLock()
+	names := make([]string, 0, len(c.channels))
+	for name := range c.channels {
+		names = append(names, name)
+	}
+	c.cm.RUnlock()
+
+	for _, name := range names {
+		ch := c.getChannel(name)
+		for _, peer := range c.opts.Peers {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+snapshotPath+"?channel="+url.QueryEscape(name), nil)
+			if err != nil {
+				continue
+			}
+			b, err := c.do(req)
+			if err != nil {
+				c.opts.Logger.Info("failed to pull snapshot", zap.String("channel", name), zap.String("peer", peer), zap.Error(err))
+				continue
+			}
+			if err := ch.Apply(b); err != nil {
+				c.opts.Logger.Warn("failed to apply snapshot", zap.String("channel", name), zap.String("peer", peer), zap.Error(err))
+				continue
+			}
+			c.opts.Logger.Info("snapshot applied", zap.String("channel", name), zap.String("peer", peer), zap.Int("size", len(b)))
+			break
+		}
+	}
+}
+
+// ServeHTTP serves requests from peers. It should be mounted at "/cluster/".
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(c.opts.Secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case req.URL.Path == syncPath && req.Method == http.MethodPost:
+		bt := new(batch)
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxBodySize)).Decode(bt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, u := range bt.Updates {
+			ch := c.getChannel(u.Channel)
+			if ch == nil {
+				continue
+			}
+			if err := ch.Apply(u.Data); err != nil {
+				c.opts.Logger.Warn("failed to apply update", zap.String("node", bt.Node), zap.String("channel", u.Channel), zap.Error(err))
+			}
+		}
+	case req.URL.Path == snapshotPath && req.Method == http.MethodGet:
+		ch := c.getChannel(req.URL.Query().Get("channel"))
+		if ch == nil {
+			http.Error(w, "channel not found", http.StatusNotFound)
+			return
+		}
+		b, err := ch.Snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			http.Error(w, "snapshot is not supported", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cluster
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testChannel struct {
+	m      sync.Mutex
+	values []string
+}
+
+func (c *testChannel) Snapshot() ([]byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return []byte(strings.Join(c.values, ",")), nil
+}
+
+func (c *testChannel) Apply(b []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.values = append(c.values, strings.Split(string(b), ",")...)
+	return nil
+}
+
+func (c *testChannel) get() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return strings.Join(c.values, ",")
+}
+
+func TestCluster(t *testing.T) {
+	chA := &testChannel{values: []string{"a", "b"}}
+	a, err := New(Opts{NodeName: "a", Peers: []string{"http://127.0.0.1:1"}, Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register("test", chA); err != nil {
+		t.Fatal(err)
+	}
+	sa := httptest.NewServer(a)
+	defer sa.Close()
+
+	chB := new(testChannel)
+	b, err := New(Opts{NodeName: "b", Peers: []string{sa.URL + "/"}, Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register("test", chB); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	b.pullSnapshots(ctx)
+	if got := chB.get(); got != "a,b" {
+		t.Fatalf("snapshot is not applied, got %q", got)
+	}
+
+	b.Publish("test", []byte("c"))
+	b.Publish("unknown", []byte("x"))
+	b.flush(ctx)
+	if got := chA.get(); got != "a,b,c" {
+		t.Fatalf("update is not applied, got %q", got)
+	}
+
+	wrong, _ := New(Opts{Peers: []string{sa.URL}, Secret: "wrong"})
+	if err := wrong.push(ctx, sa.URL, []byte(`{"updates":[{"channel":"test","data":"ZA=="}]}`)); err == nil {
+		t.Fatal("request with a wrong secret should fail")
+	}
+	if got := chA.get(); got != "a,b,c" {
+		t.Fatalf("unauthorized update is applied, got %q", got)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_limiter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+var ErrQueueFull = errors.New("too many concurrent requests")
+
+// ConcurrencyLimiter limits the number of concurrent requests. Requests
+// over the limit wait in a bounded queue.
+type ConcurrencyLimiter struct {
+	sem      chan struct{}
+	maxQueue int64
+	queued   atomic.Int64
+	rejected atomic.Uint64
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter that allows max
+// concurrent requests and at most maxQueue waiting requests. max must
+// be positive.
+func NewConcurrencyLimiter(max, maxQueue int) *ConcurrencyLimiter {
+	if max <= 0 {
+		panic("concurrent_limiter: non-positive max")
+	}
+	return &ConcurrencyLimiter{sem: make(chan struct{}, max), maxQueue: int64(maxQueue)}
+}
+
+// Acquire waits until the request can run. It returns ErrQueueFull if
+// the queue is full, or the cause of ctx if ctx is done while waiting.
+// Release must be called if Acquire returns nil.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return ErrQueueFull
+	}
+	defer l.queued.Add(-1)
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (l *ConcurrencyLimiter) Release() {
+	<-l.sem
+}
+
+// Running returns the number of running requests.
+func (l *ConcurrencyLimiter) Running() int {
+	return len(l.sem)
+}
+
+// Queued returns the number of waiting requests.
+func (l *ConcurrencyLimiter) Queued() int {
+	return int(l.queued.Load())
+}
+
+// Rejected returns the number of requests rejected by a full queue.
+func (l *ConcurrencyLimiter) Rejected() uint64 {
+	return l.rejected.Load()
+}
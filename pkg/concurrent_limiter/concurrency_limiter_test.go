@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_ConcurrencyLimiter(t *testing.T) {
+	l := NewConcurrencyLimiter(2, 1)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.Acquire(ctx) }()
+	for l.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.Acquire(ctx); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want ErrQueueFull, got %v", err)
+	}
+	if l.Rejected() != 1 {
+		t.Fatalf("rejected = %d", l.Rejected())
+	}
+
+	l.Release()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if l.Running() != 2 || l.Queued() != 0 {
+		t.Fatalf("running = %d, queued = %d", l.Running(), l.Queued())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	if err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if l.Queued() != 0 {
+		t.Fatalf("queued = %d", l.Queued())
+	}
+}
@@ -66,6 +66,15 @@ func (c *ShardedLRU[V]) Clean(f func(key string, v V) (remove bool)) (removed in
 	return removed
 }
 
+// Shrink removes the oldest entries of each shard, keeping
+// approximately keep (0~1) of its entries.
+func (c *ShardedLRU[V]) Shrink(keep float64) (removed int) {
+	for i := range c.l {
+		removed += c.l[i].Shrink(int(float64(c.l[i].Len()) * keep))
+	}
+	return removed
+}
+
 func (c *ShardedLRU[V]) Get(key string) (v V, ok bool) {
 	sl := c.getShard(key)
 	v, ok = sl.Get(key)
@@ -127,6 +136,20 @@ func (c *ConcurrentLRU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed i
 	return c.lru.Clean(f)
 }
 
+func (c *ConcurrentLRU[K, V]) Range(f func(key K, v V) bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lru.Range(f)
+}
+
+func (c *ConcurrentLRU[K, V]) Shrink(size int) (removed int) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Shrink(size)
+}
+
 func (c *ConcurrentLRU[K, V]) Get(key K) (v V, ok bool) {
 	c.Lock()
 	defer c.Unlock()
@@ -23,11 +23,13 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/remote_kv"
 	"github.com/pmkol/mosdns-x/pkg/safe_close"
 )
 
@@ -58,10 +60,35 @@ func (m *DataManager) GetDataProvider(name string) *DataProvider {
 	return m.ps[name]
 }
 
+// GetDataProviders returns a copy of all DataProvider(s).
+func (m *DataManager) GetDataProviders() map[string]*DataProvider {
+	m.pm.RLock()
+	defer m.pm.RUnlock()
+	ps := make(map[string]*DataProvider, len(m.ps))
+	for name, p := range m.ps {
+		ps[name] = p
+	}
+	return ps
+}
+
 type DataProviderConfig struct {
 	Tag        string `yaml:"tag"`
 	File       string `yaml:"file"`
 	AutoReload bool   `yaml:"auto_reload"`
+
+	// Redis loads data from a redis key instead of a file.
+	// Format: redis://<user>:<password>@<host>:<port>/<db_number>
+	Redis string `yaml:"redis"`
+	// RedisKey is the key that stores the data. It can be a string,
+	// a list or a set. Elements of list and set will be joined by "\n".
+	RedisKey string `yaml:"redis_key"`
+	// RedisChannel is the pub/sub channel to watch. Any message
+	// published to it triggers a reload. Optional.
+	RedisChannel string `yaml:"redis_channel"`
+
+	// KV loads data from a Consul or etcd key. See remote_kv.NewClient
+	// for the url format. If AutoReload is true, the key will be watched.
+	KV string `yaml:"kv"`
 }
 
 type DataProvider struct {
@@ -69,9 +96,21 @@ type DataProvider struct {
 	file       string
 	autoReload bool
 
+	redis *redisSource
+	kv    remote_kv.Client
+
 	lm        sync.Mutex
 	listeners map[DataListener]struct{}
 
+	om      sync.Mutex // protects runtime
+	runtime runtimeEntries
+	fm      sync.Mutex // serializes writes to file
+
+	dataSize atomic.Int64  // size of the latest loaded data
+	kvIndex  atomic.Uint64 // modify index of the latest loaded kv data
+	stats    atomic.Pointer[Stats]
+	data     atomic.Pointer[[]byte] // the data that was last passed to listeners
+
 	sc *safe_close.SafeClose
 }
 
@@ -83,17 +122,49 @@ func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, err
 
 	dp.sc = safe_close.NewSafeClose()
 
+	if len(cfg.Redis) > 0 {
+		rs, err := newRedisSource(cfg.Redis, cfg.RedisKey, cfg.RedisChannel)
+		if err != nil {
+			return nil, err
+		}
+		dp.redis = rs
+	}
+	if len(cfg.KV) > 0 {
+		c, err := remote_kv.NewClient(cfg.KV)
+		if err != nil {
+			dp.Close()
+			return nil, fmt.Errorf("invalid kv url, %w", err)
+		}
+		dp.kv = c
+	}
+
 	if err := dp.init(); err != nil {
+		dp.Close()
 		return nil, err
 	}
 	return dp, nil
 }
 
 func (ds *DataProvider) init() error {
-	_, err := ds.loadFromDisk()
+	b, err := ds.GetData()
 	if err != nil {
 		return err
 	}
+	ds.setLoaded(b)
+
+	if ds.redis != nil {
+		if len(ds.redis.channel) > 0 {
+			ds.startRedisWatcher()
+		}
+		return nil
+	}
+
+	if ds.kv != nil {
+		if ds.autoReload {
+			ds.startKVWatcher()
+		}
+		return nil
+	}
 
 	if ds.autoReload {
 		if err := ds.startFsWatcher(); err != nil {
@@ -106,6 +177,9 @@ func (ds *DataProvider) init() error {
 func (ds *DataProvider) Close() {
 	ds.sc.Done()
 	ds.sc.CloseWait()
+	if ds.redis != nil {
+		_ = ds.redis.client.Close()
+	}
 }
 
 // LoadAndAddListener loads the DataListener, returns any error that occurs, and
@@ -119,6 +193,7 @@ func (ds *DataProvider) LoadAndAddListener(l DataListener) error {
 	if err := l.Update(b); err != nil {
 		return err
 	}
+	ds.setLoaded(b)
 
 	ds.lm.Lock()
 	if ds.listeners == nil {
@@ -135,12 +210,42 @@ func (ds *DataProvider) DeleteListener(l DataListener) {
 	delete(ds.listeners, l)
 }
 
+// GetData returns the data with runtime entries applied.
 func (ds *DataProvider) GetData() ([]byte, error) {
-	return os.ReadFile(ds.file)
+	b, err := ds.loadData()
+	if err != nil {
+		return nil, err
+	}
+	return ds.applyRuntimeEntries(b), nil
+}
+
+// File returns the file path (or the redis key) of this DataProvider.
+func (ds *DataProvider) File() string {
+	switch {
+	case ds.redis != nil:
+		return ds.redis.key
+	case ds.kv != nil:
+		return ds.kv.Key()
+	}
+	return ds.file
+}
+
+// DataSize returns the size of the latest loaded data in bytes.
+func (ds *DataProvider) DataSize() int64 {
+	return ds.dataSize.Load()
+}
+
+// ListenerNum returns the number of listeners attached to this DataProvider.
+func (ds *DataProvider) ListenerNum() int {
+	ds.lm.Lock()
+	defer ds.lm.Unlock()
+	return len(ds.listeners)
 }
 
 // pushData notify the notifier and trigger all listeners.
 func (ds *DataProvider) pushData(newData []byte) {
+	newData = ds.applyRuntimeEntries(newData)
+	ds.setLoaded(newData)
 	ds.lm.Lock()
 	ls := make([]DataListener, 0, len(ds.listeners))
 	for listener := range ds.listeners {
@@ -158,8 +263,22 @@ func (ds *DataProvider) pushData(newData []byte) {
 	}
 }
 
-func (ds *DataProvider) loadFromDisk() ([]byte, error) {
-	return os.ReadFile(ds.file)
+func (ds *DataProvider) loadData() ([]byte, error) {
+	var b []byte
+	var err error
+	switch {
+	case ds.redis != nil:
+		b, err = ds.redis.load()
+	case ds.kv != nil:
+		b, err = ds.loadKV()
+	default:
+		b, err = os.ReadFile(ds.file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds.dataSize.Store(int64(len(b)))
+	return b, nil
 }
 
 func (ds *DataProvider) startFsWatcher() error {
@@ -210,7 +329,7 @@ func (ds *DataProvider) startFsWatcher() error {
 							"reloading file",
 							zap.String("file", ds.file),
 						)
-						if v, err := ds.loadFromDisk(); err != nil {
+						if v, err := ds.loadData(); err != nil {
 							ds.logger.Error(
 								"failed to reload file",
 								zap.String("file", ds.file),
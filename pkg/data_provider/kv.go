@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/remote_kv"
+)
+
+const (
+	kvLoadTimeout = time.Second * 10
+	kvRetryDelay  = time.Second * 5
+)
+
+func (ds *DataProvider) loadKV() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kvLoadTimeout)
+	defer cancel()
+	b, index, err := ds.kv.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ds.kvIndex.Store(index)
+	return b, nil
+}
+
+// startKVWatcher watches the kv key and pushes new data to listeners.
+func (ds *DataProvider) startKVWatcher() {
+	ds.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeSignal
+			cancel()
+		}()
+
+		remote_kv.Watch(ctx, ds.kv, ds.kvIndex.Load(), kvRetryDelay,
+			func(v []byte) {
+				ds.logger.Info("kv data updated", zap.String("key", ds.kv.Key()))
+				ds.dataSize.Store(int64(len(v)))
+				ds.pushData(v)
+			},
+			func(err error) {
+				ds.logger.Error("failed to watch kv", zap.String("key", ds.kv.Key()), zap.Error(err))
+			},
+		)
+	})
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const redisLoadTimeout = time.Second * 10
+
+type redisSource struct {
+	client  *redis.Client
+	key     string
+	channel string
+}
+
+func newRedisSource(url, key, channel string) (*redisSource, error) {
+	if len(key) == 0 {
+		return nil, errors.New("redis key is required")
+	}
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url, %w", err)
+	}
+	return &redisSource{
+		client:  redis.NewClient(opt),
+		key:     key,
+		channel: channel,
+	}, nil
+}
+
+// load reads the data from the redis key. Strings are returned as is.
+// Lists and sets are joined by "\n".
+func (s *redisSource) load() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisLoadTimeout)
+	defer cancel()
+
+	typ, err := s.client.Type(ctx, s.key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key type, %w", err)
+	}
+
+	var elems []string
+	switch typ {
+	case "string":
+		return s.client.Get(ctx, s.key).Bytes()
+	case "list":
+		elems, err = s.client.LRange(ctx, s.key, 0, -1).Result()
+	case "set":
+		elems, err = s.client.SMembers(ctx, s.key).Result()
+	case "none":
+		return nil, fmt.Errorf("redis key %s does not exist", s.key)
+	default:
+		return nil, fmt.Errorf("unsupported redis key type %s", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(elems, "\n")), nil
+}
+
+// startRedisWatcher subscribes to the redis channel and reloads the
+// data when a message is received.
+func (ds *DataProvider) startRedisWatcher() {
+	rs := ds.redis
+	ps := rs.client.Subscribe(context.Background(), rs.channel)
+	ds.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		defer ps.Close()
+		c := ps.Channel()
+		for {
+			select {
+			case _, ok := <-c:
+				if !ok {
+					return
+				}
+				ds.logger.Info(
+					"redis invalidation received, reloading data",
+					zap.String("key", rs.key),
+				)
+				if v, err := ds.loadData(); err != nil {
+					ds.logger.Error(
+						"failed to reload data from redis",
+						zap.String("key", rs.key),
+						zap.Error(err),
+					)
+				} else {
+					ds.pushData(v)
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.uber.org/zap"
+)
+
+type chanListener chan []byte
+
+func (l chanListener) Update(b []byte) error {
+	l <- b
+	return nil
+}
+
+// waitNoConn waits until all connections to s are closed.
+func waitNoConn(t *testing.T, s *miniredis.Miniredis) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for s.CurrentConnectionCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d redis connections are not closed", s.CurrentConnectionCount())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func Test_DataProvider_redis(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.RPush("rules", "a.example.com", "b.example.com")
+
+	dp, err := NewDataProvider(zap.NewNop(), DataProviderConfig{
+		Redis:        "redis://" + s.Addr(),
+		RedisKey:     "rules",
+		RedisChannel: "reload",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := make(chanListener, 1)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-l; string(b) != "a.example.com\nb.example.com" {
+		t.Fatalf("unexpected data %q", b)
+	}
+
+	s.Del("rules")
+	s.Set("rules", "c.example.com")
+	deadline := time.After(time.Second * 5)
+	for done := false; !done; {
+		s.Publish("reload", "") // the subscription may not be ready yet
+		select {
+		case b := <-l:
+			if string(b) != "c.example.com" {
+				t.Fatalf("unexpected data %q", b)
+			}
+			done = true
+		case <-time.After(time.Millisecond * 50):
+		case <-deadline:
+			t.Fatal("data is not reloaded")
+		}
+	}
+
+	dp.Close()
+	waitNoConn(t, s)
+}
+
+func Test_NewDataProvider_redisInitError(t *testing.T) {
+	s := miniredis.RunT(t)
+	tests := []struct {
+		name string
+		cfg  DataProviderConfig
+	}{
+		{"missing key", DataProviderConfig{Redis: "redis://" + s.Addr(), RedisKey: "missing"}},
+		{"invalid kv", DataProviderConfig{Redis: "redis://" + s.Addr(), RedisKey: "k", KV: "consul:///k"}},
+	}
+	s.HSet("hash", "f", "v")
+	tests = append(tests, struct {
+		name string
+		cfg  DataProviderConfig
+	}{"unsupported type", DataProviderConfig{Redis: "redis://" + s.Addr(), RedisKey: "hash", RedisChannel: "c"}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDataProvider(zap.NewNop(), tt.cfg); err == nil {
+				t.Fatal("NewDataProvider should fail")
+			}
+			waitNoConn(t, s)
+		})
+	}
+}
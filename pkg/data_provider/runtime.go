@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrPersistNotSupported is returned if entries are persisted to a
+// DataProvider that is not backed by a file.
+var ErrPersistNotSupported = errors.New("persistence is only supported by file data providers")
+
+// runtimeEntries are entries added or removed at runtime. They are
+// applied on top of the loaded data.
+type runtimeEntries struct {
+	added   map[string]time.Time // entry -> expire time, zero means never
+	removed map[string]struct{}
+}
+
+// RuntimeEntries is a snapshot of runtime entries of a DataProvider.
+type RuntimeEntries struct {
+	Added   []RuntimeEntry `json:"added"`
+	Removed []string       `json:"removed"`
+}
+
+type RuntimeEntry struct {
+	Entry  string     `json:"entry"`
+	Expire *time.Time `json:"expire,omitempty"`
+}
+
+// AddEntries adds entries to this DataProvider and pushes the new data to
+// all listeners. If ttl > 0, entries will be removed after ttl.
+// If persist is true, entries will be appended to the backing file
+// instead. ttl and persist are mutually exclusive.
+func (ds *DataProvider) AddEntries(entries []string, ttl time.Duration, persist bool) error {
+	entries = cleanEntries(entries)
+	if len(entries) == 0 {
+		return errors.New("no entry")
+	}
+	if persist && ttl > 0 {
+		return errors.New("entries with ttl cannot be persisted")
+	}
+	if persist {
+		if err := ds.persistEntries(entries, nil); err != nil {
+			return err
+		}
+	}
+
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+	ds.om.Lock()
+	for _, e := range entries {
+		delete(ds.runtime.removed, e)
+		if !persist {
+			if ds.runtime.added == nil {
+				ds.runtime.added = make(map[string]time.Time)
+			}
+			ds.runtime.added[e] = expire
+		}
+	}
+	ds.om.Unlock()
+
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() { ds.expireEntries(entries, expire) })
+	}
+	return ds.Reload()
+}
+
+// RemoveEntries removes entries from this DataProvider and pushes the new
+// data to all listeners. If persist is true, entries will also be removed
+// from the backing file.
+func (ds *DataProvider) RemoveEntries(entries []string, persist bool) error {
+	entries = cleanEntries(entries)
+	if len(entries) == 0 {
+		return errors.New("no entry")
+	}
+	if persist {
+		if err := ds.persistEntries(nil, entries); err != nil {
+			return err
+		}
+	}
+
+	ds.om.Lock()
+	for _, e := range entries {
+		delete(ds.runtime.added, e)
+		if !persist {
+			if ds.runtime.removed == nil {
+				ds.runtime.removed = make(map[string]struct{})
+			}
+			ds.runtime.removed[e] = struct{}{}
+		}
+	}
+	ds.om.Unlock()
+	return ds.Reload()
+}
+
+// GetRuntimeEntries returns a snapshot of runtime entries.
+func (ds *DataProvider) GetRuntimeEntries() RuntimeEntries {
+	ds.om.Lock()
+	defer ds.om.Unlock()
+	s := RuntimeEntries{
+		Added:   make([]RuntimeEntry, 0, len(ds.runtime.added)),
+		Removed: make([]string, 0, len(ds.runtime.removed)),
+	}
+	for e, expire := range ds.runtime.added {
+		re := RuntimeEntry{Entry: e}
+		if !expire.IsZero() {
+			expire := expire
+			re.Expire = &expire
+		}
+		s.Added = append(s.Added, re)
+	}
+	for e := range ds.runtime.removed {
+		s.Removed = append(s.Removed, e)
+	}
+	sort.Slice(s.Added, func(i, j int) bool { return s.Added[i].Entry < s.Added[j].Entry })
+	sort.Strings(s.Removed)
+	return s
+}
+
+func (ds *DataProvider) expireEntries(entries []string, expire time.Time) {
+	changed := false
+	ds.om.Lock()
+	for _, e := range entries {
+		// The entry may be re-added with another ttl.
+		if t, ok := ds.runtime.added[e]; ok && t.Equal(expire) {
+			delete(ds.runtime.added, e)
+			changed = true
+		}
+	}
+	ds.om.Unlock()
+	if changed {
+		if err := ds.Reload(); err != nil {
+			ds.logger.Error("failed to reload data after entries expired", zap.String("file", ds.File()), zap.Error(err))
+		}
+	}
+}
+
+// Reload loads the data and pushes it to all listeners.
+func (ds *DataProvider) Reload() error {
+	b, err := ds.loadData()
+	if err != nil {
+		return err
+	}
+	ds.pushData(b)
+	return nil
+}
+
+// applyRuntimeEntries returns b with runtime entries applied.
+func (ds *DataProvider) applyRuntimeEntries(b []byte) []byte {
+	ds.om.Lock()
+	defer ds.om.Unlock()
+	return ds.runtime.apply(b)
+}
+
+func (r *runtimeEntries) apply(b []byte) []byte {
+	if len(r.added) == 0 && len(r.removed) == 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+	if len(r.removed) == 0 {
+		out = append(out, b...)
+	} else {
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			if _, ok := r.removed[entryOfLine(s.Text())]; ok {
+				continue
+			}
+			out = append(out, s.Bytes()...)
+			out = append(out, '\n')
+		}
+	}
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	for e := range r.added {
+		out = append(out, e...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// persistEntries appends add to and deletes del from the backing file.
+func (ds *DataProvider) persistEntries(add, del []string) error {
+	if ds.redis != nil || ds.kv != nil || len(ds.file) == 0 {
+		return ErrPersistNotSupported
+	}
+	ds.fm.Lock()
+	defer ds.fm.Unlock()
+
+	b, err := os.ReadFile(ds.file)
+	if err != nil {
+		return err
+	}
+	r := runtimeEntries{removed: make(map[string]struct{}, len(del))}
+	for _, e := range del {
+		r.removed[e] = struct{}{}
+	}
+	if len(add) > 0 {
+		exist := make(map[string]struct{})
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			exist[entryOfLine(s.Text())] = struct{}{}
+		}
+		r.added = make(map[string]time.Time, len(add))
+		for _, e := range add {
+			if _, ok := exist[e]; !ok {
+				r.added[e] = time.Time{}
+			}
+		}
+	}
+	return os.WriteFile(ds.file, r.apply(b), 0644)
+}
+
+// entryOfLine returns the line without comments and spaces.
+func entryOfLine(s string) string {
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func cleanEntries(entries []string) []string {
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e = entryOfLine(e); len(e) > 0 {
+			out = append(out, e)
+		}
+	}
+	return out
+}
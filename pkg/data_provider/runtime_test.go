@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testListener struct {
+	m sync.Mutex
+	b []byte
+}
+
+func (l *testListener) Update(b []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.b = b
+	return nil
+}
+
+func (l *testListener) entries() []string {
+	l.m.Lock()
+	defer l.m.Unlock()
+	var s []string
+	for _, line := range strings.Split(string(l.b), "\n") {
+		if e := entryOfLine(line); len(e) > 0 {
+			s = append(s, e)
+		}
+	}
+	sort.Strings(s)
+	return s
+}
+
+func Test_RuntimeEntries(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(f, []byte("a.com\nb.com # comment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want ...string) {
+		t.Helper()
+		if got := l.entries(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	if err := dp.AddEntries([]string{"c.com", " "}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	check("a.com", "b.com", "c.com")
+	if err := dp.RemoveEntries([]string{"b.com", "c.com"}, false); err != nil {
+		t.Fatal(err)
+	}
+	check("a.com")
+	if s := dp.GetRuntimeEntries(); len(s.Added) != 0 || len(s.Removed) != 2 {
+		t.Fatalf("unexpected runtime entries %+v", s)
+	}
+
+	// ttl
+	if err := dp.AddEntries([]string{"d.com"}, time.Millisecond*50, false); err != nil {
+		t.Fatal(err)
+	}
+	check("a.com", "d.com")
+	time.Sleep(time.Millisecond * 200)
+	check("a.com")
+
+	// persist
+	if err := dp.AddEntries([]string{"e.com", "a.com"}, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.RemoveEntries([]string{"a.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+	check("e.com")
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "b.com # comment\ne.com\n"; got != want {
+		t.Fatalf("file: got %q, want %q", got, want)
+	}
+	if err := dp.AddEntries([]string{"f.com"}, time.Second, true); err == nil {
+		t.Fatal("ttl entries should not be persisted")
+	}
+}
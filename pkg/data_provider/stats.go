@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+)
+
+// Stats describes the data that was last loaded by a DataProvider,
+// so operators can verify which version of a list is in use.
+type Stats struct {
+	Entries  int       `json:"entries"` // lines that are not empty or comments
+	Digest   string    `json:"digest"`  // sha256 of the data, hex encoded
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+func newStats(b []byte) *Stats {
+	s := &Stats{LoadedAt: time.Now()}
+	sum := sha256.Sum256(b)
+	s.Digest = hex.EncodeToString(sum[:])
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if len(entryOfLine(sc.Text())) > 0 {
+			s.Entries++
+		}
+	}
+	return s
+}
+
+func (ds *DataProvider) setLoaded(b []byte) {
+	ds.data.Store(&b)
+	ds.stats.Store(newStats(b))
+}
+
+// Stats returns the stats of the data that was last passed to listeners.
+// Runtime entries are included.
+func (ds *DataProvider) Stats() Stats {
+	if s := ds.stats.Load(); s != nil {
+		return *s
+	}
+	return Stats{}
+}
+
+// Export writes entries of the data, one per line, to w. Comments and
+// empty lines are removed. If filter is not empty, only entries that
+// contain filter are written. The data is the one that was last passed to
+// listeners, so it always matches Stats.
+func (ds *DataProvider) Export(w io.Writer, filter string) error {
+	var b []byte
+	if p := ds.data.Load(); p != nil {
+		b = *p
+	}
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		e := entryOfLine(sc.Text())
+		if len(e) == 0 || !strings.Contains(e, filter) {
+			continue
+		}
+		bw.WriteString(e)
+		bw.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
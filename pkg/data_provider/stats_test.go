@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func Test_DataProvider_StatsAndExport(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(f, []byte("# ads\nads.example.com\n\ntracker.example.net # comment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+
+	s := dp.Stats()
+	if s.Entries != 2 || len(s.Digest) != 64 || s.LoadedAt.IsZero() {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if err := dp.AddEntries([]string{"new.example.com"}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if s2 := dp.Stats(); s2.Entries != 3 || s2.Digest == s.Digest {
+		t.Fatalf("stats are not updated, %+v", s2)
+	}
+
+	b := new(strings.Builder)
+	if err := dp.Export(b, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "ads.example.com\nnew.example.com\n" {
+		t.Fatalf("Export() = %q", got)
+	}
+
+	// Without auto reload, Export keeps the loaded data and does not
+	// touch the source.
+	size := dp.DataSize()
+	if err := os.WriteFile(f, []byte("changed.example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := dp.Export(b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "ads.example.com\ntracker.example.net\nnew.example.com\n" {
+		t.Fatalf("Export() = %q", got)
+	}
+	if dp.DataSize() != size {
+		t.Fatalf("Export changed DataSize to %d", dp.DataSize())
+	}
+}
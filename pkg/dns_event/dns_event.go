@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dns_event builds query events that can be sent to external
+// services, e.g. webhooks and mqtt brokers.
+package dns_event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// Event is a summary of a query and its response.
+type Event struct {
+	Time   time.Time `json:"time"`
+	QName  string    `json:"qname"`
+	QType  string    `json:"qtype"`
+	Client string    `json:"client,omitempty"`
+	// ClientName is the friendly name of the client. See client_names.
+	ClientName string   `json:"client_name,omitempty"`
+	Rule       string   `json:"rule,omitempty"`
+	Rcode      string   `json:"rcode,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+	// Values are attached by plugins. See query_context.NewKey.
+	Values map[string]any `json:"values,omitempty"`
+}
+
+// FromContext creates an Event from qCtx. rule is a user defined label.
+func FromContext(qCtx *query_context.Context, rule string) *Event {
+	e := &Event{
+		Time: time.Now(),
+		Rule: rule,
+	}
+	if q := qCtx.Q(); len(q.Question) > 0 {
+		e.QName = q.Question[0].Name
+		e.QType = dnsutils.QtypeToString(q.Question[0].Qtype)
+	}
+	if addr := qCtx.ReqMeta().GetClientAddr(); addr.IsValid() {
+		e.Client = addr.String()
+	}
+	e.ClientName = qCtx.ReqMeta().GetClientName()
+	e.Values = qCtx.Values()
+	if r := qCtx.R(); r != nil {
+		e.Rcode = dnsutils.RcodeToString(r.Rcode)
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			e.IPs = append(e.IPs, ip.String())
+		}
+	}
+	return e
+}
+
+// Template renders Events.
+type Template struct {
+	t *template.Template
+}
+
+var funcs = template.FuncMap{
+	// json encodes v as a json value.
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewTemplate parses a text/template. Fields of Event can be used in
+// the template, e.g. `{"domain": {{json .QName}}}`.
+// An empty s renders Events as json objects.
+func NewTemplate(s string) (*Template, error) {
+	if len(s) == 0 {
+		return &Template{}, nil
+	}
+	t, err := template.New("event").Funcs(funcs).Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template, %w", err)
+	}
+	return &Template{t: t}, nil
+}
+
+func (t *Template) Render(e *Event) ([]byte, error) {
+	if t.t == nil {
+		return json.Marshal(e)
+	}
+	b := new(bytes.Buffer)
+	if err := t.t.Execute(b, e); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_event
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, query_context.NewRequestMeta(netip.MustParseAddr("192.168.1.2")))
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(1, 2, 3, 4)}}
+	qCtx.SetResponse(r)
+	e := FromContext(qCtx, "ads")
+
+	tmpl, err := NewTemplate(`{"d":{{json .QName}},"c":"{{.Client}}","r":"{{.Rule}}","ip":{{json .IPs}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tmpl.Render(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"d":"example.com.","c":"192.168.1.2","r":"ads","ip":["1.2.3.4"]}`
+	if string(b) != want {
+		t.Fatalf("want %s, got %s", want, b)
+	}
+
+	tmpl, _ = NewTemplate("")
+	if b, err := tmpl.Render(e); err != nil || len(b) == 0 || b[0] != '{' {
+		t.Fatalf("default template should render json, got %s, %v", b, err)
+	}
+
+	if _, err := NewTemplate("{{"); err == nil {
+		t.Fatal("invalid template should fail")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dns_json implements the JSON DNS API format used by Google
+// and Cloudflare (application/dns-json).
+package dns_json
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const ContentType = "application/dns-json"
+
+type Msg struct {
+	Status     int        `json:"Status"`
+	TC         bool       `json:"TC"`
+	RD         bool       `json:"RD"`
+	RA         bool       `json:"RA"`
+	AD         bool       `json:"AD"`
+	CD         bool       `json:"CD"`
+	Question   []Question `json:"Question"`
+	Answer     []RR       `json:"Answer,omitempty"`
+	Authority  []RR       `json:"Authority,omitempty"`
+	Additional []RR       `json:"Additional,omitempty"`
+	ECS        string     `json:"edns_client_subnet,omitempty"`
+	Comment    string     `json:"Comment,omitempty"`
+}
+
+type Question struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type RR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// FromMsg converts a dns response to the json format.
+func FromMsg(m *dns.Msg) *Msg {
+	j := &Msg{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		j.Question = append(j.Question, Question{Name: q.Name, Type: q.Qtype})
+	}
+	j.Answer = fromRRs(m.Answer)
+	j.Authority = fromRRs(m.Ns)
+	j.Additional = fromRRs(m.Extra)
+	if ecs := dnsutils.GetMsgECS(m); ecs != nil {
+		j.ECS = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	}
+	return j
+}
+
+func fromRRs(rrs []dns.RR) []RR {
+	var s []RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		s = append(s, RR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return s
+}
+
+// ParseQuery builds a dns query from the url params of a json api
+// request. Supported params are "name" (required), "type", "cd", "do"
+// and "edns_client_subnet".
+func ParseQuery(v url.Values) (*dns.Msg, error) {
+	name := v.Get("name")
+	if len(name) == 0 {
+		return nil, errors.New("missing name param")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %s", name)
+	}
+	qtype := dns.TypeA
+	if s := v.Get("type"); len(s) > 0 {
+		t, err := dnsutils.ParseQtype(s)
+		if err != nil {
+			return nil, err
+		}
+		qtype = t
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.CheckingDisabled = parseBool(v.Get("cd"))
+	do := parseBool(v.Get("do"))
+	ecs := v.Get("edns_client_subnet")
+	if do || len(ecs) > 0 {
+		opt := dnsutils.UpgradeEDNS0(q)
+		opt.SetDo(do)
+		if len(ecs) > 0 {
+			e, err := parseECS(ecs)
+			if err != nil {
+				return nil, err
+			}
+			dnsutils.AddECS(opt, e, true)
+		}
+	}
+	return q, nil
+}
+
+func parseBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+func parseECS(s string) (*dns.EDNS0_SUBNET, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edns_client_subnet %s", s)
+		}
+		s = netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid edns_client_subnet %s", s)
+	}
+	p = p.Masked()
+	addr := p.Addr().Unmap()
+	return dnsutils.NewEDNS0Subnet(net.IP(addr.AsSlice()), uint8(min(p.Bits(), addr.BitLen())), addr.Is6()), nil
+}
+
+// EncodeQuery is the reverse of ParseQuery.
+func EncodeQuery(q *dns.Msg) (url.Values, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("json api only supports one question")
+	}
+	v := make(url.Values)
+	v.Set("name", q.Question[0].Name)
+	v.Set("type", strconv.Itoa(int(q.Question[0].Qtype)))
+	if q.CheckingDisabled {
+		v.Set("cd", "1")
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		if opt.Do() {
+			v.Set("do", "1")
+		}
+		if ecs := dnsutils.GetECS(opt); ecs != nil {
+			v.Set("edns_client_subnet", fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask))
+		}
+	}
+	return v, nil
+}
+
+// ToMsg converts j to a dns response of q.
+func (j *Msg) ToMsg(q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Rcode = j.Status
+	r.Truncated = j.TC
+	r.RecursionAvailable = j.RA
+	r.AuthenticatedData = j.AD
+	r.CheckingDisabled = j.CD
+
+	var err error
+	if r.Answer, err = toRRs(j.Answer); err != nil {
+		return nil, err
+	}
+	if r.Ns, err = toRRs(j.Authority); err != nil {
+		return nil, err
+	}
+	if r.Extra, err = toRRs(j.Additional); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func toRRs(s []RR) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, jr := range s {
+		if jr.Type == dns.TypeOPT {
+			continue
+		}
+		t, ok := dns.TypeToString[jr.Type]
+		if !ok {
+			t = "TYPE" + strconv.Itoa(int(jr.Type))
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(jr.Name), jr.TTL, t, jr.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rr %s %s, %w", t, jr.Data, err)
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_json
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func TestParseQuery(t *testing.T) {
+	v, _ := url.ParseQuery("name=example.com&type=aaaa&cd=1&do=true&edns_client_subnet=1.2.3.0/24")
+	q, err := ParseQuery(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Question[0].Name != "example.com." || q.Question[0].Qtype != dns.TypeAAAA || !q.CheckingDisabled {
+		t.Fatalf("unexpected query %s", q)
+	}
+	opt := q.IsEdns0()
+	if opt == nil || !opt.Do() {
+		t.Fatal("missing do bit")
+	}
+	ecs := dnsutils.GetECS(opt)
+	if ecs == nil || ecs.SourceNetmask != 24 || !ecs.Address.Equal(net.IPv4(1, 2, 3, 0)) {
+		t.Fatalf("unexpected ecs %v", ecs)
+	}
+
+	for _, s := range []string{"", "name=example.com&type=NOTATYPE", "name=example.com&edns_client_subnet=x"} {
+		v, _ := url.ParseQuery(s)
+		if _, err := ParseQuery(v); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
+
+func TestFromMsg(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(1, 2, 3, 4)})
+	r.SetEdns0(1232, false)
+
+	j := FromMsg(r)
+	if j.Status != 0 || !j.RD || !j.RA || len(j.Question) != 1 || len(j.Additional) != 0 {
+		t.Fatalf("unexpected msg %+v", j)
+	}
+	if len(j.Answer) != 1 || j.Answer[0].Data != "1.2.3.4" || j.Answer[0].TTL != 300 || j.Answer[0].Type != dns.TypeA {
+		t.Fatalf("unexpected answer %+v", j.Answer)
+	}
+}
+
+func TestToMsg(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	q.SetEdns0(1232, true)
+	v, err := EncodeQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Get("name") != "example.com." || v.Get("type") != "16" || v.Get("do") != "1" {
+		t.Fatalf("unexpected params %v", v)
+	}
+
+	j := &Msg{Status: dns.RcodeSuccess, RA: true, Answer: []RR{
+		{Name: "example.com", Type: dns.TypeTXT, TTL: 60, Data: `"hello world"`},
+	}}
+	r, err := j.ToMsg(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, ok := r.Answer[0].(*dns.TXT)
+	if r.Id != q.Id || !ok || txt.Txt[0] != "hello world" || txt.Hdr.Name != "example.com." {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnstap encodes and decodes dnstap messages
+// (https://dnstap.info) and sends them over Frame Streams.
+package dnstap
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the Frame Streams content type of dnstap.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// MessageType is the type of a Message.
+type MessageType int32
+
+const (
+	AuthQuery         MessageType = 1
+	AuthResponse      MessageType = 2
+	ResolverQuery     MessageType = 3
+	ResolverResponse  MessageType = 4
+	ClientQuery       MessageType = 5
+	ClientResponse    MessageType = 6
+	ForwarderQuery    MessageType = 7
+	ForwarderResponse MessageType = 8
+	StubQuery         MessageType = 9
+	StubResponse      MessageType = 10
+	ToolQuery         MessageType = 11
+	ToolResponse      MessageType = 12
+)
+
+var messageTypeNames = map[MessageType]string{
+	AuthQuery:         "AUTH_QUERY",
+	AuthResponse:      "AUTH_RESPONSE",
+	ResolverQuery:     "RESOLVER_QUERY",
+	ResolverResponse:  "RESOLVER_RESPONSE",
+	ClientQuery:       "CLIENT_QUERY",
+	ClientResponse:    "CLIENT_RESPONSE",
+	ForwarderQuery:    "FORWARDER_QUERY",
+	ForwarderResponse: "FORWARDER_RESPONSE",
+	StubQuery:         "STUB_QUERY",
+	StubResponse:      "STUB_RESPONSE",
+	ToolQuery:         "TOOL_QUERY",
+	ToolResponse:      "TOOL_RESPONSE",
+}
+
+func (t MessageType) String() string {
+	if s, ok := messageTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// IsQuery reports whether t is a query type.
+func (t MessageType) IsQuery() bool {
+	return t%2 == 1
+}
+
+// SocketProtocol is the transport of a Message.
+type SocketProtocol int32
+
+const (
+	UDP SocketProtocol = 1
+	TCP SocketProtocol = 2
+	DOT SocketProtocol = 3
+	DOH SocketProtocol = 4
+	DOQ SocketProtocol = 7
+)
+
+func (p SocketProtocol) String() string {
+	switch p {
+	case UDP:
+		return "udp"
+	case TCP:
+		return "tcp"
+	case DOT:
+		return "dot"
+	case DOH:
+		return "doh"
+	case DOQ:
+		return "doq"
+	}
+	return fmt.Sprintf("protocol%d", p)
+}
+
+// ProtocolOf returns the SocketProtocol of a transport name, e.g. "udp",
+// "tcp", "dot", "doh" and "doq". It returns 0 for unknown names.
+func ProtocolOf(s string) SocketProtocol {
+	switch s {
+	case "udp":
+		return UDP
+	case "tcp":
+		return TCP
+	case "dot", "tls":
+		return DOT
+	case "doh", "https", "h3", "doh3", "http":
+		return DOH
+	case "doq", "quic":
+		return DOQ
+	}
+	return 0
+}
+
+// Logger logs dnstap messages.
+type Logger interface {
+	Log(m *Message)
+}
+
+// Message is a dnstap message. Messages are packed dns messages, nil if
+// absent. Zero fields are omitted.
+type Message struct {
+	Identity []byte
+	Version  []byte
+
+	Type            MessageType
+	Protocol        SocketProtocol
+	QueryAddress    netip.AddrPort
+	ResponseAddress netip.AddrPort
+	QueryTime       time.Time
+	QueryMessage    []byte
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+// Field numbers of dnstap.proto.
+const (
+	fieldIdentity = 1
+	fieldVersion  = 2
+	fieldMessage  = 14
+	fieldType     = 15
+
+	fieldMsgType             = 1
+	fieldMsgSocketFamily     = 2
+	fieldMsgSocketProtocol   = 3
+	fieldMsgQueryAddress     = 4
+	fieldMsgResponseAddress  = 5
+	fieldMsgQueryPort        = 6
+	fieldMsgResponsePort     = 7
+	fieldMsgQueryTimeSec     = 8
+	fieldMsgQueryTimeNsec    = 9
+	fieldMsgQueryMessage     = 10
+	fieldMsgResponseTimeSec  = 12
+	fieldMsgResponseTimeNsec = 13
+	fieldMsgResponseMessage  = 14
+
+	dnstapTypeMessage = 1
+	familyINET        = 1
+	familyINET6       = 2
+)
+
+// Marshal encodes m as a dnstap.Dnstap protobuf message.
+func (m *Message) Marshal() []byte {
+	var b []byte
+	if m.Identity != nil {
+		b = protowire.AppendTag(b, fieldIdentity, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Identity)
+	}
+	if m.Version != nil {
+		b = protowire.AppendTag(b, fieldVersion, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Version)
+	}
+	b = protowire.AppendTag(b, fieldMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.marshalMessage())
+	b = protowire.AppendTag(b, fieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, dnstapTypeMessage)
+	return b
+}
+
+func (m *Message) marshalMessage() []byte {
+	var b []byte
+	appendVarint := func(num protowire.Number, v uint64) {
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	}
+	appendBytes := func(num protowire.Number, v []byte) {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	appendTime := func(secNum, nsecNum protowire.Number, t time.Time) {
+		appendVarint(secNum, uint64(t.Unix()))
+		b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+	}
+
+	appendVarint(fieldMsgType, uint64(m.Type))
+	if addr := m.QueryAddress.Addr(); addr.IsValid() {
+		if addr.Unmap().Is4() {
+			appendVarint(fieldMsgSocketFamily, familyINET)
+		} else {
+			appendVarint(fieldMsgSocketFamily, familyINET6)
+		}
+	}
+	if m.Protocol != 0 {
+		appendVarint(fieldMsgSocketProtocol, uint64(m.Protocol))
+	}
+	if addr := m.QueryAddress.Addr(); addr.IsValid() {
+		appendBytes(fieldMsgQueryAddress, addr.Unmap().AsSlice())
+	}
+	if addr := m.ResponseAddress.Addr(); addr.IsValid() {
+		appendBytes(fieldMsgResponseAddress, addr.Unmap().AsSlice())
+	}
+	if p := m.QueryAddress.Port(); p != 0 {
+		appendVarint(fieldMsgQueryPort, uint64(p))
+	}
+	if p := m.ResponseAddress.Port(); p != 0 {
+		appendVarint(fieldMsgResponsePort, uint64(p))
+	}
+	if !m.QueryTime.IsZero() {
+		appendTime(fieldMsgQueryTimeSec, fieldMsgQueryTimeNsec, m.QueryTime)
+	}
+	if m.QueryMessage != nil {
+		appendBytes(fieldMsgQueryMessage, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		appendTime(fieldMsgResponseTimeSec, fieldMsgResponseTimeNsec, m.ResponseTime)
+	}
+	if m.ResponseMessage != nil {
+		appendBytes(fieldMsgResponseMessage, m.ResponseMessage)
+	}
+	return b
+}
+
+var errInvalidMessage = errors.New("invalid dnstap message")
+
+// Unmarshal decodes a dnstap.Dnstap protobuf message. Unknown fields
+// are ignored.
+func Unmarshal(b []byte) (*Message, error) {
+	m := new(Message)
+	hasMessage := false
+	err := walkFields(b, func(num protowire.Number, v uint64, bs []byte) error {
+		switch num {
+		case fieldIdentity:
+			m.Identity = bs
+		case fieldVersion:
+			m.Version = bs
+		case fieldMessage:
+			hasMessage = true
+			return m.unmarshalMessage(bs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !hasMessage {
+		return nil, errInvalidMessage
+	}
+	return m, nil
+}
+
+func (m *Message) unmarshalMessage(b []byte) error {
+	var qAddr, rAddr netip.Addr
+	var qPort, rPort uint16
+	var qSec, rSec int64
+	var qNsec, rNsec int64
+	err := walkFields(b, func(num protowire.Number, v uint64, bs []byte) error {
+		switch num {
+		case fieldMsgType:
+			m.Type = MessageType(v)
+		case fieldMsgSocketProtocol:
+			m.Protocol = SocketProtocol(v)
+		case fieldMsgQueryAddress:
+			qAddr, _ = netip.AddrFromSlice(bs)
+		case fieldMsgResponseAddress:
+			rAddr, _ = netip.AddrFromSlice(bs)
+		case fieldMsgQueryPort:
+			qPort = uint16(v)
+		case fieldMsgResponsePort:
+			rPort = uint16(v)
+		case fieldMsgQueryTimeSec:
+			qSec = int64(v)
+		case fieldMsgQueryTimeNsec:
+			qNsec = int64(v)
+		case fieldMsgQueryMessage:
+			m.QueryMessage = bs
+		case fieldMsgResponseTimeSec:
+			rSec = int64(v)
+		case fieldMsgResponseTimeNsec:
+			rNsec = int64(v)
+		case fieldMsgResponseMessage:
+			m.ResponseMessage = bs
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if qAddr.IsValid() {
+		m.QueryAddress = netip.AddrPortFrom(qAddr, qPort)
+	}
+	if rAddr.IsValid() {
+		m.ResponseAddress = netip.AddrPortFrom(rAddr, rPort)
+	}
+	if qSec != 0 || qNsec != 0 {
+		m.QueryTime = time.Unix(qSec, qNsec)
+	}
+	if rSec != 0 || rNsec != 0 {
+		m.ResponseTime = time.Unix(rSec, rNsec)
+	}
+	return nil
+}
+
+// walkFields calls f for every field of b. v is the value of varint and
+// fixed fields, bs is the value of bytes fields.
+func walkFields(b []byte, f func(num protowire.Number, v uint64, bs []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errInvalidMessage
+		}
+		b = b[n:]
+		var v uint64
+		var bs []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bs, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errInvalidMessage
+		}
+		b = b[n:]
+		if err := f(num, v, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessage_Marshal(t *testing.T) {
+	m := &Message{
+		Identity:        []byte("ns1"),
+		Version:         []byte("mosdns"),
+		Type:            ForwarderResponse,
+		Protocol:        DOT,
+		QueryAddress:    netip.MustParseAddrPort("[2001:db8::1]:5353"),
+		ResponseAddress: netip.MustParseAddrPort("8.8.8.8:853"),
+		QueryTime:       time.Unix(1700000000, 123),
+		QueryMessage:    []byte{1, 2, 3},
+		ResponseTime:    time.Unix(1700000001, 456),
+		ResponseMessage: []byte{4, 5, 6},
+	}
+	got, err := Unmarshal(m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("want %+v, got %+v", m, got)
+	}
+
+	if _, err := Unmarshal([]byte{0xff}); err == nil {
+		t.Fatal("invalid message should be an error")
+	}
+}
+
+func TestEmitter(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	frames := make(chan []byte, 8)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fr, err := NewFrameReader(c, ContentType)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for {
+			b, err := fr.ReadFrame()
+			if err == io.EOF {
+				close(frames)
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			frames <- b
+		}
+	}()
+
+	e := NewEmitter(EmitterOpts{Network: "unix", Addr: addr})
+	m := &Message{Type: ClientQuery, QueryMessage: []byte{1}}
+	e.Emit(m)
+	select {
+	case b := <-frames:
+		if !bytes.Equal(b, m.Marshal()) {
+			t.Fatal("unexpected frame")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+	e.Close()
+	if _, ok := <-frames; ok {
+		t.Fatal("stream is not stopped")
+	}
+	if e.Sent() != 1 || e.Dropped() != 0 {
+		t.Fatalf("sent = %d, dropped = %d", e.Sent(), e.Dropped())
+	}
+}
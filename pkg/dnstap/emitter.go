@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	dialTimeout     = time.Second * 5
+	writeTimeout    = time.Second * 5
+	maxRetryBackoff = time.Second * 30
+)
+
+type EmitterOpts struct {
+	// Network is "unix" or "tcp".
+	Network string
+	Addr    string
+
+	// QueueSize is the number of messages buffered while the receiver
+	// is slow or unreachable. Messages are dropped if the queue is full.
+	// Default is 4096.
+	QueueSize int
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Emitter sends dnstap messages to a Frame Streams receiver. It
+// reconnects if the connection is lost. It never blocks callers.
+type Emitter struct {
+	opts   EmitterOpts
+	queue  chan []byte
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func NewEmitter(opts EmitterOpts) *Emitter {
+	utils.SetDefaultNum(&opts.QueueSize, 4096)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Emitter{
+		opts:   opts,
+		queue:  make(chan []byte, opts.QueueSize),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go e.run(ctx)
+	return e
+}
+
+// Emit queues m.
+func (e *Emitter) Emit(m *Message) {
+	select {
+	case e.queue <- m.Marshal():
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Sent returns the number of sent messages.
+func (e *Emitter) Sent() uint64 {
+	return e.sent.Load()
+}
+
+// Dropped returns the number of messages dropped by a full queue or
+// connection errors.
+func (e *Emitter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Close stops e. Queued messages are dropped.
+func (e *Emitter) Close() error {
+	e.cancel()
+	<-e.done
+	return nil
+}
+
+func (e *Emitter) run(ctx context.Context) {
+	defer close(e.done)
+	backoff := time.Second
+	for {
+		err := e.serveConn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		e.opts.Logger.Warn("dnstap connection lost", zap.String("addr", e.opts.Addr), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+			backoff = min(backoff*2, maxRetryBackoff)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveConn connects to the receiver and sends queued messages until an
+// error occurs or ctx is done.
+func (e *Emitter) serveConn(ctx context.Context) error {
+	d := net.Dialer{Timeout: dialTimeout}
+	c, err := d.DialContext(ctx, e.opts.Network, e.opts.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(writeTimeout))
+	fw, err := NewFrameWriter(c, ContentType)
+	if err != nil {
+		return err
+	}
+	e.opts.Logger.Info("dnstap connected", zap.String("addr", e.opts.Addr))
+
+	for {
+		select {
+		case b := <-e.queue:
+			c.SetDeadline(time.Now().Add(writeTimeout))
+			if err := fw.WriteFrame(b); err != nil {
+				e.dropped.Add(1)
+				return err
+			}
+			// Flush once the queue is drained, so frames are batched
+			// under load.
+			if len(e.queue) == 0 {
+				if err := fw.Flush(); err != nil {
+					return err
+				}
+			}
+			e.sent.Add(1)
+		case <-ctx.Done():
+			c.SetDeadline(time.Now().Add(writeTimeout))
+			if err := fw.Flush(); err != nil {
+				return err
+			}
+			return fw.Close()
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Control frame types of Frame Streams.
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+
+	maxControlFrameSize = 512
+	maxDataFrameSize    = 1 << 20
+)
+
+var errUnexpectedControl = errors.New("unexpected control frame")
+
+// FrameWriter writes data frames to a bidirectional Frame Streams
+// connection.
+type FrameWriter struct {
+	w  *bufio.Writer
+	r  io.Reader
+	ct string
+}
+
+// NewFrameWriter handshakes with the receiver on rw. The receiver must
+// accept content type ct.
+func NewFrameWriter(rw io.ReadWriter, ct string) (*FrameWriter, error) {
+	fw := &FrameWriter{w: bufio.NewWriter(rw), r: rw, ct: ct}
+	if err := fw.writeControl(controlReady, ct); err != nil {
+		return nil, err
+	}
+	typ, cts, err := readControl(rw)
+	if err != nil {
+		return nil, err
+	}
+	if typ != controlAccept || !slices.Contains(cts, ct) {
+		return nil, fmt.Errorf("receiver doesn't accept %s", ct)
+	}
+	if err := fw.writeControl(controlStart, ct); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// WriteFrame writes a data frame. Frames are buffered until Flush.
+func (fw *FrameWriter) WriteFrame(b []byte) error {
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(len(b)))
+	if _, err := fw.w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(b)
+	return err
+}
+
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// Close stops the stream and waits for the receiver to finish. It
+// doesn't close the underlying connection.
+func (fw *FrameWriter) Close() error {
+	if err := fw.writeControl(controlStop, ""); err != nil {
+		return err
+	}
+	typ, _, err := readControl(fw.r)
+	if err != nil {
+		return err
+	}
+	if typ != controlFinish {
+		return errUnexpectedControl
+	}
+	return nil
+}
+
+func (fw *FrameWriter) writeControl(typ uint32, ct string) error {
+	if err := writeControl(fw.w, typ, ct); err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
+
+// FrameReader reads data frames from a bidirectional Frame Streams
+// connection.
+type FrameReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// NewFrameReader handshakes with the sender on rw. The sender must offer
+// content type ct.
+func NewFrameReader(rw io.ReadWriter, ct string) (*FrameReader, error) {
+	fr := &FrameReader{r: bufio.NewReader(rw), w: rw}
+	typ, cts, err := readControl(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != controlReady || !slices.Contains(cts, ct) {
+		return nil, fmt.Errorf("sender doesn't offer %s", ct)
+	}
+	if err := writeControl(rw, controlAccept, ct); err != nil {
+		return nil, err
+	}
+	if typ, _, err = readControl(fr.r); err != nil {
+		return nil, err
+	}
+	if typ != controlStart {
+		return nil, errUnexpectedControl
+	}
+	return fr, nil
+}
+
+// ReadFrame returns the next data frame. It returns io.EOF after the
+// sender stopped the stream.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(fr.r, h[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n == 0 { // control frame
+		typ, _, err := readControlFrame(fr.r)
+		if err != nil {
+			return nil, err
+		}
+		if typ != controlStop {
+			return nil, errUnexpectedControl
+		}
+		if err := writeControl(fr.w, controlFinish, ""); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	if n > maxDataFrameSize {
+		return nil, fmt.Errorf("data frame too large, %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(fr.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeControl writes an escaped control frame. ct is omitted if empty.
+func writeControl(w io.Writer, typ uint32, ct string) error {
+	b := make([]byte, 12, 20+len(ct))
+	binary.BigEndian.PutUint32(b[8:], typ)
+	if len(ct) > 0 {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(ct)))
+		b = append(b, ct...)
+	}
+	// b[0:4] is the escape, b[4:8] is the length of the control frame.
+	binary.BigEndian.PutUint32(b[4:], uint32(len(b)-8))
+	_, err := w.Write(b)
+	return err
+}
+
+// readControl reads an escaped control frame.
+func readControl(r io.Reader) (typ uint32, cts []string, err error) {
+	var esc [4]byte
+	if _, err := io.ReadFull(r, esc[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(esc[:]) != 0 {
+		return 0, nil, errors.New("missing control frame escape")
+	}
+	return readControlFrame(r)
+}
+
+// readControlFrame reads a control frame after its escape.
+func readControlFrame(r io.Reader) (typ uint32, cts []string, err error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n < 4 || n > maxControlFrameSize {
+		return 0, nil, fmt.Errorf("invalid control frame length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	typ = binary.BigEndian.Uint32(b)
+	b = b[4:]
+	for len(b) >= 8 {
+		field := binary.BigEndian.Uint32(b)
+		l := binary.BigEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint32(len(b)) < l {
+			return 0, nil, errors.New("invalid control field")
+		}
+		if field == controlFieldContentType {
+			cts = append(cts, string(b[:l]))
+		}
+		b = b[l:]
+	}
+	return typ, cts, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import "github.com/miekg/dns"
+
+// EDNS0ClientID is the option code of the client (device) id. It's the
+// CPE-ID option of dnsmasq (--add-cpe-id), which public resolvers like
+// NextDNS and AdGuard DNS read to identify devices behind a shared ip.
+// The payload is the id as is.
+const EDNS0ClientID = 65074
+
+// GetClientID returns the client id of m. ok is false if m has no
+// such option.
+func GetClientID(m *dns.Msg) (id string, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return "", false
+	}
+	o, _ := GetEDNS0Option(opt, EDNS0ClientID).(*dns.EDNS0_LOCAL)
+	if o == nil {
+		return "", false
+	}
+	return string(o.Data), true
+}
+
+// SetClientID sets the client id of m, replacing the existing one.
+// upgraded reports whether m was upgraded to an EDNS0 msg.
+func SetClientID(m *dns.Msg, id string) (upgraded bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(m)
+		upgraded = true
+	}
+	RemoveEDNS0Option(opt, EDNS0ClientID)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0ClientID, Data: []byte(id)})
+	return upgraded
+}
+
+// RemoveClientID removes the client id from m.
+func RemoveClientID(m *dns.Msg) {
+	if opt := m.IsEdns0(); opt != nil {
+		RemoveEDNS0Option(opt, EDNS0ClientID)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientID(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, ok := GetClientID(q); ok {
+		t.Fatal("unexpected client id")
+	}
+
+	if upgraded := SetClientID(q, "kids-tablet"); !upgraded {
+		t.Fatal("query should be upgraded")
+	}
+	if upgraded := SetClientID(q, "laptop"); upgraded {
+		t.Fatal("query should not be upgraded twice")
+	}
+	if n := len(q.IsEdns0().Option); n != 1 {
+		t.Fatalf("want 1 option, got %d", n)
+	}
+
+	// Pack and unpack, the option should survive the wire.
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := GetClientID(m); !ok || id != "laptop" {
+		t.Fatalf("want client id laptop, got %q, %v", id, ok)
+	}
+
+	RemoveClientID(m)
+	if _, ok := GetClientID(m); ok {
+		t.Fatal("client id should be removed")
+	}
+}
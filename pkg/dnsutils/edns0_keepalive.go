@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// KeepaliveUnit is the unit of the timeout of the edns-tcp-keepalive
+// option (RFC 7828).
+const KeepaliveUnit = time.Millisecond * 100
+
+// GetKeepalive returns the timeout of the edns-tcp-keepalive option of m.
+// ok is false if m has no such option. A zero timeout means the option
+// has no timeout, which is the case of queries.
+func GetKeepalive(m *dns.Msg) (timeout time.Duration, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	o, _ := GetEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE).(*dns.EDNS0_TCP_KEEPALIVE)
+	if o == nil {
+		return 0, false
+	}
+	return time.Duration(o.Timeout) * KeepaliveUnit, true
+}
+
+// SetKeepalive returns a copy of m that has an edns-tcp-keepalive option.
+// Zero timeout means the option has no timeout. m is not modified, its
+// OPT record is copied. m is returned as is if it's not an EDNS0 msg.
+func SetKeepalive(m *dns.Msg, timeout time.Duration) *dns.Msg {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return m
+	}
+	o := &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(min(timeout/KeepaliveUnit, 0xffff)),
+	}
+	return replaceOPT(m, opt, dns.EDNS0TCPKEEPALIVE, o)
+}
+
+// RemoveKeepalive removes the edns-tcp-keepalive option from m. The option
+// is only meaningful to the tcp connection it was received from.
+// Like SetKeepalive, m is not modified.
+func RemoveKeepalive(m *dns.Msg) *dns.Msg {
+	opt := m.IsEdns0()
+	if opt == nil || GetEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE) == nil {
+		return m
+	}
+	return replaceOPT(m, opt, dns.EDNS0TCPKEEPALIVE, nil)
+}
+
+// replaceOPT returns a shallow copy of m whose OPT record is a copy of opt
+// without option code, plus o if o is not nil.
+func replaceOPT(m *dns.Msg, opt *dns.OPT, code uint16, o dns.EDNS0) *dns.Msg {
+	nOpt := new(dns.OPT)
+	nOpt.Hdr = opt.Hdr
+	nOpt.Option = make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, e := range opt.Option {
+		if e.Option() != code {
+			nOpt.Option = append(nOpt.Option, e)
+		}
+	}
+	if o != nil {
+		nOpt.Option = append(nOpt.Option, o)
+	}
+
+	nm := new(dns.Msg)
+	*nm = *m
+	nm.Extra = make([]dns.RR, len(m.Extra))
+	for i, rr := range m.Extra {
+		if rr == opt {
+			rr = nOpt
+		}
+		nm.Extra[i] = rr
+	}
+	return nm
+}
@@ -19,7 +19,11 @@
 
 package dnsutils
 
-import "github.com/miekg/dns"
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
 
 // PadToMinimum pads m to the minimum length.
 // If the length of m is larger than minLen, PadToMinimum won't do anything.
@@ -58,3 +62,19 @@ func PadToMinimum(m *dns.Msg, minLen int) (upgraded, newPadding bool) {
 	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLen)})
 	return true, true
 }
+
+// PadToBlock pads m with a Padding option, so its length is a multiple
+// of blockLen, as the block-length padding of RFC 8467. The existing
+// Padding option of m is replaced. m is upgraded to an EDNS0 msg if it
+// isn't.
+func PadToBlock(m *dns.Msg, blockLen int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = UpgradeEDNS0(m)
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		return o.Option() == dns.EDNS0PADDING
+	})
+	l := m.Len() + 4 // a Padding option has a 4 bytes header.
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, (blockLen-l%blockLen)%blockLen)})
+}
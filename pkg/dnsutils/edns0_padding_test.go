@@ -68,3 +68,34 @@ func TestPadToMinimum(t *testing.T) {
 		})
 	}
 }
+
+func TestPadToBlock(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeA)
+	qPadded := q.Copy()
+	PadToMinimum(qPadded, 200)
+	qLarge := new(dns.Msg)
+	qLarge.SetQuestion(strings.Repeat("a.", 100), dns.TypeA)
+
+	tests := []struct {
+		name    string
+		q       *dns.Msg
+		wantLen int
+	}{
+		{"small", q, 128},
+		{"padded", qPadded, 128},
+		{"large", qLarge, 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			PadToBlock(tt.q, 128)
+			b, err := tt.q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != tt.wantLen {
+				t.Fatalf("got len %d, want %d", len(b), tt.wantLen)
+			}
+		})
+	}
+}
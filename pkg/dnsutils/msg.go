@@ -132,6 +132,13 @@ func QtypeToString(u uint16) string {
 	return uint16Conv(u, dns.TypeToString)
 }
 
+func RcodeToString(u int) string {
+	if s, ok := dns.RcodeToString[u]; ok {
+		return s
+	}
+	return strconv.Itoa(u)
+}
+
 func GenEmptyReply(q *dns.Msg, rcode int) *dns.Msg {
 	r := new(dns.Msg)
 	r.SetRcode(q, rcode)
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParseQtype parses type names (e.g. "AAAA", "HTTPS", "TYPE65") or numbers.
+func ParseQtype(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if t, ok := dns.StringToType[s]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qtype %s", s)
+	}
+	return uint16(n), nil
+}
+
+// ParseRcode parses rcode names (e.g. "NOERROR", "REFUSED") or numbers.
+func ParseRcode(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if rcode, ok := dns.StringToRcode[s]; ok {
+		return rcode, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 12)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rcode %s", s)
+	}
+	return int(n), nil
+}
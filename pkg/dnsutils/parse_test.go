@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseQtype(t *testing.T) {
+	tests := map[string]uint16{"AAAA": dns.TypeAAAA, "https": dns.TypeHTTPS, "TYPE65": 65, "12": dns.TypePTR}
+	for s, want := range tests {
+		got, err := ParseQtype(s)
+		if err != nil || got != want {
+			t.Errorf("%s: got %d %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseQtype("NOTATYPE"); err == nil {
+		t.Error("invalid qtype should fail")
+	}
+}
+
+func TestParseRcode(t *testing.T) {
+	tests := map[string]int{"NOERROR": dns.RcodeSuccess, "refused": dns.RcodeRefused, "3": dns.RcodeNameError}
+	for s, want := range tests {
+		got, err := ParseRcode(s)
+		if err != nil || got != want {
+			t.Errorf("%s: got %d %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseRcode("NOTARCODE"); err == nil {
+		t.Error("invalid rcode should fail")
+	}
+}
@@ -308,3 +308,24 @@ exec:
 		})
 	}
 }
+
+func Test_TracedMatcher(t *testing.T) {
+	m := &TracedMatcher{Name: "m", Matcher: &DummyMatcher{Matched: true}}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	ctx := context.Background()
+
+	// Queries without tracing pay nothing.
+	if n := testing.AllocsPerRun(100, func() { m.Match(ctx, qCtx) }); n != 0 {
+		t.Fatalf("untraced match allocates %v times", n)
+	}
+
+	qCtx.EnableTrace()
+	if ok, err := m.Match(ctx, qCtx); !ok || err != nil {
+		t.Fatalf("Match() = %t, %v", ok, err)
+	}
+	if es := qCtx.TraceEvents(); len(es) != 1 || es[0].Msg != "match m: true" {
+		t.Fatalf("unexpected trace events %+v", es)
+	}
+}
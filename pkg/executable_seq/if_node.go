@@ -223,6 +223,9 @@ func (m *conditionMatcher) Match(ctx context.Context, qCtx *query_context.Contex
 		return false, err
 	}
 	res := out.(bool)
+	if qCtx.Tracing() {
+		qCtx.Tracef("if %s: %t", m.expr.String(), res)
+	}
 	m.lg.Debug(
 		"condition matcher result",
 		paramsPH.makeResultZapFields(qCtx.InfoField(), res)...,
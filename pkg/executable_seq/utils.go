@@ -75,10 +75,28 @@ func ExecChainNode(ctx context.Context, qCtx *query_context.Context, n Executabl
 		return nil
 	}
 
+	if qCtx.Tracing() {
+		traceNode(qCtx, n)
+	}
+
 	// TODO: Error logging
 	return n.Exec(ctx, qCtx, n.Next())
 }
 
+// traceNode records the plugin of n.
+func traceNode(qCtx *query_context.Context, n ExecutableChainNode) {
+	w, ok := n.(*ExecutableNodeWrapper)
+	if !ok {
+		return
+	}
+	if p, ok := w.Executable.(interface {
+		Tag() string
+		Type() string
+	}); ok {
+		qCtx.Tracef("exec %s (%s)", p.Tag(), p.Type())
+	}
+}
+
 type DummyMatcher struct {
 	Matched bool
 	WantErr error
@@ -117,6 +135,20 @@ func (d *DummyExecutable) Exec(ctx context.Context, qCtx *query_context.Context,
 	return ExecChainNode(ctx, qCtx, next)
 }
 
+// TracedMatcher records the result of Matcher in the trace of queries.
+type TracedMatcher struct {
+	Name string
+	Matcher
+}
+
+func (m *TracedMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := m.Matcher.Match(ctx, qCtx)
+	if err == nil && qCtx.Tracing() {
+		qCtx.Tracef("match %s: %t", m.Name, ok)
+	}
+	return ok, err
+}
+
 func LogicalAndMatcherGroup(ctx context.Context, qCtx *query_context.Context, mg []Matcher) (matched bool, err error) {
 	if len(mg) == 0 {
 		return false, nil
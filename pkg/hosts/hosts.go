@@ -33,7 +33,9 @@ import (
 )
 
 type Hosts struct {
-	matcher domain.Matcher[*IPs]
+	matcher  domain.Matcher[*IPs]
+	locality *Locality
+	zone     *Zone // maybe nil
 }
 
 // NewHosts creates a hosts using m.
@@ -43,6 +45,12 @@ func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	}
 }
 
+// SetLocality sets the Locality that LookupMsgFrom uses to select
+// addresses for clients.
+func (h *Hosts) SetLocality(l *Locality) {
+	h.locality = l
+}
+
 func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	ips, ok := h.matcher.Match(fqdn)
 	if !ok {
@@ -52,13 +60,25 @@ func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 }
 
 func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
+	return h.LookupMsgFrom(m, netip.Addr{})
+}
+
+// LookupMsgFrom is like LookupMsg but only answers the addresses that
+// are nearest to client. See Locality.
+func (h *Hosts) LookupMsgFrom(m *dns.Msg, client netip.Addr) *dns.Msg {
 	if len(m.Question) != 1 {
 		return nil
 	}
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	if q.Qclass != dns.ClassINET || (typ != dns.TypeA && typ != dns.TypeAAAA) {
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if h.zone != nil && (typ == dns.TypeSOA || typ == dns.TypeNS) {
+		return h.lookupApexMsg(m)
+	}
+	if typ != dns.TypeA && typ != dns.TypeAAAA {
 		return nil
 	}
 
@@ -72,8 +92,9 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	r.RecursionAvailable = true
 	switch {
 	case typ == dns.TypeA && len(ipv4) > 0:
+		ipv4 = selectAddrs(h.locality, client, ipv4)
 		rand.Shuffle(len(ipv4), func(i, j int) {
-			ipv4[i], ipv4[j] = ipv4[j], ipv4[j]
+			ipv4[i], ipv4[j] = ipv4[j], ipv4[i]
 		})
 		for _, ip := range ipv4 {
 			rr := &dns.A{
@@ -88,8 +109,9 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 			r.Answer = append(r.Answer, rr)
 		}
 	case typ == dns.TypeAAAA && len(ipv6) > 0:
+		ipv6 = selectAddrs(h.locality, client, ipv6)
 		rand.Shuffle(len(ipv6), func(i, j int) {
-			ipv6[i], ipv6[j] = ipv6[j], ipv6[j]
+			ipv6[i], ipv6[j] = ipv6[j], ipv6[i]
 		})
 		for _, ip := range ipv6 {
 			rr := &dns.AAAA{
@@ -105,6 +127,9 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 		}
 	}
 
+	if h.zone != nil && h.zone.setAuthority(r, fqdn) {
+		return r
+	}
 	// Append fake SOA record for empty reply.
 	if len(r.Answer) == 0 {
 		r.Ns = []dns.RR{dnsutils.FakeSOA(fqdn)}
@@ -112,6 +137,12 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	return r
 }
 
+// selectAddrs returns a copy of the addrs selected by l. The copy
+// can be shuffled without touching the matcher's data.
+func selectAddrs(l *Locality, client netip.Addr, addrs []netip.Addr) []netip.Addr {
+	return append([]netip.Addr(nil), l.Select(client, addrs)...)
+}
+
 type IPs struct {
 	IPv4 []netip.Addr
 	IPv6 []netip.Addr
@@ -105,3 +105,26 @@ func Test_hostsContainer_Match(t *testing.T) {
 		})
 	}
 }
+
+func Test_LookupMsg_shuffle(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	err := domain.LoadFromTextReader[*IPs](m, bytes.NewBufferString("test.com 1.0.0.1 1.0.0.2 1.0.0.3 1.0.0.4 1.0.0.5"), ParseIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHosts(m)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	for i := 0; i < 100; i++ {
+		r := h.LookupMsg(q)
+		seen := make(map[string]bool)
+		for _, rr := range r.Answer {
+			seen[rr.(*dns.A).A.String()] = true
+		}
+		if len(seen) != 5 {
+			t.Fatalf("shuffled answer lost addresses: %v", r.Answer)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"net/netip"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+)
+
+// Site is a location of services. Clients of a site prefer the
+// addresses of the same site.
+type Site struct {
+	Name    string
+	Clients netlist.Matcher
+	Addrs   netlist.Matcher
+}
+
+// Locality selects the addresses nearest to the client.
+type Locality struct {
+	sites []Site
+}
+
+func NewLocality(sites []Site) *Locality {
+	return &Locality{sites: sites}
+}
+
+// Select returns addrs that belong to the first site of client that
+// has any of addrs. If client does not belong to any site or none of
+// its sites has an address in addrs, all addrs are returned so
+// the name stays resolvable.
+func (l *Locality) Select(client netip.Addr, addrs []netip.Addr) []netip.Addr {
+	if l == nil || !client.IsValid() || len(addrs) <= 1 {
+		return addrs
+	}
+	client = client.Unmap()
+	for _, s := range l.sites {
+		if ok, _ := s.Clients.Match(client); !ok {
+			continue
+		}
+		var local []netip.Addr
+		for _, a := range addrs {
+			if ok, _ := s.Addrs.Match(a); ok {
+				local = append(local, a)
+			}
+		}
+		if len(local) > 0 {
+			return local
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+)
+
+func newTestList(s ...string) *netlist.List {
+	l := netlist.NewList()
+	for _, p := range s {
+		l.Append(netip.MustParsePrefix(p))
+	}
+	l.Sort()
+	return l
+}
+
+func Test_LookupMsgFrom(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	if err := m.Add("svc.home", &IPs{IPv4: []netip.Addr{
+		netip.MustParseAddr("10.0.1.1"),
+		netip.MustParseAddr("10.0.2.1"),
+		netip.MustParseAddr("10.0.2.2"),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHosts(m)
+	h.SetLocality(NewLocality([]Site{
+		{Name: "a", Clients: newTestList("192.168.1.0/24"), Addrs: newTestList("10.0.1.0/24")},
+		{Name: "b", Clients: newTestList("192.168.2.0/24"), Addrs: newTestList("10.0.2.0/24")},
+		{Name: "c", Clients: newTestList("192.168.3.0/24"), Addrs: newTestList("10.0.3.0/24")},
+	}))
+
+	tests := []struct {
+		client string
+		want   int
+	}{
+		{"192.168.1.10", 1},
+		{"192.168.2.10", 2},
+		{"192.168.3.10", 3}, // site c has no address, fallback to all.
+		{"172.16.0.1", 3},
+		{"", 3},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("svc.home.", dns.TypeA)
+	for _, tt := range tests {
+		var client netip.Addr
+		if len(tt.client) > 0 {
+			client = netip.MustParseAddr(tt.client)
+		}
+		r := h.LookupMsgFrom(q, client)
+		if r == nil || len(r.Answer) != tt.want {
+			t.Fatalf("client %s: want %d answers, got %v", tt.client, tt.want, r)
+		}
+	}
+}
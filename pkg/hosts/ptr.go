@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+)
+
+// PTRMatcher is a domain.MixMatcher that also indexes the addresses of
+// its full domain rules, so they can be used to answer PTR queries.
+type PTRMatcher struct {
+	*domain.MixMatcher[*IPs]
+	ptr map[netip.Addr]string
+}
+
+var _ domain.WriteableMatcher[*IPs] = (*PTRMatcher)(nil)
+
+// NewPTRMatcher returns a PTRMatcher which default match type is full.
+func NewPTRMatcher() *PTRMatcher {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	return &PTRMatcher{MixMatcher: m, ptr: make(map[netip.Addr]string)}
+}
+
+func (m *PTRMatcher) Add(s string, v *IPs) error {
+	if err := m.MixMatcher.Add(s, v); err != nil {
+		return err
+	}
+	typ, pattern, ok := strings.Cut(s, ":")
+	if !ok {
+		typ, pattern = domain.MatcherFull, s
+	}
+	if typ != domain.MatcherFull || v == nil {
+		return nil
+	}
+	fqdn := dns.Fqdn(strings.ToLower(pattern))
+	for _, addrs := range [...][]netip.Addr{v.IPv4, v.IPv6} {
+		for _, addr := range addrs {
+			if _, dup := m.ptr[addr]; !dup { // first rule wins
+				m.ptr[addr] = fqdn
+			}
+		}
+	}
+	return nil
+}
+
+// LookupPTR returns the name of the first full domain rule that has addr.
+func (m *PTRMatcher) LookupPTR(addr netip.Addr) (string, bool) {
+	name, ok := m.ptr[addr.Unmap()]
+	return name, ok
+}
+
+// RangeFull calls f for each full domain rule of m until f returns false.
+func (m *PTRMatcher) RangeFull(f func(fqdn string, v *IPs) bool) {
+	if full, ok := m.GetSubMatcher(domain.MatcherFull).(*domain.FullMatcher[*IPs]); ok {
+		full.Range(func(d string, v *IPs) bool {
+			return f(dns.Fqdn(d), v)
+		})
+	}
+}
+
+// RangeFull calls f for each full domain rule of h, in the order of
+// its matchers, until f returns false. A name is passed again if it is
+// in multiple matchers, queries only match the first one. Only rules
+// that were loaded by a PTRMatcher are searched.
+func (h *Hosts) RangeFull(f func(fqdn string, v *IPs) bool) {
+	rangeFull(h.matcher, f)
+}
+
+// rangeFull returns false if f returned false.
+func rangeFull(m domain.Matcher[*IPs], f func(fqdn string, v *IPs) bool) bool {
+	switch m := m.(type) {
+	case *PTRMatcher:
+		next := true
+		m.RangeFull(func(fqdn string, v *IPs) bool {
+			next = f(fqdn, v)
+			return next
+		})
+		return next
+	case *domain.DynamicMatcher[*IPs]:
+		if sub := m.Matcher(); sub != nil {
+			return rangeFull(sub, f)
+		}
+	case *domain.MatcherGroup[*IPs]:
+		for _, sub := range m.Matchers() {
+			if !rangeFull(sub, f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LookupPTR returns the host name of addr. Only rules that were loaded
+// by a PTRMatcher are searched.
+func (h *Hosts) LookupPTR(addr netip.Addr) (string, bool) {
+	return lookupPTR(h.matcher, addr)
+}
+
+func lookupPTR(m domain.Matcher[*IPs], addr netip.Addr) (string, bool) {
+	switch m := m.(type) {
+	case *PTRMatcher:
+		return m.LookupPTR(addr)
+	case *domain.DynamicMatcher[*IPs]:
+		if sub := m.Matcher(); sub != nil {
+			return lookupPTR(sub, addr)
+		}
+	case *domain.MatcherGroup[*IPs]:
+		for _, sub := range m.Matchers() {
+			if name, ok := lookupPTR(sub, addr); ok {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+)
+
+func TestHosts_LookupPTR(t *testing.T) {
+	m := NewPTRMatcher()
+	err := domain.LoadFromTextReader[*IPs](m, bytes.NewBufferString(test_hosts), ParseIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mg := new(domain.MatcherGroup[*IPs])
+	mg.Append(m)
+	h := NewHosts(mg)
+
+	tests := []struct {
+		addr   string
+		want   string
+		wantOk bool
+	}{
+		{"8.8.8.8", "dns.google.", true},
+		{"2001:4860:4860::8888", "dns.google.", true},
+		{"2.3.4.5", "test.com.", true},
+		{"192.168.1.1", "", false}, // regexp rule
+		{"1.1.1.1", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := h.LookupPTR(netip.MustParseAddr(tt.addr))
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("LookupPTR(%s) = %s, %v, want %s, %v", tt.addr, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Zone makes answers of Hosts look like those of an authoritative server
+// of the zone, so downstream resolvers cache them properly.
+type Zone struct {
+	// Name is the fqdn of the zone apex. If it is empty, every host name
+	// is the apex of its own zone.
+	Name string
+	// NS are name servers of the zone. Default is MName.
+	NS []string
+	// MName and RName of the SOA record. Default is "ns.<apex>" and
+	// "hostmaster.<apex>".
+	MName, RName string
+	Serial       uint32
+	// TTL of SOA/NS records, also the negative ttl.
+	TTL uint32
+}
+
+// SetZone sets the zone that Hosts serves.
+func (h *Hosts) SetZone(z *Zone) {
+	h.zone = z
+}
+
+// apex returns the zone apex of fqdn, or an empty string if fqdn is not
+// in the zone.
+func (z *Zone) apex(fqdn string) string {
+	if len(z.Name) == 0 {
+		return fqdn
+	}
+	if dns.IsSubDomain(z.Name, fqdn) {
+		return z.Name
+	}
+	return ""
+}
+
+func (z *Zone) hdr(apex string, typ uint16) dns.RR_Header {
+	return dns.RR_Header{Name: apex, Rrtype: typ, Class: dns.ClassINET, Ttl: z.TTL}
+}
+
+func (z *Zone) mname(apex string) string {
+	if len(z.MName) > 0 {
+		return z.MName
+	}
+	return "ns." + apex
+}
+
+func (z *Zone) soa(apex string) *dns.SOA {
+	rname := z.RName
+	if len(rname) == 0 {
+		rname = "hostmaster." + apex
+	}
+	return &dns.SOA{
+		Hdr:     z.hdr(apex, dns.TypeSOA),
+		Ns:      z.mname(apex),
+		Mbox:    rname,
+		Serial:  z.Serial,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  z.TTL,
+	}
+}
+
+func (z *Zone) ns(apex string) []dns.RR {
+	names := z.NS
+	if len(names) == 0 {
+		names = []string{z.mname(apex)}
+	}
+	rrs := make([]dns.RR, 0, len(names))
+	for _, n := range names {
+		rrs = append(rrs, &dns.NS{Hdr: z.hdr(apex, dns.TypeNS), Ns: n})
+	}
+	return rrs
+}
+
+// setAuthority makes r an authoritative answer of the zone of fqdn.
+// It reports false if fqdn is not in the zone.
+func (z *Zone) setAuthority(r *dns.Msg, fqdn string) bool {
+	apex := z.apex(fqdn)
+	if len(apex) == 0 {
+		return false
+	}
+	r.Authoritative = true
+	if len(r.Answer) > 0 {
+		r.Ns = z.ns(apex)
+	} else {
+		r.Ns = []dns.RR{z.soa(apex)}
+	}
+	return true
+}
+
+// lookupApexMsg answers SOA and NS queries of the zone apex.
+func (h *Hosts) lookupApexMsg(m *dns.Msg) *dns.Msg {
+	q := m.Question[0]
+	z := h.zone
+	if len(z.Name) > 0 {
+		if !strings.EqualFold(q.Name, z.Name) {
+			return nil
+		}
+	} else if ipv4, ipv6 := h.Lookup(q.Name); len(ipv4)+len(ipv6) == 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.RecursionAvailable = true
+	r.Authoritative = true
+	apex := q.Name
+	if q.Qtype == dns.TypeSOA {
+		r.Answer = []dns.RR{z.soa(apex)}
+	} else {
+		r.Answer = z.ns(apex)
+	}
+	return r
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+)
+
+func Test_Zone(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	err := domain.LoadFromTextReader[*IPs](m, bytes.NewBufferString("nas.lan 192.168.1.2\nexample.com 1.2.3.4"), ParseIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHosts(m)
+	h.SetZone(&Zone{Name: "lan.", Serial: 1, TTL: 300})
+
+	tests := []struct {
+		name     string
+		qName    string
+		qType    uint16
+		wantNil  bool
+		wantAns  uint16 // type of answer, 0 means empty
+		wantNs   uint16 // type of authority
+		wantAuth bool
+	}{
+		{"answer", "nas.lan.", dns.TypeA, false, dns.TypeA, dns.TypeNS, true},
+		{"nodata", "nas.lan.", dns.TypeAAAA, false, 0, dns.TypeSOA, true},
+		{"apex soa", "lan.", dns.TypeSOA, false, dns.TypeSOA, 0, true},
+		{"apex ns", "lan.", dns.TypeNS, false, dns.TypeNS, 0, true},
+		{"not apex", "nas.lan.", dns.TypeSOA, true, 0, 0, false},
+		{"out of zone", "example.com.", dns.TypeA, false, dns.TypeA, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qType)
+			r := h.LookupMsg(q)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatalf("want nil, got %s", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("nil response")
+			}
+			if got := rrType(r.Answer); got != tt.wantAns {
+				t.Fatalf("want answer type %d, got %d", tt.wantAns, got)
+			}
+			if got := rrType(r.Ns); got != tt.wantNs {
+				t.Fatalf("want authority type %d, got %d", tt.wantNs, got)
+			}
+			if r.Authoritative != tt.wantAuth {
+				t.Fatalf("want aa %v", tt.wantAuth)
+			}
+			for _, rr := range r.Ns {
+				if rr.Header().Name != "lan." {
+					t.Fatalf("unexpected authority owner %s", rr.Header().Name)
+				}
+			}
+		})
+	}
+}
+
+func rrType(rrs []dns.RR) uint16 {
+	if len(rrs) == 0 {
+		return 0
+	}
+	return rrs[0].Header().Rrtype
+}
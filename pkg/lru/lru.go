@@ -103,6 +103,20 @@ func (q *LRU[K, V]) PopOldest() (key K, v V, ok bool) {
 	return
 }
 
+// Shrink removes the oldest entries until the length of q
+// is no larger than size. onEvict is called for every removed entry.
+func (q *LRU[K, V]) Shrink(size int) (removed int) {
+	for q.Len() > size {
+		e := q.l.Front()
+		if e == nil {
+			break
+		}
+		q.delElem(e)
+		removed++
+	}
+	return removed
+}
+
 func (q *LRU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int) {
 	e := q.l.Front()
 	for e != nil {
@@ -117,6 +131,16 @@ func (q *LRU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int) {
 	return removed
 }
 
+// Range calls f for each entry from the oldest to the newest until f
+// returns false. It does not change the order of entries.
+func (q *LRU[K, V]) Range(f func(key K, v V) bool) {
+	for e := q.l.Front(); e != nil; e = e.Next() {
+		if !f(e.Value.key, e.Value.v) {
+			return
+		}
+	}
+}
+
 func (q *LRU[K, V]) Get(key K) (v V, ok bool) {
 	e, ok := q.m[key]
 	if !ok {
@@ -130,6 +130,29 @@ func Test_lru(t *testing.T) {
 	}
 	mustPopOldest(2, 4)
 
+	// test range
+	reset(4)
+	add(1, 2, 3, 4)
+	var keys []int
+	q.Range(func(key int, v int) bool {
+		keys = append(keys, key)
+		return key < 3
+	})
+	if len(keys) != 3 || keys[0] != 1 || keys[2] != 3 {
+		t.Fatalf("q.Range want keys [1 2 3], got %v", keys)
+	}
+	checkLen(4)
+	mustPopOldest(1, 2, 3, 4)
+
+	// test shrink
+	reset(4)
+	add(1, 2, 3, 4)
+	if removed := q.Shrink(2); removed != 2 {
+		t.Fatalf("q.Shrink want removed = 2, got %v", removed)
+	}
+	checkLen(2)
+	mustPopOldest(3, 4)
+
 	// test lru
 	reset(4)
 	add(1, 2, 3, 4) // 1 2 3 4
@@ -99,11 +99,25 @@ func (m *MatcherGroup[T]) Len() int {
 	return s
 }
 
+// approxBytesPerRule is a rough estimation of the memory used by a single
+// domain rule, including the pattern string and the map/trie overhead.
+const approxBytesPerRule = 96
+
+// MemoryUsage returns the approximate memory usage of all sub matchers in bytes.
+func (m *MatcherGroup[T]) MemoryUsage() int64 {
+	return int64(m.Len()) * approxBytesPerRule
+}
+
 func (m *MatcherGroup[T]) Append(nm Matcher[T]) {
 	m.g = append(m.g, nm)
 	return
 }
 
+// Matchers returns the sub matchers of m.
+func (m *MatcherGroup[T]) Matchers() []Matcher[T] {
+	return m.g
+}
+
 func (m *MatcherGroup[T]) AppendCloser(f func()) {
 	m.closer = append(m.closer, f)
 	return
@@ -217,6 +231,14 @@ func (d *DynamicMatcher[T]) Len() int {
 	return m.Len()
 }
 
+// Matcher returns the current matcher of d. It is nil if d has not
+// been loaded yet.
+func (d *DynamicMatcher[T]) Matcher() Matcher[T] {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	return d.m
+}
+
 func (d *DynamicMatcher[T]) Update(b []byte) error {
 	m, err := d.parserFunc(b)
 	if err != nil {
@@ -110,6 +110,16 @@ func (m *FullMatcher[T]) Len() int {
 	return len(m.m)
 }
 
+// Range calls f for each normalized domain and its value, in no
+// particular order, until f returns false.
+func (m *FullMatcher[T]) Range(f func(domain string, v T) bool) {
+	for d, v := range m.m {
+		if !f(d, v) {
+			return
+		}
+	}
+}
+
 type KeywordMatcher[T any] struct {
 	kws map[string]T
 }
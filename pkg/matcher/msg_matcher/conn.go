@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+
+	"github.com/gobwas/glob"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// ConnMatcher matches an attribute of the connection of the query with
+// wildcard patterns.
+type ConnMatcher struct {
+	attr     func(c query_context.ConnInfo) string
+	patterns []glob.Glob
+}
+
+func newConnMatcher(attr func(c query_context.ConnInfo) string, patterns []string) (*ConnMatcher, error) {
+	gs, err := compileGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnMatcher{attr: attr, patterns: gs}, nil
+}
+
+// NewListenerMatcher matches the tag of the server listener.
+func NewListenerMatcher(patterns []string) (*ConnMatcher, error) {
+	return newConnMatcher(func(c query_context.ConnInfo) string { return c.Listener }, patterns)
+}
+
+// NewTransportMatcher matches the transport, e.g. "udp", "dot", "doh".
+func NewTransportMatcher(patterns []string) (*ConnMatcher, error) {
+	return newConnMatcher(func(c query_context.ConnInfo) string { return c.Transport }, patterns)
+}
+
+// NewALPNMatcher matches the negotiated application protocol of tls.
+func NewALPNMatcher(patterns []string) (*ConnMatcher, error) {
+	return newConnMatcher(func(c query_context.ConnInfo) string { return c.ALPN }, patterns)
+}
+
+func (m *ConnMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	return matchGlobs(m.patterns, m.attr(qCtx.ReqMeta().GetConnInfo())), nil
+}
+
+// EncryptedMatcher matches queries from encrypted transports.
+type EncryptedMatcher struct{}
+
+func (EncryptedMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	return qCtx.ReqMeta().GetConnInfo().Encrypted(), nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func TestConnMatcher_Match(t *testing.T) {
+	meta := new(C.RequestMeta)
+	meta.SetConnInfo(C.ConnInfo{Listener: "lan-dot", Transport: "dot", ALPN: "dot"})
+	qCtx := C.NewContext(new(dns.Msg), meta)
+	plainCtx := C.NewContext(new(dns.Msg), nil)
+
+	mustMatcher := func(m *ConnMatcher, err error) *ConnMatcher {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		m    *ConnMatcher
+		want bool
+	}{
+		{"listener", mustMatcher(NewListenerMatcher([]string{"lan-*"})), true},
+		{"listener not matched", mustMatcher(NewListenerMatcher([]string{"wan-*"})), false},
+		{"transport", mustMatcher(NewTransportMatcher([]string{"doh", "dot"})), true},
+		{"transport not matched", mustMatcher(NewTransportMatcher([]string{"udp"})), false},
+		{"alpn", mustMatcher(NewALPNMatcher([]string{"dot"})), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := tt.m.Match(context.Background(), qCtx); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+			if got, _ := tt.m.Match(context.Background(), plainCtx); got {
+				t.Fatal("query without connection should not match")
+			}
+		})
+	}
+
+	if got, _ := (EncryptedMatcher{}).Match(context.Background(), qCtx); !got {
+		t.Fatal("dot should be encrypted")
+	}
+	if got, _ := (EncryptedMatcher{}).Match(context.Background(), plainCtx); got {
+		t.Fatal("query without connection should not be encrypted")
+	}
+}
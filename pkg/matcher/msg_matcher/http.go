@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// HTTPMatcher matches an attribute of the DoH request with wildcard
+// patterns. Queries that are not from DoH servers never match.
+type HTTPMatcher struct {
+	attr     func(r *query_context.HTTPRequest) string
+	patterns []glob.Glob
+}
+
+func newHTTPMatcher(attr func(r *query_context.HTTPRequest) string, patterns []string) (*HTTPMatcher, error) {
+	gs, err := compileGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPMatcher{attr: attr, patterns: gs}, nil
+}
+
+// NewHTTPPathMatcher matches the url path, e.g. "/dns-query".
+func NewHTTPPathMatcher(patterns []string) (*HTTPMatcher, error) {
+	return newHTTPMatcher(func(r *query_context.HTTPRequest) string { return r.Path }, patterns)
+}
+
+// NewUserAgentMatcher matches the User-Agent header.
+func NewUserAgentMatcher(patterns []string) (*HTTPMatcher, error) {
+	return NewHTTPHeaderMatcher("User-Agent", patterns)
+}
+
+// NewHTTPHeaderMatcher matches the header of key.
+func NewHTTPHeaderMatcher(key string, patterns []string) (*HTTPMatcher, error) {
+	return newHTTPMatcher(func(r *query_context.HTTPRequest) string {
+		if r.Header == nil {
+			return ""
+		}
+		return r.Header.Get(key)
+	}, patterns)
+}
+
+// NewSNIMatcher matches the tls server name of the connection.
+func NewSNIMatcher(patterns []string) (*HTTPMatcher, error) {
+	return newHTTPMatcher(func(r *query_context.HTTPRequest) string { return r.ServerName }, patterns)
+}
+
+func (m *HTTPMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	r := qCtx.ReqMeta().GetHTTPRequest()
+	if r == nil {
+		return false, nil
+	}
+	return matchGlobs(m.patterns, m.attr(r)), nil
+}
+
+// ParseHTTPHeaderPatterns parses "Key: pattern" strings and groups
+// patterns by keys.
+func ParseHTTPHeaderPatterns(ss []string) (map[string][]string, error) {
+	m := make(map[string][]string)
+	for _, s := range ss {
+		k, p, ok := strings.Cut(s, ":")
+		k = strings.TrimSpace(k)
+		if !ok || len(k) == 0 {
+			return nil, fmt.Errorf("invalid header pattern %s, want \"Key: pattern\"", s)
+		}
+		m[k] = append(m[k], strings.TrimSpace(p))
+	}
+	return m, nil
+}
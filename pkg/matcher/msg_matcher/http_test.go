@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func TestHTTPMatcher_Match(t *testing.T) {
+	h := make(http.Header)
+	h.Set("User-Agent", "Firefox/128.0")
+	h.Set("X-Device", "kids-tablet")
+	meta := new(C.RequestMeta)
+	meta.SetHTTPRequest(&C.HTTPRequest{Path: "/dns-query/kids", Header: h, ServerName: "kids.dns.example"})
+	qCtx := C.NewContext(new(dns.Msg), meta)
+	plainCtx := C.NewContext(new(dns.Msg), nil)
+
+	headers, err := ParseHTTPHeaderPatterns([]string{"X-Device: kids-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustMatcher := func(m *HTTPMatcher, err error) *HTTPMatcher {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		m    *HTTPMatcher
+		want bool
+	}{
+		{"path", mustMatcher(NewHTTPPathMatcher([]string{"/dns-query/*"})), true},
+		{"user agent", mustMatcher(NewUserAgentMatcher([]string{"Chrome/*", "Firefox/*"})), true},
+		{"user agent not matched", mustMatcher(NewUserAgentMatcher([]string{"Chrome/*"})), false},
+		{"header", mustMatcher(NewHTTPHeaderMatcher("X-Device", headers["X-Device"])), true},
+		{"missing header", mustMatcher(NewHTTPHeaderMatcher("X-User", []string{"*"})), true},
+		{"sni", mustMatcher(NewSNIMatcher([]string{"kids.*"})), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := tt.m.Match(context.Background(), qCtx)
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+			if got, _ := tt.m.Match(context.Background(), plainCtx); got {
+				t.Fatal("non-DoH query should not match")
+			}
+		})
+	}
+
+	if _, err := ParseHTTPHeaderPatterns([]string{"no-colon"}); err == nil {
+		t.Fatal("want error")
+	}
+}
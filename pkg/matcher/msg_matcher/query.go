@@ -21,8 +21,10 @@ package msg_matcher
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
 
+	"github.com/gobwas/glob"
 	"github.com/miekg/dns"
 
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
@@ -64,6 +66,87 @@ func (m *ClientECSMatcher) Match(_ context.Context, qCtx *query_context.Context)
 	return false, nil
 }
 
+// ClientCertMatcher matches the identities of the client certificate,
+// which are its subject common name and SANs (dns names, emails and uris).
+type ClientCertMatcher struct {
+	patterns []glob.Glob
+}
+
+// NewClientCertMatcher compiles patterns. Patterns support wildcards,
+// e.g. "*.users.example.com".
+func NewClientCertMatcher(patterns []string) (*ClientCertMatcher, error) {
+	gs, err := compileGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCertMatcher{patterns: gs}, nil
+}
+
+func (m *ClientCertMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	c := qCtx.ReqMeta().GetClientCert()
+	if c == nil {
+		return false, nil
+	}
+	ids := make([]string, 0, 1+len(c.DNSNames)+len(c.EmailAddresses)+len(c.URIs))
+	if len(c.Subject.CommonName) > 0 {
+		ids = append(ids, c.Subject.CommonName)
+	}
+	ids = append(ids, c.DNSNames...)
+	ids = append(ids, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		ids = append(ids, u.String())
+	}
+	for _, id := range ids {
+		if matchGlobs(m.patterns, id) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClientIDMatcher matches the client id in the edns0 option
+// (see dnsutils.EDNS0ClientID) with wildcard patterns.
+type ClientIDMatcher struct {
+	patterns []glob.Glob
+}
+
+func NewClientIDMatcher(patterns []string) (*ClientIDMatcher, error) {
+	gs, err := compileGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIDMatcher{patterns: gs}, nil
+}
+
+func (m *ClientIDMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	id, ok := dnsutils.GetClientID(qCtx.Q())
+	if !ok {
+		return false, nil
+	}
+	return matchGlobs(m.patterns, id), nil
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	gs := make([]glob.Glob, 0, len(patterns))
+	for _, s := range patterns {
+		g, err := glob.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s, %w", s, err)
+		}
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+func matchGlobs(gs []glob.Glob, s string) bool {
+	for _, g := range gs {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
 type QNameMatcher struct {
 	domainMatcher domain.Matcher[struct{}]
 }
@@ -21,6 +21,8 @@ package msg_matcher
 
 import (
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net"
 	"net/netip"
 	"testing"
@@ -174,3 +176,72 @@ func TestQClassMatcher_Match(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestClientCertMatcher_Match(t *testing.T) {
+	m, err := NewClientCertMatcher([]string{"alice", "*.users.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	newCtx := func(c *x509.Certificate) *C.Context {
+		meta := new(C.RequestMeta)
+		meta.SetClientCert(c)
+		return C.NewContext(q, meta)
+	}
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{"cn", &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, true},
+		{"san", &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}, DNSNames: []string{"bob.users.example.com"}}, true},
+		{"not matched", &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}, false},
+		{"no cert", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Match(context.Background(), newCtx(tt.cert))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIDMatcher_Match(t *testing.T) {
+	m, err := NewClientIDMatcher([]string{"kids-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newQ := func(id string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if len(id) > 0 {
+			dnsutils.SetClientID(q, id)
+		}
+		return q
+	}
+	tests := []struct {
+		name string
+		q    *dns.Msg
+		want bool
+	}{
+		{"matched", newQ("kids-tablet"), true},
+		{"not matched", newQ("laptop"), false},
+		{"no id", newQ(""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Match(context.Background(), C.NewContext(tt.q, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
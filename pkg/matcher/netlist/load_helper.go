@@ -27,6 +27,7 @@ import (
 	"net/netip"
 	"strings"
 	"sync/atomic"
+	"unsafe"
 
 	"google.golang.org/protobuf/proto"
 
@@ -48,6 +49,11 @@ func (m *MatcherGroup) Len() int {
 	return s
 }
 
+// MemoryUsage returns the approximate memory usage of all sub lists in bytes.
+func (m *MatcherGroup) MemoryUsage() int64 {
+	return int64(m.Len()) * int64(unsafe.Sizeof(netip.Prefix{}))
+}
+
 func (m *MatcherGroup) Match(addr netip.Addr) (bool, error) {
 	for _, list := range m.g {
 		ok, err := list.Match(addr)
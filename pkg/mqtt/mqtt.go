@@ -0,0 +1,326 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mqtt implements a minimal MQTT 3.1.1 client that can only
+// publish messages with QoS 0.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	pktConnect    = 1
+	pktConnAck    = 2
+	pktPublish    = 3
+	pktPingReq    = 12
+	pktPingResp   = 13
+	pktDisconnect = 14
+
+	maxRemainingLength = 268435455
+)
+
+// Will is the last will message that the broker publishes when
+// the client disconnects unexpectedly.
+type Will struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type Opts struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration // Default is 60s.
+	Will      *Will
+	TLSConfig *tls.Config // Used by "tls://" and "ssl://" brokers.
+}
+
+// Conn is a connection to a MQTT broker.
+// Publish is concurrent safe.
+type Conn struct {
+	c         net.Conn
+	keepAlive time.Duration
+
+	wm sync.Mutex
+	bw *bufio.Writer
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	err         error
+}
+
+// Dial connects to broker and sends the CONNECT packet.
+// Supported broker url schemes are "tcp", "mqtt", "tls", "ssl" and "mqtts".
+func Dial(ctx context.Context, broker string, opts Opts) (*Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url, %w", err)
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = time.Minute
+	}
+
+	var c net.Conn
+	d := new(net.Dialer)
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		c, err = d.DialContext(ctx, "tcp", hostWithDefaultPort(u, "1883"))
+	case "tls", "ssl", "mqtts":
+		td := &tls.Dialer{NetDialer: d, Config: opts.TLSConfig}
+		c, err = td.DialContext(ctx, "tcp", hostWithDefaultPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := NewConn(ctx, c, opts)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if len(u.Port()) > 0 {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// NewConn sends the CONNECT packet through c and waits for the CONNACK.
+func NewConn(ctx context.Context, c net.Conn, opts Opts) (*Conn, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = time.Minute
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(ddl)
+		defer c.SetDeadline(time.Time{})
+	}
+
+	if _, err := c.Write(encodeConnect(opts)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	typ, body, err := readPacket(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connack, %w", err)
+	}
+	if typ != pktConnAck || len(body) != 2 {
+		return nil, fmt.Errorf("unexpected packet type %d", typ)
+	}
+	if rc := body[1]; rc != 0 {
+		return nil, fmt.Errorf("connection refused by broker, return code %d", rc)
+	}
+
+	conn := &Conn{
+		c:           c,
+		keepAlive:   opts.KeepAlive,
+		bw:          bufio.NewWriter(c),
+		closeNotify: make(chan struct{}),
+	}
+	go conn.readLoop(br)
+	go conn.pingLoop()
+	return conn, nil
+}
+
+// Publish publishes a QoS 0 message.
+func (c *Conn) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(pktPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return c.writePacket(header, body, c.keepAlive)
+}
+
+// Done returns a channel that is closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closeNotify
+}
+
+// Err returns the error that closed the connection.
+func (c *Conn) Err() error {
+	select {
+	case <-c.closeNotify:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close sends DISCONNECT and closes the connection. The broker
+// will not publish the will message.
+func (c *Conn) Close() error {
+	_ = c.writePacket(pktDisconnect<<4, nil, time.Second)
+	c.closeWithErr(net.ErrClosed)
+	return nil
+}
+
+func (c *Conn) closeWithErr(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.c.Close()
+		close(c.closeNotify)
+	})
+}
+
+func (c *Conn) writePacket(header byte, body []byte, timeout time.Duration) error {
+	if len(body) > maxRemainingLength {
+		return errors.New("packet too large")
+	}
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	c.c.SetWriteDeadline(time.Now().Add(timeout))
+	c.bw.WriteByte(header)
+	c.bw.Write(appendVarint(nil, len(body)))
+	c.bw.Write(body)
+	if err := c.bw.Flush(); err != nil {
+		c.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) readLoop(br *bufio.Reader) {
+	for {
+		// Broker closes the connection if no packet is received in 1.5 keepalive.
+		c.c.SetReadDeadline(time.Now().Add(c.keepAlive * 2))
+		if _, _, err := readPacket(br); err != nil {
+			c.closeWithErr(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writePacket(pktPingReq<<4, nil, c.keepAlive); err != nil {
+				return
+			}
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+func encodeConnect(opts Opts) []byte {
+	var flags byte = 0x02 // clean session
+	if opts.Will != nil {
+		flags |= 0x04
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if len(opts.Username) > 0 {
+		flags |= 0x80
+	}
+	if len(opts.Password) > 0 {
+		flags |= 0x40
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 (3.1.1)
+	ka := uint16(opts.KeepAlive / time.Second)
+	body = append(body, byte(ka>>8), byte(ka))
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		body = appendString(body, opts.Will.Topic)
+		body = appendBytes(body, opts.Will.Payload)
+	}
+	if len(opts.Username) > 0 {
+		body = appendString(body, opts.Username)
+	}
+	if len(opts.Password) > 0 {
+		body = appendString(body, opts.Password)
+	}
+
+	b := []byte{pktConnect << 4}
+	b = appendVarint(b, len(body))
+	return append(b, body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, s []byte) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readPacket reads a packet and returns its type and body.
+func readPacket(br *bufio.Reader) (typ byte, body []byte, err error) {
+	header, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		d, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(d&0x7f) * mul
+		mul *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
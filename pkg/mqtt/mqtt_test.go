@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Conn(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	type got struct {
+		connect []byte
+		publish []byte
+		pubType byte
+		err     error
+	}
+	res := make(chan got, 1)
+	go func() {
+		var g got
+		defer func() { res <- g }()
+		br := bufio.NewReader(sc)
+		var typ byte
+		if typ, g.connect, g.err = readPacket(br); g.err != nil {
+			return
+		}
+		if typ != pktConnect {
+			g.err = net.ErrClosed
+			return
+		}
+		if _, g.err = sc.Write([]byte{pktConnAck << 4, 2, 0, 0}); g.err != nil {
+			return
+		}
+		var header byte
+		if header, g.err = br.ReadByte(); g.err != nil {
+			return
+		}
+		g.pubType = header
+		br.UnreadByte()
+		_, g.publish, g.err = readPacket(br)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := NewConn(ctx, cc, Opts{
+		ClientID: "id",
+		Username: "u",
+		Password: "p",
+		Will:     &Will{Topic: "s", Payload: []byte("offline"), Retain: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Publish("t/1", []byte("hello"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	g := <-res
+	if g.err != nil {
+		t.Fatal(g.err)
+	}
+	wantConnect := []byte{
+		0, 4, 'M', 'Q', 'T', 'T', 4, 0x80 | 0x40 | 0x20 | 0x04 | 0x02, 0, 60,
+		0, 2, 'i', 'd',
+		0, 1, 's', 0, 7, 'o', 'f', 'f', 'l', 'i', 'n', 'e',
+		0, 1, 'u',
+		0, 1, 'p',
+	}
+	if !bytes.Equal(g.connect, wantConnect) {
+		t.Fatalf("connect packet: got %v, want %v", g.connect, wantConnect)
+	}
+	if g.pubType != pktPublish<<4|0x01 {
+		t.Fatalf("publish header: got %x", g.pubType)
+	}
+	wantPublish := []byte{0, 3, 't', '/', '1', 'h', 'e', 'l', 'l', 'o'}
+	if !bytes.Equal(g.publish, wantPublish) {
+		t.Fatalf("publish packet: got %v, want %v", g.publish, wantPublish)
+	}
+}
+
+func Test_varint(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152} {
+		b := appendVarint(nil, n)
+		b = append([]byte{pktPublish << 4}, b...)
+		b = append(b, make([]byte, n)...)
+		_, body, err := readPacket(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != n {
+			t.Fatalf("n %d: got %d", n, len(body))
+		}
+	}
+}
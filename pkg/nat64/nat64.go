@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package nat64 implements address synthesis and prefix discovery of
+// NAT64 (RFC 6052, RFC 7050 and RFC 8781).
+package nat64
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Well-known ipv4 addresses of ipv4only.arpa (RFC 7050).
+var (
+	wka1 = netip.AddrFrom4([4]byte{192, 0, 0, 170})
+	wka2 = netip.AddrFrom4([4]byte{192, 0, 0, 171})
+)
+
+// validPrefixLen are prefix lengths that can embed an ipv4 address (RFC 6052).
+var validPrefixLen = []int{96, 64, 56, 48, 40, 32}
+
+// ValidPrefixLen reports whether l is a valid NAT64 prefix length.
+func ValidPrefixLen(l int) bool {
+	for _, v := range validPrefixLen {
+		if v == l {
+			return true
+		}
+	}
+	return false
+}
+
+// EmbedIPv4 returns an ipv6 address that embeds v4 in prefix as RFC 6052
+// section 2.2. Bits 64 to 71 (the "u" octet) are always zero.
+func EmbedIPv4(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	b4 := v4.As4()
+	i := prefix.Bits() / 8
+	for _, c := range b4 {
+		if i == 8 {
+			b[i] = 0
+			i++
+		}
+		b[i] = c
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// ExtractIPv4 is the reverse of EmbedIPv4.
+func ExtractIPv4(addr netip.Addr, prefixLen int) netip.Addr {
+	b := addr.As16()
+	var b4 [4]byte
+	i := prefixLen / 8
+	for j := range b4 {
+		if i == 8 {
+			i++
+		}
+		b4[j] = b[i]
+		i++
+	}
+	return netip.AddrFrom4(b4)
+}
+
+// PrefixFromWKA finds the NAT64 prefix from a synthesized address of
+// ipv4only.arpa (RFC 7050 section 3).
+func PrefixFromWKA(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Prefix{}, false
+	}
+	for _, l := range validPrefixLen {
+		if v4 := ExtractIPv4(addr, l); v4 == wka1 || v4 == wka2 {
+			return netip.PrefixFrom(addr, l).Masked(), true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Lookup discovers the NAT64 prefix by querying the AAAA record of
+// ipv4only.arpa (RFC 7050) from r. It returns an invalid prefix and a
+// nil error if the network has no NAT64.
+func Lookup(ctx context.Context, r *net.Resolver) (netip.Prefix, error) {
+	addrs, err := r.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return netip.Prefix{}, nil
+		}
+		return netip.Prefix{}, err
+	}
+	for _, addr := range addrs {
+		if p, ok := PrefixFromWKA(addr); ok {
+			return p, nil
+		}
+	}
+	return netip.Prefix{}, nil
+}
+
+const (
+	icmpTypeRouterAdvertisement = 134
+	raOptionPref64              = 38
+	raHeaderLen                 = 16
+)
+
+// plcToBits maps the prefix length code of PREF64 options to prefix lengths.
+var plcToBits = [...]int{96, 64, 56, 48, 40, 32}
+
+// ValidRASource reports whether a router advertisement from src with
+// the ip hop limit hopLimit is valid. Routers send advertisements from
+// link-local addresses with a hop limit of 255, so they can't come from
+// other links (RFC 4861 6.1.2).
+func ValidRASource(src netip.Addr, hopLimit int) bool {
+	return hopLimit == 255 && src.Unmap().Is6() && src.IsLinkLocalUnicast()
+}
+
+// ParseRAPref64 parses an icmpv6 router advertisement and returns the
+// PREF64 option (RFC 8781) in it.
+func ParseRAPref64(b []byte) (prefix netip.Prefix, lifetime time.Duration, ok bool) {
+	if len(b) < raHeaderLen || b[0] != icmpTypeRouterAdvertisement || b[1] != 0 {
+		return netip.Prefix{}, 0, false
+	}
+	opts := b[raHeaderLen:]
+	for len(opts) >= 2 {
+		l := int(opts[1]) * 8
+		if l == 0 || l > len(opts) {
+			return netip.Prefix{}, 0, false
+		}
+		if opts[0] == raOptionPref64 && l == 16 {
+			v := binary.BigEndian.Uint16(opts[2:4])
+			plc := int(v & 0x7)
+			if plc >= len(plcToBits) {
+				return netip.Prefix{}, 0, false
+			}
+			var a [16]byte
+			copy(a[:12], opts[4:16])
+			lifetime = time.Duration(v>>3) * 8 * time.Second
+			return netip.PrefixFrom(netip.AddrFrom16(a), plcToBits[plc]).Masked(), lifetime, true
+		}
+		opts = opts[l:]
+	}
+	return netip.Prefix{}, 0, false
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nat64
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_embedIPv4(t *testing.T) {
+	// Examples from RFC 6052 section 2.4.
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	}
+	for _, tt := range tests {
+		p := netip.MustParsePrefix(tt.prefix)
+		got := EmbedIPv4(p, v4)
+		if want := netip.MustParseAddr(tt.want); got != want {
+			t.Errorf("%s: got %s, want %s", tt.prefix, got, want)
+		}
+		if back := ExtractIPv4(got, p.Bits()); back != v4 {
+			t.Errorf("%s: extract got %s", tt.prefix, back)
+		}
+		if tt.prefix == "64:ff9b::/96" {
+			continue
+		}
+		if wp, ok := PrefixFromWKA(EmbedIPv4(p, wka1)); !ok || wp != p {
+			t.Errorf("%s: PrefixFromWKA got %s %v", tt.prefix, wp, ok)
+		}
+	}
+}
+
+func Test_parseRAPref64(t *testing.T) {
+	ra := make([]byte, 16)
+	ra[0] = icmpTypeRouterAdvertisement
+	// A source link-layer address option, then a PREF64 option of
+	// 64:ff9b::/96 with a 600s lifetime.
+	ra = append(ra, 1, 1, 0, 1, 2, 3, 4, 5)
+	ra = append(ra, raOptionPref64, 2, 0x02, 0x58 /* 600/8<<3 | plc 0 */, 0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0)
+	p, lifetime, ok := ParseRAPref64(ra)
+	if !ok {
+		t.Fatal("pref64 option not found")
+	}
+	if p != netip.MustParsePrefix("64:ff9b::/96") || lifetime != 600*time.Second {
+		t.Fatalf("got %s %s", p, lifetime)
+	}
+	if _, _, ok := ParseRAPref64(ra[:24]); ok {
+		t.Fatal("ra without pref64 option")
+	}
+}
+
+func Test_validRASource(t *testing.T) {
+	tests := []struct {
+		src      string
+		hopLimit int
+		want     bool
+	}{
+		{"fe80::1", 255, true},
+		{"fe80::1", 254, false},     // forwarded by a router
+		{"2001:db8::1", 255, false}, // not link-local
+		{"169.254.0.1", 255, false},
+		{"", 255, false},
+	}
+	for _, tt := range tests {
+		var src netip.Addr
+		if len(tt.src) > 0 {
+			src = netip.MustParseAddr(tt.src)
+		}
+		if got := ValidRASource(src, tt.hopLimit); got != tt.want {
+			t.Errorf("ValidRASource(%s, %d) = %t, want %t", tt.src, tt.hopLimit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package neighbor identifies clients in the local network by their mac
+// addresses.
+package neighbor
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// EDNS0MACOption is the option code that dnsmasq (--add-mac) uses
+	// to forward client mac addresses.
+	EDNS0MACOption = 65001
+
+	// DefaultARPFile is the arp table of linux.
+	DefaultARPFile = "/proc/net/arp"
+
+	arpRefreshInterval = time.Second * 5
+)
+
+// MACFromQuery returns the mac address in the edns0 option 65001.
+func MACFromQuery(q *dns.Msg) (net.HardwareAddr, bool) {
+	opt := q.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0MACOption && len(local.Data) == 6 {
+			return net.HardwareAddr(local.Data), true
+		}
+	}
+	return nil, false
+}
+
+// ARPTable resolves ip addresses to mac addresses from a linux
+// /proc/net/arp format file.
+type ARPTable struct {
+	file string
+
+	m         sync.Mutex
+	t         map[netip.Addr]string
+	updatedAt time.Time
+}
+
+func NewARPTable(file string) *ARPTable {
+	return &ARPTable{file: file}
+}
+
+// ClientMAC returns the mac address of the client of q from the edns0
+// option, or from t if q has no mac. t can be nil.
+func ClientMAC(q *dns.Msg, addr netip.Addr, t *ARPTable) (string, bool) {
+	if hw, ok := MACFromQuery(q); ok {
+		return hw.String(), true
+	}
+	if t == nil || !addr.IsValid() {
+		return "", false
+	}
+	return t.Lookup(addr)
+}
+
+// Lookup returns the mac address of addr. The table is reloaded on miss,
+// at most once every arpRefreshInterval.
+func (a *ARPTable) Lookup(addr netip.Addr) (string, bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if mac, ok := a.t[addr]; ok && time.Since(a.updatedAt) < time.Minute {
+		return mac, true
+	}
+	if time.Since(a.updatedAt) < arpRefreshInterval {
+		mac, ok := a.t[addr]
+		return mac, ok
+	}
+	a.updatedAt = time.Now()
+	if b, err := os.ReadFile(a.file); err == nil {
+		a.t = parseARP(b)
+	}
+	mac, ok := a.t[addr]
+	return mac, ok
+}
+
+// parseARP parses lines like
+// "192.168.1.2  0x1  0x2  aa:bb:cc:dd:ee:ff  *  eth0".
+// Incomplete entries are ignored.
+func parseARP(b []byte) map[netip.Addr]string {
+	t := make(map[netip.Addr]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue // header
+		}
+		hw, err := net.ParseMAC(fields[3])
+		if err != nil || fields[3] == "00:00:00:00:00:00" {
+			continue
+		}
+		t[addr] = hw.String()
+	}
+	return t
+}
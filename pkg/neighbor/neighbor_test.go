@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_parseARP(t *testing.T) {
+	b := []byte(`IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.2      0x1         0x2         AA:BB:CC:DD:EE:FF     *        br-lan
+192.168.1.3      0x1         0x0         00:00:00:00:00:00     *        br-lan
+`)
+	tb := parseARP(b)
+	if len(tb) != 1 {
+		t.Fatalf("got %d entries", len(tb))
+	}
+	if mac := tb[netip.MustParseAddr("192.168.1.2")]; mac != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("got mac %s", mac)
+	}
+}
+
+func TestMACFromQuery(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, ok := MACFromQuery(q); ok {
+		t.Fatal("query without edns0 has no mac")
+	}
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0MACOption, Data: []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}})
+	q.Extra = append(q.Extra, opt)
+	hw, ok := MACFromQuery(q)
+	if !ok || hw.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("got %v %v", hw, ok)
+	}
+}
+
+func TestClientMAC(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, ok := ClientMAC(q, netip.MustParseAddr("192.168.1.2"), nil); ok {
+		t.Fatal("no mac without edns0 option and arp table")
+	}
+	if _, ok := ClientMAC(q, netip.MustParseAddr("192.168.1.2"), NewARPTable("/nonexistent")); ok {
+		t.Fatal("no mac in a missing arp table")
+	}
+}
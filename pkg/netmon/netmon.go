@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package netmon watches network changes, e.g. a WAN reconnection.
+package netmon
+
+import (
+	"time"
+)
+
+// Watch calls f after the network changes. Changes within delay are
+// merged into one call. It blocks until closeSignal is closed or an
+// error occurs.
+func Watch(delay time.Duration, f func(), closeSignal <-chan struct{}) error {
+	events := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go debounce(delay, events, f, done)
+	return watch(events, closeSignal)
+}
+
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+func debounce(delay time.Duration, events <-chan struct{}, f func(), done <-chan struct{}) {
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-events:
+			timer.Reset(delay)
+		case <-timer.C:
+			f()
+		case <-done:
+			return
+		}
+	}
+}
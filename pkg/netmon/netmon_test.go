@@ -0,0 +1,43 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netmon
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_debounce(t *testing.T) {
+	events := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	var calls atomic.Int32
+	go debounce(time.Millisecond*50, events, func() { calls.Add(1) }, done)
+
+	for i := 0; i < 5; i++ {
+		notify(events)
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("want 1 call, got %d", n)
+	}
+}
@@ -20,6 +20,7 @@
 package query_context
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -38,6 +39,50 @@ type RequestMeta struct {
 	// ClientAddr contains the client ip address.
 	// It might be zero/invalid.
 	clientAddr netip.Addr
+
+	// clientCert is the verified certificate of a DoT/DoH/DoQ client.
+	// It might be nil.
+	clientCert *x509.Certificate
+
+	// httpRequest is the DoH request of the query. It might be nil.
+	httpRequest *HTTPRequest
+
+	// serverName is the server name the client asked for. It might be empty.
+	serverName string
+
+	// clientName is the friendly name of the client, set by plugins.
+	// It might be empty.
+	clientName string
+
+	connInfo ConnInfo
+}
+
+// ConnInfo describes the connection of the request.
+type ConnInfo struct {
+	Listener  string // tag of the server listener, maybe empty
+	Transport string // "udp", "tcp", "dot", "doh", "http", "doq" or "doh3"
+	ALPN      string // negotiated application protocol of tls, maybe empty
+}
+
+// Encrypted reports whether the transport is encrypted.
+func (c ConnInfo) Encrypted() bool {
+	switch c.Transport {
+	case "dot", "doh", "doq", "doh3":
+		return true
+	}
+	return false
+}
+
+// HTTPRequest contains attributes of a DoH request.
+type HTTPRequest struct {
+	Path       string
+	Header     HTTPHeader
+	ServerName string // SNI of the tls connection, maybe empty.
+}
+
+// HTTPHeader is the header of a DoH request.
+type HTTPHeader interface {
+	Get(key string) string
 }
 
 func NewRequestMeta(addr netip.Addr) *RequestMeta {
@@ -60,6 +105,56 @@ func (m *RequestMeta) GetClientAddr() netip.Addr {
 	return m.clientAddr
 }
 
+func (m *RequestMeta) SetClientCert(c *x509.Certificate) {
+	m.clientCert = c
+}
+
+// GetClientCert returns the verified client certificate. It returns nil
+// if the client didn't authenticate with a certificate.
+func (m *RequestMeta) GetClientCert() *x509.Certificate {
+	return m.clientCert
+}
+
+func (m *RequestMeta) SetHTTPRequest(r *HTTPRequest) {
+	m.httpRequest = r
+}
+
+// GetHTTPRequest returns the DoH request. It returns nil if the query
+// is not from a DoH server.
+func (m *RequestMeta) GetHTTPRequest() *HTTPRequest {
+	return m.httpRequest
+}
+
+func (m *RequestMeta) SetServerName(s string) {
+	m.serverName = s
+}
+
+// GetServerName returns the SNI of DoT/DoH/DoQ connections. For DoH
+// requests without SNI, it's the host of the Host header.
+func (m *RequestMeta) GetServerName() string {
+	return m.serverName
+}
+
+func (m *RequestMeta) SetClientName(s string) {
+	m.clientName = s
+}
+
+// GetClientName returns the friendly name of the client, e.g.
+// "Ana's iPhone". It might be empty.
+func (m *RequestMeta) GetClientName() string {
+	return m.clientName
+}
+
+func (m *RequestMeta) SetConnInfo(c ConnInfo) {
+	m.connInfo = c
+}
+
+// GetConnInfo returns the connection of the request. It's zero if the
+// query is not from a server.
+func (m *RequestMeta) GetConnInfo() ConnInfo {
+	return m.connInfo
+}
+
 // Context is a query context that pass through plugins
 // A Context will always have a non-nil Q.
 // Context MUST be created using NewContext.
@@ -72,8 +167,10 @@ type Context struct {
 	id            uint32 // additional uint to distinguish duplicated msg
 	reqMeta       *RequestMeta
 
-	r     *dns.Msg
-	marks map[uint]struct{}
+	r      *dns.Msg
+	marks  map[uint]struct{}
+	trace  *trace // nil if tracing is disabled, shared by copies
+	values map[int]any
 }
 
 var (
@@ -120,6 +217,9 @@ func (ctx *Context) String() string {
 	} else {
 		clientAddr = "unknown client"
 	}
+	if len(ctx.reqMeta.clientName) > 0 {
+		clientAddr += " (" + ctx.reqMeta.clientName + ")"
+	}
 
 	return fmt.Sprintf("%s %d %d %s", question, ctx.q.Id, ctx.id, clientAddr)
 }
@@ -187,6 +287,7 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 	d.originalQuery = ctx.originalQuery
 	d.reqMeta = ctx.reqMeta
 	d.id = ctx.id
+	d.trace = ctx.trace
 
 	if r := ctx.r; r != nil {
 		d.r = r.Copy()
@@ -194,6 +295,12 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 	for m := range ctx.marks {
 		d.AddMark(m)
 	}
+	if len(ctx.values) > 0 {
+		d.values = make(map[int]any, len(ctx.values))
+		for k, v := range ctx.values {
+			d.values[k] = v
+		}
+	}
 	return d
 }
 
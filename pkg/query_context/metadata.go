@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Key is a typed key of values that plugins attach to a Context to
+// pass data downstream, e.g. the matched list or the chosen upstream.
+// Keys must be created by NewKey, usually as package level vars.
+type Key[T any] struct {
+	id   int
+	name string
+}
+
+// Name returns the registered name of k.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+var keyRegistry struct {
+	m     sync.RWMutex
+	names []string
+	ids   map[string]int
+}
+
+// NewKey registers a key. Names should be prefixed by the package or
+// plugin type to avoid conflicts. e.g. "fast_forward.upstream".
+// It panics if name was registered.
+func NewKey[T any](name string) Key[T] {
+	r := &keyRegistry
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.ids == nil {
+		r.ids = make(map[string]int)
+	}
+	if _, dup := r.ids[name]; dup {
+		panic(fmt.Sprintf("query_context: duplicated key %s", name))
+	}
+	id := len(r.names)
+	r.names = append(r.names, name)
+	r.ids[name] = id
+	return Key[T]{id: id, name: name}
+}
+
+// RegisteredKeys returns names of all registered keys.
+func RegisteredKeys() []string {
+	r := &keyRegistry
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+func keyName(id int) string {
+	r := &keyRegistry
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.names[id]
+}
+
+// SetValue attaches v to ctx.
+func SetValue[T any](ctx *Context, k Key[T], v T) {
+	if ctx.values == nil {
+		ctx.values = make(map[int]any)
+	}
+	ctx.values[k.id] = v
+}
+
+// GetValue returns the value of k in ctx.
+func GetValue[T any](ctx *Context, k Key[T]) (v T, ok bool) {
+	v, ok = ctx.values[k.id].(T)
+	return v, ok
+}
+
+// DeleteValue removes the value of k from ctx.
+func DeleteValue[T any](ctx *Context, k Key[T]) {
+	delete(ctx.values, k.id)
+}
+
+// Values returns all values in ctx by their key names.
+func (ctx *Context) Values() map[string]any {
+	if len(ctx.values) == 0 {
+		return nil
+	}
+	m := make(map[string]any, len(ctx.values))
+	for id, v := range ctx.values {
+		m[keyName(id)] = v
+	}
+	return m
+}
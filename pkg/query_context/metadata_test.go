@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	testKeyStr = NewKey[string]("test.str")
+	testKeyInt = NewKey[int]("test.int")
+)
+
+func TestValues(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx := NewContext(q, nil)
+	if _, ok := GetValue(ctx, testKeyStr); ok {
+		t.Fatal("empty context should not have values")
+	}
+
+	SetValue(ctx, testKeyStr, "a")
+	SetValue(ctx, testKeyInt, 1)
+	c := ctx.Copy()
+	SetValue(c, testKeyInt, 2)
+	if v, _ := GetValue(ctx, testKeyInt); v != 1 {
+		t.Fatalf("copy should not change the original, got %d", v)
+	}
+	if v, ok := GetValue(c, testKeyStr); !ok || v != "a" {
+		t.Fatalf("copy should have values, got %q", v)
+	}
+	if m := c.Values(); len(m) != 2 || m["test.str"] != "a" || m["test.int"] != 2 {
+		t.Fatalf("unexpected values %v", m)
+	}
+	DeleteValue(c, testKeyStr)
+	if _, ok := GetValue(c, testKeyStr); ok {
+		t.Fatal("value is not deleted")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicated key should panic")
+		}
+	}()
+	NewKey[bool]("test.str")
+}
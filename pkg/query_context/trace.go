@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTraceEvents limits the size of a trace.
+const maxTraceEvents = 64
+
+// trace records how a query was processed. It is shared by the copies
+// of a Context, which may run concurrently, so it has a lock.
+type trace struct {
+	m       sync.Mutex
+	events  []TraceEvent
+	dropped int
+}
+
+// TraceEvent is a step of a traced query.
+type TraceEvent struct {
+	// Elapsed is the time since the query arrived.
+	Elapsed time.Duration
+	Msg     string
+}
+
+// String returns the event with its timing, e.g. "+1.234ms exec cache (cache)".
+func (e TraceEvent) String() string {
+	return "+" + strconv.FormatFloat(float64(e.Elapsed.Microseconds())/1000, 'f', 3, 64) + "ms " + e.Msg
+}
+
+// EnableTrace enables tracing of this Context and its future copies.
+func (ctx *Context) EnableTrace() {
+	if ctx.trace == nil {
+		ctx.trace = new(trace)
+	}
+}
+
+// Tracing reports whether tracing is enabled. Callers can use it to
+// skip building expensive trace events.
+func (ctx *Context) Tracing() bool {
+	return ctx.trace != nil
+}
+
+// Tracef records a trace event if tracing is enabled.
+func (ctx *Context) Tracef(format string, a ...any) {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	e := TraceEvent{Elapsed: time.Since(ctx.startTime), Msg: fmt.Sprintf(format, a...)}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(t.events) >= maxTraceEvents {
+		t.dropped++
+		return
+	}
+	t.events = append(t.events, e)
+}
+
+// TraceEvents returns a copy of recorded trace events.
+func (ctx *Context) TraceEvents() []TraceEvent {
+	t := ctx.trace
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	events := append([]TraceEvent(nil), t.events...)
+	if t.dropped > 0 {
+		events = append(events, TraceEvent{
+			Elapsed: time.Since(ctx.startTime),
+			Msg:     fmt.Sprintf("%d more events dropped", t.dropped),
+		})
+	}
+	return events
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestContext_trace(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := NewContext(q, nil)
+	qCtx.Tracef("not traced")
+	if qCtx.TraceEvents() != nil {
+		t.Fatal("trace should be disabled")
+	}
+
+	qCtx.EnableTrace()
+	for i := 0; i < maxTraceEvents+2; i++ {
+		qCtx.Copy().Tracef("event %d", i)
+	}
+	events := qCtx.TraceEvents()
+	if len(events) != maxTraceEvents+1 {
+		t.Fatalf("want %d events, got %d", maxTraceEvents+1, len(events))
+	}
+	if got := events[1].Msg; got != "event 1" {
+		t.Fatalf("unexpected event %q", got)
+	}
+	if got := events[maxTraceEvents].Msg; got != "2 more events dropped" {
+		t.Fatalf("unexpected last event %q", got)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Elapsed < events[i-1].Elapsed {
+			t.Fatal("events are not in order")
+		}
+	}
+}
+
+func TestTraceEvent_String(t *testing.T) {
+	e := TraceEvent{Elapsed: 1234567 * time.Nanosecond, Msg: "exec cache (cache)"}
+	if got := e.String(); got != "+1.234ms exec cache (cache)" {
+		t.Fatalf("unexpected string %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote_kv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const consulMaxWait = "5m"
+
+type consulClient struct {
+	hc       *http.Client
+	endpoint string
+	key      string
+	token    string
+	dc       string
+}
+
+func (c *consulClient) Key() string {
+	return c.key
+}
+
+func (c *consulClient) do(ctx context.Context, index uint64) (v []byte, newIndex uint64, err error) {
+	q := url.Values{}
+	q.Set("raw", "")
+	if len(c.dc) > 0 {
+		q.Set("dc", c.dc)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulMaxWait)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/v1/kv/"+c.key+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	newIndex, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, newIndex, ErrKeyNotFound
+	default:
+		return nil, 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	v, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, newIndex, nil
+}
+
+func (c *consulClient) Get(ctx context.Context) ([]byte, uint64, error) {
+	return c.do(ctx, 0)
+}
+
+// Wait uses consul blocking query. Note that consul may return before
+// the key is modified (e.g. wait timeout), the caller should check
+// the index returned by Get.
+func (c *consulClient) Wait(ctx context.Context, index uint64) error {
+	_, _, err := c.do(ctx, index)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
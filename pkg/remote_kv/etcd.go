@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote_kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type etcdClient struct {
+	hc       *http.Client
+	endpoint string
+	key      string
+	user     string
+	password string
+
+	tm    sync.Mutex
+	token string
+}
+
+func (c *etcdClient) Key() string {
+	return c.key
+}
+
+func (c *etcdClient) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.user) > 0 {
+		token, err := c.getToken(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to authenticate, %w", err)
+		}
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.tm.Lock()
+			c.token = ""
+			c.tm.Unlock()
+		}
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (c *etcdClient) getToken(ctx context.Context) (string, error) {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	if len(c.token) > 0 {
+		return c.token, nil
+	}
+
+	b, _ := json.Marshal(map[string]string{"name": c.user, "password": c.password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/v3/auth/authenticate", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var r struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	c.token = r.Token
+	return r.Token, nil
+}
+
+type etcdKV struct {
+	Value       []byte `json:"value"` // base64 encoded in json
+	ModRevision string `json:"mod_revision"`
+}
+
+func (c *etcdClient) Get(ctx context.Context) ([]byte, uint64, error) {
+	resp, err := c.post(ctx, "/v3/kv/range", map[string][]byte{"key": []byte(c.key)})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, 0, ErrKeyNotFound
+	}
+	rev, _ := strconv.ParseUint(r.Kvs[0].ModRevision, 10, 64)
+	return r.Kvs[0].Value, rev, nil
+}
+
+// Wait opens a watch stream that starts after index and returns
+// once an event is received.
+func (c *etcdClient) Wait(ctx context.Context, index uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	body := map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(c.key),
+			"start_revision": strconv.FormatUint(index+1, 10),
+		},
+	}
+	resp, err := c.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return errors.New("watch canceled by server")
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
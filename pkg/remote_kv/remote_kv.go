@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package remote_kv implements minimal http clients for Consul KV and etcd v3
+// (through its grpc-gateway json api) to read and watch a single key.
+package remote_kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// Client reads and watches a single key.
+type Client interface {
+	// Get returns the value of the key and its modify index.
+	Get(ctx context.Context) (v []byte, index uint64, err error)
+
+	// Wait blocks until the key was modified after index, or ctx is done.
+	Wait(ctx context.Context, index uint64) error
+
+	// Key returns the key of this Client.
+	Key() string
+}
+
+// IsKVURL returns true if s has a scheme that is supported by NewClient.
+func IsKVURL(s string) bool {
+	for _, prefix := range [...]string{"consul://", "consul+https://", "etcd://", "etcd+https://"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClient creates a Client from a url.
+// Supported formats are:
+//
+//	consul[+https]://host:port/path/to/key[?token=xxx&dc=xxx]
+//	etcd[+https]://[user:password@]host:port/path/to/key
+//
+// Note that the leading "/" of the path is stripped for consul, but
+// kept for etcd.
+func NewClient(s string) (Client, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	backend, tlsScheme, _ := strings.Cut(u.Scheme, "+")
+	scheme := "http"
+	if tlsScheme == "https" {
+		scheme = "https"
+	} else if len(tlsScheme) > 0 {
+		return nil, fmt.Errorf("invalid scheme %s", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New("missing host")
+	}
+	endpoint := scheme + "://" + u.Host
+	hc := &http.Client{}
+
+	switch backend {
+	case "consul":
+		key := strings.TrimPrefix(u.Path, "/")
+		if len(key) == 0 {
+			return nil, errors.New("missing key")
+		}
+		return &consulClient{
+			hc:       hc,
+			endpoint: endpoint,
+			key:      key,
+			token:    u.Query().Get("token"),
+			dc:       u.Query().Get("dc"),
+		}, nil
+	case "etcd":
+		if len(u.Path) == 0 || u.Path == "/" {
+			return nil, errors.New("missing key")
+		}
+		c := &etcdClient{
+			hc:       hc,
+			endpoint: endpoint,
+			key:      u.Path,
+		}
+		if u.User != nil {
+			c.user = u.User.Username()
+			c.password, _ = u.User.Password()
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported kv backend %s", backend)
+	}
+}
+
+// Watch calls Get and then calls f every time the key is modified until
+// ctx is done. Errors are reported to onErr and retried after retryDelay.
+func Watch(ctx context.Context, c Client, index uint64, retryDelay time.Duration, f func(v []byte), onErr func(err error)) {
+	for {
+		err := c.Wait(ctx, index)
+		if err == nil {
+			var v []byte
+			var newIndex uint64
+			v, newIndex, err = c.Get(ctx)
+			if err == nil {
+				if newIndex != index {
+					index = newIndex
+					f(v)
+				}
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		onErr(err)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote_kv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantKey string
+		wantErr bool
+	}{
+		{"consul://127.0.0.1:8500/mosdns/rules", "mosdns/rules", false},
+		{"consul+https://127.0.0.1:8500/k?token=t", "k", false},
+		{"etcd://127.0.0.1:2379/mosdns/rules", "/mosdns/rules", false},
+		{"etcd://127.0.0.1:2379/", "", true},
+		{"consul+tls://127.0.0.1:8500/k", "", true},
+		{"zk://127.0.0.1:2181/k", "", true},
+		{"consul:///k", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			c, err := NewClient(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && c.Key() != tt.wantKey {
+				t.Fatalf("want key %s, got %s", tt.wantKey, c.Key())
+			}
+		})
+	}
+}
+
+func TestConsulClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "tk" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/a/b":
+			w.Header().Set("X-Consul-Index", "7")
+			w.Write([]byte("example.com"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	host := strings.TrimPrefix(s.URL, "http://")
+	c, err := NewClient("consul://" + host + "/a/b?token=tk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, index, err := c.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "example.com" || index != 7 {
+		t.Fatalf("unexpected result %s, %d", v, index)
+	}
+
+	c, _ = NewClient("consul://" + host + "/none?token=tk")
+	if _, _, err := c.Get(context.Background()); err != ErrKeyNotFound {
+		t.Fatalf("want ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestEtcdClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key []byte `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/v3/kv/range" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if string(req.Key) != "/a/b" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"kvs": []etcdKV{{Value: []byte("1.1.1.1"), ModRevision: "42"}},
+		})
+	}))
+	defer s.Close()
+
+	host := strings.TrimPrefix(s.URL, "http://")
+	c, _ := NewClient("etcd://" + host + "/a/b")
+	v, index, err := c.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "1.1.1.1" || index != 42 {
+		t.Fatalf("unexpected result %s, %d", v, index)
+	}
+
+	c, _ = NewClient("etcd://" + host + "/none")
+	if _, _, err := c.Get(context.Background()); err != ErrKeyNotFound {
+		t.Fatalf("want ErrKeyNotFound, got %v", err)
+	}
+}
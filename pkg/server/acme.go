@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+
+	eTLS "gitlab.com/go-extension/tls"
+	"golang.org/x/crypto/acme"
+)
+
+// CertManager obtains and renews certificates, e.g. *autocert.Manager.
+type CertManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// isACMEChallenge reports whether the client hello is a tls-alpn-01
+// challenge of an ACME CA.
+func isACMEChallenge(protos []string) bool {
+	return len(protos) == 1 && protos[0] == acme.ALPNProto
+}
+
+// eTLSACMECertificate is CertManager.GetCertificate for eTLS.
+func eTLSACMECertificate(m CertManager, chi *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
+	hello := &tls.ClientHelloInfo{
+		CipherSuites:      chi.CipherSuites,
+		ServerName:        chi.ServerName,
+		SupportedPoints:   chi.SupportedPoints,
+		SupportedProtos:   chi.SupportedProtos,
+		SupportedVersions: chi.SupportedVersions,
+	}
+	for _, c := range chi.SupportedCurves {
+		hello.SupportedCurves = append(hello.SupportedCurves, tls.CurveID(c))
+	}
+	for _, s := range chi.SignatureSchemes {
+		hello.SignatureSchemes = append(hello.SignatureSchemes, tls.SignatureScheme(s))
+	}
+	c, err := m.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return &eTLS.Certificate{
+		Certificate:                 c.Certificate,
+		PrivateKey:                  c.PrivateKey,
+		OCSPStaple:                  c.OCSPStaple,
+		SignedCertificateTimestamps: c.SignedCertificateTimestamps,
+		Leaf:                        c.Leaf,
+	}, nil
+}
@@ -66,6 +66,27 @@ type EntryHandlerOpts struct {
 
 	// RecursionAvailable sets the dns.Msg.RecursionAvailable flag globally.
 	RecursionAvailable bool
+
+	// CompleteCanceled keeps Entry running after ctx is canceled, e.g. the
+	// client closed its connection, until QueryTimeout. So the upstream
+	// exchange of an abandoned query still populates caches.
+	CompleteCanceled bool
+
+	// Trace decides whether the execution trace of a query is appended
+	// to its response. Optional. See TraceOptionCode.
+	Trace func(req *dns.Msg, meta *query_context.RequestMeta) bool
+
+	// Capture decides whether a query is traced without changing its
+	// response. It returns a function that receives the traced query
+	// and its error after it is processed, or nil if the query is not
+	// captured. Optional.
+	Capture func(req *dns.Msg, meta *query_context.RequestMeta) func(qCtx *query_context.Context, err error)
+
+	// Malformed handles malformed queries. Optional. If nil, queries
+	// without questions or with invalid names get FORMERR responses,
+	// queries that can't be unpacked are dropped, others are passed to
+	// Entry.
+	Malformed *MalformedPolicy
 }
 
 func (opts *EntryHandlerOpts) Init() error {
@@ -94,6 +115,10 @@ func NewEntryHandler(opts EntryHandlerOpts) (*EntryHandler, error) {
 // If entry returns an error, a SERVFAIL response will be returned.
 // If entry returns without a response, a REFUSED response will be returned.
 func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	if h.opts.CompleteCanceled {
+		ctx = context.WithoutCancel(ctx) // also drops the deadline of ctx
+	}
+
 	// apply timeout to ctx
 	ddl := time.Now().Add(h.opts.QueryTimeout)
 	ctxDdl, ok := ctx.Deadline()
@@ -102,23 +127,49 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 		defer cancel()
 		ctx = newCtx
 	}
-	// return FORMERR response
-	if len(req.Question) == 0 {
-		h.opts.Logger.Warn("zero question")
-		return h.responseFormErr(req), nil
-	}
-	for _, question := range req.Question {
-		_, ok := dns.IsDomainName(question.Name)
-		if !ok {
-			h.opts.Logger.Warn(fmt.Sprintf("invalid question name: %s", question.Name))
+	if p := h.opts.Malformed; p != nil {
+		if reason := malformedReason(req); len(reason) > 0 {
+			h.opts.Logger.Debug("malformed query", zap.String("reason", reason), zap.Stringer("client", meta.GetClientAddr()))
+			r, err := p.handle(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			if h.opts.RecursionAvailable {
+				r.RecursionAvailable = true
+			}
+			r.Id = req.Id
+			return r, nil
+		}
+	} else {
+		// return FORMERR response
+		if len(req.Question) == 0 {
+			h.opts.Logger.Warn("zero question")
 			return h.responseFormErr(req), nil
 		}
+		for _, question := range req.Question {
+			_, ok := dns.IsDomainName(question.Name)
+			if !ok {
+				h.opts.Logger.Warn(fmt.Sprintf("invalid question name: %s", question.Name))
+				return h.responseFormErr(req), nil
+			}
+		}
 	}
 	// cache original id
 	id := req.Id
 
 	// exec entry
+	tracing := h.opts.Trace != nil && h.opts.Trace(req, meta)
+	if tracing {
+		removeTraceOption(req)
+	}
+	var captured func(qCtx *query_context.Context, err error)
+	if h.opts.Capture != nil {
+		captured = h.opts.Capture(req, meta)
+	}
 	qCtx := query_context.NewContext(req, meta)
+	if tracing || captured != nil {
+		qCtx.EnableTrace()
+	}
 	err := h.opts.Entry.Exec(ctx, qCtx, nil)
 	respMsg := qCtx.R()
 	if err != nil {
@@ -139,10 +190,26 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	if h.opts.RecursionAvailable {
 		respMsg.RecursionAvailable = true
 	}
+	if captured != nil {
+		captured(qCtx, err)
+	}
+	if tracing {
+		appendTrace(respMsg, qCtx.TraceEvents())
+	}
 	respMsg.Id = id
 	return respMsg, nil
 }
 
+// ServeRaw implements RawHandler.
+func (h *EntryHandler) ServeRaw(ctx context.Context, b []byte, meta *query_context.RequestMeta) ([]byte, error) {
+	p := h.opts.Malformed
+	if p == nil {
+		return nil, ErrDropped
+	}
+	h.opts.Logger.Debug("malformed query", zap.String("reason", "unpack failed"), zap.Stringer("client", meta.GetClientAddr()))
+	return p.handleRaw(ctx, b)
+}
+
 func (h *EntryHandler) responseFormErr(req *dns.Msg) *dns.Msg {
 	res := new(dns.Msg)
 	res.SetReply(req)
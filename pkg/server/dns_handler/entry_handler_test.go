@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// slowExec responds after 50ms unless ctx is done.
+type slowExec struct{}
+
+func (slowExec) Exec(ctx context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	select {
+	case <-time.After(time.Millisecond * 50):
+		qCtx.SetResponse(new(dns.Msg).SetReply(qCtx.Q()))
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func TestEntryHandler_completeCanceled(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	for _, complete := range []bool{false, true} {
+		h, err := NewEntryHandler(EntryHandlerOpts{Entry: slowExec{}, CompleteCanceled: complete})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r, err := h.ServeDNS(ctx, q.Copy(), new(query_context.RequestMeta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := dns.RcodeServerFailure
+		if complete {
+			want = dns.RcodeSuccess
+		}
+		if r.Rcode != want {
+			t.Fatalf("complete %t: want rcode %d, got %d", complete, want, r.Rcode)
+		}
+	}
+}
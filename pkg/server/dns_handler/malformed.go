@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// ErrDropped is returned by handlers that drop the query on purpose.
+// Servers send nothing back.
+var ErrDropped = errors.New("query dropped")
+
+// RawHandler is an optional interface of Handler. It handles queries
+// that can't be unpacked.
+type RawHandler interface {
+	// ServeRaw returns the raw response of b, or ErrDropped.
+	ServeRaw(ctx context.Context, b []byte, meta *query_context.RequestMeta) ([]byte, error)
+}
+
+// Actions of MalformedPolicy.
+const (
+	MalformedFormErr = "formerr"
+	MalformedDrop    = "drop"
+	MalformedRefused = "refused"
+	MalformedNotImp  = "notimp"
+	MalformedForward = "forward"
+)
+
+const malformedForwardTimeout = time.Second * 3
+
+// MalformedPolicy handles malformed queries, which can't be unpacked,
+// have no or multiple questions, invalid names or an opcode other than
+// QUERY.
+type MalformedPolicy struct {
+	action  string
+	forward string // udp address of the upstream, for MalformedForward
+}
+
+// NewMalformedPolicy returns a MalformedPolicy of action. forward is the
+// "host:port" of an udp upstream, which is required by MalformedForward.
+// Queries are forwarded as is.
+func NewMalformedPolicy(action, forward string) (*MalformedPolicy, error) {
+	switch action {
+	case MalformedFormErr, MalformedDrop, MalformedRefused, MalformedNotImp:
+	case MalformedForward:
+		if _, _, err := net.SplitHostPort(forward); err != nil {
+			return nil, fmt.Errorf("invalid upstream of malformed queries, %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action of malformed queries %s", action)
+	}
+	return &MalformedPolicy{action: action, forward: forward}, nil
+}
+
+// malformedReason returns why req is malformed, or "" if it's not.
+func malformedReason(req *dns.Msg) string {
+	if req.Opcode != dns.OpcodeQuery {
+		return "unexpected opcode " + dns.OpcodeToString[req.Opcode]
+	}
+	switch len(req.Question) {
+	case 0:
+		return "zero question"
+	case 1:
+	default:
+		return "multiple questions"
+	}
+	if _, ok := dns.IsDomainName(req.Question[0].Name); !ok {
+		return "invalid question name " + req.Question[0].Name
+	}
+	return ""
+}
+
+// handle returns the response of req, which is malformed.
+func (p *MalformedPolicy) handle(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	switch p.action {
+	case MalformedDrop:
+		return nil, ErrDropped
+	case MalformedForward:
+		b, err := req.Pack()
+		if err != nil {
+			return nil, err
+		}
+		rb, err := p.exchangeRaw(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(rb); err != nil {
+			return nil, fmt.Errorf("invalid response of malformed query, %w", err)
+		}
+		return r, nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(req, p.rcode())
+	return r, nil
+}
+
+// handleRaw returns the response of b, which can't be unpacked.
+func (p *MalformedPolicy) handleRaw(ctx context.Context, b []byte) ([]byte, error) {
+	switch p.action {
+	case MalformedDrop:
+		return nil, ErrDropped
+	case MalformedForward:
+		return p.exchangeRaw(ctx, b)
+	}
+	if len(b) < 12 { // not even a header
+		return nil, ErrDropped
+	}
+	// A header only response with the id, opcode and RD flag of b.
+	r := make([]byte, 12)
+	copy(r, b[:2])
+	flags := binary.BigEndian.Uint16(b[2:4])
+	flags = 1<<15 | flags&(0xf<<11|1<<8) | uint16(p.rcode())
+	binary.BigEndian.PutUint16(r[2:4], flags)
+	return r, nil
+}
+
+func (p *MalformedPolicy) rcode() int {
+	switch p.action {
+	case MalformedRefused:
+		return dns.RcodeRefused
+	case MalformedNotImp:
+		return dns.RcodeNotImplemented
+	default:
+		return dns.RcodeFormatError
+	}
+}
+
+// exchangeRaw sends b to p.forward over udp and returns the response.
+func (p *MalformedPolicy) exchangeRaw(ctx context.Context, b []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, malformedForwardTimeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", p.forward)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ddl, _ := ctx.Deadline()
+	c.SetDeadline(ddl)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	rb := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := c.Read(rb)
+		if err != nil {
+			return nil, err
+		}
+		// Skip responses of other ids, if b has one.
+		if len(b) < 2 || n >= 2 && rb[0] == b[0] && rb[1] == b[1] {
+			return rb[:n], nil
+		}
+	}
+}
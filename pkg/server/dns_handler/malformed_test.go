@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newMalformedHandler(t *testing.T, action, forward string) *EntryHandler {
+	t.Helper()
+	p, err := NewMalformedPolicy(action, forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewEntryHandler(EntryHandlerOpts{Entry: tracedExec{}, Malformed: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestEntryHandler_malformed(t *testing.T) {
+	ctx := context.Background()
+	meta := new(query_context.RequestMeta)
+
+	multi := new(dns.Msg)
+	multi.SetQuestion("a.example.", dns.TypeA)
+	multi.Question = append(multi.Question, dns.Question{Name: "b.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	notify := new(dns.Msg)
+	notify.SetNotify("example.")
+
+	tests := []struct {
+		action string
+		q      *dns.Msg
+		rcode  int
+	}{
+		{MalformedRefused, multi, dns.RcodeRefused},
+		{MalformedNotImp, notify, dns.RcodeNotImplemented},
+		{MalformedFormErr, new(dns.Msg), dns.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		r, err := newMalformedHandler(t, tt.action, "").ServeDNS(ctx, tt.q.Copy(), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tt.rcode || r.Id != tt.q.Id {
+			t.Fatalf("%s: unexpected response %v", tt.action, r)
+		}
+	}
+
+	// Normal queries are passed to the entry.
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	if r, err := newMalformedHandler(t, MalformedDrop, "").ServeDNS(ctx, q, meta); err != nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected response %v, %v", r, err)
+	}
+	if _, err := newMalformedHandler(t, MalformedDrop, "").ServeDNS(ctx, multi.Copy(), meta); !errors.Is(err, ErrDropped) {
+		t.Fatalf("want ErrDropped, got %v", err)
+	}
+
+	// Raw queries.
+	raw := []byte{0x12, 0x34, 0x01, 0x00, 0xff}
+	if _, err := newMalformedHandler(t, MalformedRefused, "").ServeRaw(ctx, raw, meta); !errors.Is(err, ErrDropped) {
+		t.Fatalf("short raw query should be dropped, got %v", err)
+	}
+	raw = append([]byte{0x12, 0x34, 0x01, 0x00}, make([]byte, 10)...)
+	b, err := newMalformedHandler(t, MalformedRefused, "").ServeRaw(ctx, raw, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != 0x1234 || !r.Response || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("unexpected raw response %v", r)
+	}
+	if _, err := NewMalformedPolicy("ignore", ""); err == nil {
+		t.Fatal("unknown action should be an error")
+	}
+}
+
+func TestEntryHandler_malformedForward(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			// Echo the query back as the response.
+			c.WriteTo(b[:n], addr)
+		}
+	}()
+
+	h := newMalformedHandler(t, MalformedForward, c.LocalAddr().String())
+	raw := []byte{0x12, 0x34, 0xff, 0xff, 0xff}
+	b, err := h.ServeRaw(context.Background(), raw, new(query_context.RequestMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, raw) {
+		t.Fatalf("unexpected response %x", b)
+	}
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.")
+	r, err := h.ServeDNS(context.Background(), notify, new(query_context.RequestMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Opcode != dns.OpcodeNotify || r.Id != notify.Id {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// TraceOptionCode is the EDNS0 local option that clients use to
+// request the execution trace. e.g. "dig +ednsopt=65010 example.com".
+const TraceOptionCode = 65010
+
+// TraceName is the owner name of the TXT record that carries the trace.
+const TraceName = "trace.mosdns."
+
+// HasTraceOption reports whether m has the TraceOptionCode option.
+func HasTraceOption(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && dnsutils.GetEDNS0Option(opt, TraceOptionCode) != nil
+}
+
+func removeTraceOption(m *dns.Msg) {
+	if opt := m.IsEdns0(); opt != nil {
+		dnsutils.RemoveEDNS0Option(opt, TraceOptionCode)
+	}
+}
+
+// appendTrace appends events to r as a TXT record of class CHAOS in
+// the additional section. Each event is a string of the record.
+func appendTrace(r *dns.Msg, events []query_context.TraceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: TraceName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}}
+	for _, ev := range events {
+		e := ev.String()
+		for len(e) > 255 {
+			txt.Txt = append(txt.Txt, e[:255])
+			e = e[255:]
+		}
+		txt.Txt = append(txt.Txt, e)
+	}
+	r.Extra = append(r.Extra, txt)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type tracedExec struct{}
+
+func (tracedExec) Tag() string  { return "forward" }
+func (tracedExec) Type() string { return "test" }
+
+func (tracedExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	qCtx.SetResponse(new(dns.Msg).SetReply(qCtx.Q()))
+	return nil
+}
+
+type entryExec struct {
+	next executable_seq.ExecutableChainNode
+}
+
+func (e entryExec) Exec(ctx context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	qCtx.Tracef("entry")
+	return executable_seq.ExecChainNode(ctx, qCtx, e.next)
+}
+
+func TestEntryHandler_trace(t *testing.T) {
+	h, err := NewEntryHandler(EntryHandlerOpts{
+		Entry: entryExec{next: executable_seq.WrapExecutable(tracedExec{})},
+		Trace: func(req *dns.Msg, _ *query_context.RequestMeta) bool { return HasTraceOption(req) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := h.ServeDNS(context.Background(), q.Copy(), new(query_context.RequestMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Extra) != 0 {
+		t.Fatal("query without trace option should not be traced")
+	}
+
+	opt := q.SetEdns0(1232, false).IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: TraceOptionCode})
+	req := q.Copy()
+	r, err = h.ServeDNS(context.Background(), req, new(query_context.RequestMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HasTraceOption(req) {
+		t.Fatal("trace option should be removed from the query")
+	}
+	var txt *dns.TXT
+	for _, rr := range r.Extra {
+		if rr, ok := rr.(*dns.TXT); ok && rr.Hdr.Name == TraceName {
+			txt = rr
+		}
+	}
+	if txt == nil {
+		t.Fatal("missing trace record")
+	}
+	var events []string
+	for _, s := range txt.Txt {
+		elapsed, e, _ := strings.Cut(s, " ")
+		if !strings.HasPrefix(elapsed, "+") || !strings.HasSuffix(elapsed, "ms") {
+			t.Fatalf("missing timing in %q", s)
+		}
+		events = append(events, e)
+	}
+	if got := strings.Join(events, "|"); got != "entry|exec forward (test)" {
+		t.Fatalf("unexpected trace %q", got)
+	}
+}
@@ -21,6 +21,7 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"io"
 	"net"
 	"net/url"
@@ -28,6 +29,7 @@ import (
 
 	"gitlab.com/go-extension/http"
 
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
 )
 
@@ -44,7 +46,7 @@ func (s *Server) ServeHTTP(l net.Listener) error {
 	}
 
 	hs := &http.Server{
-		Handler:           &eHandler{s.opts.HttpHandler},
+		Handler:           &eHandler{h: s.opts.HttpHandler, listener: s.opts.Listener},
 		ReadHeaderTimeout: time.Millisecond * 500,
 		ReadTimeout:       time.Second * 5,
 		WriteTimeout:      time.Second * 5,
@@ -66,15 +68,17 @@ func (s *Server) ServeHTTP(l net.Listener) error {
 }
 
 type eHandler struct {
-	h *H.Handler
+	h        *H.Handler
+	listener string
 }
 
 func (h *eHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.h.ServeHTTP(&eWriter{w}, &eRequest{r})
+	h.h.ServeHTTP(&eWriter{w}, &eRequest{r: r, listener: h.listener})
 }
 
 type eRequest struct {
-	r *http.Request
+	r        *http.Request
+	listener string
 }
 
 func (r *eRequest) URL() *url.URL {
@@ -109,6 +113,31 @@ func (r *eRequest) SetRemoteAddr(addr string) {
 	r.r.RemoteAddr = addr
 }
 
+func (r *eRequest) ServerName() string {
+	if r.r.TLS == nil {
+		return ""
+	}
+	return r.r.TLS.ServerName
+}
+
+func (r *eRequest) Host() string {
+	return r.r.Host
+}
+
+func (r *eRequest) ConnInfo() C.ConnInfo {
+	if r.r.TLS == nil {
+		return C.ConnInfo{Listener: r.listener, Transport: "http"}
+	}
+	return C.ConnInfo{Listener: r.listener, Transport: "doh", ALPN: r.r.TLS.NegotiatedProtocol}
+}
+
+func (r *eRequest) ClientCert() *x509.Certificate {
+	if r.r.TLS == nil {
+		return nil
+	}
+	return verifiedClientCert(r.r.TLS.VerifiedChains)
+}
+
 type eWriter struct {
 	w http.ResponseWriter
 }
@@ -21,6 +21,7 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"io"
 	"net/http"
 	"net/url"
@@ -29,6 +30,7 @@ import (
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
 )
 
@@ -47,7 +49,7 @@ func (s *Server) ServeH3(l *quic.EarlyListener) error {
 	}
 
 	hs := &http3.Server{
-		Handler:        &sHandler{s.opts.HttpHandler},
+		Handler:        &sHandler{h: s.opts.HttpHandler, listener: s.opts.Listener},
 		IdleTimeout:    idleTimeout,
 		MaxHeaderBytes: 2048,
 	}
@@ -66,15 +68,17 @@ func (s *Server) ServeH3(l *quic.EarlyListener) error {
 }
 
 type sHandler struct {
-	h *H.Handler
+	h        *H.Handler
+	listener string
 }
 
 func (h *sHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.h.ServeHTTP(&sWriter{w}, &sRequest{r})
+	h.h.ServeHTTP(&sWriter{w}, &sRequest{r: r, listener: h.listener})
 }
 
 type sRequest struct {
-	r *http.Request
+	r        *http.Request
+	listener string
 }
 
 func (r *sRequest) URL() *url.URL {
@@ -109,6 +113,32 @@ func (r *sRequest) SetRemoteAddr(addr string) {
 	r.r.RemoteAddr = addr
 }
 
+func (r *sRequest) ServerName() string {
+	if r.r.TLS == nil {
+		return ""
+	}
+	return r.r.TLS.ServerName
+}
+
+func (r *sRequest) Host() string {
+	return r.r.Host
+}
+
+func (r *sRequest) ConnInfo() C.ConnInfo {
+	c := C.ConnInfo{Listener: r.listener, Transport: "doh3"}
+	if r.r.TLS != nil {
+		c.ALPN = r.r.TLS.NegotiatedProtocol
+	}
+	return c
+}
+
+func (r *sRequest) ClientCert() *x509.Certificate {
+	if r.r.TLS == nil {
+		return nil
+	}
+	return verifiedClientCert(r.r.TLS.VerifiedChains)
+}
+
 type sWriter struct {
 	w http.ResponseWriter
 }
@@ -99,7 +99,23 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 
 			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 			meta := C.NewRequestMeta(clientAddr)
+			meta.SetServerName(c.ConnectionState().TLS.ServerName)
+			meta.SetConnInfo(C.ConnInfo{
+				Listener:  s.opts.Listener,
+				Transport: "doq",
+				ALPN:      c.ConnectionState().TLS.NegotiatedProtocol,
+			})
 			defer s.trackCloser(closer, false)
+			if s.opts.ClientCAs != nil {
+				// Client certificates are not verified before the
+				// handshake is completed. Don't accept 0-RTT queries.
+				select {
+				case <-c.HandshakeComplete():
+				case <-quicConnCtx.Done():
+					return
+				}
+				meta.SetClientCert(verifiedClientCert(c.ConnectionState().TLS.VerifiedChains))
+			}
 
 			timeout := time.AfterFunc(firstReadTimeout, cancelConn)
 			for {
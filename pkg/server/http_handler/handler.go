@@ -21,10 +21,12 @@ package http_handler
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
@@ -36,6 +38,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
@@ -51,10 +54,21 @@ type HandlerOpts struct {
 	// will ignore the request path.
 	Path string
 
+	// JSONPath specifies the endpoint of the json api (application/dns-json).
+	// e.g. "/resolve". Json api requests (with "Accept: application/dns-json")
+	// to Path are also accepted. If it is empty, only the latter is supported.
+	JSONPath string
+
 	// SrcIPHeader specifies the header that contain client source address.
 	// "True-Client-IP" "X-Real-IP" "X-Forwarded-For" will parse automatically.
 	SrcIPHeader string
 
+	// TrustedProxies are addresses of reverse proxies. If it is not nil,
+	// client address headers are only accepted from these peers, and the
+	// client address is the rightmost untrusted address in X-Forwarded-For.
+	// Otherwise, headers from any peer are accepted.
+	TrustedProxies *netlist.List
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
@@ -105,14 +119,39 @@ type Request interface {
 	RequestURI() string
 	GetRemoteAddr() string
 	SetRemoteAddr(addr string)
+	// ClientCert returns the verified client certificate, maybe nil.
+	ClientCert() *x509.Certificate
+	// ServerName returns the SNI of the tls connection, maybe empty.
+	ServerName() string
+	// Host returns the host of the Host header, maybe with a port.
+	Host() string
+	// ConnInfo returns the connection of the request.
+	ConnInfo() C.ConnInfo
 }
 
 func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	// get remote addr from header and request
 	meta := new(C.RequestMeta)
-	if addr, err := getRemoteAddr(req, h.opts.SrcIPHeader); err == nil {
+	if addr, err := getRemoteAddr(req, h.opts.SrcIPHeader, h.opts.TrustedProxies); err == nil {
 		meta.SetClientAddr(addr)
 	}
+	meta.SetClientCert(req.ClientCert())
+	meta.SetHTTPRequest(&C.HTTPRequest{
+		Path:       req.URL().Path,
+		Header:     req.Header(),
+		ServerName: req.ServerName(),
+	})
+	meta.SetConnInfo(req.ConnInfo())
+	if sn := req.ServerName(); len(sn) > 0 {
+		meta.SetServerName(sn)
+	} else {
+		meta.SetServerName(hostWithoutPort(req.Host()))
+	}
+
+	if h.isJSONRequest(req) {
+		h.serveJSON(w, req, meta)
+		return
+	}
 
 	// check url path
 	if len(h.opts.Path) != 0 && req.URL().Path != h.opts.Path {
@@ -225,7 +264,13 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	}
 }
 
-func getRemoteAddr(req Request, customHeader string) (netip.Addr, error) {
+func getRemoteAddr(req Request, customHeader string, trusted *netlist.List) (netip.Addr, error) {
+	peer, peerErr := netip.ParseAddrPort(req.GetRemoteAddr())
+	// Peers without an ip address (e.g. unix socket peers) are trusted.
+	if trusted != nil && peerErr == nil && !isTrusted(trusted, peer.Addr()) {
+		return peer.Addr(), nil
+	}
+
 	if tcip := req.Header().Get("True-Client-IP"); tcip != "" {
 		if addr, err := netip.ParseAddr(tcip); err == nil {
 			req.SetRemoteAddr(tcip)
@@ -239,9 +284,8 @@ func getRemoteAddr(req Request, customHeader string) (netip.Addr, error) {
 		}
 	}
 	if xff := req.Header().Get("X-Forwarded-For"); xff != "" {
-		ip, _, _ := strings.Cut(xff, ",")
-		if addr, err := netip.ParseAddr(ip); err == nil {
-			req.SetRemoteAddr(ip)
+		if addr, ok := xffClientAddr(xff, trusted); ok {
+			req.SetRemoteAddr(addr.String())
 			return addr, nil
 		}
 	}
@@ -253,11 +297,37 @@ func getRemoteAddr(req Request, customHeader string) (netip.Addr, error) {
 			}
 		}
 	}
-	addrport, err := netip.ParseAddrPort(req.GetRemoteAddr())
-	if err != nil {
-		return netip.Addr{}, err
+	if peerErr != nil {
+		return netip.Addr{}, peerErr
+	}
+	return peer.Addr(), nil
+}
+
+// xffClientAddr returns the client address in the X-Forwarded-For header.
+// It is the first address, or the rightmost untrusted address if trusted
+// is not nil. Proxies append the address of their peers, so addresses
+// before the last untrusted one may be forged by clients.
+func xffClientAddr(xff string, trusted *netlist.List) (netip.Addr, bool) {
+	ips := strings.Split(xff, ",")
+	if trusted == nil {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ips[0]))
+		return addr, err == nil
+	}
+	for i := len(ips) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if i == 0 || !isTrusted(trusted, addr) {
+			return addr, true
+		}
 	}
-	return addrport.Addr(), nil
+	return netip.Addr{}, false
+}
+
+func isTrusted(trusted *netlist.List, addr netip.Addr) bool {
+	ok, _ := trusted.Contains(addr)
+	return ok
 }
 
 func contain[T any](arr []T, it T) bool {
@@ -268,3 +338,10 @@ func contain[T any](arr []T, it T) bool {
 	}
 	return false
 }
+
+func hostWithoutPort(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
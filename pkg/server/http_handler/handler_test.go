@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+)
+
+func Test_xffClientAddr(t *testing.T) {
+	trusted := netlist.NewList()
+	if err := netlist.LoadFromText(trusted, "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	trusted.Sort()
+
+	tests := []struct {
+		name    string
+		xff     string
+		trusted *netlist.List
+		want    string
+	}{
+		{"first", "1.1.1.1, 2.2.2.2", nil, "1.1.1.1"},
+		{"invalid first", "x, 2.2.2.2", nil, ""},
+		{"rightmost untrusted", "1.1.1.1, 2.2.2.2, 10.0.0.1", trusted, "2.2.2.2"},
+		{"all trusted", "10.0.0.2,10.0.0.1", trusted, "10.0.0.2"},
+		{"invalid", "1.1.1.1, x, 10.0.0.1", trusted, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, ok := xffClientAddr(tt.xff, tt.trusted)
+			if len(tt.want) == 0 {
+				if ok {
+					t.Fatalf("want failure, got %s", addr)
+				}
+				return
+			}
+			if !ok || addr != netip.MustParseAddr(tt.want) {
+				t.Fatalf("got %s %v, want %s", addr, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pmkol/mosdns-x/pkg/dns_json"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func (h *Handler) isJSONRequest(req Request) bool {
+	path := req.URL().Path
+	if len(h.opts.JSONPath) != 0 && path == h.opts.JSONPath {
+		return true
+	}
+	if len(h.opts.Path) != 0 && path != h.opts.Path {
+		return false
+	}
+	if req.Method() != http.MethodGet || !req.URL().Query().Has("name") {
+		return false
+	}
+	return strings.Contains(req.Header().Get("Accept"), dns_json.ContentType) ||
+		req.URL().Query().Get("ct") == dns_json.ContentType
+}
+
+// serveJSON serves the json api. e.g. "GET /resolve?name=example.com&type=AAAA".
+func (h *Handler) serveJSON(w ResponseWriter, req Request, meta *C.RequestMeta) {
+	if req.Method() != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("invalid request method"))
+		h.warnErr(req, fmt.Errorf("invalid method: %s", req.Method()))
+		return
+	}
+
+	q, err := dns_json.ParseQuery(req.URL().Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		h.warnErr(req, fmt.Errorf("invalid json query: %s", err))
+		return
+	}
+
+	r, err := h.opts.DNSHandler.ServeDNS(req.Context(), q, meta)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "handle response failed")
+		h.warnErr(req, fmt.Errorf("handle response failed: %s", err))
+		return
+	}
+
+	b, err := json.Marshal(dns_json.FromMsg(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "marshal response failed")
+		h.warnErr(req, fmt.Errorf("marshal response failed: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", dns_json.ContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dnsutils.GetMinimalTTL(r)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		h.warnErr(req, fmt.Errorf("write response failed: %s", err))
+	}
+}
+
+func writeJSONError(w ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: msg})
+	w.Header().Set("Content-Type", dns_json.ContentType)
+	w.WriteHeader(code)
+	w.Write(b)
+}
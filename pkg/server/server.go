@@ -20,8 +20,10 @@
 package server
 
 import (
+	"crypto/x509"
 	"errors"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -54,6 +56,31 @@ type ServerOpts struct {
 	// Only useful if there is no server certificate specified in TLSConfig.
 	Cert, Key string
 
+	// SNICerts are presented to clients that ask for their names. Others
+	// get Cert, or the first of SNICerts if Cert is empty.
+	SNICerts []SNICert
+
+	// ACME obtains and renews certificates for clients that don't ask
+	// for names of SNICerts. Cert and Key are not used if it is set.
+	ACME CertManager
+
+	// Listener is the tag of the listener, see query_context.ConnInfo.
+	Listener string
+
+	// NeedServerName makes the DoT server finish the handshake before
+	// reading queries, so DNSHandler knows the server name. It disables
+	// 0-RTT queries.
+	NeedServerName bool
+
+	// ClientCAs verifies client certificates of DoT, DoH and DoQ servers.
+	// Verified certificates are available in the query context.
+	// Nil disables client certificates.
+	ClientCAs *x509.CertPool
+
+	// RequireClientCert rejects clients that don't have a valid certificate.
+	// Otherwise, a certificate is only verified if the client sends one.
+	RequireClientCert bool
+
 	// KernelTX and KernelRX control whether kernel TLS offloading is enabled
 	// If the kernel is not supported, it is automatically downgraded to the application implementation
 	//
@@ -66,6 +93,34 @@ type ServerOpts struct {
 	IdleTimeout time.Duration
 }
 
+// SNICert is a certificate for server names.
+type SNICert struct {
+	// Names are server names, e.g. "dns.example.com". "*.example.com"
+	// matches all subdomains of example.com.
+	Names     []string
+	Cert, Key string
+}
+
+// MatchServerName reports whether name matches one of patterns.
+// See SNICert.Names.
+func MatchServerName(patterns []string, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if len(name) == 0 {
+		return false
+	}
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(p), ".")
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
 func (opts *ServerOpts) init() {
 	if opts.Logger == nil {
 		opts.Logger = nopLogger
@@ -87,6 +142,7 @@ type Server struct {
 	m             sync.Mutex
 	closed        bool
 	closerTracker map[io.Closer]struct{}
+	certs         []interface{ reload() error }
 }
 
 func NewServer(opts ServerOpts) *Server {
@@ -103,6 +159,28 @@ func (s *Server) Closed() bool {
 	return s.closed
 }
 
+func (s *Server) addCertReloader(c interface{ reload() error }) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.certs = append(s.certs, c)
+}
+
+// ReloadCerts loads certificate files of the Server again. Certificates
+// are also reloaded automatically when their files change. Certificates
+// that fail to load are not replaced.
+func (s *Server) ReloadCerts() error {
+	s.m.Lock()
+	certs := s.certs
+	s.m.Unlock()
+	var errs []error
+	for _, c := range certs {
+		if err := c.reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // trackCloser adds or removes c to the Server and return true if Server is not closed.
 // We use a pointer in case the underlying value is incomparable.
 func (s *Server) trackCloser(c io.Closer, add bool) bool {
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+func TestMatchServerName(t *testing.T) {
+	patterns := []string{"family.example.com", "*.kids.example.com"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"family.example.com", true},
+		{"Family.Example.com.", true},
+		{"a.kids.example.com", true},
+		{"a.b.kids.example.com", true},
+		{"kids.example.com", false},
+		{"clean.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := MatchServerName(patterns, tt.name); got != tt.want {
+			t.Errorf("MatchServerName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServer_ServeQUIC(t *testing.T) {
+	s := NewServer(ServerOpts{
+		DNSHandler: &D.DummyServerHandler{T: t},
+		Cert:       "testdata/test.test.cert",
+		Key:        "testdata/test.test.key",
+	})
+	defer s.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.CreateQUICListner(conn, []string{"doq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeQUIC(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, conn.LocalAddr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseWithError(0, "")
+	stream, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = 0 // rfc 9250 4.2.1
+	if _, err := dnsutils.WriteMsgToTCP(stream, q); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	r, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Question[0].Name != "example.com." {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func Test_loadCerts_acme(t *testing.T) {
+	s := NewServer(ServerOpts{
+		ACME:     new(autocert.Manager),
+		SNICerts: []SNICert{{Names: []string{"dns.test"}, Cert: "testdata/test.test.cert", Key: "testdata/test.test.key"}},
+	})
+	getCert, err := loadCerts(s, tls.LoadX509KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getCert("dns.test") == nil {
+		t.Fatal("missing sni certificate")
+	}
+	if getCert("other.test") != nil {
+		t.Fatal("other names should be handled by acme")
+	}
+}
+
+func TestServer_ReloadCerts(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert"), filepath.Join(dir, "key")
+	for src, dst := range map[string]string{"testdata/test.test.cert": certFile, "testdata/test.test.key": keyFile} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewServer(ServerOpts{Cert: certFile, Key: keyFile})
+	getCert, err := loadCerts(s, tls.LoadX509KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := getCert("")
+	if err := s.ReloadCerts(); err != nil {
+		t.Fatal(err)
+	}
+	if getCert("") == old {
+		t.Fatal("certificate was not reloaded")
+	}
+
+	if err := os.WriteFile(certFile, []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old = getCert("")
+	if err := s.ReloadCerts(); err == nil {
+		t.Fatal("invalid certificate should fail")
+	}
+	if getCert("") != old {
+		t.Fatal("certificate should be kept")
+	}
+}
@@ -21,16 +21,20 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/miekg/dns"
+	eTLS "gitlab.com/go-extension/tls"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -86,8 +90,27 @@ func (s *Server) ServeTCP(l net.Listener) error {
 
 			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
 			meta := C.NewRequestMeta(clientAddr)
+			tc, isTLS := c.(*eTLS.Conn)
+			connInfo := C.ConnInfo{Listener: s.opts.Listener, Transport: "tcp"}
+			if isTLS {
+				connInfo.Transport = "dot"
+			}
+			meta.SetConnInfo(connInfo)
+			if isTLS && (s.opts.ClientCAs != nil || s.opts.NeedServerName) {
+				// Finish the handshake now to get the client certificate
+				// and the server name.
+				c.SetDeadline(time.Now().Add(firstReadTimeout))
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				c.SetDeadline(time.Time{})
+				cs := tc.ConnectionState()
+				meta.SetClientCert(verifiedClientCert(cs.VerifiedChains))
+				meta.SetServerName(cs.ServerName)
+			}
 
 			firstRead := true
+			alpnChecked := false
 
 			var access sync.Mutex
 			for {
@@ -97,19 +120,63 @@ func (s *Server) ServeTCP(l net.Listener) error {
 				} else {
 					c.SetReadDeadline(time.Now().Add(idleTimeout))
 				}
-				req, _, err := dnsutils.ReadMsgFromTCP(c)
+				rb, _, err := dnsutils.ReadRawMsgFromTCP(c)
 				if err != nil {
 					return // read err, close the connection
 				}
+				req := new(dns.Msg)
+				err = req.Unpack(rb.Bytes())
+				if err != nil {
+					rh, ok := handler.(D.RawHandler)
+					if !ok {
+						rb.Release()
+						return // invalid msg, close the connection
+					}
+					go func() {
+						defer rb.Release()
+						r, err := rh.ServeRaw(tcpConnCtx, rb.Bytes(), meta)
+						if err != nil {
+							c.Close()
+							return
+						}
+						access.Lock()
+						_, err = dnsutils.WriteRawMsgToTCP(c, r)
+						access.Unlock()
+						if err != nil {
+							s.opts.Logger.Warn("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+						}
+					}()
+					continue
+				}
+				rb.Release()
+				if isTLS && !alpnChecked {
+					// The first read finished the handshake. No query
+					// is being handled, it's safe to update meta.
+					alpnChecked = true
+					connInfo.ALPN = tc.ConnectionState().NegotiatedProtocol
+					meta.SetConnInfo(connInfo)
+				}
+
+				// The edns-tcp-keepalive option (RFC 7828) belongs to this
+				// connection and must not be forwarded.
+				_, keepalive := dnsutils.GetKeepalive(req)
+				if keepalive {
+					req = dnsutils.RemoveKeepalive(req)
+				}
 
 				// handle query
 				go func() {
 					r, err := handler.ServeDNS(tcpConnCtx, req, meta)
 					if err != nil {
-						s.opts.Logger.Warn("handler err", zap.Error(err))
+						if !errors.Is(err, D.ErrDropped) {
+							s.opts.Logger.Warn("handler err", zap.Error(err))
+						}
 						c.Close()
 						return
 					}
+					if keepalive {
+						r = dnsutils.SetKeepalive(r, idleTimeout)
+					}
 
 					b, buf, err := pool.PackBuffer(r)
 					if err != nil {
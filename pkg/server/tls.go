@@ -21,32 +21,55 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/quic-go/quic-go"
 	eTLS "gitlab.com/go-extension/tls"
+	"golang.org/x/crypto/acme"
 )
 
+// cert is a certificate that is reloaded when its files change.
 type cert[T tls.Certificate | eTLS.Certificate] struct {
-	c *T
+	certFile, keyFile string
+	createFunc        func(string, string) (T, error)
+	c                 atomic.Pointer[T]
 }
 
-func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, keyFile string, createFunc func(string, string) (T, error)) (*cert[T], error) {
-	c, err := createFunc(certFile, keyFile)
+func (c *cert[T]) get() *T {
+	return c.c.Load()
+}
+
+// reload loads the files again. The old certificate is kept if it fails.
+func (c *cert[T]) reload() error {
+	v, err := c.createFunc(c.certFile, c.keyFile)
 	if err != nil {
+		return fmt.Errorf("failed to load certificate %s, %w", c.certFile, err)
+	}
+	c.c.Store(&v)
+	return nil
+}
+
+func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, keyFile string, createFunc func(string, string) (T, error)) (*cert[T], error) {
+	cc := &cert[T]{certFile: certFile, keyFile: keyFile, createFunc: createFunc}
+	if err := cc.reload(); err != nil {
 		return nil, err
 	}
-	cc := &cert[T]{&c}
 	go func() {
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
 			return
 		}
-		watcher.Add(certFile)
-		watcher.Add(keyFile)
+		// Watch the directories. Files that are replaced by renaming, or
+		// symlinks that are switched to new files, can't be watched.
+		watcher.Add(filepath.Dir(certFile))
+		watcher.Add(filepath.Dir(keyFile))
 		var timer *time.Timer
 		for {
 			select {
@@ -58,15 +81,12 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 					}
 					return
 				}
-				if e.Has(fsnotify.Chmod) || e.Has(fsnotify.Remove) {
+				if e.Has(fsnotify.Chmod) {
 					continue
 				}
 				if timer == nil {
 					timer = time.AfterFunc(time.Second, func() {
-						timer = nil
-						if c, err := createFunc(certFile, keyFile); err == nil {
-							cc.c = &c
-						}
+						cc.reload()
 					})
 				} else {
 					timer.Reset(time.Second)
@@ -85,20 +105,77 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 	return cc, nil
 }
 
-func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string) (*quic.EarlyListener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
-		return nil, errors.New("missing certificate for tls listener")
+// loadCerts loads the certificates of opts and returns a func that
+// selects one of them by the server name. If opts.ACME is set, the func
+// returns nil for names that are not in opts.SNICerts.
+func loadCerts[T tls.Certificate | eTLS.Certificate](s *Server, createFunc func(string, string) (T, error)) (func(serverName string) *T, error) {
+	opts := &s.opts
+	var def *cert[T]
+	if opts.ACME == nil && (opts.Cert != "" || opts.Key != "") {
+		c, err := tryCreateWatchCert(opts.Cert, opts.Key, createFunc)
+		if err != nil {
+			return nil, err
+		}
+		def = c
+		s.addCertReloader(c)
+	}
+	snis := make([]*cert[T], 0, len(opts.SNICerts))
+	for _, sc := range opts.SNICerts {
+		c, err := tryCreateWatchCert(sc.Cert, sc.Key, createFunc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate for %v, %w", sc.Names, err)
+		}
+		snis = append(snis, c)
+		s.addCertReloader(c)
 	}
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, tls.LoadX509KeyPair)
+	if def == nil && opts.ACME == nil {
+		if len(snis) == 0 {
+			return nil, errors.New("missing certificate for tls listener")
+		}
+		def = snis[0]
+	}
+	return func(serverName string) *T {
+		for i, sc := range opts.SNICerts {
+			if MatchServerName(sc.Names, serverName) {
+				return snis[i].get()
+			}
+		}
+		if def == nil {
+			return nil
+		}
+		return def.get()
+	}, nil
+}
+
+func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string) (*quic.EarlyListener, error) {
+	getCert, err := loadCerts(s, tls.LoadX509KeyPair)
 	if err != nil {
 		return nil, err
 	}
-	return quic.ListenEarly(conn, &tls.Config{
+	tlsConfig := &tls.Config{
 		NextProtos: nextProtos,
 		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return c.c, nil
+			c := getCert(chi.ServerName)
+			if s.opts.ACME == nil || (c != nil && !isACMEChallenge(chi.SupportedProtos)) {
+				return c, nil
+			}
+			return s.opts.ACME.GetCertificate(chi)
 		},
-	}, &quic.Config{
+	}
+	if s.opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.opts.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	idleTimeout := s.opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultQUICIdleTimeout
+	}
+	// quic-go enables GSO and GRO by itself if conn is a *net.UDPConn.
+	return quic.ListenEarly(conn, tlsConfig, &quic.Config{
+		MaxIdleTimeout:                 idleTimeout,
 		Allow0RTT:                      true,
 		InitialStreamReceiveWindow:     1252,
 		MaxStreamReceiveWindow:         4 * 1024,
@@ -108,21 +185,42 @@ func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string) (*q
 }
 
 func (s *Server) CreateETLSListner(l net.Listener, nextProtos []string) (net.Listener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
-		return nil, errors.New("missing certificate for tls listener")
-	}
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, eTLS.LoadX509KeyPair)
+	getCert, err := loadCerts(s, eTLS.LoadX509KeyPair)
 	if err != nil {
 		return nil, err
 	}
-	return eTLS.NewListener(l, &eTLS.Config{
+	if s.opts.ACME != nil {
+		nextProtos = append(nextProtos[:len(nextProtos):len(nextProtos)], acme.ALPNProto)
+	}
+	tlsConfig := &eTLS.Config{
 		KernelTX:       s.opts.KernelTX,
 		KernelRX:       s.opts.KernelRX,
 		AllowEarlyData: true,
 		MaxEarlyData:   16384,
 		NextProtos:     nextProtos,
-		GetCertificate: func(_ *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
-			return c.c, nil
+		GetCertificate: func(chi *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
+			c := getCert(chi.ServerName)
+			if s.opts.ACME == nil || (c != nil && !isACMEChallenge(chi.SupportedProtos)) {
+				return c, nil
+			}
+			return eTLSACMECertificate(s.opts.ACME, chi)
 		},
-	}), nil
+	}
+	if s.opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.opts.ClientCAs
+		tlsConfig.ClientAuth = eTLS.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			tlsConfig.ClientAuth = eTLS.RequireAndVerifyClientCert
+		}
+	}
+	return eTLS.NewListener(l, tlsConfig), nil
+}
+
+// verifiedClientCert returns the leaf certificate of the first verified
+// chain, or nil if there is no verified chain.
+func verifiedClientCert(chains [][]*x509.Certificate) *x509.Certificate {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
 }
@@ -21,6 +21,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
@@ -29,6 +30,7 @@ import (
 
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -82,6 +84,11 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 
 		q := new(dns.Msg)
 		if err := q.Unpack(rb[:n]); err != nil {
+			if rh, ok := handler.(D.RawHandler); ok {
+				b := append([]byte(nil), rb[:n]...)
+				go s.serveRawUDP(listenerCtx, rh, b, cmc, localAddr, ifIndex, remoteAddr)
+				continue
+			}
 			s.opts.Logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", rb[:n]), zap.Stringer("from", remoteAddr))
 			continue
 		}
@@ -89,10 +96,13 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 		// handle query
 		go func() {
 			meta := C.NewRequestMeta(clientAddr)
+			meta.SetConnInfo(C.ConnInfo{Listener: s.opts.Listener, Transport: "udp"})
 
 			r, err := handler.ServeDNS(listenerCtx, q, meta)
 			if err != nil {
-				s.opts.Logger.Warn("handler err", zap.Error(err))
+				if !errors.Is(err, D.ErrDropped) {
+					s.opts.Logger.Warn("handler err", zap.Error(err))
+				}
 				return
 			}
 			if r != nil {
@@ -111,6 +121,22 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 	}
 }
 
+// serveRawUDP handles b, which can't be unpacked, by rh.
+func (s *Server) serveRawUDP(ctx context.Context, rh D.RawHandler, b []byte, cmc cmcUDPConn, localAddr net.IP, ifIndex int, remoteAddr net.Addr) {
+	meta := C.NewRequestMeta(utils.GetAddrFromAddr(remoteAddr))
+	meta.SetConnInfo(C.ConnInfo{Listener: s.opts.Listener, Transport: "udp"})
+	r, err := rh.ServeRaw(ctx, b, meta)
+	if err != nil {
+		if !errors.Is(err, D.ErrDropped) {
+			s.opts.Logger.Warn("handler err", zap.Error(err))
+		}
+		return
+	}
+	if _, err := cmc.writeTo(r, localAddr, ifIndex, remoteAddr); err != nil {
+		s.opts.Logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+	}
+}
+
 func getUDPSize(m *dns.Msg) int {
 	var s uint16
 	if opt := m.IsEdns0(); opt != nil {
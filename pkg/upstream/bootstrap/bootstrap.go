@@ -25,6 +25,24 @@ import (
 	"strings"
 )
 
+// NewBootstrap returns a system bootstrap if s is System. If s is a url
+// of "tcp://", "tls://" or "https://" schemes, e.g. "tls://1.1.1.1" or
+// "https://8.8.8.8/dns-query", queries are sent to the server with the
+// protocol. Otherwise, it returns NewPlainBootstrap(s).
+func NewBootstrap(s string) *net.Resolver {
+	if s == System {
+		return NewSystemBootstrap()
+	}
+	if strings.Contains(s, "://") && !strings.HasPrefix(s, "udp://") {
+		ex, err := newExchanger(s)
+		if err != nil {
+			return errResolver(err)
+		}
+		return exchangerResolver(ex)
+	}
+	return NewPlainBootstrap(strings.TrimPrefix(s, "udp://"))
+}
+
 // NewPlainBootstrap returns a customized *net.Resolver which Dial func is modified to dial s.
 // s SHOULD be a literal IP address and the port SHOULD also be literal.
 // Port can be omitted. In this case, the default port is :53.
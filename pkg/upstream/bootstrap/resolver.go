@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	minTTL      = time.Second * 10
+	maxTTL      = time.Hour
+	negativeTTL = time.Second * 30
+	// maxStale is how long expired addresses can still be used while
+	// they can't be refreshed.
+	maxStale = time.Hour
+	// retryInterval is the interval of refreshes after a failure.
+	retryInterval = time.Second * 10
+)
+
+// Resolver looks up addresses with a bootstrap server and caches them
+// by their ttl. Expired addresses are returned as is while they are
+// refreshed in the background, so only the first lookup of a name
+// waits for the bootstrap server.
+type Resolver struct {
+	ex exchanger
+
+	m     sync.Mutex
+	cache map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	host  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	ready chan struct{} // closed once the first lookup is done
+	err   error         // error of the first lookup
+
+	addrs       []netip.Addr
+	expire      time.Time
+	nextRefresh time.Time
+	refreshing  bool
+}
+
+// NewResolver creates a Resolver. See NewBootstrap for the format of s.
+func NewResolver(s string) (*Resolver, error) {
+	ex, err := newExchanger(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{ex: ex, cache: make(map[cacheKey]*cacheEntry)}, nil
+}
+
+// LookupNetIP looks up host. network is "ip", "ip4" or "ip6". It has
+// the same signature as (*net.Resolver).LookupNetIP.
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	host = dns.Fqdn(host)
+	switch network {
+	case "ip4":
+		return r.lookupOrErr(ctx, host, dns.TypeA)
+	case "ip6":
+		return r.lookupOrErr(ctx, host, dns.TypeAAAA)
+	case "ip":
+	default:
+		return nil, &net.DNSError{Err: "unsupported network " + network, Name: host}
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		addrs, err := r.lookup(ctx, host, dns.TypeAAAA)
+		ch <- result{addrs, err}
+	}()
+	addrs, err := r.lookup(ctx, host, dns.TypeA)
+	v6 := <-ch
+	if err != nil && v6.err != nil {
+		return nil, err
+	}
+	addrs = append(v6.addrs, addrs...)
+	if len(addrs) == 0 {
+		return nil, notFound(host)
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) lookupOrErr(ctx context.Context, host string, qtype uint16) ([]netip.Addr, error) {
+	addrs, err := r.lookup(ctx, host, qtype)
+	if err == nil && len(addrs) == 0 {
+		err = notFound(host)
+	}
+	return addrs, err
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup returns cached addresses of host. It waits for the bootstrap
+// server only if there is no usable cache.
+func (r *Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]netip.Addr, error) {
+	k := cacheKey{host: host, qtype: qtype}
+	now := time.Now()
+
+	r.m.Lock()
+	e := r.cache[k]
+	if e != nil {
+		select {
+		case <-e.ready:
+			if now.After(e.expire.Add(maxStale)) {
+				e = nil // too old, look it up again
+			}
+		default:
+		}
+	}
+	if e == nil {
+		e = &cacheEntry{ready: make(chan struct{})}
+		r.cache[k] = e
+		go r.firstLookup(k, e)
+	}
+	r.m.Unlock()
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if now.After(e.nextRefresh) && !e.refreshing {
+		e.refreshing = true
+		go r.refresh(k, e)
+	}
+	return e.addrs, nil
+}
+
+func (r *Resolver) firstLookup(k cacheKey, e *cacheEntry) {
+	addrs, ttl, err := r.query(k)
+	r.m.Lock()
+	if err != nil {
+		e.err = err
+		if r.cache[k] == e {
+			delete(r.cache, k)
+		}
+	} else {
+		e.set(addrs, ttl)
+	}
+	r.m.Unlock()
+	close(e.ready)
+}
+
+func (r *Resolver) refresh(k cacheKey, e *cacheEntry) {
+	addrs, ttl, err := r.query(k)
+	r.m.Lock()
+	defer r.m.Unlock()
+	e.refreshing = false
+	if err != nil {
+		e.nextRefresh = time.Now().Add(retryInterval)
+		return
+	}
+	e.set(addrs, ttl)
+}
+
+func (e *cacheEntry) set(addrs []netip.Addr, ttl time.Duration) {
+	e.addrs = addrs
+	e.expire = time.Now().Add(ttl)
+	e.nextRefresh = e.expire
+}
+
+// query sends the query of k to the bootstrap server and returns the
+// addresses and their ttl.
+func (r *Resolver) query(k cacheKey) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+	q := new(dns.Msg)
+	q.SetQuestion(k.host, k.qtype)
+	resp, err := r.ex.exchange(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, 0, notFound(k.host)
+	default:
+		return nil, 0, &net.DNSError{Err: "server returned " + dns.RcodeToString[resp.Rcode], Name: k.host, IsTemporary: true}
+	}
+
+	var addrs []netip.Addr
+	ttl := maxTTL
+	for _, rr := range resp.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue // e.g. CNAME
+		}
+		if !addr.IsValid() {
+			continue
+		}
+		addrs = append(addrs, addr)
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	if len(addrs) == 0 {
+		ttl = negativeTTL
+	}
+	return addrs, max(ttl, minTTL), nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeExchanger answers A and AAAA queries with addrs.
+type fakeExchanger struct {
+	m       sync.Mutex
+	v4, v6  []string
+	ttl     uint32
+	err     error
+	queries int
+}
+
+func (e *fakeExchanger) exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.queries++
+	if e.err != nil {
+		return nil, e.err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: e.ttl}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		for _, s := range e.v4 {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(s)})
+		}
+	case dns.TypeAAAA:
+		for _, s := range e.v6 {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(s)})
+		}
+	}
+	return r, nil
+}
+
+func (e *fakeExchanger) set(v4 []string, err error) int {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.v4, e.err = v4, err
+	return e.queries
+}
+
+func addrs(s ...string) []netip.Addr {
+	var as []netip.Addr
+	for _, s := range s {
+		as = append(as, netip.MustParseAddr(s))
+	}
+	return as
+}
+
+func TestResolver_LookupNetIP(t *testing.T) {
+	ex := &fakeExchanger{v4: []string{"192.0.2.1"}, v6: []string{"2001:db8::1"}, ttl: 300}
+	r := &Resolver{ex: ex, cache: make(map[cacheKey]*cacheEntry)}
+	ctx := context.Background()
+
+	tests := []struct {
+		network, host string
+		want          []netip.Addr
+	}{
+		{"ip", "dns.example", addrs("2001:db8::1", "192.0.2.1")},
+		{"ip4", "dns.example", addrs("192.0.2.1")},
+		{"ip6", "dns.example", addrs("2001:db8::1")},
+		{"ip", "192.0.2.2", addrs("192.0.2.2")},
+	}
+	for _, tt := range tests {
+		got, err := r.LookupNetIP(ctx, tt.network, tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("LookupNetIP(%s, %s) = %v, want %v", tt.network, tt.host, got, tt.want)
+		}
+	}
+	if ex.queries != 2 {
+		t.Fatalf("want 2 queries, got %d", ex.queries)
+	}
+
+	// v4 only
+	ex.v6 = nil
+	if got, _ := r.LookupNetIP(ctx, "ip", "v4.example"); !reflect.DeepEqual(got, addrs("192.0.2.1")) {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := r.LookupNetIP(ctx, "ip6", "v4.example"); !isNotFound(err) {
+		t.Fatalf("want not found err, got %v", err)
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func TestResolver_refresh(t *testing.T) {
+	ex := &fakeExchanger{v4: []string{"192.0.2.1"}, ttl: 300}
+	r := &Resolver{ex: ex, cache: make(map[cacheKey]*cacheEntry)}
+	ctx := context.Background()
+	expire := func() {
+		r.m.Lock()
+		for _, e := range r.cache {
+			e.expire = time.Now().Add(-time.Second)
+			e.nextRefresh = e.expire
+		}
+		r.m.Unlock()
+	}
+	waitQueries := func(n int) {
+		for i := 0; i < 100; i++ {
+			if ex.set(ex.v4, ex.err) >= n {
+				time.Sleep(time.Millisecond * 10) // let refresh update the entry
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("want %d queries", n)
+	}
+
+	if _, err := r.LookupNetIP(ctx, "ip4", "dns.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired addresses are returned, and refreshed in the background.
+	ex.set([]string{"192.0.2.2"}, nil)
+	expire()
+	if got, _ := r.LookupNetIP(ctx, "ip4", "dns.example"); !reflect.DeepEqual(got, addrs("192.0.2.1")) {
+		t.Fatalf("want stale addrs, got %v", got)
+	}
+	waitQueries(2)
+	if got, _ := r.LookupNetIP(ctx, "ip4", "dns.example"); !reflect.DeepEqual(got, addrs("192.0.2.2")) {
+		t.Fatalf("want refreshed addrs, got %v", got)
+	}
+
+	// Failed refreshes keep the addresses.
+	ex.set(nil, errors.New("timeout"))
+	expire()
+	if _, err := r.LookupNetIP(ctx, "ip4", "dns.example"); err != nil {
+		t.Fatal(err)
+	}
+	waitQueries(3)
+	if got, _ := r.LookupNetIP(ctx, "ip4", "dns.example"); !reflect.DeepEqual(got, addrs("192.0.2.2")) {
+		t.Fatalf("want stale addrs, got %v", got)
+	}
+
+	// Failed first lookups are not cached.
+	if _, err := r.LookupNetIP(ctx, "ip4", "new.example"); err == nil {
+		t.Fatal("want err")
+	}
+	ex.set([]string{"192.0.2.3"}, nil)
+	if got, _ := r.LookupNetIP(ctx, "ip4", "new.example"); !reflect.DeepEqual(got, addrs("192.0.2.3")) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func Test_exchangerResolver(t *testing.T) {
+	ex := &fakeExchanger{v4: []string{"192.0.2.1"}, ttl: 300}
+	got, err := exchangerResolver(ex).LookupNetIP(context.Background(), "ip4", "dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, addrs("192.0.2.1")) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func Test_newExchanger(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantNet string
+		addr    string
+		wantErr bool
+	}{
+		{s: "8.8.8.8", wantNet: "udp", addr: "8.8.8.8:53"},
+		{s: "[::1]:5353", wantNet: "udp", addr: "[::1]:5353"},
+		{s: "tcp://8.8.8.8", wantNet: "tcp", addr: "8.8.8.8:53"},
+		{s: "tls://1.1.1.1", wantNet: "tcp-tls", addr: "1.1.1.1:853"},
+		{s: "tls://1.1.1.1:8853", wantNet: "tcp-tls", addr: "1.1.1.1:8853"},
+		{s: "https://1.1.1.1/dns-query"},
+		{s: "tls://dns.google", wantErr: true},
+		{s: "quic://1.1.1.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		ex, err := newExchanger(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("newExchanger(%s) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if de, ok := ex.(*dnsExchanger); ok && (de.c.Net != tt.wantNet || de.addr != tt.addr) {
+			t.Fatalf("newExchanger(%s) = %s %s", tt.s, de.c.Net, de.addr)
+		}
+	}
+}
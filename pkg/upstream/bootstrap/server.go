@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const exchangeTimeout = time.Second * 5
+
+// exchanger sends queries to a bootstrap server.
+type exchanger interface {
+	exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+}
+
+// Exchanger sends queries to a bootstrap server.
+type Exchanger interface {
+	Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+}
+
+// NewExchanger returns an Exchanger that sends queries to s, which has
+// the same format as the bootstrap of NewBootstrap. If s is empty, the
+// resolvers of the operating system are used. It is for queries that
+// *net.Resolver cannot send, e.g. SVCB.
+func NewExchanger(s string) (Exchanger, error) {
+	if len(s) == 0 {
+		s = System
+	}
+	ex, err := newExchanger(s)
+	if err != nil {
+		return nil, err
+	}
+	return exchangerFunc(ex.exchange), nil
+}
+
+type exchangerFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+func (f exchangerFunc) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, q)
+}
+
+// newExchanger parses s, which is System, an ip address with an optional
+// port, or a url of "udp://", "tcp://", "tls://" and "https://" schemes,
+// e.g. "tls://1.1.1.1", "https://8.8.8.8/dns-query". Hosts must be ip
+// addresses, bootstrap servers cannot be resolved.
+func newExchanger(s string) (exchanger, error) {
+	if s == System {
+		return &systemExchanger{servers: new(systemServers)}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		// Not a url, e.g. "8.8.8.8", "[::1]:5353".
+		u = &url.URL{Scheme: "udp", Host: s}
+	}
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err != nil {
+		return nil, fmt.Errorf("bootstrap server %s is not an ip address", host)
+	}
+	addr := func(port string) string {
+		if len(u.Port()) > 0 {
+			port = u.Port()
+		}
+		return net.JoinHostPort(host, port)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &dnsExchanger{c: &dns.Client{Net: "udp"}, addr: addr("53")}, nil
+	case "tcp":
+		return &dnsExchanger{c: &dns.Client{Net: "tcp"}, addr: addr("53")}, nil
+	case "tls":
+		c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: host}}
+		return &dnsExchanger{c: c, addr: addr("853")}, nil
+	case "https":
+		return &dohExchanger{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{ForceAttemptHTTP2: true, IdleConnTimeout: time.Minute},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported bootstrap scheme %s", u.Scheme)
+	}
+}
+
+// dnsExchanger sends queries over udp, tcp or tls. Truncated udp
+// responses are retried over tcp.
+type dnsExchanger struct {
+	c    *dns.Client
+	addr string
+}
+
+func (e *dnsExchanger) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, _, err := e.c.ExchangeContext(ctx, q, e.addr)
+	if err == nil && r.Truncated && e.c.Net == "udp" {
+		r, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, q, e.addr)
+	}
+	return r, err
+}
+
+// systemExchanger sends queries to the resolvers of the operating system
+// in turn.
+type systemExchanger struct {
+	servers *systemServers
+}
+
+func (e *systemExchanger) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	addr, err := e.servers.next()
+	if err != nil {
+		return nil, err
+	}
+	return (&dnsExchanger{c: &dns.Client{Net: "udp"}, addr: addr}).exchange(ctx, q)
+}
+
+type dohExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func (e *dohExchanger) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	q = q.Copy()
+	q.Id = 0 // RFC 8484 4.1, for http caches.
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// exchangerResolver returns a *net.Resolver that sends queries with ex.
+// The go resolver talks to an in-memory stream conn, which forwards
+// its queries to ex.
+func exchangerResolver(ex exchanger) *net.Resolver {
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: false,
+		Dial: func(_ context.Context, _, _ string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go serveConn(c2, ex)
+			return c1, nil
+		},
+	}
+}
+
+func serveConn(c net.Conn, ex exchanger) {
+	defer c.Close()
+	for {
+		q, _, err := dnsutils.ReadMsgFromTCP(c)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+		r, err := ex.exchange(ctx, q)
+		cancel()
+		if err != nil {
+			return
+		}
+		r.Id = q.Id
+		if _, err := dnsutils.WriteMsgToTCP(c, r); err != nil {
+			return
+		}
+	}
+}
+
+// errResolver returns a *net.Resolver that always fails with err.
+func errResolver(err error) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return nil, err
+		},
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// System is the bootstrap value that uses the resolvers configured
+// in the operating system.
+const System = "system"
+
+const systemServersRefreshInterval = time.Second * 30
+
+var siteLocalPrefix = netip.MustParsePrefix("fec0::/10")
+
+// NewSystemBootstrap returns a *net.Resolver that sends queries to the
+// resolvers configured in the operating system. Resolvers are discovered
+// by platform apis (GetAdaptersAddresses on Windows, SystemConfiguration on
+// macOS, /etc/resolv.conf on others) and are refreshed periodically, so
+// network changes can be followed.
+func NewSystemBootstrap() *net.Resolver {
+	s := new(systemServers)
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: false,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr, err := s.next()
+			if err != nil {
+				return nil, err
+			}
+			d := new(net.Dialer)
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+type systemServers struct {
+	m         sync.Mutex
+	servers   []string
+	updatedAt time.Time
+	i         atomic.Uint32
+}
+
+// next returns servers in turn, so retries of the go resolver
+// will be sent to different servers.
+func (s *systemServers) next() (string, error) {
+	s.m.Lock()
+	if time.Since(s.updatedAt) > systemServersRefreshInterval || len(s.servers) == 0 {
+		if addrs, err := getSystemServers(); err == nil && len(addrs) > 0 {
+			s.servers = formatServers(addrs)
+			s.updatedAt = time.Now()
+		} else if len(s.servers) == 0 {
+			s.m.Unlock()
+			if err == nil {
+				err = errors.New("no system resolver is configured")
+			}
+			return "", err
+		}
+	}
+	servers := s.servers
+	s.m.Unlock()
+	return servers[int(s.i.Add(1)-1)%len(servers)], nil
+}
+
+// formatServers removes duplicated and unusable addresses and adds the port.
+func formatServers(addrs []netip.Addr) []string {
+	seen := make(map[netip.Addr]struct{}, len(addrs))
+	s := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if !addr.IsValid() || addr.IsUnspecified() {
+			continue
+		}
+		// fec0:0:0:ffff::1-3 are deprecated site-local defaults of Windows.
+		if siteLocalPrefix.Contains(addr) {
+			continue
+		}
+		if _, dup := seen[addr]; dup {
+			continue
+		}
+		seen[addr] = struct{}{}
+		s = append(s, netip.AddrPortFrom(addr, 53).String())
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+//go:build darwin && !cgo
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// getSystemServers returns dns servers from "scutil --dns", which
+// prints the SystemConfiguration dns settings. It is used when cgo is
+// not available.
+func getSystemServers() ([]netip.Addr, error) {
+	out, err := exec.Command("scutil", "--dns").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseScutilDNS(out), nil
+}
+
+// parseScutilDNS parses lines like "  nameserver[0] : 192.168.1.1".
+func parseScutilDNS(b []byte) []netip.Addr {
+	var addrs []netip.Addr
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), ":")
+		if !ok || !strings.HasPrefix(strings.TrimSpace(k), "nameserver[") {
+			continue
+		}
+		if addr, err := netip.ParseAddr(strings.TrimSpace(v)); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
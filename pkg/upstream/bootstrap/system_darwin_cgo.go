@@ -0,0 +1,87 @@
+//go:build darwin && cgo
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework SystemConfiguration
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <SystemConfiguration/SystemConfiguration.h>
+
+// copy_dns_servers writes global dns servers to buf, one per line.
+// It returns the number of bytes written or -1 on error.
+static int copy_dns_servers(char *buf, int buflen) {
+	SCDynamicStoreRef store = SCDynamicStoreCreate(NULL, CFSTR("mosdns"), NULL, NULL);
+	if (store == NULL) {
+		return -1;
+	}
+	CFPropertyListRef dict = SCDynamicStoreCopyValue(store, CFSTR("State:/Network/Global/DNS"));
+	CFRelease(store);
+	if (dict == NULL) {
+		return 0;
+	}
+	int n = 0;
+	if (CFGetTypeID(dict) == CFDictionaryGetTypeID()) {
+		CFArrayRef servers = CFDictionaryGetValue((CFDictionaryRef)dict, kSCPropNetDNSServerAddresses);
+		if (servers != NULL && CFGetTypeID(servers) == CFArrayGetTypeID()) {
+			CFIndex count = CFArrayGetCount(servers);
+			for (CFIndex i = 0; i < count; i++) {
+				CFStringRef s = CFArrayGetValueAtIndex(servers, i);
+				if (CFGetTypeID(s) != CFStringGetTypeID()) {
+					continue;
+				}
+				if (!CFStringGetCString(s, buf + n, buflen - n - 1, kCFStringEncodingUTF8)) {
+					break;
+				}
+				n += strlen(buf + n);
+				buf[n++] = '\n';
+			}
+		}
+	}
+	CFRelease(dict);
+	return n;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"unsafe"
+)
+
+// getSystemServers returns global dns servers from SystemConfiguration.
+func getSystemServers() ([]netip.Addr, error) {
+	buf := make([]byte, 4096)
+	n := C.copy_dns_servers((*C.char)(unsafe.Pointer(&buf[0])), C.int(len(buf)))
+	if n < 0 {
+		return nil, errors.New("failed to open SystemConfiguration dynamic store")
+	}
+	var addrs []netip.Addr
+	for _, s := range strings.Split(string(buf[:n]), "\n") {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
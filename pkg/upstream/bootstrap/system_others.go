@@ -0,0 +1,37 @@
+//go:build !windows && !darwin
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"net/netip"
+	"os"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+func getSystemServers() ([]netip.Addr, error) {
+	b, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	return parseResolvConf(b), nil
+}
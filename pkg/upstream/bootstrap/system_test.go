@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func Test_parseResolvConf(t *testing.T) {
+	b := []byte(`# comment
+nameserver 192.168.1.1
+nameserver  fe80::1%eth0
+nameserver bad
+search lan
+nameserver 8.8.8.8
+`)
+	got := formatServers(parseResolvConf(b))
+	want := []string{"192.168.1.1:53", "[fe80::1%eth0]:53", "8.8.8.8:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func Test_formatServers(t *testing.T) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("::ffff:1.1.1.1"),
+		netip.MustParseAddr("1.1.1.1"),
+		netip.MustParseAddr("0.0.0.0"),
+		netip.MustParseAddr("fec0:0:0:ffff::1"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	got := formatServers(addrs)
+	want := []string{"1.1.1.1:53", "[2001:db8::1]:53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// getSystemServers returns dns servers of all up adapters.
+func getSystemServers() ([]netip.Addr, error) {
+	b := make([]byte, 15000) // Recommended initial size by Microsoft.
+	for {
+		size := uint32(len(b))
+		aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0]))
+		err := windows.GetAdaptersAddresses(
+			windows.AF_UNSPEC,
+			windows.GAA_FLAG_SKIP_UNICAST|windows.GAA_FLAG_SKIP_ANYCAST|windows.GAA_FLAG_SKIP_MULTICAST|windows.GAA_FLAG_SKIP_FRIENDLY_NAME,
+			0, aa, &size,
+		)
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) && size > uint32(len(b)) {
+			b = make([]byte, size)
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("getadaptersaddresses", err)
+		}
+		break
+	}
+
+	var addrs []netip.Addr
+	for aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0])); aa != nil; aa = aa.Next {
+		if aa.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		for ds := aa.FirstDnsServerAddress; ds != nil; ds = ds.Next {
+			if addr, ok := netip.AddrFromSlice(ds.Address.IP()); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
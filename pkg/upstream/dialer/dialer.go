@@ -21,22 +21,89 @@ package dialer
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/netip"
+	"strings"
+	"time"
 )
 
 type Dialer interface {
 	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
 }
 
+// Resolver looks up addresses of host names. *net.Resolver is a Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
 type DialerOpts struct {
-	Dialer    *net.Dialer
-	SocksAddr string
+	Dialer        *net.Dialer
+	SocksAddr     string
+	HTTPProxyAddr string
+
+	// Proxies is a chain of proxies, e.g. "socks5://host:port" and
+	// "http://[user:password@]host:port". The first proxy is dialed
+	// directly, and each of the others is dialed through the previous one.
+	// UDP is only supported if there is only one socks5 proxy.
+	Proxies []string
+
+	// SocksHandshakeTimeout limits the handshake with socks5 proxies.
+	// Default is 10s.
+	SocksHandshakeTimeout time.Duration
+
+	// HappyEyeballsDelay is the delay between tcp dial attempts to the
+	// addresses of a host name, see RFC 8305. Default is 250ms. Negative
+	// leaves it to net.Dialer, which waits for both lookups and races only
+	// the first address of each family. UDP is not raced.
+	HappyEyeballsDelay time.Duration
+
+	// Resolver looks up host names of addresses that are dialed directly,
+	// e.g. a bootstrap.Resolver. Default is Dialer.Resolver. Proxies
+	// are resolved by Dialer.Resolver.
+	Resolver Resolver
 }
 
 func NewDialer(opts DialerOpts) (Dialer, error) {
-	if len(opts.SocksAddr) == 0 {
-		return newPlainDialer(opts.Dialer), nil
-	} else {
-		return newSocksDialer(opts.Dialer, opts.SocksAddr)
+	proxies := opts.Proxies
+	switch {
+	case len(opts.SocksAddr) > 0 && len(opts.HTTPProxyAddr) > 0,
+		len(proxies) > 0 && (len(opts.SocksAddr) > 0 || len(opts.HTTPProxyAddr) > 0):
+		return nil, fmt.Errorf("socks5, http proxy and proxy chain cannot be used together")
+	case len(opts.SocksAddr) > 0:
+		proxies = []string{"socks5://" + opts.SocksAddr}
+	case len(opts.HTTPProxyAddr) > 0:
+		proxies = []string{opts.HTTPProxyAddr}
+		if !strings.Contains(opts.HTTPProxyAddr, "://") {
+			proxies[0] = "http://" + opts.HTTPProxyAddr
+		}
+	}
+
+	if len(proxies) == 0 {
+		// Proxies dial targets by themselves, so only plain dialers
+		// need to care about NAT64.
+		return newNAT64Dialer(newPlainDialer(opts.Dialer, opts.Resolver, opts.HappyEyeballsDelay), opts.Dialer.Resolver), nil
+	}
+	var d Dialer // nil means dialing the proxy directly
+	for _, p := range proxies {
+		var err error
+		d, err = newProxyDialer(&opts, d, p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s, %w", p, err)
+		}
+	}
+	return d, nil
+}
+
+// newProxyDialer creates a dialer of proxy s. The proxy is dialed by
+// forward, or opts.Dialer if forward is nil.
+func newProxyDialer(opts *DialerOpts, forward Dialer, s string) (Dialer, error) {
+	switch {
+	case strings.HasPrefix(s, "socks5://"):
+		return newSocksDialer(opts.Dialer, forward, strings.TrimPrefix(s, "socks5://"), opts.SocksHandshakeTimeout)
+	case strings.HasPrefix(s, "http://"):
+		return newHTTPProxyDialer(opts.Dialer, forward, s)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme")
 	}
 }
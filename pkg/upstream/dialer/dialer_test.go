@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// startConnectProxy starts an http proxy that dials targets directly.
+// It returns the proxy address and a counter of tunnels.
+func startConnectProxy(t *testing.T) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	tunnels := new(atomic.Int32)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tunnels.Add(1)
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, c)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+	return l.Addr().String(), tunnels
+}
+
+func TestNewDialer_chain(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	p1, n1 := startConnectProxy(t)
+	p2, n2 := startConnectProxy(t)
+	d, err := NewDialer(DialerOpts{Dialer: &net.Dialer{}, Proxies: []string{"http://" + p1, "http://" + p2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Fatalf("unexpected echo %q, %v", b, err)
+	}
+	if n1.Load() != 1 || n2.Load() != 1 {
+		t.Fatalf("want one tunnel on each proxy, got %d %d", n1.Load(), n2.Load())
+	}
+
+	if _, err := NewDialer(DialerOpts{Dialer: &net.Dialer{}, Proxies: []string{"ftp://" + p1}}); err == nil {
+		t.Fatal("want unsupported scheme error")
+	}
+	if _, err := NewDialer(DialerOpts{Dialer: &net.Dialer{}, SocksAddr: p1, Proxies: []string{"http://" + p1}}); err == nil {
+		t.Fatal("want conflict error")
+	}
+	d, _ = NewDialer(DialerOpts{Dialer: &net.Dialer{}, Proxies: []string{"http://" + p1, "socks5://" + p2}})
+	if _, err := d.DialContext(context.Background(), "udp", echo.Addr().String()); err == nil {
+		t.Fatal("want udp error")
+	}
+}
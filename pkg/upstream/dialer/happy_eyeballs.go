@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAttemptDelay = time.Millisecond * 250
+	resolutionDelay     = time.Millisecond * 50
+)
+
+// happyEyeballs dials tcp connections to host names as RFC 8305 describes.
+// A and AAAA are looked up at the same time, and dials are started as soon
+// as addresses are known, alternating between ipv6 and ipv4. A new
+// attempt starts every delay or after the previous one fails, and the
+// first connection wins.
+type happyEyeballs struct {
+	delay  time.Duration
+	lookup func(ctx context.Context, network, host string) ([]netip.Addr, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type lookupResult struct {
+	v6    bool
+	addrs []netip.Addr
+	err   error
+}
+
+type dialResult struct {
+	c   net.Conn
+	err error
+}
+
+func (h *happyEyeballs) dialContext(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lookups := make(chan lookupResult)
+	for _, network := range []string{"ip6", "ip4"} {
+		go func() {
+			addrs, err := h.lookup(ctx, network, host)
+			select {
+			case lookups <- lookupResult{v6: network == "ip6", addrs: addrs, err: err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var (
+		v6q, v4q       []netip.Addr
+		nextV6         = true
+		pendingLookups = 2
+		v6Done         bool
+		started        bool
+		inflight       int
+		timerActive    bool
+		lastErr        error
+	)
+	results := make(chan dialResult)
+	attempt := func() bool {
+		var addr netip.Addr
+		switch {
+		case len(v6q) > 0 && (nextV6 || len(v4q) == 0):
+			addr, v6q = v6q[0], v6q[1:]
+			nextV6 = false
+		case len(v4q) > 0:
+			addr, v4q = v4q[0], v4q[1:]
+			nextV6 = true
+		default:
+			return false
+		}
+		started = true
+		inflight++
+		go func() {
+			c, err := h.dial(ctx, "tcp", netip.AddrPortFrom(addr, port).String())
+			select {
+			case results <- dialResult{c: c, err: err}:
+			case <-ctx.Done():
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+		return true
+	}
+
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	schedule := func(d time.Duration) {
+		timer.Reset(d)
+		timerActive = true
+	}
+	// attemptNow starts an attempt and schedules the next one.
+	attemptNow := func() {
+		if attempt() {
+			schedule(h.delay)
+		}
+	}
+	for {
+		select {
+		case r := <-lookups:
+			pendingLookups--
+			if r.err != nil {
+				lastErr = r.err
+			}
+			if r.v6 {
+				v6q = append(v6q, r.addrs...)
+				v6Done = true
+			} else {
+				v4q = append(v4q, r.addrs...)
+			}
+			switch {
+			case r.v6 && !started:
+				// AAAA ends the resolution delay.
+				timer.Stop()
+				timerActive = false
+				attemptNow()
+			case timerActive:
+				// The next attempt will pick them up.
+			case !started && !v6Done && len(r.addrs) > 0:
+				// Give AAAA a little more time, ipv6 is preferred.
+				schedule(resolutionDelay)
+			default:
+				attemptNow()
+			}
+		case <-timer.C:
+			timerActive = false
+			attemptNow()
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.c, nil
+			}
+			lastErr = r.err
+			attemptNow()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if pendingLookups == 0 && inflight == 0 && len(v6q) == 0 && len(v4q) == 0 {
+			if lastErr == nil {
+				lastErr = errors.New("no address for " + host)
+			}
+			return nil, lastErr
+		}
+	}
+}
+
+// dialHost dials addr with happy eyeballs if its host is a name.
+func (h *happyEyeballs) dialHost(ctx context.Context, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return h.dial(ctx, "tcp", addr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+	return h.dialContext(ctx, host, uint16(port))
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeAddr struct {
+	addrs []string
+	delay time.Duration
+	err   error
+}
+
+// newTestHappyEyeballs returns a happyEyeballs that resolves and dials
+// fake addresses. Dials to addresses in hang block until ctx is done,
+// others fail, except win.
+func newTestHappyEyeballs(v6, v4 fakeAddr, win string, hang map[string]bool) *happyEyeballs {
+	return &happyEyeballs{
+		delay: time.Millisecond * 100,
+		lookup: func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+			a := v4
+			if network == "ip6" {
+				a = v6
+			}
+			time.Sleep(a.delay)
+			var addrs []netip.Addr
+			for _, s := range a.addrs {
+				addrs = append(addrs, netip.MustParseAddr(s))
+			}
+			return addrs, a.err
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			switch {
+			case addr == win:
+				c1, c2 := net.Pipe()
+				c2.Close()
+				return c1, nil
+			case hang[addr]:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			default:
+				return nil, errors.New("refused")
+			}
+		},
+	}
+}
+
+func Test_happyEyeballs_dialContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		v6, v4  fakeAddr
+		win     string
+		hang    map[string]bool
+		minTime time.Duration
+		maxTime time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "v6 wins",
+			v6:      fakeAddr{addrs: []string{"2001:db8::1"}},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1"}},
+			win:     "[2001:db8::1]:53",
+			hang:    map[string]bool{"192.0.2.1:53": true},
+			maxTime: time.Millisecond * 50,
+		},
+		{
+			name:    "v6 hangs",
+			v6:      fakeAddr{addrs: []string{"2001:db8::1"}},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1"}},
+			win:     "192.0.2.1:53",
+			hang:    map[string]bool{"[2001:db8::1]:53": true},
+			minTime: time.Millisecond * 100,
+			maxTime: time.Millisecond * 200,
+		},
+		{
+			name:    "v6 fails fast",
+			v6:      fakeAddr{addrs: []string{"2001:db8::1"}},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1"}},
+			win:     "192.0.2.1:53",
+			maxTime: time.Millisecond * 50,
+		},
+		{
+			name:    "late AAAA",
+			v6:      fakeAddr{addrs: []string{"2001:db8::1"}, delay: time.Millisecond * 20},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1"}},
+			win:     "[2001:db8::1]:53",
+			hang:    map[string]bool{"192.0.2.1:53": true},
+			maxTime: time.Millisecond * 50,
+		},
+		{
+			name:    "v4 only",
+			v6:      fakeAddr{err: errors.New("no AAAA")},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1", "192.0.2.2"}},
+			win:     "192.0.2.2:53",
+			maxTime: time.Millisecond * 50,
+		},
+		{
+			name:    "all fail",
+			v6:      fakeAddr{addrs: []string{"2001:db8::1"}},
+			v4:      fakeAddr{addrs: []string{"192.0.2.1"}},
+			wantErr: true,
+		},
+		{
+			name:    "no address",
+			v6:      fakeAddr{err: errors.New("no AAAA")},
+			v4:      fakeAddr{err: errors.New("no A")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHappyEyeballs(tt.v6, tt.v4, tt.win, tt.hang)
+			start := time.Now()
+			c, err := h.dialContext(context.Background(), "example.com", 53)
+			elapsed := time.Since(start)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			c.Close()
+			if elapsed < tt.minTime || (tt.maxTime > 0 && elapsed > tt.maxTime) {
+				t.Fatalf("dialContext() took %s, want [%s, %s]", elapsed, tt.minTime, tt.maxTime)
+			}
+		})
+	}
+}
+
+func Test_happyEyeballs_dialHost(t *testing.T) {
+	h := newTestHappyEyeballs(fakeAddr{}, fakeAddr{}, "192.0.2.1:53", nil)
+	h.lookup = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		t.Fatal("ip literal should not be resolved")
+		return nil, nil
+	}
+	c, err := h.dialHost(context.Background(), "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const httpProxyHandshakeTimeout = time.Second * 10
+
+// HTTPProxyDialer tunnels tcp connections through an http proxy with
+// the CONNECT method.
+type HTTPProxyDialer struct {
+	dialer Dialer
+	addr   string // host:port of the proxy
+	auth   string // value of the Proxy-Authorization header, maybe empty
+}
+
+// newHTTPProxyDialer parses s, which is "host:port" or
+// "http://[user:password@]host:port". The proxy is dialed by forward,
+// or dialer if forward is nil.
+func newHTTPProxyDialer(dialer *net.Dialer, forward Dialer, s string) (*HTTPProxyDialer, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http proxy address, %w", err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported http proxy scheme %s", u.Scheme)
+	}
+	if forward == nil {
+		forward = dialer
+	}
+	d := &HTTPProxyDialer{dialer: forward, addr: u.Host}
+	if len(u.Port()) == 0 {
+		d.addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	return d, nil
+}
+
+func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("unsupported network type for http proxy: %s", network)
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial http proxy, %w", err)
+	}
+	if err := d.connect(ctx, conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *HTTPProxyDialer) connect(ctx context.Context, conn net.Conn, addr string) error {
+	deadline := time.Now().Add(httpProxyHandshakeTimeout)
+	if ddl, ok := ctx.Deadline(); ok && ddl.Before(deadline) {
+		deadline = ddl
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if len(d.auth) > 0 {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("failed to send connect request, %w", err)
+	}
+
+	// The proxy must not send anything after the response header before
+	// we send data, so it's safe to drop the bufio.Reader.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 1024), req)
+	if err != nil {
+		return fmt.Errorf("failed to read connect response, %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http proxy connect failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/pmkol/mosdns-x/pkg/nat64"
+)
+
+const (
+	nat64PrefixTTL     = time.Minute * 10
+	nat64LookupTimeout = time.Second * 3
+)
+
+// NAT64Dialer dials ipv4 literal addresses through the NAT64 of the
+// network if they are unreachable, e.g. on ipv6-only networks without
+// 464XLAT. Other addresses are dialed as is.
+type NAT64Dialer struct {
+	dialer Dialer
+	lookup func(ctx context.Context) (netip.Prefix, error)
+
+	sf     singleflight.Group
+	m      sync.Mutex
+	prefix netip.Prefix // invalid if the network has no NAT64
+	expire time.Time
+}
+
+func newNAT64Dialer(d Dialer, r *net.Resolver) *NAT64Dialer {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &NAT64Dialer{
+		dialer: d,
+		lookup: func(ctx context.Context) (netip.Prefix, error) {
+			return nat64.Lookup(ctx, r)
+		},
+	}
+}
+
+func (d *NAT64Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err == nil || !isUnreachable(err) {
+		return conn, err
+	}
+	ap, perr := netip.ParseAddrPort(addr)
+	if perr != nil || !ap.Addr().Unmap().Is4() {
+		return nil, err
+	}
+	p := d.getPrefix(ctx)
+	if !p.IsValid() {
+		return nil, err
+	}
+	v6 := netip.AddrPortFrom(nat64.EmbedIPv4(p, ap.Addr().Unmap()), ap.Port())
+	return d.dialer.DialContext(ctx, network, v6.String())
+}
+
+// getPrefix returns the cached NAT64 prefix, or looks it up if the cache
+// expired. Failed lookups are not cached. Concurrent callers share one
+// lookup, which is not canceled if a caller leaves.
+func (d *NAT64Dialer) getPrefix(ctx context.Context) netip.Prefix {
+	d.m.Lock()
+	p, expire := d.prefix, d.expire
+	d.m.Unlock()
+	if time.Now().Before(expire) {
+		return p
+	}
+
+	c := d.sf.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), nat64LookupTimeout)
+		defer cancel()
+		p, err := d.lookup(ctx)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		d.m.Lock()
+		d.prefix = p
+		d.expire = time.Now().Add(nat64PrefixTTL)
+		d.m.Unlock()
+		return p, nil
+	})
+	select {
+	case r := <-c:
+		return r.Val.(netip.Prefix)
+	case <-ctx.Done():
+		return netip.Prefix{}
+	}
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
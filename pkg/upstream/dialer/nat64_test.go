@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_NAT64Dialer_getPrefix(t *testing.T) {
+	want := netip.MustParsePrefix("64:ff9b::/96")
+	var calls atomic.Int32
+	unblock := make(chan struct{})
+	d := &NAT64Dialer{lookup: func(ctx context.Context) (netip.Prefix, error) {
+		calls.Add(1)
+		<-unblock
+		return want, nil
+	}}
+
+	// A caller that leaves does not wait for the lookup.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if p := d.getPrefix(ctx); p.IsValid() {
+		t.Fatalf("want invalid prefix, got %s", p)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p := d.getPrefix(context.Background()); p != want {
+				t.Errorf("want %s, got %s", want, p)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	close(unblock)
+	wg.Wait()
+	if p := d.getPrefix(context.Background()); p != want {
+		t.Fatalf("want cached %s, got %s", want, p)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("want 1 lookup, got %d", n)
+	}
+}
+
+func Test_NAT64Dialer_getPrefixFailure(t *testing.T) {
+	var calls atomic.Int32
+	d := &NAT64Dialer{lookup: func(ctx context.Context) (netip.Prefix, error) {
+		calls.Add(1)
+		return netip.Prefix{}, errors.New("no nat64")
+	}}
+	for i := 0; i < 2; i++ {
+		if p := d.getPrefix(context.Background()); p.IsValid() {
+			t.Fatalf("want invalid prefix, got %s", p)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("failed lookups should not be cached, got %d lookups", n)
+	}
+}
@@ -23,23 +23,47 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"syscall"
 	"time"
 )
 
 type PlainDialer struct {
-	dialer *net.Dialer
-}
-
-func newPlainDialer(dialer *net.Dialer) *PlainDialer {
-	return &PlainDialer{dialer: dialer}
+	dialer   *net.Dialer
+	resolver Resolver       // nil if dialer resolves host names by itself
+	he       *happyEyeballs // nil if disabled
+}
+
+// newPlainDialer creates a PlainDialer. Host names are looked up by r,
+// or dialer.Resolver if r is nil. Tcp connections to host names are
+// dialed with happy eyeballs, a new attempt is started every
+// attemptDelay. Zero means 250ms, negative disables it.
+func newPlainDialer(dialer *net.Dialer, r Resolver, attemptDelay time.Duration) *PlainDialer {
+	d := &PlainDialer{dialer: dialer, resolver: r}
+	if attemptDelay >= 0 {
+		if attemptDelay == 0 {
+			attemptDelay = defaultAttemptDelay
+		}
+		if r == nil {
+			if dialer.Resolver != nil {
+				r = dialer.Resolver
+			} else {
+				r = net.DefaultResolver
+			}
+		}
+		d.he = &happyEyeballs{delay: attemptDelay, lookup: r.LookupNetIP, dial: dialer.DialContext}
+	}
+	return d
 }
 
 func (d *PlainDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
 	if network != "tcp" && network != "udp" {
 		return nil, fmt.Errorf("unsupported network type: %s", network)
 	}
-	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if network == "tcp" && d.he != nil {
+		return d.he.dialHost(ctx, addr)
+	}
+	conn, err := d.dial(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +77,33 @@ func (d *PlainDialer) DialContext(ctx context.Context, network string, addr stri
 	return &PlainPacketConn{inner: uc}, nil
 }
 
+// dial dials addr. If d has a resolver, addresses of the host name are
+// dialed in turn.
+func (d *PlainDialer) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if d.resolver == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var c net.Conn
+		c, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
 type PlainPacketConn struct {
 	inner *net.UDPConn
 }
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+type clientAddrKey struct{}
+
+// WithClientAddr returns a copy of ctx that carries the address of the
+// client that sent the query. ProxyProtocolDialer puts it in the header.
+func WithClientAddr(ctx context.Context, addr netip.Addr) context.Context {
+	if !addr.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ProxyProtocolDialer sends a PROXY protocol v2 header on new tcp
+// connections, for servers behind load balancers that require it.
+// The source address in the header is the client address from
+// WithClientAddr. If ctx carries no client address, e.g. for health
+// checks, a LOCAL header is sent. Because the header describes one
+// client, connections must not be shared by queries.
+type ProxyProtocolDialer struct {
+	dialer Dialer
+}
+
+func NewProxyProtocolDialer(d Dialer) *ProxyProtocolDialer {
+	return &ProxyProtocolDialer{dialer: d}
+}
+
+func (d *ProxyProtocolDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil || !strings.HasPrefix(network, "tcp") {
+		return conn, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(ddl)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	if _, err := proxyHeader(ctx, conn.RemoteAddr()).WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write proxy protocol header, %w", err)
+	}
+	return conn, nil
+}
+
+func proxyHeader(ctx context.Context, remote net.Addr) *proxyproto.Header {
+	client, _ := ctx.Value(clientAddrKey{}).(netip.Addr)
+	ta, ok := remote.(*net.TCPAddr)
+	if !client.IsValid() || !ok {
+		return &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	}
+	dst := ta.AddrPort()
+	src := client.Unmap()
+	// Both addresses of a header must be in the same family.
+	if src.Is4() != dst.Addr().Unmap().Is4() {
+		src = netip.AddrFrom16(src.As16())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	} else {
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+	return proxyproto.HeaderProxyFromAddrs(2, net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0)), net.TCPAddrFromAddrPort(dst))
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestProxyProtocolDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pl := &proxyproto.Listener{Listener: l}
+	d := NewProxyProtocolDialer(new(net.Dialer))
+
+	tests := []struct {
+		name    string
+		client  netip.Addr
+		command proxyproto.ProtocolVersionAndCommand
+		want    string // remote addr seen by the server, empty for the conn addr
+	}{
+		{"no client", netip.Addr{}, proxyproto.LOCAL, ""},
+		{"ipv4 client", netip.MustParseAddr("192.0.2.1"), proxyproto.PROXY, "192.0.2.1:0"},
+		{"ipv6 client", netip.MustParseAddr("2001:db8::1"), proxyproto.PROXY, "[2001:db8::1]:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := d.DialContext(WithClientAddr(context.Background(), tt.client), "tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			sc, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sc.Close()
+			// The header is read by the first read.
+			go c.Write([]byte{0})
+			if _, err := sc.Read(make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			h := sc.(*proxyproto.Conn).ProxyHeader()
+			if h == nil || h.Command != tt.command {
+				t.Fatalf("unexpected proxy header %v", h)
+			}
+			want := tt.want
+			if len(want) == 0 {
+				want = c.LocalAddr().String()
+			}
+			if got := sc.RemoteAddr().String(); got != want {
+				t.Fatalf("want remote addr %s, got %s", want, got)
+			}
+		})
+	}
+}
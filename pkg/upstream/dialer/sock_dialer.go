@@ -23,172 +23,277 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
+	"strings"
+	"time"
 )
 
+const defaultSocksHandshakeTimeout = time.Second * 10
+
 type SocksDialer struct {
-	dialer *net.Dialer
-	addr   *SocksAddr
+	dialer  *net.Dialer
+	forward Dialer        // maybe nil
+	addr    *SocksAddr    // nil if the proxy is a unix socket
+	unix    string        // path of the unix socket
+	timeout time.Duration // handshake timeout
+}
+
+// SocksReplyError is returned if the socks5 proxy rejects a request.
+// Code is the REP field of the reply, or MethodNoAcceptable if the proxy
+// rejected the authentication method.
+type SocksReplyError struct {
+	Code byte
+}
+
+func (e *SocksReplyError) Error() string {
+	if e.Code == MethodNoAcceptable {
+		return "socks5 proxy rejected authentication methods"
+	}
+	return fmt.Sprintf("socks5 proxy replied %d: %s", e.Code, handleAssociateStatus(e.Code))
 }
 
-func newSocksDialer(dialer *net.Dialer, addr string) (*SocksDialer, error) {
+// newSocksDialer creates a SocksDialer. addr is "host:port", or
+// "unix:///path/to/socket" for proxies listening on unix sockets. If
+// forward is not nil, the proxy is dialed through it and udp is not
+// supported. Zero timeout means defaultSocksHandshakeTimeout.
+func newSocksDialer(dialer *net.Dialer, forward Dialer, addr string, timeout time.Duration) (*SocksDialer, error) {
+	if timeout <= 0 {
+		timeout = defaultSocksHandshakeTimeout
+	}
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if forward != nil {
+			return nil, fmt.Errorf("unix socket proxy cannot be dialed through other proxies")
+		}
+		if len(path) == 0 {
+			return nil, fmt.Errorf("empty unix socket path")
+		}
+		return &SocksDialer{dialer: dialer, unix: path, timeout: timeout}, nil
+	}
 	sAddr, err := ParseSocksAddr(addr)
 	if err != nil {
 		return nil, err
 	}
-	return &SocksDialer{dialer: dialer, addr: sAddr}, nil
+	return &SocksDialer{dialer: dialer, forward: forward, addr: sAddr, timeout: timeout}, nil
 }
 
 func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	if network != "tcp" && network != "udp" {
 		return nil, fmt.Errorf("unsupported network type: %s", network)
 	}
-	conn, err := d.dialer.DialContext(ctx, "tcp", d.addr.String())
-	if err != nil {
-		return nil, fmt.Errorf("dial faile: %v", err)
+	if network == "udp" && d.forward != nil {
+		return nil, fmt.Errorf("udp is not supported by chained socks5 proxies")
 	}
-	negoReq := []byte{Version5, 1, MethodNoAuth}
-	_, err = conn.Write(negoReq)
+	sAddr, err := ParseSocksAddr(addr)
 	if err != nil {
-		return nil, fmt.Errorf("send negotiation request failed: %v", err)
+		return nil, fmt.Errorf("parse socks addr failed: %v", err)
+	}
+	var conn net.Conn
+	switch {
+	case len(d.unix) > 0:
+		// Socket options of d.dialer are for network sockets.
+		conn, err = new(net.Dialer).DialContext(ctx, "unix", d.unix)
+	case d.forward != nil:
+		conn, err = d.forward.DialContext(ctx, "tcp", d.addr.String())
+	default:
+		conn, err = d.dialer.DialContext(ctx, "tcp", d.addr.String())
 	}
-	negoRes := make([]byte, 2)
-	n, err := conn.Read(negoRes)
 	if err != nil {
-		return nil, fmt.Errorf("receive negotiation response failed: %v", err)
+		return nil, fmt.Errorf("dial faile: %w", err)
 	}
-	if n < 2 {
-		return nil, fmt.Errorf("negotiation response too short")
+	cmd := byte(CMDCONNECT)
+	if network == "udp" {
+		cmd = CMDASSOCIATE
 	}
-	if negoRes[0] != 5 {
-		return nil, fmt.Errorf("unsupported negotiation response version: %v", negoReq[0])
+	bindAddr, err := d.handshake(ctx, conn, cmd, sAddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	var reqType string
-	var cmd byte
 	if network == "tcp" {
-		reqType = "connect"
-		cmd = CMDCONNECT
-	} else {
-		reqType = "associate"
-		cmd = CMDASSOCIATE
+		return conn, nil
 	}
-	sAddr, err := ParseSocksAddr(addr)
+	relayAddr, err := d.udpRelayAddr(ctx, bindAddr, conn.RemoteAddr())
 	if err != nil {
-		return nil, fmt.Errorf("parse socks addr failed: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("invalid udp relay address %s: %w", bindAddr.String(), err)
 	}
-	authReq := append([]byte{Version5, cmd, Reversed}, sAddr.Slice()...)
-	_, err = conn.Write(authReq)
+	c, err := d.dialer.DialContext(context.Background(), "udp", relayAddr.String())
 	if err != nil {
-		return nil, fmt.Errorf("send %s request failed: %v", reqType, err)
+		conn.Close()
+		return nil, err
 	}
-	authRes := make([]byte, 4)
-	n, err = conn.Read(authRes)
-	if err != nil {
-		return nil, fmt.Errorf("receive %s response failed: %v", reqType, err)
+	uc, isUC := c.(*net.UDPConn)
+	if !isUC {
+		c.Close()
+		conn.Close()
+		return nil, fmt.Errorf("not a udp conn")
+	}
+	spc := &SocksPacketConn{
+		conn:  conn,
+		inner: uc,
+		cache: make([]byte, 65535),
+	}
+	if !sAddr.addr.IsUnspecified() && sAddr.port != 0 {
+		spc.dest = sAddr
 	}
-	if n < 4 {
-		return nil, fmt.Errorf("%s response too short", reqType)
+	return spc, nil
+}
+
+// handshake negotiates with the proxy and sends the request cmd. It returns
+// the bind address of the reply. The handshake must finish within
+// d.timeout and the deadline of ctx.
+func (d *SocksDialer) handshake(ctx context.Context, conn net.Conn, cmd byte, dst *SocksAddr) (*SocksAddr, error) {
+	deadline := time.Now().Add(d.timeout)
+	if ddl, ok := ctx.Deadline(); ok && ddl.Before(deadline) {
+		deadline = ddl
 	}
-	if authRes[0] != Version5 {
-		return nil, fmt.Errorf("unsupported %s response version: %v", reqType, negoReq[0])
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte{Version5, 1, MethodNoAuth}); err != nil {
+		return nil, fmt.Errorf("send negotiation request failed: %w", err)
 	}
-	if authRes[1] != AuthSuccessed {
-		return nil, fmt.Errorf("%s failed: %s", reqType, handleAssociateStatus(authRes[1]))
+	negoRes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, negoRes); err != nil {
+		return nil, fmt.Errorf("receive negotiation response failed: %w", err)
 	}
-	if authRes[2] != Reversed {
-		return nil, fmt.Errorf("invalid %s response reserved byte: %v", reqType, authRes[2])
+	if negoRes[0] != Version5 {
+		return nil, fmt.Errorf("unsupported negotiation response version: %v", negoRes[0])
 	}
-	var bindAddr SocksAddr
-	switch authRes[3] {
-	case TypeIPv4:
-		addr := make([]byte, 4)
-		n, err = conn.Read(addr)
-		if err != nil {
-			return nil, fmt.Errorf("parse ipv4 bind address failed: %v", err)
-		}
-		if n < 4 {
-			return nil, fmt.Errorf("parse ipv4 bind address failed: bind address too short")
+	if negoRes[1] != MethodNoAuth {
+		return nil, &SocksReplyError{Code: MethodNoAcceptable}
+	}
+
+	reqType := "connect"
+	if cmd == CMDASSOCIATE {
+		reqType = "associate"
+	}
+	if _, err := conn.Write(append([]byte{Version5, cmd, Reversed}, dst.Slice()...)); err != nil {
+		return nil, fmt.Errorf("send %s request failed: %w", reqType, err)
+	}
+	res := make([]byte, 4)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return nil, fmt.Errorf("receive %s response failed: %w", reqType, err)
+	}
+	if res[0] != Version5 {
+		return nil, fmt.Errorf("unsupported %s response version: %v", reqType, res[0])
+	}
+	if res[1] != AuthSuccessed {
+		return nil, fmt.Errorf("%s failed: %w", reqType, &SocksReplyError{Code: res[1]})
+	}
+	if res[2] != Reversed {
+		return nil, fmt.Errorf("invalid %s response reserved byte: %v", reqType, res[2])
+	}
+	bindAddr, err := readSocksAddr(conn, res[3])
+	if err != nil {
+		return nil, fmt.Errorf("parse bind address failed: %w", err)
+	}
+	return bindAddr, nil
+}
+
+// readSocksAddr reads an address of type atyp and a port from r.
+func readSocksAddr(r io.Reader, atyp byte) (*SocksAddr, error) {
+	a := new(SocksAddr)
+	switch atyp {
+	case TypeIPv4, TypeIPv6:
+		b := make([]byte, 4)
+		if atyp == TypeIPv6 {
+			b = make([]byte, 16)
 		}
-		if addr, ok := netip.AddrFromSlice(addr); ok {
-			bindAddr.SetAddr(addr)
-		} else {
-			return nil, fmt.Errorf("parse ipv4 bind address failed: invalid ipv4 address")
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
 		}
+		addr, _ := netip.AddrFromSlice(b)
+		a.SetAddr(addr)
 	case TypeFqdn:
-		addrLen := make([]byte, 1)
-		n, err = conn.Read(addrLen)
-		if err != nil {
-			return nil, fmt.Errorf("parse fqdn bind address length failed: %v", err)
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
 		}
-		if n == 0 {
-			return nil, fmt.Errorf("parse fqdn bind address failed: length is zero")
+		if l[0] == 0 {
+			return nil, fmt.Errorf("zero length fqdn")
 		}
-		addr := make([]byte, addrLen[0])
-		n, err = conn.Read(addr)
-		if err != nil {
-			return nil, fmt.Errorf("parse fqdn bind address failed: %v", err)
-		}
-		if n < int(addrLen[0]) {
-			return nil, fmt.Errorf("parse fqdn bind address failed: bind address too short")
-		}
-		bindAddr.SetFqdn(string(addr))
-	case TypeIPv6:
-		addr := make([]byte, 16)
-		n, err = conn.Read(addr)
-		if err != nil {
-			return nil, fmt.Errorf("parse ipv6 bind address failed: %v", err)
-		}
-		if n < 16 {
-			return nil, fmt.Errorf("parse ipv6 bind address failed: bind address too short")
-		}
-		if addr, ok := netip.AddrFromSlice(addr); ok {
-			bindAddr.SetAddr(addr)
-		} else {
-			return nil, fmt.Errorf("parse ipv6 bind address failed: invalid ipv6 address")
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
 		}
+		a.SetFqdn(string(b))
 	default:
-		return nil, fmt.Errorf("unsupported bind address type: %v", authRes[3])
+		return nil, fmt.Errorf("unsupported address type: %v", atyp)
 	}
 	rawPort := make([]byte, 2)
-	n, err = conn.Read(rawPort)
-	if err != nil {
-		return nil, fmt.Errorf("parse bind port failed: %v", err)
-	}
-	if n < 2 {
-		return nil, fmt.Errorf("parse bind port failed: bind port too short")
+	if _, err := io.ReadFull(r, rawPort); err != nil {
+		return nil, err
 	}
-	bindAddr.SetPort(binary.BigEndian.Uint16(rawPort))
-	if network == "tcp" {
-		return conn, nil
+	a.SetPort(binary.BigEndian.Uint16(rawPort))
+	return a, nil
+}
+
+// udpRelayAddr returns the udp relay address from the bind address of an
+// associate response. Many servers reply an unspecified address, which
+// means the relay is on the proxy server itself, or an fqdn, which is
+// resolved here. proxyAddr is the remote address of the control connection.
+func (d *SocksDialer) udpRelayAddr(ctx context.Context, bind *SocksAddr, proxyAddr net.Addr) (netip.AddrPort, error) {
+	if bind.port == 0 {
+		return netip.AddrPort{}, fmt.Errorf("zero port")
 	}
-	c, err := d.dialer.DialContext(context.Background(), "udp", bindAddr.String())
-	if err != nil {
-		return nil, err
+	var proxyIP netip.Addr
+	if ta, ok := proxyAddr.(*net.TCPAddr); ok {
+		proxyIP = ta.AddrPort().Addr().Unmap()
 	}
-	pc, isPC := c.(net.PacketConn)
-	if !isPC {
-		return nil, fmt.Errorf("not a packet conn")
+
+	addr := bind.addr
+	if len(bind.fqdn) > 0 {
+		r := d.dialer.Resolver
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		addrs, err := r.LookupNetIP(ctx, "ip", bind.fqdn)
+		if err != nil {
+			// The fqdn may only be resolvable on the proxy side, e.g. its hostname.
+			if !proxyIP.IsValid() {
+				return netip.AddrPort{}, err
+			}
+			addrs = []netip.Addr{proxyIP}
+		}
+		addr = pickAddr(addrs, proxyIP)
 	}
-	uc, isUC := pc.(*net.UDPConn)
-	if !isUC {
-		return nil, fmt.Errorf("not a udp conn")
+	addr = addr.Unmap()
+
+	switch {
+	case !addr.IsValid():
+		return netip.AddrPort{}, fmt.Errorf("no address")
+	case addr.IsUnspecified(), addr.IsLoopback() && proxyIP.IsValid() && !proxyIP.IsLoopback():
+		// A loopback address from a remote proxy is its own view, not ours.
+		if !proxyIP.IsValid() {
+			return netip.AddrPort{}, fmt.Errorf("unspecified address and unknown proxy address")
+		}
+		addr = proxyIP
+	case addr.IsMulticast(), addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}):
+		return netip.AddrPort{}, fmt.Errorf("not a unicast address")
 	}
-	spc := &SocksPacketConn{
-		conn:  conn,
-		inner: uc,
-		cache: make([]byte, 65535),
+	return netip.AddrPortFrom(addr, bind.port), nil
+}
+
+// pickAddr prefers the address that has the same family as the proxy.
+func pickAddr(addrs []netip.Addr, proxyIP netip.Addr) netip.Addr {
+	for _, a := range addrs {
+		if a.Unmap().Is4() == proxyIP.Is4() {
+			return a
+		}
 	}
-	if !sAddr.addr.IsUnspecified() && sAddr.port != 0 {
-		spc.dest = sAddr
+	if len(addrs) > 0 {
+		return addrs[0]
 	}
-	return spc, nil
+	return netip.Addr{}
 }
 
 func handleAssociateStatus(status byte) string {
 	switch status {
 	case 1:
-		return "associate failed: general socks server failure"
+		return "general socks server failure"
 	case 2:
 		return "connection not allowed by ruleset"
 	case 3:
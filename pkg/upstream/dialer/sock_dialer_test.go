@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSocksDialer_udpRelayAddr(t *testing.T) {
+	d := &SocksDialer{dialer: &net.Dialer{}}
+	proxy := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}
+	tests := []struct {
+		name    string
+		bind    *SocksAddr
+		proxy   net.Addr
+		want    string
+		wantErr bool
+	}{
+		{"addr", &SocksAddr{addr: netip.MustParseAddr("192.0.2.2"), port: 5000}, proxy, "192.0.2.2:5000", false},
+		{"unspecified", &SocksAddr{addr: netip.IPv4Unspecified(), port: 5000}, proxy, "192.0.2.1:5000", false},
+		{"unspecified v6", &SocksAddr{addr: netip.IPv6Unspecified(), port: 5000}, proxy, "192.0.2.1:5000", false},
+		{"remote loopback", &SocksAddr{addr: netip.MustParseAddr("127.0.0.1"), port: 5000}, proxy, "192.0.2.1:5000", false},
+		{"local loopback", &SocksAddr{addr: netip.MustParseAddr("127.0.0.1"), port: 5000}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "127.0.0.1:5000", false},
+		{"fqdn", &SocksAddr{fqdn: "localhost", port: 5000}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "127.0.0.1:5000", false},
+		{"zero port", &SocksAddr{addr: netip.MustParseAddr("192.0.2.2")}, proxy, "", true},
+		{"multicast", &SocksAddr{addr: netip.MustParseAddr("224.0.0.1"), port: 5000}, proxy, "", true},
+		{"unknown proxy", &SocksAddr{addr: netip.IPv4Unspecified(), port: 5000}, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.udpRelayAddr(context.Background(), tt.bind, tt.proxy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("udpRelayAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Fatalf("udpRelayAddr() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSocksDialer_handshake(t *testing.T) {
+	dst, _ := ParseSocksAddr("example.com:53")
+	tests := []struct {
+		name     string
+		reply    []byte // sent byte by byte after reading the requests
+		wantBind string
+		wantCode int // -1 means no SocksReplyError
+	}{
+		{"ipv4", []byte{5, 0, 5, 0, 0, 1, 192, 0, 2, 1, 0, 53}, "192.0.2.1:53", -1},
+		{"fqdn", []byte{5, 0, 5, 0, 0, 3, 4, 'h', 'o', 's', 't', 0, 53}, "host:53", -1},
+		{"not allowed", []byte{5, 0, 5, 2, 0, 1, 0, 0, 0, 0, 0, 0}, "", 2},
+		{"no acceptable method", []byte{5, 0xff}, "", MethodNoAcceptable},
+		{"short reply", []byte{5, 0, 5, 0, 0, 1, 192, 0}, "", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			go func() {
+				defer s.Close()
+				nego := make([]byte, 3)
+				io.ReadFull(s, nego)
+				for i, b := range tt.reply {
+					if i == 2 {
+						req := make([]byte, 3+len(dst.Slice()))
+						io.ReadFull(s, req)
+					}
+					s.Write([]byte{b})
+				}
+			}()
+
+			d := &SocksDialer{timeout: time.Second}
+			bind, err := d.handshake(context.Background(), c, CMDCONNECT, dst)
+			var replyErr *SocksReplyError
+			if tt.wantCode >= 0 {
+				if !errors.As(err, &replyErr) || int(replyErr.Code) != tt.wantCode {
+					t.Fatalf("handshake() error = %v, want reply code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if len(tt.wantBind) == 0 {
+				if err == nil || errors.As(err, &replyErr) {
+					t.Fatalf("handshake() error = %v, want a read error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bind.String() != tt.wantBind {
+				t.Fatalf("handshake() bind = %s, want %s", bind, tt.wantBind)
+			}
+		})
+	}
+}
+
+func TestSocksDialer_handshakeTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go io.Copy(io.Discard, s)
+
+	dst, _ := ParseSocksAddr("192.0.2.1:53")
+	d := &SocksDialer{timeout: time.Millisecond * 50}
+	_, err := d.handshake(context.Background(), c, CMDCONNECT, dst)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("handshake() error = %v, want timeout", err)
+	}
+}
+
+func TestSocksDialer_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dst, _ := ParseSocksAddr("192.0.2.1:53")
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, 3))
+		c.Write([]byte{5, 0})
+		io.ReadFull(c, make([]byte, 3+len(dst.Slice())))
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		io.Copy(c, c)
+	}()
+
+	d, err := NewDialer(DialerOpts{Dialer: &net.Dialer{}, SocksAddr: "unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", dst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Fatalf("unexpected echo %q, %v", b, err)
+	}
+
+	if _, err := NewDialer(DialerOpts{Dialer: &net.Dialer{}, Proxies: []string{"http://127.0.0.1:8080", "socks5://unix://" + path}}); err == nil {
+		t.Fatal("chained unix socket proxy should fail")
+	}
+}
@@ -33,6 +33,8 @@ const Version5 = 5
 const (
 	MethodNoAuth   = 0
 	MethodUserPass = 2
+
+	MethodNoAcceptable = 0xff
 )
 
 const AuthSuccessed = 0
@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Encryption systems.
+const (
+	esXSalsa20Poly1305  = 0x0001
+	esXChacha20Poly1305 = 0x0002
+)
+
+const (
+	certMagic     = "DNSC"
+	certLen       = 124
+	resolverMagic = "r6fnvWj8"
+
+	clientMagicLen = 8
+	halfNonceLen   = 12
+	nonceLen       = 24
+	keyLen         = 32
+
+	// minUDPQueryLen is the minimum length of padded udp queries.
+	minUDPQueryLen = 256
+	paddingBlock   = 64
+)
+
+// cert is a verified resolver certificate and the keys to talk to it.
+type cert struct {
+	esVersion   uint16
+	resolverPK  [keyLen]byte
+	clientMagic [clientMagicLen]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+
+	clientPK  [keyLen]byte
+	sharedKey [keyLen]byte
+}
+
+// parseCert parses and verifies b with the provider public key pk.
+func parseCert(b []byte, pk ed25519.PublicKey) (*cert, error) {
+	if len(b) < certLen {
+		return nil, fmt.Errorf("invalid cert length %d", len(b))
+	}
+	if string(b[:4]) != certMagic {
+		return nil, errors.New("invalid cert magic")
+	}
+	c := &cert{esVersion: binary.BigEndian.Uint16(b[4:6])}
+	if c.esVersion != esXSalsa20Poly1305 && c.esVersion != esXChacha20Poly1305 {
+		return nil, fmt.Errorf("unsupported encryption system %d", c.esVersion)
+	}
+	if minor := binary.BigEndian.Uint16(b[6:8]); minor != 0 {
+		return nil, fmt.Errorf("unsupported protocol minor version %d", minor)
+	}
+	// Signature covers everything after it, including extensions.
+	if !ed25519.Verify(pk, b[72:], b[8:72]) {
+		return nil, errors.New("invalid cert signature")
+	}
+	copy(c.resolverPK[:], b[72:104])
+	copy(c.clientMagic[:], b[104:112])
+	c.serial = binary.BigEndian.Uint32(b[112:116])
+	c.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	c.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	return c, nil
+}
+
+func (c *cert) validAt(t time.Time) bool {
+	return !t.Before(c.notBefore) && t.Before(c.notAfter)
+}
+
+// better reports whether c should be used instead of o. Higher serials
+// win, and XChacha20 wins ties.
+func (c *cert) better(o *cert) bool {
+	if o == nil || c.serial != o.serial {
+		return o == nil || c.serial > o.serial
+	}
+	return c.esVersion > o.esVersion
+}
+
+// initKeys generates a new client key pair for c and computes the shared
+// key.
+func (c *cert) initKeys() error {
+	var sk [keyLen]byte
+	if _, err := rand.Read(sk[:]); err != nil {
+		return err
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	copy(c.clientPK[:], pk)
+
+	switch c.esVersion {
+	case esXSalsa20Poly1305:
+		box.Precompute(&c.sharedKey, &c.resolverPK, &sk)
+	case esXChacha20Poly1305:
+		dh, err := curve25519.X25519(sk[:], c.resolverPK[:])
+		if err != nil {
+			return err
+		}
+		k, err := chacha20.HChaCha20(dh, make([]byte, 16))
+		if err != nil {
+			return err
+		}
+		copy(c.sharedKey[:], k)
+	}
+	return nil
+}
+
+// encryptQuery pads and encrypts q. minLen is the minimum length of the
+// padded query. It returns the packet and the client half nonce.
+func (c *cert) encryptQuery(q []byte, minLen int) ([]byte, [halfNonceLen]byte, error) {
+	var nonce [nonceLen]byte
+	if _, err := rand.Read(nonce[:halfNonceLen]); err != nil {
+		return nil, [halfNonceLen]byte{}, err
+	}
+	b := make([]byte, 0, clientMagicLen+keyLen+halfNonceLen+poly1305.TagSize+len(q)+minLen+paddingBlock)
+	b = append(b, c.clientMagic[:]...)
+	b = append(b, c.clientPK[:]...)
+	b = append(b, nonce[:halfNonceLen]...)
+	b = c.seal(b, pad(q, minLen), &nonce)
+	return b, [halfNonceLen]byte(nonce[:halfNonceLen]), nil
+}
+
+// decryptResponse decrypts and unpads b, which must be the response to
+// the query with the client half nonce cn.
+func (c *cert) decryptResponse(b []byte, cn [halfNonceLen]byte) ([]byte, error) {
+	if len(b) < len(resolverMagic)+nonceLen+poly1305.TagSize {
+		return nil, errors.New("response is too short")
+	}
+	if string(b[:len(resolverMagic)]) != resolverMagic {
+		return nil, errors.New("invalid resolver magic")
+	}
+	b = b[len(resolverMagic):]
+	var nonce [nonceLen]byte
+	copy(nonce[:], b[:nonceLen])
+	if subtle.ConstantTimeCompare(nonce[:halfNonceLen], cn[:]) != 1 {
+		return nil, errors.New("unexpected response nonce")
+	}
+	p, ok := c.open(b[nonceLen:], &nonce)
+	if !ok {
+		return nil, errors.New("failed to decrypt response")
+	}
+	return unpad(p)
+}
+
+func (c *cert) seal(out, m []byte, nonce *[nonceLen]byte) []byte {
+	if c.esVersion == esXSalsa20Poly1305 {
+		return secretbox.Seal(out, m, nonce, &c.sharedKey)
+	}
+	return xchachaSeal(out, m, nonce, &c.sharedKey)
+}
+
+func (c *cert) open(b []byte, nonce *[nonceLen]byte) ([]byte, bool) {
+	if c.esVersion == esXSalsa20Poly1305 {
+		return secretbox.Open(nil, b, nonce, &c.sharedKey)
+	}
+	return xchachaOpen(b, nonce, &c.sharedKey)
+}
+
+// xchachaSeal is secretbox with XChacha20 instead of XSalsa20, which is
+// what DNSCrypt es-version 2 uses. The first 32 bytes of the key stream
+// are the poly1305 key, the message is encrypted with the rest, and the
+// tag is put in front of the cipher text.
+func xchachaSeal(out, m []byte, nonce *[nonceLen]byte, key *[keyLen]byte) []byte {
+	s, polyKey := newXChacha(nonce, key)
+	start := len(out)
+	out = append(out, make([]byte, poly1305.TagSize+len(m))...)
+	ct := out[start+poly1305.TagSize:]
+	s.XORKeyStream(ct, m)
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ct, polyKey)
+	copy(out[start:], tag[:])
+	return out
+}
+
+func xchachaOpen(b []byte, nonce *[nonceLen]byte, key *[keyLen]byte) ([]byte, bool) {
+	if len(b) < poly1305.TagSize {
+		return nil, false
+	}
+	s, polyKey := newXChacha(nonce, key)
+	tag := (*[poly1305.TagSize]byte)(b[:poly1305.TagSize])
+	ct := b[poly1305.TagSize:]
+	if !poly1305.Verify(tag, ct, polyKey) {
+		return nil, false
+	}
+	m := make([]byte, len(ct))
+	s.XORKeyStream(m, ct)
+	return m, true
+}
+
+// newXChacha returns the XChacha20 stream and the poly1305 key, which is
+// consumed from the stream.
+func newXChacha(nonce *[nonceLen]byte, key *[keyLen]byte) (*chacha20.Cipher, *[32]byte) {
+	s, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:]) // sizes are fixed, never fails
+	polyKey := new([32]byte)
+	s.XORKeyStream(polyKey[:], polyKey[:])
+	return s, polyKey
+}
+
+// pad pads m with ISO/IEC 7816-4 padding to a multiple of paddingBlock,
+// and at least minLen bytes.
+func pad(m []byte, minLen int) []byte {
+	l := len(m) + 1
+	if l < minLen {
+		l = minLen
+	}
+	l = (l + paddingBlock - 1) / paddingBlock * paddingBlock
+	p := make([]byte, l)
+	copy(p, m)
+	p[len(m)] = 0x80
+	return p
+}
+
+func unpad(p []byte) ([]byte, error) {
+	for i := len(p) - 1; i >= 0; i-- {
+		switch p[i] {
+		case 0:
+			continue
+		case 0x80:
+			return p[:i], nil
+		}
+		break
+	}
+	return nil, errors.New("invalid padding")
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/pool"
+)
+
+const (
+	// certRefreshInterval is how often certs are fetched again, so rotated
+	// certs are picked up before the old ones expire.
+	certRefreshInterval = time.Hour
+	certFetchTimeout    = time.Second * 5
+	defaultQueryTimeout = time.Second * 5
+)
+
+// DialFunc dials addr. network is "udp" or "tcp".
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Upstream is a DNSCrypt v2 upstream. See https://dnscrypt.info/protocol.
+// Queries are sent over udp, and over tcp if the response is truncated.
+type Upstream struct {
+	stamp *Stamp
+	addr  string
+	dial  DialFunc
+
+	sf        singleflight.Group // fetches certs
+	m         sync.Mutex
+	cert      *cert
+	refreshAt time.Time
+}
+
+// NewUpstream creates an Upstream for st. The server is dialed at addr,
+// or st.Addr if addr is empty.
+func NewUpstream(st *Stamp, addr string, dial DialFunc) *Upstream {
+	if len(addr) == 0 {
+		addr = st.Addr
+	}
+	return &Upstream{stamp: st, addr: addr, dial: dial}
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c, err := u.getCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.exchange(ctx, c, q, "udp")
+	if err == nil && r.Truncated {
+		r, err = u.exchange(ctx, c, q, "tcp")
+	}
+	return r, err
+}
+
+func (u *Upstream) Close() error {
+	return nil
+}
+
+// getCert returns the cached cert, or fetches certs if the cache needs a
+// refresh. If the fetch fails, the cached cert is used until it expires.
+// Concurrent queries share one fetch, and a query whose ctx ends stops
+// waiting for it.
+func (u *Upstream) getCert(ctx context.Context) (*cert, error) {
+	u.m.Lock()
+	cached, refreshAt := u.cert, u.refreshAt
+	u.m.Unlock()
+	now := time.Now()
+	if cached != nil && now.Before(refreshAt) {
+		return cached, nil
+	}
+
+	ch := u.sf.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), certFetchTimeout)
+		defer cancel()
+		c, err := u.fetchCert(ctx)
+		if err != nil {
+			return nil, err
+		}
+		u.m.Lock()
+		u.cert = c
+		u.refreshAt = time.Now().Add(certRefreshInterval)
+		if c.notAfter.Before(u.refreshAt) {
+			u.refreshAt = c.notAfter
+		}
+		u.m.Unlock()
+		return c, nil
+	})
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			if cached != nil && cached.validAt(now) {
+				return cached, nil
+			}
+			return nil, fmt.Errorf("failed to fetch dnscrypt cert, %w", r.Err)
+		}
+		return r.Val.(*cert), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// invalidateCert forces a refresh on the next query if c is still the
+// cached cert.
+func (u *Upstream) invalidateCert(c *cert) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.cert == c {
+		u.refreshAt = time.Time{}
+	}
+}
+
+// fetchCert queries the provider name for certs and returns the best valid
+// one with new client keys.
+func (u *Upstream) fetchCert(ctx context.Context) (*cert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(u.stamp.ProviderName), dns.TypeTXT)
+	r, err := u.exchangePlain(ctx, q, "udp")
+	if err == nil && r.Truncated {
+		r, err = u.exchangePlain(ctx, q, "tcp")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("cert query failed with rcode %s", dns.RcodeToString[r.Rcode])
+	}
+
+	now := time.Now()
+	var best *cert
+	var lastErr error
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		b, err := unescapeTXT(strings.Join(txt.Txt, ""))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c, err := parseCert(b, u.stamp.ProviderPK)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !c.validAt(now) {
+			lastErr = errors.New("cert is expired or not yet valid")
+			continue
+		}
+		if c.better(best) {
+			best = c
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no cert in response")
+		}
+		return nil, lastErr
+	}
+	if err := best.initKeys(); err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// exchangePlain exchanges unencrypted q, which is only used to fetch certs.
+func (u *Upstream) exchangePlain(ctx context.Context, q *dns.Msg, network string) (*dns.Msg, error) {
+	conn, err := u.dialConn(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if network == "tcp" {
+		if _, err := dnsutils.WriteMsgToTCP(conn, q); err != nil {
+			return nil, err
+		}
+		r, _, err := dnsutils.ReadMsgFromTCP(conn)
+		return r, err
+	}
+	if _, err := dnsutils.WriteMsgToUDP(conn, q); err != nil {
+		return nil, err
+	}
+	r, _, err := dnsutils.ReadMsgFromUDP(conn, dns.MaxMsgSize)
+	return r, err
+}
+
+func (u *Upstream) exchange(ctx context.Context, c *cert, q *dns.Msg, network string) (*dns.Msg, error) {
+	qb, buf, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, err
+	}
+	minLen := 0
+	if network == "udp" {
+		minLen = minUDPQueryLen
+	}
+	b, cn, err := c.encryptQuery(qb, minLen)
+	buf.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := u.dialConn(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var rb []byte
+	if network == "tcp" {
+		if _, err := dnsutils.WriteRawMsgToTCP(conn, b); err != nil {
+			return nil, err
+		}
+		rBuf, _, err := dnsutils.ReadRawMsgFromTCP(conn)
+		if err != nil {
+			return nil, err
+		}
+		defer rBuf.Release()
+		rb = rBuf.Bytes()
+	} else {
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		rBuf := pool.GetBuf(dns.MaxMsgSize)
+		defer rBuf.Release()
+		n, err := conn.Read(rBuf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		rb = rBuf.Bytes()[:n]
+	}
+
+	p, err := c.decryptResponse(rb, cn)
+	if err != nil {
+		// The server may have rotated its keys.
+		u.invalidateCert(c)
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(p); err != nil {
+		return nil, err
+	}
+	if r.Id != q.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
+
+func (u *Upstream) dialConn(ctx context.Context, network string) (net.Conn, error) {
+	conn, err := u.dial(ctx, network, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultQueryTimeout)
+	}
+	conn.SetDeadline(ddl)
+	return conn, nil
+}
+
+// unescapeTXT decodes the presentation format of a TXT string, where
+// binary bytes are escaped as "\DDD".
+func unescapeTXT(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, errors.New("invalid txt escape")
+		}
+		if s[i] < '0' || s[i] > '9' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, errors.New("invalid txt escape")
+		}
+		n, err := strconv.ParseUint(s[i:i+3], 10, 8)
+		if err != nil {
+			return nil, errors.New("invalid txt escape")
+		}
+		b = append(b, byte(n))
+		i += 2
+	}
+	return b, nil
+}
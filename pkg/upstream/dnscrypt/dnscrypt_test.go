@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestParseStamp(t *testing.T) {
+	// AdGuard DNS
+	s := "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+	st, err := ParseStamp(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Props != 3 || st.Addr != "94.140.14.14:5443" || st.ProviderName != "2.dnscrypt.default.ns1.adguard.com" {
+		t.Fatalf("unexpected stamp %+v", st)
+	}
+	if st.String() != s {
+		t.Fatalf("String() = %s, want %s", st.String(), s)
+	}
+
+	pk := make([]byte, ed25519.PublicKeySize)
+	tests := []struct {
+		name     string
+		s        string
+		wantAddr string
+		wantErr  bool
+	}{
+		{"default port", (&Stamp{Addr: "1.1.1.1", ProviderPK: pk, ProviderName: "p"}).String(), "1.1.1.1:443", false},
+		{"ipv6", (&Stamp{Addr: "[::1]", ProviderPK: pk, ProviderName: "p"}).String(), "[::1]:443", false},
+		{"bad pk", (&Stamp{Addr: "1.1.1.1", ProviderPK: pk[:8], ProviderName: "p"}).String(), "", true},
+		{"no provider", (&Stamp{Addr: "1.1.1.1", ProviderPK: pk}).String(), "", true},
+		{"doh stamp", "sdns://AgAAAAAAAAAAAAA", "", true},
+		{"no scheme", "AQMAAAAAAAAA", "", true},
+		{"truncated", s[:40], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := ParseStamp(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseStamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && st.Addr != tt.wantAddr {
+				t.Fatalf("ParseStamp() addr = %s, want %s", st.Addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func Test_pad(t *testing.T) {
+	for _, l := range []int{0, 1, 63, 64, 255, 256, 1000} {
+		m := make([]byte, l)
+		rand.Read(m)
+		for _, minLen := range []int{0, minUDPQueryLen} {
+			p := pad(m, minLen)
+			if len(p)%paddingBlock != 0 || len(p) < minLen || len(p) <= l {
+				t.Fatalf("invalid padded length %d for %d, %d", len(p), l, minLen)
+			}
+			got, err := unpad(p)
+			if err != nil || string(got) != string(m) {
+				t.Fatalf("unpad() failed, %v", err)
+			}
+		}
+	}
+	if _, err := unpad(make([]byte, 64)); err == nil {
+		t.Fatal("unpad() accepted invalid padding")
+	}
+}
+
+// fakeServer is a minimal DNSCrypt server. It answers A queries with
+// 1.2.3.4.
+type fakeServer struct {
+	conn       net.PacketConn
+	providerSK ed25519.PrivateKey
+
+	m         sync.Mutex
+	esVersion uint16
+	serial    uint32
+	pk        [keyLen]byte
+	magic     [clientMagicLen]byte
+	keys      map[[clientMagicLen]byte][keyLen]byte // all client magics and secret keys
+}
+
+func newFakeServer(t *testing.T, esVersion uint16) (*fakeServer, *Stamp) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	providerPK, providerSK, _ := ed25519.GenerateKey(rand.Reader)
+	s := &fakeServer{conn: conn, providerSK: providerSK, esVersion: esVersion, keys: make(map[[clientMagicLen]byte][keyLen]byte)}
+	s.rotate()
+	go s.serve()
+	return s, &Stamp{Addr: conn.LocalAddr().String(), ProviderPK: providerPK, ProviderName: "2.dnscrypt-cert.test"}
+}
+
+// rotate publishes a new cert. Old certs are still accepted, like real
+// servers do during the rotation.
+func (s *fakeServer) rotate() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var sk [keyLen]byte
+	rand.Read(sk[:])
+	pk, _ := curve25519.X25519(sk[:], curve25519.Basepoint)
+	copy(s.pk[:], pk)
+	rand.Read(s.magic[:])
+	s.keys[s.magic] = sk
+	s.serial++
+}
+
+func (s *fakeServer) cert() []byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b := []byte(certMagic)
+	b = binary.BigEndian.AppendUint16(b, s.esVersion)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = append(b, make([]byte, ed25519.SignatureSize)...)
+	b = append(b, s.pk[:]...)
+	b = append(b, s.magic[:]...)
+	b = binary.BigEndian.AppendUint32(b, s.serial)
+	now := time.Now()
+	b = binary.BigEndian.AppendUint32(b, uint32(now.Add(-time.Hour).Unix()))
+	b = binary.BigEndian.AppendUint32(b, uint32(now.Add(time.Hour).Unix()))
+	copy(b[8:72], ed25519.Sign(s.providerSK, b[72:]))
+	return b
+}
+
+func (s *fakeServer) serve() {
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		var resp []byte
+		var magic [clientMagicLen]byte
+		copy(magic[:], b[:n])
+		s.m.Lock()
+		sk, ok := s.keys[magic]
+		s.m.Unlock()
+		if ok {
+			resp = s.handleEncrypted(b[:n], sk)
+		} else {
+			resp = s.handlePlain(b[:n])
+		}
+		if resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *fakeServer) handlePlain(b []byte) []byte {
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil
+	}
+	var sb strings.Builder
+	for _, c := range s.cert() {
+		fmt.Fprintf(&sb, "\\%03d", c)
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{sb.String()},
+	}}
+	out, _ := r.Pack()
+	return out
+}
+
+func (s *fakeServer) handleEncrypted(b []byte, sk [keyLen]byte) []byte {
+	c := &cert{esVersion: s.esVersion}
+	b = b[clientMagicLen:]
+	var clientPK [keyLen]byte
+	copy(clientPK[:], b[:keyLen])
+	switch c.esVersion {
+	case esXSalsa20Poly1305:
+		box.Precompute(&c.sharedKey, &clientPK, &sk)
+	case esXChacha20Poly1305:
+		dh, _ := curve25519.X25519(sk[:], clientPK[:])
+		k, _ := chacha20.HChaCha20(dh, make([]byte, 16))
+		copy(c.sharedKey[:], k)
+	}
+	var nonce [nonceLen]byte
+	copy(nonce[:], b[keyLen:keyLen+halfNonceLen])
+	p, ok := c.open(b[keyLen+halfNonceLen:], &nonce)
+	if !ok {
+		return nil
+	}
+	p, err := unpad(p)
+	if err != nil {
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(p); err != nil {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(1, 2, 3, 4),
+	}}
+	rb, _ := r.Pack()
+	rand.Read(nonce[halfNonceLen:])
+	out := append([]byte(resolverMagic), nonce[:]...)
+	return c.seal(out, pad(rb, 0), &nonce)
+}
+
+func TestUpstream_ExchangeContext(t *testing.T) {
+	for _, es := range []uint16{esXSalsa20Poly1305, esXChacha20Poly1305} {
+		t.Run(fmt.Sprintf("es%d", es), func(t *testing.T) {
+			s, st := newFakeServer(t, es)
+			u := NewUpstream(st, "", (&net.Dialer{}).DialContext)
+
+			exchange := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				r, err := u.ExchangeContext(ctx, q)
+				if err != nil {
+					return err
+				}
+				if r.Id != q.Id || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(1, 2, 3, 4)) {
+					return fmt.Errorf("unexpected response %s", r)
+				}
+				return nil
+			}
+			if err := exchange(); err != nil {
+				t.Fatal(err)
+			}
+
+			s.rotate()
+			if err := exchange(); err != nil {
+				t.Fatalf("old cert was rejected, %v", err)
+			}
+			if u.cert.serial != 1 {
+				t.Fatalf("cert was refreshed too early")
+			}
+			u.refreshAt = time.Now() // pretend certRefreshInterval passed
+			if err := exchange(); err != nil {
+				t.Fatal(err)
+			}
+			if u.cert.serial != 2 {
+				t.Fatalf("cert serial = %d, want 2", u.cert.serial)
+			}
+		})
+	}
+}
+
+func TestUpstream_getCert_shared(t *testing.T) {
+	_, st := newFakeServer(t, esXChacha20Poly1305)
+	var mu sync.Mutex
+	dials := 0
+	unblock := make(chan struct{})
+	u := NewUpstream(st, "", func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		<-unblock
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+
+	// Queries leave when their ctx ends, while the fetch goes on.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+			defer cancel()
+			if _, err := u.getCert(ctx); err == nil {
+				t.Error("want a ctx error")
+			}
+		}()
+	}
+	wg.Wait()
+	u.invalidateCert(nil) // u.m is not held by the fetch.
+
+	close(unblock)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := u.getCert(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dials != 1 {
+		t.Fatalf("want 1 fetch, got %d dials", dials)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	stampScheme         = "sdns://"
+	stampProtoDNSCrypt  = 0x01
+	defaultDNSCryptPort = "443"
+	stampPropsLen       = 8
+)
+
+// Stamp is a DNSCrypt server stamp, see
+// https://dnscrypt.info/stamps-specifications.
+type Stamp struct {
+	Props        uint64 // informal properties, e.g. dnssec, no logs.
+	Addr         string // ip:port of the server.
+	ProviderPK   ed25519.PublicKey
+	ProviderName string // e.g. "2.dnscrypt-cert.example.com"
+}
+
+// ParseStamp parses s, which is "sdns://<base64url>". Only DNSCrypt stamps
+// are supported.
+func ParseStamp(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, stampScheme) {
+		return nil, errors.New("stamp must start with " + stampScheme)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(stampScheme):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding, %w", err)
+	}
+	if len(b) < 1+stampPropsLen {
+		return nil, errors.New("stamp is too short")
+	}
+	if b[0] != stampProtoDNSCrypt {
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x", b[0])
+	}
+	st := &Stamp{Props: binary.LittleEndian.Uint64(b[1:])}
+	b = b[1+stampPropsLen:]
+
+	var addr, pk, name []byte
+	for _, f := range []*[]byte{&addr, &pk, &name} {
+		if *f, b, err = readLP(b); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) != 0 {
+		return nil, errors.New("stamp has trailing data")
+	}
+
+	st.Addr = string(addr)
+	if _, _, err := net.SplitHostPort(st.Addr); err != nil {
+		st.Addr = net.JoinHostPort(strings.Trim(st.Addr, "[]"), defaultDNSCryptPort)
+	}
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid provider public key length %d", len(pk))
+	}
+	st.ProviderPK = ed25519.PublicKey(pk)
+	st.ProviderName = strings.TrimSuffix(string(name), ".")
+	if len(st.ProviderName) == 0 {
+		return nil, errors.New("empty provider name")
+	}
+	return st, nil
+}
+
+// String returns the "sdns://" form of st.
+func (st *Stamp) String() string {
+	b := []byte{stampProtoDNSCrypt}
+	b = binary.LittleEndian.AppendUint64(b, st.Props)
+	for _, f := range [][]byte{[]byte(st.Addr), st.ProviderPK, []byte(st.ProviderName)} {
+		b = append(b, byte(len(f)))
+		b = append(b, f...)
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// readLP reads a length prefixed field from b.
+func readLP(b []byte) (f, rest []byte, err error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, errors.New("stamp is truncated")
+	}
+	l := int(b[0])
+	return b[1 : 1+l], b[1+l:], nil
+}
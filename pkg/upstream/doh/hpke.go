@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// This file implements the base mode sender of HPKE (RFC 9180) with
+// DHKEM(X25519, HKDF-SHA256) and HKDF-SHA256, which is all ODoH needs.
+
+const (
+	kemX25519HKDFSHA256  = 0x0020
+	kdfHKDFSHA256        = 0x0001
+	aeadAES128GCM        = 0x0001
+	aeadChaCha20Poly1305 = 0x0003
+
+	hpkeNonceLen = 12
+	hpkeHashLen  = sha256.Size
+	x25519KeyLen = 32
+)
+
+type hpkeSuite struct {
+	kem, kdf, aead uint16
+}
+
+func (s hpkeSuite) supported() bool {
+	return s.kem == kemX25519HKDFSHA256 && s.kdf == kdfHKDFSHA256 &&
+		(s.aead == aeadAES128GCM || s.aead == aeadChaCha20Poly1305)
+}
+
+func (s hpkeSuite) id() []byte {
+	b := []byte("HPKE")
+	b = binary.BigEndian.AppendUint16(b, s.kem)
+	b = binary.BigEndian.AppendUint16(b, s.kdf)
+	return binary.BigEndian.AppendUint16(b, s.aead)
+}
+
+// keyLen returns Nk of the aead.
+func (s hpkeSuite) keyLen() int {
+	if s.aead == aeadAES128GCM {
+		return 16
+	}
+	return chacha20poly1305.KeySize
+}
+
+func (s hpkeSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if s.aead == aeadAES128GCM {
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// hpkeContext is the context of a single message, so the sequence number
+// is always 0.
+type hpkeContext struct {
+	suite          hpkeSuite
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+// setupBaseS encapsulates a new shared secret to the public key pkR and
+// returns the encapsulated key and the sender context.
+func setupBaseS(s hpkeSuite, pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	pub, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key, %w", err)
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	ctx, err := s.keySchedule(kemSharedSecret(dh, enc, pkR), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// kemSharedSecret is ExtractAndExpand of DHKEM.
+func kemSharedSecret(dh, enc, pkR []byte) []byte {
+	kemID := binary.BigEndian.AppendUint16([]byte("KEM"), kemX25519HKDFSHA256)
+	kemContext := append(append([]byte(nil), enc...), pkR...)
+	prk := labeledExtract(kemID, nil, "eae_prk", dh)
+	return labeledExpand(kemID, prk, "shared_secret", kemContext, hpkeHashLen)
+}
+
+func (s hpkeSuite) keySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	suiteID := s.id()
+
+	ksContext := []byte{0} // mode_base
+	ksContext = append(ksContext, labeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	ksContext = append(ksContext, labeledExtract(suiteID, nil, "info_hash", info)...)
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+
+	aead, err := s.newAEAD(labeledExpand(suiteID, secret, "key", ksContext, s.keyLen()))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		suite:          s,
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", ksContext, hpkeNonceLen),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", ksContext, hpkeHashLen),
+	}, nil
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, pt, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(c.suite.id(), c.exporterSecret, "sec", exporterContext, l)
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	b := append([]byte("HPKE-v1"), suiteID...)
+	b = append(b, label...)
+	b = append(b, ikm...)
+	prk, _ := hkdf.Extract(sha256.New, b, salt) // never fails
+	return prk
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(l))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, info...)
+	out, _ := hkdf.Expand(sha256.New, prk, string(b), l) // l is always valid
+	return out
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/miekg/dns"
+	"gitlab.com/go-extension/http"
+
+	C "github.com/pmkol/mosdns-x/constant"
+	"github.com/pmkol/mosdns-x/pkg/dns_json"
+)
+
+// JSONUpstream queries servers that only have the json api
+// (application/dns-json), e.g. "https://dns.google/resolve".
+type JSONUpstream struct {
+	url       *url.URL
+	header    map[string]string
+	transport *http.Transport
+}
+
+// NewJSONUpstream creates a JSONUpstream. header is the same as NewUpstream.
+func NewJSONUpstream(url *url.URL, transport *http.Transport, header map[string]string) *JSONUpstream {
+	return &JSONUpstream{url: url, header: header, transport: transport}
+}
+
+func (u *JSONUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	v, err := dns_json.EncodeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	reqURL := *u.url
+	query := reqURL.Query()
+	for k, s := range v {
+		query[k] = s
+	}
+	reqURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dns_json.ContentType)
+	req.Header.Set("User-Agent", fmt.Sprintf("mosdns-x/%s", C.Version))
+	for k, v := range u.header {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	res, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %v: %s", res.StatusCode, res.Status)
+	}
+
+	j := new(dns_json.Msg)
+	if err := json.NewDecoder(io.LimitReader(res.Body, 65535*4)).Decode(j); err != nil {
+		return nil, fmt.Errorf("invalid json response, %w", err)
+	}
+	return j.ToMsg(q)
+}
+
+func (u *JSONUpstream) Close() error {
+	u.transport.CloseIdleConnections()
+	return nil
+}
+
+func (u *JSONUpstream) CloseIdleConnections() {
+	u.transport.CloseIdleConnections()
+}
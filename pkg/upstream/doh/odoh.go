@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.com/go-extension/http"
+
+	C "github.com/pmkol/mosdns-x/constant"
+	"github.com/pmkol/mosdns-x/pkg/pool"
+)
+
+const (
+	odohContentType = "application/oblivious-dns-message"
+	odohConfigsPath = "/.well-known/odohconfigs"
+	odohVersion     = 0x0001
+	odohConfigTTL   = time.Hour
+
+	odohMsgQuery    = 0x01
+	odohMsgResponse = 0x02
+
+	// odohPaddingBlock pads queries to a multiple of 128 bytes, as RFC 8467
+	// suggests.
+	odohPaddingBlock = 128
+	odohMaxMsgSize   = 65535 + 1024 // dns msg + padding and encryption overhead
+)
+
+// odohConfig is a supported ObliviousDoHConfigContents of the target.
+type odohConfig struct {
+	suite hpkeSuite
+	pk    []byte
+	keyID []byte
+}
+
+// ODoHUpstream is an Oblivious DoH (RFC 9230) upstream. Queries are
+// encrypted to the target and relayed by the proxy, so the proxy doesn't
+// see queries and the target doesn't see who sent them.
+type ODoHUpstream struct {
+	target    *url.URL
+	proxy     *url.URL // maybe nil
+	header    map[string]string
+	transport *http.Transport
+
+	m      sync.Mutex
+	config *odohConfig
+	expire time.Time
+}
+
+// NewODoHUpstream creates an ODoHUpstream. target is the DoH url of the
+// target, e.g. "https://odoh.cloudflare-dns.com/dns-query". proxy is the
+// url of the proxy, e.g. "https://odoh-proxy.example/proxy". If proxy is
+// nil, queries are sent to the target directly, which are still encrypted
+// but the target sees the client address. header is the same as
+// NewUpstream, and is sent to the proxy.
+func NewODoHUpstream(target, proxy *url.URL, transport *http.Transport, header map[string]string) *ODoHUpstream {
+	return &ODoHUpstream{target: target, proxy: proxy, header: header, transport: transport}
+}
+
+func (u *ODoHUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wire, buf, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Release()
+	binary.BigEndian.PutUint16(wire, 0) // same as DoH
+
+	qPlain := odohPlaintext(wire, odohPaddingBlock)
+	enc, hctx, err := setupBaseS(c.suite, c.pk, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	ct := hctx.seal(odohAAD(odohMsgQuery, c.keyID), qPlain)
+	body := odohMessage(odohMsgQuery, c.keyID, append(enc, ct...))
+
+	b, err := u.post(ctx, body)
+	if err != nil {
+		if errors.Is(err, errODoHUnauthorized) {
+			// The target doesn't know the key id. Its keys were rotated.
+			u.invalidateConfig(c)
+		}
+		return nil, err
+	}
+	rPlain, err := openODoHResponse(hctx, c.suite, qPlain, b)
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(rPlain); err != nil {
+		return nil, err
+	}
+	r.Id = q.Id
+	return r, nil
+}
+
+func (u *ODoHUpstream) Close() error {
+	u.transport.CloseIdleConnections()
+	return nil
+}
+
+func (u *ODoHUpstream) CloseIdleConnections() {
+	u.transport.CloseIdleConnections()
+}
+
+var errODoHUnauthorized = errors.New("odoh target rejected the key id")
+
+// post sends the encrypted query to the proxy, or the target if there is
+// no proxy, and returns the encrypted response.
+func (u *ODoHUpstream) post(ctx context.Context, body []byte) ([]byte, error) {
+	reqURL := *u.target
+	if u.proxy != nil {
+		reqURL = *u.proxy
+		query := reqURL.Query()
+		query.Set("targethost", u.target.Host)
+		query.Set("targetpath", u.target.EscapedPath())
+		reqURL.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", odohContentType)
+	req.Header.Set("Accept", odohContentType)
+	req.Header.Set("User-Agent", fmt.Sprintf("mosdns-x/%s", C.Version))
+	for k, v := range u.header {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	res, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return nil, errODoHUnauthorized
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %v: %s", res.StatusCode, res.Status)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != odohContentType {
+		return nil, fmt.Errorf("unexpected content type: %s", contentType)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, odohMaxMsgSize))
+}
+
+// getConfig returns the cached config of the target, or fetches it if the
+// cache expired.
+func (u *ODoHUpstream) getConfig(ctx context.Context) (*odohConfig, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.config != nil && time.Now().Before(u.expire) {
+		return u.config, nil
+	}
+	c, err := u.fetchConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch odoh config, %w", err)
+	}
+	u.config = c
+	u.expire = time.Now().Add(odohConfigTTL)
+	return c, nil
+}
+
+func (u *ODoHUpstream) invalidateConfig(c *odohConfig) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.config == c {
+		u.expire = time.Time{}
+	}
+}
+
+func (u *ODoHUpstream) fetchConfig(ctx context.Context) (*odohConfig, error) {
+	configURL := url.URL{Scheme: u.target.Scheme, Host: u.target.Host, Path: odohConfigsPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("mosdns-x/%s", C.Version))
+	res, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v: %s", res.StatusCode, res.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, 65535+2))
+	if err != nil {
+		return nil, err
+	}
+	return parseODoHConfigs(b)
+}
+
+// parseODoHConfigs returns the first supported config in the
+// ObliviousDoHConfigs b.
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	configs, _, err := readU16Prefixed(b)
+	if err != nil {
+		return nil, err
+	}
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("truncated odoh config")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		var contents []byte
+		contents, configs, err = readU16Prefixed(configs[2:])
+		if err != nil {
+			return nil, err
+		}
+		if version != odohVersion || len(contents) < 6 {
+			continue
+		}
+		s := hpkeSuite{
+			kem:  binary.BigEndian.Uint16(contents[0:]),
+			kdf:  binary.BigEndian.Uint16(contents[2:]),
+			aead: binary.BigEndian.Uint16(contents[4:]),
+		}
+		pk, _, err := readU16Prefixed(contents[6:])
+		if err != nil || !s.supported() || len(pk) != x25519KeyLen {
+			continue
+		}
+		prk, _ := hkdf.Extract(sha256.New, contents, nil)
+		keyID, _ := hkdf.Expand(sha256.New, prk, "odoh key id", hpkeHashLen)
+		return &odohConfig{suite: s, pk: pk, keyID: keyID}, nil
+	}
+	return nil, errors.New("no supported odoh config")
+}
+
+// openODoHResponse decrypts the response b of the query qPlain.
+func openODoHResponse(hctx *hpkeContext, s hpkeSuite, qPlain, b []byte) ([]byte, error) {
+	if len(b) < 1 || b[0] != odohMsgResponse {
+		return nil, errors.New("invalid odoh response type")
+	}
+	nonce, rest, err := readU16Prefixed(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	ct, _, err := readU16Prefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != max(hpkeNonceLen, s.keyLen()) {
+		return nil, fmt.Errorf("invalid odoh response nonce length %d", len(nonce))
+	}
+
+	secret := hctx.export([]byte("odoh response"), s.keyLen())
+	salt := append(append([]byte(nil), qPlain...), odohU16Prefixed(nonce)...)
+	prk, _ := hkdf.Extract(sha256.New, secret, salt)
+	key, _ := hkdf.Expand(sha256.New, prk, "odoh key", s.keyLen())
+	aeadNonce, _ := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNonceLen)
+	aead, err := s.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	p, err := aead.Open(nil, aeadNonce, ct, odohAAD(odohMsgResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt odoh response, %w", err)
+	}
+	msg, _, err := readU16Prefixed(p)
+	return msg, err
+}
+
+// odohPlaintext encodes ObliviousDoHMessagePlaintext with zero padding
+// to a multiple of block.
+func odohPlaintext(msg []byte, block int) []byte {
+	l := 4 + len(msg)
+	padding := (block - l%block) % block
+	b := make([]byte, 0, l+padding)
+	b = append(b, odohU16Prefixed(msg)...)
+	return append(b, odohU16Prefixed(make([]byte, padding))...)
+}
+
+func odohMessage(typ byte, keyID, encrypted []byte) []byte {
+	b := []byte{typ}
+	b = append(b, odohU16Prefixed(keyID)...)
+	return append(b, odohU16Prefixed(encrypted)...)
+}
+
+func odohAAD(typ byte, keyID []byte) []byte {
+	return append([]byte{typ}, odohU16Prefixed(keyID)...)
+}
+
+func odohU16Prefixed(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+func readU16Prefixed(b []byte) (f, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("odoh message is truncated")
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, errors.New("odoh message is truncated")
+	}
+	return b[2 : 2+l], b[2+l:], nil
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gitlab.com/go-extension/http"
+)
+
+// fakeODoHTarget is an ODoH target that answers A queries with 1.2.3.4.
+// It also relays queries to itself as the proxy at "/proxy".
+type fakeODoHTarget struct {
+	suite   hpkeSuite
+	sk      atomic.Pointer[ecdh.PrivateKey]
+	proxied atomic.Int32
+}
+
+func (s *fakeODoHTarget) configContents() []byte {
+	b := binary.BigEndian.AppendUint16(nil, s.suite.kem)
+	b = binary.BigEndian.AppendUint16(b, s.suite.kdf)
+	b = binary.BigEndian.AppendUint16(b, s.suite.aead)
+	return append(b, odohU16Prefixed(s.sk.Load().PublicKey().Bytes())...)
+}
+
+func (s *fakeODoHTarget) ServeHTTP(w nethttp.ResponseWriter, req *nethttp.Request) {
+	switch req.URL.Path {
+	case odohConfigsPath:
+		// An unsupported config first.
+		unsupported := binary.BigEndian.AppendUint16(nil, 0x0002)
+		unsupported = append(unsupported, odohU16Prefixed([]byte{1, 2, 3})...)
+		supported := binary.BigEndian.AppendUint16(nil, odohVersion)
+		supported = append(supported, odohU16Prefixed(s.configContents())...)
+		w.Write(odohU16Prefixed(append(unsupported, supported...)))
+	case "/proxy":
+		if req.URL.Query().Get("targethost") == "" || req.URL.Query().Get("targetpath") != "/dns-query" {
+			w.WriteHeader(nethttp.StatusBadRequest)
+			return
+		}
+		s.proxied.Add(1)
+		s.serveQuery(w, req)
+	case "/dns-query":
+		s.serveQuery(w, req)
+	default:
+		w.WriteHeader(nethttp.StatusNotFound)
+	}
+}
+
+func (s *fakeODoHTarget) serveQuery(w nethttp.ResponseWriter, req *nethttp.Request) {
+	b, _ := io.ReadAll(req.Body)
+	if len(b) < 1 || b[0] != odohMsgQuery {
+		w.WriteHeader(nethttp.StatusBadRequest)
+		return
+	}
+	keyID, rest, _ := readU16Prefixed(b[1:])
+	encrypted, _, _ := readU16Prefixed(rest)
+	prk, _ := hkdf.Extract(sha256.New, s.configContents(), nil)
+	wantKeyID, _ := hkdf.Expand(sha256.New, prk, "odoh key id", hpkeHashLen)
+	if !bytes.Equal(keyID, wantKeyID) {
+		w.WriteHeader(nethttp.StatusUnauthorized)
+		return
+	}
+
+	// setupBaseR
+	sk := s.sk.Load()
+	enc, ct := encrypted[:x25519KeyLen], encrypted[x25519KeyLen:]
+	pkE, _ := ecdh.X25519().NewPublicKey(enc)
+	dh, _ := sk.ECDH(pkE)
+	hctx, _ := s.suite.keySchedule(kemSharedSecret(dh, enc, sk.PublicKey().Bytes()), []byte("odoh query"))
+	qPlain, err := hctx.aead.Open(nil, hctx.baseNonce, ct, odohAAD(odohMsgQuery, keyID))
+	if err != nil {
+		w.WriteHeader(nethttp.StatusBadRequest)
+		return
+	}
+	if len(qPlain)%odohPaddingBlock != 0 {
+		w.WriteHeader(nethttp.StatusBadRequest)
+		return
+	}
+	wire, _, _ := readU16Prefixed(qPlain)
+	q := new(dns.Msg)
+	if err := q.Unpack(wire); err != nil || q.Id != 0 {
+		w.WriteHeader(nethttp.StatusBadRequest)
+		return
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{1, 2, 3, 4},
+	}}
+	rWire, _ := r.Pack()
+
+	nonce := make([]byte, max(hpkeNonceLen, s.suite.keyLen()))
+	rand.Read(nonce)
+	secret := hctx.export([]byte("odoh response"), s.suite.keyLen())
+	prk, _ = hkdf.Extract(sha256.New, secret, append(qPlain, odohU16Prefixed(nonce)...))
+	key, _ := hkdf.Expand(sha256.New, prk, "odoh key", s.suite.keyLen())
+	aeadNonce, _ := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNonceLen)
+	aead, _ := s.suite.newAEAD(key)
+	rct := aead.Seal(nil, aeadNonce, odohPlaintext(rWire, 1), odohAAD(odohMsgResponse, nonce))
+
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(odohMessage(odohMsgResponse, nonce, rct))
+}
+
+func (s *fakeODoHTarget) rotate() {
+	sk, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	s.sk.Store(sk)
+}
+
+func TestODoHUpstream(t *testing.T) {
+	for _, aeadID := range []uint16{aeadAES128GCM, aeadChaCha20Poly1305} {
+		s := &fakeODoHTarget{suite: hpkeSuite{kem: kemX25519HKDFSHA256, kdf: kdfHKDFSHA256, aead: aeadID}}
+		s.rotate()
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		target, _ := url.Parse(srv.URL + "/dns-query")
+		proxy, _ := url.Parse(srv.URL + "/proxy")
+
+		for _, proxy := range []*url.URL{nil, proxy} {
+			u := NewODoHUpstream(target, proxy, &http.Transport{}, nil)
+			exchange := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				defer cancel()
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				r, err := u.ExchangeContext(ctx, q)
+				if err != nil {
+					return err
+				}
+				if r.Id != q.Id || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+					t.Fatalf("unexpected response %s", r)
+				}
+				return nil
+			}
+			if err := exchange(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The target rotates its key, the first query fails and the
+			// config is fetched again.
+			s.rotate()
+			if err := exchange(); err == nil {
+				t.Fatal("query with the old key should fail")
+			}
+			if err := exchange(); err != nil {
+				t.Fatal(err)
+			}
+			u.Close()
+		}
+		if s.proxied.Load() != 3 {
+			t.Fatalf("%d queries were proxied, want 3", s.proxied.Load())
+		}
+	}
+}
+
+func Test_parseODoHConfigs(t *testing.T) {
+	if _, err := parseODoHConfigs(odohU16Prefixed(nil)); err == nil {
+		t.Fatal("empty configs should fail")
+	}
+	if _, err := parseODoHConfigs([]byte{0, 10, 0, 1}); err == nil {
+		t.Fatal("truncated configs should fail")
+	}
+}
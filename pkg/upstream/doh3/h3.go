@@ -40,11 +40,14 @@ var bufPool = pool.NewBytesBufPool(65535)
 
 type Upstream struct {
 	url       *url.URL
+	header    map[string]string
 	transport *http3.Transport
 }
 
-func NewUpstream(url *url.URL, transport *http3.Transport) *Upstream {
-	return &Upstream{url, transport}
+// NewUpstream creates a DoH upstream. header will be added to every
+// request. A "Host" key overwrites the request host.
+func NewUpstream(url *url.URL, transport *http3.Transport, header map[string]string) *Upstream {
+	return &Upstream{url: url, header: header, transport: transport}
 }
 
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
@@ -61,6 +64,13 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	req.Header.Set("Content-Type", dnsContentType)
 	req.Header.Set("Accept", dnsContentType)
 	req.Header.Set("User-Agent", fmt.Sprintf("mosdns-x/%s", C.Version))
+	for k, v := range u.header {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
 	res, err := u.transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
@@ -91,6 +101,10 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	return r, nil
 }
 
+func (u *Upstream) CloseIdleConnections() {
+	u.transport.CloseIdleConnections()
+}
+
 func (u *Upstream) Close() error {
 	u.transport.CloseIdleConnections()
 	return u.transport.Close()
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	h3RetryInterval = time.Minute * 5
+	h3ProbeTimeout  = time.Second * 5
+)
+
+// h3WithFallback sends queries over HTTP/3. If HTTP/3 fails, e.g. UDP/443
+// is blocked, queries are sent over HTTP/2 and HTTP/3 is probed every
+// h3RetryInterval until it works again.
+type h3WithFallback struct {
+	h3     Upstream
+	h2     Upstream
+	logger *zap.Logger
+
+	fallback  atomic.Bool
+	lastProbe atomic.Int64 // unix nano
+	probing   atomic.Bool
+}
+
+func newH3WithFallback(h3, h2 Upstream, logger *zap.Logger) *h3WithFallback {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &h3WithFallback{h3: h3, h2: h2, logger: logger}
+}
+
+func (u *h3WithFallback) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.fallback.Load() {
+		u.tryProbe()
+		return u.h2.ExchangeContext(ctx, q)
+	}
+	r, err := u.h3.ExchangeContext(ctx, q)
+	if err == nil {
+		return r, nil
+	}
+	// The query was canceled or timed out, not an http3 failure.
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	if u.fallback.CompareAndSwap(false, true) {
+		u.lastProbe.Store(time.Now().UnixNano())
+		u.logger.Warn("http3 failed, falling back to http2", zap.Error(err))
+	}
+	return u.h2.ExchangeContext(ctx, q)
+}
+
+// tryProbe starts a probe in the background if the last one was
+// h3RetryInterval ago.
+func (u *h3WithFallback) tryProbe() {
+	last := u.lastProbe.Load()
+	if time.Since(time.Unix(0, last)) < h3RetryInterval || !u.probing.CompareAndSwap(false, true) {
+		return
+	}
+	u.lastProbe.Store(time.Now().UnixNano())
+	go func() {
+		defer u.probing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), h3ProbeTimeout)
+		defer cancel()
+		q := new(dns.Msg)
+		q.SetQuestion(".", dns.TypeNS)
+		if _, err := u.h3.ExchangeContext(ctx, q); err != nil {
+			u.logger.Debug("http3 probe failed", zap.Error(err))
+			return
+		}
+		u.fallback.Store(false)
+		u.logger.Info("http3 recovered")
+	}()
+}
+
+func (u *h3WithFallback) CloseIdleConnections() {
+	for _, x := range [...]Upstream{u.h3, u.h2} {
+		if c, ok := x.(IdleConnCloser); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+func (u *h3WithFallback) Close() error {
+	u.h3.Close()
+	u.h2.Close()
+	return nil
+}
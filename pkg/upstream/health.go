@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultFailureThreshold   = 3
+	defaultHealthCheckPeriod  = time.Second * 30
+	defaultHealthCheckTimeout = time.Second * 5
+)
+
+// Health tracks the health of an upstream by the results of its
+// exchanges. An upstream is unhealthy after some consecutive failures,
+// and is healthy again after a success. It's safe for concurrent use.
+type Health struct {
+	threshold int
+
+	m       sync.Mutex
+	fails   int           // consecutive failures
+	latency time.Duration // moving average of successful exchanges
+
+	onChange atomic.Pointer[func(healthy bool)]
+}
+
+// NewHealth creates a Health. failureThreshold is the number of
+// consecutive failures that make the upstream unhealthy. Default is 3.
+func NewHealth(failureThreshold int) *Health {
+	if failureThreshold <= 0 {
+		failureThreshold = defaultFailureThreshold
+	}
+	return &Health{threshold: failureThreshold}
+}
+
+// Observe records the result of an exchange that took d.
+func (h *Health) Observe(d time.Duration, err error) {
+	h.m.Lock()
+	wasHealthy := h.fails < h.threshold
+	if err != nil {
+		h.fails++
+	} else {
+		h.fails = 0
+		if h.latency == 0 {
+			h.latency = d
+		} else {
+			h.latency = (h.latency*7 + d) / 8
+		}
+	}
+	healthy := h.fails < h.threshold
+	h.m.Unlock()
+
+	if healthy != wasHealthy {
+		if f := h.onChange.Load(); f != nil {
+			(*f)(healthy)
+		}
+	}
+}
+
+// SetOnChange sets f to be called when Observe makes the upstream
+// healthy or unhealthy.
+func (h *Health) SetOnChange(f func(healthy bool)) {
+	h.onChange.Store(&f)
+}
+
+// Set replaces the state, e.g. with the state of the same upstream on
+// another node. It does not call the func of SetOnChange.
+func (h *Health) Set(fails int, latency time.Duration) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.fails = max(fails, 0)
+	h.latency = max(latency, 0)
+}
+
+func (h *Health) Healthy() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.fails < h.threshold
+}
+
+// Failures returns the number of consecutive failures.
+func (h *Health) Failures() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.fails
+}
+
+// Latency returns the moving average latency. It's zero if there was no
+// successful exchange.
+func (h *Health) Latency() time.Duration {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.latency
+}
+
+// HealthCheckOpts configures active health checks.
+type HealthCheckOpts struct {
+	// Interval between probes. Default is 30s.
+	Interval time.Duration
+	// Timeout of a probe. Default is 5s.
+	Timeout time.Duration
+	// Query is the probe query. Default is "." NS.
+	Query *dns.Msg
+}
+
+func (opts *HealthCheckOpts) init() {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultHealthCheckPeriod
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultHealthCheckTimeout
+	}
+	if opts.Query == nil {
+		opts.Query = new(dns.Msg)
+		opts.Query.SetQuestion(".", dns.TypeNS)
+	}
+}
+
+// CheckHealth sends a probe query with exchange every opts.Interval,
+// and records the results in h, until closeSignal is closed. So
+// unhealthy upstreams that no longer get queries can recover. Any
+// response is a success, upstreams that answer SERVFAIL are alive.
+func CheckHealth(exchange func(ctx context.Context, q *dns.Msg) (*dns.Msg, error), h *Health, opts HealthCheckOpts, closeSignal <-chan struct{}) {
+	opts.init()
+	t := time.NewTicker(opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+			start := time.Now()
+			_, err := exchange(ctx, opts.Query.Copy())
+			cancel()
+			h.Observe(time.Since(start), err)
+		case <-closeSignal:
+			return
+		}
+	}
+}
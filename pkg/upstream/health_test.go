@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth(2)
+	var changes []bool
+	h.SetOnChange(func(healthy bool) { changes = append(changes, healthy) })
+	errFailed := errors.New("failed")
+	steps := []struct {
+		d           time.Duration
+		err         error
+		wantHealthy bool
+		wantLatency time.Duration
+	}{
+		{d: time.Millisecond * 80, wantHealthy: true, wantLatency: time.Millisecond * 80},
+		{d: time.Millisecond * 160, wantHealthy: true, wantLatency: time.Millisecond * 90},
+		{err: errFailed, wantHealthy: true, wantLatency: time.Millisecond * 90},
+		{err: errFailed, wantHealthy: false, wantLatency: time.Millisecond * 90},
+		{err: errFailed, wantHealthy: false, wantLatency: time.Millisecond * 90},
+		{d: time.Millisecond * 90, wantHealthy: true, wantLatency: time.Millisecond * 90},
+	}
+	for i, s := range steps {
+		h.Observe(s.d, s.err)
+		if h.Healthy() != s.wantHealthy || h.Latency() != s.wantLatency {
+			t.Fatalf("step %d: healthy %v latency %s, want %v %s", i, h.Healthy(), h.Latency(), s.wantHealthy, s.wantLatency)
+		}
+	}
+	if len(changes) != 2 || changes[0] || !changes[1] {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+
+	h.Set(5, time.Millisecond*30)
+	if h.Healthy() || h.Failures() != 5 || h.Latency() != time.Millisecond*30 || len(changes) != 2 {
+		t.Fatal("Set did not replace the state")
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	var probes atomic.Int32
+	exchange := func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		probes.Add(1)
+		if q.Question[0].Name != "." || q.Question[0].Qtype != dns.TypeNS {
+			t.Errorf("unexpected probe %v", q.Question[0])
+		}
+		if down.Load() {
+			return nil, errors.New("down")
+		}
+		return new(dns.Msg).SetReply(q), nil
+	}
+
+	h := NewHealth(1)
+	closeSignal := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		CheckHealth(exchange, h, HealthCheckOpts{Interval: time.Millisecond * 10}, closeSignal)
+		close(done)
+	}()
+	waitFor := func(healthy bool) {
+		for i := 0; i < 100; i++ {
+			if h.Healthy() == healthy {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("want healthy %v", healthy)
+	}
+	waitFor(false)
+	down.Store(false)
+	waitFor(true)
+	close(closeSignal)
+	<-done
+}
@@ -22,7 +22,9 @@ package quic
 import (
 	"context"
 	"errors"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -38,19 +40,43 @@ func (e *closedConnError) Error() string {
 	return "connection is closed"
 }
 
+// DoQ error codes, see RFC 9250 section 4.3.
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqRequestCancelled = 0x3
+)
+
 type Conn struct {
 	conn       *quic.Conn
 	closed     chan struct{}
 	handshaked chan struct{}
 	sync.RWMutex
+
+	// transports and their sockets are closed with the connection.
+	// quic-go doesn't close them because they were not created by it.
+	transports []*quic.Transport
 }
 
-func NewConn(conn *quic.Conn) *Conn {
+// NewConn wraps conn, which was dialed by tr. tr must not be a single
+// use transport, e.g. the one created by quic.DialEarly, which uses zero
+// length connection IDs and can't be migrated.
+func NewConn(conn *quic.Conn, tr *quic.Transport) *Conn {
 	c := &Conn{
 		conn:       conn,
 		closed:     make(chan struct{}),
 		handshaked: make(chan struct{}),
+		transports: []*quic.Transport{tr},
 	}
+	go func() {
+		<-conn.Context().Done()
+		c.Lock()
+		defer c.Unlock()
+		for _, tr := range c.transports {
+			closeTransport(tr)
+		}
+		c.transports = nil
+	}()
 	go func() {
 		select {
 		case <-c.closed:
@@ -99,6 +125,43 @@ func (c *Conn) closeWithError(code quic.ApplicationErrorCode, desc string) error
 	return c.conn.CloseWithError(code, desc)
 }
 
+// migrate moves c to a new socket pc, e.g. after the network changed.
+// pc is owned by c if migrate succeeds. The old path is closed with c.
+func (c *Conn) migrate(ctx context.Context, pc net.PacketConn) error {
+	c.RLock()
+	conn := c.conn
+	c.RUnlock()
+	tr := &quic.Transport{Conn: pc}
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		return err
+	}
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		tr.Close()
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		tr.Close()
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.transports == nil { // closed
+		closeTransport(tr)
+		return net.ErrClosed
+	}
+	c.transports = append(c.transports, tr)
+	return nil
+}
+
+func closeTransport(tr *quic.Transport) {
+	tr.Close()
+	tr.Conn.Close()
+}
+
 func (c *Conn) openStreamSync(ctx context.Context) (*quic.Stream, error) {
 	c.RLock()
 	conn := c.conn
@@ -107,14 +170,18 @@ func (c *Conn) openStreamSync(ctx context.Context) (*quic.Stream, error) {
 }
 
 type Upstream struct {
-	conn     *Conn
-	dialFunc func(ctx context.Context) (*Conn, error)
+	conn           *Conn
+	dialFunc       func(ctx context.Context) (*Conn, error)
+	dialPacketConn func(ctx context.Context) (net.PacketConn, error) // maybe nil
 	sync.RWMutex
 }
 
-func NewQUICUpstream(addr string, dialFunc func(ctx context.Context) (*Conn, error)) *Upstream {
+// NewQUICUpstream creates a DoQ upstream. dialPacketConn opens new sockets
+// for connection migration. It can be nil if migration is not supported.
+func NewQUICUpstream(addr string, dialFunc func(ctx context.Context) (*Conn, error), dialPacketConn func(ctx context.Context) (net.PacketConn, error)) *Upstream {
 	return &Upstream{
-		dialFunc: dialFunc,
+		dialFunc:       dialFunc,
+		dialPacketConn: dialPacketConn,
 	}
 }
 
@@ -144,13 +211,51 @@ func (h *Upstream) Close() error {
 	defer h.Unlock()
 	conn := h.conn
 	if conn != nil {
-		go conn.closeWithError(0, "")
+		go conn.closeWithError(doqNoError, "")
+	}
+	return nil
+}
+
+// CloseIdleConnections closes the current connection. A new one is
+// dialed by the next query.
+func (h *Upstream) CloseIdleConnections() {
+	h.Lock()
+	defer h.Unlock()
+	if conn := h.conn; conn != nil {
+		h.conn = nil
+		go conn.closeWithError(doqNoError, "")
+	}
+}
+
+// Migrate moves the current connection to a new socket, so it survives
+// network changes without a new handshake. It fails if the server
+// disabled active migration, then the caller should close the connection.
+func (h *Upstream) Migrate(ctx context.Context) error {
+	h.RLock()
+	conn := h.conn
+	h.RUnlock()
+	if conn == nil || !conn.isActive() {
+		return nil
+	}
+	if h.dialPacketConn == nil {
+		return errors.New("migration is not supported")
+	}
+	pc, err := h.dialPacketConn(ctx)
+	if err != nil {
+		return err
+	}
+	if err := conn.migrate(ctx, pc); err != nil {
+		pc.Close()
+		return err
 	}
 	return nil
 }
 
 func (h *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	// The DNS Message ID must be 0 in DoQ.
+	id := q.Id
 	q.Id = 0
+	defer func() { q.Id = id }()
 	var err error
 	for range 3 {
 		var conn *Conn
@@ -161,7 +266,11 @@ func (h *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 		var resp *dns.Msg
 		resp, err = exchangeMsg(ctx, conn, q)
 		if err == nil {
-			return resp, err
+			resp.Id = id
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
 		}
 	}
 	return nil, err
@@ -185,17 +294,31 @@ func exchange(ctx context.Context, conn *Conn, q *dns.Msg) (*dns.Msg, error) {
 	if err != nil {
 		return nil, err
 	}
+	if ddl, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(ddl)
+	}
+	// Unblock reads and writes if ctx is canceled.
+	stop := context.AfterFunc(ctx, func() { stream.SetDeadline(time.Now()) })
+	defer stop()
+
 	_, err = dnsutils.WriteMsgToTCP(stream, q)
 	if err != nil {
-		stream.CancelRead(1)
-		stream.CancelWrite(1)
+		stream.CancelRead(cancelCode(ctx))
+		stream.CancelWrite(cancelCode(ctx))
 		return nil, err
 	}
 	stream.Close()
 	r, _, err := dnsutils.ReadMsgFromTCP(stream)
 	if err != nil {
-		stream.CancelRead(1)
+		stream.CancelRead(cancelCode(ctx))
 		return nil, err
 	}
 	return r, nil
 }
+
+func cancelCode(ctx context.Context) quic.StreamErrorCode {
+	if ctx.Err() != nil {
+		return doqRequestCancelled
+	}
+	return doqInternalError
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	eTLS "gitlab.com/go-extension/tls"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	svcbMinTTL        = time.Minute
+	svcbMaxTTL        = time.Hour * 24
+	svcbNegativeTTL   = time.Hour
+	svcbRetryInterval = time.Minute
+	svcbLookupTimeout = time.Second * 5
+)
+
+// SVCBParams are the connection parameters that an encrypted server
+// advertises in its SVCB (RFC 9461) or HTTPS (RFC 9460) records. A
+// zero SVCBParams means the server has no applicable record.
+type SVCBParams struct {
+	ALPN   []string  `json:"alpn,omitempty"`
+	Port   uint16    `json:"port,omitempty"`
+	ECH    []byte    `json:"ech,omitempty"`
+	Expire time.Time `json:"expire"`
+}
+
+// SVCBStore persists SVCBParams, so they are used right after restarts.
+type SVCBStore interface {
+	Load(key string) (*SVCBParams, bool)
+	Store(key string, p *SVCBParams) error
+}
+
+// svcbPinner looks up and caches the SVCBParams of an upstream. It never
+// blocks dialing, connections use the defaults until the params are
+// known. A nil *svcbPinner is valid and does nothing.
+type svcbPinner struct {
+	key     string // "name type" in the store
+	name    string
+	qtype   uint16
+	alpn    string // protocol of the upstream
+	host    string // fqdn of the server
+	usePort bool   // the address has no explicit port
+	ex      bootstrap.Exchanger
+	store   SVCBStore // maybe nil
+	logger  *zap.Logger
+
+	m           sync.Mutex
+	p           *SVCBParams // nil if unknown
+	noECH       bool        // ech failed, disabled until the next refresh
+	nextRefresh time.Time
+	refreshing  bool
+}
+
+// newSVCBPinner returns a pinner for the upstream u of protocol alpn.
+// It returns nil if opt.SVCB is false or the host is an ip.
+func newSVCBPinner(opt *Opt, alpn string, u *url.URL) (*svcbPinner, error) {
+	if !opt.SVCB {
+		return nil, nil
+	}
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil, nil
+	}
+	ex, err := bootstrap.NewExchanger(opt.Bootstrap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap, %w", err)
+	}
+	s := &svcbPinner{
+		host:    dns.Fqdn(strings.ToLower(host)),
+		alpn:    alpn,
+		usePort: len(u.Port()) == 0 && len(opt.DialAddr) == 0,
+		ex:      ex,
+		store:   opt.SVCBStore,
+		logger:  opt.Logger,
+	}
+	if s.logger == nil {
+		s.logger = zap.NewNop()
+	}
+	switch alpn {
+	case "h2", "h3":
+		s.name, s.qtype = s.host, dns.TypeHTTPS
+	default:
+		s.name, s.qtype = "_dns."+s.host, dns.TypeSVCB
+	}
+	s.key = s.name + " " + dns.TypeToString[s.qtype]
+	if s.store != nil {
+		if p, ok := s.store.Load(s.key); ok {
+			s.p = p
+			s.nextRefresh = p.Expire
+		}
+	}
+	return s, nil
+}
+
+// params returns the cached params, maybe nil, and refreshes them in
+// the background if they are expired.
+func (s *svcbPinner) params() *SVCBParams {
+	if s == nil {
+		return nil
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.refreshing && time.Now().After(s.nextRefresh) {
+		s.refreshing = true
+		go s.refresh()
+	}
+	return s.p
+}
+
+func (s *svcbPinner) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), svcbLookupTimeout)
+	defer cancel()
+	p, err := s.lookup(ctx)
+
+	s.m.Lock()
+	s.refreshing = false
+	if err != nil {
+		s.nextRefresh = time.Now().Add(svcbRetryInterval)
+		s.m.Unlock()
+		s.logger.Debug("failed to lookup svcb params", zap.String("name", s.name), zap.Error(err))
+		return
+	}
+	s.p = p
+	s.noECH = false
+	s.nextRefresh = p.Expire
+	s.m.Unlock()
+
+	if s.store != nil {
+		if err := s.store.Store(s.key, p); err != nil {
+			s.logger.Warn("failed to save svcb params", zap.Error(err))
+		}
+	}
+}
+
+func (s *svcbPinner) lookup(ctx context.Context) (*SVCBParams, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(s.name, s.qtype)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	r, err := s.ex.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("svcb lookup of %s failed, %s", s.name, dns.RcodeToString[r.Rcode])
+	}
+	p, ttl := s.parse(r.Answer)
+	p.Expire = time.Now().Add(ttl)
+	return p, nil
+}
+
+// parse returns the params of the first ServiceMode record of the same
+// host that supports the protocol.
+func (s *svcbPinner) parse(answer []dns.RR) (*SVCBParams, time.Duration) {
+	var rrs []*dns.SVCB
+	ttl := svcbMaxTTL
+	for _, rr := range answer {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+		ttl = min(ttl, time.Duration(svcb.Hdr.Ttl)*time.Second)
+		// AliasMode records point to other hosts, whose params can't
+		// be used with this host.
+		if svcb.Priority == 0 {
+			continue
+		}
+		if target := strings.ToLower(svcb.Target); target != "." && target != s.host {
+			continue
+		}
+		rrs = append(rrs, svcb)
+	}
+	slices.SortStableFunc(rrs, func(a, b *dns.SVCB) int { return cmp.Compare(a.Priority, b.Priority) })
+	for _, rr := range rrs {
+		p := new(SVCBParams)
+		for _, kv := range rr.Value {
+			switch kv := kv.(type) {
+			case *dns.SVCBAlpn:
+				p.ALPN = kv.Alpn
+			case *dns.SVCBPort:
+				p.Port = kv.Port
+			case *dns.SVCBECHConfig:
+				p.ECH = kv.ECH
+			}
+		}
+		if len(p.ALPN) > 0 && !slices.Contains(p.ALPN, s.alpn) {
+			continue
+		}
+		return p, max(ttl, svcbMinTTL)
+	}
+	return new(SVCBParams), svcbNegativeTTL
+}
+
+// dialAddr replaces the port of addr with the advertised one, unless
+// the upstream has an explicit port.
+func (s *svcbPinner) dialAddr(addr string) string {
+	if s == nil || !s.usePort {
+		return addr
+	}
+	p := s.params()
+	if p == nil || p.Port == 0 {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.Port)))
+}
+
+// eTLSConfig returns a copy of c with the advertised ech config, or c
+// if there is no ech config.
+func (s *svcbPinner) eTLSConfig(c *eTLS.Config) *eTLS.Config {
+	if s == nil || (c.MaxVersion != 0 && c.MaxVersion < eTLS.VersionTLS13) {
+		return c
+	}
+	p := s.params()
+	s.m.Lock()
+	noECH := s.noECH
+	s.m.Unlock()
+	if p == nil || len(p.ECH) == 0 || noECH {
+		return c
+	}
+	c = c.Clone()
+	c.EncryptedClientHelloConfigList = p.ECH
+	return c
+}
+
+// handshakeFailed handles ech failures of a handshake with c. If the
+// server rejected ech with new configs, they are used. Other tls errors
+// disable ech until the next refresh. Network errors are ignored.
+func (s *svcbPinner) handshakeFailed(c *eTLS.Config, err error) {
+	if s == nil || len(c.EncryptedClientHelloConfigList) == 0 {
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	var rejection *eTLS.ECHRejectionError
+	if errors.As(err, &rejection) && len(rejection.RetryConfigList) > 0 && s.p != nil {
+		p := *s.p
+		p.ECH = rejection.RetryConfigList
+		s.p = &p
+		return
+	}
+	s.noECH = true
+	s.logger.Debug("ech disabled", zap.String("name", s.name), zap.Error(err))
+}
+
+// SVCBFileStore is a SVCBStore that saves params in a json file.
+type SVCBFileStore struct {
+	file string
+
+	m  sync.Mutex
+	ps map[string]*SVCBParams
+}
+
+// NewSVCBFileStore loads params from file. A missing file is not an
+// error.
+func NewSVCBFileStore(file string) (*SVCBFileStore, error) {
+	s := &SVCBFileStore{file: file, ps: make(map[string]*SVCBParams)}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.ps); err != nil {
+		return nil, fmt.Errorf("invalid svcb params file, %w", err)
+	}
+	return s, nil
+}
+
+func (s *SVCBFileStore) Load(key string) (*SVCBParams, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.ps[key]
+	return p, ok
+}
+
+// Store saves p and writes the file atomically.
+func (s *SVCBFileStore) Store(key string, p *SVCBParams) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ps[key] = p
+	b, err := json.Marshal(s.ps)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.file, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
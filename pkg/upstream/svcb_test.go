@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	eTLS "gitlab.com/go-extension/tls"
+)
+
+type exchangerFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+func (f exchangerFunc) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, q)
+}
+
+func Test_svcbPinner(t *testing.T) {
+	store, err := NewSVCBFileStore(filepath.Join(t.TempDir(), "svcb.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("tls://dns.example")
+	pin, err := newSVCBPinner(&Opt{SVCB: true, SVCBStore: store}, "dot", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ech := []byte{1, 2, 3}
+	queried := make(chan struct{}, 1)
+	pin.ex = exchangerFunc(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		if q.Question[0].Name != "_dns.dns.example." || q.Question[0].Qtype != dns.TypeSVCB {
+			t.Errorf("unexpected query %v", q.Question[0])
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: 300}
+		r.Answer = []dns.RR{
+			// Another host, ignored.
+			&dns.SVCB{Hdr: hdr, Priority: 1, Target: "other.example.", Value: []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: []string{"dot"}}}},
+			// Another protocol, ignored.
+			&dns.SVCB{Hdr: hdr, Priority: 2, Target: "dns.example.", Value: []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: []string{"h2"}}, &dns.SVCBPort{Port: 443}}},
+			&dns.SVCB{Hdr: hdr, Priority: 3, Target: "dns.example.", Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"dot", "doq"}}, &dns.SVCBPort{Port: 8853}, &dns.SVCBECHConfig{ECH: ech},
+			}},
+		}
+		queried <- struct{}{}
+		return r, nil
+	})
+
+	// Params are unknown yet, defaults are used.
+	if addr := pin.dialAddr("dns.example:853"); addr != "dns.example:853" {
+		t.Fatalf("unexpected addr %s", addr)
+	}
+	<-queried
+	deadline := time.Now().Add(time.Second)
+	for pin.params().Port == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("params are not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if addr := pin.dialAddr("dns.example:853"); addr != "dns.example:8853" {
+		t.Fatalf("unexpected addr %s", addr)
+	}
+	c := pin.eTLSConfig(new(eTLS.Config))
+	if !bytes.Equal(c.EncryptedClientHelloConfigList, ech) {
+		t.Fatal("ech config is not used")
+	}
+
+	// A tls error disables ech.
+	pin.handshakeFailed(c, eTLS.AlertError(40))
+	if c := pin.eTLSConfig(new(eTLS.Config)); len(c.EncryptedClientHelloConfigList) != 0 {
+		t.Fatal("ech should be disabled")
+	}
+
+	// Params are persisted and loaded by new pinners.
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, ok := store.Load("_dns.dns.example. SVCB"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("params are not persisted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store2, err := NewSVCBFileStore(store.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin2, err := newSVCBPinner(&Opt{SVCB: true, SVCBStore: store2}, "dot", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := pin2.p; p == nil || p.Port != 8853 || !bytes.Equal(p.ECH, ech) {
+		t.Fatalf("unexpected loaded params %+v", p)
+	}
+
+	// Explicit ports are kept.
+	u, _ = url.Parse("tls://dns.example:853")
+	pin3, err := newSVCBPinner(&Opt{SVCB: true, SVCBStore: store2}, "dot", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := pin3.dialAddr("dns.example:853"); addr != "dns.example:853" {
+		t.Fatalf("unexpected addr %s", addr)
+	}
+}
+
+func Test_svcbPinner_noRecord(t *testing.T) {
+	u, _ := url.Parse("https://dns.example/dns-query")
+	pin, err := newSVCBPinner(&Opt{SVCB: true}, "h2", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ttl := pin.parse(nil)
+	if p.Port != 0 || len(p.ECH) != 0 || ttl != svcbNegativeTTL {
+		t.Fatalf("unexpected params %+v, ttl %s", p, ttl)
+	}
+
+	u, _ = url.Parse("https://1.1.1.1/dns-query")
+	if pin, _ := newSVCBPinner(&Opt{SVCB: true}, "h2", u); pin != nil {
+		t.Fatal("ip servers have no svcb records")
+	}
+}
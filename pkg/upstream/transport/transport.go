@@ -23,19 +23,23 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math/rand/v2"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 var (
 	errEOL             = errors.New("end of life")
 	errClosedTransport = errors.New("transport has been closed")
+	errIdleConnClosed  = errors.New("idle connection closed")
 
 	nopLogger = zap.NewNop()
 )
@@ -49,6 +53,10 @@ const (
 
 	writeTimeout        = time.Second
 	connTooOldThreshold = time.Millisecond * 500
+
+	// minKeepaliveIdleTimeout is the lower limit of idle timeouts from
+	// servers' edns-tcp-keepalive options.
+	minKeepaliveIdleTimeout = time.Second
 )
 
 // Opts for Transport,
@@ -90,6 +98,18 @@ type Opts struct {
 	// can handle. The connection will be closed if it reached the limit.
 	// Default is defaultMaxQueryPerConn.
 	MaxQueryPerConn uint16
+
+	// PacketConn indicates that connections from DialFunc are datagram
+	// connections, e.g. UDP. Pipelined queries use random query ids instead
+	// of sequential ones, and responses that are malformed or don't match
+	// their queries are dropped instead of aborting the connection.
+	PacketConn bool
+
+	// If Keepalive is set and IdleTimeout > 0, the Transport sends the
+	// edns-tcp-keepalive option (RFC 7828) with EDNS0 queries. If a server
+	// returns a shorter timeout than IdleTimeout, the connection will be
+	// idled for that timeout only. The option is removed from responses.
+	Keepalive bool
 }
 
 // init check and set defaults for this Opts.
@@ -132,8 +152,9 @@ type Transport struct {
 }
 
 type pipelineStatus struct {
-	wg     sync.WaitGroup
-	served int
+	wg       sync.WaitGroup
+	served   int
+	inflight int // protected by Transport.m
 }
 
 func (t *Transport) isClosed() bool {
@@ -152,6 +173,10 @@ func (t *Transport) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg,
 		return t.exchangeWithoutConnReuse(ctx, q)
 	}
 
+	if t.opts.Keepalive {
+		q = dnsutils.SetKeepalive(q, 0)
+	}
+
 	if t.opts.EnablePipeline {
 		return t.exchangeWithPipelineConn(ctx, q)
 	}
@@ -193,13 +218,13 @@ func (t *Transport) exchangeWithPipelineConn(ctx context.Context, m *dns.Msg) (*
 			t.opts.Logger.Debug("retrying pipeline connection", zap.NamedError("previous_err", latestErr), zap.Int("attempt", attempt))
 		}
 
-		conn, allocatedQid, isNewConn, wg, err := t.getPipelineConn()
+		conn, allocatedQid, isNewConn, status, err := t.getPipelineConn()
 		if err != nil {
 			return nil, err
 		}
 
 		r, err := conn.exchangePipeline(ctx, m, allocatedQid)
-		wg.Done()
+		t.releasePipelineConn(status)
 
 		if err != nil {
 			if !isNewConn && attempt <= maxRetry {
@@ -277,6 +302,27 @@ func (t *Transport) exchangeWithReusableConn(ctx context.Context, m *dns.Msg) (*
 	}
 }
 
+// CloseIdleConnections closes idle connections. Pipeline connections
+// are closed after their queries finished. The Transport is still usable
+// and will dial new connections.
+func (t *Transport) CloseIdleConnections() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for conn, status := range t.pipelineConns {
+		delete(t.pipelineConns, conn)
+		go func() {
+			status.wg.Wait()
+			conn.closeWithErr(errIdleConnClosed)
+		}()
+	}
+	for conn := range t.idledReusableConns {
+		conn.closeWithErr(errIdleConnClosed)
+		delete(t.reusableConns, conn)
+		delete(t.idledReusableConns, conn)
+	}
+}
+
 // getReusableConn returns a *dnsConn.
 // The caller must call releaseReusableConn to release the dnsConn.
 func (t *Transport) getReusableConn() (c *dnsConn, reused bool, err error) {
@@ -330,13 +376,13 @@ func (t *Transport) releaseReusableConn(c *dnsConn, err error) {
 	}
 }
 
-// getPipelineConn returns a dnsConn for pipelining queries.
-// Caller must call wg.Done() after dnsConn.exchangePipeline.
+// getPipelineConn returns the least busy dnsConn for pipelining queries.
+// Caller must call releasePipelineConn after dnsConn.exchangePipeline.
 func (t *Transport) getPipelineConn() (
 	conn *dnsConn,
 	allocatedQid uint16,
 	isNewConn bool,
-	wg *sync.WaitGroup,
+	connStatus *pipelineStatus,
 	err error,
 ) {
 	t.m.Lock()
@@ -347,20 +393,22 @@ func (t *Transport) getPipelineConn() (
 		return
 	}
 
-	// Try to get an existing connection.
-	var connStatus *pipelineStatus
+	// Try to get an existing connection. Queries are spread over
+	// connections, so a slow response only delays queries on its own
+	// connection.
 	for c, status := range t.pipelineConns {
 		if c.isClosed() || t.connTooOld(c) {
 			delete(t.pipelineConns, c)
 			continue
 		}
-		conn = c
-		connStatus = status
-		break
+		if conn == nil || status.inflight < connStatus.inflight {
+			conn = c
+			connStatus = status
+		}
 	}
 
-	// No conn available, create a new one.
-	if conn == nil || (conn.queueLen() > 0 && len(t.pipelineConns) < t.opts.MaxConns) {
+	// No conn available, or all of them are busy, create a new one.
+	if conn == nil || (connStatus.inflight > 0 && len(t.pipelineConns) < t.opts.MaxConns) {
 		conn = newDNSConn(t)
 		isNewConn = true
 		if t.pipelineConns == nil {
@@ -371,10 +419,11 @@ func (t *Transport) getPipelineConn() (
 	}
 
 	connStatus.served++
+	connStatus.inflight++
 	connStatus.wg.Add(1)
 	eol := connStatus.served >= int(t.opts.MaxQueryPerConn)
 	allocatedQid = uint16(connStatus.served)
-	wg = &connStatus.wg
+	wg := &connStatus.wg
 	if eol {
 		// This connection has served too many queries.
 		// Note: the connection should be closed only after all its queries finished.
@@ -390,6 +439,13 @@ func (t *Transport) getPipelineConn() (
 	return
 }
 
+func (t *Transport) releasePipelineConn(s *pipelineStatus) {
+	t.m.Lock()
+	s.inflight--
+	t.m.Unlock()
+	s.wg.Done()
+}
+
 // connTooOld returns true if c's last read time is close to
 // its idle deadline.
 func (t *Transport) connTooOld(c *dnsConn) bool {
@@ -397,7 +453,7 @@ func (t *Transport) connTooOld(c *dnsConn) bool {
 	if lrt.IsZero() {
 		return false
 	}
-	if tooOldTimeout := t.opts.IdleTimeout - connTooOldThreshold; tooOldTimeout > 0 {
+	if tooOldTimeout := c.getIdleTimeout() - connTooOldThreshold; tooOldTimeout > 0 {
 		tooOldDdl := lrt.Add(tooOldTimeout)
 		return time.Now().After(tooOldDdl)
 	}
@@ -417,8 +473,9 @@ type dnsConn struct {
 	closeNotify        chan struct{}
 	closeErr           error
 
-	statMu   sync.Mutex
-	lastRead time.Time
+	statMu      sync.Mutex
+	lastRead    time.Time
+	idleTimeout time.Duration
 }
 
 func newDNSConn(t *Transport) *dnsConn {
@@ -427,19 +484,20 @@ func newDNSConn(t *Transport) *dnsConn {
 		dialFinishedNotify: make(chan struct{}),
 		queue:              make(map[uint16]chan *dns.Msg),
 		closeNotify:        make(chan struct{}),
+		idleTimeout:        t.opts.IdleTimeout,
 	}
 	go dc.dialAndRead()
 	return dc
 }
 
 func (dc *dnsConn) exchangeConnReuse(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	return dc.exchange(ctx, q)
+	return dc.exchange(ctx, q, false)
 }
 
 func (dc *dnsConn) exchangePipeline(ctx context.Context, q *dns.Msg, allocatedQid uint16) (*dns.Msg, error) {
 	qSend := shadowCopy(q)
 	qSend.Id = allocatedQid
-	r, err := dc.exchange(ctx, qSend)
+	r, err := dc.exchange(ctx, qSend, dc.t.opts.PacketConn)
 	if err != nil {
 		return nil, err
 	}
@@ -447,7 +505,9 @@ func (dc *dnsConn) exchangePipeline(ctx context.Context, q *dns.Msg, allocatedQi
 	return r, nil
 }
 
-func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+// exchange sends q and waits for its response. If randomQid, q.Id will be
+// replaced by a random id that is not used by other queries of dc.
+func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg, randomQid bool) (*dns.Msg, error) {
 	select {
 	case <-dc.dialFinishedNotify:
 	case <-dc.closeNotify:
@@ -456,10 +516,13 @@ func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 		return nil, ctx.Err()
 	}
 
-	qid := q.Id
 	resChan := make(chan *dns.Msg, 1)
-	dc.addQueueC(qid, resChan)
-	defer dc.deleteQueueC(qid)
+	if randomQid {
+		q.Id = dc.addQueueCWithRandomQid(resChan)
+	} else {
+		dc.addQueueC(q.Id, resChan)
+	}
+	defer dc.deleteQueueC(q.Id)
 
 	dc.c.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := dc.t.opts.WriteFunc(dc.c, q)
@@ -469,14 +532,32 @@ func (dc *dnsConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case r := <-resChan:
-		return r, nil
-	case <-dc.closeNotify:
-		return nil, dc.closeErr
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-resChan:
+			if dc.t.opts.PacketConn && !questionMatch(q, r) {
+				continue // maybe spoofed
+			}
+			return r, nil
+		case <-dc.closeNotify:
+			return nil, dc.closeErr
+		}
+	}
+}
+
+func questionMatch(q, r *dns.Msg) bool {
+	if len(q.Question) != len(r.Question) {
+		return false
+	}
+	for i := range q.Question {
+		qq, rq := q.Question[i], r.Question[i]
+		if qq.Qtype != rq.Qtype || qq.Qclass != rq.Qclass || !strings.EqualFold(qq.Name, rq.Name) {
+			return false
+		}
 	}
+	return true
 }
 
 func (dc *dnsConn) dialAndRead() {
@@ -504,13 +585,24 @@ func (dc *dnsConn) dialAndRead() {
 
 func (dc *dnsConn) readLoop() {
 	for {
-		dc.c.SetReadDeadline(time.Now().Add(dc.t.opts.IdleTimeout))
-		r, _, err := dc.t.opts.ReadFunc(dc.c)
+		dc.c.SetReadDeadline(time.Now().Add(dc.getIdleTimeout()))
+		r, n, err := dc.t.opts.ReadFunc(dc.c)
 		if err != nil {
+			if dc.t.opts.PacketConn && n > 0 {
+				continue // A malformed packet. Drop it.
+			}
 			dc.closeWithErr(err) // abort this connection.
 			return
 		}
 		dc.updateReadTime()
+		if dc.t.opts.Keepalive {
+			if timeout, ok := dnsutils.GetKeepalive(r); ok {
+				if timeout > 0 {
+					dc.setIdleTimeout(timeout)
+				}
+				r = dnsutils.RemoveKeepalive(r)
+			}
+		}
 
 		resChan := dc.getQueueC(r.Id)
 		if resChan != nil {
@@ -562,6 +654,19 @@ func (dc *dnsConn) addQueueC(qid uint16, c chan *dns.Msg) {
 	dc.queue[qid] = c
 }
 
+// addQueueCWithRandomQid adds c with a random unused qid and returns it.
+func (dc *dnsConn) addQueueCWithRandomQid(c chan *dns.Msg) uint16 {
+	dc.queueMu.Lock()
+	defer dc.queueMu.Unlock()
+	for {
+		qid := uint16(rand.Uint32())
+		if _, used := dc.queue[qid]; !used {
+			dc.queue[qid] = c
+			return qid
+		}
+	}
+}
+
 func (dc *dnsConn) deleteQueueC(qid uint16) {
 	dc.queueMu.Lock()
 	defer dc.queueMu.Unlock()
@@ -580,3 +685,18 @@ func (dc *dnsConn) getLastReadTime() time.Time {
 	defer dc.statMu.Unlock()
 	return dc.lastRead
 }
+
+func (dc *dnsConn) getIdleTimeout() time.Duration {
+	dc.statMu.Lock()
+	defer dc.statMu.Unlock()
+	return dc.idleTimeout
+}
+
+// setIdleTimeout sets the idle timeout of dc to d, but not longer than
+// Opts.IdleTimeout.
+func (dc *dnsConn) setIdleTimeout(d time.Duration) {
+	d = min(max(d, minKeepaliveIdleTimeout), dc.t.opts.IdleTimeout)
+	dc.statMu.Lock()
+	defer dc.statMu.Unlock()
+	dc.idleTimeout = d
+}
@@ -342,14 +342,14 @@ func TestTransport_Exchange(t *testing.T) {
 			// Wait until all connections are timed out.
 			time.Sleep(tt.fields.IdleTimeout + time.Millisecond*200)
 
-			_, _, newConn, pipelineWg, err := transport.getPipelineConn()
+			_, _, newConn, pipelineStatus, err := transport.getPipelineConn()
 			if err != nil {
 				t.Fatal(err)
 			}
 			if !newConn {
 				t.Fatal("pipelineConn should be a new connection")
 			}
-			pipelineWg.Done()
+			transport.releasePipelineConn(pipelineStatus)
 			reusableConn, reused, err := transport.getReusableConn()
 			if err != nil {
 				t.Fatal(err)
@@ -371,3 +371,179 @@ func TestTransport_Exchange(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_PacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(b[:n]); err != nil {
+				continue
+			}
+			// A malformed packet and a spoofed response come first.
+			pc.WriteTo([]byte{1, 2, 3}, addr)
+			spoofed := new(dns.Msg)
+			spoofed.SetQuestion("spoofed.", dns.TypeA)
+			spoofed.Id = q.Id
+			spoofed.Response = true
+			sb, _ := spoofed.Pack()
+			pc.WriteTo(sb, addr)
+
+			r := new(dns.Msg)
+			r.SetReply(q)
+			rb, _ := r.Pack()
+			pc.WriteTo(rb, addr)
+		}
+	}()
+
+	tt, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return net.Dial("udp", pc.LocalAddr().String())
+		},
+		WriteFunc: dnsutils.WriteMsgToUDP,
+		ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
+			return dnsutils.ReadMsgFromUDP(c, dns.MaxMsgSize)
+		},
+		EnablePipeline: true,
+		PacketConn:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion(fmt.Sprintf("%d.example.", i), dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			r, err := tt.ExchangeContext(ctx, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Id != q.Id || r.Question[0].Name != q.Question[0].Name {
+				t.Errorf("unexpected response %v", r)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTransport_getPipelineConn(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	tt, err := NewTransport(Opts{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			c1, _ := net.Pipe()
+			return c1, nil
+		},
+		WriteFunc:      dnsutils.WriteMsgToTCP,
+		ReadFunc:       func(c io.Reader) (*dns.Msg, int, error) { <-block; return nil, 0, io.EOF },
+		EnablePipeline: true,
+		MaxConns:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+
+	c1, _, isNew, s1, err := tt.getPipelineConn()
+	if err != nil || !isNew {
+		t.Fatal("first conn should be a new one")
+	}
+	c2, _, isNew, s2, _ := tt.getPipelineConn()
+	if !isNew || c2 == c1 {
+		t.Fatal("c1 is busy, a new conn should be dialed")
+	}
+	c3, _, isNew, s3, _ := tt.getPipelineConn()
+	if isNew || (c3 != c1 && c3 != c2) {
+		t.Fatal("pool is full, an existing conn should be reused")
+	}
+
+	// One of c1 and c2 carries two queries now, the other one must be picked.
+	other := c1
+	if c3 == c1 {
+		other = c2
+	}
+	c4, _, isNew, s4, _ := tt.getPipelineConn()
+	if isNew || c4 != other {
+		t.Fatal("the least busy conn should be picked")
+	}
+	for _, s := range []*pipelineStatus{s1, s2, s3, s4} {
+		tt.releasePipelineConn(s)
+	}
+}
+
+func TestTransport_Keepalive(t *testing.T) {
+	queryHasKeepalive := make(chan bool, 1)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			for {
+				q, _, err := dnsutils.ReadMsgFromTCP(c2)
+				if err != nil {
+					return
+				}
+				_, ok := dnsutils.GetKeepalive(q)
+				queryHasKeepalive <- ok
+				r := new(dns.Msg)
+				r.SetReply(q)
+				r.SetEdns0(512, false)
+				r = dnsutils.SetKeepalive(r, time.Second*2)
+				dnsutils.WriteMsgToTCP(c2, r)
+			}
+		}()
+		return c1, nil
+	}
+
+	tt, err := NewTransport(Opts{
+		DialFunc:    dial,
+		WriteFunc:   dnsutils.WriteMsgToTCP,
+		ReadFunc:    dnsutils.ReadMsgFromTCP,
+		IdleTimeout: time.Second * 10,
+		Keepalive:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(512, false)
+	r, err := tt.ExchangeContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-queryHasKeepalive {
+		t.Fatal("query has no keepalive option")
+	}
+	if _, ok := dnsutils.GetKeepalive(q); ok {
+		t.Fatal("query was modified")
+	}
+	if _, ok := dnsutils.GetKeepalive(r); ok {
+		t.Fatal("keepalive option was not removed from the response")
+	}
+
+	tt.m.Lock()
+	defer tt.m.Unlock()
+	for c := range tt.reusableConns {
+		if got := c.getIdleTimeout(); got != time.Second*2 {
+			t.Fatalf("want idle timeout 2s, got %s", got)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/url"
 	"strconv"
@@ -41,11 +42,11 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
 	D "github.com/pmkol/mosdns-x/pkg/upstream/dialer"
+	"github.com/pmkol/mosdns-x/pkg/upstream/dnscrypt"
 	"github.com/pmkol/mosdns-x/pkg/upstream/doh"
 	"github.com/pmkol/mosdns-x/pkg/upstream/doh3"
 	mQUIC "github.com/pmkol/mosdns-x/pkg/upstream/quic"
 	"github.com/pmkol/mosdns-x/pkg/upstream/transport"
-	"github.com/pmkol/mosdns-x/pkg/upstream/udp"
 )
 
 // Upstream represents a DNS upstream.
@@ -57,15 +58,55 @@ type Upstream interface {
 	io.Closer
 }
 
+// IdleConnCloser is implemented by upstreams that reuse connections.
+// Unlike Close, the upstream is still usable after CloseIdleConnections.
+type IdleConnCloser interface {
+	CloseIdleConnections()
+}
+
+// Migrator is implemented by upstreams whose connections can move to
+// new sockets, e.g. DoQ after a network change.
+type Migrator interface {
+	Migrate(ctx context.Context) error
+}
+
+// udpMaxQueryPerConn is the number of queries a udp socket sends
+// before it is replaced.
+const udpMaxQueryPerConn = 4096
+
 type Opt struct {
 	// DialAddr specifies the address the upstream will
 	// actually dial to.
 	DialAddr string
 
 	// Socks5 specifies the socks5 proxy server that the upstream
-	// will connect though.
+	// will connect though. Format is "host:port", or "unix:///path"
+	// for proxies that listen on unix sockets.
 	Socks5 string
 
+	// HTTPProxy specifies the http proxy server that the upstream will
+	// connect though with the CONNECT method. Format is "host:port" or
+	// "http://[user:password@]host:port". UDP based protocols (udp, doq
+	// and h3) are not supported. Cannot be used with Socks5.
+	HTTPProxy string
+
+	// Proxies specifies a chain of proxies that the upstream will connect
+	// though, e.g. ["socks5://10.0.0.1:1080", "http://10.0.1.1:8080"].
+	// Each proxy is dialed through the previous one. UDP based protocols
+	// are only supported if there is only one socks5 proxy. The first
+	// proxy can be a unix socket, e.g. "socks5://unix:///run/proxy.sock".
+	// Cannot be used with Socks5 or HTTPProxy.
+	Proxies []string
+
+	// Socks5HandshakeTimeout limits the handshake with socks5 proxies.
+	// Default is 10s.
+	Socks5HandshakeTimeout time.Duration
+
+	// HappyEyeballsDelay is the delay between tcp dial attempts when the
+	// upstream host name has multiple addresses, e.g. both A and AAAA.
+	// Default is 250ms. Negative disables RFC 8305 dialing.
+	HappyEyeballsDelay time.Duration
+
 	// SoMark sets the socket SO_MARK option in unix system.
 	SoMark int
 
@@ -73,27 +114,33 @@ type Opt struct {
 	BindToDevice string
 
 	// IdleTimeout specifies the idle timeout for long-connections.
-	// Available for TCP, DoT, DoH.
-	// If negative, TCP, DoT will not reuse connections.
-	// Default: TCP, DoT: 10s , DoH: 30s.
+	// Available for UDP, TCP, DoT, DoH.
+	// If negative, UDP, TCP, DoT will not reuse connections.
+	// Default: UDP, TCP, DoT: 10s , DoH: 30s.
 	IdleTimeout time.Duration
 
 	// EnablePipeline enables query pipelining support as RFC 7766 6.2.1.1 suggested.
+	// Concurrent queries are spread over up to MaxConns connections and
+	// matched by their ids, so a slow response doesn't block others.
 	// Available for TCP, DoT upstream with IdleTimeout >= 0.
 	EnablePipeline bool
 
+	// MaxQueryPerConn limits the number of queries a pipelined TCP or DoT
+	// connection serves before it is replaced. Default and max is 65535.
+	MaxQueryPerConn int
+
 	// MaxConns limits the total number of connections, including connections
 	// in the dialing states.
-	// Implemented for TCP/DoT pipeline enabled upstreams and DoH upstreams.
+	// Implemented for UDP, TCP/DoT pipeline enabled upstreams and DoH upstreams.
 	// Default is 2.
 	MaxConns int
 
-	// Bootstrap specifies a plain dns server for the go runtime to solve the
-	// domain of the upstream server. It SHOULD be an IP address. Custom port
-	// is supported.
-	// Note: Use a domain address may cause dead resolve loop and additional
-	// latency to dial upstream server.
-	// HTTP3 is not supported.
+	// Bootstrap specifies a dns server to solve the domain of the upstream
+	// server. It must be an IP address, custom port is supported. Urls of
+	// "udp://", "tcp://", "tls://" and "https://" schemes select the
+	// protocol, e.g. "tls://1.1.1.1", "https://8.8.8.8/dns-query".
+	// "system" uses the resolvers configured in the operating system.
+	// Addresses are cached by their ttl and refreshed in the background.
 	Bootstrap string
 
 	// TLS skip certificate veriry
@@ -102,6 +149,65 @@ type Opt struct {
 	// The set of root certificate authorities that clients use when verifying server certificates.
 	RootCAs *x509.CertPool
 
+	// ServerName overwrites the tls server name (SNI) and the name to
+	// verify, which is the host of the address by default. Not available
+	// for ODoH, whose connections go to both the proxy and the target.
+	ServerName string
+
+	// ALPN overwrites the default tls application protocols, e.g. "dot",
+	// "h2", "doq", "h3".
+	ALPN []string
+
+	// MinTLSVersion and MaxTLSVersion are versions such as tls.VersionTLS12.
+	// Zero means the default of the tls package. DoQ and DoH3 always use
+	// TLS 1.3.
+	MinTLSVersion, MaxTLSVersion uint16
+
+	// ClientCert and ClientKey are files of the client certificate and its
+	// key, presented to servers that require mutual tls. The files are
+	// reloaded on every full handshake, so they can be renewed in place.
+	ClientCert, ClientKey string
+
+	// SVCB looks up the SVCB records of DoT and DoQ servers ("_dns." +
+	// host, RFC 9461) or the HTTPS records of DoH and DoH3 servers
+	// (RFC 9460) with the Bootstrap, and uses the advertised port and ech
+	// config. Only records of the same host that advertise the protocol
+	// are used. The port is not used if the address has a port or
+	// DialAddr is set. ECH is not supported by DoQ and DoH3. Params are
+	// refreshed by their ttl in the background, connections use the
+	// defaults until they are known.
+	SVCB bool
+	// SVCBStore persists params of SVCB, so they are used right after
+	// restarts. Optional.
+	SVCBStore SVCBStore
+
+	// TLSSessionCacheSize is the number of tls sessions cached for session
+	// resumption. Default is 64. Negative disables session resumption.
+	TLSSessionCacheSize int
+
+	// DialFunc overwrites the dialer of the upstream, e.g. to dial through
+	// a tailnet. Socks5, HTTPProxy, Proxies, SoMark, BindToDevice and Bootstrap are ignored.
+	// Conns of "udp" network must also implement net.PacketConn.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Headers specifies additional http headers of DoH requests.
+	// A "Host" key overwrites the request host, e.g. for domain fronting.
+	// Available for DoH and DoH3.
+	Headers map[string]string
+
+	// QueryParams specifies additional url query parameters of DoH requests.
+	// Available for DoH and DoH3.
+	QueryParams map[string]string
+
+	// H3Fallback makes DoH3 upstreams fall back to HTTP/2 if HTTP/3 fails,
+	// e.g. UDP is blocked. HTTP/3 is retried every 5 minutes.
+	H3Fallback bool
+
+	// ODoHProxy is the url of the Oblivious DoH proxy of ODoH upstreams,
+	// e.g. "https://odoh-proxy.example/proxy". If empty, queries are sent to
+	// the target directly. DialAddr is ignored by ODoH upstreams.
+	ODoHProxy string
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
 
@@ -111,6 +217,11 @@ type Opt struct {
 	// If this option is enabled, please mount the TLS module before you run application.
 	// On Linux, it will try to automatically mount the tls kernel module.
 	KernelRX, KernelTX bool
+
+	// ProxyProtocol sends a PROXY protocol v2 header with the client
+	// address from dialer.WithClientAddr on tcp and dot connections.
+	// Connections are not reused when it is set.
+	ProxyProtocol bool
 }
 
 func NewUpstream(addr string, opt *Opt) (Upstream, error) {
@@ -126,22 +237,97 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid server address, %w", err)
 	}
+	if len(opt.HTTPProxy) > 0 && opt.DialFunc == nil {
+		switch addrURL.Scheme {
+		case "", "udp", "doq", "quic", "h3", "doh3":
+			// Fail now instead of on every query.
+			return nil, fmt.Errorf("http proxy does not support udp based %s upstreams", addrURL.Scheme)
+		}
+	}
+	if len(opt.ClientCert) > 0 || len(opt.ClientKey) > 0 {
+		// Fail now instead of on the first handshake.
+		if _, err := tls.LoadX509KeyPair(opt.ClientCert, opt.ClientKey); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate, %w", err)
+		}
+	}
 
-	d, err := D.NewDialer(D.DialerOpts{
-		Dialer: &net.Dialer{
-			Resolver: bootstrap.NewPlainBootstrap(opt.Bootstrap),
-			Control: getSocketControlFunc(socketOpts{
-				so_mark:        opt.SoMark,
-				bind_to_device: opt.BindToDevice,
-			}),
-		},
-		SocksAddr: opt.Socks5,
-	})
-	if err != nil {
-		return nil, err
+	var d D.Dialer
+	if opt.DialFunc != nil {
+		d = dialFunc(opt.DialFunc)
+	} else {
+		dOpts := D.DialerOpts{
+			Dialer: &net.Dialer{
+				Resolver: bootstrap.NewBootstrap(opt.Bootstrap),
+				Control: getSocketControlFunc(socketOpts{
+					so_mark:        opt.SoMark,
+					bind_to_device: opt.BindToDevice,
+				}),
+			},
+			SocksAddr:     opt.Socks5,
+			HTTPProxyAddr: opt.HTTPProxy,
+			Proxies:       opt.Proxies,
+
+			SocksHandshakeTimeout: opt.Socks5HandshakeTimeout,
+			HappyEyeballsDelay:    opt.HappyEyeballsDelay,
+		}
+		if len(opt.Bootstrap) > 0 {
+			r, err := bootstrap.NewResolver(opt.Bootstrap)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bootstrap, %w", err)
+			}
+			dOpts.Resolver = r
+		}
+		d, err = D.NewDialer(dOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idleTimeout := opt.IdleTimeout
+	if opt.ProxyProtocol {
+		switch addrURL.Scheme {
+		case "tcp", "dot", "tls":
+		default:
+			return nil, fmt.Errorf("proxy protocol is not supported by %s upstreams", addrURL.Scheme)
+		}
+		d = D.NewProxyProtocolDialer(d)
+		idleTimeout = -1 // each header describes one client
+	}
+
+	switch addrURL.Scheme {
+	case "http", "https", "h2", "doh", "h3", "doh3", "http+json", "https+json", "json":
+		if len(opt.QueryParams) > 0 {
+			q := addrURL.Query()
+			for k, v := range opt.QueryParams {
+				q.Set(k, v)
+			}
+			addrURL.RawQuery = q.Encode()
+		}
 	}
 
 	switch addrURL.Scheme {
+	case "unix":
+		// Plain dns over a stream unix socket, framed like tcp. Proxies,
+		// DialAddr and socket options are not used.
+		path := addrURL.Host + addrURL.Path
+		if len(path) == 0 {
+			return nil, fmt.Errorf("empty unix socket path")
+		}
+		to := transport.Opts{
+			Logger: opt.Logger,
+			DialFunc: func(ctx context.Context) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", path)
+			},
+			WriteFunc:      dnsutils.WriteMsgToTCP,
+			ReadFunc:       dnsutils.ReadMsgFromTCP,
+			IdleTimeout:    opt.IdleTimeout,
+			EnablePipeline: opt.EnablePipeline,
+			MaxConns:       opt.MaxConns,
+			// Zero means the default of transport.
+			MaxQueryPerConn: uint16(min(max(opt.MaxQueryPerConn, 0), math.MaxUint16)),
+			Keepalive:       true,
+		}
+		return transport.NewTransport(to)
 	case "", "udp":
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
 		tto := transport.Opts{
@@ -156,9 +342,28 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		if err != nil {
 			return nil, fmt.Errorf("cannot init tcp transport, %w", err)
 		}
-		return udp.NewUDPUpstream(func(ctx context.Context) (net.Conn, error) {
-			return d.DialContext(ctx, "udp", dialAddr)
-		}, tt)
+		uto := transport.Opts{
+			Logger: opt.Logger,
+			DialFunc: func(ctx context.Context) (net.Conn, error) {
+				return d.DialContext(ctx, "udp", dialAddr)
+			},
+			WriteFunc: dnsutils.WriteMsgToUDP,
+			ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
+				return dnsutils.ReadMsgFromUDP(c, dns.MaxMsgSize)
+			},
+			IdleTimeout:    opt.IdleTimeout,
+			EnablePipeline: true,
+			MaxConns:       opt.MaxConns,
+			// Rotate source ports from time to time, which makes
+			// spoofing harder.
+			MaxQueryPerConn: udpMaxQueryPerConn,
+			PacketConn:      true,
+		}
+		ut, err := transport.NewTransport(uto)
+		if err != nil {
+			return nil, fmt.Errorf("cannot init udp transport, %w", err)
+		}
+		return &udpWithFallback{u: ut, t: tt}, nil
 	case "tcp":
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 53)
 		to := transport.Opts{
@@ -168,23 +373,32 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			},
 			WriteFunc:      dnsutils.WriteMsgToTCP,
 			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
+			IdleTimeout:    idleTimeout,
 			EnablePipeline: opt.EnablePipeline,
 			MaxConns:       opt.MaxConns,
+			// Zero means the default of transport.
+			MaxQueryPerConn: uint16(min(max(opt.MaxQueryPerConn, 0), math.MaxUint16)),
+			Keepalive:       true,
 		}
 		return transport.NewTransport(to)
 	case "dot", "tls":
 		tlsConfig := createETLSConfig(opt, "dot", tryRemovePort(addrURL.Host))
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 853)
+		pin, err := newSVCBPinner(opt, "dot", addrURL)
+		if err != nil {
+			return nil, err
+		}
 		to := transport.Opts{
 			Logger: opt.Logger,
 			DialFunc: func(ctx context.Context) (net.Conn, error) {
-				conn, err := d.DialContext(ctx, "tcp", dialAddr)
+				conn, err := d.DialContext(ctx, "tcp", pin.dialAddr(dialAddr))
 				if err != nil {
 					return nil, err
 				}
+				tlsConfig := pin.eTLSConfig(tlsConfig)
 				tlsConn := eTLS.Client(conn, tlsConfig)
 				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					pin.handshakeFailed(tlsConfig, err)
 					tlsConn.Close()
 					return nil, err
 				}
@@ -192,9 +406,12 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			},
 			WriteFunc:      dnsutils.WriteMsgToTCP,
 			ReadFunc:       dnsutils.ReadMsgFromTCP,
-			IdleTimeout:    opt.IdleTimeout,
+			IdleTimeout:    idleTimeout,
 			EnablePipeline: opt.EnablePipeline,
 			MaxConns:       opt.MaxConns,
+			// Zero means the default of transport.
+			MaxQueryPerConn: uint16(min(max(opt.MaxQueryPerConn, 0), math.MaxUint16)),
+			Keepalive:       true,
 		}
 		return transport.NewTransport(to)
 	case "doq", "quic":
@@ -204,6 +421,10 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			idleConnTimeout = opt.IdleTimeout
 		}
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 853)
+		pin, err := newSVCBPinner(opt, "doq", addrURL)
+		if err != nil {
+			return nil, err
+		}
 		quicConfig := &quic.Config{
 			TokenStore:                     quic.NewLRUTokenStore(1, 10),
 			InitialStreamReceiveWindow:     4 * 1024,
@@ -212,8 +433,8 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			MaxConnectionReceiveWindow:     64 * 1024,
 			KeepAlivePeriod:                idleConnTimeout / 2,
 		}
-		return mQUIC.NewQUICUpstream(dialAddr, func(ctx context.Context) (*mQUIC.Conn, error) {
-			c, err := d.DialContext(ctx, "udp", dialAddr)
+		dialPacketConn := func(ctx context.Context) (net.PacketConn, error) {
+			c, err := d.DialContext(ctx, "udp", pin.dialAddr(dialAddr))
 			if err != nil {
 				return nil, err
 			}
@@ -222,41 +443,77 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 				c.Close()
 				return nil, fmt.Errorf("not a net.PacketConn")
 			}
-			conn, err := quic.DialEarly(ctx, pc, c.RemoteAddr(), tlsConfig, quicConfig)
+			return pc, nil
+		}
+		return mQUIC.NewQUICUpstream(dialAddr, func(ctx context.Context) (*mQUIC.Conn, error) {
+			pc, err := dialPacketConn(ctx)
 			if err != nil {
-				c.Close()
+				return nil, err
+			}
+			// Use a non single use transport, so the connection has
+			// connection IDs and can migrate.
+			tr := &quic.Transport{Conn: pc}
+			conn, err := tr.DialEarly(ctx, pc.(net.Conn).RemoteAddr(), tlsConfig, quicConfig)
+			if err != nil {
+				tr.Close()
+				pc.Close()
 				return nil, fmt.Errorf("dial quic early conn failed: %v", err)
 			}
-			return mQUIC.NewConn(conn), nil
-		}), nil
-	case "http":
+			return mQUIC.NewConn(conn, tr), nil
+		}, dialPacketConn), nil
+	case "sdns", "dnscrypt":
+		stamp, err := dnscrypt.ParseStamp("sdns://" + strings.SplitN(addr, "://", 2)[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid dnscrypt stamp, %w", err)
+		}
+		_, port, _ := net.SplitHostPort(stamp.Addr)
+		defaultPort, _ := strconv.Atoi(port)
+		dialAddr := getDialAddrWithPort(stamp.Addr, opt.DialAddr, defaultPort)
+		return dnscrypt.NewUpstream(stamp, dialAddr, d.DialContext), nil
+	case "http", "http+json":
 		idleConnTimeout := time.Second * 30
 		if opt.IdleTimeout > 0 {
 			idleConnTimeout = opt.IdleTimeout
 		}
+		isJSON := addrURL.Scheme == "http+json"
+		addrURL.Scheme = "http"
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 80)
-		return doh.NewUpstream(addrURL, &http.Transport{
+		t := &http.Transport{
 			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				return d.DialContext(ctx, "tcp", dialAddr)
 			},
 			IdleConnTimeout: idleConnTimeout,
-		}), nil
-	case "https", "h2", "doh":
+		}
+		if isJSON {
+			t.Proxy = http.ProxyFromEnvironment
+			return doh.NewJSONUpstream(addrURL, t, opt.Headers), nil
+		}
+		return doh.NewUpstream(addrURL, t, opt.Headers), nil
+	case "https", "h2", "doh", "https+json", "json":
 		idleConnTimeout := time.Second * 30
 		if opt.IdleTimeout > 0 {
 			idleConnTimeout = opt.IdleTimeout
 		}
+		isJSON := addrURL.Scheme == "https+json" || addrURL.Scheme == "json"
 		addrURL.Scheme = "https"
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
 		tlsConfig := createETLSConfig(opt, "h2", addrURL.Hostname())
-		return doh.NewUpstream(addrURL, &http.Transport{
+		var pin *svcbPinner
+		if !isJSON {
+			if pin, err = newSVCBPinner(opt, "h2", addrURL); err != nil {
+				return nil, err
+			}
+		}
+		t := &http.Transport{
 			DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
-				conn, err := d.DialContext(ctx, "tcp", dialAddr)
+				conn, err := d.DialContext(ctx, "tcp", pin.dialAddr(dialAddr))
 				if err != nil {
 					return nil, err
 				}
+				tlsConfig := pin.eTLSConfig(tlsConfig)
 				tlsConn := eTLS.Client(conn, tlsConfig)
 				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					pin.handshakeFailed(tlsConfig, err)
 					tlsConn.Close()
 					return nil, err
 				}
@@ -264,7 +521,51 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			},
 			IdleConnTimeout:   idleConnTimeout,
 			ForceAttemptHTTP2: true,
-		}), nil
+		}
+		if isJSON {
+			// The json api is usually used where only an http proxy
+			// can reach the server. Tunnel through the proxy from env.
+			t.Proxy = http.ProxyFromEnvironment
+			t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			}
+			t.TLSClientConfig = tlsConfig
+			return doh.NewJSONUpstream(addrURL, t, opt.Headers), nil
+		}
+		return doh.NewUpstream(addrURL, t, opt.Headers), nil
+	case "odoh":
+		idleConnTimeout := time.Second * 30
+		if opt.IdleTimeout > 0 {
+			idleConnTimeout = opt.IdleTimeout
+		}
+		addrURL.Scheme = "https"
+		var proxyURL *url.URL
+		if len(opt.ODoHProxy) > 0 {
+			proxyURL, err = url.Parse(opt.ODoHProxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid odoh proxy, %w", err)
+			}
+		}
+		// Connections go to both the proxy and the target.
+		odohOpt := *opt
+		odohOpt.ServerName = ""
+		t := &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := d.DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := eTLS.Client(conn, createETLSConfig(&odohOpt, "h2", tryRemovePort(addr)))
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					tlsConn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			IdleConnTimeout:   idleConnTimeout,
+			ForceAttemptHTTP2: true,
+		}
+		return doh.NewODoHUpstream(addrURL, proxyURL, t, opt.Headers), nil
 	case "h3", "doh3":
 		idleConnTimeout := time.Second * 30
 		if opt.IdleTimeout > 0 {
@@ -272,7 +573,11 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		}
 		addrURL.Scheme = "https"
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
-		return doh3.NewUpstream(addrURL, &http3.Transport{
+		pin, err := newSVCBPinner(opt, "h3", addrURL)
+		if err != nil {
+			return nil, err
+		}
+		h3 := doh3.NewUpstream(addrURL, &http3.Transport{
 			TLSClientConfig: createTLSConfig(opt, "h3", addrURL.Hostname()),
 			QUICConfig: &quic.Config{
 				TokenStore:                     quic.NewLRUTokenStore(1, 10),
@@ -283,7 +588,7 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 				KeepAlivePeriod:                idleConnTimeout / 2,
 			},
 			Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
-				c, err := d.DialContext(ctx, "udp", dialAddr)
+				c, err := d.DialContext(ctx, "udp", pin.dialAddr(dialAddr))
 				if err != nil {
 					return nil, err
 				}
@@ -292,21 +597,53 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 					c.Close()
 					return nil, fmt.Errorf("not a net.PacketConn")
 				}
-				return quic.DialEarly(ctx, pc, c.RemoteAddr(), tlsCfg, cfg)
+				conn, err := quic.DialEarly(ctx, pc, c.RemoteAddr(), tlsCfg, cfg)
+				if err != nil {
+					c.Close()
+					return nil, err
+				}
+				return conn, nil
 			},
-		}), nil
+		}, opt.Headers)
+		if !opt.H3Fallback {
+			return h3, nil
+		}
+		h2, err := NewUpstream(addrURL.String(), opt)
+		if err != nil {
+			h3.Close()
+			return nil, err
+		}
+		return newH3WithFallback(h3, h2, opt.Logger), nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
 }
 
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+const defaultTLSSessionCacheSize = 64
+
 func createTLSConfig(opt *Opt, alpn string, serverName string) *tls.Config {
 	config := &tls.Config{
 		InsecureSkipVerify: opt.Insecure,
 		RootCAs:            opt.RootCAs,
-		NextProtos:         []string{alpn},
-		ServerName:         serverName,
-		ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		NextProtos:         tlsALPN(opt, alpn),
+		ServerName:         tlsServerName(opt, serverName),
+		MinVersion:         opt.MinTLSVersion,
+		MaxVersion:         opt.MaxTLSVersion,
+	}
+	if n := tlsSessionCacheSize(opt); n > 0 {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(n)
+	}
+	if len(opt.ClientCert) > 0 {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(opt.ClientCert, opt.ClientKey)
+			return &cert, err
+		}
 	}
 	return config
 }
@@ -317,13 +654,44 @@ func createETLSConfig(opt *Opt, alpn string, serverName string) *eTLS.Config {
 		KernelRX:           opt.KernelRX,
 		InsecureSkipVerify: opt.Insecure,
 		RootCAs:            opt.RootCAs,
-		NextProtos:         []string{alpn},
-		ServerName:         serverName,
-		ClientSessionCache: eTLS.NewLRUClientSessionCache(64),
+		NextProtos:         tlsALPN(opt, alpn),
+		ServerName:         tlsServerName(opt, serverName),
+		MinVersion:         opt.MinTLSVersion,
+		MaxVersion:         opt.MaxTLSVersion,
+	}
+	if n := tlsSessionCacheSize(opt); n > 0 {
+		config.ClientSessionCache = eTLS.NewLRUClientSessionCache(n)
+	}
+	if len(opt.ClientCert) > 0 {
+		config.GetClientCertificate = func(*eTLS.CertificateRequestInfo) (*eTLS.Certificate, error) {
+			cert, err := eTLS.LoadX509KeyPair(opt.ClientCert, opt.ClientKey)
+			return &cert, err
+		}
 	}
 	return config
 }
 
+func tlsALPN(opt *Opt, alpn string) []string {
+	if len(opt.ALPN) > 0 {
+		return opt.ALPN
+	}
+	return []string{alpn}
+}
+
+func tlsServerName(opt *Opt, serverName string) string {
+	if len(opt.ServerName) > 0 {
+		return opt.ServerName
+	}
+	return serverName
+}
+
+func tlsSessionCacheSize(opt *Opt) int {
+	if opt.TLSSessionCacheSize == 0 {
+		return defaultTLSSessionCacheSize
+	}
+	return opt.TLSSessionCacheSize
+}
+
 func getDialAddrWithPort(host, dialAddr string, defaultPort int) string {
 	addr := host
 	if len(dialAddr) > 0 {
@@ -360,6 +728,11 @@ func (u *udpWithFallback) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns
 	return m, nil
 }
 
+func (u *udpWithFallback) CloseIdleConnections() {
+	u.u.CloseIdleConnections()
+	u.t.CloseIdleConnections()
+}
+
 func (u *udpWithFallback) Close() error {
 	u.u.Close()
 	u.t.Close()
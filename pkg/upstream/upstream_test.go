@@ -21,16 +21,29 @@ package upstream
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -90,12 +103,35 @@ func newDoTTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownF
 	}
 }
 
+func newUnixTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func()) {
+	dir, err := os.MkdirTemp("", "mosdns") // t.TempDir() may be too long for a socket path.
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dns.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixServer := dns.Server{
+		Listener:      l,
+		Handler:       handler,
+		MaxTCPQueries: -1,
+	}
+	go unixServer.ActivateAndServe()
+	return path, func() {
+		unixServer.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
 type newTestServerFunc func(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func())
 
 var m = map[string]newTestServerFunc{
-	"udp": newUDPTestServer,
-	"tcp": newTCPTestServer,
-	"tls": newDoTTestServer,
+	"udp":  newUDPTestServer,
+	"tcp":  newTCPTestServer,
+	"tls":  newDoTTestServer,
+	"unix": newUnixTestServer,
 }
 
 func Test_fastUpstream(t *testing.T) {
@@ -211,3 +247,316 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_dohHeaders(t *testing.T) {
+	type got struct {
+		host, token, query string
+	}
+	gotC := make(chan got, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case gotC <- got{host: req.Host, token: req.Header.Get("X-Token"), query: req.URL.RawQuery}:
+		default:
+		}
+		b, _ := io.ReadAll(req.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		wire, _ := r.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Header().Set("Content-Length", strconv.Itoa(len(wire)))
+		w.Write(wire)
+	}))
+	defer s.Close()
+
+	u, err := NewUpstream(s.URL+"/dns-query?a=1", &Opt{
+		Headers:     map[string]string{"host": "front.example", "X-Token": "secret"},
+		QueryParams: map[string]string{"key": "v"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+	g := <-gotC
+	if g.host != "front.example" || g.token != "secret" || g.query != "a=1&key=v" {
+		t.Fatalf("unexpected request %+v", g)
+	}
+}
+
+func Test_jsonUpstream(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		v := req.URL.Query()
+		if req.URL.Path != "/resolve" || v.Get("name") != "example.com." || v.Get("type") != "1" || v.Get("key") != "v" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		io.WriteString(w, `{"Status":0,"RD":true,"RA":true,"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":300,"data":"1.2.3.4"}]}`)
+	}))
+	defer s.Close()
+
+	u, err := NewUpstream("http+json"+strings.TrimPrefix(s.URL, "http")+"/resolve", &Opt{
+		QueryParams: map[string]string{"key": "v"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := u.ExchangeContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func Test_doqUpstream(t *testing.T) {
+	cert, err := utils.GenerateCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						q, _, err := dnsutils.ReadMsgFromTCP(stream)
+						if err != nil || q.Id != 0 {
+							stream.CancelWrite(1)
+							return
+						}
+						r := new(dns.Msg)
+						r.SetReply(q)
+						dnsutils.WriteMsgToTCP(stream, r)
+					}()
+				}
+			}()
+		}
+	}()
+
+	u, err := NewUpstream("quic://"+l.Addr().String(), &Opt{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := u.(Migrator).Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakeUpstream struct {
+	err   atomic.Pointer[error]
+	calls atomic.Int32
+}
+
+func (u *fakeUpstream) ExchangeContext(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	u.calls.Add(1)
+	if err := u.err.Load(); err != nil {
+		return nil, *err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func (u *fakeUpstream) Close() error { return nil }
+
+func Test_h3WithFallback(t *testing.T) {
+	h3, h2 := new(fakeUpstream), new(fakeUpstream)
+	blocked := errors.New("udp blocked")
+	h3.err.Store(&blocked)
+	u := newH3WithFallback(h3, h2, nil)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// A canceled query is not an http3 failure.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := u.ExchangeContext(ctx, q); err == nil {
+		t.Fatal("canceled query should fail")
+	}
+	if u.fallback.Load() {
+		t.Fatal("canceled query should not cause a fallback")
+	}
+	h3.calls.Store(0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := u.ExchangeContext(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h3.calls.Load() != 1 || h2.calls.Load() != 3 {
+		t.Fatalf("want 1 h3 and 3 h2 calls, got %d and %d", h3.calls.Load(), h2.calls.Load())
+	}
+
+	// h3 recovers after a probe.
+	h3.err.Store(nil)
+	u.lastProbe.Store(time.Now().Add(-h3RetryInterval).UnixNano())
+	u.ExchangeContext(context.Background(), q)
+	deadline := time.Now().Add(time.Second)
+	for u.fallback.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("h3 did not recover")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h2Calls := h2.calls.Load()
+	if _, err := u.ExchangeContext(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if h2.calls.Load() != h2Calls {
+		t.Fatal("query should be sent over h3")
+	}
+}
+
+func Test_dotClientTLS(t *testing.T) {
+	serverCert, err := utils.GenerateCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := utils.GenerateCertificate("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	keyDER, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotServerName atomic.Value
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			gotServerName.Store(cs.ServerName)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := dns.Server{Net: "tcp-tls", Listener: l, Handler: &vServer{}}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	newUpstream := func(withCert bool) Upstream {
+		opt := &Opt{
+			Insecure:      true,
+			ServerName:    "private.example",
+			MinTLSVersion: tls.VersionTLS13,
+		}
+		if withCert {
+			opt.ClientCert, opt.ClientKey = certFile, keyFile
+		}
+		u, err := NewUpstream("tls://"+l.Addr().String(), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	u := newUpstream(true)
+	defer u.Close()
+	if _, err := u.ExchangeContext(ctx, q.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	if sn, _ := gotServerName.Load().(string); sn != "private.example" {
+		t.Fatalf("want server name private.example, got %s", sn)
+	}
+
+	u2 := newUpstream(false)
+	defer u2.Close()
+	if _, err := u2.ExchangeContext(ctx, q.Copy()); err == nil {
+		t.Fatal("exchange without client cert should fail")
+	}
+
+	if _, err := NewUpstream("tls://127.0.0.1", &Opt{ClientCert: certFile}); err == nil {
+		t.Fatal("client cert without key should fail")
+	}
+}
+
+func Test_proxyProtocolSchemes(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"tcp://127.0.0.1":       true,
+		"tls://127.0.0.1":       true,
+		"udp://127.0.0.1":       false,
+		"https://127.0.0.1/dns": false,
+	} {
+		u, err := NewUpstream(addr, &Opt{ProxyProtocol: true})
+		if (err == nil) != ok {
+			t.Errorf("%s: unexpected err %v", addr, err)
+		}
+		if u != nil {
+			u.Close()
+		}
+	}
+}
+
+func Test_httpProxySchemes(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1":             false,
+		"udp://127.0.0.1":       false,
+		"quic://127.0.0.1":      false,
+		"h3://127.0.0.1/dns":    false,
+		"tcp://127.0.0.1":       true,
+		"tls://127.0.0.1":       true,
+		"https://127.0.0.1/dns": true,
+	} {
+		u, err := NewUpstream(addr, &Opt{HTTPProxy: "127.0.0.1:8080"})
+		if (err == nil) != ok {
+			t.Errorf("%s: unexpected err %v", addr, err)
+		}
+		if u != nil {
+			u.Close()
+		}
+	}
+}
@@ -21,7 +21,9 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -76,3 +78,86 @@ func reverse6(s string) (netip.Addr, error) {
 	}
 	return netip.ParseAddr(b.String())
 }
+
+// ParsePTRPrefix parses a full or partial reverse name to the prefix it
+// represents. e.g. "1.168.192.in-addr.arpa." is 192.168.1.0/24 and
+// "in-addr.arpa." is 0.0.0.0/0.
+func ParsePTRPrefix(fqdn string) (netip.Prefix, error) {
+	fqdn = strings.ToLower(fqdn)
+	var (
+		labels []string
+		v6     bool
+	)
+	switch {
+	case fqdn == IP4arpa[1:]:
+	case fqdn == IP6arpa[1:]:
+		v6 = true
+	case strings.HasSuffix(fqdn, IP4arpa):
+		labels = strings.Split(strings.TrimSuffix(fqdn, IP4arpa), ".")
+	case strings.HasSuffix(fqdn, IP6arpa):
+		labels = strings.Split(strings.TrimSuffix(fqdn, IP6arpa), ".")
+		v6 = true
+	default:
+		return netip.Prefix{}, errNotPTRDomain
+	}
+
+	if !v6 {
+		if len(labels) > 4 {
+			return netip.Prefix{}, fmt.Errorf("too many labels in %s", fqdn)
+		}
+		var b [4]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil || len(l) > 3 {
+				return netip.Prefix{}, fmt.Errorf("invalid label %q in %s", l, fqdn)
+			}
+			b[len(labels)-1-i] = byte(n)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(b), len(labels)*8), nil
+	}
+
+	if len(labels) > 32 {
+		return netip.Prefix{}, fmt.Errorf("too many labels in %s", fqdn)
+	}
+	var b [16]byte
+	for i, l := range labels {
+		n, err := strconv.ParseUint(l, 16, 4)
+		if err != nil || len(l) != 1 {
+			return netip.Prefix{}, fmt.Errorf("invalid label %q in %s", l, fqdn)
+		}
+		j := len(labels) - 1 - i // nibble index
+		if j%2 == 0 {
+			b[j/2] |= byte(n) << 4
+		} else {
+			b[j/2] |= byte(n)
+		}
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(b), len(labels)*4), nil
+}
+
+// PTRName returns the reverse name of p. Bits of p that do not fill a
+// whole label (an octet for IPv4 or a nibble for IPv6) are ignored.
+func PTRName(p netip.Prefix) string {
+	b := new(strings.Builder)
+	addr := p.Addr()
+	if addr.Is4() {
+		a := addr.As4()
+		for i := p.Bits()/8 - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(a[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString(IP4arpa[1:])
+		return b.String()
+	}
+	a := addr.As16()
+	for i := p.Bits()/4 - 1; i >= 0; i-- {
+		n := a[i/2]
+		if i%2 == 0 {
+			n >>= 4
+		}
+		b.WriteString(strconv.FormatUint(uint64(n&0xf), 16))
+		b.WriteByte('.')
+	}
+	b.WriteString(IP6arpa[1:])
+	return b.String()
+}
@@ -22,6 +22,7 @@ package utils
 import (
 	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -72,3 +73,37 @@ func Test_reverse6(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePTRPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    netip.Prefix
+		wantErr bool
+	}{
+		{"in-addr.arpa.", netip.MustParsePrefix("0.0.0.0/0"), false},
+		{"1.168.192.in-addr.arpa.", netip.MustParsePrefix("192.168.1.0/24"), false},
+		{"4.1.168.192.In-Addr.Arpa.", netip.MustParsePrefix("192.168.1.4/32"), false},
+		{"d.f.ip6.arpa.", netip.MustParsePrefix("fd00::/8"), false},
+		{"b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", netip.MustParsePrefix("2001:db8::567:89ab/128"), false},
+		{"256.in-addr.arpa.", netip.Prefix{}, true},
+		{"1.2.3.4.5.in-addr.arpa.", netip.Prefix{}, true},
+		{"df.ip6.arpa.", netip.Prefix{}, true},
+		{"example.com.", netip.Prefix{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePTRPrefix(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePTRPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParsePTRPrefix() got = %v, want %v", got, tt.want)
+			}
+			if err == nil {
+				if name := PTRName(got); name != strings.ToLower(tt.name) {
+					t.Fatalf("PTRName() got = %s, want %s", name, tt.name)
+				}
+			}
+		})
+	}
+}
@@ -20,7 +20,9 @@
 package utils
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"unsafe"
 )
@@ -55,3 +57,37 @@ func SplitString2(s, symbol string) (s1 string, s2 string, ok bool) {
 	}
 	return "", "", false
 }
+
+// ParseByteSize parses a human-readable size string like "128M", "1.5GiB"
+// or "4096" into bytes. Units are case-insensitive and 1024 based.
+// Valid units are "" (bytes), "b", "k", "kb", "kib", "m", "mb", "mib",
+// "g", "gb", "gib".
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size number %s", num)
+	}
+
+	var m float64
+	switch strings.ToLower(unit) {
+	case "", "b":
+		m = 1
+	case "k", "kb", "kib":
+		m = 1 << 10
+	case "m", "mb", "mib":
+		m = 1 << 20
+	case "g", "gb", "gib":
+		m = 1 << 30
+	default:
+		return 0, fmt.Errorf("invalid size unit %s", unit)
+	}
+	return int64(f * m), nil
+}
@@ -20,8 +20,13 @@
 package utils
 
 import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSplitString2(t *testing.T) {
@@ -87,6 +92,35 @@ func TestRemoveComment(t *testing.T) {
 	}
 }
 
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"4096", 4096, false},
+		{"1k", 1024, false},
+		{"128M", 128 << 20, false},
+		{"256MiB", 256 << 20, false},
+		{"1.5 GB", 3 << 29, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"12T", 0, true},
+		{"-1M", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseByteSize(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseByteSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 type TestArgsStruct struct {
 	A string `yaml:"1"`
 	B []int  `yaml:"2"`
@@ -112,3 +146,56 @@ func Test_WeakDecode(t *testing.T) {
 		t.Fatalf("args decode failed, want %v, got %v", wantObj, testObj)
 	}
 }
+
+func TestParseWeekdays(t *testing.T) {
+	got, err := ParseWeekdays([]string{"Mon", "friday"})
+	if err != nil || got != [7]bool{time.Monday: true, time.Friday: true} {
+		t.Fatalf("ParseWeekdays() = %v, %v", got, err)
+	}
+	if got, err := ParseWeekdays(nil); err != nil || got != [7]bool{true, true, true, true, true, true, true} {
+		t.Fatalf("empty days should be every day, %v, %v", got, err)
+	}
+	for _, d := range []string{"", "x", "funday"} {
+		if _, err := ParseWeekdays([]string{d}); err == nil {
+			t.Errorf("day %q should be invalid", d)
+		}
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	if m, err := ParseClock("07:30"); err != nil || m != 450 {
+		t.Fatalf("ParseClock() = %d, %v", m, err)
+	}
+	for _, s := range []string{"", "7", "24:00", "12:60"} {
+		if _, err := ParseClock(s); err == nil {
+			t.Errorf("clock %q should be invalid", s)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f")
+	write := func(s string) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, s)
+			return err
+		}
+	}
+	if err := WriteFileAtomic(file, write("a")); err != nil {
+		t.Fatal(err)
+	}
+	failed := func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("test")
+	}
+	if err := WriteFileAtomic(file, failed); err == nil {
+		t.Fatal("WriteFileAtomic should fail")
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "a" {
+		t.Fatalf("file is changed by a failed write, %q, %v", b, err)
+	}
+	if es, _ := os.ReadDir(dir); len(es) != 1 {
+		t.Fatalf("temporary files are left, %d files", len(es))
+	}
+}
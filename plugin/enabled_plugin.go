@@ -21,29 +21,51 @@ package plugin
 
 // import all plugins
 import (
+	_ "github.com/pmkol/mosdns-x/plugin/executable/address_list"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/arbitrary"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/blackhole"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/bufsize"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/cache"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/client_id"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/client_limiter"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/client_names"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/client_profile"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dhcp_lease"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dns64"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dnssec_exception"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dnstap"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/dual_selector"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ecs"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/edns0_filter"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/fake_ip"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/fast_forward"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/hosts"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/ip_router"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ipset"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/ipv6_probe"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/kubernetes"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/local_ptr"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/marker"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/mdns"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/metrics_collector"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/misc_optm"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/mqtt"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/nftset"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/normalize"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/padding"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/qtype_block"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/qtype_router"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/query_summary"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/querylog"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/redirect"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/reject_any"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/response_limit"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/reverse_lookup"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sequence"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sleep"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ttl"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/webhook"
 	_ "github.com/pmkol/mosdns-x/plugin/matcher/query_matcher"
 	_ "github.com/pmkol/mosdns-x/plugin/matcher/response_matcher"
+	_ "github.com/pmkol/mosdns-x/plugin/preset/china_split"
 )
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package address_list
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "address_list"
+
+const (
+	batchSize     = 64
+	batchInterval = time.Second
+	pushTimeout   = time.Second * 10
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*addressList)(nil)
+
+type Args struct {
+	// Type can be "routeros" (RouterOS v7 REST api) or "vyos" (VyOS http api).
+	Type string `yaml:"type"`
+	// URL is the base url of the router api, e.g. "https://192.168.88.1".
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"` // routeros
+	Password string `yaml:"password"` // routeros
+	APIKey   string `yaml:"api_key"`  // vyos
+	Insecure bool   `yaml:"insecure_skip_verify"`
+
+	// List4 and List6 are the names of the address-list (routeros)
+	// or address-group (vyos).
+	List4 string `yaml:"list4"`
+	List6 string `yaml:"list6"`
+	Mask4 int    `yaml:"mask4"` // Default is 32.
+	Mask6 int    `yaml:"mask6"` // Default is 128.
+
+	// EntryTimeout (sec) is the timeout of routeros list entries.
+	// Zero means permanent. vyos does not support entry timeout.
+	EntryTimeout int `yaml:"entry_timeout"`
+	QueueSize    int `yaml:"queue_size"` // Default is 1024.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.Mask4, 32)
+	utils.SetDefaultNum(&a.Mask6, 128)
+	utils.SetDefaultNum(&a.QueueSize, 1024)
+}
+
+type entry struct {
+	list    string
+	prefix  netip.Prefix
+	comment string
+}
+
+// pusher pushes entries to a remote router.
+type pusher interface {
+	push(ctx context.Context, entries []entry) error
+}
+
+type addressList struct {
+	*coremain.BP
+	args   *Args
+	pusher pusher
+	queue  chan entry
+
+	// recent suppresses duplicated pushes.
+	recent *concurrent_lru.ShardedLRU[time.Time]
+	cancel context.CancelFunc
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newAddressList(bp, args.(*Args))
+}
+
+func newAddressList(bp *coremain.BP, args *Args) (*addressList, error) {
+	args.init()
+	if !utils.CheckNumRange(args.Mask4, 0, 32) || !utils.CheckNumRange(args.Mask6, 0, 128) {
+		return nil, fmt.Errorf("invalid mask4 %d or mask6 %d", args.Mask4, args.Mask6)
+	}
+	if len(args.URL) == 0 {
+		return nil, fmt.Errorf("missing router api url")
+	}
+	hc := &http.Client{
+		Timeout: pushTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: args.Insecure},
+		},
+	}
+	baseURL := strings.TrimSuffix(args.URL, "/")
+
+	var ps pusher
+	switch args.Type {
+	case "routeros":
+		ps = &routerOS{hc: hc, url: baseURL, username: args.Username, password: args.Password, timeout: args.EntryTimeout}
+	case "vyos":
+		ps = &vyOS{hc: hc, url: baseURL, key: args.APIKey}
+	default:
+		return nil, fmt.Errorf("unknown router type %s", args.Type)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &addressList{
+		BP:     bp,
+		args:   args,
+		pusher: ps,
+		queue:  make(chan entry, args.QueueSize),
+		recent: concurrent_lru.NewShardedLRU[time.Time](64, args.QueueSize/16+16, nil),
+		cancel: cancel,
+	}
+	go p.pushLoop(ctx)
+	return p, nil
+}
+
+// Exec queues the ips in the response. Pushes are asynchronous and
+// never block the query.
+func (p *addressList) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := qCtx.R(); r != nil {
+		p.enqueue(r)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *addressList) enqueue(r *dns.Msg) {
+	var comment string
+	if len(r.Question) > 0 {
+		comment = strings.TrimSuffix(r.Question[0].Name, ".")
+	}
+	now := time.Now()
+	for _, rr := range r.Answer {
+		var e entry
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok || len(p.args.List4) == 0 {
+				continue
+			}
+			e = entry{list: p.args.List4, prefix: netip.PrefixFrom(addr, p.args.Mask4).Masked()}
+		case *dns.AAAA:
+			addr, ok := netip.AddrFromSlice(rr.AAAA.To16())
+			if !ok || len(p.args.List6) == 0 {
+				continue
+			}
+			e = entry{list: p.args.List6, prefix: netip.PrefixFrom(addr, p.args.Mask6).Masked()}
+		default:
+			continue
+		}
+		e.comment = comment
+
+		key := e.list + e.prefix.String()
+		if exp, ok := p.recent.Get(key); ok && now.Before(exp) {
+			continue
+		}
+		select {
+		case p.queue <- e:
+			p.recent.Add(key, now.Add(p.dedupWindow()))
+		default:
+			p.L().Warn("address list queue is full, entry dropped", zap.Stringer("prefix", e.prefix))
+		}
+	}
+}
+
+// dedupWindow is how long a pushed entry won't be pushed again.
+func (p *addressList) dedupWindow() time.Duration {
+	if t := p.args.EntryTimeout; t > 0 {
+		return time.Duration(t) * time.Second / 2
+	}
+	return time.Hour
+}
+
+func (p *addressList) pushLoop(ctx context.Context) {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	batch := make([]entry, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		pCtx, cancel := context.WithTimeout(ctx, pushTimeout)
+		err := p.pusher.push(pCtx, batch)
+		cancel()
+		if err != nil {
+			p.L().Warn("failed to push address list", zap.Int("entries", len(batch)), zap.Error(err))
+			for _, e := range batch { // allow retry
+				p.recent.Del(e.list + e.prefix.String())
+			}
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e := <-p.queue:
+			batch = append(batch, e)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *addressList) Close() error {
+	p.cancel()
+	return nil
+}
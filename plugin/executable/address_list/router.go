@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package address_list
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// routerOS pushes entries through the RouterOS v7 REST api.
+type routerOS struct {
+	hc       *http.Client
+	url      string
+	username string
+	password string
+	timeout  int
+}
+
+func (r *routerOS) push(ctx context.Context, entries []entry) error {
+	for _, e := range entries {
+		path := "/rest/ip/firewall/address-list"
+		addr := e.prefix.Addr().String()
+		if e.prefix.Addr().Is6() {
+			path = "/rest/ipv6/firewall/address-list"
+			addr = e.prefix.String()
+		} else if e.prefix.Bits() != 32 {
+			addr = e.prefix.String()
+		}
+
+		body := map[string]string{
+			"list":    e.list,
+			"address": addr,
+			"comment": e.comment,
+		}
+		if r.timeout > 0 {
+			body["timeout"] = strconv.Itoa(r.timeout) + "s"
+		}
+		b, _ := json.Marshal(body)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.url+path, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(r.username, r.password)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := r.hc.Do(req)
+		if err != nil {
+			return err
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			// The entry was added before and has not expired yet.
+			if resp.StatusCode == http.StatusBadRequest && bytes.Contains(msg, []byte("already have such entry")) {
+				continue
+			}
+			return fmt.Errorf("routeros returned status %d, %s", resp.StatusCode, msg)
+		}
+	}
+	return nil
+}
+
+// vyOS pushes entries through the VyOS http api. All entries are
+// committed in one request.
+type vyOS struct {
+	hc  *http.Client
+	url string
+	key string
+}
+
+type vyOSOp struct {
+	Op   string   `json:"op"`
+	Path []string `json:"path"`
+}
+
+func (v *vyOS) push(ctx context.Context, entries []entry) error {
+	ops := make([]vyOSOp, 0, len(entries))
+	for _, e := range entries {
+		group, value := "address-group", e.prefix.Addr().String()
+		hostBits := e.prefix.Addr().BitLen()
+		if e.prefix.Addr().Is6() {
+			group = "ipv6-address-group"
+		}
+		if e.prefix.Bits() != hostBits {
+			group = strings.Replace(group, "address-group", "network-group", 1)
+			value = e.prefix.String()
+		}
+		ops = append(ops, vyOSOp{Op: "set", Path: []string{"firewall", "group", group, e.list, valueKey(group), value}})
+	}
+	b, _ := json.Marshal(ops)
+
+	form := url.Values{}
+	form.Set("data", string(b))
+	form.Set("key", v.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url+"/configure", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Success bool    `json:"success"`
+		Error   *string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("vyos returned status %d, %w", resp.StatusCode, err)
+	}
+	if !res.Success {
+		if res.Error != nil {
+			return fmt.Errorf("vyos returned error, %s", *res.Error)
+		}
+		return fmt.Errorf("vyos returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func valueKey(group string) string {
+	if strings.Contains(group, "network-group") {
+		return "network"
+	}
+	return "address"
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package address_list
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+var testEntries = []entry{
+	{list: "proxy", prefix: netip.MustParsePrefix("1.1.1.1/32"), comment: "example.com"},
+	{list: "proxy6", prefix: netip.MustParsePrefix("2001:db8::/64"), comment: "example.com"},
+}
+
+func Test_routerOS_push(t *testing.T) {
+	var got []map[string]string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "admin" || p != "pw" || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		m := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&m)
+		m["path"] = r.URL.Path
+		got = append(got, m)
+	}))
+	defer s.Close()
+
+	ros := &routerOS{hc: s.Client(), url: s.URL, username: "admin", password: "pw", timeout: 60}
+	if err := ros.push(context.Background(), testEntries); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 requests, got %d", len(got))
+	}
+	if got[0]["path"] != "/rest/ip/firewall/address-list" || got[0]["address"] != "1.1.1.1" || got[0]["timeout"] != "60s" {
+		t.Fatalf("unexpected ipv4 request %v", got[0])
+	}
+	if got[1]["path"] != "/rest/ipv6/firewall/address-list" || got[1]["address"] != "2001:db8::/64" {
+		t.Fatalf("unexpected ipv6 request %v", got[1])
+	}
+}
+
+func Test_vyOS_push(t *testing.T) {
+	var ops []vyOSOp
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("key") != "k" {
+			w.Write([]byte(`{"success":false,"error":"invalid key"}`))
+			return
+		}
+		json.Unmarshal([]byte(r.FormValue("data")), &ops)
+		w.Write([]byte(`{"success":true,"data":null,"error":null}`))
+	}))
+	defer s.Close()
+
+	v := &vyOS{hc: s.Client(), url: s.URL, key: "k"}
+	if err := v.push(context.Background(), testEntries); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 {
+		t.Fatalf("want 2 ops, got %d", len(ops))
+	}
+	want0 := []string{"firewall", "group", "address-group", "proxy", "address", "1.1.1.1"}
+	want1 := []string{"firewall", "group", "ipv6-network-group", "proxy6", "network", "2001:db8::/64"}
+	for i, want := range [][]string{want0, want1} {
+		for j := range want {
+			if ops[i].Path[j] != want[j] {
+				t.Fatalf("want path %v, got %v", want, ops[i].Path)
+			}
+		}
+	}
+
+	v.key = "bad"
+	if err := v.push(context.Background(), testEntries); err == nil {
+		t.Fatal("invalid key should fail")
+	}
+}
@@ -21,10 +21,10 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/golang/snappy"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
@@ -34,7 +34,7 @@ import (
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
-	"github.com/pmkol/mosdns-x/pkg/cache/redis_cache"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/pool"
@@ -53,6 +53,9 @@ func init() {
 	})
 }
 
+// KeyHit is set if the response is from the cache.
+var KeyHit = query_context.NewKey[bool]("cache.hit")
+
 const (
 	defaultLazyUpdateTimeout = time.Second * 5
 	defaultEmptyAnswerTTL    = time.Second * 300
@@ -69,6 +72,42 @@ type Args struct {
 	CacheEverything   bool   `yaml:"cache_everything"`
 	CompressResp      bool   `yaml:"compress_resp"`
 	WhenHit           string `yaml:"when_hit"`
+
+	// RedisCluster uses a redis cluster. Nodes are comma separated hosts
+	// of the redis url, e.g. "redis://10.0.0.1:6379,10.0.0.2:6379".
+	RedisCluster bool `yaml:"redis_cluster"`
+	// RedisL1Size is the size of an in-memory cache in front of redis, so
+	// hot entries don't cost a round trip. Zero disables it. Entries are
+	// kept in it for at most RedisL1TTL seconds, default is 30, so
+	// updates from other instances sharing the redis are seen.
+	RedisL1Size int `yaml:"redis_l1_size"`
+	RedisL1TTL  int `yaml:"redis_l1_ttl"`
+
+	// PrefetchHTTPS queries the HTTPS record of a name in the background
+	// if its A/AAAA record is not cached, and vice versa, so follow-up
+	// queries of browsers hit the cache.
+	PrefetchHTTPS bool `yaml:"prefetch_https"`
+
+	// Persist is the file that the memory cache is saved to every
+	// SaveInterval seconds (default is 300) and on shutdown, and loaded
+	// from on startup, so a restart doesn't cause a burst of upstream
+	// queries. Entries keep their remaining ttls. Not supported with
+	// redis, which is persisted by itself.
+	Persist      string `yaml:"persist"`
+	SaveInterval int    `yaml:"save_interval"`
+
+	// ServeStale answers queries from entries that expired no more than
+	// ServeStale seconds ago (or lazy_cache_ttl seconds ago if lazy cache
+	// is enabled) when upstreams fail, time out or return SERVFAIL
+	// (RFC 8767). Stale answers have a ttl of StaleReplyTTL, default is
+	// 30. For 30s after a failure, queries of the name are answered from
+	// the stale entry at once while it is refreshed in the background.
+	ServeStale    int `yaml:"serve_stale"`
+	StaleReplyTTL int `yaml:"stale_reply_ttl"`
+
+	// Cluster replicates cache entries to cluster peers. Peers must
+	// have the same tag. See coremain.ClusterConfig.
+	Cluster bool `yaml:"cluster"`
 }
 
 type cachePlugin struct {
@@ -78,10 +117,14 @@ type cachePlugin struct {
 	whenHit      executable_seq.Executable
 	backend      cache.Backend
 	lazyUpdateSF singleflight.Group
+	prefetchSF   singleflight.Group
+	cluster      *clusterChannel                       // maybe nil
+	staleFailed  *concurrent_lru.ShardedLRU[time.Time] // maybe nil, see recentlyFailed
 
 	queryTotal   prometheus.Counter
 	hitTotal     prometheus.Counter
 	lazyHitTotal prometheus.Counter
+	staleTotal   prometheus.Counter
 	size         prometheus.GaugeFunc
 }
 
@@ -92,23 +135,10 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	var c cache.Backend
 	if len(args.Redis) != 0 {
-		opt, err := redis.ParseURL(args.Redis)
-		if err != nil {
-			return nil, fmt.Errorf("invalid redis url, %w", err)
+		var err error
+		if c, err = newRedisBackend(bp, args); err != nil {
+			return nil, err
 		}
-		opt.MaxRetries = -1
-		r := redis.NewClient(opt)
-		rcOpts := redis_cache.RedisCacheOpts{
-			Client:        r,
-			ClientCloser:  r,
-			ClientTimeout: time.Duration(args.RedisTimeout) * time.Millisecond,
-			Logger:        bp.L(),
-		}
-		rc, err := redis_cache.NewRedisCache(rcOpts)
-		if err != nil {
-			return nil, fmt.Errorf("failed to init redis cache, %w", err)
-		}
-		c = rc
 	} else {
 		c = mem_cache.NewMemCache(args.Size, 0)
 	}
@@ -116,6 +146,9 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	if args.LazyCacheReplyTTL <= 0 {
 		args.LazyCacheReplyTTL = 5
 	}
+	if args.StaleReplyTTL <= 0 {
+		args.StaleReplyTTL = defaultStaleReplyTTL
+	}
 
 	var whenHit executable_seq.Executable
 	if tag := args.WhenHit; len(tag) > 0 {
@@ -144,6 +177,10 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 			Name: "lazy_hit_total",
 			Help: "The total number of queries that hit the expired cache",
 		}),
+		staleTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stale_total",
+			Help: "The total number of queries that were answered by stale entries",
+		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name: "cache_size",
 			Help: "Current cache size in records",
@@ -151,7 +188,22 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 			return float64(c.Len())
 		}),
 	}
-	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.size)
+	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.staleTotal, p.size)
+	if args.ServeStale > 0 {
+		p.staleFailed = concurrent_lru.NewShardedLRU[time.Time](16, staleFailedSize/16, nil)
+	}
+	if len(args.Persist) > 0 {
+		if _, ok := c.(entryRanger); !ok {
+			return nil, errors.New("persist is only supported by the memory cache")
+		}
+		p.loadPersist()
+		bp.M().GetSafeClose().Attach(p.saveLoop)
+	}
+	if args.Cluster {
+		if err := p.joinCluster(); err != nil {
+			return nil, err
+		}
+	}
 	return p, nil
 }
 
@@ -180,6 +232,8 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 		cachedResp.Id = q.Id // change msg id
 		c.L().Debug("cache hit", qCtx.InfoField())
 		qCtx.SetResponse(cachedResp)
+		query_context.SetValue(qCtx, KeyHit, true)
+		qCtx.Tracef("%s: cache hit, lazy %t", c.Tag(), lazyHit)
 		if c.whenHit != nil {
 			return c.whenHit.Exec(ctx, qCtx, nil)
 		}
@@ -188,6 +242,19 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 
 	// cache miss, run the entry and try to store its response.
 	c.L().Debug("cache miss", qCtx.InfoField())
+	qCtx.Tracef("%s: cache miss", c.Tag())
+	if c.staleFailed != nil && c.recentlyFailed(msgKey) {
+		// Don't wait for upstreams that just failed. The response of
+		// the refresh replaces the stale one if they are back.
+		if r := c.lookupStale(msgKey, qCtx); r != nil {
+			c.doLazyUpdate(msgKey, qCtx, next)
+			c.setStaleResp(qCtx, r)
+			return nil
+		}
+	}
+	if c.args.PrefetchHTTPS {
+		c.prefetchHTTPS(qCtx, next)
+	}
 	err = executable_seq.ExecChainNode(ctx, qCtx, next)
 	r := qCtx.R()
 	if r != nil {
@@ -195,6 +262,14 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
 	}
+	if c.staleFailed != nil && (err != nil || r == nil || r.Rcode == dns.RcodeServerFailure) {
+		if r := c.lookupStale(msgKey, qCtx); r != nil {
+			c.staleFailed.Add(msgKey, time.Now())
+			c.L().Debug("upstreams failed, serving stale", qCtx.InfoField(), zap.Error(err))
+			c.setStaleResp(qCtx, r)
+			return nil
+		}
+	}
 	return err
 }
 
@@ -215,56 +290,68 @@ func (c *cachePlugin) getMsgKey(q *dns.Msg) (string, error) {
 // lookupCache returns the cached response. The ttl of returned msg will be changed properly.
 // Remember, caller must change the msg id.
 func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, lazyHit bool, err error) {
-	// lookup in cache
-	v, storedTime, _ := c.backend.Get(msgKey)
-
-	// cache hit
-	if v != nil {
-		if c.args.CompressResp {
-			decodeLen, err := snappy.DecodedLen(v)
-			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
-			}
-			if decodeLen > dns.MaxMsgSize {
-				return nil, false, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
-			}
-			decompressBuf := pool.GetBuf(decodeLen)
-			defer decompressBuf.Release()
-			v, err = snappy.Decode(decompressBuf.Bytes(), v)
-			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
-			}
-		}
-		r = new(dns.Msg)
-		if err := r.Unpack(v); err != nil {
-			return nil, false, fmt.Errorf("failed to unpack cached data, %w", err)
-		}
+	r, storedTime, expirationTime, err := c.getMsg(msgKey)
+	if r == nil {
+		return nil, false, err
+	}
+	// Entries are kept serve_stale seconds longer for lookupStale.
+	if !expirationTime.Add(-time.Duration(c.args.ServeStale) * time.Second).After(time.Now()) {
+		return nil, false, nil
+	}
 
-		var msgTTL time.Duration
-		if len(r.Answer) == 0 {
-			msgTTL = defaultEmptyAnswerTTL
-		} else {
-			msgTTL = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
-		}
+	var msgTTL time.Duration
+	if len(r.Answer) == 0 {
+		msgTTL = defaultEmptyAnswerTTL
+	} else {
+		msgTTL = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
+	}
 
-		// not expired
-		if storedTime.Add(msgTTL).After(time.Now()) {
-			dnsutils.SubtractTTL(r, uint32(time.Since(storedTime).Seconds()))
-			return r, false, nil
-		}
+	// not expired
+	if storedTime.Add(msgTTL).After(time.Now()) {
+		dnsutils.SubtractTTL(r, uint32(time.Since(storedTime).Seconds()))
+		return r, false, nil
+	}
 
-		// expired but lazy update enabled
-		if c.args.LazyCacheTTL > 0 {
-			// set the default ttl
-			dnsutils.SetTTL(r, uint32(c.args.LazyCacheReplyTTL))
-			return r, true, nil
-		}
+	// expired but lazy update enabled
+	if c.args.LazyCacheTTL > 0 {
+		// set the default ttl
+		dnsutils.SetTTL(r, uint32(c.args.LazyCacheReplyTTL))
+		return r, true, nil
 	}
 
 	// cache miss
 	return nil, false, nil
 }
 
+// getMsg returns the msg stored in the backend, or nil if there is no
+// such msg.
+func (c *cachePlugin) getMsg(msgKey string) (r *dns.Msg, storedTime, expirationTime time.Time, err error) {
+	v, storedTime, expirationTime := c.backend.Get(msgKey)
+	if v == nil {
+		return nil, storedTime, expirationTime, nil
+	}
+	if c.args.CompressResp {
+		decodeLen, err := snappy.DecodedLen(v)
+		if err != nil {
+			return nil, storedTime, expirationTime, fmt.Errorf("snappy decode err: %w", err)
+		}
+		if decodeLen > dns.MaxMsgSize {
+			return nil, storedTime, expirationTime, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
+		}
+		decompressBuf := pool.GetBuf(decodeLen)
+		defer decompressBuf.Release()
+		v, err = snappy.Decode(decompressBuf.Bytes(), v)
+		if err != nil {
+			return nil, storedTime, expirationTime, fmt.Errorf("snappy decode err: %w", err)
+		}
+	}
+	r = new(dns.Msg)
+	if err := r.Unpack(v); err != nil {
+		return nil, storedTime, expirationTime, fmt.Errorf("failed to unpack cached data, %w", err)
+	}
+	return r, storedTime, expirationTime, nil
+}
+
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
 // It has an inner singleflight.Group to de-duplicate same msgKey.
 func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
@@ -292,6 +379,51 @@ func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, n
 	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
+// prefetchHTTPS starts new goroutines to query and cache the HTTPS record
+// of an A/AAAA query, or A and AAAA records of an HTTPS query, if they are
+// not cached.
+func (c *cachePlugin) prefetchHTTPS(qCtx *query_context.Context, next executable_seq.ExecutableChainNode) {
+	q := qCtx.Q()
+	var qTypes []uint16
+	switch q.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		qTypes = []uint16{dns.TypeHTTPS}
+	case dns.TypeHTTPS:
+		qTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	default:
+		return
+	}
+
+	for _, qType := range qTypes {
+		prefetchQCtx := qCtx.Copy()
+		prefetchQCtx.SetResponse(nil)
+		prefetchQCtx.Q().Question[0].Qtype = qType
+		msgKey, err := c.getMsgKey(prefetchQCtx.Q())
+		if err != nil || len(msgKey) == 0 {
+			continue
+		}
+		if v, _, _ := c.backend.Get(msgKey); v != nil {
+			continue
+		}
+		prefetchFunc := func() (interface{}, error) {
+			defer c.prefetchSF.Forget(msgKey)
+			ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+			defer cancel()
+
+			if err := executable_seq.ExecChainNode(ctx, prefetchQCtx, next); err != nil {
+				c.L().Debug("failed to prefetch", prefetchQCtx.InfoField(), zap.Error(err))
+			}
+			if r := prefetchQCtx.R(); r != nil {
+				if err := c.tryStoreMsg(msgKey, r); err != nil {
+					c.L().Error("cache store", prefetchQCtx.InfoField(), zap.Error(err))
+				}
+			}
+			return nil, nil
+		}
+		c.prefetchSF.DoChan(msgKey, prefetchFunc)
+	}
+}
+
 // tryStoreMsg tries to store r to cache. If r should be cached.
 func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 	if r.Rcode != dns.RcodeSuccess || r.Truncated != false {
@@ -314,15 +446,45 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 		}
 		expirationTime = now.Add(time.Duration(minTTL) * time.Second)
 	}
+	expirationTime = expirationTime.Add(time.Duration(c.args.ServeStale) * time.Second)
 	if c.args.CompressResp {
 		compressBuf := pool.GetBuf(snappy.MaxEncodedLen(len(v)))
 		v = snappy.Encode(compressBuf.Bytes(), v)
 		defer compressBuf.Release()
 	}
 	c.backend.Store(key, v, now, expirationTime)
+	if c.cluster != nil {
+		c.cluster.publish(key, v, now, expirationTime)
+	}
 	return nil
 }
 
 func (c *cachePlugin) Shutdown() error {
 	return c.backend.Close()
 }
+
+// MemoryUsage implements coremain.MemoryReporter.
+// Backends that do not store data in memory report 0.
+func (c *cachePlugin) MemoryUsage() int64 {
+	if mr, ok := c.backend.(coremain.MemoryReporter); ok {
+		return mr.MemoryUsage()
+	}
+	return 0
+}
+
+// ShrinkMemory implements coremain.MemoryShrinker.
+func (c *cachePlugin) ShrinkMemory() {
+	if s, ok := c.backend.(interface{ Shrink(keep float64) }); ok {
+		s.Shrink(0.5)
+	}
+}
+
+// Flush implements coremain.Flusher.
+func (c *cachePlugin) Flush() error {
+	f, ok := c.backend.(interface{ Flush() })
+	if !ok {
+		return errors.New("the cache backend doesn't support flushing")
+	}
+	f.Flush()
+	return nil
+}
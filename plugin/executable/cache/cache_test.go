@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_cachePlugin_prefetchHTTPS(t *testing.T) {
+	c := &cachePlugin{
+		BP:         coremain.NewBP("test", PluginType, nil, new(coremain.Mosdns)),
+		args:       &Args{PrefetchHTTPS: true},
+		backend:    mem_cache.NewMemCache(1024, 0),
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+		hitTotal:   prometheus.NewCounter(prometheus.CounterOpts{Name: "hit_total"}),
+	}
+	defer c.backend.Close()
+
+	var mu sync.Mutex
+	queried := make(map[uint16]int)
+	next := executable_seq.WrapExecutable(execFunc(func(qCtx *query_context.Context) {
+		q := qCtx.Q()
+		mu.Lock()
+		queried[q.Question[0].Qtype]++
+		mu.Unlock()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(1, 2, 3, 4)})
+		case dns.TypeHTTPS:
+			r.Answer = append(r.Answer, &dns.HTTPS{SVCB: dns.SVCB{Hdr: hdr, Priority: 1, Target: "."}})
+		}
+		qCtx.SetResponse(r)
+	}))
+
+	exec := func(qType uint16) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qType)
+		if err := c.Exec(context.Background(), query_context.NewContext(q, nil), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(qType uint16) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queried[qType]
+	}
+
+	exec(dns.TypeA)
+	deadline := time.Now().Add(time.Second)
+	for count(dns.TypeHTTPS) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if count(dns.TypeHTTPS) != 1 {
+		t.Fatal("https record was not prefetched")
+	}
+	time.Sleep(time.Millisecond * 50) // wait for the cache store
+
+	exec(dns.TypeHTTPS) // cache hit, no prefetch
+	if n := count(dns.TypeHTTPS); n != 1 {
+		t.Fatalf("https query was not served from cache, %d queries", n)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := count(dns.TypeAAAA); n != 0 {
+		t.Fatalf("unexpected aaaa prefetch on cache hit, %d queries", n)
+	}
+}
+
+type execFunc func(qCtx *query_context.Context)
+
+func (f execFunc) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	f(qCtx)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+)
+
+// clusterChannel replicates cache entries. Data is a sequence of
+// entries, each is
+//
+//	[4 bytes length][8 stored unix ms][8 expiration unix ms][2 key length][key][value]
+//
+// Peers must have the same cache key and compression settings.
+type clusterChannel struct {
+	c       *cachePlugin
+	cluster *cluster.Cluster
+}
+
+var _ cluster.Channel = (*clusterChannel)(nil)
+
+const entryHeaderLen = 8 + 8 + 2
+
+func (c *cachePlugin) joinCluster() error {
+	cl, err := c.M().GetCluster()
+	if err != nil {
+		return err
+	}
+	ch := &clusterChannel{c: c, cluster: cl}
+	if err := cl.Register(c.Tag(), ch); err != nil {
+		return err
+	}
+	c.cluster = ch
+	return nil
+}
+
+func appendEntry(b []byte, key string, v []byte, storedTime, expirationTime time.Time) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(entryHeaderLen+len(key)+len(v)))
+	b = binary.BigEndian.AppendUint64(b, uint64(storedTime.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(expirationTime.UnixMilli()))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+	b = append(b, key...)
+	return append(b, v...)
+}
+
+// publish sends a stored entry to peers.
+func (ch *clusterChannel) publish(key string, v []byte, storedTime, expirationTime time.Time) {
+	if len(key) > 0xffff {
+		return
+	}
+	ch.cluster.Publish(ch.c.Tag(), appendEntry(nil, key, v, storedTime, expirationTime))
+}
+
+// entryRanger is implemented by memory backends.
+type entryRanger interface {
+	Range(f func(key string, v []byte, storedTime, expirationTime time.Time))
+}
+
+// appendEntries appends all entries of r to b.
+func appendEntries(b []byte, r entryRanger) []byte {
+	r.Range(func(key string, v []byte, storedTime, expirationTime time.Time) {
+		if len(key) <= 0xffff {
+			b = appendEntry(b, key, v, storedTime, expirationTime)
+		}
+	})
+	return b
+}
+
+var errInvalidEntry = errors.New("invalid entry")
+
+// storeEntries stores entries in b into backend. Expired entries are
+// dropped by the backend.
+func storeEntries(backend cache.Backend, b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errInvalidEntry
+		}
+		l := int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if l < entryHeaderLen || l > len(b) {
+			return errInvalidEntry
+		}
+		e := b[:l]
+		b = b[l:]
+
+		storedTime := time.UnixMilli(int64(binary.BigEndian.Uint64(e)))
+		expirationTime := time.UnixMilli(int64(binary.BigEndian.Uint64(e[8:])))
+		kl := int(binary.BigEndian.Uint16(e[16:]))
+		if entryHeaderLen+kl > len(e) {
+			return errInvalidEntry
+		}
+		key := string(e[entryHeaderLen : entryHeaderLen+kl])
+		backend.Store(key, e[entryHeaderLen+kl:], storedTime, expirationTime)
+	}
+	return nil
+}
+
+// Snapshot returns all entries of the memory backend. Shared backends
+// (redis) do not need snapshots.
+func (ch *clusterChannel) Snapshot() ([]byte, error) {
+	r, ok := ch.c.backend.(entryRanger)
+	if !ok {
+		return nil, nil
+	}
+	return appendEntries(nil, r), nil
+}
+
+func (ch *clusterChannel) Apply(b []byte) error {
+	return storeEntries(ch.c.backend, b)
+}
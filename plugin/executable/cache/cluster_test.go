@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+)
+
+func Test_clusterChannel(t *testing.T) {
+	src := &clusterChannel{c: &cachePlugin{backend: mem_cache.NewMemCache(1024, 0)}}
+	dst := &clusterChannel{c: &cachePlugin{backend: mem_cache.NewMemCache(1024, 0)}}
+	defer src.c.backend.Close()
+	defer dst.c.backend.Close()
+
+	now := time.Now().Truncate(time.Millisecond)
+	src.c.backend.Store("k1", []byte("v1"), now, now.Add(time.Minute))
+	src.c.backend.Store("k2", []byte("v2"), now, now.Add(time.Minute))
+
+	b, err := src.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Apply(appendEntry(nil, "k3", []byte("v3"), now, now.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"k1", "k2", "k3"} {
+		v, stored, expire := dst.c.backend.Get(k)
+		if !bytes.Equal(v, []byte("v"+k[1:])) || !stored.Equal(now) || !expire.Equal(now.Add(time.Minute)) {
+			t.Fatalf("%s: got %q %s %s", k, v, stored, expire)
+		}
+	}
+
+	if err := dst.Apply(b[:len(b)-1]); err == nil {
+		t.Fatal("truncated data should fail")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const defaultSaveInterval = time.Second * 300
+
+// Persisted entries use the same format as cluster replication. Times
+// are absolute, so entries keep their remaining ttls and the ones that
+// expired while mosdns was down are dropped on loading.
+
+// loadPersist loads entries from the persist file. A broken file is
+// not fatal, entries before the broken one are kept.
+func (c *cachePlugin) loadPersist() {
+	b, err := os.ReadFile(c.args.Persist)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.L().Warn("failed to read cache persist file", zap.Error(err))
+		}
+		return
+	}
+	if err := storeEntries(c.backend, b); err != nil {
+		c.L().Warn("broken cache persist file", zap.Error(err))
+	}
+	c.L().Info("cache loaded", zap.Int("length", c.backend.Len()))
+}
+
+// save writes all entries to the persist file atomically.
+func (c *cachePlugin) save() error {
+	r, ok := c.backend.(entryRanger)
+	if !ok {
+		return nil
+	}
+	b := appendEntries(nil, r)
+	return utils.WriteFileAtomic(c.args.Persist, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+func (c *cachePlugin) saveLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	interval := defaultSaveInterval
+	if c.args.SaveInterval > 0 {
+		interval = time.Duration(c.args.SaveInterval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				c.L().Warn("failed to save cache", zap.Error(err))
+			}
+		case <-closeSignal:
+			if err := c.save(); err != nil {
+				c.L().Warn("failed to save cache", zap.Error(err))
+			}
+			return
+		}
+	}
+}
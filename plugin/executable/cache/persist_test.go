@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+)
+
+func Test_cachePlugin_persist(t *testing.T) {
+	args := &Args{Persist: filepath.Join(t.TempDir(), "cache.dump")}
+	newPlugin := func() *cachePlugin {
+		return &cachePlugin{
+			BP:      coremain.NewBP("test", PluginType, nil, nil),
+			args:    args,
+			backend: mem_cache.NewMemCache(1024, 0),
+		}
+	}
+	src := newPlugin()
+	defer src.backend.Close()
+
+	now := time.Now().Truncate(time.Millisecond)
+	src.backend.Store("k1", []byte("v1"), now, now.Add(time.Minute))
+	src.backend.Store("k2", []byte("v2"), now.Add(-time.Minute), now.Add(time.Millisecond*50))
+	if err := src.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 100) // k2 expires
+	dst := newPlugin()
+	defer dst.backend.Close()
+	dst.loadPersist()
+	if v, stored, expire := dst.backend.Get("k1"); !bytes.Equal(v, []byte("v1")) || !stored.Equal(now) || !expire.Equal(now.Add(time.Minute)) {
+		t.Fatalf("k1: got %q %s %s", v, stored, expire)
+	}
+	if v, _, _ := dst.backend.Get("k2"); v != nil {
+		t.Fatal("expired entry should not be loaded")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/layered_cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/redis_cache"
+)
+
+const defaultRedisL1TTL = time.Second * 30
+
+func newRedisBackend(bp *coremain.BP, args *Args) (cache.Backend, error) {
+	r, err := newRedisClient(args.Redis, args.RedisCluster)
+	if err != nil {
+		return nil, err
+	}
+	rcOpts := redis_cache.RedisCacheOpts{
+		Client:        r,
+		ClientCloser:  r,
+		ClientTimeout: time.Duration(args.RedisTimeout) * time.Millisecond,
+		Logger:        bp.L(),
+	}
+	rc, err := redis_cache.NewRedisCache(rcOpts)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to init redis cache, %w", err)
+	}
+	if args.RedisL1Size <= 0 {
+		return rc, nil
+	}
+	l1TTL := defaultRedisL1TTL
+	if args.RedisL1TTL > 0 {
+		l1TTL = time.Duration(args.RedisL1TTL) * time.Second
+	}
+	return layered_cache.NewLayeredCache(mem_cache.NewMemCache(args.RedisL1Size, 0), rc, l1TTL), nil
+}
+
+// newRedisClient parses the redis url s. If cluster is true, hosts of
+// s are comma separated cluster nodes, e.g.
+// "redis://:password@10.0.0.1:6379,10.0.0.2:6379".
+func newRedisClient(s string, cluster bool) (redis.UniversalClient, error) {
+	if !cluster {
+		opt, err := redis.ParseURL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url, %w", err)
+		}
+		opt.MaxRetries = -1
+		return redis.NewClient(opt), nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url, %w", err)
+	}
+	addrs := strings.Split(u.Host, ",")
+	u.Host = addrs[0]
+	opt, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url, %w", err)
+	}
+	if opt.DB != 0 {
+		return nil, errors.New("redis cluster has no db")
+	}
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:        addrs,
+		Username:     opt.Username,
+		Password:     opt.Password,
+		MaxRetries:   -1,
+		DialTimeout:  opt.DialTimeout,
+		ReadTimeout:  opt.ReadTimeout,
+		WriteTimeout: opt.WriteTimeout,
+		PoolSize:     opt.PoolSize,
+		MinIdleConns: opt.MinIdleConns,
+		IdleTimeout:  opt.IdleTimeout,
+		TLSConfig:    opt.TLSConfig,
+	}), nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func Test_newRedisClient(t *testing.T) {
+	c, err := newRedisClient("redis://:pw@10.0.0.1:6379,10.0.0.2:6380", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, ok := c.(*redis.ClusterClient)
+	if !ok {
+		t.Fatalf("want a cluster client, got %T", c)
+	}
+	opt := cc.Options()
+	if want := []string{"10.0.0.1:6379", "10.0.0.2:6380"}; !reflect.DeepEqual(opt.Addrs, want) || opt.Password != "pw" {
+		t.Fatalf("unexpected options, addrs %v, password %s", opt.Addrs, opt.Password)
+	}
+
+	if _, err := newRedisClient("redis://10.0.0.1:6379/1", true); err == nil {
+		t.Fatal("cluster with db should be rejected")
+	}
+	c, err = newRedisClient("redis://10.0.0.1:6379/1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const (
+	defaultStaleReplyTTL = 30               // RFC 8767 section 4
+	staleRecheckInterval = time.Second * 30 // failure recheck timer of RFC 8767
+	staleFailedSize      = 4096
+)
+
+// recentlyFailed reports whether upstreams failed to answer msgKey in the
+// last staleRecheckInterval.
+func (c *cachePlugin) recentlyFailed(msgKey string) bool {
+	t, ok := c.staleFailed.Get(msgKey)
+	return ok && time.Since(t) < staleRecheckInterval
+}
+
+// lookupStale returns the stale entry of msgKey with the ttl and id of
+// the response to qCtx, or nil if there is no such entry.
+func (c *cachePlugin) lookupStale(msgKey string, qCtx *query_context.Context) *dns.Msg {
+	r, _, expirationTime, err := c.getMsg(msgKey)
+	if err != nil {
+		c.L().Error("lookup stale cache", qCtx.InfoField(), zap.Error(err))
+	}
+	if r == nil || !expirationTime.After(time.Now()) {
+		return nil
+	}
+	dnsutils.SetTTL(r, uint32(c.args.StaleReplyTTL))
+	r.Id = qCtx.Q().Id
+	return r
+}
+
+func (c *cachePlugin) setStaleResp(qCtx *query_context.Context, r *dns.Msg) {
+	c.staleTotal.Inc()
+	qCtx.SetResponse(r)
+	query_context.SetValue(qCtx, KeyHit, true)
+	qCtx.Tracef("%s: serving stale", c.Tag())
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/cache/layered_cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// flakyExec answers A queries with 1.2.3.4 unless fail is set.
+type flakyExec struct {
+	fail    atomic.Bool
+	queries atomic.Int32
+}
+
+func (e *flakyExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	e.queries.Add(1)
+	if e.fail.Load() {
+		return errors.New("upstream failed")
+	}
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+	r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(1, 2, 3, 4)})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_serveStale(t *testing.T) {
+	c := &cachePlugin{
+		BP:          coremain.NewBP("test", PluginType, nil, new(coremain.Mosdns)),
+		args:        &Args{ServeStale: 60, StaleReplyTTL: 30},
+		backend:     mem_cache.NewMemCache(1024, 0),
+		staleFailed: concurrent_lru.NewShardedLRU[time.Time](1, 16, nil),
+		queryTotal:  prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+		hitTotal:    prometheus.NewCounter(prometheus.CounterOpts{Name: "hit_total"}),
+		staleTotal:  prometheus.NewCounter(prometheus.CounterOpts{Name: "stale_total"}),
+	}
+	defer c.backend.Close()
+	upstream := new(flakyExec)
+	next := executable_seq.WrapExecutable(upstream)
+
+	exec := func(name string) (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		err := c.Exec(context.Background(), qCtx, next)
+		return qCtx.R(), err
+	}
+
+	// An entry with a ttl of 10s that was stored 20s ago.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IPv4(5, 6, 7, 8),
+	})
+	key, err := c.getMsgKey(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.backend.Store(key, v, now.Add(-time.Second*20), now.Add(time.Second*50))
+
+	upstream.fail.Store(true)
+	resp, err := exec("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("unexpected stale response %v", resp)
+	}
+	if _, err := exec("other.com."); err == nil {
+		t.Fatal("query without stale entry should fail")
+	}
+
+	// The entry is served at once and refreshed in the background.
+	upstream.fail.Store(false)
+	queries := upstream.queries.Load()
+	if resp, err = exec("example.com."); err != nil || resp == nil || resp.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("stale entry was not served after a recent failure, %v, %v", resp, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for upstream.queries.Load() == queries && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50) // wait for the cache store
+	if resp, err = exec("example.com."); err != nil || resp == nil || dnsutils.GetMinimalTTL(resp) < 299 {
+		t.Fatalf("stale entry was not refreshed, %v, %v", resp, err)
+	}
+}
+
+// The stale window must not be cut by the l1 ttl of redis_l1.
+func Test_cachePlugin_serveStaleL1(t *testing.T) {
+	c := &cachePlugin{
+		BP:          coremain.NewBP("test", PluginType, nil, new(coremain.Mosdns)),
+		args:        &Args{ServeStale: 60, StaleReplyTTL: 30},
+		backend:     layered_cache.NewLayeredCache(mem_cache.NewMemCache(1024, 0), mem_cache.NewMemCache(1024, 0), time.Millisecond*20),
+		staleFailed: concurrent_lru.NewShardedLRU[time.Time](1, 16, nil),
+		queryTotal:  prometheus.NewCounter(prometheus.CounterOpts{Name: "query_total"}),
+		hitTotal:    prometheus.NewCounter(prometheus.CounterOpts{Name: "hit_total"}),
+		staleTotal:  prometheus.NewCounter(prometheus.CounterOpts{Name: "stale_total"}),
+	}
+	defer c.backend.Close()
+	upstream := new(flakyExec)
+	next := executable_seq.WrapExecutable(upstream)
+
+	exec := func() (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q, nil)
+		err := c.Exec(context.Background(), qCtx, next)
+		return qCtx.R(), err
+	}
+
+	if _, err := exec(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50) // l1 entry expired
+	if _, err := exec(); err != nil {
+		t.Fatal(err)
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("fresh entry was not served from l2, %d upstream queries", n)
+	}
+
+	// Make the entry stale. It's still in l2.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	key, _ := c.getMsgKey(q)
+	v, _, _ := c.backend.Get(key)
+	now := time.Now()
+	c.backend.Store(key, v, now.Add(-time.Second*400), now.Add(time.Second*50))
+	time.Sleep(time.Millisecond * 50)
+
+	upstream.fail.Store(true)
+	resp, err := exec()
+	if err != nil || resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("unexpected stale response %v, %v", resp, err)
+	}
+}
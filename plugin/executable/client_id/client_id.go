@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_id
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/neighbor"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "client_id"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*clientID)(nil)
+
+// Args configures the client (device) id that is added to queries as
+// the edns0 option 65074, so upstreams like NextDNS and AdGuard DNS can
+// apply per-device settings to clients behind one ip.
+type Args struct {
+	// From are sources of client ids. They are tried in order and the
+	// first non-empty id is used.
+	//  - "edns0": the id sent by the client, e.g. dnsmasq --add-cpe-id.
+	//  - "doh_path": the last segment of the DoH path, e.g.
+	//    "/dns-query/kids-tablet".
+	//  - "sni:<server_name>": the first label of the tls server name,
+	//    e.g. "sni:dns.example.com" and "kids-tablet.dns.example.com".
+	//  - "mac": the client mac address, see client_profile.
+	//  - "name": the client name, see client_names.
+	From []string `yaml:"from"`
+	// ID is used if no id is found in From.
+	ID string `yaml:"id"`
+	// Strip removes ids sent by clients if no id is found, so they
+	// are not forwarded to upstreams.
+	Strip   bool   `yaml:"strip"`
+	ARPFile string `yaml:"arp_file"` // Default is /proc/net/arp.
+}
+
+type idSource func(qCtx *query_context.Context) string
+
+type clientID struct {
+	*coremain.BP
+	args *Args
+
+	sources []idSource
+	arp     *neighbor.ARPTable // nil if mac is not a source
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newClientID(bp, args.(*Args))
+}
+
+func newClientID(bp *coremain.BP, args *Args) (*clientID, error) {
+	c := &clientID{BP: bp, args: args}
+	for _, s := range args.From {
+		src, err := c.newSource(s)
+		if err != nil {
+			return nil, err
+		}
+		c.sources = append(c.sources, src)
+	}
+	return c, nil
+}
+
+func (c *clientID) newSource(s string) (idSource, error) {
+	switch {
+	case s == "edns0":
+		return func(qCtx *query_context.Context) string {
+			id, _ := dnsutils.GetClientID(qCtx.Q())
+			return id
+		}, nil
+	case s == "doh_path":
+		return idFromDoHPath, nil
+	case strings.HasPrefix(s, "sni:"):
+		suffix := "." + strings.Trim(s[4:], ".")
+		if len(suffix) == 1 {
+			return nil, fmt.Errorf("invalid source %s, missing server name", s)
+		}
+		return func(qCtx *query_context.Context) string {
+			return idFromServerName(qCtx.ReqMeta().GetServerName(), suffix)
+		}, nil
+	case s == "mac":
+		if c.arp == nil {
+			f := c.args.ARPFile
+			if len(f) == 0 {
+				f = neighbor.DefaultARPFile
+			}
+			c.arp = neighbor.NewARPTable(f)
+		}
+		return func(qCtx *query_context.Context) string {
+			mac, _ := neighbor.ClientMAC(qCtx.Q(), qCtx.ReqMeta().GetClientAddr(), c.arp)
+			return mac
+		}, nil
+	case s == "name":
+		return func(qCtx *query_context.Context) string {
+			return qCtx.ReqMeta().GetClientName()
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid source %s", s)
+	}
+}
+
+// idFromDoHPath returns the last segment of paths that have more than
+// one segment.
+func idFromDoHPath(qCtx *query_context.Context) string {
+	r := qCtx.ReqMeta().GetHTTPRequest()
+	if r == nil {
+		return ""
+	}
+	p := strings.Trim(r.Path, "/")
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return ""
+	}
+	return p[i+1:]
+}
+
+// idFromServerName returns the first label of name if the rest of it
+// is suffix.
+func idFromServerName(name, suffix string) string {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) <= len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return ""
+	}
+	id := name[:len(name)-len(suffix)]
+	if strings.Contains(id, ".") {
+		return ""
+	}
+	return id
+}
+
+func (c *clientID) clientID(qCtx *query_context.Context) string {
+	for _, src := range c.sources {
+		if id := src(qCtx); len(id) > 0 {
+			return id
+		}
+	}
+	return c.args.ID
+}
+
+func (c *clientID) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	upgraded := false
+	if id := c.clientID(qCtx); len(id) > 0 {
+		upgraded = dnsutils.SetClientID(q, id)
+		qCtx.Tracef("client id %s", id)
+	} else if c.args.Strip {
+		dnsutils.RemoveClientID(q)
+	}
+
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		if upgraded {
+			dnsutils.RemoveEDNS0(r)
+		} else {
+			dnsutils.RemoveClientID(r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_id
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_clientID(t *testing.T) {
+	c, err := newClientID(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		From: []string{"edns0", "doh_path", "sni:dns.example.com", "name"},
+		ID:   "home",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCtx := func(f func(q *dns.Msg, meta *query_context.RequestMeta)) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		meta := query_context.NewRequestMeta(netip.MustParseAddr("192.168.1.2"))
+		if f != nil {
+			f(q, meta)
+		}
+		return query_context.NewContext(q, meta)
+	}
+	tests := []struct {
+		name string
+		qCtx *query_context.Context
+		want string
+	}{
+		{"edns0", newCtx(func(q *dns.Msg, _ *query_context.RequestMeta) { dnsutils.SetClientID(q, "router") }), "router"},
+		{"doh path", newCtx(func(_ *dns.Msg, meta *query_context.RequestMeta) {
+			meta.SetHTTPRequest(&query_context.HTTPRequest{Path: "/dns-query/kids-tablet"})
+		}), "kids-tablet"},
+		{"doh path without id", newCtx(func(_ *dns.Msg, meta *query_context.RequestMeta) {
+			meta.SetHTTPRequest(&query_context.HTTPRequest{Path: "/dns-query"})
+		}), "home"},
+		{"sni", newCtx(func(_ *dns.Msg, meta *query_context.RequestMeta) { meta.SetServerName("laptop.dns.example.com") }), "laptop"},
+		{"sni without id", newCtx(func(_ *dns.Msg, meta *query_context.RequestMeta) { meta.SetServerName("dns.example.com") }), "home"},
+		{"name", newCtx(func(_ *dns.Msg, meta *query_context.RequestMeta) { meta.SetClientName("TV") }), "TV"},
+		{"default", newCtx(nil), "home"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Exec(context.Background(), tt.qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			if id, _ := dnsutils.GetClientID(tt.qCtx.Q()); id != tt.want {
+				t.Fatalf("want client id %s, got %s", tt.want, id)
+			}
+		})
+	}
+}
+
+func Test_clientID_strip(t *testing.T) {
+	c, err := newClientID(coremain.NewBP("test", PluginType, nil, nil), &Args{Strip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	dnsutils.SetClientID(q, "router")
+	qCtx := query_context.NewContext(q, nil)
+	if err := c.Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dnsutils.GetClientID(qCtx.Q()); ok {
+		t.Fatal("client id should be stripped")
+	}
+
+	if _, err := newClientID(coremain.NewBP("test", PluginType, nil, nil), &Args{From: []string{"sni:"}}); err == nil {
+		t.Fatal("sni without server name should be rejected")
+	}
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_names
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/neighbor"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "client_names"
+
+const (
+	ptrTimeout     = time.Second * 2
+	maxConcurrency = 8 // of background lookups
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*clientNames)(nil)
+
+type Args struct {
+	// Names are manual names, "client name", e.g. "192.168.1.23 Ana's
+	// iPhone" or "aa:bb:cc:dd:ee:ff Living room TV". client is an ip, a
+	// cidr or a mac address. Macs are from the edns0 option 65001
+	// (dnsmasq --add-mac) or the arp table, so they also name clients
+	// with rotating ipv6 privacy addresses behind dnsmasq. Manual names
+	// take precedence over learned names.
+	Names   []string `yaml:"names"`
+	ARPFile string   `yaml:"arp_file"` // Default is /proc/net/arp.
+
+	// Sources are tags of the plugins that names of local clients are
+	// learned from, e.g. hosts, dhcp_lease and mdns. They are looked up
+	// in order, in the background, so the first queries of a new client
+	// are not named.
+	Sources []string `yaml:"sources"`
+	// PTRServer is a dns server, e.g. the router "192.168.1.1", that
+	// names of local clients are learned from by PTR queries. It is
+	// looked up after Sources. Optional.
+	PTRServer string `yaml:"ptr_server"`
+
+	TTL         int `yaml:"ttl"`          // (sec) of learned names. Default is 3600.
+	NegativeTTL int `yaml:"negative_ttl"` // (sec) of clients without names. Default is 300.
+	MaxClients  int `yaml:"max_clients"`  // with learned names. Default is 4096.
+}
+
+func (a *Args) init() {
+	if len(a.ARPFile) == 0 {
+		a.ARPFile = neighbor.DefaultARPFile
+	}
+	utils.SetDefaultNum(&a.TTL, 3600)
+	utils.SetDefaultNum(&a.NegativeTTL, 300)
+	utils.SetDefaultNum(&a.MaxClients, 4096)
+}
+
+// nameSource is implemented by plugins that know the host names of
+// local addresses.
+type nameSource interface {
+	LookupPTR(addr netip.Addr) (string, bool)
+}
+
+type prefixName struct {
+	p    netip.Prefix
+	name string
+}
+
+type learnedName struct {
+	name   string // empty if the client has no name
+	expire time.Time
+}
+
+type clientNames struct {
+	*coremain.BP
+	args *Args
+
+	addrs    map[netip.Addr]string
+	prefixes []prefixName
+	macs     map[string]string
+	arp      *neighbor.ARPTable // nil if no mac is named
+
+	sources []nameSource
+	learned *concurrent_lru.ConcurrentLRU[netip.Addr, *learnedName]
+	sem     chan struct{}
+	pm      sync.Mutex
+	pending map[netip.Addr]struct{}
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newClientNames(bp, args.(*Args))
+}
+
+func newClientNames(bp *coremain.BP, args *Args) (*clientNames, error) {
+	args.init()
+	c := &clientNames{
+		BP:      bp,
+		args:    args,
+		addrs:   make(map[netip.Addr]string),
+		macs:    make(map[string]string),
+		learned: concurrent_lru.NewConecurrentLRU[netip.Addr, *learnedName](args.MaxClients, nil),
+		sem:     make(chan struct{}, maxConcurrency),
+		pending: make(map[netip.Addr]struct{}),
+	}
+	for _, s := range args.Names {
+		if err := c.addName(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.macs) > 0 {
+		c.arp = neighbor.NewARPTable(args.ARPFile)
+	}
+
+	for _, tag := range args.Sources {
+		e := bp.M().GetExecutables()[tag]
+		if e == nil {
+			return nil, fmt.Errorf("cannot find plugin %s", tag)
+		}
+		s, ok := e.(nameSource)
+		if !ok {
+			return nil, fmt.Errorf("plugin %s cannot provide host names", tag)
+		}
+		c.sources = append(c.sources, s)
+	}
+	if len(args.PTRServer) > 0 {
+		addr := args.PTRServer
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		c.sources = append(c.sources, &ptrServer{addr: addr})
+	}
+	return c, nil
+}
+
+// addName parses a "client name" line.
+func (c *clientNames) addName(s string) error {
+	client, name, ok := strings.Cut(strings.TrimSpace(s), " ")
+	name = strings.TrimSpace(name)
+	if !ok || len(name) == 0 {
+		return fmt.Errorf("invalid name %q", s)
+	}
+	if hw, err := net.ParseMAC(client); err == nil {
+		c.macs[hw.String()] = name
+		return nil
+	}
+	if strings.Contains(client, "/") {
+		p, err := netip.ParsePrefix(client)
+		if err != nil {
+			return fmt.Errorf("invalid client %s, %w", client, err)
+		}
+		c.prefixes = append(c.prefixes, prefixName{p: p.Masked(), name: name})
+		return nil
+	}
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return fmt.Errorf("invalid client %s, %w", client, err)
+	}
+	c.addrs[addr.Unmap()] = name
+	return nil
+}
+
+// Exec sets the name of the client, then executes next.
+func (c *clientNames) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if name, ok := c.lookup(qCtx.Q(), qCtx.ReqMeta().GetClientAddr().Unmap()); ok {
+		qCtx.ReqMeta().SetClientName(name)
+		qCtx.Tracef("%s: client %s", c.Tag(), name)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// lookup returns the name of the client of q. Names of unknown local
+// clients are learned in the background.
+func (c *clientNames) lookup(q *dns.Msg, addr netip.Addr) (string, bool) {
+	if len(c.macs) > 0 {
+		if mac, ok := neighbor.ClientMAC(q, addr, c.arp); ok {
+			if name, ok := c.macs[mac]; ok {
+				return name, true
+			}
+		}
+	}
+	if !addr.IsValid() {
+		return "", false
+	}
+	if name, ok := c.addrs[addr]; ok {
+		return name, true
+	}
+	for _, p := range c.prefixes {
+		if p.p.Contains(addr) {
+			return p.name, true
+		}
+	}
+	if len(c.sources) == 0 {
+		return "", false
+	}
+	if e, ok := c.learned.Get(addr); ok && time.Now().Before(e.expire) {
+		return e.name, len(e.name) > 0
+	}
+	if addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLoopback() {
+		c.learnAsync(addr)
+	}
+	return "", false
+}
+
+// learnAsync learns the name of addr in the background. It does nothing
+// if addr is being learned or there are too many lookups.
+func (c *clientNames) learnAsync(addr netip.Addr) {
+	c.pm.Lock()
+	if _, ok := c.pending[addr]; ok {
+		c.pm.Unlock()
+		return
+	}
+	select {
+	case c.sem <- struct{}{}:
+	default:
+		c.pm.Unlock()
+		return
+	}
+	c.pending[addr] = struct{}{}
+	c.pm.Unlock()
+
+	go func() {
+		defer func() {
+			c.pm.Lock()
+			delete(c.pending, addr)
+			c.pm.Unlock()
+			<-c.sem
+		}()
+		c.learn(addr)
+	}()
+}
+
+// learn looks up the name of addr from sources, and caches it.
+func (c *clientNames) learn(addr netip.Addr) {
+	e := &learnedName{expire: time.Now().Add(time.Duration(c.args.NegativeTTL) * time.Second)}
+	for _, s := range c.sources {
+		if name, ok := s.LookupPTR(addr); ok {
+			e.name = strings.TrimSuffix(name, ".")
+			e.expire = time.Now().Add(time.Duration(c.args.TTL) * time.Second)
+			c.L().Debug("client name learned", zap.Stringer("addr", addr), zap.String("name", e.name))
+			break
+		}
+	}
+	c.learned.Add(addr, e)
+}
+
+type clientEntry struct {
+	Client  string `json:"client"`
+	Name    string `json:"name"`
+	Learned bool   `json:"learned,omitempty"`
+}
+
+// ServeHTTP lists named clients.
+func (c *clientNames) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var es []clientEntry
+	for mac, name := range c.macs {
+		es = append(es, clientEntry{Client: mac, Name: name})
+	}
+	for addr, name := range c.addrs {
+		es = append(es, clientEntry{Client: addr.String(), Name: name})
+	}
+	for _, p := range c.prefixes {
+		es = append(es, clientEntry{Client: p.p.String(), Name: p.name})
+	}
+	now := time.Now()
+	c.learned.Range(func(addr netip.Addr, e *learnedName) bool {
+		if len(e.name) > 0 && now.Before(e.expire) {
+			es = append(es, clientEntry{Client: addr.String(), Name: e.name, Learned: true})
+		}
+		return true
+	})
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Name != es[j].Name {
+			return es[i].Name < es[j].Name
+		}
+		return es[i].Client < es[j].Client
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(es); err != nil {
+		c.L().Warn("failed to write client names", zap.Error(err))
+	}
+}
+
+// ptrServer looks up host names by PTR queries to a dns server.
+type ptrServer struct {
+	addr string
+}
+
+func (s *ptrServer) LookupPTR(addr netip.Addr) (string, bool) {
+	name, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return "", false
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypePTR)
+	ctx, cancel := context.WithTimeout(context.Background(), ptrTimeout)
+	defer cancel()
+	r, _, err := (&dns.Client{}).ExchangeContext(ctx, q, s.addr)
+	if err != nil || r.Rcode != dns.RcodeSuccess {
+		return "", false
+	}
+	for _, rr := range r.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return ptr.Ptr, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_names
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/neighbor"
+)
+
+type mapSource map[netip.Addr]string
+
+func (s mapSource) LookupPTR(addr netip.Addr) (string, bool) {
+	name, ok := s[addr]
+	return name, ok
+}
+
+func newQuery() *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	return q
+}
+
+func Test_clientNames_manual(t *testing.T) {
+	c, err := newClientNames(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		Names: []string{
+			"192.168.1.23 Ana's iPhone",
+			"192.168.2.0/24 Guests",
+			"aa:bb:cc:dd:ee:ff Living room TV",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newQuery()
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.23", "Ana's iPhone"},
+		{"192.168.2.9", "Guests"},
+		{"192.168.3.1", ""},
+	}
+	for _, tt := range tests {
+		name, _ := c.lookup(q, netip.MustParseAddr(tt.addr))
+		if name != tt.want {
+			t.Errorf("lookup(%s) = %q, want %q", tt.addr, name, tt.want)
+		}
+	}
+
+	opt := q.SetEdns0(1232, false).IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: neighbor.EDNS0MACOption, Data: []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}})
+	if name, _ := c.lookup(q, netip.MustParseAddr("2001:db8::1234")); name != "Living room TV" {
+		t.Fatalf("unexpected name %q of the mac", name)
+	}
+}
+
+func Test_clientNames_invalid(t *testing.T) {
+	for _, s := range []string{"192.168.1.1", "192.168.1.1 ", "host name"} {
+		_, err := newClientNames(coremain.NewBP("test", PluginType, nil, nil), &Args{Names: []string{s}})
+		if err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func Test_clientNames_learn(t *testing.T) {
+	c, err := newClientNames(coremain.NewBP("test", PluginType, nil, nil), &Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := netip.MustParseAddr("192.168.1.2")
+	c.sources = []nameSource{mapSource{}, mapSource{known: "nas.lan."}}
+
+	q := newQuery()
+	if _, ok := c.lookup(q, known); ok {
+		t.Fatal("names are learned in the background")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if name, ok := c.lookup(q, known); ok {
+			if name != "nas.lan" {
+				t.Fatalf("unexpected learned name %q", name)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("name was not learned")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	unknown := netip.MustParseAddr("192.168.1.3")
+	c.learn(unknown)
+	if _, ok := c.lookup(q, unknown); ok {
+		t.Fatal("unknown client should not have a name")
+	}
+
+	public := netip.MustParseAddr("8.8.8.8")
+	c.lookup(q, public)
+	time.Sleep(time.Millisecond * 10)
+	if _, ok := c.learned.Get(public); ok {
+		t.Fatal("names of public clients should not be learned")
+	}
+}
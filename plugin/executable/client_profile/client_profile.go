@@ -0,0 +1,377 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_profile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/matcher/msg_matcher"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/neighbor"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "client_profile"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*clientProfile)(nil)
+
+// KeyProfile is the name of the matched profile.
+var KeyProfile = query_context.NewKey[string]("client_profile.profile")
+
+type Args struct {
+	// Profiles are matched in order. The first matched profile is used.
+	Profiles []ProfileConfig `yaml:"profiles"`
+	// Default is the name of the profile for unmatched clients.
+	// If empty, unmatched queries go to next directly.
+	Default string `yaml:"default"`
+	// ARPFile is used to lookup mac addresses of clients.
+	// Default is "/proc/net/arp".
+	ARPFile string `yaml:"arp_file"`
+	// Timezone of schedules, e.g. "Asia/Shanghai". Default is local time.
+	Timezone string `yaml:"timezone"`
+}
+
+type ProfileConfig struct {
+	Name string `yaml:"name"`
+
+	// Clients: ip/cidr, "provider:" data providers of ip lists,
+	// "mac:aa:bb:cc:dd:ee:ff", "id:<pattern>" of client ids, or
+	// "tag:<matcher_tag>" that refers to a matcher plugin, e.g. a marker.
+	// Macs are read from the edns0 option 65001 (dnsmasq --add-mac)
+	// or the arp table. Client ids are read from the edns0 option 65074
+	// (dnsmasq --add-cpe-id) and support wildcards.
+	Clients []string `yaml:"clients"`
+
+	// Exec is the pipeline of this profile. Same as sequence exec.
+	Exec interface{} `yaml:"exec"`
+	// Block replies NXDOMAIN to matched domains. Same as query_matcher domain.
+	Block      []string `yaml:"block"`
+	SafeSearch bool     `yaml:"safe_search"`
+	// LogLevel logs every query of this profile at the level.
+	// "debug", "info", "warn". Empty disables it.
+	LogLevel string `yaml:"log_level"`
+	// Schedules block domain sets during weekly time windows.
+	Schedules []ScheduleConfig `yaml:"schedules"`
+}
+
+type clientProfile struct {
+	*coremain.BP
+	profiles   []*profile
+	defaultP   *profile
+	arp        *neighbor.ARPTable
+	safeSearch *domain.MixMatcher[string]
+	loc        *time.Location
+	closer     []io.Closer
+}
+
+type profile struct {
+	name     string
+	ips      *netlist.MatcherGroup // maybe nil
+	macs     map[string]struct{}
+	matchers []executable_seq.Matcher
+
+	exec       executable_seq.ExecutableChainNode
+	block      *domain.MatcherGroup[struct{}] // maybe nil
+	schedules  []*schedule
+	safeSearch bool
+	logLevel   zapcore.Level
+	log        bool
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newClientProfile(bp, args.(*Args))
+}
+
+func newClientProfile(bp *coremain.BP, args *Args) (*clientProfile, error) {
+	if len(args.Profiles) == 0 {
+		return nil, errors.New("no profile is configured")
+	}
+	if len(args.ARPFile) == 0 {
+		args.ARPFile = neighbor.DefaultARPFile
+	}
+	c := &clientProfile{BP: bp, arp: neighbor.NewARPTable(args.ARPFile), loc: time.Local}
+	if len(args.Timezone) > 0 {
+		loc, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone, %w", err)
+		}
+		c.loc = loc
+	}
+
+	names := make(map[string]*profile)
+	for i := range args.Profiles {
+		pc := &args.Profiles[i]
+		if len(pc.Name) == 0 {
+			c.Close()
+			return nil, fmt.Errorf("profile #%d has no name", i)
+		}
+		if _, dup := names[pc.Name]; dup {
+			c.Close()
+			return nil, fmt.Errorf("duplicated profile %s", pc.Name)
+		}
+		p, err := c.newProfile(pc)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to init profile %s, %w", pc.Name, err)
+		}
+		names[pc.Name] = p
+		c.profiles = append(c.profiles, p)
+		if p.safeSearch && c.safeSearch == nil {
+			if c.safeSearch, err = newSafeSearchMatcher(); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	if len(args.Default) > 0 {
+		c.defaultP = names[args.Default]
+		if c.defaultP == nil {
+			c.Close()
+			return nil, fmt.Errorf("default profile %s not found", args.Default)
+		}
+	}
+	return c, nil
+}
+
+func (c *clientProfile) newProfile(pc *ProfileConfig) (*profile, error) {
+	p := &profile{name: pc.Name, macs: make(map[string]struct{}), safeSearch: pc.SafeSearch}
+
+	var ips, ids []string
+	for _, s := range pc.Clients {
+		switch {
+		case strings.HasPrefix(s, "mac:"):
+			hw, err := net.ParseMAC(s[4:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid mac %s, %w", s, err)
+			}
+			p.macs[hw.String()] = struct{}{}
+		case strings.HasPrefix(s, "id:"):
+			ids = append(ids, s[3:])
+		case strings.HasPrefix(s, "tag:"):
+			m := c.M().GetMatchers()[s[4:]]
+			if m == nil {
+				return nil, fmt.Errorf("cannot find matcher %s", s[4:])
+			}
+			p.matchers = append(p.matchers, m)
+		default:
+			ips = append(ips, s)
+		}
+	}
+	if len(ids) > 0 {
+		m, err := msg_matcher.NewClientIDMatcher(ids)
+		if err != nil {
+			return nil, err
+		}
+		p.matchers = append(p.matchers, m)
+	}
+	if len(ips) > 0 {
+		l, err := netlist.BatchLoadProvider(ips, c.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.ips = l
+		c.closer = append(c.closer, l)
+	}
+
+	if pc.Exec != nil {
+		ecs, err := executable_seq.BuildExecutableLogicTree(pc.Exec, c.L(), c.M().GetExecutables(), c.M().GetMatchers())
+		if err != nil {
+			return nil, fmt.Errorf("cannot build exec: %w", err)
+		}
+		p.exec = ecs
+	}
+	if len(pc.Block) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(pc.Block, c.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.block = mg
+		c.closer = append(c.closer, mg)
+	}
+	for i := range pc.Schedules {
+		sc := &pc.Schedules[i]
+		s, err := parseSchedule(sc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule #%d, %w", i, err)
+		}
+		if len(sc.Block) == 0 {
+			return nil, fmt.Errorf("schedule #%d has no block list", i)
+		}
+		mg, err := domain.BatchLoadDomainProvider(sc.Block, c.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		s.block = mg
+		c.closer = append(c.closer, mg)
+		p.schedules = append(p.schedules, s)
+	}
+	if len(pc.LogLevel) > 0 {
+		lvl, err := zapcore.ParseLevel(pc.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		p.logLevel = lvl
+		p.log = true
+	}
+	return p, nil
+}
+
+// Exec runs the matched profile, then next.
+func (c *clientProfile) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	p, err := c.match(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	query_context.SetValue(qCtx, KeyProfile, p.name)
+	qCtx.Tracef("client profile %s", p.name)
+	return c.execProfile(ctx, qCtx, p, next)
+}
+
+func (c *clientProfile) match(ctx context.Context, qCtx *query_context.Context) (*profile, error) {
+	addr := qCtx.ReqMeta().GetClientAddr()
+	var mac string
+	macLoaded := false
+	getMAC := func() string {
+		if !macLoaded {
+			macLoaded = true
+			mac, _ = neighbor.ClientMAC(qCtx.Q(), addr, c.arp)
+		}
+		return mac
+	}
+
+	for _, p := range c.profiles {
+		if p.ips != nil && addr.IsValid() {
+			ok, err := p.ips.Match(addr)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return p, nil
+			}
+		}
+		if len(p.macs) > 0 {
+			if _, ok := p.macs[getMAC()]; ok {
+				return p, nil
+			}
+		}
+		for _, m := range p.matchers {
+			ok, err := m.Match(ctx, qCtx)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return p, nil
+			}
+		}
+	}
+	return c.defaultP, nil
+}
+
+// execProfile runs p.exec and then next. A blocked query is answered
+// with NXDOMAIN and stops here. Safe search redirects the question for
+// both p.exec and next, so it also works for profiles without exec.
+func (c *clientProfile) execProfile(ctx context.Context, qCtx *query_context.Context, p *profile, next executable_seq.ExecutableChainNode) error {
+	if p.log {
+		if ce := c.L().Check(p.logLevel, "profile query"); ce != nil {
+			ce.Write(zap.String("profile", p.name), qCtx.InfoField())
+		}
+	}
+
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return execThen(ctx, qCtx, p.exec, next)
+	}
+	qName := q.Question[0].Name
+
+	if c.blocked(p, qName) {
+		r := dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	if p.safeSearch && q.Question[0].Qclass == dns.ClassINET {
+		if target, ok := c.safeSearch.Match(qName); ok && !strings.EqualFold(target, qName) {
+			q.Question[0].Name = target
+			err := execThen(ctx, qCtx, p.exec, next)
+			q.Question[0].Name = qName
+			if r := qCtx.R(); r != nil {
+				restoreRedirectedResponse(r, qName, target)
+			}
+			return err
+		}
+	}
+	return execThen(ctx, qCtx, p.exec, next)
+}
+
+func execThen(ctx context.Context, qCtx *query_context.Context, exec, next executable_seq.ExecutableChainNode) error {
+	if err := executable_seq.ExecChainNode(ctx, qCtx, exec); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// blocked reports whether qName is blocked by p now.
+func (c *clientProfile) blocked(p *profile, qName string) bool {
+	if p.block != nil {
+		if _, ok := p.block.Match(qName); ok {
+			return true
+		}
+	}
+	if len(p.schedules) == 0 {
+		return false
+	}
+	now := time.Now().In(c.loc)
+	for _, s := range p.schedules {
+		if s.active(now) {
+			if _, ok := s.block.Match(qName); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *clientProfile) Close() error {
+	for _, closer := range c.closer {
+		_ = closer.Close()
+	}
+	return nil
+}
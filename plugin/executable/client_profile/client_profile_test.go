@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_profile
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/neighbor"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_profileMatchAndSafeSearch(t *testing.T) {
+	ss, err := newSafeSearchMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arpFile := filepath.Join(t.TempDir(), "arp")
+	arp := "IP address  HW type  Flags  HW address  Mask  Device\n192.168.1.2  0x1  0x2  aa:bb:cc:dd:ee:ff  *  br-lan\n"
+	if err := os.WriteFile(arpFile, []byte(arp), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kids := &profile{name: "kids", macs: map[string]struct{}{"aa:bb:cc:dd:ee:ff": {}}, safeSearch: true}
+	adult := &profile{name: "adult"}
+	c := &clientProfile{
+		BP:         coremain.NewBP("test", PluginType, nil, nil),
+		profiles:   []*profile{kids},
+		defaultP:   adult,
+		arp:        neighbor.NewARPTable(arpFile),
+		safeSearch: ss,
+	}
+
+	newCtx := func(client, name string) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		return query_context.NewContext(q, query_context.NewRequestMeta(netip.MustParseAddr(client)))
+	}
+
+	ctx := context.Background()
+	qCtx := newCtx("192.168.1.2", "www.google.com.hk.")
+	p, err := c.match(ctx, qCtx)
+	if err != nil || p != kids {
+		t.Fatalf("unexpected profile %v, %v", p, err)
+	}
+	if p, _ := c.match(ctx, newCtx("192.168.1.9", "a.")); p != adult {
+		t.Fatal("unmatched client should use the default profile")
+	}
+
+	tablet, err := c.newProfile(&ProfileConfig{Name: "tablet", Clients: []string{"id:tablet-*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.profiles = append(c.profiles, tablet)
+	idCtx := newCtx("192.168.1.9", "a.")
+	dnsutils.SetClientID(idCtx.Q(), "tablet-1")
+	if p, _ := c.match(ctx, idCtx); p != tablet {
+		t.Fatalf("client id should match profile tablet, got %v", p)
+	}
+
+	// Safe search also redirects the query for next when the profile
+	// has no exec.
+	next := executable_seq.WrapExecutable(execFunc(func(qCtx *query_context.Context) {
+		if name := qCtx.Q().Question[0].Name; name != "forcesafesearch.google.com." {
+			t.Errorf("unexpected redirected name %s", name)
+		}
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		qCtx.SetResponse(r)
+	}))
+	for _, exec := range []executable_seq.ExecutableChainNode{nil, executable_seq.WrapExecutable(execFunc(func(*query_context.Context) {}))} {
+		kids.exec = exec
+		qCtx := newCtx("192.168.1.2", "www.google.com.hk.")
+		if err := c.Exec(ctx, qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if r == nil || r.Question[0].Name != "www.google.com.hk." || len(r.Answer) != 1 || r.Answer[0].(*dns.CNAME).Target != "forcesafesearch.google.com." {
+			t.Fatalf("unexpected response %v", r)
+		}
+	}
+}
+
+type execFunc func(qCtx *query_context.Context)
+
+func (f execFunc) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	f(qCtx)
+	return nil
+}
+
+func Test_schedule(t *testing.T) {
+	// School nights: Sun-Thu 22:00 to 07:00 next day.
+	s, err := parseSchedule(&ScheduleConfig{Days: []string{"sun", "mon", "tue", "wed", "thursday"}, Start: "22:00", End: "07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day int, clock string) time.Time { // 2024-01-07 is a Sunday
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, 7+day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(0, "21:59"), false}, // sun
+		{at(0, "22:00"), true},
+		{at(1, "06:59"), true}, // mon morning, started on sun
+		{at(1, "07:00"), false},
+		{at(4, "23:00"), true},  // thu
+		{at(5, "03:00"), true},  // fri morning, started on thu
+		{at(5, "23:00"), false}, // fri
+		{at(6, "03:00"), false}, // sat morning, started on fri
+	}
+	for _, tt := range tests {
+		if got := s.active(tt.t); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	day, err := parseSchedule(&ScheduleConfig{Start: "09:00", End: "17:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !day.active(at(6, "12:00")) || day.active(at(6, "17:00")) {
+		t.Fatal("unexpected daytime schedule result")
+	}
+	if _, err := parseSchedule(&ScheduleConfig{Days: []string{"someday"}, Start: "09:00", End: "17:00"}); err == nil {
+		t.Fatal("invalid day should fail")
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_profile
+
+import (
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+)
+
+// safeSearchRules redirects search engines to their safe search hosts.
+var safeSearchRules = [][2]string{
+	{`regexp:^(www\.)?google\.[a-z]{2,3}(\.[a-z]{2})?$`, "forcesafesearch.google.com."},
+	{"full:www.youtube.com", "restrict.youtube.com."},
+	{"full:m.youtube.com", "restrict.youtube.com."},
+	{"full:youtubei.googleapis.com", "restrict.youtube.com."},
+	{"full:youtube.googleapis.com", "restrict.youtube.com."},
+	{"full:www.youtube-nocookie.com", "restrict.youtube.com."},
+	{"full:www.bing.com", "strict.bing.com."},
+	{"full:duckduckgo.com", "safe.duckduckgo.com."},
+	{"full:www.duckduckgo.com", "safe.duckduckgo.com."},
+	{"full:pixabay.com", "safesearch.pixabay.com."},
+}
+
+func newSafeSearchMatcher() (*domain.MixMatcher[string], error) {
+	m := domain.NewMixMatcher[string]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	for _, r := range safeSearchRules {
+		if err := m.Add(r[0], r[1]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// restoreRedirectedResponse restores the query name of r and inserts a
+// CNAME from orgQName to target.
+func restoreRedirectedResponse(r *dns.Msg, orgQName, target string) {
+	for i := range r.Question {
+		if r.Question[i].Name == target {
+			r.Question[i].Name = orgQName
+		}
+	}
+	newAns := make([]dns.RR, 1, len(r.Answer)+1)
+	newAns[0] = &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   orgQName,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    1,
+		},
+		Target: target,
+	}
+	r.Answer = append(newAns, r.Answer...)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_profile
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // Windows may not have a zoneinfo database.
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+type ScheduleConfig struct {
+	// Block is the domain set that is blocked during the schedule.
+	Block []string `yaml:"block"`
+	// Days are the days when the schedule starts, e.g. "mon", "tue".
+	// Empty means every day.
+	Days []string `yaml:"days"`
+	// Start and End are "hh:mm". If End is earlier than Start, the
+	// schedule ends on the next day, e.g. 22:00-07:00.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+type schedule struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes of the day
+	block      *domain.MatcherGroup[struct{}]
+}
+
+func parseSchedule(c *ScheduleConfig) (*schedule, error) {
+	s := new(schedule)
+	var err error
+	if s.days, err = utils.ParseWeekdays(c.Days); err != nil {
+		return nil, err
+	}
+	if s.start, err = utils.ParseClock(c.Start); err != nil {
+		return nil, fmt.Errorf("invalid start, %w", err)
+	}
+	if s.end, err = utils.ParseClock(c.End); err != nil {
+		return nil, fmt.Errorf("invalid end, %w", err)
+	}
+	return s, nil
+}
+
+// active reports whether the schedule covers t.
+func (s *schedule) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	if s.start <= s.end {
+		return s.days[wd] && m >= s.start && m < s.end
+	}
+	// Overnight, the part after midnight belongs to the previous day.
+	if m >= s.start {
+		return s.days[wd]
+	}
+	return m < s.end && s.days[(wd+6)%7]
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "dhcp_lease"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*dhcpLease)(nil)
+
+type Args struct {
+	Leases []LeaseArgs `yaml:"leases"`
+	// Domain is appended to lease hostnames. Default is "lan".
+	Domain string `yaml:"domain"`
+	TTL    uint32 `yaml:"ttl"` // Default is 60.
+}
+
+type LeaseArgs struct {
+	// Provider is the tag of the data provider of the lease file.
+	// Enable its auto_reload to reload leases.
+	Provider string `yaml:"provider"`
+	// Format can be "dnsmasq", "isc", "kea" (memfile csv) or
+	// "windows" (csv exported by Get-DhcpServerv4Lease).
+	Format string `yaml:"format"`
+}
+
+func (a *Args) init() {
+	if len(a.Domain) == 0 {
+		a.Domain = "lan"
+	}
+	utils.SetDefaultNum(&a.TTL, 60)
+}
+
+type table struct {
+	names map[string][]lease   // fqdn -> leases
+	addrs map[netip.Addr]lease // addr -> lease with fqdn as its hostname
+}
+
+type dhcpLease struct {
+	*coremain.BP
+	args   *Args
+	domain string
+
+	m       sync.Mutex
+	sources []*leaseSource
+	closer  []func()
+	t       atomic.Pointer[table]
+}
+
+type leaseSource struct {
+	p      *dhcpLease
+	format string
+	leases []lease // protected by p.m
+}
+
+// Update implements data_provider.DataListener.
+func (s *leaseSource) Update(b []byte) error {
+	ls, err := parseLeases(s.format, b)
+	if err != nil {
+		return err
+	}
+	s.p.m.Lock()
+	s.leases = ls
+	s.p.rebuildLocked()
+	s.p.m.Unlock()
+	s.p.L().Info("dhcp leases loaded", zap.Int("length", len(ls)))
+	return nil
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newDHCPLease(bp, args.(*Args), bp.M().GetDataManager())
+}
+
+func newDHCPLease(bp *coremain.BP, args *Args, dm *data_provider.DataManager) (*dhcpLease, error) {
+	args.init()
+	if len(args.Leases) == 0 {
+		return nil, errors.New("no lease source is configured")
+	}
+	p := &dhcpLease{
+		BP:     bp,
+		args:   args,
+		domain: dns.CanonicalName(args.Domain),
+	}
+	p.t.Store(&table{})
+
+	for _, la := range args.Leases {
+		dp := dm.GetDataProvider(la.Provider)
+		if dp == nil {
+			p.Close()
+			return nil, fmt.Errorf("cannot find data provider %s", la.Provider)
+		}
+		// s must be in p.sources before it's loaded, or its leases are
+		// not in the table until the next update.
+		s := &leaseSource{p: p, format: la.Format}
+		p.m.Lock()
+		p.sources = append(p.sources, s)
+		p.m.Unlock()
+		if err := dp.LoadAndAddListener(s); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to load leases from %s, %w", la.Provider, err)
+		}
+		p.closer = append(p.closer, func() { dp.DeleteListener(s) })
+	}
+	return p, nil
+}
+
+func (p *dhcpLease) Close() error {
+	for _, f := range p.closer {
+		f()
+	}
+	return nil
+}
+
+func (p *dhcpLease) rebuildLocked() {
+	t := &table{
+		names: make(map[string][]lease),
+		addrs: make(map[netip.Addr]lease),
+	}
+	for _, s := range p.sources {
+		for _, l := range s.leases {
+			label, _, _ := strings.Cut(strings.ToLower(l.hostname), ".")
+			if _, ok := dns.IsDomainName(label); !ok || len(label) == 0 {
+				continue
+			}
+			fqdn := label + "." + p.domain
+			t.names[fqdn] = append(t.names[fqdn], l)
+			t.addrs[l.addr] = lease{hostname: fqdn, addr: l.addr, expire: l.expire}
+		}
+	}
+	p.t.Store(t)
+}
+
+// Exec answers A, AAAA and PTR queries for lease hostnames. Other
+// queries are passed to next.
+func (p *dhcpLease) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookup(qCtx.Q(), time.Now()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// LookupPTR returns the fqdn of the active lease of addr.
+func (p *dhcpLease) LookupPTR(addr netip.Addr) (string, bool) {
+	l, ok := p.t.Load().addrs[addr.Unmap()]
+	if !ok || l.expired(time.Now()) {
+		return "", false
+	}
+	return l.hostname, true
+}
+
+func (p *dhcpLease) lookup(q *dns.Msg, now time.Time) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	t := p.t.Load()
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: p.args.TTL}
+
+	var answer []dns.RR
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ls, ok := t.names[strings.ToLower(question.Name)]
+		if !ok {
+			return nil
+		}
+		for _, l := range ls {
+			if l.expired(now) {
+				continue
+			}
+			switch {
+			case question.Qtype == dns.TypeA && l.addr.Is4():
+				answer = append(answer, &dns.A{Hdr: hdr, A: l.addr.AsSlice()})
+			case question.Qtype == dns.TypeAAAA && l.addr.Is6():
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: l.addr.AsSlice()})
+			}
+		}
+	case dns.TypePTR:
+		addr, err := utils.ParsePTRName(question.Name)
+		if err != nil {
+			return nil
+		}
+		l, ok := t.addrs[addr]
+		if !ok || l.expired(now) {
+			return nil
+		}
+		answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: l.hostname})
+	default:
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Authoritative = true
+	r.Answer = answer
+	return r
+}
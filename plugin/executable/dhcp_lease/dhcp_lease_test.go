@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_lease
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+)
+
+func Test_dhcpLease_lookup(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(f, []byte(testDnsmasq), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := data_provider.NewDataProvider(zap.NewNop(), data_provider.DataProviderConfig{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+	dm := data_provider.NewDataManager()
+	dm.AddDataProvider("leases", dp)
+
+	bp := coremain.NewBP("test", PluginType, zap.NewNop(), new(coremain.Mosdns))
+	args := &Args{Leases: []LeaseArgs{{Provider: "leases", Format: formatDnsmasq}}}
+	p, err := newDHCPLease(bp, args, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Leases of the file are loaded at init, before it changes.
+	now := time.Unix(1600000000, 0)
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeA)
+	r := p.lookup(q, now)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if name, ok := p.LookupPTR(netip.MustParseAddr("192.168.1.11")); !ok || name != "printer.lan." {
+		t.Fatalf("unexpected ptr %s, %t", name, ok)
+	}
+
+	args = &Args{Leases: []LeaseArgs{{Provider: "leases", Format: formatDnsmasq}, {Provider: "missing"}}}
+	if _, err := newDHCPLease(bp, args, dm); err == nil {
+		t.Fatal("missing provider should fail")
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_lease
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatDnsmasq = "dnsmasq"
+	formatISC     = "isc"
+	formatKea     = "kea"
+	formatWindows = "windows"
+)
+
+type lease struct {
+	hostname string
+	addr     netip.Addr
+	expire   time.Time // zero means never expires
+}
+
+func (l *lease) expired(now time.Time) bool {
+	return !l.expire.IsZero() && now.After(l.expire)
+}
+
+func parseLeases(format string, b []byte) ([]lease, error) {
+	switch format {
+	case formatDnsmasq:
+		return parseDnsmasq(b)
+	case formatISC:
+		return parseISC(b)
+	case formatKea:
+		return parseCSV(b, "address", "hostname", "expire")
+	case formatWindows:
+		// Output of "Get-DhcpServerv4Lease | Export-Csv -NoTypeInformation".
+		return parseCSV(b, "IPAddress", "HostName", "")
+	default:
+		return nil, fmt.Errorf("unknown lease format %s", format)
+	}
+}
+
+// parseDnsmasq parses dnsmasq.leases. Each line has the format:
+// "<expiry> <mac> <ip> <hostname> <client id>". Expiry 0 means infinite.
+func parseDnsmasq(b []byte) ([]lease, error) {
+	var ls []lease
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 4 || f[0] == "duid" {
+			continue
+		}
+		if f[3] == "*" { // no hostname
+			continue
+		}
+		addr, err := netip.ParseAddr(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %s, %w", f[2], err)
+		}
+		expiry, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %s, %w", f[0], err)
+		}
+		l := lease{hostname: f[3], addr: addr}
+		if expiry > 0 {
+			l.expire = time.Unix(expiry, 0)
+		}
+		ls = append(ls, l)
+	}
+	return ls, s.Err()
+}
+
+// parseISC parses ISC dhcpd.leases. Only active leases with
+// client-hostname are returned. Later leases overwrite earlier ones.
+func parseISC(b []byte) ([]lease, error) {
+	var ls []lease
+	idx := make(map[netip.Addr]int)
+
+	var cur *lease
+	active := false
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case f[0] == "lease" && len(f) >= 2:
+			addr, err := netip.ParseAddr(f[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid lease ip %s, %w", f[1], err)
+			}
+			cur = &lease{addr: addr}
+			active = false
+		case cur == nil:
+			continue
+		case f[0] == "}":
+			if active && len(cur.hostname) > 0 {
+				if i, ok := idx[cur.addr]; ok {
+					ls[i] = *cur
+				} else {
+					idx[cur.addr] = len(ls)
+					ls = append(ls, *cur)
+				}
+			} else if i, ok := idx[cur.addr]; ok { // lease was released
+				ls[i].hostname = ""
+			}
+			cur = nil
+		case f[0] == "client-hostname" && len(f) >= 2:
+			cur.hostname = strings.Trim(strings.Join(f[1:], " "), "\"")
+		case f[0] == "binding" && len(f) >= 3 && f[1] == "state":
+			active = f[2] == "active"
+		case f[0] == "ends" && len(f) >= 2:
+			if f[1] == "never" {
+				continue
+			}
+			// "ends 4 2022/11/08 16:03:10", time is in UTC.
+			if len(f) >= 4 {
+				t, err := time.Parse("2006/01/02 15:04:05", f[2]+" "+f[3])
+				if err == nil {
+					cur.expire = t
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	res := ls[:0]
+	for _, l := range ls {
+		if len(l.hostname) > 0 {
+			res = append(res, l)
+		}
+	}
+	return res, nil
+}
+
+// parseCSV parses a csv lease file with a header line.
+// expireCol is optional and contains unix time.
+func parseCSV(b []byte, addrCol, hostCol, expireCol string) ([]lease, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header, %w", err)
+	}
+	addrIdx, hostIdx, expireIdx := -1, -1, -1
+	for i, h := range header {
+		switch strings.TrimSpace(h) {
+		case addrCol:
+			addrIdx = i
+		case hostCol:
+			hostIdx = i
+		case expireCol:
+			expireIdx = i
+		}
+	}
+	if addrIdx < 0 || hostIdx < 0 {
+		return nil, fmt.Errorf("csv header must contain %s and %s", addrCol, hostCol)
+	}
+
+	var ls []lease
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) <= addrIdx || len(rec) <= hostIdx {
+			continue
+		}
+		hostname := strings.TrimSuffix(strings.TrimSpace(rec[hostIdx]), ".")
+		if len(hostname) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(rec[addrIdx]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %s, %w", rec[addrIdx], err)
+		}
+		l := lease{hostname: hostname, addr: addr}
+		if expireIdx >= 0 && len(rec) > expireIdx {
+			if e, err := strconv.ParseInt(strings.TrimSpace(rec[expireIdx]), 10, 64); err == nil && e > 0 {
+				l.expire = time.Unix(e, 0)
+			}
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
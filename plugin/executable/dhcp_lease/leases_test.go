@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_lease
+
+import (
+	"testing"
+)
+
+const (
+	testDnsmasq = `1700000000 aa:bb:cc:dd:ee:ff 192.168.1.10 nas 01:aa:bb:cc:dd:ee:ff
+0 aa:bb:cc:dd:ee:00 192.168.1.11 printer *
+1700000000 aa:bb:cc:dd:ee:01 192.168.1.12 * *
+duid 00:01:00:01
+`
+	testISC = `# comment
+lease 192.168.1.20 {
+  starts 4 2022/11/08 15:03:10;
+  ends 4 2022/11/08 16:03:10;
+  binding state active;
+  client-hostname "laptop";
+}
+lease 192.168.1.21 {
+  ends never;
+  binding state free;
+  client-hostname "old";
+}
+lease 192.168.1.20 {
+  ends never;
+  binding state active;
+  client-hostname "laptop2";
+}
+`
+	testKea = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state
+192.168.1.30,aa:bb:cc:dd:ee:30,,3600,1700000000,1,0,0,tv.lan.,0
+192.168.1.31,aa:bb:cc:dd:ee:31,,3600,1700000000,1,0,0,,0
+`
+	testWindows = `"IPAddress","ScopeId","ClientId","HostName","AddressState"
+"192.168.1.40","192.168.1.0","aa-bb-cc-dd-ee-40","pc.corp.example.com","Active"
+`
+)
+
+func Test_parseLeases(t *testing.T) {
+	tests := []struct {
+		format    string
+		data      string
+		wantHosts []string
+	}{
+		{formatDnsmasq, testDnsmasq, []string{"nas", "printer"}},
+		{formatISC, testISC, []string{"laptop2"}},
+		{formatKea, testKea, []string{"tv.lan"}},
+		{formatWindows, testWindows, []string{"pc.corp.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			ls, err := parseLeases(tt.format, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ls) != len(tt.wantHosts) {
+				t.Fatalf("want %d leases, got %d", len(tt.wantHosts), len(ls))
+			}
+			for i, l := range ls {
+				if l.hostname != tt.wantHosts[i] {
+					t.Fatalf("want hostname %s, got %s", tt.wantHosts[i], l.hostname)
+				}
+			}
+		})
+	}
+
+	if _, err := parseLeases("unknown", nil); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/nat64"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "dns64"
+
+const (
+	discoveryDNS = "dns" // RFC 7050, AAAA of ipv4only.arpa.
+	discoveryRA  = "ra"  // RFC 8781, PREF64 option in router advertisements.
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+type Args struct {
+	// Prefix is a static NAT64 prefix. e.g. "64:ff9b::/96".
+	// If it is empty, the prefix will be discovered automatically.
+	Prefix string `yaml:"prefix"`
+
+	// Discovery methods, "dns" and/or "ra". Default is both.
+	Discovery []string `yaml:"discovery"`
+
+	// Bootstrap is the resolver that looks up ipv4only.arpa.
+	// Default is "system".
+	Bootstrap string `yaml:"bootstrap"`
+
+	// Interval of dns discovery in seconds. Default is 600.
+	Interval int `yaml:"interval"`
+}
+
+func (a *Args) init() {
+	if len(a.Discovery) == 0 {
+		a.Discovery = []string{discoveryDNS, discoveryRA}
+	}
+	if len(a.Bootstrap) == 0 {
+		a.Bootstrap = bootstrap.System
+	}
+	utils.SetDefaultNum(&a.Interval, 600)
+}
+
+var _ coremain.ExecutablePlugin = (*dns64)(nil)
+
+type dns64 struct {
+	*coremain.BP
+	args *Args
+
+	resolver *net.Resolver
+	prefix   atomic.Pointer[pref64]
+}
+
+type pref64 struct {
+	prefix netip.Prefix
+	source string
+	expire time.Time // zero means never.
+}
+
+func (p *pref64) valid(now time.Time) bool {
+	return p != nil && (p.expire.IsZero() || now.Before(p.expire))
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newDNS64(bp, args.(*Args))
+}
+
+func newDNS64(bp *coremain.BP, args *Args) (*dns64, error) {
+	args.init()
+	d := &dns64{BP: bp, args: args}
+
+	if len(args.Prefix) > 0 {
+		p, err := netip.ParsePrefix(args.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix, %w", err)
+		}
+		if !p.Addr().Is6() || p.Addr().Is4In6() || !nat64.ValidPrefixLen(p.Bits()) {
+			return nil, fmt.Errorf("invalid prefix %s, must be an ipv6 prefix with length 32, 40, 48, 56, 64 or 96", p)
+		}
+		d.prefix.Store(&pref64{prefix: p.Masked(), source: "static"})
+		return d, nil
+	}
+
+	for _, m := range args.Discovery {
+		switch m {
+		case discoveryDNS:
+			d.resolver = bootstrap.NewBootstrap(args.Bootstrap)
+			if d.resolver == nil {
+				d.resolver = net.DefaultResolver
+			}
+			bp.M().GetSafeClose().Attach(d.dnsDiscoveryLoop)
+		case discoveryRA:
+			bp.M().GetSafeClose().Attach(d.raDiscoveryLoop)
+		default:
+			return nil, fmt.Errorf("unknown discovery method %s", m)
+		}
+	}
+	return d, nil
+}
+
+// Exec executes next. If the AAAA query has no AAAA answer, it queries
+// the A record and synthesizes AAAA records from the current prefix.
+func (d *dns64) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	p := d.prefix.Load()
+	q := qCtx.Q()
+	if !p.valid(time.Now()) || len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA || q.Question[0].Qclass != dns.ClassINET {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	qCtxA := qCtx.Copy()
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess || msgAnsHasRR(r, dns.TypeAAAA) {
+		return nil
+	}
+
+	qCtxA.Q().Question[0].Qtype = dns.TypeA
+	if err := executable_seq.ExecChainNode(ctx, qCtxA, next); err != nil {
+		d.L().Debug("failed to query A record for synthesis", qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	rA := qCtxA.R()
+	if rA == nil || rA.Rcode != dns.RcodeSuccess || !msgAnsHasRR(rA, dns.TypeA) {
+		return nil
+	}
+	qCtx.SetResponse(synthesize(q, rA, p.prefix))
+	return nil
+}
+
+// synthesize builds the AAAA response of q from the A response rA.
+func synthesize(q, rA *dns.Msg, prefix netip.Prefix) *dns.Msg {
+	r := rA.Copy()
+	r.Id = q.Id
+	r.Question = append(r.Question[:0], q.Question[0])
+	r.Answer = r.Answer[:0]
+	for _, rr := range rA.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			r.Answer = append(r.Answer, dns.Copy(rr))
+			continue
+		}
+		v4, ok := netip.AddrFromSlice(a.A.To4())
+		if !ok {
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: nat64.EmbedIPv4(prefix, v4).AsSlice()})
+	}
+	return r
+}
+
+func msgAnsHasRR(m *dns.Msg, t uint16) bool {
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// setPrefix updates the current prefix from source. An invalid prefix
+// removes the prefix if it was set by the same source.
+func (d *dns64) setPrefix(p netip.Prefix, source string, lifetime time.Duration) {
+	old := d.prefix.Load()
+	if !p.IsValid() {
+		if old != nil && old.source == source {
+			d.prefix.CompareAndSwap(old, nil)
+			d.L().Info("nat64 prefix removed", zap.String("source", source))
+		}
+		return
+	}
+	n := &pref64{prefix: p, source: source}
+	if lifetime > 0 {
+		n.expire = time.Now().Add(lifetime)
+	}
+	d.prefix.Store(n)
+	if old == nil || old.prefix != p {
+		d.L().Info("nat64 prefix discovered", zap.Stringer("prefix", p), zap.String("source", source))
+	}
+}
+
+func (d *dns64) dnsDiscoveryLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	ticker := time.NewTicker(time.Duration(d.args.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		d.discoverDNS()
+		select {
+		case <-ticker.C:
+		case <-closeSignal:
+			return
+		}
+	}
+}
+
+func (d *dns64) discoverDNS() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	p, err := nat64.Lookup(ctx, d.resolver)
+	if err != nil {
+		d.L().Warn("failed to lookup ipv4only.arpa", zap.Error(err))
+		return
+	}
+	d.setPrefix(p, discoveryDNS, 0) // An invalid p means not a NAT64 network.
+}
+
+func (d *dns64) raDiscoveryLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		d.L().Warn("failed to listen router advertisements, ra discovery is disabled", zap.Error(err))
+		return
+	}
+	go func() {
+		<-closeSignal
+		c.Close()
+	}()
+
+	pc := c.IPv6PacketConn()
+	if err := pc.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+		d.L().Warn("failed to read hop limits of router advertisements, ra discovery is disabled", zap.Error(err))
+		return
+	}
+
+	b := make([]byte, 1500)
+	for {
+		n, cm, src, err := pc.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-closeSignal:
+			default:
+				d.L().Warn("failed to read router advertisements", zap.Error(err))
+			}
+			return
+		}
+		// Drop spoofed advertisements that are not from a router of
+		// this link.
+		if cm == nil || !nat64.ValidRASource(utils.GetAddrFromAddr(src), cm.HopLimit) {
+			continue
+		}
+		p, lifetime, ok := nat64.ParseRAPref64(b[:n])
+		if !ok {
+			continue
+		}
+		if lifetime == 0 {
+			p = netip.Prefix{}
+		}
+		d.setPrefix(p, discoveryRA, lifetime)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_synthesize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	qA := q.Copy()
+	qA.Question[0].Qtype = dns.TypeA
+	rA := new(dns.Msg)
+	rA.SetReply(qA)
+	rA.Answer = append(rA.Answer,
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "a.example.com."},
+		&dns.A{Hdr: dns.RR_Header{Name: "a.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 33)},
+	)
+
+	r := synthesize(q, rA, netip.MustParsePrefix("64:ff9b::/96"))
+	if r.Question[0].Qtype != dns.TypeAAAA || len(r.Answer) != 2 {
+		t.Fatalf("unexpected response %s", r)
+	}
+	if _, ok := r.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("cname is not kept")
+	}
+	aaaa, ok := r.Answer[1].(*dns.AAAA)
+	if !ok || aaaa.Hdr.Ttl != 60 || !aaaa.AAAA.Equal(net.ParseIP("64:ff9b::192.0.2.33")) {
+		t.Fatalf("unexpected aaaa %v", r.Answer[1])
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_exception
+
+import (
+	"context"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "dnssec_exception"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*dnssecException)(nil)
+
+// Args configures domains whose DNSSEC validation failures should not
+// break resolution, e.g. broken third-party zones under investigation.
+// mosdns doesn't validate DNSSEC itself, the CD bit asks upstreams not to.
+// Both lists have the same format as the domain of query_matcher.
+type Args struct {
+	// NegativeTrustAnchors (RFC 7646) are domains that are treated as
+	// unsigned. Queries of them are sent with the CD bit, and the AD bit
+	// is removed from their responses because they are not validated.
+	NegativeTrustAnchors []string `yaml:"negative_trust_anchors"`
+
+	// ForceCD sets the CD bit on queries of these domains. Responses are
+	// not modified.
+	ForceCD []string `yaml:"force_cd"`
+}
+
+type dnssecException struct {
+	*coremain.BP
+	nta     *domain.MatcherGroup[struct{}] // maybe nil
+	forceCD *domain.MatcherGroup[struct{}] // maybe nil
+	closer  []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newDNSSECException(bp, args.(*Args))
+}
+
+func newDNSSECException(bp *coremain.BP, args *Args) (*dnssecException, error) {
+	d := &dnssecException{BP: bp}
+	load := func(s []string) (*domain.MatcherGroup[struct{}], error) {
+		if len(s) == 0 {
+			return nil, nil
+		}
+		mg, err := domain.BatchLoadDomainProvider(s, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		d.closer = append(d.closer, mg)
+		return mg, nil
+	}
+
+	var err error
+	if d.nta, err = load(args.NegativeTrustAnchors); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if d.forceCD, err = load(args.ForceCD); err != nil {
+		d.Close()
+		return nil, err
+	}
+	bp.L().Info("dnssec exceptions loaded", zap.Int("negative_trust_anchors", matcherLen(d.nta)), zap.Int("force_cd", matcherLen(d.forceCD)))
+	return d, nil
+}
+
+func matcherLen(mg *domain.MatcherGroup[struct{}]) int {
+	if mg == nil {
+		return 0
+	}
+	return mg.Len()
+}
+
+// Exec sets the CD bit on queries of the configured domains. The CD bit
+// of responses is restored, so clients see the bit they sent.
+func (d *dnssecException) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+	name := q.Question[0].Name
+	nta := match(d.nta, name)
+	if !nta && !match(d.forceCD, name) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	orgCD := q.CheckingDisabled
+	q.CheckingDisabled = true
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	q.CheckingDisabled = orgCD
+	if r := qCtx.R(); r != nil {
+		r.CheckingDisabled = orgCD
+		if nta {
+			r.AuthenticatedData = false
+		}
+	}
+	return err
+}
+
+func match(mg *domain.MatcherGroup[struct{}], name string) bool {
+	if mg == nil {
+		return false
+	}
+	_, ok := mg.Match(name)
+	return ok
+}
+
+func (d *dnssecException) Close() error {
+	for _, c := range d.closer {
+		_ = c.Close()
+	}
+	return nil
+}
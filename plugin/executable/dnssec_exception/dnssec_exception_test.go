@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_exception
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_dnssecException(t *testing.T) {
+	d, err := newDNSSECException(coremain.NewBP("test", PluginType, nil, new(coremain.Mosdns)), &Args{
+		NegativeTrustAnchors: []string{"domain:broken.com"},
+		ForceCD:              []string{"full:cd.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	tests := []struct {
+		name   string
+		qName  string
+		wantCD bool // CD bit of the query sent to next
+		wantAD bool
+	}{
+		{"nta", "www.broken.com.", true, false},
+		{"force cd", "cd.com.", true, true},
+		{"force cd subdomain", "www.cd.com.", false, true},
+		{"others", "example.com.", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, dns.TypeA)
+			var gotCD bool
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.AuthenticatedData = true
+			next := executable_seq.WrapExecutable(execFunc(func(qCtx *query_context.Context) {
+				gotCD = qCtx.Q().CheckingDisabled
+				qCtx.SetResponse(r)
+			}))
+
+			qCtx := query_context.NewContext(q, nil)
+			if err := d.Exec(context.Background(), qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if gotCD != tt.wantCD {
+				t.Fatalf("want cd %v, got %v", tt.wantCD, gotCD)
+			}
+			if q.CheckingDisabled || qCtx.R().CheckingDisabled {
+				t.Fatal("cd bit was not restored")
+			}
+			if qCtx.R().AuthenticatedData != tt.wantAD {
+				t.Fatalf("want ad %v, got %v", tt.wantAD, qCtx.R().AuthenticatedData)
+			}
+		})
+	}
+}
+
+type execFunc func(qCtx *query_context.Context)
+
+func (f execFunc) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	f(qCtx)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "dnstap"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var (
+	_ coremain.ExecutablePlugin = (*dnstapPlugin)(nil)
+	_ dnstap.Logger             = (*dnstapPlugin)(nil)
+)
+
+type Args struct {
+	// Addr of the receiver, "unix:///path/to/socket" or
+	// "tcp://host:port". A path is a unix socket.
+	Addr string `yaml:"addr"`
+
+	Identity  string `yaml:"identity"`   // Default is the host name.
+	Version   string `yaml:"version"`    // Default is "mosdns".
+	QueueSize int    `yaml:"queue_size"` // Default is 4096.
+
+	// NoClientQueries and NoClientResponses disable CLIENT_QUERY and
+	// CLIENT_RESPONSE messages of queries that pass through this plugin.
+	// Upstream exchanges are logged by fast_forward, see its dnstap arg.
+	NoClientQueries   bool `yaml:"no_client_queries"`
+	NoClientResponses bool `yaml:"no_client_responses"`
+}
+
+type dnstapPlugin struct {
+	*coremain.BP
+	args     *Args
+	identity []byte
+	version  []byte
+	e        *dnstap.Emitter
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newDnstap(bp, args.(*Args))
+}
+
+func newDnstap(bp *coremain.BP, args *Args) (*dnstapPlugin, error) {
+	network, addr, err := parseAddr(args.Addr)
+	if err != nil {
+		return nil, err
+	}
+	identity := args.Identity
+	if len(identity) == 0 {
+		identity, _ = os.Hostname()
+	}
+	version := args.Version
+	if len(version) == 0 {
+		version = "mosdns"
+	}
+	e := dnstap.NewEmitter(dnstap.EmitterOpts{
+		Network:   network,
+		Addr:      addr,
+		QueueSize: args.QueueSize,
+		Logger:    bp.L(),
+	})
+	bp.GetMetricsReg().MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "sent_total",
+			Help: "The total number of sent dnstap messages",
+		}, func() float64 { return float64(e.Sent()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of dnstap messages dropped by a full queue or connection errors",
+		}, func() float64 { return float64(e.Dropped()) }),
+	)
+	return &dnstapPlugin{
+		BP:       bp,
+		args:     args,
+		identity: []byte(identity),
+		version:  []byte(version),
+		e:        e,
+	}, nil
+}
+
+func parseAddr(s string) (network, addr string, err error) {
+	if len(s) == 0 {
+		return "", "", errors.New("missing addr")
+	}
+	if addr, ok := strings.CutPrefix(s, "unix://"); ok {
+		return "unix", addr, nil
+	}
+	if addr, ok := strings.CutPrefix(s, "tcp://"); ok {
+		return "tcp", addr, nil
+	}
+	if strings.Contains(s, "://") {
+		return "", "", fmt.Errorf("unsupported addr %s", s)
+	}
+	return "unix", s, nil
+}
+
+// Log implements dnstap.Logger.
+func (d *dnstapPlugin) Log(m *dnstap.Message) {
+	m.Identity = d.identity
+	m.Version = d.version
+	d.e.Emit(m)
+}
+
+// Exec logs the query, executes next, then logs the response.
+func (d *dnstapPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	meta := qCtx.ReqMeta()
+	clientAddr := netip.AddrPortFrom(meta.GetClientAddr(), 0)
+	protocol := dnstap.ProtocolOf(meta.GetConnInfo().Transport)
+	queryTime := time.Now()
+	q, _ := qCtx.Q().Pack()
+	if !d.args.NoClientQueries {
+		d.Log(&dnstap.Message{
+			Type:         dnstap.ClientQuery,
+			Protocol:     protocol,
+			QueryAddress: clientAddr,
+			QueryTime:    queryTime,
+			QueryMessage: q,
+		})
+	}
+
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	if !d.args.NoClientResponses {
+		m := &dnstap.Message{
+			Type:         dnstap.ClientResponse,
+			Protocol:     protocol,
+			QueryAddress: clientAddr,
+			QueryTime:    queryTime,
+			QueryMessage: q,
+			ResponseTime: time.Now(),
+		}
+		if r := qCtx.R(); r != nil {
+			m.ResponseMessage, _ = r.Pack()
+		}
+		d.Log(m)
+	}
+	return err
+}
+
+func (d *dnstapPlugin) Close() error {
+	return d.e.Close()
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
@@ -53,6 +54,14 @@ type Args struct {
 	// force overwrite existing ecs
 	ForceOverwrite bool `yaml:"force_overwrite"`
 
+	// ClientECS is the policy of ecs sent by clients. Can be "keep"
+	// (default), "override" (replace it, same as force_overwrite) or
+	// "strip" (remove it, no ecs is sent).
+	ClientECS string `yaml:"client_ecs"`
+	// TrustedClients are ips/cidrs or "provider:" of clients, e.g. a DoH
+	// gateway, whose ecs is always kept.
+	TrustedClients []string `yaml:"trusted_clients"`
+
 	// mask for ecs
 	Mask4 int `yaml:"mask4"` // default 24
 	Mask6 int `yaml:"mask6"` // default 48
@@ -62,6 +71,12 @@ type Args struct {
 	IPv6 string `yaml:"ipv6"`
 }
 
+const (
+	clientECSKeep = iota
+	clientECSOverride
+	clientECSStrip
+)
+
 func (a *Args) Init() error {
 	if ok := utils.CheckNumRange(a.Mask4, 0, 32); !ok {
 		return fmt.Errorf("invalid mask4 %d, should between 0~32", a.Mask4)
@@ -78,6 +93,9 @@ type ecsPlugin struct {
 	*coremain.BP
 	args       *Args
 	ipv4, ipv6 netip.Addr
+
+	clientECS int
+	trusted   *netlist.MatcherGroup // maybe nil
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -93,6 +111,19 @@ func newPlugin(bp *coremain.BP, args *Args) (p *ecsPlugin, err error) {
 	ep.BP = bp
 	ep.args = args
 
+	switch args.ClientECS {
+	case "", "keep":
+		if args.ForceOverwrite {
+			ep.clientECS = clientECSOverride
+		}
+	case "override":
+		ep.clientECS = clientECSOverride
+	case "strip":
+		ep.clientECS = clientECSStrip
+	default:
+		return nil, fmt.Errorf("invalid client_ecs %s", args.ClientECS)
+	}
+
 	if len(args.IPv4) != 0 {
 		addr, err := netip.ParseAddr(args.IPv4)
 		if err != nil {
@@ -117,9 +148,34 @@ func newPlugin(bp *coremain.BP, args *Args) (p *ecsPlugin, err error) {
 		}
 	}
 
+	if len(args.TrustedClients) > 0 {
+		ep.trusted, err = netlist.BatchLoadProvider(args.TrustedClients, bp.M().GetDataManager())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load trusted clients, %w", err)
+		}
+	}
 	return ep, nil
 }
 
+func (e *ecsPlugin) Close() error {
+	if e.trusted != nil {
+		return e.trusted.Close()
+	}
+	return nil
+}
+
+// clientECSPolicy returns the policy of ecs from the client of qCtx.
+func (e *ecsPlugin) clientECSPolicy(qCtx *query_context.Context) int {
+	if e.trusted != nil && e.clientECS != clientECSKeep {
+		if addr := qCtx.ReqMeta().GetClientAddr(); addr.IsValid() {
+			if ok, _ := e.trusted.Match(addr.Unmap()); ok {
+				return clientECSKeep
+			}
+		}
+	}
+	return e.clientECS
+}
+
 // Exec tries to append ECS to qCtx.Q().
 func (e *ecsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
 	upgraded, newECS := e.addECS(qCtx)
@@ -148,9 +204,15 @@ func (e *ecsPlugin) addECS(qCtx *query_context.Context) (upgraded bool, newECS b
 	q := qCtx.Q()
 	opt := q.IsEdns0()
 	hasECS := opt != nil && dnsutils.GetECS(opt) != nil
-	if hasECS && !e.args.ForceOverwrite {
-		// Argument args.ForceOverwrite is disabled. q already has an edns0 subnet. Skip it.
-		return false, false
+	if hasECS {
+		switch e.clientECSPolicy(qCtx) {
+		case clientECSKeep:
+			// q already has an edns0 subnet. Skip it.
+			return false, false
+		case clientECSStrip:
+			dnsutils.RemoveMsgECS(q)
+			return false, false
+		}
 	}
 
 	var ecs *dns.EDNS0_SUBNET
@@ -55,6 +55,11 @@ func Test_ecsPlugin(t *testing.T) {
 
 		{"overwrite off", Args{Auto: true}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "1.2.3.4", true, true},
 		{"overwrite on", Args{Auto: true, ForceOverwrite: true}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "1.0.0.0", true, true},
+		{"client ecs override", Args{Auto: true, ClientECS: "override"}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "1.0.0.0", true, true},
+		{"client ecs strip", Args{Auto: true, ClientECS: "strip"}, dns.TypeA, true, "1.2.3.4", "1.0.0.0", "", true, true},
+		{"client ecs strip no ecs", Args{Auto: true, ClientECS: "strip"}, dns.TypeA, true, "", "1.0.0.0", "1.0.0.0", true, false},
+		{"trusted client", Args{Auto: true, ClientECS: "strip", TrustedClients: []string{"1.0.0.0/24"}}, dns.TypeA, true, "1.2.3.4", "1.0.0.1", "1.2.3.4", true, true},
+		{"untrusted client", Args{Auto: true, ClientECS: "override", TrustedClients: []string{"1.0.0.0/24"}}, dns.TypeA, true, "1.2.3.4", "2.0.0.1", "2.0.0.1", true, true},
 
 		{"preset v4", Args{IPv4: "1.2.3.4"}, dns.TypeA, false, "", "", "1.2.3.4", false, false},
 		{"preset v6", Args{IPv6: "::1"}, dns.TypeA, false, "", "", "::1", false, false},
@@ -62,7 +67,7 @@ func Test_ecsPlugin(t *testing.T) {
 		{"preset both2", Args{IPv4: "1.2.3.4", IPv6: "::1"}, dns.TypeAAAA, false, "", "", "::1", false, false},
 	}
 	for _, tt := range tests {
-		p, err := newPlugin(coremain.NewBP("ecs", PluginType, nil, nil), &tt.args)
+		p, err := newPlugin(coremain.NewBP("ecs", PluginType, nil, new(coremain.Mosdns)), &tt.args)
 		if err != nil {
 			t.Fatal(err)
 		}
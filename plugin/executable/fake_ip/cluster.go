@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fake_ip
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+)
+
+// clusterChannel replicates mappings as "domain ip" lines, the same
+// format as the persist file.
+type clusterChannel struct {
+	p *fakeIP
+}
+
+var _ cluster.Channel = (*clusterChannel)(nil)
+
+func (p *fakeIP) joinCluster() error {
+	c, err := p.M().GetCluster()
+	if err != nil {
+		return err
+	}
+	if err := c.Register(p.Tag(), &clusterChannel{p: p}); err != nil {
+		return err
+	}
+	for _, pool := range p.pools() {
+		pool.onAlloc = func(domain string, ip netip.Addr) {
+			c.Publish(p.Tag(), []byte(domain+" "+ip.String()))
+		}
+	}
+	return nil
+}
+
+func (c *clusterChannel) Snapshot() ([]byte, error) {
+	b := new(bytes.Buffer)
+	for _, pool := range c.p.pools() {
+		if err := pool.dump(b, false); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func (c *clusterChannel) Apply(b []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(f[1])
+		if err != nil {
+			return fmt.Errorf("invalid ip %s, %w", f[1], err)
+		}
+		for _, pool := range c.p.pools() {
+			if pool.contains(ip) {
+				pool.set(f[0], ip)
+				break
+			}
+		}
+	}
+	return s.Err()
+}
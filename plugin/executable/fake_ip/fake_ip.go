@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fake_ip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "fake_ip"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var (
+	_ coremain.ExecutablePlugin = (*fakeIP)(nil)
+	_ coremain.Maintainer       = (*fakeIP)(nil)
+)
+
+type Args struct {
+	IPv4 string `yaml:"ipv4"` // Default is "198.18.0.0/15".
+	// IPv6 is optional. If it is empty, AAAA queries will get empty responses.
+	IPv6 string `yaml:"ipv6"`
+	TTL  uint32 `yaml:"ttl"` // Default is 1.
+	// Persist is the file to store mappings. Optional.
+	Persist      string `yaml:"persist"`
+	SaveInterval int    `yaml:"save_interval"` // (sec) Default is 60.
+	// Cluster replicates mappings to cluster peers. Peers must have
+	// the same tag and prefixes. See coremain.ClusterConfig.
+	Cluster bool `yaml:"cluster"`
+	// Rotate frees mappings that were not used since the previous
+	// maintenance, see coremain.MaintenanceConfig. Freed addresses are
+	// reused before the pool recycles mappings that are still in use.
+	Rotate bool `yaml:"rotate"`
+}
+
+func (a *Args) init() {
+	if len(a.IPv4) == 0 {
+		a.IPv4 = "198.18.0.0/15"
+	}
+	utils.SetDefaultNum(&a.TTL, 1)
+	utils.SetDefaultNum(&a.SaveInterval, 60)
+}
+
+type fakeIP struct {
+	*coremain.BP
+	args  *Args
+	pool4 *ipPool
+	pool6 *ipPool
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newFakeIP(bp, args.(*Args))
+}
+
+func newFakeIP(bp *coremain.BP, args *Args) (*fakeIP, error) {
+	args.init()
+	p := &fakeIP{BP: bp, args: args}
+
+	var err error
+	if p.pool4, err = newPoolFromString(args.IPv4, true); err != nil {
+		return nil, err
+	}
+	if len(args.IPv6) > 0 {
+		if p.pool6, err = newPoolFromString(args.IPv6, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args.Persist) > 0 {
+		if err := p.load(); err != nil {
+			return nil, fmt.Errorf("failed to load persisted mappings, %w", err)
+		}
+		bp.M().GetSafeClose().Attach(p.saveLoop)
+	}
+	if args.Rotate {
+		for _, pool := range p.pools() {
+			pool.enableRotation()
+		}
+	}
+	if args.Cluster {
+		if err := p.joinCluster(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func newPoolFromString(s string, v4 bool) (*ipPool, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %s, %w", s, err)
+	}
+	if prefix.Addr().Is4() != v4 {
+		return nil, fmt.Errorf("prefix %s has a wrong ip version", s)
+	}
+	return newIPPool(prefix)
+}
+
+func (p *fakeIP) pools() []*ipPool {
+	if p.pool6 != nil {
+		return []*ipPool{p.pool4, p.pool6}
+	}
+	return []*ipPool{p.pool4}
+}
+
+func (p *fakeIP) persistFile(i int) string {
+	if i == 0 {
+		return p.args.Persist
+	}
+	return p.args.Persist + ".v6"
+}
+
+func (p *fakeIP) load() error {
+	for i, pool := range p.pools() {
+		f, err := os.Open(p.persistFile(i))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		err = pool.load(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes mappings to the persist file atomically.
+func (p *fakeIP) save() error {
+	for i, pool := range p.pools() {
+		if !pool.isDirty() {
+			continue
+		}
+		if err := utils.WriteFileAtomic(p.persistFile(i), pool.save); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *fakeIP) saveLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	ticker := time.NewTicker(time.Duration(p.args.SaveInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.save(); err != nil {
+				p.L().Warn("failed to save mappings", zap.Error(err))
+			}
+		case <-closeSignal:
+			if err := p.save(); err != nil {
+				p.L().Warn("failed to save mappings", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// Maintain implements coremain.Maintainer. It rotates pools if
+// Args.Rotate is set, then saves mappings, so freed ones are also
+// dropped from the persist file.
+func (p *fakeIP) Maintain(_ context.Context) error {
+	if p.args.Rotate {
+		for _, pool := range p.pools() {
+			if n := pool.rotate(); n > 0 {
+				p.L().Info("unused mappings freed", zap.Stringer("prefix", pool.prefix), zap.Int("freed", n))
+			}
+		}
+	}
+	if len(p.args.Persist) > 0 {
+		return p.save()
+	}
+	return nil
+}
+
+// Exec answers A/AAAA queries with fake ips and PTR queries of
+// allocated fake ips. Other queries are passed to next.
+func (p *fakeIP) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.handle(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *fakeIP) handle(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: p.args.TTL}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	switch question.Qtype {
+	case dns.TypeA:
+		ip := p.pool4.lookupOrAlloc(name)
+		r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip.AsSlice()}}
+	case dns.TypeAAAA:
+		if p.pool6 == nil {
+			return dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+		}
+		ip := p.pool6.lookupOrAlloc(name)
+		r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()}}
+	case dns.TypePTR:
+		addr, err := utils.ParsePTRName(question.Name)
+		if err != nil {
+			return nil
+		}
+		for _, pool := range p.pools() {
+			if !pool.contains(addr) {
+				continue
+			}
+			d, ok := pool.lookupIP(addr)
+			if !ok {
+				return dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+			}
+			r.Answer = []dns.RR{&dns.PTR{Hdr: hdr, Ptr: d}}
+			return r
+		}
+		return nil
+	default:
+		return nil
+	}
+	return r
+}
+
+// LookupIP returns the domain that ip was allocated to.
+func (p *fakeIP) LookupIP(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	for _, pool := range p.pools() {
+		if pool.contains(ip) {
+			return pool.lookupIP(ip)
+		}
+	}
+	return "", false
+}
+
+// ServeHTTP returns the domain of "ip" if the query parameter is set.
+// Otherwise, it returns all mappings (domain -> ip) as a json object.
+func (p *fakeIP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s := req.URL.Query().Get("ip"); len(s) > 0 {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		d, ok := p.LookupIP(addr)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(d))
+		return
+	}
+
+	m := make(map[string][]string)
+	for _, pool := range p.pools() {
+		for d, ip := range pool.mappings() {
+			m[d] = append(m[d], ip)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		p.L().Warn("failed to write mappings", zap.Error(err))
+	}
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fake_ip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/pmkol/mosdns-x/pkg/lru"
+)
+
+// ipPool allocates addresses from a prefix to domains. When the pool
+// is exhausted, the least recently used mapping is recycled.
+// It is concurrent safe.
+type ipPool struct {
+	prefix netip.Prefix
+	first  netip.Addr // first usable address
+	end    netip.Addr // first address after the usable ones
+	size   int
+
+	m       sync.Mutex
+	next    netip.Addr   // next never allocated address
+	free    []netip.Addr // FIFO, so freed addresses are reused as late as possible
+	domains *lru.LRU[string, netip.Addr]
+	ips     map[netip.Addr]string
+	dirty   bool
+	// seen are addresses used since the last rotate. Nil disables
+	// the tracking.
+	seen map[netip.Addr]struct{}
+
+	// onAlloc is called with the lock held when a new mapping is
+	// allocated. Optional.
+	onAlloc func(domain string, ip netip.Addr)
+}
+
+// newIPPool creates an ipPool. The network address and, for ipv4,
+// the broadcast address are not allocated.
+func newIPPool(prefix netip.Prefix) (*ipPool, error) {
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits < 2 {
+		return nil, fmt.Errorf("prefix %s is too small", prefix)
+	}
+	size := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	size.Sub(size, big.NewInt(2))
+	const maxSize = 1 << 20
+	n := maxSize
+	if size.IsInt64() && size.Int64() < maxSize {
+		n = int(size.Int64())
+	}
+
+	first := prefix.Addr().Next()
+	p := &ipPool{
+		prefix: prefix,
+		first:  first,
+		end:    addrAdd(first, n),
+		size:   n,
+		ips:    make(map[netip.Addr]string),
+	}
+	p.next = p.first
+	p.domains = lru.NewLRU[string, netip.Addr](n, nil)
+	return p, nil
+}
+
+// addrAdd returns the address n after a.
+func addrAdd(a netip.Addr, n int) netip.Addr {
+	b := a.As16()
+	v := new(big.Int).SetBytes(b[:])
+	v.Add(v, big.NewInt(int64(n)))
+	v.FillBytes(b[:])
+	r := netip.AddrFrom16(b)
+	if a.Is4() {
+		r = r.Unmap()
+	}
+	return r
+}
+
+// inRange reports whether ip can be allocated by p.
+func (p *ipPool) inRange(ip netip.Addr) bool {
+	return p.prefix.Contains(ip) && !ip.Less(p.first) && ip.Less(p.end)
+}
+
+// lookupOrAlloc returns the address of domain, allocates one if
+// domain does not have it.
+func (p *ipPool) lookupOrAlloc(domain string) netip.Addr {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if ip, ok := p.domains.Get(domain); ok {
+		p.markSeen(ip)
+		return ip
+	}
+
+	var ip netip.Addr
+	if p.domains.Len() >= p.size { // recycle the oldest mapping
+		_, oldIP, _ := p.domains.PopOldest()
+		delete(p.ips, oldIP)
+		ip = oldIP
+	} else if len(p.free) > 0 {
+		ip = p.free[0]
+		p.free = p.free[1:]
+	} else {
+		ip = p.next
+		p.next = p.next.Next()
+	}
+	p.domains.Add(domain, ip)
+	p.ips[ip] = domain
+	p.dirty = true
+	p.markSeen(ip)
+	if p.onAlloc != nil {
+		p.onAlloc(domain, ip)
+	}
+	return ip
+}
+
+// set maps domain to ip, replacing the existing mappings of both. It
+// applies mappings allocated by cluster peers. It returns false if ip
+// cannot be allocated by this pool.
+func (p *ipPool) set(domain string, ip netip.Addr) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if !p.inRange(ip) {
+		return false
+	}
+	if !ip.Less(p.next) {
+		// Every address below next is either used or free.
+		remaining := p.size - len(p.ips) - len(p.free)
+		n := 1 // addresses to allocate, including ip
+		for a := p.next; a != ip && n <= remaining; a = a.Next() {
+			n++
+		}
+		if n > remaining {
+			return false
+		}
+		for ; p.next != ip; p.next = p.next.Next() {
+			p.free = append(p.free, p.next)
+		}
+		p.next = ip.Next()
+	} else if d, used := p.ips[ip]; used {
+		if d == domain {
+			return true
+		}
+		p.domains.Del(d)
+		delete(p.ips, ip)
+	} else {
+		for i, a := range p.free {
+			if a == ip {
+				p.free = append(p.free[:i], p.free[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if old, ok := p.domains.Get(domain); ok {
+		delete(p.ips, old)
+		p.free = append(p.free, old)
+	} else if p.domains.Len() >= p.size {
+		_, oldIP, _ := p.domains.PopOldest()
+		delete(p.ips, oldIP)
+		p.free = append(p.free, oldIP)
+	}
+	p.domains.Add(domain, ip)
+	p.ips[ip] = domain
+	p.dirty = true
+	p.markSeen(ip)
+	return true
+}
+
+// lookupIP returns the domain of ip.
+func (p *ipPool) lookupIP(ip netip.Addr) (string, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	d, ok := p.ips[ip]
+	if ok {
+		p.markSeen(ip)
+	}
+	return d, ok
+}
+
+// enableRotation starts tracking used addresses for rotate. Existing
+// mappings are treated as used.
+func (p *ipPool) enableRotation() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.seen = make(map[netip.Addr]struct{}, len(p.ips))
+	for ip := range p.ips {
+		p.seen[ip] = struct{}{}
+	}
+}
+
+func (p *ipPool) markSeen(ip netip.Addr) {
+	if p.seen != nil {
+		p.seen[ip] = struct{}{}
+	}
+}
+
+// rotate frees mappings that were not used since the last rotate and
+// returns the number of them. enableRotation must be called first.
+func (p *ipPool) rotate() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	n := 0
+	p.domains.Clean(func(_ string, ip netip.Addr) bool {
+		if _, ok := p.seen[ip]; ok {
+			return false
+		}
+		delete(p.ips, ip)
+		p.free = append(p.free, ip)
+		n++
+		return true
+	})
+	clear(p.seen)
+	if n > 0 {
+		p.dirty = true
+	}
+	return n
+}
+
+func (p *ipPool) contains(ip netip.Addr) bool {
+	return p.prefix.Contains(ip)
+}
+
+// mappings returns a copy of all mappings.
+func (p *ipPool) mappings() map[string]string {
+	p.m.Lock()
+	defer p.m.Unlock()
+	m := make(map[string]string, len(p.ips))
+	for ip, d := range p.ips {
+		m[d] = ip.String()
+	}
+	return m
+}
+
+// save writes all mappings, oldest first, to w as "domain ip" lines.
+// It resets the dirty flag.
+func (p *ipPool) save(w io.Writer) error {
+	return p.dump(w, true)
+}
+
+func (p *ipPool) dump(w io.Writer, resetDirty bool) error {
+	p.m.Lock()
+	type kv struct {
+		d  string
+		ip netip.Addr
+	}
+	kvs := make([]kv, 0, p.domains.Len())
+	p.domains.Clean(func(d string, ip netip.Addr) bool {
+		kvs = append(kvs, kv{d: d, ip: ip})
+		return false
+	})
+	if resetDirty {
+		p.dirty = false
+	}
+	p.m.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, e := range kvs {
+		if _, err := fmt.Fprintf(bw, "%s %s\n", e.d, e.ip); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (p *ipPool) isDirty() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.dirty
+}
+
+// load restores mappings that were written by save. Addresses that
+// are out of the pool are ignored, so the prefix can be changed. If a
+// domain appears more than once, the last (newest) mapping is used.
+func (p *ipPool) load(r io.Reader) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(f[1])
+		if err != nil {
+			return fmt.Errorf("invalid ip %s, %w", f[1], err)
+		}
+		if !p.inRange(ip) || p.domains.Len() >= p.size {
+			continue
+		}
+		if _, dup := p.ips[ip]; dup {
+			continue
+		}
+		if old, dup := p.domains.Get(f[0]); dup {
+			delete(p.ips, old) // freed below
+		}
+		p.domains.Add(f[0], ip)
+		p.ips[ip] = f[0]
+		if !ip.Less(p.next) {
+			p.next = ip.Next()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	// Addresses below next that are not used are free.
+	for ip := p.first; ip.Less(p.next); ip = ip.Next() {
+		if _, used := p.ips[ip]; !used {
+			p.free = append(p.free, ip)
+		}
+	}
+	return nil
+}
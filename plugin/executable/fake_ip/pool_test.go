@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fake_ip
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func Test_ipPool(t *testing.T) {
+	p, err := newIPPool(netip.MustParsePrefix("10.0.0.0/30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.lookupOrAlloc("a.")
+	b := p.lookupOrAlloc("b.")
+	if a != netip.MustParseAddr("10.0.0.1") || b != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("unexpected allocation %s, %s", a, b)
+	}
+	if ip := p.lookupOrAlloc("a."); ip != a {
+		t.Fatalf("want %s, got %s", a, ip)
+	}
+
+	// Pool is full, "b." is the oldest one and should be recycled.
+	c := p.lookupOrAlloc("c.")
+	if c != b {
+		t.Fatalf("want recycled %s, got %s", b, c)
+	}
+	if d, ok := p.lookupIP(c); !ok || d != "c." {
+		t.Fatalf("want c., got %s", d)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.save(buf); err != nil {
+		t.Fatal(err)
+	}
+	np, _ := newIPPool(netip.MustParsePrefix("10.0.0.0/30"))
+	if err := np.load(buf); err != nil {
+		t.Fatal(err)
+	}
+	if ip := np.lookupOrAlloc("a."); ip != a {
+		t.Fatalf("restored mapping mismatched, want %s, got %s", a, ip)
+	}
+	if ip := np.lookupOrAlloc("c."); ip != c {
+		t.Fatalf("restored mapping mismatched, want %s, got %s", c, ip)
+	}
+
+	if _, err := newIPPool(netip.MustParsePrefix("10.0.0.0/32")); err == nil {
+		t.Fatal("too small prefix should fail")
+	}
+}
+
+func Test_ipPool_set(t *testing.T) {
+	p, err := newIPPool(netip.MustParsePrefix("10.0.0.0/29")) // 6 addresses
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocated []string
+	p.onAlloc = func(domain string, ip netip.Addr) {
+		allocated = append(allocated, domain+" "+ip.String())
+	}
+	a := p.lookupOrAlloc("a.")
+	if len(allocated) != 1 || allocated[0] != "a. 10.0.0.1" {
+		t.Fatalf("unexpected allocations %v", allocated)
+	}
+
+	if !p.set("b.", netip.MustParseAddr("10.0.0.4")) {
+		t.Fatal("failed to set b.")
+	}
+	// Addresses skipped by set are free.
+	if ip := p.lookupOrAlloc("c."); ip == a || ip == netip.MustParseAddr("10.0.0.4") || !ip.Less(netip.MustParseAddr("10.0.0.4")) {
+		t.Fatalf("c. got %s", ip)
+	}
+	// Peer reassigns a.'s address.
+	if !p.set("d.", a) {
+		t.Fatal("failed to set d.")
+	}
+	if d, _ := p.lookupIP(a); d != "d." {
+		t.Fatalf("%s should be d., got %s", a, d)
+	}
+	if ip := p.lookupOrAlloc("a."); ip == a {
+		t.Fatal("a. should get a new address")
+	}
+	if p.set("e.", netip.MustParseAddr("10.0.0.7")) || p.set("e.", netip.MustParseAddr("10.0.1.1")) {
+		t.Fatal("addresses out of the pool should not be set")
+	}
+	if len(p.ips) != p.domains.Len() {
+		t.Fatalf("inconsistent pool, %d ips, %d domains", len(p.ips), p.domains.Len())
+	}
+}
+
+func Test_ipPool_rotate(t *testing.T) {
+	p, err := newIPPool(netip.MustParsePrefix("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.lookupOrAlloc("a.")
+	b := p.lookupOrAlloc("b.")
+	p.enableRotation()
+	if n := p.rotate(); n != 0 {
+		t.Fatalf("existing mappings should be kept, but %d freed", n)
+	}
+
+	p.lookupOrAlloc("a.")
+	c := p.lookupOrAlloc("c.")
+	if n := p.rotate(); n != 1 {
+		t.Fatalf("want 1 freed, got %d", n)
+	}
+	if _, ok := p.lookupIP(b); ok {
+		t.Fatal("b. should be freed")
+	}
+	if d, _ := p.lookupIP(a); d != "a." {
+		t.Fatalf("want a., got %s", d)
+	}
+	if d, _ := p.lookupIP(c); d != "c." {
+		t.Fatalf("want c., got %s", d)
+	}
+	if ip := p.lookupOrAlloc("d."); ip != b {
+		t.Fatalf("freed %s should be reused, got %s", b, ip)
+	}
+}
+
+func Test_ipPool_freeFIFO(t *testing.T) {
+	p, err := newIPPool(netip.MustParsePrefix("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.lookupOrAlloc("a.")
+	b := p.lookupOrAlloc("b.")
+	p.enableRotation()
+	clear(p.seen)
+	p.lookupOrAlloc("c.")
+	p.rotate() // frees a. and b.
+
+	// Freed addresses are reused in the order they were freed.
+	if ip := p.lookupOrAlloc("d."); ip != a {
+		t.Fatalf("want %s, got %s", a, ip)
+	}
+	if ip := p.lookupOrAlloc("e."); ip != b {
+		t.Fatalf("want %s, got %s", b, ip)
+	}
+}
+
+func Test_ipPool_range(t *testing.T) {
+	p, err := newIPPool(netip.MustParsePrefix("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcast := netip.MustParseAddr("10.0.0.7")
+	if p.set("a.", broadcast) {
+		t.Fatal("broadcast address should not be set")
+	}
+
+	np, _ := newIPPool(netip.MustParsePrefix("10.0.0.0/29"))
+	data := "a. 10.0.0.7\nb. 10.0.0.1\nb. 10.0.0.2\n"
+	if err := np.load(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := np.lookupIP(broadcast); ok {
+		t.Fatal("broadcast address should not be loaded")
+	}
+	if d, ok := np.lookupIP(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Fatalf("earlier address of a duplicate domain is leaked to %s", d)
+	}
+	if ip := np.lookupOrAlloc("b."); ip != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("want the newest mapping of b., got %s", ip)
+	}
+	if ip := np.lookupOrAlloc("c."); ip != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("earlier address of a duplicate domain is not freed, got %s", ip)
+	}
+	if len(np.ips) != np.domains.Len() {
+		t.Fatalf("inconsistent pool, %d ips, %d domains", len(np.ips), np.domains.Len())
+	}
+}
+
+func Test_addrAdd(t *testing.T) {
+	if got := addrAdd(netip.MustParseAddr("10.0.0.255"), 2); got != netip.MustParseAddr("10.0.1.1") {
+		t.Fatalf("got %s", got)
+	}
+	if got := addrAdd(netip.MustParseAddr("fd00::ffff"), 1); got != netip.MustParseAddr("fd00::1:0") {
+		t.Fatalf("got %s", got)
+	}
+}
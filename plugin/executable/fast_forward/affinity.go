@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// AffinityConfig makes a domain prefer the upstream that answered it
+// last time. This keeps answers of geo-sensitive CDN domains consistent
+// when upstreams disagree.
+type AffinityConfig struct {
+	// TTL is how long in seconds a domain remembers its upstream after
+	// the last successful answer. Default is 600.
+	TTL int `yaml:"ttl"`
+	// Size is the max number of remembered domains. Default is 4096.
+	Size int `yaml:"size"`
+	// Timeout is how long in milliseconds the preferred upstream has to
+	// answer before the query is sent to the others. Default is 500.
+	Timeout int `yaml:"timeout"`
+}
+
+func (c *AffinityConfig) init() error {
+	if c.TTL < 0 || c.Size < 0 || c.Timeout < 0 {
+		return errors.New("negative ttl, size or timeout")
+	}
+	utils.SetDefaultNum(&c.TTL, 600)
+	utils.SetDefaultNum(&c.Size, 4096)
+	utils.SetDefaultNum(&c.Timeout, 500)
+	return nil
+}
+
+type affinity struct {
+	ttl     time.Duration
+	timeout time.Duration // of the preferred upstream
+	lru     *concurrent_lru.ShardedLRU[affinityEntry]
+}
+
+type affinityEntry struct {
+	addr   string
+	expire time.Time
+}
+
+func newAffinity(c *AffinityConfig) *affinity {
+	return &affinity{
+		ttl:     time.Duration(c.TTL) * time.Second,
+		timeout: time.Duration(c.Timeout) * time.Millisecond,
+		lru:     concurrent_lru.NewShardedLRU[affinityEntry](16, c.Size/16+1, nil),
+	}
+}
+
+// get returns the preferred upstream address of qName, or "" if there
+// is no one. a can be nil.
+func (a *affinity) get(qName string) string {
+	if a == nil {
+		return ""
+	}
+	e, ok := a.lru.Get(qName)
+	if !ok {
+		return ""
+	}
+	if time.Now().After(e.expire) {
+		a.lru.Del(qName)
+		return ""
+	}
+	return e.addr
+}
+
+// update remembers the upstream that successfully answered qName, or
+// forgets the preferred one if the exchange failed. a can be nil.
+func (a *affinity) update(qName, preferred string, qCtx *query_context.Context, r *dns.Msg, err error) {
+	if a == nil || len(qName) == 0 {
+		return
+	}
+	if err != nil || r == nil || r.Rcode != dns.RcodeSuccess {
+		if len(preferred) > 0 {
+			a.lru.Del(qName)
+		}
+		return
+	}
+	if addr, ok := query_context.GetValue(qCtx, bundled_upstream.KeyUpstream); ok {
+		a.lru.Add(qName, affinityEntry{addr: addr, expire: time.Now().Add(a.ttl)})
+	}
+}
+
+// prefer returns a copy of us with the upstream whose address is addr
+// moved to the front. The order of others is kept.
+func prefer(us []bundled_upstream.Upstream, addr string) []bundled_upstream.Upstream {
+	if len(addr) == 0 {
+		return us
+	}
+	for i, u := range us {
+		if u.Address() == addr {
+			ordered := make([]bundled_upstream.Upstream, 0, len(us))
+			ordered = append(ordered, u)
+			ordered = append(ordered, us[:i]...)
+			return append(ordered, us[i+1:]...)
+		}
+	}
+	return us
+}
+
+// exchangePreferred sends the query to the preferred upstream first. If it
+// fails, doesn't answer with NOERROR or doesn't answer within the
+// affinity timeout, the query is sent to the others in parallel.
+func (f *fastForward) exchangePreferred(ctx context.Context, qCtx *query_context.Context, us []bundled_upstream.Upstream, addr string) (*dns.Msg, error) {
+	us = prefer(us, addr)
+	if us[0].Address() != addr {
+		return bundled_upstream.ExchangeParallel(ctx, qCtx, us, f.L())
+	}
+	pCtx, cancel := context.WithTimeout(ctx, f.affinity.timeout)
+	r, err := bundled_upstream.ExchangeParallel(pCtx, qCtx, us[:1], f.L())
+	cancel()
+	if (err == nil && r != nil && r.Rcode == dns.RcodeSuccess) || len(us) == 1 || ctx.Err() != nil {
+		return r, err
+	}
+	r2, err2 := bundled_upstream.ExchangeParallel(ctx, qCtx, us[1:], f.L())
+	if err2 != nil && err == nil && r != nil {
+		// Others failed, use the first response anyway.
+		query_context.SetValue(qCtx, bundled_upstream.KeyUpstream, addr)
+		return r, nil
+	}
+	return r2, err2
+}
+
+func affinityKey(q *dns.Msg) string {
+	if len(q.Question) == 0 {
+		return ""
+	}
+	return strings.ToLower(q.Question[0].Name)
+}
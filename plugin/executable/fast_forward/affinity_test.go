@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type fakeUpstream string
+
+func (u fakeUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) { return nil, nil }
+func (u fakeUpstream) Address() string                                      { return string(u) }
+func (u fakeUpstream) Trusted() bool                                        { return true }
+
+func Test_prefer(t *testing.T) {
+	us := []bundled_upstream.Upstream{fakeUpstream("a"), fakeUpstream("b"), fakeUpstream("c")}
+	addrs := func(us []bundled_upstream.Upstream) (s string) {
+		for _, u := range us {
+			s += u.Address()
+		}
+		return s
+	}
+	if got := addrs(prefer(us, "c")); got != "cab" {
+		t.Fatalf("prefer() = %s, want cab", got)
+	}
+	if got := addrs(prefer(us, "x")); got != "abc" {
+		t.Fatalf("prefer() = %s, want abc", got)
+	}
+	if got := addrs(us); got != "abc" {
+		t.Fatal("prefer() modified its input")
+	}
+}
+
+func Test_affinity(t *testing.T) {
+	c := &AffinityConfig{}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	a := newAffinity(c)
+	q := new(dns.Msg)
+	q.SetQuestion("CDN.Example.", dns.TypeA)
+	qName := affinityKey(q)
+	qCtx := query_context.NewContext(q, nil)
+	query_context.SetValue(qCtx, bundled_upstream.KeyUpstream, "b")
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	a.update(qName, "", qCtx, r, nil)
+	if got := a.get("cdn.example."); got != "b" {
+		t.Fatalf("get() = %q, want b", got)
+	}
+
+	// Failures forget the preferred upstream.
+	a.update(qName, "b", qCtx, nil, errors.New("timeout"))
+	if got := a.get(qName); got != "" {
+		t.Fatalf("get() = %q, want empty", got)
+	}
+
+	// Entries decay.
+	a.ttl = time.Millisecond
+	a.update(qName, "", qCtx, r, nil)
+	time.Sleep(time.Millisecond * 5)
+	if got := a.get(qName); got != "" {
+		t.Fatalf("get() = %q, want empty after ttl", got)
+	}
+
+	var nilAffinity *affinity
+	if got := nilAffinity.get(qName); got != "" {
+		t.Fatal("nil affinity should have no preference")
+	}
+	nilAffinity.update(qName, "", qCtx, r, nil)
+}
+
+// hungUpstream never answers.
+type hungUpstream struct{ fakeUpstream }
+
+func (u hungUpstream) Exchange(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// replyUpstream answers every query with NOERROR.
+type replyUpstream struct{ fakeUpstream }
+
+func (u replyUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return r, nil
+}
+
+func Test_exchangePreferred_timeout(t *testing.T) {
+	f := &fastForward{
+		BP:       coremain.NewBP("test", PluginType, nil, nil),
+		affinity: newAffinity(&AffinityConfig{TTL: 1, Size: 1, Timeout: 10}),
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("cdn.example.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	us := []bundled_upstream.Upstream{replyUpstream{"b"}, hungUpstream{"a"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	r, err := f.exchangePreferred(ctx, qCtx, us, "a")
+	if err != nil || r == nil {
+		t.Fatalf("want a response of the other upstream, got %v, %v", r, err)
+	}
+	if addr, _ := query_context.GetValue(qCtx, bundled_upstream.KeyUpstream); addr != "b" {
+		t.Fatalf("want response from b, got %q", addr)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("preferred upstream is not bounded by the affinity timeout")
+	}
+}
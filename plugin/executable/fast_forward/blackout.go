@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// BlackoutConfig is a time window when an upstream is avoided, e.g. a
+// metered backup link at daytime rates.
+type BlackoutConfig struct {
+	// Days are the days when the window starts, e.g. "mon", "tue".
+	// Empty means every day.
+	Days []string `yaml:"days"`
+	// Start and End are "hh:mm". If End is earlier than Start, the
+	// window ends on the next day, e.g. 22:00-07:00.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Deprioritize still uses the upstream, but only after others.
+	// Otherwise, the upstream is not used unless no other upstream is
+	// available.
+	Deprioritize bool `yaml:"deprioritize"`
+}
+
+type blackout struct {
+	days         [7]bool // indexed by time.Weekday
+	start, end   int     // minutes of the day
+	deprioritize bool
+}
+
+func parseBlackout(c *BlackoutConfig) (*blackout, error) {
+	b := &blackout{deprioritize: c.Deprioritize}
+	var err error
+	if b.days, err = utils.ParseWeekdays(c.Days); err != nil {
+		return nil, err
+	}
+	if b.start, err = utils.ParseClock(c.Start); err != nil {
+		return nil, fmt.Errorf("invalid start, %w", err)
+	}
+	if b.end, err = utils.ParseClock(c.End); err != nil {
+		return nil, fmt.Errorf("invalid end, %w", err)
+	}
+	return b, nil
+}
+
+// active reports whether the window covers t.
+func (b *blackout) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	if b.start <= b.end {
+		return b.days[wd] && m >= b.start && m < b.end
+	}
+	// Overnight, the part after midnight belongs to the previous day.
+	if m >= b.start {
+		return b.days[wd]
+	}
+	return m < b.end && b.days[(wd+6)%7]
+}
+
+const (
+	availNormal = iota
+	availDeprioritized
+	availBlackedOut
+)
+
+// availability returns the availability of m at t.
+func (m *member) availability(t time.Time) int {
+	a := availNormal
+	for _, b := range m.blackouts {
+		if b.active(t) {
+			if !b.deprioritize {
+				return availBlackedOut
+			}
+			a = availDeprioritized
+		}
+	}
+	return a
+}
+
+// withoutBlackouts removes upstreams in blackout windows from us, and
+// moves deprioritized upstreams to the end. If all upstreams are blacked
+// out, it returns us. If ordered is false, deprioritized upstreams are
+// also removed, unless no other upstream is left.
+func withoutBlackouts(us []bundled_upstream.Upstream, t time.Time, ordered bool) []bundled_upstream.Upstream {
+	hasBlackouts := false
+	for _, u := range us {
+		if len(u.(*member).blackouts) > 0 {
+			hasBlackouts = true
+			break
+		}
+	}
+	if !hasBlackouts {
+		return us
+	}
+
+	normal := make([]bundled_upstream.Upstream, 0, len(us))
+	var deprioritized []bundled_upstream.Upstream
+	for _, u := range us {
+		switch u.(*member).availability(t) {
+		case availNormal:
+			normal = append(normal, u)
+		case availDeprioritized:
+			deprioritized = append(deprioritized, u)
+		}
+	}
+	switch {
+	case len(normal)+len(deprioritized) == 0:
+		return us
+	case ordered:
+		return append(normal, deprioritized...)
+	case len(normal) == 0:
+		return deprioritized
+	default:
+		return normal
+	}
+}
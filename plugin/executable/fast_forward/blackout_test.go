@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+func Test_withoutBlackouts(t *testing.T) {
+	day, err := parseBlackout(&BlackoutConfig{Start: "08:00", End: "20:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nightDeprioritized, err := parseBlackout(&BlackoutConfig{Days: []string{"mon"}, Start: "22:00", End: "07:00", Deprioritize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dayDeprioritized, err := parseBlackout(&BlackoutConfig{Start: "08:00", End: "20:00", Deprioritize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &member{addr: "a"}
+	b := &member{addr: "b", blackouts: []*blackout{day}}
+	c := &member{addr: "c", blackouts: []*blackout{nightDeprioritized}}
+	d := &member{addr: "d", blackouts: []*blackout{dayDeprioritized}}
+	us := []bundled_upstream.Upstream{c, b, a}
+
+	monNoon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local) // Monday
+	tueEarly := time.Date(2024, 1, 2, 3, 0, 0, 0, time.Local)
+	tueNight := time.Date(2024, 1, 2, 23, 0, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		us      []bundled_upstream.Upstream
+		t       time.Time
+		ordered bool
+		want    string
+	}{
+		{"day", us, monNoon, true, "ca"},
+		{"overnight deprioritized ordered", us, tueEarly, true, "bac"},
+		{"overnight deprioritized parallel", us, tueEarly, false, "ba"},
+		{"not monday night", us, tueNight, true, "cba"},
+		{"only deprioritized left", []bundled_upstream.Upstream{d, b}, monNoon, false, "d"},
+		{"all blacked out", []bundled_upstream.Upstream{b}, monNoon, false, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			for _, u := range withoutBlackouts(tt.us, tt.t, tt.ordered) {
+				got += u.(*member).addr
+			}
+			if got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+)
+
+// clusterChannel replicates the health of upstreams as
+// "addr failures latency_us" lines. It is registered after all members
+// are created.
+type clusterChannel struct {
+	f *fastForward
+}
+
+var _ cluster.Channel = (*clusterChannel)(nil)
+
+func appendHealth(b []byte, u *statsUpstream) []byte {
+	return fmt.Appendf(b, "%s %d %d\n", u.Address(), u.h.Failures(), u.h.Latency().Microseconds())
+}
+
+// publishHealth sends the health of u to peers.
+func (f *fastForward) publishHealth(u *statsUpstream) {
+	f.cluster.Publish(f.Tag(), appendHealth(nil, u))
+}
+
+func (c *clusterChannel) Snapshot() ([]byte, error) {
+	var b []byte
+	for _, m := range c.f.allMembers() {
+		b = appendHealth(b, m.statsUpstream)
+	}
+	return b, nil
+}
+
+func (c *clusterChannel) Apply(b []byte) error {
+	ms := c.f.allMembers()
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 3 {
+			continue
+		}
+		fails, err := strconv.Atoi(f[1])
+		if err != nil {
+			return fmt.Errorf("invalid failures %s, %w", f[1], err)
+		}
+		us, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid latency %s, %w", f[2], err)
+		}
+		// Zones may have members of the same address.
+		for _, m := range ms {
+			if m.Address() == f[0] {
+				m.h.Set(fails, time.Duration(us)*time.Microsecond)
+			}
+		}
+	}
+	return s.Err()
+}
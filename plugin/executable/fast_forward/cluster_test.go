@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/coremain"
+)
+
+func Test_clusterChannel(t *testing.T) {
+	newFF := func() *fastForward {
+		f := &fastForward{BP: coremain.NewBP("test", PluginType, nil, nil), args: &Args{}}
+		for _, addr := range []string{"udp://127.0.0.1:5300", "udp://127.0.0.1:5301"} {
+			m, err := f.newMember(&UpstreamConfig{}, addr, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.static = append(f.static, m)
+		}
+		f.members.Store(newMemberSet(f.static, ""))
+		return f
+	}
+	src, dst := newFF(), newFF()
+	defer src.Shutdown()
+	defer dst.Shutdown()
+
+	for range 3 {
+		src.static[1].h.Observe(0, errors.New("failed"))
+	}
+	src.static[0].h.Observe(time.Millisecond*20, nil)
+
+	b, err := (&clusterChannel{f: src}).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&clusterChannel{f: dst}).Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if h := dst.static[0].h; !h.Healthy() || h.Latency() != time.Millisecond*20 {
+		t.Fatalf("unexpected health of %s", dst.static[0].addr)
+	}
+	if h := dst.static[1].h; h.Healthy() || h.Failures() != 3 {
+		t.Fatalf("unexpected health of %s", dst.static[1].addr)
+	}
+
+	if err := (&clusterChannel{f: dst}).Apply([]byte("udp://127.0.0.1:5300 x 0\n")); err == nil {
+		t.Fatal("invalid data should fail")
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	discoveryTimeout    = time.Second * 10
+	memberCloseDelay    = time.Second * 30
+	maxDiscoveryRespLen = 1 << 20
+)
+
+type DiscoveryConfig struct {
+	// URL is the service discovery endpoint.
+	// "http(s)://..." returns a json array of upstream addresses or
+	// one address per line.
+	// "srv://_dns._udp.example.com" looks up the DNS SRV records.
+	// "srv+tls://..." overwrites Scheme.
+	// "svcb://_dns.example.com" looks up the DNS SVCB records, see
+	// RFC 9461. Protocols and ports are taken from the records.
+	URL string `yaml:"url"`
+	// Scheme is the protocol of upstreams from SRV records. Default is "udp".
+	Scheme   string `yaml:"scheme"`
+	Interval int    `yaml:"interval"` // (sec) Default is 60.
+	// Template is the config of discovered upstreams. Its addr is ignored.
+	// Its bootstrap is also used to lookup SRV and SVCB records.
+	Template UpstreamConfig `yaml:"template"`
+}
+
+func (c *DiscoveryConfig) init() {
+	if scheme, rest, ok := strings.Cut(c.URL, "://"); ok {
+		if srvScheme, ok := strings.CutPrefix(scheme, "srv+"); ok {
+			c.Scheme = srvScheme
+			c.URL = "srv://" + rest
+		}
+	}
+	if len(c.Scheme) == 0 {
+		c.Scheme = "udp"
+	}
+	utils.SetDefaultNum(&c.Interval, 60)
+}
+
+// isDiscoveryAddr reports whether addr is a SRV or SVCB name instead of
+// an upstream.
+func isDiscoveryAddr(addr string) bool {
+	return strings.HasPrefix(addr, "srv://") || strings.HasPrefix(addr, "srv+") ||
+		strings.HasPrefix(addr, "svcb://")
+}
+
+type discovery struct {
+	cfg      *DiscoveryConfig
+	hc       *http.Client
+	resolver *net.Resolver
+	ex       bootstrap.Exchanger // for svcb
+
+	ms []*member // current members, guarded by fastForward.discoveryMu
+}
+
+func (f *fastForward) startDiscovery(cfg *DiscoveryConfig) error {
+	cfg.init()
+	d := &discovery{
+		cfg:      cfg,
+		hc:       &http.Client{Timeout: discoveryTimeout},
+		resolver: bootstrap.NewBootstrap(cfg.Template.Bootstrap),
+	}
+	if d.resolver == nil {
+		d.resolver = net.DefaultResolver
+	}
+	switch {
+	case strings.HasPrefix(cfg.URL, "http://"), strings.HasPrefix(cfg.URL, "https://"),
+		strings.HasPrefix(cfg.URL, "srv://"):
+	case strings.HasPrefix(cfg.URL, "svcb://"):
+		ex, err := bootstrap.NewExchanger(cfg.Template.Bootstrap)
+		if err != nil {
+			return err
+		}
+		d.ex = ex
+	default:
+		return fmt.Errorf("unsupported discovery url %s", cfg.URL)
+	}
+	f.discoveryMu.Lock()
+	f.discoveries = append(f.discoveries, d)
+	f.discoveryMu.Unlock()
+
+	// Members that failed in the first discovery will be retried in the next round.
+	if err := f.refreshMembers(d); err != nil {
+		f.L().Warn("failed to discover upstreams", zap.String("url", cfg.URL), zap.Error(err))
+	}
+
+	f.M().GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.refreshMembers(d); err != nil {
+					f.L().Warn("failed to discover upstreams", zap.String("url", cfg.URL), zap.Error(err))
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// refreshMembers replaces members of d with the latest ones. Existing
+// members with the same address are reused.
+func (f *fastForward) refreshMembers(d *discovery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	addrs, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return errors.New("empty member list")
+	}
+
+	f.discoveryMu.Lock()
+	defer f.discoveryMu.Unlock()
+	old := make(map[string]*member)
+	for _, m := range d.ms {
+		old[m.addr] = m
+	}
+
+	ms := make([]*member, 0, len(addrs))
+	var added []string
+	seen := make(map[string]struct{}, len(addrs))
+	for i, addr := range addrs {
+		if _, dup := seen[addr]; dup {
+			continue
+		}
+		seen[addr] = struct{}{}
+		if m, ok := old[addr]; ok {
+			ms = append(ms, m)
+			delete(old, addr)
+			continue
+		}
+		// If there is no static upstream, the first member is trusted.
+		trusted := d.cfg.Template.Trusted || (len(f.static) == 0 && d == f.discoveries[0] && i == 0)
+		m, err := f.newMember(&d.cfg.Template, addr, trusted)
+		if err != nil {
+			f.L().Warn("invalid discovered upstream", zap.String("addr", addr), zap.Error(err))
+			continue
+		}
+		ms = append(ms, m)
+		added = append(added, addr)
+	}
+	d.ms = ms
+
+	all := append([]*member(nil), f.static...)
+	for _, other := range f.discoveries {
+		all = append(all, other.ms...)
+	}
+	f.members.Store(newMemberSet(all, f.args.Policy))
+
+	if len(added) > 0 || len(old) > 0 {
+		removed := make([]string, 0, len(old))
+		for addr, m := range old {
+			removed = append(removed, addr)
+			// Wait for in-flight queries.
+			time.AfterFunc(memberCloseDelay, m.close)
+		}
+		f.dropRemovedLatency(removed)
+		f.L().Info("upstream members updated", zap.String("url", d.cfg.URL), zap.Strings("added", added), zap.Strings("removed", removed))
+	}
+	return nil
+}
+
+// dropRemovedLatency drops latency histograms of removed addresses that
+// are no longer used by any member, e.g. of a zone. Their counters are
+// kept, so they never go backwards.
+func (f *fastForward) dropRemovedLatency(removed []string) {
+	if f.metrics == nil || len(removed) == 0 {
+		return
+	}
+	inUse := make(map[string]struct{})
+	for _, m := range f.allMembers() {
+		inUse[m.Address()] = struct{}{}
+	}
+	for _, addr := range removed {
+		if _, ok := inUse[addr]; !ok {
+			f.metrics.latency.DeleteLabelValues(addr)
+		}
+	}
+}
+
+func (d *discovery) lookup(ctx context.Context) ([]string, error) {
+	if name, ok := strings.CutPrefix(d.cfg.URL, "srv://"); ok {
+		_, srvs, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(srvs))
+		for _, srv := range srvs { // already sorted by priority and weight
+			host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			addrs = append(addrs, d.cfg.Scheme+"://"+host)
+		}
+		return addrs, nil
+	}
+	if name, ok := strings.CutPrefix(d.cfg.URL, "svcb://"); ok {
+		return lookupSVCB(ctx, d.ex, dns.Fqdn(name))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoveryRespLen))
+	if err != nil {
+		return nil, err
+	}
+	return parseMemberList(b)
+}
+
+// parseMemberList parses a json array of strings or a list of addresses,
+// one per line. Empty lines and "#" comments are ignored.
+func parseMemberList(b []byte) ([]string, error) {
+	b = bytes.TrimSpace(b)
+	var addrs []string
+	if len(b) > 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &addrs); err != nil {
+			return nil, fmt.Errorf("invalid json member list, %w", err)
+		}
+		return addrs, nil
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, nil
+}
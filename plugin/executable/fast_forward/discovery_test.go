@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pmkol/mosdns-x/coremain"
+)
+
+func Test_parseMemberList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`["udp://1.1.1.1", "tls://8.8.8.8"]`, []string{"udp://1.1.1.1", "tls://8.8.8.8"}},
+		{"udp://1.1.1.1\n# comment\n\n tls://8.8.8.8 # dot\n", []string{"udp://1.1.1.1", "tls://8.8.8.8"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseMemberList([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	if _, err := parseMemberList([]byte("[1]")); err == nil {
+		t.Fatal("invalid json should fail")
+	}
+}
+
+func TestDiscoveryConfig_init(t *testing.T) {
+	c := &DiscoveryConfig{URL: "srv+tls://_dns._tcp.example.com"}
+	c.init()
+	if c.URL != "srv://_dns._tcp.example.com" || c.Scheme != "tls" {
+		t.Fatalf("got url %s, scheme %s", c.URL, c.Scheme)
+	}
+	c = &DiscoveryConfig{URL: "srv://_dns._udp.example.com"}
+	c.init()
+	if c.Scheme != "udp" {
+		t.Fatalf("default scheme should be udp, got %s", c.Scheme)
+	}
+}
+
+func Test_refreshMembers(t *testing.T) {
+	var list atomic.Value
+	list.Store("udp://127.0.0.1:5301\nudp://127.0.0.1:5302\nudp://127.0.0.1:5302")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(list.Load().(string)))
+	}))
+	defer s.Close()
+
+	f := &fastForward{BP: coremain.NewBP("test", PluginType, nil, nil), args: &Args{}}
+	static, err := f.newMember(&UpstreamConfig{}, "udp://127.0.0.1:5300", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.static = []*member{static}
+	f.members.Store(newMemberSet(f.static, ""))
+
+	cfg := &DiscoveryConfig{URL: s.URL}
+	cfg.init()
+	d := &discovery{cfg: cfg, hc: s.Client()}
+	f.discoveries = []*discovery{d}
+
+	addrs := func() []string {
+		var s []string
+		for _, m := range f.members.Load().ms {
+			s = append(s, m.addr)
+		}
+		return s
+	}
+
+	if err := f.refreshMembers(d); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrs(), []string{"udp://127.0.0.1:5300", "udp://127.0.0.1:5301", "udp://127.0.0.1:5302"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	m5302 := f.members.Load().ms[2]
+
+	list.Store(`["udp://127.0.0.1:5302", "udp://127.0.0.1:5303"]`)
+	if err := f.refreshMembers(d); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrs(), []string{"udp://127.0.0.1:5300", "udp://127.0.0.1:5302", "udp://127.0.0.1:5303"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if f.members.Load().ms[1] != m5302 {
+		t.Fatal("existing member should be reused")
+	}
+	if len(f.members.Load().us) != 3 {
+		t.Fatal("upstream list is not updated")
+	}
+
+	list.Store("")
+	if err := f.refreshMembers(d); err == nil {
+		t.Fatal("empty list should be rejected")
+	}
+	if len(addrs()) != 3 {
+		t.Fatal("members should be kept if discovery failed")
+	}
+}
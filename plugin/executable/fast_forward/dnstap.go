@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
+)
+
+func lookupDnstap(bp *coremain.BP, tag string) (dnstap.Logger, error) {
+	e := bp.M().GetExecutables()[tag]
+	if e == nil {
+		return nil, fmt.Errorf("cannot find plugin %s", tag)
+	}
+	l, ok := e.(dnstap.Logger)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s is not a dnstap plugin", tag)
+	}
+	return l, nil
+}
+
+// upstreamTap logs exchanges with an upstream to dnstap.
+type upstreamTap struct {
+	l        dnstap.Logger
+	protocol dnstap.SocketProtocol
+	addr     netip.AddrPort // invalid if the upstream host is not an ip
+}
+
+func newUpstreamTap(l dnstap.Logger, addr string) *upstreamTap {
+	protocol, ap := parseTapAddr(addr)
+	return &upstreamTap{l: l, protocol: protocol, addr: ap}
+}
+
+// parseTapAddr returns the dnstap protocol and the address of an
+// upstream address. The address is invalid if the host is a domain.
+func parseTapAddr(s string) (dnstap.SocketProtocol, netip.AddrPort) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return 0, netip.AddrPort{}
+	}
+	var protocol dnstap.SocketProtocol
+	var defaultPort string
+	switch u.Scheme {
+	case "udp", "udpme":
+		protocol, defaultPort = dnstap.UDP, "53"
+	case "tcp":
+		protocol, defaultPort = dnstap.TCP, "53"
+	case "tls":
+		protocol, defaultPort = dnstap.DOT, "853"
+	case "https", "h3":
+		protocol, defaultPort = dnstap.DOH, "443"
+	case "quic":
+		protocol, defaultPort = dnstap.DOQ, "853"
+	default:
+		return 0, netip.AddrPort{}
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	ap, _ := netip.ParseAddrPort(net.JoinHostPort(u.Hostname(), port))
+	return protocol, ap
+}
+
+func (t *upstreamTap) exchange(ctx context.Context, q *dns.Msg, next func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	queryTime := time.Now()
+	qb, _ := q.Pack()
+	t.l.Log(&dnstap.Message{
+		Type:            dnstap.ForwarderQuery,
+		Protocol:        t.protocol,
+		ResponseAddress: t.addr,
+		QueryTime:       queryTime,
+		QueryMessage:    qb,
+	})
+
+	r, err := next(ctx, q)
+	if r != nil {
+		rb, _ := r.Pack()
+		t.l.Log(&dnstap.Message{
+			Type:            dnstap.ForwarderResponse,
+			Protocol:        t.protocol,
+			ResponseAddress: t.addr,
+			QueryTime:       queryTime,
+			QueryMessage:    qb,
+			ResponseTime:    time.Now(),
+			ResponseMessage: rb,
+		})
+	}
+	return r, err
+}
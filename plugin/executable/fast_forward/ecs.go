@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+// ecsRejectTTL is how long queries to an upstream that rejected ECS are
+// sent without ECS. ECS is tried again after that.
+const ecsRejectTTL = time.Hour
+
+// ecsFallback retries a query without ECS if the upstream replied
+// SERVFAIL or FORMERR to it, since some resolvers reject unknown
+// options. If the retry succeeded, the upstream is remembered and
+// later queries are sent without ECS for ecsRejectTTL.
+type ecsFallback struct {
+	logger      *zap.Logger
+	rejectUntil atomic.Int64 // unix nano
+}
+
+func (e *ecsFallback) exchange(ctx context.Context, q *dns.Msg, next func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	if dnsutils.GetMsgECS(q) == nil {
+		return next(ctx, q)
+	}
+	if time.Now().UnixNano() < e.rejectUntil.Load() {
+		return next(ctx, withoutECS(q))
+	}
+
+	r, err := next(ctx, q)
+	if err != nil || !isECSRejection(r.Rcode) {
+		return r, err
+	}
+	r2, err := next(ctx, withoutECS(q))
+	if err != nil || isECSRejection(r2.Rcode) {
+		return r, nil // ECS was not the cause.
+	}
+	now := time.Now()
+	if e.rejectUntil.Swap(now.Add(ecsRejectTTL).UnixNano()) < now.UnixNano() {
+		e.logger.Info("upstream rejected ecs, sending queries without ecs", zap.Duration("duration", ecsRejectTTL))
+	}
+	return r2, nil
+}
+
+func isECSRejection(rcode int) bool {
+	return rcode == dns.RcodeServerFailure || rcode == dns.RcodeFormatError
+}
+
+// withoutECS returns a copy of q without ECS. q may be shared by
+// concurrent upstreams, it must not be modified.
+func withoutECS(q *dns.Msg) *dns.Msg {
+	nq := q.Copy()
+	dnsutils.RemoveMsgECS(nq)
+	return nq
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func Test_ecsFallback(t *testing.T) {
+	var calls, callsWithECS int
+	next := func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		calls++
+		r := new(dns.Msg)
+		if dnsutils.GetMsgECS(q) != nil {
+			callsWithECS++
+			r.SetRcode(q, dns.RcodeFormatError)
+		} else {
+			r.SetReply(q)
+		}
+		return r, nil
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	dnsutils.AddECS(q.IsEdns0(), dnsutils.NewEDNS0Subnet(net.ParseIP("1.2.3.0"), 24, false), true)
+
+	e := &ecsFallback{logger: zap.NewNop()}
+	r, err := e.exchange(context.Background(), q, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || calls != 2 || callsWithECS != 1 {
+		t.Fatalf("unexpected retry, rcode %d, calls %d, calls with ecs %d", r.Rcode, calls, callsWithECS)
+	}
+	if dnsutils.GetMsgECS(q) == nil {
+		t.Fatal("query was modified")
+	}
+
+	// The upstream is remembered, ECS should not be sent.
+	if _, err := e.exchange(context.Background(), q, next); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || callsWithECS != 1 {
+		t.Fatalf("ecs should be removed, calls %d, calls with ecs %d", calls, callsWithECS)
+	}
+}
@@ -26,15 +26,22 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/cluster"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/upstream"
+	"github.com/pmkol/mosdns-x/pkg/upstream/dialer"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -48,31 +55,212 @@ var _ coremain.ExecutablePlugin = (*fastForward)(nil)
 
 type fastForward struct {
 	*coremain.BP
-	args *Args
+	args    *Args
+	rootCAs *x509.CertPool
 
-	upstreamWrappers []bundled_upstream.Upstream
-	upstreamsCloser  []io.Closer
+	svcbStore *upstream.SVCBFileStore // maybe nil
+
+	static  []*member
+	members atomic.Pointer[memberSet] // static and discovered members
+
+	zones    map[string]*zone // fqdn -> zone
+	zoneList []*zone
+
+	forced map[string]int // fqdn -> transport
+
+	affinity    *affinity     // maybe nil
+	rcodePolicy *rcodePolicy  // maybe nil
+	dnstap      dnstap.Logger // maybe nil
+
+	discoveryMu sync.Mutex
+	discoveries []*discovery
+
+	metrics *upstreamMetrics // maybe nil in tests
+
+	cluster *cluster.Cluster // maybe nil
+}
+
+// member is an upstream of fastForward.
+type member struct {
+	*statsUpstream
+	addr   string    // configured address
+	weight int       // >= 1
+	closer io.Closer // maybe nil
+
+	transport     int  // transportUDP etc.
+	proxyProtocol bool // queries need the client address in ctx
+
+	blackouts []*blackout
+
+	limiter *concurrent_limiter.ConcurrencyLimiter // maybe nil
+
+	stopHealthCheck chan struct{} // nil if health checks are disabled
+}
+
+type memberSet struct {
+	ms []*member
+	us []bundled_upstream.Upstream
+
+	wrr           *weightedRR // for policyWeighted
+	ring          *hashRing   // for policyConsistentHash
+	lowestLatency bool        // for policyLowestLatency
+	proxyProtocol bool        // any member has proxy_protocol
+}
+
+func newMemberSet(ms []*member, policy string) *memberSet {
+	s := &memberSet{ms: ms, us: make([]bundled_upstream.Upstream, 0, len(ms))}
+	for _, m := range ms {
+		s.us = append(s.us, m)
+		s.proxyProtocol = s.proxyProtocol || m.proxyProtocol
+	}
+	switch policy {
+	case policyWeighted:
+		s.wrr = newWeightedRR(ms)
+	case policyConsistentHash:
+		s.ring = newHashRing(ms)
+	case policyLowestLatency:
+		s.lowestLatency = true
+	}
+	return s
 }
 
 type Args struct {
 	Upstream []*UpstreamConfig `yaml:"upstream"`
 	CA       []string          `yaml:"ca"`
+
+	// Discovery fetches additional upstreams from a service discovery
+	// endpoint. Optional.
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+
+	// Policy of upstream selection. Can be "parallel" (default),
+	// "weighted", "consistent_hash" or "lowest_latency". With the latter
+	// three, a query is sent to one upstream, others are fallbacks if it
+	// fails.
+	Policy string `yaml:"policy"`
+
+	// HealthCheck probes upstreams periodically. Unhealthy upstreams are
+	// skipped, or tried last if the policy has fallbacks. Optional.
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+
+	// Cluster replicates the health of upstreams to cluster peers, so a
+	// standby node does not start with failed upstreams marked healthy.
+	// Peers must have the same tag. See coremain.ClusterConfig.
+	Cluster bool `yaml:"cluster"`
+
+	// Zones forwards queries of some zones to other upstreams. If
+	// only zones are configured, other queries are passed to the next
+	// node untouched.
+	Zones []*ZoneConfig `yaml:"zones"`
+
+	// Prewarm connects to upstreams at startup and after network
+	// changes (Linux only), so the first queries don't wait for
+	// TLS/QUIC handshakes.
+	Prewarm bool `yaml:"prewarm"`
+
+	// Privacy adds random delays and dummy queries, and makes queries
+	// uniform. Optional.
+	Privacy *PrivacyConfig `yaml:"privacy"`
+
+	// Affinity makes domains prefer the upstream that answered them
+	// last time. Optional.
+	Affinity *AffinityConfig `yaml:"affinity"`
+
+	// RcodePolicy handles REFUSED, FORMERR etc. from upstreams. Optional.
+	RcodePolicy *RcodePolicyConfig `yaml:"rcode_policy"`
+
+	// ForceTransport resolves some domains only over tcp or encrypted
+	// upstreams. Optional.
+	ForceTransport []*ForceTransportConfig `yaml:"force_transport"`
+
+	// Dnstap is the tag of a dnstap plugin. Queries to upstreams and
+	// their responses are logged as FORWARDER_QUERY and
+	// FORWARDER_RESPONSE messages. Optional.
+	Dnstap string `yaml:"dnstap"`
+
+	// SVCBPersist is the file that SVCB params of upstreams are saved
+	// to, see UpstreamConfig.SVCB. It should not be shared with other
+	// plugins. Optional.
+	SVCBPersist string `yaml:"svcb_persist"`
 }
 
 type UpstreamConfig struct {
-	Addr           string `yaml:"addr"` // required
-	DialAddr       string `yaml:"dial_addr"`
-	Trusted        bool   `yaml:"trusted"`
-	Socks5         string `yaml:"socks5"`
-	SoMark         int    `yaml:"so_mark"`
-	BindToDevice   string `yaml:"bind_to_device"`
-	IdleTimeout    int    `yaml:"idle_timeout"`
-	MaxConns       int    `yaml:"max_conns"`
-	EnablePipeline bool   `yaml:"enable_pipeline"`
-	Bootstrap      string `yaml:"bootstrap"`
-	Insecure       bool   `yaml:"insecure"`
-	KernelTX       bool   `yaml:"kernel_tx"` // use kernel tls to send data
-	KernelRX       bool   `yaml:"kernel_rx"` // use kernel tls to receive data
+	Addr           string   `yaml:"addr"` // required
+	DialAddr       string   `yaml:"dial_addr"`
+	Trusted        bool     `yaml:"trusted"`
+	Weight         int      `yaml:"weight"` // for weighted and consistent_hash policy, default 1
+	Socks5         string   `yaml:"socks5"`
+	HTTPProxy      string   `yaml:"http_proxy"`
+	Proxies        []string `yaml:"proxies"` // a chain of "socks5://" and "http://" proxies
+	SoMark         int      `yaml:"so_mark"`
+	BindToDevice   string   `yaml:"bind_to_device"`
+	IdleTimeout    int      `yaml:"idle_timeout"`
+	MaxConns       int      `yaml:"max_conns"`
+	EnablePipeline bool     `yaml:"enable_pipeline"` // for tcp and dot
+	Bootstrap      string   `yaml:"bootstrap"`
+	Insecure       bool     `yaml:"insecure"`
+	KernelTX       bool     `yaml:"kernel_tx"` // use kernel tls to send data
+	KernelRX       bool     `yaml:"kernel_rx"` // use kernel tls to receive data
+
+	// Headers and QueryParams are added to DoH requests. A "Host"
+	// header overwrites the request host.
+	Headers     map[string]string `yaml:"headers"`
+	QueryParams map[string]string `yaml:"query_params"`
+
+	// Tailscale dials the upstream through the tailnet. See
+	// coremain.TailscaleConfig.
+	Tailscale bool `yaml:"tailscale"`
+
+	// Socks5HandshakeTimeout is the timeout of socks5 handshakes in
+	// seconds. Default is 10.
+	Socks5HandshakeTimeout int `yaml:"socks5_handshake_timeout"`
+
+	// H3Fallback makes h3:// upstreams fall back to HTTP/2 if HTTP/3
+	// fails, e.g. UDP is blocked.
+	H3Fallback bool `yaml:"h3_fallback"`
+
+	// ODoHProxy is the url of the proxy of odoh:// upstreams, e.g.
+	// "https://odoh-proxy.example/proxy".
+	ODoHProxy string `yaml:"odoh_proxy"`
+
+	// MaxQueriesPerConn is the number of queries a pipelined tcp or dot
+	// connection serves before it is replaced. Default is 65535.
+	MaxQueriesPerConn int `yaml:"max_queries_per_conn"`
+
+	// HappyEyeballsDelay is the delay in milliseconds between tcp dial
+	// attempts to the addresses of the upstream host name. Default is
+	// 250. Negative disables racing ipv6 and ipv4 addresses.
+	HappyEyeballsDelay int `yaml:"happy_eyeballs_delay"`
+
+	// TLS overwrites tls parameters of tls based upstreams. Optional.
+	TLS *TLSConfig `yaml:"tls"`
+
+	// SVCB uses the port and ech config that DoT, DoQ, DoH and DoH3
+	// servers advertise in their SVCB/HTTPS records, and refreshes them
+	// by their ttl. See upstream.Opt.SVCB.
+	SVCB bool `yaml:"svcb"`
+
+	// ProxyProtocol sends a PROXY protocol v2 header with the query's
+	// client address, for upstreams behind load balancers that require
+	// it. Only tcp and dot upstreams support it, and they open a new
+	// connection for each query.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+
+	// Blackouts are time windows when the upstream is not used, or only
+	// used after other upstreams.
+	Blackouts []*BlackoutConfig `yaml:"blackouts"`
+
+	// MaxConcurrent limits concurrent queries to the upstream, so a hung
+	// upstream can't hold all queries. Queries over the limit wait in a
+	// queue of MaxQueue queries. If the queue is full, the query fails
+	// on this upstream and other upstreams are tried. Default is no limit.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	MaxQueue      int `yaml:"max_queue"`
+
+	// DiscoveryInterval is the refresh interval in seconds of "srv://"
+	// and "svcb://" addrs. Those addrs are looked up like
+	// DiscoveryConfig.URL, and every endpoint becomes an upstream with
+	// this config. Default is 60.
+	DiscoveryInterval int `yaml:"discovery_interval"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -80,86 +268,276 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 }
 
 func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
-	if len(args.Upstream) == 0 {
+	if len(args.Upstream) == 0 && args.Discovery == nil && len(args.Zones) == 0 {
 		return nil, errors.New("no upstream is configured")
 	}
+	if err := checkPolicy(args.Policy); err != nil {
+		return nil, err
+	}
+	if args.Privacy != nil {
+		if err := args.Privacy.init(); err != nil {
+			return nil, fmt.Errorf("invalid privacy config, %w", err)
+		}
+	}
+	if args.Affinity != nil {
+		if err := args.Affinity.init(); err != nil {
+			return nil, fmt.Errorf("invalid affinity config, %w", err)
+		}
+	}
 
 	f := &fastForward{
-		BP:   bp,
-		args: args,
+		BP:      bp,
+		args:    args,
+		metrics: newUpstreamMetrics(bp.GetMetricsReg()),
+	}
+	bp.GetMetricsReg().MustRegister(&upstreamCollector{f: f})
+	if args.Affinity != nil {
+		f.affinity = newAffinity(args.Affinity)
+	}
+	if args.RcodePolicy != nil {
+		p, err := newRcodePolicy(args.RcodePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rcode policy, %w", err)
+		}
+		f.rcodePolicy = p
+	}
+	if tag := args.Dnstap; len(tag) > 0 {
+		l, err := lookupDnstap(bp, tag)
+		if err != nil {
+			return nil, err
+		}
+		f.dnstap = l
+	}
+
+	// Members publish health changes once they are created.
+	if args.Cluster {
+		c, err := bp.M().GetCluster()
+		if err != nil {
+			return nil, err
+		}
+		f.cluster = c
 	}
 
 	// rootCAs
-	var rootCAs *x509.CertPool
 	if len(args.CA) != 0 {
 		var err error
-		rootCAs, err = utils.LoadCertPool(args.CA)
+		f.rootCAs, err = utils.LoadCertPool(args.CA)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load ca: %w", err)
 		}
 	}
 
-	for i, c := range args.Upstream {
-		if len(c.Addr) == 0 {
-			return nil, errors.New("missing server addr")
+	if len(args.SVCBPersist) > 0 {
+		var err error
+		if f.svcbStore, err = upstream.NewSVCBFileStore(args.SVCBPersist); err != nil {
+			return nil, err
 		}
+	}
 
-		if strings.HasPrefix(c.Addr, "udpme://") {
-			u := newUDPME(c.Addr[8:], c.Trusted)
-			f.upstreamWrappers = append(f.upstreamWrappers, u)
-			if i == 0 {
-				u.trusted = true
-			}
+	var discoveries []*DiscoveryConfig
+	for i, c := range args.Upstream {
+		if isDiscoveryAddr(c.Addr) {
+			dc := &DiscoveryConfig{URL: c.Addr, Interval: c.DiscoveryInterval, Template: *c}
+			dc.Template.Trusted = c.Trusted || i == 0
+			discoveries = append(discoveries, dc)
 			continue
 		}
+		// Set first upstream as trusted upstream.
+		m, err := f.newMember(c, c.Addr, c.Trusted || i == 0)
+		if err != nil {
+			f.Shutdown()
+			return nil, err
+		}
+		f.static = append(f.static, m)
+	}
+	f.members.Store(newMemberSet(f.static, args.Policy))
+
+	if err := f.initZones(args.Zones); err != nil {
+		f.Shutdown()
+		return nil, err
+	}
+	if err := f.initForceTransport(args.ForceTransport); err != nil {
+		f.Shutdown()
+		return nil, err
+	}
+
+	for _, dc := range discoveries {
+		if err := f.startDiscovery(dc); err != nil {
+			f.Shutdown()
+			return nil, fmt.Errorf("failed to init upstream %s, %w", dc.URL, err)
+		}
+	}
+	if args.Discovery != nil {
+		if err := f.startDiscovery(args.Discovery); err != nil {
+			f.Shutdown()
+			return nil, fmt.Errorf("failed to init discovery, %w", err)
+		}
+	}
 
-		opt := &upstream.Opt{
-			DialAddr:       c.DialAddr,
-			Socks5:         c.Socks5,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			MaxConns:       c.MaxConns,
-			EnablePipeline: c.EnablePipeline,
-			Bootstrap:      c.Bootstrap,
-			Insecure:       c.Insecure,
-			RootCAs:        rootCAs,
-			KernelTX:       c.KernelTX,
-			KernelRX:       c.KernelRX,
-			Logger:         bp.L(),
+	if args.Prewarm {
+		f.startPrewarm()
+	}
+	if args.Privacy != nil && args.Privacy.CoverInterval > 0 {
+		f.startCoverTraffic(args.Privacy)
+	}
+	if f.cluster != nil {
+		if err := f.cluster.Register(f.Tag(), &clusterChannel{f: f}); err != nil {
+			f.Shutdown()
+			return nil, err
 		}
+	}
+	return f, nil
+}
 
-		u, err := upstream.NewUpstream(c.Addr, opt)
+// newMember creates an upstream from c, addr overwrites c.Addr.
+func (f *fastForward) newMember(c *UpstreamConfig, addr string, trusted bool) (*member, error) {
+	if len(addr) == 0 {
+		return nil, errors.New("missing server addr")
+	}
+	weight := max(c.Weight, 1)
+	var blackouts []*blackout
+	for i, bc := range c.Blackouts {
+		b, err := parseBlackout(bc)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init upstream: %w", err)
+			return nil, fmt.Errorf("invalid blackout #%d, %w", i, err)
+		}
+		blackouts = append(blackouts, b)
+	}
+	if c.MaxConcurrent < 0 || c.MaxQueue < 0 {
+		return nil, errors.New("negative max_concurrent or max_queue")
+	}
+	var limiter *concurrent_limiter.ConcurrencyLimiter
+	if c.MaxConcurrent > 0 {
+		limiter = concurrent_limiter.NewConcurrencyLimiter(c.MaxConcurrent, c.MaxQueue)
+	}
+
+	if strings.HasPrefix(addr, "udpme://") {
+		m := &member{statsUpstream: f.newStatsUpstream(newUDPME(addr[8:], trusted)), addr: addr, weight: weight, blackouts: blackouts, limiter: limiter}
+		if f.args.HealthCheck != nil {
+			f.startHealthCheck(m)
 		}
+		return m, nil
+	}
 
-		w := &upstreamWrapper{
-			address: c.Addr,
-			trusted: c.Trusted,
-			u:       u,
+	opt := &upstream.Opt{
+		DialAddr:               c.DialAddr,
+		Socks5:                 c.Socks5,
+		Socks5HandshakeTimeout: time.Duration(c.Socks5HandshakeTimeout) * time.Second,
+		HTTPProxy:              c.HTTPProxy,
+		Proxies:                c.Proxies,
+		SoMark:                 c.SoMark,
+		BindToDevice:           c.BindToDevice,
+		IdleTimeout:            time.Duration(c.IdleTimeout) * time.Second,
+		MaxConns:               c.MaxConns,
+		EnablePipeline:         c.EnablePipeline,
+		MaxQueryPerConn:        c.MaxQueriesPerConn,
+		Bootstrap:              c.Bootstrap,
+		HappyEyeballsDelay:     time.Duration(c.HappyEyeballsDelay) * time.Millisecond,
+		Insecure:               c.Insecure,
+		RootCAs:                f.rootCAs,
+		KernelTX:               c.KernelTX,
+		KernelRX:               c.KernelRX,
+		Headers:                c.Headers,
+		QueryParams:            c.QueryParams,
+		H3Fallback:             c.H3Fallback,
+		ODoHProxy:              c.ODoHProxy,
+		ProxyProtocol:          c.ProxyProtocol,
+		SVCB:                   c.SVCB,
+		Logger:                 f.L(),
+	}
+	if f.svcbStore != nil {
+		opt.SVCBStore = f.svcbStore
+	}
+	if c.TLS != nil {
+		if err := c.TLS.apply(opt); err != nil {
+			return nil, err
 		}
+	}
 
-		if i == 0 { // Set first upstream as trusted upstream.
-			w.trusted = true
+	if c.Tailscale {
+		dial, err := f.M().TailscaleDialer()
+		if err != nil {
+			return nil, err
 		}
+		opt.DialFunc = dial
+	}
 
-		f.upstreamWrappers = append(f.upstreamWrappers, w)
-		f.upstreamsCloser = append(f.upstreamsCloser, u)
+	u, err := upstream.NewUpstream(addr, opt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init upstream: %w", err)
 	}
 
-	return f, nil
+	w := &upstreamWrapper{
+		address: addr,
+		trusted: trusted,
+		u:       u,
+		ecs:     &ecsFallback{logger: f.L().With(zap.String("addr", addr))},
+		uniform: f.args.Privacy != nil && f.args.Privacy.UniformQueries,
+	}
+	if f.rcodePolicy != nil {
+		w.rcode = newRcodeFilter(f.rcodePolicy)
+	}
+	if f.dnstap != nil {
+		w.tap = newUpstreamTap(f.dnstap, addr)
+	}
+	m := &member{statsUpstream: f.newStatsUpstream(w), addr: addr, weight: weight, closer: u, transport: addrTransport(addr), proxyProtocol: c.ProxyProtocol, blackouts: blackouts, limiter: limiter}
+	if f.args.HealthCheck != nil {
+		f.startHealthCheck(m)
+	}
+	return m, nil
+}
+
+func (f *fastForward) newStatsUpstream(u bundled_upstream.Upstream) *statsUpstream {
+	threshold := 0
+	if c := f.args.HealthCheck; c != nil {
+		threshold = c.FailureThreshold
+	}
+	s := newStatsUpstream(u, threshold)
+	if um := f.metrics; um != nil {
+		s.queryTotal = um.queryTotal.WithLabelValues(u.Address())
+		s.errTotal = um.errTotal.WithLabelValues(u.Address())
+		s.latency = um.latency.WithLabelValues(u.Address())
+	}
+	if f.cluster != nil {
+		s.h.SetOnChange(func(bool) { f.publishHealth(s) })
+	}
+	return s
 }
 
 type upstreamWrapper struct {
 	address string
 	trusted bool
 	u       upstream.Upstream
+	rcode   *rcodeFilter // maybe nil
+	ecs     *ecsFallback
+	uniform bool
+	tap     *upstreamTap // maybe nil
 }
 
 func (u *upstreamWrapper) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.tap != nil {
+		return u.tap.exchange(ctx, q, u.exchangeUniform)
+	}
+	return u.exchangeUniform(ctx, q)
+}
+
+func (u *upstreamWrapper) exchangeUniform(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.uniform {
+		return exchangeUniform(ctx, q, u.exchangeFiltered)
+	}
+	return u.exchangeFiltered(ctx, q)
+}
+
+func (u *upstreamWrapper) exchangeFiltered(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	q.Compress = true
-	return u.u.ExchangeContext(ctx, q)
+	if u.rcode != nil {
+		return u.rcode.exchange(ctx, q, u.exchange)
+	}
+	return u.exchange(ctx, q)
+}
+
+func (u *upstreamWrapper) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return u.ecs.exchange(ctx, q, u.u.ExchangeContext)
 }
 
 func (u *upstreamWrapper) Address() string {
@@ -183,7 +561,45 @@ func (f *fastForward) Exec(ctx context.Context, qCtx *query_context.Context, nex
 }
 
 func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) (err error) {
-	r, err := bundled_upstream.ExchangeParallel(ctx, qCtx, f.upstreamWrappers, f.L())
+	var r *dns.Msg
+	s := f.members.Load()
+	if z := f.matchZone(qCtx.Q()); z != nil {
+		z.prepare(qCtx.Q())
+		s = z.members
+		qCtx.Tracef("%s: using zone upstreams", f.Tag())
+	}
+	if len(s.ms) == 0 {
+		return nil
+	}
+	t := f.forcedTransport(qCtx.Q())
+	if !s.hasTransport(t) {
+		return errors.New("no upstream of the forced transport")
+	}
+	if err := f.jitter(ctx); err != nil {
+		return err
+	}
+	if s.proxyProtocol {
+		ctx = dialer.WithClientAddr(ctx, qCtx.ReqMeta().GetClientAddr())
+	}
+	qName := affinityKey(qCtx.Q())
+	preferred := f.affinity.get(qName)
+	if len(preferred) > 0 {
+		qCtx.Tracef("%s: affinity prefers %s", f.Tag(), preferred)
+	}
+	now := time.Now()
+	switch {
+	case s.wrr != nil:
+		r, err = bundled_upstream.ExchangeSequential(ctx, qCtx, withoutBlackouts(f.healthyFirst(prefer(withTransport(s.wrr.order(), t), preferred)), now, true), f.L())
+	case s.ring != nil:
+		r, err = bundled_upstream.ExchangeSequential(ctx, qCtx, withoutBlackouts(f.healthyFirst(prefer(withTransport(s.ring.order(qName), t), preferred)), now, true), f.L())
+	case s.lowestLatency:
+		r, err = bundled_upstream.ExchangeSequential(ctx, qCtx, withoutBlackouts(f.healthyFirst(prefer(withTransport(byLatency(s.ms), t), preferred)), now, true), f.L())
+	case len(preferred) > 0:
+		r, err = f.exchangePreferred(ctx, qCtx, withoutBlackouts(f.onlyHealthy(withTransport(s.us, t)), now, false), preferred)
+	default:
+		r, err = bundled_upstream.ExchangeParallel(ctx, qCtx, withoutBlackouts(f.onlyHealthy(withTransport(s.us, t)), now, false), f.L())
+	}
+	f.affinity.update(qName, preferred, qCtx, r, err)
 	if err != nil {
 		return err
 	}
@@ -192,8 +608,26 @@ func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) (er
 }
 
 func (f *fastForward) Shutdown() error {
-	for _, u := range f.upstreamsCloser {
-		u.Close()
+	ms := f.static
+	if s := f.members.Load(); s != nil {
+		ms = s.ms
+	}
+	for _, m := range ms {
+		m.close()
+	}
+	for _, z := range f.zoneList {
+		for _, m := range z.static {
+			m.close()
+		}
 	}
 	return nil
 }
+
+func (m *member) close() {
+	if m.stopHealthCheck != nil {
+		close(m.stopHealthCheck)
+	}
+	if m.closer != nil {
+		m.closer.Close()
+	}
+}
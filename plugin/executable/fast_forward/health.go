@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/upstream"
+)
+
+// HealthCheckConfig configures active health checks of upstreams.
+type HealthCheckConfig struct {
+	Interval int `yaml:"interval"` // (sec) Default is 30.
+	Timeout  int `yaml:"timeout"`  // (sec) Default is 5.
+	// Domain is the name of A queries of probes. Default is "." NS.
+	Domain string `yaml:"domain"`
+	// FailureThreshold is the number of consecutive failures that make
+	// an upstream unhealthy. Default is 3.
+	FailureThreshold int `yaml:"failure_threshold"`
+}
+
+func (c *HealthCheckConfig) opts() upstream.HealthCheckOpts {
+	opts := upstream.HealthCheckOpts{
+		Interval: time.Duration(c.Interval) * time.Second,
+		Timeout:  time.Duration(c.Timeout) * time.Second,
+	}
+	if len(c.Domain) > 0 {
+		opts.Query = new(dns.Msg)
+		opts.Query.SetQuestion(dns.Fqdn(c.Domain), dns.TypeA)
+	}
+	return opts
+}
+
+// startHealthCheck probes m until it's closed.
+func (f *fastForward) startHealthCheck(m *member) {
+	m.stopHealthCheck = make(chan struct{})
+	go upstream.CheckHealth(m.statsUpstream.Upstream.Exchange, m.h, f.args.HealthCheck.opts(), m.stopHealthCheck)
+}
+
+// healthyFirst moves unhealthy upstreams to the end of us if health
+// checks are enabled. Without health checks it does nothing, because
+// nothing would probe an unhealthy upstream, and it would stay at the end
+// even after it recovers.
+func (f *fastForward) healthyFirst(us []bundled_upstream.Upstream) []bundled_upstream.Upstream {
+	if f.args.HealthCheck == nil {
+		return us
+	}
+	healthy := make([]bundled_upstream.Upstream, 0, len(us))
+	var unhealthy []bundled_upstream.Upstream
+	for _, u := range us {
+		if u.(*member).h.Healthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// onlyHealthy returns healthy upstreams of us if health checks are
+// enabled. If all upstreams are unhealthy, it returns us.
+func (f *fastForward) onlyHealthy(us []bundled_upstream.Upstream) []bundled_upstream.Upstream {
+	if f.args.HealthCheck == nil {
+		return us
+	}
+	healthy := make([]bundled_upstream.Upstream, 0, len(us))
+	for _, u := range us {
+		if u.(*member).h.Healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return us
+	}
+	return healthy
+}
+
+// statsUpstream records health stats of an upstream.
+type statsUpstream struct {
+	bundled_upstream.Upstream
+
+	queries    atomic.Uint64
+	errs       atomic.Uint64
+	h          *upstream.Health
+	queryTotal prometheus.Counter  // maybe nil
+	errTotal   prometheus.Counter  // maybe nil
+	latency    prometheus.Observer // maybe nil
+
+	m         sync.Mutex
+	lastErr   string
+	lastErrAt time.Time
+}
+
+func newStatsUpstream(u bundled_upstream.Upstream, failureThreshold int) *statsUpstream {
+	return &statsUpstream{Upstream: u, h: upstream.NewHealth(failureThreshold)}
+}
+
+func (u *statsUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	r, err := u.Upstream.Exchange(ctx, q)
+	// Exchanges canceled by a faster upstream are not counted.
+	if errors.Is(err, context.Canceled) {
+		return r, err
+	}
+	u.queries.Add(1)
+	if u.queryTotal != nil {
+		u.queryTotal.Inc()
+	}
+	d := time.Since(start)
+	u.h.Observe(d, err)
+	if err == nil && u.latency != nil {
+		u.latency.Observe(float64(d.Milliseconds()))
+	}
+	if err != nil {
+		u.errs.Add(1)
+		if u.errTotal != nil {
+			u.errTotal.Inc()
+		}
+		u.m.Lock()
+		u.lastErr = err.Error()
+		u.lastErrAt = time.Now()
+		u.m.Unlock()
+	}
+	return r, err
+}
+
+type upstreamHealth struct {
+	Address     string     `json:"address"`
+	Healthy     bool       `json:"healthy"`
+	Queries     uint64     `json:"queries"`
+	Errors      uint64     `json:"errors"`
+	Latency     int64      `json:"latency"` // ms
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (u *statsUpstream) health() upstreamHealth {
+	u.m.Lock()
+	defer u.m.Unlock()
+	h := upstreamHealth{
+		Address: u.Address(),
+		Healthy: u.h.Healthy(),
+		Queries: u.queries.Load(),
+		Errors:  u.errs.Load(),
+		Latency: u.h.Latency().Milliseconds(),
+	}
+	if !u.lastErrAt.IsZero() {
+		t := u.lastErrAt
+		h.LastError = u.lastErr
+		h.LastErrorAt = &t
+	}
+	return h
+}
+
+// ServeHTTP reports health stats of upstreams.
+func (f *fastForward) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	ms := f.members.Load().ms
+	hs := make([]upstreamHealth, 0, len(ms))
+	for _, m := range ms {
+		hs = append(hs, m.health())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hs); err != nil {
+		f.L().Warn("failed to write upstream health", zap.Error(err))
+	}
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Exchange sends q to the upstream once m.limiter allows it.
+func (m *member) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if m.limiter != nil {
+		if err := m.limiter.Acquire(ctx); err != nil {
+			return nil, fmt.Errorf("upstream %s is busy, %w", m.addr, err)
+		}
+		defer m.limiter.Release()
+	}
+	return m.statsUpstream.Exchange(ctx, q)
+}
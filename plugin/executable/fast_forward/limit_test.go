@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
+)
+
+// blockingUpstream blocks exchanges until unblock is closed.
+type blockingUpstream struct {
+	fakeUpstream
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (u *blockingUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	u.started <- struct{}{}
+	<-u.unblock
+	return new(dns.Msg), nil
+}
+
+func Test_member_limit(t *testing.T) {
+	u := &blockingUpstream{fakeUpstream: "a", started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	m := &member{
+		statsUpstream: newStatsUpstream(u, 0),
+		addr:          "a",
+		limiter:       concurrent_limiter.NewConcurrencyLimiter(1, 0),
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Exchange(context.Background(), q)
+		done <- err
+	}()
+	<-u.started
+	if _, err := m.Exchange(context.Background(), q); !errors.Is(err, concurrent_limiter.ErrQueueFull) {
+		t.Fatalf("want ErrQueueFull, got %v", err)
+	}
+	close(u.unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Exchange(context.Background(), q); err != nil {
+		t.Fatalf("limit is not released, %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstreamMetrics are metrics of queries of upstreams, labeled by the
+// upstream address. They are kept by the plugin, so counters don't go
+// backwards when discovered upstreams are removed.
+type upstreamMetrics struct {
+	queryTotal *prometheus.CounterVec
+	errTotal   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+}
+
+func newUpstreamMetrics(reg prometheus.Registerer) *upstreamMetrics {
+	um := &upstreamMetrics{
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_query_total",
+			Help: "The total number of queries sent to the upstream",
+		}, []string{"upstream"}),
+		errTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_err_total",
+			Help: "The total number of failed queries of the upstream",
+		}, []string{"upstream"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_response_latency_millisecond",
+			Help:    "The response latency of upstreams in millisecond",
+			Buckets: []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+		}, []string{"upstream"}),
+	}
+	reg.MustRegister(um.queryTotal, um.errTotal, um.latency)
+	return um
+}
+
+var (
+	upstreamHealthyDesc = prometheus.NewDesc("upstream_healthy", "Whether the upstream is healthy (1) or not (0)", []string{"upstream"}, nil)
+	upstreamRunningDesc = prometheus.NewDesc("upstream_running", "Queries running on the upstream", []string{"upstream"}, nil)
+	upstreamQueuedDesc  = prometheus.NewDesc("upstream_queued", "Queries waiting for the concurrency limit of the upstream", []string{"upstream"}, nil)
+	upstreamRejectDesc  = prometheus.NewDesc("upstream_rejected_total", "Queries rejected by the full queue of the upstream", []string{"upstream"}, nil)
+)
+
+// upstreamCollector collects the health and limiter stats of upstreams.
+// Discovered upstreams come and go, so they are collected from the
+// current members.
+type upstreamCollector struct {
+	f *fastForward
+}
+
+func (c *upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamHealthyDesc
+	ch <- upstreamRunningDesc
+	ch <- upstreamQueuedDesc
+	ch <- upstreamRejectDesc
+}
+
+func (c *upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	// Zones may have upstreams of the same address, their stats are
+	// summed. They are healthy only if all of them are healthy.
+	type stats struct {
+		healthy                   bool
+		limited                   bool
+		running, queued, rejected float64
+	}
+	var addrs []string
+	sum := make(map[string]*stats)
+	for _, m := range c.f.allMembers() {
+		addr := m.Address()
+		s := sum[addr]
+		if s == nil {
+			s = &stats{healthy: true}
+			sum[addr] = s
+			addrs = append(addrs, addr)
+		}
+		s.healthy = s.healthy && m.h.Healthy()
+		if l := m.limiter; l != nil {
+			s.limited = true
+			s.running += float64(l.Running())
+			s.queued += float64(l.Queued())
+			s.rejected += float64(l.Rejected())
+		}
+	}
+	for _, addr := range addrs {
+		s := sum[addr]
+		healthy := 0.0
+		if s.healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(upstreamHealthyDesc, prometheus.GaugeValue, healthy, addr)
+		if s.limited {
+			ch <- prometheus.MustNewConstMetric(upstreamRunningDesc, prometheus.GaugeValue, s.running, addr)
+			ch <- prometheus.MustNewConstMetric(upstreamQueuedDesc, prometheus.GaugeValue, s.queued, addr)
+			ch <- prometheus.MustNewConstMetric(upstreamRejectDesc, prometheus.CounterValue, s.rejected, addr)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+)
+
+func Test_upstreamMetrics_removedMembers(t *testing.T) {
+	var list atomic.Value
+	list.Store("udp://127.0.0.1:5301\nudp://127.0.0.1:5302")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(list.Load().(string)))
+	}))
+	defer s.Close()
+
+	reg := prometheus.NewRegistry()
+	f := &fastForward{BP: coremain.NewBP("test", PluginType, nil, nil), args: &Args{}, metrics: newUpstreamMetrics(reg)}
+	f.members.Store(newMemberSet(nil, ""))
+	cfg := &DiscoveryConfig{URL: s.URL}
+	cfg.init()
+	d := &discovery{cfg: cfg, hc: s.Client()}
+	f.discoveries = []*discovery{d}
+	if err := f.refreshMembers(d); err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	for _, m := range f.members.Load().ms {
+		m.statsUpstream.Upstream = fakeUpstream(m.addr)
+		if _, err := m.Exchange(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list.Store("udp://127.0.0.1:5302")
+	if err := f.refreshMembers(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// metrics returns "name/upstream" -> counter value or histogram count.
+	metrics := func() map[string]uint64 {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := make(map[string]uint64)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				k := mf.GetName() + "/" + m.GetLabel()[0].GetValue()
+				if h := m.GetHistogram(); h != nil {
+					v[k] = h.GetSampleCount()
+				} else {
+					v[k] = uint64(m.GetCounter().GetValue())
+				}
+			}
+		}
+		return v
+	}
+	got := metrics()
+	for _, k := range []string{
+		"upstream_query_total/udp://127.0.0.1:5301",
+		"upstream_query_total/udp://127.0.0.1:5302",
+		"upstream_response_latency_millisecond/udp://127.0.0.1:5302",
+	} {
+		if got[k] != 1 {
+			t.Errorf("%s: want 1, got %d", k, got[k])
+		}
+	}
+	if _, ok := got["upstream_response_latency_millisecond/udp://127.0.0.1:5301"]; ok {
+		t.Error("latency of the removed member is not dropped")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/netmon"
+	"github.com/pmkol/mosdns-x/pkg/upstream"
+)
+
+const (
+	prewarmTimeout     = time.Second * 5
+	networkChangeDelay = time.Second * 2
+)
+
+// startPrewarm connects to all upstreams now and after every network
+// change, so the first queries are not stuck behind TLS/QUIC handshakes.
+func (f *fastForward) startPrewarm() {
+	f.M().GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		go f.prewarm()
+		err := netmon.Watch(networkChangeDelay, func() {
+			f.L().Info("network changed, reconnecting upstreams")
+			// Connections established before the change are probably dead,
+			// unless they can migrate to the new network.
+			for _, m := range f.allMembers() {
+				if mg, ok := m.closer.(upstream.Migrator); ok && f.migrate(mg) == nil {
+					continue
+				}
+				if c, ok := m.closer.(upstream.IdleConnCloser); ok {
+					c.CloseIdleConnections()
+				}
+			}
+			f.prewarm()
+		}, closeSignal)
+		if err != nil {
+			f.L().Warn("failed to watch network changes", zap.Error(err))
+		}
+	})
+}
+
+// prewarm sends a query to all upstreams and waits for them.
+func (f *fastForward) prewarm() {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+
+	q := new(dns.Msg)
+	q.SetQuestion(".", dns.TypeNS)
+	wg := new(sync.WaitGroup)
+	for _, m := range f.allMembers() {
+		if m.closer == nil { // udpme has no connection to warm up
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Bypass statsUpstream, warm-up queries are not counted.
+			if _, err := m.statsUpstream.Upstream.Exchange(ctx, q.Copy()); err != nil {
+				f.L().Debug("failed to prewarm upstream", zap.String("addr", m.addr), zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (f *fastForward) migrate(m upstream.Migrator) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarmTimeout)
+	defer cancel()
+	err := m.Migrate(ctx)
+	if err != nil {
+		f.L().Debug("failed to migrate upstream connection", zap.Error(err))
+	}
+	return err
+}
+
+// allMembers returns members of f and its zones.
+func (f *fastForward) allMembers() []*member {
+	ms := append([]*member(nil), f.members.Load().ms...)
+	for _, z := range f.zoneList {
+		ms = append(ms, z.static...)
+	}
+	return ms
+}
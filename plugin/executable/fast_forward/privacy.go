@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const coverQueryTimeout = time.Second * 5
+
+// defaultCoverDomains are popular domains, so cover queries look like
+// normal traffic.
+var defaultCoverDomains = []string{
+	"google.com", "youtube.com", "facebook.com", "wikipedia.org", "amazon.com",
+	"apple.com", "microsoft.com", "cloudflare.com", "github.com", "netflix.com",
+}
+
+// PrivacyConfig blunts timing correlation and fingerprinting of clients
+// in the queries upstreams see.
+type PrivacyConfig struct {
+	// MaxJitter delays every query by a random duration in [0, MaxJitter) ms.
+	MaxJitter int `yaml:"max_jitter"`
+
+	// CoverInterval sends a dummy query to a random encrypted upstream
+	// about every CoverInterval seconds. Actual intervals are randomized
+	// by +-50%. Zero disables cover traffic.
+	CoverInterval int `yaml:"cover_interval"`
+	// CoverDomains are names of dummy queries. Default is a list of
+	// popular domains.
+	CoverDomains []string `yaml:"cover_domains"`
+
+	// UniformQueries rebuilds queries before they are sent to upstreams,
+	// so they look the same regardless of the client software. See
+	// uniformQuery.
+	UniformQueries bool `yaml:"uniform_queries"`
+}
+
+func (c *PrivacyConfig) init() error {
+	if c.MaxJitter < 0 || c.CoverInterval < 0 {
+		return errors.New("negative max_jitter or cover_interval")
+	}
+	if len(c.CoverDomains) == 0 {
+		c.CoverDomains = defaultCoverDomains
+	}
+	for _, d := range c.CoverDomains {
+		if _, ok := dns.IsDomainName(d); !ok {
+			return errors.New("invalid cover domain " + d)
+		}
+	}
+	return nil
+}
+
+// jitter sleeps a random duration.
+func (f *fastForward) jitter(ctx context.Context) error {
+	c := f.args.Privacy
+	if c == nil || c.MaxJitter == 0 {
+		return nil
+	}
+	t := time.NewTimer(rand.N(time.Duration(c.MaxJitter) * time.Millisecond))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (f *fastForward) startCoverTraffic(c *PrivacyConfig) {
+	interval := time.Duration(c.CoverInterval) * time.Second
+	f.M().GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		t := time.NewTimer(randInterval(interval))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				f.sendCoverQuery(c)
+				t.Reset(randInterval(interval))
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+// randInterval returns a random duration in [d/2, d*3/2).
+func randInterval(d time.Duration) time.Duration {
+	return d/2 + rand.N(d)
+}
+
+func (f *fastForward) sendCoverQuery(c *PrivacyConfig) {
+	// Plain dns upstreams see the real names of queries, covering them
+	// hides nothing and leaks the cover domains.
+	us := withTransport(f.members.Load().us, transportEncrypted)
+	if len(us) == 0 {
+		return
+	}
+	m := us[rand.IntN(len(us))].(*member)
+	qType := dns.TypeA
+	if rand.IntN(2) == 0 {
+		qType = dns.TypeAAAA
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(c.CoverDomains[rand.IntN(len(c.CoverDomains))]), qType)
+
+	ctx, cancel := context.WithTimeout(context.Background(), coverQueryTimeout)
+	defer cancel()
+	// Bypass statsUpstream, cover queries are not counted.
+	if _, err := m.statsUpstream.Upstream.Exchange(ctx, q); err != nil {
+		f.L().Debug("failed to send cover query", zap.String("addr", m.addr), zap.Error(err))
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_randInterval(t *testing.T) {
+	d := time.Second * 10
+	for i := 0; i < 1000; i++ {
+		if got := randInterval(d); got < d/2 || got >= d*3/2 {
+			t.Fatalf("randInterval() = %s, out of range", got)
+		}
+	}
+}
+
+func Test_fastForward_jitter(t *testing.T) {
+	f := &fastForward{args: &Args{Privacy: &PrivacyConfig{MaxJitter: 3600000}}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := f.jitter(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+
+	f.args.Privacy = &PrivacyConfig{}
+	if err := f.jitter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_uniformQuery(t *testing.T) {
+	q1 := new(dns.Msg)
+	q1.SetQuestion("example.com.", dns.TypeA)
+	q1.SetEdns0(4096, true)
+	opt := q1.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 33)},
+	)
+	q2 := new(dns.Msg)
+	q2.SetQuestion("example.com.", dns.TypeA)
+	q2.SetEdns0(1232, true)
+
+	u1, u2 := uniformQuery(q1), uniformQuery(q2)
+	u1.Id, u2.Id = 0, 0
+	b1, err := u1.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := u2.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Fatalf("queries are not uniform:\n%s\n%s", u1, u2)
+	}
+	if len(b1) != uniformBlockLen {
+		t.Fatalf("query is not padded, len %d", len(b1))
+	}
+
+	// Long queries are padded to the next block.
+	q3 := new(dns.Msg)
+	q3.SetQuestion(strings.Repeat("a", 63)+"."+strings.Repeat("b", 63)+".example.com.", dns.TypeA)
+	b3, err := uniformQuery(q3).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b3) != 2*uniformBlockLen {
+		t.Fatalf("long query is not padded to a block, len %d", len(b3))
+	}
+	if !u1.IsEdns0().Do() {
+		t.Fatal("do bit is lost")
+	}
+}
+
+// countingUpstream counts its exchanges.
+type countingUpstream struct {
+	fakeUpstream
+	n atomic.Int32
+}
+
+func (u *countingUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	u.n.Add(1)
+	return new(dns.Msg), nil
+}
+
+func Test_fastForward_sendCoverQuery(t *testing.T) {
+	udp := &countingUpstream{fakeUpstream: "udp"}
+	tls := &countingUpstream{fakeUpstream: "tls"}
+	f := new(fastForward)
+	f.members.Store(newMemberSet([]*member{
+		{statsUpstream: newStatsUpstream(udp, 0), addr: "udp", transport: transportUDP},
+		{statsUpstream: newStatsUpstream(tls, 0), addr: "tls", transport: transportEncrypted},
+	}, ""))
+	c := &PrivacyConfig{CoverInterval: 1}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		f.sendCoverQuery(c)
+	}
+	if udp.n.Load() != 0 || tls.n.Load() != 10 {
+		t.Fatalf("cover queries: udp %d, tls %d", udp.n.Load(), tls.n.Load())
+	}
+
+	// No encrypted upstream, no cover query.
+	f.members.Store(newMemberSet([]*member{{statsUpstream: newStatsUpstream(udp, 0), addr: "udp"}}, ""))
+	f.sendCoverQuery(c)
+	if udp.n.Load() != 0 {
+		t.Fatal("cover query is sent to a plain upstream")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+)
+
+// Actions of RcodePolicyConfig.
+const (
+	// rcodeActionRetry treats the response as an error, so the query is
+	// sent to the next upstream, even if the upstream is trusted.
+	rcodeActionRetry = "retry"
+	// rcodeActionPropagate returns the response as is. Responses from
+	// trusted upstreams are accepted, others are used only if no upstream
+	// gives a NOERROR response.
+	rcodeActionPropagate = "propagate"
+)
+
+const rcodeCacheSize = 1024
+
+// RcodePolicyConfig handles responses with rcodes other than NOERROR and
+// NXDOMAIN, e.g. REFUSED and FORMERR from broken or rate limiting upstreams.
+type RcodePolicyConfig struct {
+	// Rcodes that the policy applies to, e.g. ["REFUSED", "FORMERR"].
+	// Default is all rcodes except NOERROR and NXDOMAIN.
+	Rcodes []string `yaml:"rcodes"`
+	// Action can be "retry" (default) or "propagate".
+	Action string `yaml:"action"`
+	// CacheTTL caches these responses for CacheTTL seconds per upstream
+	// and question, so the same query is not sent to an upstream which
+	// just refused it. Zero disables the cache.
+	CacheTTL int `yaml:"cache_ttl"`
+}
+
+type rcodePolicy struct {
+	rcodes   map[int]struct{} // nil means all except NOERROR and NXDOMAIN
+	retry    bool
+	cacheTTL time.Duration
+}
+
+func newRcodePolicy(c *RcodePolicyConfig) (*rcodePolicy, error) {
+	p := &rcodePolicy{cacheTTL: time.Duration(c.CacheTTL) * time.Second}
+	switch c.Action {
+	case "", rcodeActionRetry:
+		p.retry = true
+	case rcodeActionPropagate:
+	default:
+		return nil, fmt.Errorf("unknown action %s", c.Action)
+	}
+	if c.CacheTTL < 0 {
+		return nil, fmt.Errorf("negative cache_ttl")
+	}
+	if len(c.Rcodes) > 0 {
+		p.rcodes = make(map[int]struct{})
+		for _, s := range c.Rcodes {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+			if !ok {
+				return nil, fmt.Errorf("invalid rcode %s", s)
+			}
+			p.rcodes[rcode] = struct{}{}
+		}
+	}
+	return p, nil
+}
+
+func (p *rcodePolicy) match(rcode int) bool {
+	if p.rcodes == nil {
+		return rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError
+	}
+	_, ok := p.rcodes[rcode]
+	return ok
+}
+
+// rcodeError is returned by upstreams if the response is dropped by
+// rcodePolicy.
+type rcodeError struct {
+	rcode  int
+	cached bool
+}
+
+func (e *rcodeError) Error() string {
+	if e.cached {
+		return "upstream replied " + dns.RcodeToString[e.rcode] + " recently"
+	}
+	return "upstream replied " + dns.RcodeToString[e.rcode]
+}
+
+// rcodeFilter applies rcodePolicy to responses of an upstream.
+type rcodeFilter struct {
+	p     *rcodePolicy
+	cache *concurrent_lru.ShardedLRU[*rcodeCacheEntry] // nil if p.cacheTTL is 0
+}
+
+type rcodeCacheEntry struct {
+	r      *dns.Msg
+	expire time.Time
+}
+
+func newRcodeFilter(p *rcodePolicy) *rcodeFilter {
+	f := &rcodeFilter{p: p}
+	if p.cacheTTL > 0 {
+		f.cache = concurrent_lru.NewShardedLRU[*rcodeCacheEntry](16, rcodeCacheSize/16, nil)
+	}
+	return f
+}
+
+// exchange calls next, or returns the cached response if next recently
+// replied q with a matched rcode.
+func (f *rcodeFilter) exchange(ctx context.Context, q *dns.Msg, next func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	var key string
+	if f.cache != nil && len(q.Question) == 1 {
+		question := q.Question[0]
+		key = fmt.Sprintf("%s %d %d", strings.ToLower(question.Name), question.Qtype, question.Qclass)
+		if e, ok := f.cache.Get(key); ok {
+			if time.Now().Before(e.expire) {
+				if f.p.retry {
+					return nil, &rcodeError{rcode: e.r.Rcode, cached: true}
+				}
+				r := e.r.Copy()
+				r.Id = q.Id
+				return r, nil
+			}
+			f.cache.Del(key)
+		}
+	}
+
+	r, err := next(ctx, q)
+	if err != nil || !f.p.match(r.Rcode) {
+		return r, err
+	}
+	if len(key) > 0 {
+		f.cache.Add(key, &rcodeCacheEntry{r: r.Copy(), expire: time.Now().Add(f.p.cacheTTL)})
+	}
+	if f.p.retry {
+		return nil, &rcodeError{rcode: r.Rcode}
+	}
+	return r, nil
+}
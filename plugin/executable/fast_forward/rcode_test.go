@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_rcodeFilter(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	calls := 0
+	next := func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		calls++
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeRefused)
+		return r, nil
+	}
+
+	tests := []struct {
+		name      string
+		c         *RcodePolicyConfig
+		wantErr   bool
+		wantCalls int // after two exchanges
+	}{
+		{"retry", &RcodePolicyConfig{}, true, 2},
+		{"retry cached", &RcodePolicyConfig{CacheTTL: 60}, true, 1},
+		{"propagate cached", &RcodePolicyConfig{Action: "propagate", CacheTTL: 60}, false, 1},
+		{"unmatched rcode", &RcodePolicyConfig{Rcodes: []string{"formerr"}, CacheTTL: 60}, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newRcodePolicy(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := newRcodeFilter(p)
+			calls = 0
+			for i := 0; i < 2; i++ {
+				r, err := f.exchange(context.Background(), q, next)
+				var rErr *rcodeError
+				if tt.wantErr {
+					if !errors.As(err, &rErr) || rErr.rcode != dns.RcodeRefused {
+						t.Fatalf("exchange() error = %v, want rcodeError", err)
+					}
+					continue
+				}
+				if err != nil || r.Rcode != dns.RcodeRefused || r.Id != q.Id {
+					t.Fatalf("exchange() = %v, %v", r, err)
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("upstream called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	if _, err := newRcodePolicy(&RcodePolicyConfig{Rcodes: []string{"BOGUS"}}); err == nil {
+		t.Fatal("want error for invalid rcode")
+	}
+	if _, err := newRcodePolicy(&RcodePolicyConfig{Action: "drop"}); err == nil {
+		t.Fatal("want error for unknown action")
+	}
+}
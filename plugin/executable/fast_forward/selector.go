@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+// Upstream selection policies.
+const (
+	// policyParallel sends queries to all upstreams at the same time.
+	policyParallel = "parallel"
+	// policyWeighted picks upstreams by smooth weighted round-robin.
+	policyWeighted = "weighted"
+	// policyConsistentHash picks upstreams by the hash of the qname. So
+	// a name always goes to the same upstream, which improves cache hit
+	// rates of upstream resolver farms.
+	policyConsistentHash = "consistent_hash"
+	// policyLowestLatency picks the upstream with the lowest average
+	// latency.
+	policyLowestLatency = "lowest_latency"
+)
+
+// virtualNodes is the number of points that each unit of weight has
+// on the hash ring.
+const virtualNodes = 64
+
+func checkPolicy(p string) error {
+	switch p {
+	case "", policyParallel, policyWeighted, policyConsistentHash, policyLowestLatency:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %s", p)
+	}
+}
+
+// weightedRR is a smooth weighted round-robin (the one in nginx).
+type weightedRR struct {
+	ms []*member
+
+	m       sync.Mutex
+	current []int
+	total   int
+}
+
+func newWeightedRR(ms []*member) *weightedRR {
+	w := &weightedRR{ms: ms, current: make([]int, len(ms))}
+	for _, m := range ms {
+		w.total += m.weight
+	}
+	return w
+}
+
+// next returns the index of the next member.
+func (w *weightedRR) next() int {
+	w.m.Lock()
+	defer w.m.Unlock()
+	best := 0
+	for i, m := range w.ms {
+		w.current[i] += m.weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return best
+}
+
+// order returns all upstreams, starting from the next picked one.
+// The rest are fallbacks.
+func (w *weightedRR) order() []bundled_upstream.Upstream {
+	if len(w.ms) == 0 {
+		return nil
+	}
+	i := w.next()
+	us := make([]bundled_upstream.Upstream, 0, len(w.ms))
+	for j := range w.ms {
+		us = append(us, w.ms[(i+j)%len(w.ms)])
+	}
+	return us
+}
+
+// byLatency returns upstreams sorted by their average latency. Upstreams
+// that haven't answered any query go first, so they get measured.
+// Upstreams that failed their last queries go last, ordered by the
+// number of consecutive failures, so dead upstreams, which have no
+// latency, are not preferred.
+func byLatency(ms []*member) []bundled_upstream.Upstream {
+	type entry struct {
+		m       *member
+		fails   int
+		latency time.Duration
+	}
+	es := make([]entry, 0, len(ms))
+	for _, m := range ms {
+		es = append(es, entry{m: m, fails: m.h.Failures(), latency: m.h.Latency()})
+	}
+	slices.SortStableFunc(es, func(a, b entry) int {
+		return cmp.Or(cmp.Compare(a.fails, b.fails), cmp.Compare(a.latency, b.latency))
+	})
+	us := make([]bundled_upstream.Upstream, 0, len(es))
+	for _, e := range es {
+		us = append(us, e.m)
+	}
+	return us
+}
+
+type hashRing struct {
+	ms     []*member
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint64
+	idx  int
+}
+
+func newHashRing(ms []*member) *hashRing {
+	r := &hashRing{ms: ms}
+	for i, m := range ms {
+		for j := 0; j < m.weight*virtualNodes; j++ {
+			r.points = append(r.points, ringPoint{hash: hashString(m.addr + "#" + strconv.Itoa(j)), idx: i})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		default:
+			return a.idx - b.idx
+		}
+	})
+	return r
+}
+
+// order returns distinct upstreams in the order they appear on the
+// ring clockwise from the hash of qName.
+func (r *hashRing) order(qName string) []bundled_upstream.Upstream {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashString(strings.ToLower(qName))
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	us := make([]bundled_upstream.Upstream, 0, len(r.ms))
+	seen := make([]bool, len(r.ms))
+	for i := 0; i < len(r.points) && len(us) < len(r.ms); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.idx] {
+			seen[p.idx] = true
+			us = append(us, r.ms[p.idx])
+		}
+	}
+	return us
+}
+
+// hashString is fnv-1a with a final mix, so similar strings spread
+// on the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
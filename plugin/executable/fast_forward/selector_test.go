@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+func testMembers(weights ...int) []*member {
+	ms := make([]*member, 0, len(weights))
+	for i, w := range weights {
+		ms = append(ms, &member{addr: fmt.Sprintf("udp://127.0.0.%d", i+1), weight: w})
+	}
+	return ms
+}
+
+func Test_weightedRR(t *testing.T) {
+	ms := testMembers(5, 1, 1)
+	w := newWeightedRR(ms)
+	count := make([]int, len(ms))
+	for i := 0; i < 70; i++ {
+		us := w.order()
+		if len(us) != len(ms) {
+			t.Fatalf("want %d upstreams, got %d", len(ms), len(us))
+		}
+		for j, m := range ms {
+			if us[0] == m {
+				count[j]++
+			}
+		}
+	}
+	if count[0] != 50 || count[1] != 10 || count[2] != 10 {
+		t.Fatalf("unexpected distribution %v", count)
+	}
+}
+
+func Test_hashRing(t *testing.T) {
+	ms := testMembers(1, 1, 1, 1)
+	r := newHashRing(ms)
+
+	first := make(map[*member]int)
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("name%d.example.", i)
+		us := r.order(name)
+		if len(us) != len(ms) {
+			t.Fatalf("want %d upstreams, got %d", len(ms), len(us))
+		}
+		if r.order(name)[0] != us[0] {
+			t.Fatal("hash ring is not stable")
+		}
+		first[us[0].(*member)]++
+	}
+	for _, m := range ms {
+		if c := first[m]; c < 150 || c > 350 {
+			t.Fatalf("unbalanced ring, %s got %d names", m.addr, c)
+		}
+	}
+
+	// Removing a member only moves the names it had.
+	r2 := newHashRing(ms[:3])
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("name%d.example.", i)
+		if u := r.order(name)[0]; u != ms[3] && r2.order(name)[0] != u {
+			t.Fatalf("%s moved after removing another member", name)
+		}
+	}
+}
+
+func Test_byLatency(t *testing.T) {
+	ms := testMembers(1, 1, 1, 1)
+	for i, d := range []time.Duration{time.Millisecond * 30, time.Millisecond * 10, 0, 0} {
+		ms[i].statsUpstream = newStatsUpstream(nil, 0)
+		if d > 0 {
+			ms[i].h.Observe(d, nil)
+		}
+	}
+	// ms[3] always fails and has no latency.
+	ms[3].h.Observe(time.Second, errors.New("failed"))
+	us := byLatency(ms)
+	if us[0] != ms[2] || us[1] != ms[1] || us[2] != ms[0] || us[3] != ms[3] {
+		t.Fatalf("unexpected order %v", us)
+	}
+}
+
+func Test_healthyFirst(t *testing.T) {
+	ms := testMembers(1, 1, 1)
+	us := make([]bundled_upstream.Upstream, 0, len(ms))
+	for _, m := range ms {
+		m.statsUpstream = newStatsUpstream(nil, 1)
+		us = append(us, m)
+	}
+	f := &fastForward{args: &Args{}}
+	ms[0].h.Observe(0, errors.New("failed"))
+
+	// Health checks are disabled.
+	if got := f.healthyFirst(us); got[0] != ms[0] {
+		t.Fatal("order should not be changed")
+	}
+	if got := f.onlyHealthy(us); len(got) != 3 {
+		t.Fatal("upstreams should not be filtered")
+	}
+
+	f.args.HealthCheck = &HealthCheckConfig{}
+	if got := f.healthyFirst(us); got[0] != ms[1] || got[1] != ms[2] || got[2] != ms[0] {
+		t.Fatalf("unexpected order %v", got)
+	}
+	if got := f.onlyHealthy(us); len(got) != 2 || got[0] != ms[1] {
+		t.Fatalf("unexpected healthy upstreams %v", got)
+	}
+	ms[1].h.Observe(0, errors.New("failed"))
+	ms[2].h.Observe(0, errors.New("failed"))
+	if got := f.onlyHealthy(us); len(got) != 3 {
+		t.Fatal("all upstreams should be used if none is healthy")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
+)
+
+// maxSVCBAliasDepth limits how many AliasMode records are followed.
+const maxSVCBAliasDepth = 4
+
+// lookupSVCB looks up SVCB records of name, and returns upstream
+// addresses of the ServiceMode records, ordered by priority.
+func lookupSVCB(ctx context.Context, ex bootstrap.Exchanger, name string) ([]string, error) {
+	for range maxSVCBAliasDepth {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeSVCB)
+		q.SetEdns0(dns.DefaultMsgSize, false)
+		r, err := ex.Exchange(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("svcb lookup of %s failed, %s", name, dns.RcodeToString[r.Rcode])
+		}
+		var rrs []*dns.SVCB
+		for _, rr := range r.Answer {
+			if svcb, ok := rr.(*dns.SVCB); ok {
+				rrs = append(rrs, svcb)
+			}
+		}
+		if len(rrs) == 0 {
+			return nil, fmt.Errorf("%s has no svcb record", name)
+		}
+
+		// RFC 9460 2.4.2, AliasMode records must not be mixed with
+		// ServiceMode records. Follow the first one.
+		if rrs[0].Priority == 0 {
+			if rrs[0].Target == "." {
+				return nil, nil // service is not available
+			}
+			name = rrs[0].Target
+			continue
+		}
+		slices.SortStableFunc(rrs, func(a, b *dns.SVCB) int { return cmp.Compare(a.Priority, b.Priority) })
+		addrs := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			if addr, ok := svcbAddr(rr); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs, nil
+	}
+	return nil, errors.New("too many svcb alias records")
+}
+
+// svcbAddr returns the upstream address of a ServiceMode record with the
+// DNS server parameters of RFC 9461. The first supported protocol in
+// the alpn list is used.
+func svcbAddr(rr *dns.SVCB) (string, bool) {
+	if rr.Priority == 0 {
+		return "", false
+	}
+	host := rr.Target
+	if host == "." {
+		host = rr.Hdr.Name
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	var alpns []string
+	var port uint16
+	path := "/dns-query"
+	for _, kv := range rr.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBAlpn:
+			alpns = kv.Alpn
+		case *dns.SVCBPort:
+			port = kv.Port
+		case *dns.SVCBDoHPath:
+			// Only the path of the uri template, e.g. "/dns-query{?dns}".
+			path, _, _ = strings.Cut(kv.Template, "{")
+		}
+	}
+
+	for _, alpn := range alpns {
+		var scheme string
+		var defaultPort uint16
+		switch alpn {
+		case "dot":
+			scheme, defaultPort = "tls", 853
+		case "doq":
+			scheme, defaultPort = "quic", 853
+		case "h2", "http/1.1":
+			scheme, defaultPort = "https", 443
+		case "h3":
+			scheme, defaultPort = "h3", 443
+		default:
+			continue
+		}
+		if port == 0 {
+			port = defaultPort
+		}
+		addr := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(port)))
+		if scheme == "https" || scheme == "h3" {
+			addr += path
+		}
+		return addr, true
+	}
+	return "", false
+}
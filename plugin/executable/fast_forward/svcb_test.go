@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeSVCBExchanger map[string][]string // name -> records
+
+func (e fakeSVCBExchanger) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for _, s := range e[q.Question[0].Name] {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	return r, nil
+}
+
+func Test_lookupSVCB(t *testing.T) {
+	ex := fakeSVCBExchanger{
+		"_dns.example.com.": {
+			`_dns.example.com. 300 IN SVCB 0 _dns.fleet.example.com.`,
+		},
+		"_dns.fleet.example.com.": {
+			`_dns.fleet.example.com. 300 IN SVCB 2 doh.example.com. alpn=h2,h3 dohpath=/q{?dns}`,
+			`_dns.fleet.example.com. 300 IN SVCB 1 dot.example.com. alpn=dot port=8853`,
+			`_dns.fleet.example.com. 300 IN SVCB 3 . alpn=doq`,
+			`_dns.fleet.example.com. 300 IN SVCB 4 other.example.com. alpn=foo`,
+		},
+		"_dns.loop.example.com.": {
+			`_dns.loop.example.com. 300 IN SVCB 0 _dns.loop.example.com.`,
+		},
+	}
+
+	got, err := lookupSVCB(context.Background(), ex, "_dns.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"tls://dot.example.com:8853",
+		"https://doh.example.com:443/q",
+		"quic://_dns.fleet.example.com:853",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if _, err := lookupSVCB(context.Background(), ex, "_dns.loop.example.com."); err == nil {
+		t.Fatal("alias loop should fail")
+	}
+	if _, err := lookupSVCB(context.Background(), ex, "_dns.none.example.com."); err == nil {
+		t.Fatal("name without records should fail")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// TLSConfig overwrites the client tls parameters of an upstream,
+// e.g. to pin the CA of a private DoT server and present a client
+// certificate to it.
+type TLSConfig struct {
+	// ServerName overwrites the server name (SNI) and the name to verify,
+	// which is the host of the addr by default.
+	ServerName string `yaml:"server_name"`
+	// ALPN overwrites the default application protocols.
+	ALPN []string `yaml:"alpn"`
+	// MinVersion and MaxVersion are "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	// CA are CA bundle files to verify the server. They replace the ca
+	// of the plugin for this upstream.
+	CA []string `yaml:"ca"`
+	// Cert and Key are files of the client certificate for mutual tls.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// SessionCacheSize is the number of cached sessions for resumption.
+	// Default is 64. Negative disables session resumption.
+	SessionCacheSize int `yaml:"session_cache_size"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *TLSConfig) apply(opt *upstream.Opt) error {
+	if (len(c.Cert) == 0) != (len(c.Key) == 0) {
+		return errors.New("tls cert and key must be set together")
+	}
+	var err error
+	if opt.MinTLSVersion, err = parseTLSVersion(c.MinVersion); err != nil {
+		return err
+	}
+	if opt.MaxTLSVersion, err = parseTLSVersion(c.MaxVersion); err != nil {
+		return err
+	}
+	if opt.MinTLSVersion > 0 && opt.MaxTLSVersion > 0 && opt.MinTLSVersion > opt.MaxTLSVersion {
+		return errors.New("tls min_version is higher than max_version")
+	}
+	if len(c.CA) > 0 {
+		if opt.RootCAs, err = utils.LoadCertPool(c.CA); err != nil {
+			return fmt.Errorf("failed to load tls ca, %w", err)
+		}
+	}
+	opt.ServerName = c.ServerName
+	opt.ALPN = c.ALPN
+	opt.ClientCert = c.Cert
+	opt.ClientKey = c.Key
+	opt.TLSSessionCacheSize = c.SessionCacheSize
+	return nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid tls version %s", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+const (
+	transportUDP       = iota // plain dns that may be sent over udp
+	transportTCP              // plain dns over streams only
+	transportEncrypted        // dot, doh, doq, dnscrypt etc.
+)
+
+// ForceTransportConfig makes some domains resolved only by upstreams of a
+// transport, e.g. zones whose plain udp answers are poisoned. Queries fail
+// if no upstream of the transport is configured.
+type ForceTransportConfig struct {
+	// Domains are forced with their subdomains.
+	Domains []string `yaml:"domains"`
+	// Transport can be "tcp" (tcp and encrypted upstreams) or "encrypted".
+	Transport string `yaml:"transport"`
+}
+
+func parseTransport(s string) (int, error) {
+	switch s {
+	case "tcp":
+		return transportTCP, nil
+	case "encrypted":
+		return transportEncrypted, nil
+	default:
+		return 0, fmt.Errorf("invalid transport %q", s)
+	}
+}
+
+// addrTransport returns the transport of the upstream addr.
+func addrTransport(addr string) int {
+	scheme, _, ok := strings.Cut(addr, "://")
+	if !ok {
+		return transportUDP
+	}
+	switch scheme {
+	case "tcp", "unix", "http", "http+json":
+		return transportTCP
+	case "", "udp", "udpme":
+		return transportUDP
+	default:
+		return transportEncrypted
+	}
+}
+
+func (f *fastForward) initForceTransport(cs []*ForceTransportConfig) error {
+	for i, c := range cs {
+		t, err := parseTransport(c.Transport)
+		if err != nil {
+			return fmt.Errorf("force transport #%d, %w", i, err)
+		}
+		for _, d := range c.Domains {
+			if _, ok := dns.IsDomainName(d); !ok {
+				return fmt.Errorf("force transport #%d, invalid domain %s", i, d)
+			}
+			name := dns.CanonicalName(d)
+			if _, dup := f.forced[name]; dup {
+				return fmt.Errorf("force transport #%d, duplicated domain %s", i, name)
+			}
+			if f.forced == nil {
+				f.forced = make(map[string]int)
+			}
+			f.forced[name] = t
+		}
+	}
+	return nil
+}
+
+// forcedTransport returns the transport of the longest suffix of q's
+// name, or transportUDP if it is not forced.
+func (f *fastForward) forcedTransport(q *dns.Msg) int {
+	if len(f.forced) == 0 || len(q.Question) != 1 {
+		return transportUDP
+	}
+	name := dns.CanonicalName(q.Question[0].Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if t, ok := f.forced[name[off:]]; ok {
+			return t
+		}
+	}
+	return transportUDP
+}
+
+// hasTransport reports whether s has an upstream of transport t.
+func (s *memberSet) hasTransport(t int) bool {
+	for _, m := range s.ms {
+		if m.transport >= t {
+			return true
+		}
+	}
+	return false
+}
+
+// withTransport returns upstreams of transport t in us.
+func withTransport(us []bundled_upstream.Upstream, t int) []bundled_upstream.Upstream {
+	if t == transportUDP {
+		return us
+	}
+	res := make([]bundled_upstream.Upstream, 0, len(us))
+	for _, u := range us {
+		if u.(*member).transport >= t {
+			res = append(res, u)
+		}
+	}
+	return res
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_addrTransport(t *testing.T) {
+	tests := map[string]int{
+		"8.8.8.8":                  transportUDP,
+		"udp://8.8.8.8":            transportUDP,
+		"udpme://8.8.8.8":          transportUDP,
+		"tcp://8.8.8.8":            transportTCP,
+		"tls://8.8.8.8":            transportEncrypted,
+		"https://dns.google/query": transportEncrypted,
+		"quic://dns.adguard.com":   transportEncrypted,
+		"sdns://AQcAAAAAAAAA":      transportEncrypted,
+	}
+	for addr, want := range tests {
+		if got := addrTransport(addr); got != want {
+			t.Errorf("addrTransport(%s) = %d, want %d", addr, got, want)
+		}
+	}
+}
+
+func Test_forcedTransport(t *testing.T) {
+	f := new(fastForward)
+	err := f.initForceTransport([]*ForceTransportConfig{
+		{Domains: []string{"example.com"}, Transport: "tcp"},
+		{Domains: []string{"secure.example.com", "Example.ORG"}, Transport: "encrypted"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp := &member{addr: "udp", transport: transportUDP}
+	tcp := &member{addr: "tcp", transport: transportTCP}
+	tls := &member{addr: "tls", transport: transportEncrypted}
+	s := newMemberSet([]*member{udp, tcp, tls}, "")
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"a.example.net.", []string{"udp", "tcp", "tls"}},
+		{"example.com.", []string{"tcp", "tls"}},
+		{"a.example.com.", []string{"tcp", "tls"}},
+		{"a.secure.example.com.", []string{"tls"}},
+		{"example.org.", []string{"tls"}},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, dns.TypeA)
+		tr := f.forcedTransport(q)
+		var got []string
+		for _, u := range withTransport(s.us, tr) {
+			got = append(got, u.(*member).addr)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+
+	if newMemberSet([]*member{udp}, "").hasTransport(transportTCP) {
+		t.Fatal("udp upstream should not serve forced tcp domains")
+	}
+	if err := f.initForceTransport([]*ForceTransportConfig{{Domains: []string{"a.com"}, Transport: "udp"}}); err == nil {
+		t.Fatal("invalid transport should fail")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"math/rand/v2"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const (
+	uniformUDPSize  = 1232
+	uniformBlockLen = 128 // RFC 8467 block size
+)
+
+// uniformQuery returns a copy of q that doesn't reveal the client
+// software: a random id, fixed flags, and a fixed OPT that only keeps
+// the DO bit and the ECS option. Other options, e.g. cookies and padding
+// of the client, are removed. The query is padded to a multiple of 128
+// bytes, as RFC 8467 recommends.
+func uniformQuery(q *dns.Msg) *dns.Msg {
+	u := new(dns.Msg)
+	u.Id = uint16(rand.Uint32())
+	u.Opcode = dns.OpcodeQuery
+	u.RecursionDesired = true
+	u.AuthenticatedData = true // RFC 6840 5.7
+	u.CheckingDisabled = q.CheckingDisabled
+	u.Compress = true
+	u.Question = append([]dns.Question(nil), q.Question...)
+
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(uniformUDPSize)
+	if qOpt := q.IsEdns0(); qOpt != nil {
+		opt.SetDo(qOpt.Do())
+		if ecs := dnsutils.GetEDNS0Option(qOpt, dns.EDNS0SUBNET); ecs != nil {
+			opt.Option = append(opt.Option, ecs)
+		}
+	}
+	u.Extra = []dns.RR{opt}
+	dnsutils.PadToBlock(u, uniformBlockLen)
+	return u
+}
+
+// exchangeUniform sends a uniformQuery of q to next.
+func exchangeUniform(ctx context.Context, q *dns.Msg, next func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	r, err := next(ctx, uniformQuery(q))
+	if err != nil {
+		return nil, err
+	}
+	r.Id = q.Id
+	return r, nil
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// ZoneConfig forwards queries of some zones to their own upstreams,
+// e.g. "10.in-addr.arpa" and "corp.example.com" to the corporate DC.
+type ZoneConfig struct {
+	// Zones can be domains or CIDRs. A CIDR is converted to its reverse
+	// zones, e.g. "10.0.0.0/8" is "10.in-addr.arpa.", "172.16.0.0/12" is
+	// "16.172.in-addr.arpa." to "31.172.in-addr.arpa.".
+	Zones    []string          `yaml:"zones"`
+	Upstream []*UpstreamConfig `yaml:"upstream"`
+
+	// By default, the DO bit and ECS are removed and the CD bit is set
+	// on queries of these zones, because private zones are usually
+	// unsigned and ECS leaks client addresses to the zone's servers.
+	KeepDNSSEC bool `yaml:"keep_dnssec"`
+	KeepECS    bool `yaml:"keep_ecs"`
+}
+
+type zone struct {
+	static     []*member
+	members    *memberSet
+	keepDNSSEC bool
+	keepECS    bool
+}
+
+func (f *fastForward) initZones(cs []*ZoneConfig) error {
+	f.zones = make(map[string]*zone)
+	for i, c := range cs {
+		if len(c.Zones) == 0 || len(c.Upstream) == 0 {
+			return fmt.Errorf("zone #%d has no zones or upstream", i)
+		}
+		z := &zone{keepDNSSEC: c.KeepDNSSEC, keepECS: c.KeepECS}
+		f.zoneList = append(f.zoneList, z) // for Shutdown
+		for j, uc := range c.Upstream {
+			m, err := f.newMember(uc, uc.Addr, uc.Trusted || j == 0)
+			if err != nil {
+				return fmt.Errorf("zone #%d, %w", i, err)
+			}
+			z.static = append(z.static, m)
+		}
+		z.members = newMemberSet(z.static, f.args.Policy)
+
+		for _, s := range c.Zones {
+			names, err := parseZone(s)
+			if err != nil {
+				return fmt.Errorf("zone #%d, %w", i, err)
+			}
+			for _, name := range names {
+				if _, dup := f.zones[name]; dup {
+					return fmt.Errorf("zone #%d, duplicated zone %s", i, name)
+				}
+				f.zones[name] = z
+			}
+		}
+	}
+	return nil
+}
+
+// parseZone returns the zone names of s.
+func parseZone(s string) ([]string, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		if _, ok := dns.IsDomainName(s); !ok {
+			return nil, fmt.Errorf("invalid zone %s", s)
+		}
+		return []string{dns.CanonicalName(s)}, nil
+	}
+
+	step := 8
+	if p.Addr().Is6() {
+		step = 4
+	}
+	bits := (p.Bits() + step - 1) / step * step
+	var names []string
+	for _, sub := range splitPrefix(p.Masked(), bits) {
+		names = append(names, utils.PTRName(sub))
+	}
+	return names, nil
+}
+
+// splitPrefix splits p into prefixes of bits.
+func splitPrefix(p netip.Prefix, bits int) []netip.Prefix {
+	if p.Bits() >= bits {
+		return []netip.Prefix{p}
+	}
+	b := p.Addr().AsSlice()
+	lower := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+	b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	upperAddr, _ := netip.AddrFromSlice(b)
+	upper := netip.PrefixFrom(upperAddr, p.Bits()+1)
+	return append(splitPrefix(lower, bits), splitPrefix(upper, bits)...)
+}
+
+// matchZone returns the zone of the longest suffix of q's name.
+func (f *fastForward) matchZone(q *dns.Msg) *zone {
+	if len(f.zones) == 0 || len(q.Question) != 1 {
+		return nil
+	}
+	name := dns.CanonicalName(q.Question[0].Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z := f.zones[name[off:]]; z != nil {
+			return z
+		}
+	}
+	return nil
+}
+
+// prepare modifies q for the upstreams of z.
+func (z *zone) prepare(q *dns.Msg) {
+	if !z.keepECS {
+		dnsutils.RemoveMsgECS(q)
+	}
+	if !z.keepDNSSEC {
+		q.CheckingDisabled = true
+		if opt := q.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func Test_parseZone(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []string
+		wantErr bool
+	}{
+		{"Corp.Example.com", []string{"corp.example.com."}, false},
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}, false},
+		{"192.168.0.0/23", []string{"0.168.192.in-addr.arpa.", "1.168.192.in-addr.arpa."}, false},
+		{"fd00::/7", []string{"c.f.ip6.arpa.", "d.f.ip6.arpa."}, false},
+		{"..", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseZone(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseZone() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseZone() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, _ := parseZone("172.16.0.0/12"); len(got) != 16 || got[0] != "16.172.in-addr.arpa." || got[15] != "31.172.in-addr.arpa." {
+		t.Fatalf("unexpected zones of 172.16.0.0/12, %v", got)
+	}
+}
+
+func Test_fastForward_matchZone(t *testing.T) {
+	z1, z2 := new(zone), new(zone)
+	f := &fastForward{zones: map[string]*zone{
+		"10.in-addr.arpa.":  z1,
+		"example.com.":      z1,
+		"corp.example.com.": z2,
+	}}
+	tests := []struct {
+		name string
+		want *zone
+	}{
+		{"1.0.0.10.in-addr.arpa.", z1},
+		{"www.example.com.", z1},
+		{"example.com.", z1},
+		{"A.Corp.Example.com.", z2},
+		{"1.0.0.11.in-addr.arpa.", nil},
+		{"notexample.com.", nil},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, dns.TypePTR)
+		if got := f.matchZone(q); got != tt.want {
+			t.Errorf("matchZone(%s) got %p, want %p", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_zone_prepare(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	q.SetEdns0(1232, true)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, dnsutils.NewEDNS0Subnet(net.IPv4(1, 2, 3, 0), 24, false))
+
+	new(zone).prepare(q)
+	if opt.Do() || !q.CheckingDisabled || dnsutils.GetMsgECS(q) != nil {
+		t.Fatalf("dnssec and ecs should be disabled, %v", q)
+	}
+}
@@ -22,12 +22,19 @@ package hosts
 import (
 	"bytes"
 	"context"
-	"io"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/hosts"
 	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
@@ -41,12 +48,91 @@ var _ coremain.ExecutablePlugin = (*hostsPlugin)(nil)
 
 type Args struct {
 	Hosts []string `yaml:"hosts"`
+
+	// Sites enables location aware answers. For a name with multiple
+	// addresses, clients of a site only get the addresses of that site.
+	Sites []SiteConfig `yaml:"sites"`
+
+	// UseECS uses the address in the ECS option as the client address
+	// when selecting sites.
+	UseECS bool `yaml:"use_ecs"`
+
+	// Zone adds SOA/NS records of the zone to answers and answers SOA/NS
+	// queries of its apex, as an authoritative server does.
+	Zone *ZoneConfig `yaml:"zone"`
+
+	// RecordsFile saves records imported through the api, so they are
+	// kept across restarts. They take precedence over Hosts.
+	RecordsFile string `yaml:"records_file"`
 }
 
+type ZoneConfig struct {
+	// Name of the zone, e.g. "lan". Default is every host name.
+	Name  string   `yaml:"name"`
+	NS    []string `yaml:"ns"`    // Default is mname.
+	MName string   `yaml:"mname"` // Default is "ns.<zone>".
+	RName string   `yaml:"rname"` // Default is "hostmaster.<zone>".
+	// Serial is a number, "unixtime" or "date" (YYYYMMDD00). The latter
+	// two are taken when the plugin is loaded. Default is "unixtime".
+	Serial string `yaml:"serial"`
+	TTL    uint32 `yaml:"ttl"` // Default is 300.
+}
+
+func (c *ZoneConfig) zone(now time.Time) (*hosts.Zone, error) {
+	z := &hosts.Zone{MName: fqdnOrEmpty(c.MName), RName: fqdnOrEmpty(c.RName), TTL: c.TTL}
+	if len(c.Name) > 0 {
+		z.Name = dns.CanonicalName(c.Name)
+	}
+	for _, ns := range c.NS {
+		z.NS = append(z.NS, dns.Fqdn(ns))
+	}
+	if z.TTL == 0 {
+		z.TTL = defaultZoneTTL
+	}
+	switch c.Serial {
+	case "", "unixtime":
+		z.Serial = uint32(now.Unix())
+	case "date":
+		y, m, d := now.Date()
+		z.Serial = uint32(y*1000000 + int(m)*10000 + d*100)
+	default:
+		n, err := strconv.ParseUint(c.Serial, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid serial %s", c.Serial)
+		}
+		z.Serial = uint32(n)
+	}
+	return z, nil
+}
+
+func fqdnOrEmpty(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return dns.Fqdn(s)
+}
+
+type SiteConfig struct {
+	Name string `yaml:"name"`
+	// Clients of this site. IP, CIDR or "provider:" (geoip data is
+	// supported by "provider:geoip:cn").
+	Clients []string `yaml:"clients"`
+	// Addrs of services in this site. Same format as Clients.
+	Addrs []string `yaml:"addrs"`
+}
+
+const (
+	defaultZoneTTL       = 300
+	approxBytesPerRecord = 96 // same as rules of domain matchers
+)
+
 type hostsPlugin struct {
 	*coremain.BP
-	h             *hosts.Hosts
-	matcherCloser io.Closer
+	h       *hosts.Hosts
+	m       *domain.MatcherGroup[*hosts.IPs]
+	records *recordSet
+	useECS  bool
+	sites   []*netlist.MatcherGroup
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -54,34 +140,78 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 }
 
 func newHostsContainer(bp *coremain.BP, args *Args) (*hostsPlugin, error) {
-	staticMatcher := domain.NewMixMatcher[*hosts.IPs]()
-	staticMatcher.SetDefaultMatcher(domain.MatcherFull)
+	staticMatcher := hosts.NewPTRMatcher()
 	m, err := domain.BatchLoadProvider[*hosts.IPs](
 		args.Hosts,
 		staticMatcher,
 		hosts.ParseIPs,
 		bp.M().GetDataManager(),
 		func(b []byte) (domain.Matcher[*hosts.IPs], error) {
-			mixMatcher := domain.NewMixMatcher[*hosts.IPs]()
-			mixMatcher.SetDefaultMatcher(domain.MatcherFull)
-			if err := domain.LoadFromTextReader[*hosts.IPs](mixMatcher, bytes.NewReader(b), hosts.ParseIPs); err != nil {
+			ptrMatcher := hosts.NewPTRMatcher()
+			if err := domain.LoadFromTextReader[*hosts.IPs](ptrMatcher, bytes.NewReader(b), hosts.ParseIPs); err != nil {
 				return nil, err
 			}
-			return mixMatcher, nil
+			return ptrMatcher, nil
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
-	return &hostsPlugin{
-		BP:            bp,
-		h:             hosts.NewHosts(m),
-		matcherCloser: m,
-	}, nil
+	records, err := newRecordSet(args.RecordsFile)
+	if err != nil {
+		_ = m.Close()
+		return nil, fmt.Errorf("failed to load records, %w", err)
+	}
+	all := new(domain.MatcherGroup[*hosts.IPs])
+	all.Append(records.matcher)
+	all.Append(m)
+	h := &hostsPlugin{
+		BP:      bp,
+		h:       hosts.NewHosts(all),
+		m:       m,
+		records: records,
+		useECS:  args.UseECS,
+	}
+	if len(args.Sites) > 0 {
+		sites, err := h.loadSites(args.Sites)
+		if err != nil {
+			_ = h.Close()
+			return nil, err
+		}
+		h.h.SetLocality(hosts.NewLocality(sites))
+	}
+	if args.Zone != nil {
+		z, err := args.Zone.zone(time.Now())
+		if err != nil {
+			_ = h.Close()
+			return nil, fmt.Errorf("invalid zone, %w", err)
+		}
+		h.h.SetZone(z)
+	}
+	return h, nil
+}
+
+func (h *hostsPlugin) loadSites(cs []SiteConfig) ([]hosts.Site, error) {
+	dm := h.M().GetDataManager()
+	sites := make([]hosts.Site, 0, len(cs))
+	for i, c := range cs {
+		clients, err := netlist.BatchLoadProvider(c.Clients, dm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load clients of site #%d %s, %w", i, c.Name, err)
+		}
+		h.sites = append(h.sites, clients)
+		addrs, err := netlist.BatchLoadProvider(c.Addrs, dm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load addrs of site #%d %s, %w", i, c.Name, err)
+		}
+		h.sites = append(h.sites, addrs)
+		sites = append(sites, hosts.Site{Name: c.Name, Clients: clients, Addrs: addrs})
+	}
+	return sites, nil
 }
 
 func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	r := h.h.LookupMsg(qCtx.Q())
+	r := h.h.LookupMsgFrom(qCtx.Q(), h.clientAddr(qCtx))
 	if r != nil {
 		qCtx.SetResponse(r)
 		return nil
@@ -90,7 +220,31 @@ func (h *hostsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+func (h *hostsPlugin) clientAddr(qCtx *query_context.Context) netip.Addr {
+	if h.useECS {
+		if e := dnsutils.GetMsgECS(qCtx.Q()); e != nil {
+			if addr, ok := netip.AddrFromSlice(e.Address); ok {
+				return addr.Unmap()
+			}
+		}
+	}
+	return qCtx.ReqMeta().GetClientAddr()
+}
+
+// LookupPTR returns the host name of addr from full domain rules.
+func (h *hostsPlugin) LookupPTR(addr netip.Addr) (string, bool) {
+	return h.h.LookupPTR(addr)
+}
+
 func (h *hostsPlugin) Close() error {
-	_ = h.matcherCloser.Close()
+	_ = h.m.Close()
+	for _, s := range h.sites {
+		_ = s.Close()
+	}
 	return nil
 }
+
+// MemoryUsage implements coremain.MemoryReporter.
+func (h *hostsPlugin) MemoryUsage() int64 {
+	return h.m.MemoryUsage() + int64(h.records.matcher.Len())*approxBytesPerRecord
+}
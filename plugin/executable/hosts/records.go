@@ -0,0 +1,339 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/hosts"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	maxRecordsBody = 16 << 20
+	recordTTL      = 10 // same as answers of hosts
+)
+
+// record is a host name and its addresses.
+type record struct {
+	name  string // fqdn
+	addrs []netip.Addr
+}
+
+// recordSet is the host records managed by the api. They are matched
+// before the rules of the config.
+type recordSet struct {
+	file    string // maybe empty
+	matcher *domain.DynamicMatcher[*hosts.IPs]
+
+	m       sync.Mutex // serializes updates
+	records atomic.Pointer[[]record]
+}
+
+func newRecordSet(file string) (*recordSet, error) {
+	s := &recordSet{
+		file: file,
+		matcher: domain.NewDynamicMatcher[*hosts.IPs](func(b []byte) (domain.Matcher[*hosts.IPs], error) {
+			m := hosts.NewPTRMatcher()
+			if err := domain.LoadFromTextReader[*hosts.IPs](m, bytes.NewReader(b), hosts.ParseIPs); err != nil {
+				return nil, err
+			}
+			return m, nil
+		}),
+	}
+	var rs []record
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			rs, err = parseHostsFile(f, true)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("invalid records file %s, %w", file, err)
+			}
+		}
+	}
+	if err := s.matcher.Update(formatRules(rs)); err != nil {
+		return nil, err
+	}
+	s.records.Store(&rs)
+	return s, nil
+}
+
+// replace replaces all records with rs and saves them to the file.
+// If rs cannot be loaded or saved, old records are kept.
+func (s *recordSet) replace(rs []record) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.matcher.Update(formatRules(rs)); err != nil {
+		return err
+	}
+	if err := s.save(rs); err != nil {
+		// Old records were loaded, they can be loaded again.
+		_ = s.matcher.Update(formatRules(*s.records.Load()))
+		return err
+	}
+	s.records.Store(&rs)
+	return nil
+}
+
+func (s *recordSet) save(rs []record) error {
+	if len(s.file) == 0 {
+		return nil
+	}
+	return utils.WriteFileAtomic(s.file, func(w io.Writer) error {
+		b := bufio.NewWriter(w)
+		writeHostsFile(b, rs, true)
+		return b.Flush()
+	})
+}
+
+// allRecords returns the records of the api and full domain rules of
+// the config. A name is only taken from the first matcher that has it,
+// as queries do. Other rules, e.g. "domain:", are not records.
+func (h *hostsPlugin) allRecords() []record {
+	rb := new(recordBuilder)
+	seen := make(map[string]struct{})
+	h.h.RangeFull(func(fqdn string, v *hosts.IPs) bool {
+		if _, ok := seen[fqdn]; ok {
+			return true
+		}
+		seen[fqdn] = struct{}{}
+		if v != nil {
+			for _, addrs := range [...][]netip.Addr{v.IPv4, v.IPv6} {
+				for _, addr := range addrs {
+					rb.add(fqdn, addr)
+				}
+			}
+		}
+		return true
+	})
+	return rb.records()
+}
+
+// formatRules formats rs as rules of hosts.ParseIPs.
+func formatRules(rs []record) []byte {
+	b := new(bytes.Buffer)
+	for _, r := range rs {
+		b.WriteString(r.name)
+		for _, addr := range r.addrs {
+			b.WriteByte(' ')
+			b.WriteString(addr.String())
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// recordBuilder merges addresses of the same name, in order.
+type recordBuilder struct {
+	idx map[string]int
+	rs  []record
+}
+
+func (rb *recordBuilder) add(name string, addr netip.Addr) {
+	if rb.idx == nil {
+		rb.idx = make(map[string]int)
+	}
+	name = dns.CanonicalName(name)
+	i, ok := rb.idx[name]
+	if !ok {
+		i = len(rb.rs)
+		rb.idx[name] = i
+		rb.rs = append(rb.rs, record{name: name})
+	}
+	if !slices.Contains(rb.rs[i].addrs, addr) {
+		rb.rs[i].addrs = append(rb.rs[i].addrs, addr)
+	}
+}
+
+func (rb *recordBuilder) records() []record {
+	slices.SortStableFunc(rb.rs, func(a, b record) int { return strings.Compare(a.name, b.name) })
+	return rb.rs
+}
+
+// parseHostsFile parses lines of "addr name [name...]", as /etc/hosts.
+// If grouped, lines are "name addr [addr...]" instead, which is the
+// format of records files.
+func parseHostsFile(r io.Reader, grouped bool) ([]record, error) {
+	rb := new(recordBuilder)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s, _, _ := strings.Cut(sc.Text(), "#")
+		fs := strings.Fields(s)
+		if len(fs) == 0 {
+			continue
+		}
+		if len(fs) < 2 {
+			return nil, fmt.Errorf("line %d: missing fields", line)
+		}
+		addrs, names := fs[:1], fs[1:]
+		if grouped {
+			names, addrs = fs[:1], fs[1:]
+		}
+		for _, name := range names {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return nil, fmt.Errorf("line %d: invalid name %s", line, name)
+			}
+			for _, a := range addrs {
+				addr, err := netip.ParseAddr(a)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				rb.add(name, addr.Unmap())
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rb.records(), nil
+}
+
+// parseZoneFile parses A and AAAA records of a zone file. SOA and NS
+// records are ignored, others are errors.
+func parseZoneFile(r io.Reader) ([]record, error) {
+	rb := new(recordBuilder)
+	zp := dns.NewZoneParser(r, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ := netip.AddrFromSlice(rr.A)
+			rb.add(rr.Hdr.Name, addr.Unmap())
+		case *dns.AAAA:
+			addr, _ := netip.AddrFromSlice(rr.AAAA)
+			rb.add(rr.Hdr.Name, addr)
+		case *dns.SOA, *dns.NS:
+		default:
+			return nil, fmt.Errorf("unsupported record %s", rr.String())
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rb.records(), nil
+}
+
+func writeHostsFile(w io.Writer, rs []record, grouped bool) {
+	for _, r := range rs {
+		if grouped {
+			fmt.Fprintf(w, "%s", r.name)
+			for _, addr := range r.addrs {
+				fmt.Fprintf(w, " %s", addr)
+			}
+			fmt.Fprintln(w)
+			continue
+		}
+		for _, addr := range r.addrs {
+			fmt.Fprintf(w, "%s %s\n", addr, strings.TrimSuffix(r.name, "."))
+		}
+	}
+}
+
+func writeZoneFile(w io.Writer, rs []record) {
+	for _, r := range rs {
+		for _, addr := range r.addrs {
+			hdr := dns.RR_Header{Name: r.name, Class: dns.ClassINET, Ttl: recordTTL}
+			var rr dns.RR
+			if addr.Is4() {
+				hdr.Rrtype = dns.TypeA
+				rr = &dns.A{Hdr: hdr, A: addr.AsSlice()}
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rr = &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+			}
+			fmt.Fprintln(w, rr.String())
+		}
+	}
+}
+
+// ServeHTTP manages records of the api at "/plugins/{tag}/records".
+//
+//	GET exports records, including hosts of the config. Query parameter
+//	    "format" is "hosts" (default, /etc/hosts format) or "zone" (zone
+//	    file).
+//	PUT replaces all records of the api with the body, in the same
+//	    formats. Hosts of the config are not changed. Nothing is changed
+//	    if the body is invalid.
+func (h *hostsPlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasSuffix(req.URL.Path, "/records") {
+		http.NotFound(w, req)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "", "hosts", "zone":
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		rs := h.allRecords()
+		b := new(bytes.Buffer)
+		if format == "zone" {
+			writeZoneFile(b, rs)
+		} else {
+			writeHostsFile(b, rs, false)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(b.Bytes())
+	case http.MethodPut:
+		body := http.MaxBytesReader(w, req.Body, maxRecordsBody)
+		var rs []record
+		var err error
+		if format == "zone" {
+			rs, err = parseZoneFile(body)
+		} else {
+			rs, err = parseHostsFile(body, false)
+		}
+		if err != nil {
+			http.Error(w, "invalid records, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.records.replace(rs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.L().Info("records replaced", zap.Int("names", len(rs)))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
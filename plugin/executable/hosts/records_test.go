@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestHosts(t *testing.T, args *Args) *hostsPlugin {
+	t.Helper()
+	h, err := newHostsContainer(coremain.NewBP("hosts", PluginType, nil, new(coremain.Mosdns)), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func doRecords(h *hostsPlugin, method, query, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/plugins/hosts/records"+query, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func lookupA(t *testing.T, h *hostsPlugin, name string) []string {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	if err := h.Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	if r := qCtx.R(); r != nil {
+		for _, rr := range r.Answer {
+			addrs = append(addrs, rr.(*dns.A).A.String())
+		}
+	}
+	slices.Sort(addrs) // answers are shuffled
+	return addrs
+}
+
+func Test_hostsPlugin_records(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "records")
+	h := newTestHosts(t, &Args{Hosts: []string{"a.test 9.9.9.9", "b.test 9.9.9.9"}, RecordsFile: file})
+
+	if w := doRecords(h, http.MethodPut, "", "1.1.1.1 a.test c.test # comment\n\n1.1.1.2 a.test\n"); w.Code != http.StatusNoContent {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	if got := lookupA(t, h, "a.test."); strings.Join(got, ",") != "1.1.1.1,1.1.1.2" {
+		t.Fatalf("a.test: %v", got)
+	}
+	if got := lookupA(t, h, "b.test."); strings.Join(got, ",") != "9.9.9.9" {
+		t.Fatalf("b.test: %v", got)
+	}
+
+	w := doRecords(h, http.MethodGet, "", "")
+	if want := "1.1.1.1 a.test\n1.1.1.2 a.test\n9.9.9.9 b.test\n1.1.1.1 c.test\n"; w.Body.String() != want {
+		t.Fatalf("export: %q", w.Body)
+	}
+	w = doRecords(h, http.MethodGet, "?format=zone", "")
+	if !strings.Contains(w.Body.String(), "c.test.\t10\tIN\tA\t1.1.1.1") {
+		t.Fatalf("zone export: %q", w.Body)
+	}
+
+	// Invalid bodies change nothing.
+	for _, body := range []string{"1.1.1.1", "x a.test", "1.1.1.1 a..test"} {
+		if w := doRecords(h, http.MethodPut, "", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("put %q: %d", body, w.Code)
+		}
+	}
+	if w := doRecords(h, http.MethodPut, "?format=zone", "c.test. 60 IN TXT \"x\""); w.Code != http.StatusBadRequest {
+		t.Fatalf("put txt: %d", w.Code)
+	}
+	if got := lookupA(t, h, "c.test."); len(got) != 1 {
+		t.Fatalf("c.test: %v", got)
+	}
+
+	// Records are loaded from the file.
+	h2 := newTestHosts(t, &Args{RecordsFile: file})
+	if got := lookupA(t, h2, "c.test."); len(got) != 1 {
+		t.Fatalf("c.test after reload: %v", got)
+	}
+
+	zone := "$ORIGIN test.\n@ 60 IN SOA ns hostmaster 1 2 3 4 5\nd 60 IN A 2.2.2.2\n"
+	if w := doRecords(h, http.MethodPut, "?format=zone", zone); w.Code != http.StatusNoContent {
+		t.Fatalf("put zone: %d %s", w.Code, w.Body)
+	}
+	if got := lookupA(t, h, "c.test."); len(got) != 0 {
+		t.Fatalf("c.test after replace: %v", got)
+	}
+	if got := lookupA(t, h, "d.test."); len(got) != 1 {
+		t.Fatalf("d.test: %v", got)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil || string(b) != "d.test. 2.2.2.2\n" {
+		t.Fatalf("records file: %q %v", b, err)
+	}
+}
+
+func Test_hostsPlugin_recordsSaveFailure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "records")
+	h := newTestHosts(t, &Args{Hosts: []string{"domain:test 9.9.9.9"}, RecordsFile: file})
+	if w := doRecords(h, http.MethodPut, "", "1.1.1.1 a.test\n"); w.Code != http.StatusNoContent {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+
+	h.records.file = filepath.Join(file, "not_a_dir", "records")
+	if w := doRecords(h, http.MethodPut, "", "2.2.2.2 a.test\n"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	if got := lookupA(t, h, "a.test."); strings.Join(got, ",") != "1.1.1.1" {
+		t.Fatalf("a.test after failed put: %v", got)
+	}
+	// "domain:" rules are not exported.
+	if w := doRecords(h, http.MethodGet, "", ""); w.Body.String() != "1.1.1.1 a.test\n" {
+		t.Fatalf("export: %q", w.Body)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "ip_router"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*ipRouter)(nil)
+
+// Args of ip_router. It resolves the query with Exec first, then checks
+// the IPs in the answer. If they match IP (or don't match, if Invert),
+// the response is dropped and the query is resolved again with Reroute,
+// e.g. re-query via an overseas upstream if a local upstream returns
+// a foreign address.
+type Args struct {
+	// Exec resolves the query first. Same as sequence exec. Required.
+	Exec interface{} `yaml:"exec"`
+	// IP is a list of CIDRs and "provider:" ip sets. Required.
+	IP []string `yaml:"ip"`
+	// Reroute resolves the query again if the answer is rerouted.
+	// Same as sequence exec. Required.
+	Reroute interface{} `yaml:"reroute"`
+
+	// Invert reroutes the query if no answer IP matches IP.
+	Invert bool `yaml:"invert"`
+	// RerouteOnFailure also reroutes the query if Exec failed or got
+	// no response. Responses without A/AAAA answers, e.g. NXDOMAIN,
+	// are never rerouted.
+	RerouteOnFailure bool `yaml:"reroute_on_failure"`
+}
+
+type ipRouter struct {
+	*coremain.BP
+	args    *Args
+	exec    executable_seq.ExecutableChainNode
+	reroute executable_seq.ExecutableChainNode
+	ips     *netlist.MatcherGroup
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newIPRouter(bp, args.(*Args))
+}
+
+func newIPRouter(bp *coremain.BP, args *Args) (*ipRouter, error) {
+	if args.Exec == nil || args.Reroute == nil || len(args.IP) == 0 {
+		return nil, errors.New("exec, reroute and ip are required")
+	}
+	r := &ipRouter{BP: bp, args: args}
+	var err error
+	if r.exec, err = r.buildExec(args.Exec); err != nil {
+		return nil, fmt.Errorf("exec, %w", err)
+	}
+	if r.reroute, err = r.buildExec(args.Reroute); err != nil {
+		return nil, fmt.Errorf("reroute, %w", err)
+	}
+	if r.ips, err = netlist.BatchLoadProvider(args.IP, bp.M().GetDataManager()); err != nil {
+		return nil, err
+	}
+	bp.L().Info("ip set loaded", zap.Int("length", r.ips.Len()))
+	return r, nil
+}
+
+func (r *ipRouter) buildExec(in interface{}) (executable_seq.ExecutableChainNode, error) {
+	exec, err := executable_seq.BuildExecutableLogicTree(in, r.L(), r.M().GetExecutables(), r.M().GetMatchers())
+	if err != nil {
+		return nil, fmt.Errorf("cannot build exec: %w", err)
+	}
+	return exec, nil
+}
+
+// Exec resolves the query, reroutes it if needed, then executes next.
+func (r *ipRouter) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := r.route(ctx, qCtx); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (r *ipRouter) route(ctx context.Context, qCtx *query_context.Context) error {
+	// Exec may modify the query, e.g. add ECS. Keep the original one
+	// for Reroute.
+	qCtxCopy := qCtx.Copy()
+	err := executable_seq.ExecChainNode(ctx, qCtxCopy, r.exec)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	resp := qCtxCopy.R()
+	if err != nil || resp == nil {
+		if !r.args.RerouteOnFailure {
+			return err
+		}
+		r.L().Debug("exec failed, rerouting", qCtx.InfoField(), zap.Error(err))
+		return executable_seq.ExecChainNode(ctx, qCtx, r.reroute)
+	}
+
+	hasIP, matched := r.matchAnswer(resp)
+	if !hasIP || matched == r.args.Invert {
+		qCtx.SetResponse(resp)
+		return nil
+	}
+	if qCtx.Tracing() {
+		qCtx.Tracef("ip_router %s: answer ip matched %v, rerouting", r.Tag(), matched)
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, r.reroute)
+}
+
+// matchAnswer reports whether m has A/AAAA answers and whether any of
+// their IPs matches r.ips.
+func (r *ipRouter) matchAnswer(m *dns.Msg) (hasIP, matched bool) {
+	for _, rr := range m.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		hasIP = true
+		if ok, _ := r.ips.Match(addr); ok {
+			return true, true
+		}
+	}
+	return hasIP, false
+}
+
+func (r *ipRouter) Close() error {
+	return r.ips.Close()
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_router
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// answerExec replies an A record of ip, or nothing if ip is empty.
+type answerExec string
+
+func (e answerExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	if len(e) == 0 {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(string(e)),
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_ipRouter(t *testing.T) {
+	ips, err := netlist.BatchLoadProvider([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		first  string
+		invert bool
+		onFail bool
+		wantIP string // "" means no response
+	}{
+		{"matched", "10.0.0.1", false, false, "192.0.2.1"},
+		{"not matched", "172.16.0.1", false, false, "172.16.0.1"},
+		{"invert matched", "10.0.0.1", true, false, "10.0.0.1"},
+		{"invert not matched", "172.16.0.1", true, false, "192.0.2.1"},
+		{"no response", "", false, false, ""},
+		{"reroute on failure", "", false, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ipRouter{
+				BP:      coremain.NewBP("test", PluginType, nil, nil),
+				args:    &Args{Invert: tt.invert, RerouteOnFailure: tt.onFail},
+				exec:    executable_seq.WrapExecutable(answerExec(tt.first)),
+				reroute: executable_seq.WrapExecutable(answerExec("192.0.2.1")),
+				ips:     ips,
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q, nil)
+			if err := r.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if resp := qCtx.R(); resp != nil {
+				got = resp.Answer[0].(*dns.A).A.String()
+			}
+			if got != tt.wantIP {
+				t.Fatalf("got answer %q, want %q", got, tt.wantIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ipv6_probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/netmon"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "ipv6_probe"
+
+const networkChangeDelay = time.Second * 2
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*ipv6Probe)(nil)
+
+type Args struct {
+	// Targets are ipv6 "[addr]:port" that are dialed with tcp to probe the
+	// connectivity. Any successful dial means ipv6 works. Default is the
+	// dns servers of Google and Cloudflare.
+	Targets []string `yaml:"targets"`
+	// Interval between probes in seconds. Default is 60. Networks are
+	// also probed after they change.
+	Interval int `yaml:"interval"`
+	// Timeout of each probe in seconds. Default is 3.
+	Timeout int `yaml:"timeout"`
+	// Threshold is the number of consecutive probes needed to switch the
+	// state, so flapping links don't flip the policy on every probe.
+	// Default is 2.
+	Threshold int `yaml:"threshold"`
+}
+
+var defaultTargets = []string{"[2001:4860:4860::8888]:53", "[2606:4700:4700::1111]:53"}
+
+func (a *Args) init() {
+	if len(a.Targets) == 0 {
+		a.Targets = defaultTargets
+	}
+	utils.SetDefaultNum(&a.Interval, 60)
+	utils.SetDefaultNum(&a.Timeout, 3)
+	utils.SetDefaultNum(&a.Threshold, 2)
+}
+
+// ipv6Probe replies AAAA queries with empty responses while the host has
+// no working ipv6 connectivity.
+type ipv6Probe struct {
+	*coremain.BP
+	threshold int
+	probe     func(ctx context.Context) bool
+
+	ready atomic.Bool
+
+	m      sync.Mutex
+	probed bool
+	streak int // consecutive probe results that differ from ready
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	a := args.(*Args)
+	p, err := newIPv6Probe(bp, a)
+	if err != nil {
+		return nil, err
+	}
+	p.start(time.Duration(a.Interval) * time.Second)
+	return p, nil
+}
+
+func newIPv6Probe(bp *coremain.BP, args *Args) (*ipv6Probe, error) {
+	args.init()
+	targets := make([]string, 0, len(args.Targets))
+	for _, s := range args.Targets {
+		ap, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %s, %w", s, err)
+		}
+		if !ap.Addr().Is6() || ap.Addr().Is4In6() {
+			return nil, fmt.Errorf("target %s is not an ipv6 address", s)
+		}
+		targets = append(targets, ap.String())
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	p := &ipv6Probe{
+		BP:        bp,
+		threshold: args.Threshold,
+		probe: func(ctx context.Context) bool {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return dialAny(ctx, targets)
+		},
+	}
+	p.ready.Store(true) // until the first probe finishes
+	return p, nil
+}
+
+func (p *ipv6Probe) start(interval time.Duration) {
+	p.M().GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeSignal
+			cancel()
+		}()
+		p.runProbe(ctx)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.runProbe(ctx)
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+	p.M().GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		err := netmon.Watch(networkChangeDelay, func() {
+			p.runProbe(context.Background())
+		}, closeSignal)
+		if err != nil {
+			p.L().Warn("failed to watch network changes", zap.Error(err))
+		}
+	})
+}
+
+func (p *ipv6Probe) runProbe(ctx context.Context) {
+	p.update(p.probe(ctx))
+}
+
+// update records a probe result. The first result is applied at once,
+// later ones after threshold consecutive results.
+func (p *ipv6Probe) update(ok bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.probed && ok == p.ready.Load() {
+		p.streak = 0
+		return
+	}
+	p.streak++
+	if !p.probed || p.streak >= p.threshold {
+		p.probed = true
+		p.streak = 0
+		if p.ready.Swap(ok) != ok {
+			p.L().Info("ipv6 connectivity changed", zap.Bool("ready", ok))
+		}
+	}
+}
+
+// Exec replies AAAA queries with empty responses if ipv6 doesn't work.
+// Other queries are passed to next.
+func (p *ipv6Probe) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if !p.ready.Load() && len(q.Question) == 1 && q.Question[0].Qtype == dns.TypeAAAA {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// dialAny dials all targets at the same time and reports whether any of
+// them succeeded.
+func dialAny(ctx context.Context, targets []string) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	res := make(chan bool, len(targets))
+	d := new(net.Dialer)
+	for _, target := range targets {
+		go func() {
+			c, err := d.DialContext(ctx, "tcp6", target)
+			if err == nil {
+				c.Close()
+			}
+			res <- err == nil
+		}()
+	}
+	for range targets {
+		if <-res {
+			return true
+		}
+	}
+	return false
+}
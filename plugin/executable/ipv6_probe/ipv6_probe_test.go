@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ipv6_probe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_ipv6Probe(t *testing.T) {
+	p, err := newIPv6Probe(coremain.NewBP("test", PluginType, nil, nil), &Args{Threshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := func() bool {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeAAAA)
+		qCtx := query_context.NewContext(q, nil)
+		if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R() != nil
+	}
+
+	steps := []struct {
+		probe       bool
+		wantBlocked bool
+	}{
+		{false, true}, // the first result is applied at once
+		{true, true},
+		{false, true}, // streak is reset
+		{true, true},
+		{true, false},
+		{false, false},
+		{false, true},
+	}
+	if blocked() {
+		t.Fatal("AAAA should not be blocked before the first probe")
+	}
+	for i, s := range steps {
+		p.update(s.probe)
+		if got := blocked(); got != s.wantBlocked {
+			t.Fatalf("step #%d: blocked = %v, want %v", i, got, s.wantBlocked)
+		}
+	}
+
+	// Other qtypes are never blocked.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q, nil)
+	if err := p.Exec(context.Background(), qCtx, nil); err != nil || qCtx.R() != nil {
+		t.Fatal("A should not be blocked")
+	}
+}
+
+func Test_dialAny(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no ipv6 loopback")
+	}
+	defer l.Close()
+	closed, _ := net.Listen("tcp6", "[::1]:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !dialAny(ctx, []string{closedAddr, l.Addr().String()}) {
+		t.Fatal("dialAny should succeed")
+	}
+	if dialAny(ctx, []string{closedAddr}) {
+		t.Fatal("dialAny should fail")
+	}
+}
+
+func Test_newIPv6Probe(t *testing.T) {
+	for _, target := range []string{"1.1.1.1:53", "[::ffff:1.1.1.1]:53", "[::1]"} {
+		if _, err := newIPv6Probe(coremain.NewBP("test", PluginType, nil, nil), &Args{Targets: []string{target}}); err == nil {
+			t.Fatalf("invalid target %s should fail", target)
+		}
+	}
+}
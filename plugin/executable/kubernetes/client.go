@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	watchTimeoutSec = 300
+)
+
+// client is a minimal kubernetes api client that can only list and
+// watch resources.
+type client struct {
+	hc        *http.Client
+	server    string
+	token     string
+	tokenFile string
+}
+
+func newInClusterClient() (*client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, errors.New("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+	ca, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca file, %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid ca file")
+	}
+	return &client{
+		hc:        newHTTPClient(&tls.Config{RootCAs: pool}),
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: inClusterTokenFile,
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubeconfigClient creates a client from the current context of a
+// kubeconfig file. Exec and auth-provider plugins are not supported.
+// Relative paths in the file are relative to its directory, as kubectl
+// does.
+func newKubeconfigClient(file string) (*client, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kc := new(kubeconfig)
+	if err := yaml.Unmarshal(b, kc); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig, %w", err)
+	}
+	dir := filepath.Dir(file)
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if len(clusterName) == 0 {
+		return nil, fmt.Errorf("cannot find current context %s", kc.CurrentContext)
+	}
+
+	c := new(client)
+	tlsConfig := new(tls.Config)
+	found := false
+	for _, cl := range kc.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+		found = true
+		c.server = cl.Cluster.Server
+		tlsConfig.InsecureSkipVerify = cl.Cluster.InsecureSkipTLSVerify
+		ca, err := fileOrData(resolvePath(dir, cl.Cluster.CertificateAuthority), cl.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate authority, %w", err)
+		}
+		if len(ca) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.New("invalid certificate authority")
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cannot find cluster %s", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		c.token = u.User.Token
+		c.tokenFile = resolvePath(dir, u.User.TokenFile)
+		cert, err := fileOrData(resolvePath(dir, u.User.ClientCertificate), u.User.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate, %w", err)
+		}
+		key, err := fileOrData(resolvePath(dir, u.User.ClientKey), u.User.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client key, %w", err)
+		}
+		if len(cert) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client key pair, %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	c.hc = newHTTPClient(tlsConfig)
+	return c, nil
+}
+
+// resolvePath returns p relative to dir, if p is a relative path.
+func resolvePath(dir, p string) string {
+	if len(p) == 0 || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+func fileOrData(file, data string) ([]byte, error) {
+	if len(data) > 0 {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if len(file) > 0 {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: time.Second * 10,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+func (c *client) do(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.token
+	if len(c.tokenFile) > 0 { // tokens may be rotated, always read the latest one.
+		b, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file, %w", err)
+		}
+		token = string(bytes.TrimSpace(b))
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, path)
+	}
+	return resp, nil
+}
+
+// list lists resources from path and decodes the response into v.
+func (c *client) list(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// watch watches resources from path since resourceVersion. It returns
+// nil if any event is received or the server closes the stream.
+func (c *client) watch(ctx context.Context, path, resourceVersion string) error {
+	q := url.Values{}
+	q.Set("watch", "1")
+	q.Set("resourceVersion", resourceVersion)
+	q.Set("timeoutSeconds", fmt.Sprint(watchTimeoutSec))
+	resp, err := c.do(ctx, path, q)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Any event, including ERROR (e.g. the resource version is too old),
+	// means that a resync is needed.
+	var event json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == io.EOF { // watch timeout
+			return nil
+		}
+		return fmt.Errorf("failed to decode watch event from %s, %w", path, err)
+	}
+	return nil
+}
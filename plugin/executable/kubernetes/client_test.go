@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_newKubeconfigClient_relativePaths(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tk" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer s.Close()
+
+	dir := filepath.Join(t.TempDir(), "kube")
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "certs", "ca.crt"), ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("tk\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kc := `current-context: c
+clusters:
+- name: k
+  cluster:
+    server: ` + s.URL + `
+    certificate-authority: certs/ca.crt
+contexts:
+- name: c
+  context:
+    cluster: k
+    user: u
+users:
+- name: u
+  user:
+    tokenFile: token
+`
+	file := filepath.Join(dir, "config")
+	if err := os.WriteFile(file, []byte(kc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths must not be relative to the working directory.
+	c, err := newKubeconfigClient(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Items []any }
+	if err := c.list(context.Background(), "/api/v1/services", &v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_client_watch(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"event", `{"type":"ADDED","object":{}}`, false},
+		{"timeout", "", false},
+		{"truncated", `{"type":"ADD`, true},
+		{"invalid", `<html>`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer s.Close()
+			c := &client{hc: s.Client(), server: s.URL}
+			if err := c.watch(context.Background(), "/api/v1/services", "1"); (err != nil) != tt.wantErr {
+				t.Fatalf("watch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
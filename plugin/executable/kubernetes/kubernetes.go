@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "kubernetes"
+
+const (
+	syncTimeout   = time.Second * 30
+	retryDelay    = time.Second * 5
+	resyncBatchIn = time.Second
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*k8sPlugin)(nil)
+
+type Args struct {
+	// Kubeconfig is the path of kubeconfig file. If it is empty,
+	// the in-cluster service account will be used.
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Zone is the cluster domain. Default is "cluster.local".
+	Zone string `yaml:"zone"`
+	// Namespace limits the watched services to a namespace. Default is
+	// all namespaces.
+	Namespace string `yaml:"namespace"`
+	TTL       uint32 `yaml:"ttl"` // Default is 5.
+	// Pods enables "a-b-c-d.<namespace>.pod.<zone>" records.
+	// Like "pods insecure" in CoreDNS, the ip is not verified.
+	Pods bool `yaml:"pods"`
+}
+
+func (a *Args) init() {
+	if len(a.Zone) == 0 {
+		a.Zone = "cluster.local"
+	}
+	utils.SetDefaultNum(&a.TTL, 5)
+}
+
+type k8sPlugin struct {
+	*coremain.BP
+	args *Args
+	zone string
+	c    *client
+
+	records atomic.Pointer[records]
+	cancel  context.CancelFunc
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newK8sPlugin(bp, args.(*Args))
+}
+
+func newK8sPlugin(bp *coremain.BP, args *Args) (*k8sPlugin, error) {
+	args.init()
+	var c *client
+	var err error
+	if len(args.Kubeconfig) > 0 {
+		c, err = newKubeconfigClient(args.Kubeconfig)
+	} else {
+		c, err = newInClusterClient()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to init kubernetes client, %w", err)
+	}
+
+	p := &k8sPlugin{
+		BP:   bp,
+		args: args,
+		zone: dns.CanonicalName(args.Zone),
+		c:    c,
+	}
+
+	// Do the first sync before serving queries.
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	rvs, err := p.sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync with kubernetes api, %w", err)
+	}
+
+	ctx, p.cancel = context.WithCancel(context.Background())
+	go p.watchLoop(ctx, rvs)
+	return p, nil
+}
+
+func (p *k8sPlugin) paths() (svcPath, epPath string) {
+	if len(p.args.Namespace) > 0 {
+		return "/api/v1/namespaces/" + p.args.Namespace + "/services", "/api/v1/namespaces/" + p.args.Namespace + "/endpoints"
+	}
+	return "/api/v1/services", "/api/v1/endpoints"
+}
+
+// sync lists all services and endpoints and rebuilds the records.
+// It returns the resource versions of the lists.
+func (p *k8sPlugin) sync(ctx context.Context) ([2]string, error) {
+	svcPath, epPath := p.paths()
+	sl := new(serviceList)
+	if err := p.c.list(ctx, svcPath, sl); err != nil {
+		return [2]string{}, fmt.Errorf("failed to list services, %w", err)
+	}
+	el := new(endpointsList)
+	if err := p.c.list(ctx, epPath, el); err != nil {
+		return [2]string{}, fmt.Errorf("failed to list endpoints, %w", err)
+	}
+	p.records.Store(buildRecords(p.zone, p.args.TTL, p.args.Pods, sl, el))
+	p.L().Debug("kubernetes records synced", zap.Int("services", len(sl.Items)))
+	return [2]string{sl.Metadata.ResourceVersion, el.Metadata.ResourceVersion}, nil
+}
+
+// watchLoop waits for any change of services or endpoints, then
+// resyncs all records.
+func (p *k8sPlugin) watchLoop(ctx context.Context, rvs [2]string) {
+	svcPath, epPath := p.paths()
+	for {
+		wCtx, cancel := context.WithCancel(ctx)
+		errChan := make(chan error, 2)
+		go func() { errChan <- p.c.watch(wCtx, svcPath, rvs[0]) }()
+		go func() { errChan <- p.c.watch(wCtx, epPath, rvs[1]) }()
+		err := <-errChan
+		cancel()
+		<-errChan
+
+		delay := resyncBatchIn
+		if err != nil && ctx.Err() == nil {
+			p.L().Warn("failed to watch kubernetes api", zap.Error(err))
+			delay = retryDelay
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			sCtx, sCancel := context.WithTimeout(ctx, syncTimeout)
+			rvs, err = p.sync(sCtx)
+			sCancel()
+			if err == nil {
+				break
+			}
+			p.L().Warn("failed to sync with kubernetes api", zap.Error(err))
+			delay = retryDelay
+		}
+	}
+}
+
+// Exec answers queries in the zone authoritatively. Other queries
+// are passed to next.
+func (p *k8sPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	rs := p.records.Load()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || !rs.inZone(q.Question[0].Name) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	question := q.Question[0]
+	answer, extra, exist := rs.lookup(question.Name, question.Qtype)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+	switch {
+	case !exist:
+		r.Rcode = dns.RcodeNameError
+		r.Ns = []dns.RR{rs.soa()}
+	case len(answer) == 0:
+		r.Ns = []dns.RR{rs.soa()}
+	default:
+		r.Answer = answer
+		r.Extra = extra
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (p *k8sPlugin) Close() error {
+	p.cancel()
+	return nil
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kubernetes
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type objectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type servicePort struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+type serviceList struct {
+	Metadata listMeta `json:"metadata"`
+	Items    []struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     struct {
+			Type         string        `json:"type"`
+			ClusterIP    string        `json:"clusterIP"`
+			ClusterIPs   []string      `json:"clusterIPs"`
+			ExternalName string        `json:"externalName"`
+			Ports        []servicePort `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type endpointsList struct {
+	Metadata listMeta `json:"metadata"`
+	Items    []struct {
+		Metadata objectMeta `json:"metadata"`
+		Subsets  []struct {
+			Addresses []struct {
+				IP       string `json:"ip"`
+				Hostname string `json:"hostname"`
+			} `json:"addresses"`
+			Ports []servicePort `json:"ports"`
+		} `json:"subsets"`
+	} `json:"items"`
+}
+
+type service struct {
+	clusterIPs   []netip.Addr
+	headless     bool
+	externalName string
+	ports        []servicePort
+	endpoints    []endpoint
+}
+
+type endpoint struct {
+	name  string // hostname or dashed ip
+	addr  netip.Addr
+	ports []servicePort
+}
+
+// records is an immutable snapshot of services in the cluster.
+type records struct {
+	zone string // fqdn, e.g. "cluster.local."
+	ttl  uint32
+	pods bool
+
+	services   map[string]*service // "name.namespace"
+	namespaces map[string]struct{}
+}
+
+func buildRecords(zone string, ttl uint32, pods bool, sl *serviceList, el *endpointsList) *records {
+	r := &records{
+		zone:       zone,
+		ttl:        ttl,
+		pods:       pods,
+		services:   make(map[string]*service),
+		namespaces: make(map[string]struct{}),
+	}
+	for _, item := range sl.Items {
+		svc := &service{
+			externalName: item.Spec.ExternalName,
+			ports:        item.Spec.Ports,
+		}
+		ips := item.Spec.ClusterIPs
+		if len(ips) == 0 && len(item.Spec.ClusterIP) > 0 {
+			ips = []string{item.Spec.ClusterIP}
+		}
+		for _, s := range ips {
+			if s == "None" {
+				svc.headless = true
+				continue
+			}
+			if addr, err := netip.ParseAddr(s); err == nil {
+				svc.clusterIPs = append(svc.clusterIPs, addr)
+			}
+		}
+		r.services[strings.ToLower(item.Metadata.Name+"."+item.Metadata.Namespace)] = svc
+		r.namespaces[strings.ToLower(item.Metadata.Namespace)] = struct{}{}
+	}
+
+	for _, item := range el.Items {
+		svc := r.services[strings.ToLower(item.Metadata.Name+"."+item.Metadata.Namespace)]
+		if svc == nil {
+			continue
+		}
+		for _, subset := range item.Subsets {
+			for _, a := range subset.Addresses {
+				addr, err := netip.ParseAddr(a.IP)
+				if err != nil {
+					continue
+				}
+				name := strings.ToLower(a.Hostname)
+				if len(name) == 0 {
+					name = dashedIP(addr)
+				}
+				svc.endpoints = append(svc.endpoints, endpoint{name: name, addr: addr, ports: subset.Ports})
+			}
+		}
+	}
+	return r
+}
+
+func dashedIP(addr netip.Addr) string {
+	if addr.Is4() {
+		return strings.ReplaceAll(addr.String(), ".", "-")
+	}
+	return strings.ReplaceAll(addr.StringExpanded(), ":", "-")
+}
+
+func parseDashedIP(s string) (netip.Addr, bool) {
+	if strings.Count(s, "-") == 3 {
+		addr, err := netip.ParseAddr(strings.ReplaceAll(s, "-", "."))
+		return addr, err == nil && addr.Is4()
+	}
+	addr, err := netip.ParseAddr(strings.ReplaceAll(s, "-", ":"))
+	return addr, err == nil && addr.Is6()
+}
+
+// inZone returns true if qName is r.zone or its sub domain.
+func (r *records) inZone(qName string) bool {
+	return dns.IsSubDomain(r.zone, qName)
+}
+
+// lookup returns answers and additional records of qName and qType.
+// exist reports whether the qName exists in the zone.
+func (r *records) lookup(qName string, qType uint16) (answer, extra []dns.RR, exist bool) {
+	qName = strings.ToLower(dns.Fqdn(qName))
+	rel := strings.TrimSuffix(strings.TrimSuffix(qName, r.zone), ".")
+	if len(rel) == 0 {
+		return nil, nil, true // zone apex
+	}
+	labels := strings.Split(rel, ".")
+	n := len(labels)
+
+	switch {
+	case n >= 1 && labels[n-1] == "svc":
+		return r.lookupSvc(qName, qType, labels[:n-1])
+	case n == 3 && labels[2] == "pod" && r.pods:
+		if _, ok := r.namespaces[labels[1]]; !ok {
+			return nil, nil, false
+		}
+		addr, ok := parseDashedIP(labels[0])
+		if !ok {
+			return nil, nil, false
+		}
+		return r.addrRRs(qName, qType, []netip.Addr{addr}), nil, true
+	case n == 1 && (labels[0] == "svc" || labels[0] == "pod"):
+		return nil, nil, true
+	}
+	return nil, nil, false
+}
+
+func (r *records) lookupSvc(qName string, qType uint16, labels []string) (answer, extra []dns.RR, exist bool) {
+	n := len(labels)
+	switch n {
+	case 0:
+		return nil, nil, true
+	case 1: // <namespace>.svc
+		_, ok := r.namespaces[labels[0]]
+		return nil, nil, ok
+	}
+
+	svc := r.services[labels[n-2]+"."+labels[n-1]]
+	if svc == nil {
+		return nil, nil, false
+	}
+	svcName := labels[n-2] + "." + labels[n-1] + ".svc." + r.zone
+
+	switch n {
+	case 2: // <service>.<namespace>.svc
+		if len(svc.externalName) > 0 {
+			return []dns.RR{&dns.CNAME{Hdr: r.hdr(qName, dns.TypeCNAME), Target: dns.Fqdn(svc.externalName)}}, nil, true
+		}
+		if qType == dns.TypeSRV {
+			for _, p := range svc.ports {
+				answer, extra = r.appendSRV(answer, extra, qName, svc, p, svcName)
+			}
+			return answer, extra, true
+		}
+		return r.addrRRs(qName, qType, svc.addrs()), nil, true
+	case 3: // <endpoint>.<service>.<namespace>.svc
+		if !svc.headless {
+			return nil, nil, false
+		}
+		var addrs []netip.Addr
+		for _, e := range svc.endpoints {
+			if e.name == labels[0] {
+				addrs = append(addrs, e.addr)
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, nil, false
+		}
+		return r.addrRRs(qName, qType, addrs), nil, true
+	case 4: // _<port>._<proto>.<service>.<namespace>.svc
+		portName, proto := strings.TrimPrefix(labels[0], "_"), strings.TrimPrefix(labels[1], "_")
+		exist = false
+		for _, p := range svc.ports {
+			if strings.EqualFold(p.Name, portName) && strings.EqualFold(p.Protocol, proto) {
+				exist = true
+				if qType == dns.TypeSRV {
+					answer, extra = r.appendSRV(answer, extra, qName, svc, p, svcName)
+				}
+			}
+		}
+		return answer, extra, exist
+	}
+	return nil, nil, false
+}
+
+// appendSRV appends SRV records of the port p.
+// For headless services, every endpoint is a target.
+func (r *records) appendSRV(answer, extra []dns.RR, qName string, svc *service, p servicePort, svcName string) ([]dns.RR, []dns.RR) {
+	if !svc.headless {
+		answer = append(answer, &dns.SRV{
+			Hdr:      r.hdr(qName, dns.TypeSRV),
+			Priority: 0,
+			Weight:   100,
+			Port:     uint16(p.Port),
+			Target:   svcName,
+		})
+		extra = append(extra, r.addrRRs(svcName, dns.TypeA, svc.clusterIPs)...)
+		extra = append(extra, r.addrRRs(svcName, dns.TypeAAAA, svc.clusterIPs)...)
+		return answer, extra
+	}
+
+	for _, e := range svc.endpoints {
+		for _, ep := range e.ports {
+			if ep.Name != p.Name || ep.Protocol != p.Protocol {
+				continue
+			}
+			target := e.name + "." + svcName
+			answer = append(answer, &dns.SRV{
+				Hdr:      r.hdr(qName, dns.TypeSRV),
+				Priority: 0,
+				Weight:   100,
+				Port:     uint16(ep.Port),
+				Target:   target,
+			})
+			extra = append(extra, r.addrRRs(target, dns.TypeA, []netip.Addr{e.addr})...)
+			extra = append(extra, r.addrRRs(target, dns.TypeAAAA, []netip.Addr{e.addr})...)
+		}
+	}
+	return answer, extra
+}
+
+func (s *service) addrs() []netip.Addr {
+	if !s.headless {
+		return s.clusterIPs
+	}
+	addrs := make([]netip.Addr, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		addrs = append(addrs, e.addr)
+	}
+	return addrs
+}
+
+func (r *records) hdr(name string, typ uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: typ, Class: dns.ClassINET, Ttl: r.ttl}
+}
+
+func (r *records) addrRRs(name string, qType uint16, addrs []netip.Addr) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range addrs {
+		switch {
+		case qType == dns.TypeA && addr.Is4():
+			rrs = append(rrs, &dns.A{Hdr: r.hdr(name, dns.TypeA), A: addr.AsSlice()})
+		case qType == dns.TypeAAAA && addr.Is6():
+			rrs = append(rrs, &dns.AAAA{Hdr: r.hdr(name, dns.TypeAAAA), AAAA: addr.AsSlice()})
+		}
+	}
+	return rrs
+}
+
+// soa returns a fake SOA record of the zone for negative responses.
+func (r *records) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: r.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: r.ttl},
+		Ns:      "ns.dns." + r.zone,
+		Mbox:    "hostmaster." + r.zone,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  r.ttl,
+	}
+}
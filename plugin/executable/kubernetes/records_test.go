@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package kubernetes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testServices = `{"metadata":{"resourceVersion":"1"},"items":[
+{"metadata":{"name":"web","namespace":"default"},"spec":{"clusterIP":"10.0.0.10","clusterIPs":["10.0.0.10"],"ports":[{"name":"http","protocol":"TCP","port":80}]}},
+{"metadata":{"name":"db","namespace":"default"},"spec":{"clusterIP":"None","ports":[{"name":"pg","protocol":"TCP","port":5432}]}},
+{"metadata":{"name":"ext","namespace":"default"},"spec":{"type":"ExternalName","externalName":"example.com"}}
+]}`
+
+const testEndpoints = `{"metadata":{"resourceVersion":"1"},"items":[
+{"metadata":{"name":"db","namespace":"default"},"subsets":[{"addresses":[{"ip":"10.1.0.1","hostname":"db-0"},{"ip":"10.1.0.2"}],"ports":[{"name":"pg","protocol":"TCP","port":5432}]}]}
+]}`
+
+func Test_records_lookup(t *testing.T) {
+	sl, el := new(serviceList), new(endpointsList)
+	if err := json.Unmarshal([]byte(testServices), sl); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testEndpoints), el); err != nil {
+		t.Fatal(err)
+	}
+	rs := buildRecords("cluster.local.", 5, true, sl, el)
+
+	tests := []struct {
+		name      string
+		qName     string
+		qType     uint16
+		wantAns   int
+		wantExist bool
+	}{
+		{"cluster ip", "web.default.svc.cluster.local.", dns.TypeA, 1, true},
+		{"cluster ip nodata", "web.default.svc.cluster.local.", dns.TypeAAAA, 0, true},
+		{"headless", "db.default.svc.cluster.local.", dns.TypeA, 2, true},
+		{"endpoint hostname", "db-0.db.default.svc.cluster.local.", dns.TypeA, 1, true},
+		{"endpoint dashed ip", "10-1-0-2.db.default.svc.cluster.local.", dns.TypeA, 1, true},
+		{"srv", "_http._tcp.web.default.svc.cluster.local.", dns.TypeSRV, 1, true},
+		{"headless srv", "_pg._tcp.db.default.svc.cluster.local.", dns.TypeSRV, 2, true},
+		{"external name", "ext.default.svc.cluster.local.", dns.TypeA, 1, true},
+		{"pod", "10-1-0-1.default.pod.cluster.local.", dns.TypeA, 1, true},
+		{"namespace", "default.svc.cluster.local.", dns.TypeA, 0, true},
+		{"no service", "none.default.svc.cluster.local.", dns.TypeA, 0, false},
+		{"no namespace", "web.none.svc.cluster.local.", dns.TypeA, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ans, _, exist := rs.lookup(tt.qName, tt.qType)
+			if len(ans) != tt.wantAns || exist != tt.wantExist {
+				t.Fatalf("want %d answers, exist %v, got %d, %v", tt.wantAns, tt.wantExist, len(ans), exist)
+			}
+		})
+	}
+}
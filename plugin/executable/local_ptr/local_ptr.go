@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package local_ptr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "local_ptr"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*localPTR)(nil)
+
+type Args struct {
+	// Subnets are the local networks. Reverse names of them are answered
+	// locally and never forwarded. Default is the private and link-local
+	// ranges of RFC 1918, RFC 4193 and RFC 4291.
+	Subnets []string `yaml:"subnets"`
+	// Sources are tags of the plugins that provide host names, e.g. hosts
+	// and dhcp_lease. They are looked up in order.
+	Sources []string `yaml:"sources"`
+	TTL     uint32   `yaml:"ttl"` // Default is 60.
+}
+
+var defaultSubnets = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+func (a *Args) init() {
+	if len(a.Subnets) == 0 {
+		a.Subnets = defaultSubnets
+	}
+	utils.SetDefaultNum(&a.TTL, 60)
+}
+
+// ptrSource is implemented by plugins that know the host names of
+// local addresses.
+type ptrSource interface {
+	LookupPTR(addr netip.Addr) (string, bool)
+}
+
+type localPTR struct {
+	*coremain.BP
+	ttl     uint32
+	subnets []netip.Prefix
+	sources []ptrSource
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newLocalPTR(bp, args.(*Args))
+}
+
+func newLocalPTR(bp *coremain.BP, args *Args) (*localPTR, error) {
+	args.init()
+	if len(args.Sources) == 0 {
+		return nil, errors.New("no source is configured")
+	}
+	p := &localPTR{BP: bp, ttl: args.TTL}
+	for _, s := range args.Subnets {
+		pfx, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %s, %w", s, err)
+		}
+		p.subnets = append(p.subnets, pfx.Masked())
+	}
+	execs := bp.M().GetExecutables()
+	for _, tag := range args.Sources {
+		e := execs[tag]
+		if e == nil {
+			return nil, fmt.Errorf("cannot find plugin %s", tag)
+		}
+		s, ok := e.(ptrSource)
+		if !ok {
+			return nil, fmt.Errorf("plugin %s cannot provide host names", tag)
+		}
+		p.sources = append(p.sources, s)
+	}
+	return p, nil
+}
+
+// Exec answers queries for reverse names in the local subnets. Others
+// are passed to next.
+func (p *localPTR) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := p.lookup(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (p *localPTR) lookup(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	name, err := utils.ParsePTRPrefix(question.Name)
+	if err != nil {
+		return nil
+	}
+	subnet, ok := p.subnetOf(name)
+	if !ok {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Authoritative = true
+	soa := p.soa(zoneOf(subnet, name))
+	switch {
+	case name.IsSingleIP():
+		host, ok := p.lookupHost(name.Addr())
+		switch {
+		case !ok:
+			r.Rcode = dns.RcodeNameError
+		case question.Qtype == dns.TypePTR:
+			r.Answer = []dns.RR{&dns.PTR{Hdr: p.hdr(question.Name, dns.TypePTR), Ptr: host}}
+		}
+	case question.Qtype == dns.TypeSOA && soa.Hdr.Name == dns.CanonicalName(question.Name):
+		r.Answer = []dns.RR{soa}
+	}
+	if len(r.Answer) == 0 {
+		r.Ns = []dns.RR{soa}
+	}
+	return r
+}
+
+// subnetOf returns the subnet that covers the whole name.
+func (p *localPTR) subnetOf(name netip.Prefix) (netip.Prefix, bool) {
+	for _, s := range p.subnets {
+		if name.Addr().Is4() == s.Addr().Is4() && name.Bits() >= s.Bits() && s.Contains(name.Addr()) {
+			return s, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func (p *localPTR) lookupHost(addr netip.Addr) (string, bool) {
+	for _, s := range p.sources {
+		if host, ok := s.LookupPTR(addr); ok {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// zoneOf returns the reverse zone of name. A subnet that is not on a
+// label boundary, e.g. a /20, is served as multiple zones by rounding up
+// to the next boundary.
+func zoneOf(subnet, name netip.Prefix) string {
+	step := 8
+	if subnet.Addr().Is6() {
+		step = 4
+	}
+	bits := (subnet.Bits() + step - 1) / step * step
+	return utils.PTRName(netip.PrefixFrom(name.Addr(), bits).Masked())
+}
+
+func (p *localPTR) hdr(name string, typ uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: typ, Class: dns.ClassINET, Ttl: p.ttl}
+}
+
+func (p *localPTR) soa(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     p.hdr(zone, dns.TypeSOA),
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  p.ttl,
+	}
+}
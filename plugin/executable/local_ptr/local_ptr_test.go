@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package local_ptr
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type testSource map[netip.Addr]string
+
+func (s testSource) LookupPTR(addr netip.Addr) (string, bool) {
+	h, ok := s[addr]
+	return h, ok
+}
+
+func Test_localPTR_lookup(t *testing.T) {
+	p := &localPTR{
+		ttl: 60,
+		subnets: []netip.Prefix{
+			netip.MustParsePrefix("192.168.1.0/24"),
+			netip.MustParsePrefix("10.0.16.0/20"),
+			netip.MustParsePrefix("fd00::/8"),
+		},
+		sources: []ptrSource{testSource{
+			netip.MustParseAddr("192.168.1.10"): "nas.lan.",
+			netip.MustParseAddr("fd00::1"):      "router.lan.",
+		}},
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantNil   bool
+		wantRcode int
+		wantPTR   string
+		wantZone  string
+	}{
+		{"known v4", "10.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "nas.lan.", ""},
+		{"known v6", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, false, dns.RcodeSuccess, "router.lan.", ""},
+		{"known nodata", "10.1.168.192.in-addr.arpa.", dns.TypeA, false, dns.RcodeSuccess, "", "1.168.192.in-addr.arpa."},
+		{"unknown", "11.1.168.192.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "1.168.192.in-addr.arpa."},
+		{"apex", "1.168.192.in-addr.arpa.", dns.TypeNS, false, dns.RcodeSuccess, "", "1.168.192.in-addr.arpa."},
+		{"unaligned subnet", "1.17.0.10.in-addr.arpa.", dns.TypePTR, false, dns.RcodeNameError, "", "17.0.10.in-addr.arpa."},
+		{"outside unaligned subnet", "1.32.0.10.in-addr.arpa.", dns.TypePTR, true, 0, "", ""},
+		{"parent zone", "168.192.in-addr.arpa.", dns.TypePTR, true, 0, "", ""},
+		{"public", "8.8.8.8.in-addr.arpa.", dns.TypePTR, true, 0, "", ""},
+		{"not ptr", "example.com.", dns.TypeA, true, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r := p.lookup(q)
+			if tt.wantNil {
+				if r != nil {
+					t.Fatalf("want nil, got %v", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatal("want a response")
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if len(tt.wantPTR) > 0 {
+				if len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != tt.wantPTR {
+					t.Fatalf("want ptr %s, got %v", tt.wantPTR, r.Answer)
+				}
+			}
+			if len(tt.wantZone) > 0 {
+				if len(r.Ns) != 1 || r.Ns[0].Header().Name != tt.wantZone {
+					t.Fatalf("want soa of %s, got %v", tt.wantZone, r.Ns)
+				}
+			}
+		})
+	}
+}
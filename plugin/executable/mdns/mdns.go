@@ -0,0 +1,367 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/pool"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "mdns"
+
+const (
+	mdnsPort      = 5353
+	cacheFlushBit = 1 << 15
+)
+
+var (
+	mdnsGroupV4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroupV6 = net.ParseIP("ff02::fb")
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*mdnsPlugin)(nil)
+
+type Args struct {
+	// Allowlist limits the names that can be resolved by mdns.
+	// Default is all ".local" names.
+	Allowlist []string `yaml:"allowlist"`
+	// Interface is the network interface used to send multicast queries.
+	// Required by ipv6. Default is the system default.
+	Interface string `yaml:"interface"`
+	IPv6      bool   `yaml:"ipv6"`         // also query ff02::fb
+	Timeout   int    `yaml:"timeout"`      // (ms) Default is 1000.
+	CacheSize int    `yaml:"cache_size"`   // Default is 1024.
+	MaxTTL    uint32 `yaml:"max_ttl"`      // Default is 60.
+	NegTTL    uint32 `yaml:"negative_ttl"` // (sec) How long a not found result will be cached. Default is 5.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.Timeout, 1000)
+	utils.SetDefaultNum(&a.CacheSize, 1024)
+	utils.SetDefaultNum(&a.MaxTTL, 60)
+	utils.SetDefaultNum(&a.NegTTL, 5)
+}
+
+type cacheEntry struct {
+	// r is nil if the name was not found. It has no answer if the name
+	// exists but has no record of the queried type.
+	r          *dns.Msg
+	expireTime time.Time
+}
+
+type mdnsPlugin struct {
+	*coremain.BP
+	args      *Args
+	iface     *net.Interface
+	allowlist *domain.MatcherGroup[struct{}]
+	cache     *concurrent_lru.ConcurrentLRU[dns.Question, *cacheEntry]
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newMDNS(bp, args.(*Args))
+}
+
+func newMDNS(bp *coremain.BP, args *Args) (*mdnsPlugin, error) {
+	args.init()
+	p := &mdnsPlugin{
+		BP:    bp,
+		args:  args,
+		cache: concurrent_lru.NewConecurrentLRU[dns.Question, *cacheEntry](args.CacheSize, nil),
+	}
+	if len(args.Interface) > 0 {
+		iface, err := net.InterfaceByName(args.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface, %w", err)
+		}
+		p.iface = iface
+	}
+	if args.IPv6 && p.iface == nil {
+		return nil, errors.New("interface is required by ipv6")
+	}
+	if len(args.Allowlist) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(args.Allowlist, bp.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		p.allowlist = mg
+		bp.L().Info("allowlist loaded", zap.Int("length", mg.Len()))
+	}
+	return p, nil
+}
+
+func (p *mdnsPlugin) shouldHandle(q *dns.Msg) bool {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	name := q.Question[0].Name
+	if !dns.IsSubDomain("local.", strings.ToLower(name)) {
+		return false
+	}
+	if p.allowlist != nil {
+		_, ok := p.allowlist.Match(name)
+		return ok
+	}
+	return true
+}
+
+// Exec resolves allowed ".local" queries by mdns. Other queries are
+// passed to next.
+func (p *mdnsPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if !p.shouldHandle(q) {
+		return executable_seq.ExecChainNode(ctx, qCtx, next)
+	}
+
+	question := q.Question[0]
+	question.Name = strings.ToLower(question.Name)
+	now := time.Now()
+	if e, ok := p.cache.Get(question); ok && now.Before(e.expireTime) {
+		qCtx.SetResponse(p.makeReply(q, e))
+		return nil
+	}
+
+	answers, exists, err := p.resolve(ctx, question)
+	if err != nil {
+		return fmt.Errorf("mdns query failed, %w", err)
+	}
+	e := &cacheEntry{expireTime: now.Add(time.Duration(p.args.NegTTL) * time.Second)}
+	if len(answers) > 0 {
+		r := new(dns.Msg)
+		r.Answer = answers
+		e.r = r
+		e.expireTime = now.Add(time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second)
+	} else if exists {
+		e.r = new(dns.Msg)
+	}
+	p.cache.Add(question, e)
+	qCtx.SetResponse(p.makeReply(q, e))
+	return nil
+}
+
+// LookupPTR returns the host name of addr by a multicast reverse query.
+// It blocks until the query is answered or timed out. Results are not
+// cached.
+func (p *mdnsPlugin) LookupPTR(addr netip.Addr) (string, bool) {
+	name, err := dns.ReverseAddr(addr.Unmap().String())
+	if err != nil {
+		return "", false
+	}
+	answers, _, err := p.resolve(context.Background(), dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	if err != nil {
+		p.L().Debug("mdns reverse query failed", zap.Stringer("addr", addr), zap.Error(err))
+		return "", false
+	}
+	for _, rr := range answers {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return ptr.Ptr, true
+		}
+	}
+	return "", false
+}
+
+func (p *mdnsPlugin) makeReply(q *dns.Msg, e *cacheEntry) *dns.Msg {
+	var r *dns.Msg
+	switch {
+	case e.r == nil:
+		r = dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+	case len(e.r.Answer) == 0: // NODATA, the name exists.
+		r = dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	default:
+		r = new(dns.Msg)
+		r.SetReply(q)
+		r.RecursionAvailable = true
+		for _, rr := range e.r.Answer {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Question[0].Name
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	if ttl := uint32(time.Until(e.expireTime) / time.Second); ttl > 0 {
+		dnsutils.SetTTL(r, ttl)
+	} else {
+		dnsutils.SetTTL(r, 1)
+	}
+	return r
+}
+
+// resolve sends a one-shot (legacy unicast) mdns query, see RFC 6762 6.7.
+// It returns the first non-empty answers or nil if timed out. exists
+// reports whether a responder has the name, even if it has no record
+// of the queried type.
+func (p *mdnsPlugin) resolve(ctx context.Context, question dns.Question) (rrs []dns.RR, exists bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.args.Timeout)*time.Millisecond)
+	defer cancel()
+
+	type result struct {
+		rrs    []dns.RR
+		exists bool
+		err    error
+	}
+	groups := []*net.UDPAddr{{IP: mdnsGroupV4, Port: mdnsPort}}
+	if p.args.IPv6 {
+		groups = append(groups, &net.UDPAddr{IP: mdnsGroupV6, Port: mdnsPort, Zone: p.iface.Name})
+	}
+	resChan := make(chan result, len(groups))
+	for _, g := range groups {
+		g := g
+		go func() {
+			rrs, exists, err := p.queryGroup(ctx, g, question)
+			resChan <- result{rrs: rrs, exists: exists, err: err}
+		}()
+	}
+
+	var errs []error
+	for range groups {
+		res := <-resChan
+		if len(res.rrs) > 0 {
+			return res.rrs, true, nil
+		}
+		exists = exists || res.exists
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+	}
+	if len(errs) == len(groups) {
+		return nil, false, errors.Join(errs...)
+	}
+	return nil, exists, nil
+}
+
+func (p *mdnsPlugin) queryGroup(ctx context.Context, group *net.UDPAddr, question dns.Question) (rrs []dns.RR, exists bool, err error) {
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	c, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+	if p.iface != nil && network == "udp4" {
+		if err := ipv4.NewPacketConn(c).SetMulticastInterface(p.iface); err != nil {
+			return nil, false, err
+		}
+	}
+
+	q := new(dns.Msg)
+	q.Id = dns.Id()
+	q.Question = []dns.Question{question}
+	b, buf, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = c.WriteToUDP(b, group)
+	buf.Release()
+	if err != nil {
+		return nil, false, err
+	}
+
+	ddl, _ := ctx.Deadline()
+	c.SetReadDeadline(ddl)
+	rb := pool.GetBuf(dns.MaxMsgSize)
+	defer rb.Release()
+	for {
+		n, _, err := c.ReadFromUDP(rb.Bytes())
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, exists, nil
+			}
+			return nil, false, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(rb.Bytes()[:n]); err != nil || !r.Response {
+			continue
+		}
+		if rrs := p.filterAnswers(r, question); len(rrs) > 0 {
+			return rrs, true, nil
+		}
+		// Responders answer with an NSEC or records of other types if
+		// they have the name (RFC 6762 6.1).
+		exists = exists || hasName(r, question.Name)
+	}
+}
+
+// filterAnswers picks records that answer question from r, clears the
+// mdns cache flush bit and limits their ttl.
+func (p *mdnsPlugin) filterAnswers(r *dns.Msg, question dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, sec := range [][]dns.RR{r.Answer, r.Extra} {
+		for _, rr := range sec {
+			h := rr.Header()
+			h.Class &^= cacheFlushBit
+			if h.Class != dns.ClassINET || !strings.EqualFold(h.Name, question.Name) {
+				continue
+			}
+			if h.Rrtype != question.Qtype && h.Rrtype != dns.TypeCNAME {
+				continue
+			}
+			if h.Ttl > p.args.MaxTTL {
+				h.Ttl = p.args.MaxTTL
+			}
+			if h.Ttl == 0 { // goodbye packet
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// hasName reports whether r has a record of name.
+func hasName(r *dns.Msg, name string) bool {
+	for _, sec := range [][]dns.RR{r.Answer, r.Extra} {
+		for _, rr := range sec {
+			if h := rr.Header(); h.Ttl > 0 && strings.EqualFold(h.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *mdnsPlugin) Close() error {
+	if p.allowlist != nil {
+		_ = p.allowlist.Close()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestMDNS(t *testing.T) *mdnsPlugin {
+	t.Helper()
+	p, err := newMDNS(coremain.NewBP("test", PluginType, zap.NewNop(), new(coremain.Mosdns)), &Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_mdnsPlugin_makeReply(t *testing.T) {
+	p := newTestMDNS(t)
+	q := new(dns.Msg)
+	q.SetQuestion("Printer.local.", dns.TypeA)
+	exp := time.Now().Add(time.Second * 10)
+
+	answer := new(dns.Msg)
+	answer.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 168, 1, 2),
+	}}
+	tests := []struct {
+		name      string
+		r         *dns.Msg
+		wantRcode int
+		wantAns   int
+	}{
+		{"found", answer, dns.RcodeSuccess, 1},
+		{"nodata", new(dns.Msg), dns.RcodeSuccess, 0},
+		{"not found", nil, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := p.makeReply(q, &cacheEntry{r: tt.r, expireTime: exp})
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns {
+				t.Fatalf("want rcode %d with %d answers, got %v", tt.wantRcode, tt.wantAns, r)
+			}
+			for _, rr := range append(r.Answer, r.Ns...) {
+				if rr.Header().Ttl > 10 {
+					t.Fatalf("ttl should be limited by the cache entry, %v", rr)
+				}
+			}
+			if tt.wantAns > 0 && r.Answer[0].Header().Name != "Printer.local." {
+				t.Fatal("answer name should match the query")
+			}
+		})
+	}
+}
+
+func Test_hasName(t *testing.T) {
+	r := new(dns.Msg)
+	r.Answer = []dns.RR{&dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 120},
+		NextDomain: "printer.local.",
+		TypeBitMap: []uint16{dns.TypeA},
+	}}
+	if !hasName(r, "Printer.local.") {
+		t.Fatal("nsec should show that the name exists")
+	}
+	if hasName(r, "other.local.") {
+		t.Fatal("unexpected name")
+	}
+	p := newTestMDNS(t)
+	if rrs := p.filterAnswers(r, dns.Question{Name: "printer.local.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}); len(rrs) != 0 {
+		t.Fatalf("nsec is not an answer, %v", rrs)
+	}
+}
+
+func Test_mdnsPlugin_Exec(t *testing.T) {
+	p := newTestMDNS(t)
+	p.cache.Add(dns.Question{Name: "printer.local.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, &cacheEntry{
+		r:          new(dns.Msg),
+		expireTime: time.Now().Add(time.Minute),
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("printer.local.", dns.TypeAAAA)
+	qCtx := query_context.NewContext(q, nil)
+	if err := p.Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("want a cached nodata response, got %v", r)
+	}
+
+	// Names other than .local are not handled.
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx = query_context.NewContext(q, nil)
+	if err := p.Exec(context.Background(), qCtx, nil); err != nil || qCtx.R() != nil {
+		t.Fatalf("unexpected response %v, %v", qCtx.R(), err)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dns_event"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/mqtt"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "mqtt"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*mqttPublisher)(nil)
+
+type Args struct {
+	// Broker is the broker url, e.g. "tcp://127.0.0.1:1883", "tls://broker:8883".
+	Broker             string `yaml:"broker"`
+	ClientID           string `yaml:"client_id"` // Default is "mosdns-<hostname>".
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	KeepAlive          int    `yaml:"keep_alive"` // (sec) Default is 60.
+
+	// Topic is a go text/template of the event topic, e.g. "mosdns/{{.Rule}}".
+	// Default is "mosdns/events".
+	Topic string `yaml:"topic"`
+	// Template is a go text/template of the payload. See dns_event.NewTemplate.
+	// Default is a json object of the event.
+	Template string `yaml:"template"`
+	// Rule is a user defined label that will be sent as "rule".
+	Rule   string `yaml:"rule"`
+	Retain bool   `yaml:"retain"`
+
+	// StatusTopic is a retained topic of "online"/"offline". "offline" is
+	// published by the broker as the last will if mosdns goes away.
+	// Default is "mosdns/status".
+	StatusTopic string `yaml:"status_topic"`
+	// StatsTopic, if not empty, receives a json object of mosdns health
+	// stats every StatsInterval seconds.
+	StatsTopic    string `yaml:"stats_topic"`
+	StatsInterval int    `yaml:"stats_interval"` // (sec) Default is 60.
+	QueueSize     int    `yaml:"queue_size"`     // Default is 1024.
+}
+
+func (a *Args) init() {
+	if len(a.ClientID) == 0 {
+		host, _ := os.Hostname()
+		a.ClientID = "mosdns-" + host
+	}
+	if len(a.Topic) == 0 {
+		a.Topic = "mosdns/events"
+	}
+	if len(a.StatusTopic) == 0 {
+		a.StatusTopic = "mosdns/status"
+	}
+	utils.SetDefaultNum(&a.KeepAlive, 60)
+	utils.SetDefaultNum(&a.StatsInterval, 60)
+	utils.SetDefaultNum(&a.QueueSize, 1024)
+}
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+type mqttPublisher struct {
+	*coremain.BP
+	args      *Args
+	opts      mqtt.Opts
+	topic     *dns_event.Template
+	tmpl      *dns_event.Template
+	queue     chan message
+	startTime time.Time
+
+	published atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newMqttPublisher(bp, args.(*Args))
+}
+
+func newMqttPublisher(bp *coremain.BP, args *Args) (*mqttPublisher, error) {
+	args.init()
+	if len(args.Broker) == 0 {
+		return nil, errors.New("missing broker")
+	}
+	topic, err := dns_event.NewTemplate(args.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic, %w", err)
+	}
+	tmpl, err := dns_event.NewTemplate(args.Template)
+	if err != nil {
+		return nil, err
+	}
+	p := &mqttPublisher{
+		BP:   bp,
+		args: args,
+		opts: mqtt.Opts{
+			ClientID:  args.ClientID,
+			Username:  args.Username,
+			Password:  args.Password,
+			KeepAlive: time.Duration(args.KeepAlive) * time.Second,
+			Will:      &mqtt.Will{Topic: args.StatusTopic, Payload: []byte("offline"), Retain: true},
+			TLSConfig: &tls.Config{InsecureSkipVerify: args.InsecureSkipVerify},
+		},
+		topic:     topic,
+		tmpl:      tmpl,
+		queue:     make(chan message, args.QueueSize),
+		startTime: time.Now(),
+	}
+	bp.M().GetSafeClose().Attach(p.publishLoop)
+	return p, nil
+}
+
+// Exec executes next first, then queues an event of the query and
+// its response. It never blocks the query.
+func (p *mqttPublisher) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	e := dns_event.FromContext(qCtx, p.args.Rule)
+	topic, rErr := p.topic.Render(e)
+	if rErr != nil {
+		p.L().Warn("failed to render topic", qCtx.InfoField(), zap.Error(rErr))
+		return err
+	}
+	b, rErr := p.tmpl.Render(e)
+	if rErr != nil {
+		p.L().Warn("failed to render payload", qCtx.InfoField(), zap.Error(rErr))
+		return err
+	}
+	select {
+	case p.queue <- message{topic: string(topic), payload: b}:
+	default:
+		p.dropped.Add(1)
+		p.L().Warn("mqtt queue is full, event dropped", qCtx.InfoField())
+	}
+	return err
+}
+
+// publishLoop keeps a connection to the broker and publishes queued
+// messages until closeSignal.
+func (p *mqttPublisher) publishLoop(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-closeSignal
+		cancel()
+	}()
+
+	backoff := time.Second
+	for {
+		c, err := p.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			p.L().Warn("failed to connect mqtt broker", zap.String("broker", p.args.Broker), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+				backoff = min(backoff*2, time.Minute)
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		backoff = time.Second
+		p.L().Info("mqtt broker connected", zap.String("broker", p.args.Broker))
+
+		err = p.serveConn(ctx, c)
+		if ctx.Err() != nil {
+			_ = c.Publish(p.args.StatusTopic, []byte("offline"), true)
+			c.Close()
+			return
+		}
+		p.L().Warn("mqtt connection lost", zap.Error(err))
+		c.Close()
+	}
+}
+
+func (p *mqttPublisher) connect(ctx context.Context) (*mqtt.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	c, err := mqtt.Dial(dialCtx, p.args.Broker, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Publish(p.args.StatusTopic, []byte("online"), true); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *mqttPublisher) serveConn(ctx context.Context, c *mqtt.Conn) error {
+	var statsC <-chan time.Time
+	if len(p.args.StatsTopic) > 0 {
+		ticker := time.NewTicker(time.Duration(p.args.StatsInterval) * time.Second)
+		defer ticker.Stop()
+		statsC = ticker.C
+	}
+
+	for {
+		select {
+		case m := <-p.queue:
+			if err := c.Publish(m.topic, m.payload, p.args.Retain); err != nil {
+				p.dropped.Add(1)
+				return err
+			}
+			p.published.Add(1)
+		case <-statsC:
+			if err := c.Publish(p.args.StatsTopic, p.stats(), true); err != nil {
+				return err
+			}
+		case <-c.Done():
+			return c.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type stats struct {
+	Status     string `json:"status"`
+	Uptime     int64  `json:"uptime"`
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	Published  uint64 `json:"published"`
+	Dropped    uint64 `json:"dropped"`
+	Queued     int    `json:"queued"`
+}
+
+func (p *mqttPublisher) stats() []byte {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	b, _ := json.Marshal(stats{
+		Status:     "online",
+		Uptime:     int64(time.Since(p.startTime).Seconds()),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		Published:  p.published.Load(),
+		Dropped:    p.dropped.Load(),
+		Queued:     len(p.queue),
+	})
+	return b
+}
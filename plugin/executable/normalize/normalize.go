@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package normalize
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "normalize"
+
+func init() {
+	coremain.RegNewPersetPluginFunc("_normalize_query", func(bp *coremain.BP) (coremain.Plugin, error) {
+		return &normalize{BP: bp}, nil
+	})
+}
+
+var _ coremain.ExecutablePlugin = (*normalize)(nil)
+
+// normalize lowercases query names, so queries from clients that randomize
+// the case (dns 0x20) share cache entries and match rules. The original
+// case is restored in the response.
+type normalize struct {
+	*coremain.BP
+}
+
+func (n *normalize) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	var origNames []string // original names of questions, empty if unchanged
+	for i := range q.Question {
+		name := dns.Fqdn(q.Question[i].Name)
+		canonical := strings.ToLower(name)
+		if canonical == q.Question[i].Name {
+			continue
+		}
+		if origNames == nil {
+			origNames = make([]string, len(q.Question))
+		}
+		if canonical != name {
+			origNames[i] = name
+		}
+		q.Question[i].Name = canonical
+	}
+
+	if err := executable_seq.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil && origNames != nil {
+		restoreCase(r, origNames)
+	}
+	return nil
+}
+
+// restoreCase replaces names in r that equal to origNames, case-insensitively,
+// with origNames.
+func restoreCase(r *dns.Msg, origNames []string) {
+	orig := func(name string) string {
+		for _, o := range origNames {
+			if len(o) > 0 && o != name && strings.EqualFold(o, name) {
+				return o
+			}
+		}
+		return ""
+	}
+
+	// Questions and records may be shared with other msgs, e.g. cached
+	// responses. Modify copies.
+	r.Question = append([]dns.Question(nil), r.Question...)
+	for i := range r.Question {
+		if o := orig(r.Question[i].Name); len(o) > 0 {
+			r.Question[i].Name = o
+		}
+	}
+	copied := false
+	for i, rr := range r.Answer {
+		if o := orig(rr.Header().Name); len(o) > 0 {
+			if !copied {
+				r.Answer = append([]dns.RR(nil), r.Answer...)
+				copied = true
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = o
+			r.Answer[i] = rr
+		}
+	}
+}
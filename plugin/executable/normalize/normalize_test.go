@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package normalize
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_normalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		qName string
+	}{
+		{"lower", "example.com."},
+		{"mixed", "ExAmPlE.cOm."},
+		{"no trailing dot", "EXAMPLE.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, dns.TypeA)
+			var gotName string
+			next := executable_seq.WrapExecutable(execFunc(func(qCtx *query_context.Context) {
+				gotName = qCtx.Q().Question[0].Name
+				r := new(dns.Msg)
+				r.SetReply(qCtx.Q())
+				r.Answer = append(r.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: gotName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IPv4(1, 2, 3, 4),
+				})
+				qCtx.SetResponse(r)
+			}))
+
+			qCtx := query_context.NewContext(q, nil)
+			if err := new(normalize).Exec(context.Background(), qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if gotName != "example.com." {
+				t.Fatalf("next got name %s", gotName)
+			}
+			want := dns.Fqdn(tt.qName)
+			r := qCtx.R()
+			if r.Question[0].Name != want || r.Answer[0].Header().Name != want {
+				t.Fatalf("want name %s, got %s %s", want, r.Question[0].Name, r.Answer[0].Header().Name)
+			}
+		})
+	}
+}
+
+func Test_restoreCase_shared(t *testing.T) {
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	}
+	shared := []dns.RR{a}
+	r := new(dns.Msg)
+	r.Answer = shared
+
+	restoreCase(r, []string{"ExAmPlE.cOm."})
+	if r.Answer[0].Header().Name != "ExAmPlE.cOm." {
+		t.Fatalf("name is not restored, got %s", r.Answer[0].Header().Name)
+	}
+	if shared[0] != a || a.Hdr.Name != "example.com." {
+		t.Fatal("shared answer is modified")
+	}
+}
+
+type execFunc func(qCtx *query_context.Context)
+
+func (f execFunc) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	f(qCtx)
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qtype_block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "qtype_block"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*qtypeBlock)(nil)
+
+type Args struct {
+	// Rules are checked in order, the first matched rule replies the query.
+	// Queries that match no rule are passed to next.
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+type RuleConfig struct {
+	// Qtype can be type names (e.g. "ANY", "NAPTR", "TYPE65") or numbers.
+	Qtype []string `yaml:"qtype"`
+	// Domain limits the rule to these domains. Same format as the domain
+	// of query_matcher. Default is all domains.
+	Domain []string `yaml:"domain"`
+	// PublicPTR limits the rule to reverse names of public addresses, so
+	// PTR queries of the local networks still work.
+	PublicPTR bool `yaml:"public_ptr"`
+
+	// Action is "nodata" (default) or "refuse".
+	Action string `yaml:"action"`
+	// Rcode overrides the rcode of the action, which is NOERROR for nodata
+	// and REFUSED for refuse.
+	Rcode string `yaml:"rcode"`
+	// EDE adds an extended dns error (RFC 8914) to the response if the
+	// query has EDNS0. Optional.
+	EDE *EDEConfig `yaml:"ede"`
+}
+
+type EDEConfig struct {
+	Code uint16 `yaml:"code"` // e.g. 15 (Blocked), 18 (Prohibited), 21 (Not Supported)
+	Text string `yaml:"text"`
+}
+
+type rule struct {
+	qtypes    map[uint16]struct{}
+	domains   *domain.MatcherGroup[struct{}] // nil means all domains
+	publicPTR bool
+	rcode     int
+	ede       *dns.EDNS0_EDE // maybe nil
+}
+
+type qtypeBlock struct {
+	*coremain.BP
+	rules  []*rule
+	closer []io.Closer
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newQtypeBlock(bp, args.(*Args))
+}
+
+func newQtypeBlock(bp *coremain.BP, args *Args) (*qtypeBlock, error) {
+	b := &qtypeBlock{BP: bp}
+	for i := range args.Rules {
+		r, err := b.newRule(&args.Rules[i])
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("rule #%d, %w", i, err)
+		}
+		b.rules = append(b.rules, r)
+	}
+	return b, nil
+}
+
+func (b *qtypeBlock) newRule(c *RuleConfig) (*rule, error) {
+	if len(c.Qtype) == 0 {
+		return nil, errors.New("no qtype")
+	}
+	r := &rule{qtypes: make(map[uint16]struct{}), publicPTR: c.PublicPTR}
+	for _, s := range c.Qtype {
+		qtype, err := dnsutils.ParseQtype(s)
+		if err != nil {
+			return nil, err
+		}
+		r.qtypes[qtype] = struct{}{}
+	}
+
+	switch c.Action {
+	case "", "nodata":
+		r.rcode = dns.RcodeSuccess
+	case "refuse":
+		r.rcode = dns.RcodeRefused
+	default:
+		return nil, fmt.Errorf("invalid action %s", c.Action)
+	}
+	if len(c.Rcode) > 0 {
+		rcode, err := dnsutils.ParseRcode(c.Rcode)
+		if err != nil {
+			return nil, err
+		}
+		r.rcode = rcode
+	}
+	if c.EDE != nil {
+		r.ede = &dns.EDNS0_EDE{InfoCode: c.EDE.Code, ExtraText: c.EDE.Text}
+	}
+
+	if len(c.Domain) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(c.Domain, b.M().GetDataManager())
+		if err != nil {
+			return nil, err
+		}
+		r.domains = mg
+		b.closer = append(b.closer, mg)
+	}
+	return r, nil
+}
+
+// Exec replies queries that match a rule, others are passed to next.
+func (b *qtypeBlock) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) == 1 {
+		for _, r := range b.rules {
+			if r.match(q.Question[0]) {
+				qCtx.SetResponse(r.reply(q))
+				return nil
+			}
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (b *qtypeBlock) Close() error {
+	for _, c := range b.closer {
+		_ = c.Close()
+	}
+	return nil
+}
+
+func (r *rule) match(question dns.Question) bool {
+	if _, ok := r.qtypes[question.Qtype]; !ok {
+		return false
+	}
+	if r.publicPTR && !isPublicPTR(question.Name) {
+		return false
+	}
+	if r.domains != nil {
+		if _, ok := r.domains.Match(question.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) reply(q *dns.Msg) *dns.Msg {
+	resp := dnsutils.GenEmptyReply(q, r.rcode)
+	if r.ede != nil {
+		if qOpt := q.IsEdns0(); qOpt != nil {
+			opt := dnsutils.UpgradeEDNS0(resp)
+			opt.SetUDPSize(qOpt.UDPSize())
+			opt.Option = append(opt.Option, r.ede)
+		}
+	}
+	return resp
+}
+
+// isPublicPTR reports whether name is a reverse name of a global unicast
+// address that is not private.
+func isPublicPTR(name string) bool {
+	p, err := utils.ParsePTRPrefix(name)
+	if err != nil {
+		return false
+	}
+	addr := p.Addr()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qtype_block
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func Test_qtypeBlock(t *testing.T) {
+	b, err := newQtypeBlock(coremain.NewBP("test", PluginType, nil, new(coremain.Mosdns)), &Args{
+		Rules: []RuleConfig{
+			{Qtype: []string{"ANY"}, Action: "refuse", Rcode: "NOTIMP", EDE: &EDEConfig{Code: dns.ExtendedErrorCodeNotSupported, Text: "ANY is not supported"}},
+			{Qtype: []string{"TYPE65"}, Domain: []string{"domain:blocked.com"}},
+			{Qtype: []string{"PTR"}, Action: "refuse", PublicPTR: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		name    string
+		qName   string
+		qtype   uint16
+		edns0   bool
+		blocked bool
+		rcode   int
+		ede     bool
+	}{
+		{"any", "example.com.", dns.TypeANY, false, true, dns.RcodeNotImplemented, false},
+		{"any with edns0", "example.com.", dns.TypeANY, true, true, dns.RcodeNotImplemented, true},
+		{"https of blocked domain", "www.blocked.com.", dns.TypeHTTPS, true, true, dns.RcodeSuccess, false},
+		{"https of other domains", "example.com.", dns.TypeHTTPS, false, false, 0, false},
+		{"public ptr", "8.8.8.8.in-addr.arpa.", dns.TypePTR, false, true, dns.RcodeRefused, false},
+		{"private ptr", "1.1.168.192.in-addr.arpa.", dns.TypePTR, false, false, 0, false},
+		{"a", "example.com.", dns.TypeA, false, false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, tt.qtype)
+			if tt.edns0 {
+				q.SetEdns0(1232, false)
+			}
+			qCtx := query_context.NewContext(q, nil)
+			if err := b.Exec(context.Background(), qCtx, nil); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if (r != nil) != tt.blocked {
+				t.Fatalf("blocked = %v, want %v", r != nil, tt.blocked)
+			}
+			if r == nil {
+				return
+			}
+			if r.Rcode != tt.rcode || len(r.Answer) != 0 {
+				t.Fatalf("unexpected response %s", r)
+			}
+			var ede *dns.EDNS0_EDE
+			if opt := r.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if e, ok := o.(*dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+			if (ede != nil) != tt.ede || (ede != nil && ede.InfoCode != dns.ExtendedErrorCodeNotSupported) {
+				t.Fatalf("unexpected ede %v", ede)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qtype_router
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "qtype_router"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*qtypeRouter)(nil)
+
+type Args struct {
+	Routes []RouteConfig `yaml:"routes"`
+	// Default is executed if no route matches the query. Optional.
+	Default interface{} `yaml:"default"`
+}
+
+type RouteConfig struct {
+	// Qtype can be type names (e.g. "AAAA", "HTTPS", "TYPE65") or numbers.
+	Qtype []string `yaml:"qtype"`
+	// Exec is executed for matched queries. Same as sequence exec.
+	Exec interface{} `yaml:"exec"`
+	// Rcode replies matched queries with an empty response of this
+	// rcode (e.g. "NOERROR", "REFUSED") instead of executing Exec.
+	Rcode string `yaml:"rcode"`
+}
+
+type route struct {
+	exec  executable_seq.ExecutableChainNode
+	rcode int // -1 means no rcode
+}
+
+type qtypeRouter struct {
+	*coremain.BP
+	routes     map[uint16]*route
+	defaultExe executable_seq.ExecutableChainNode
+}
+
+func Init(bp *coremain.BP, args interface{}) (coremain.Plugin, error) {
+	return newQtypeRouter(bp, args.(*Args))
+}
+
+func newQtypeRouter(bp *coremain.BP, args *Args) (*qtypeRouter, error) {
+	r := &qtypeRouter{BP: bp, routes: make(map[uint16]*route)}
+	for i, rc := range args.Routes {
+		if len(rc.Qtype) == 0 {
+			return nil, fmt.Errorf("route #%d has no qtype", i)
+		}
+		rt := &route{rcode: -1}
+		switch {
+		case len(rc.Rcode) > 0:
+			rcode, err := dnsutils.ParseRcode(rc.Rcode)
+			if err != nil {
+				return nil, fmt.Errorf("route #%d, %w", i, err)
+			}
+			rt.rcode = rcode
+		case rc.Exec != nil:
+			exec, err := r.buildExec(rc.Exec)
+			if err != nil {
+				return nil, fmt.Errorf("route #%d, %w", i, err)
+			}
+			rt.exec = exec
+		default:
+			return nil, fmt.Errorf("route #%d has no exec or rcode", i)
+		}
+		for _, s := range rc.Qtype {
+			qtype, err := dnsutils.ParseQtype(s)
+			if err != nil {
+				return nil, fmt.Errorf("route #%d, %w", i, err)
+			}
+			if _, dup := r.routes[qtype]; dup {
+				return nil, fmt.Errorf("route #%d, duplicated qtype %s", i, s)
+			}
+			r.routes[qtype] = rt
+		}
+	}
+	if args.Default != nil {
+		exec, err := r.buildExec(args.Default)
+		if err != nil {
+			return nil, fmt.Errorf("default, %w", err)
+		}
+		r.defaultExe = exec
+	}
+	return r, nil
+}
+
+func (r *qtypeRouter) buildExec(in interface{}) (executable_seq.ExecutableChainNode, error) {
+	exec, err := executable_seq.BuildExecutableLogicTree(in, r.L(), r.M().GetExecutables(), r.M().GetMatchers())
+	if err != nil {
+		return nil, fmt.Errorf("cannot build exec: %w", err)
+	}
+	return exec, nil
+}
+
+// Exec executes the route of the query type, then next.
+func (r *qtypeRouter) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if err := r.exec(ctx, qCtx); err != nil {
+		return err
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+func (r *qtypeRouter) exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) == 1 {
+		if rt := r.routes[q.Question[0].Qtype]; rt != nil {
+			if rt.rcode >= 0 {
+				qCtx.SetResponse(dnsutils.GenEmptyReply(q, rt.rcode))
+				return nil
+			}
+			return executable_seq.ExecChainNode(ctx, qCtx, rt.exec)
+		}
+	}
+	if r.defaultExe != nil {
+		return executable_seq.ExecChainNode(ctx, qCtx, r.defaultExe)
+	}
+	return nil
+}
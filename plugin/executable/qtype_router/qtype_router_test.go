@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qtype_router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type markExec uint
+
+func (m markExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecutableChainNode) error {
+	qCtx.AddMark(uint(m))
+	return nil
+}
+
+func Test_qtypeRouter(t *testing.T) {
+	r, err := newQtypeRouter(coremain.NewBP("test", PluginType, nil, nil), &Args{
+		Routes: []RouteConfig{{Qtype: []string{"TYPE65"}, Rcode: "NOERROR"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.routes[dns.TypeAAAA] = &route{exec: executable_seq.WrapExecutable(markExec(1)), rcode: -1}
+	r.defaultExe = executable_seq.WrapExecutable(markExec(2))
+
+	run := func(qtype uint16) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		qCtx := query_context.NewContext(q, nil)
+		if err := r.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx
+	}
+
+	if qCtx := run(dns.TypeHTTPS); qCtx.R() == nil || qCtx.R().Rcode != dns.RcodeSuccess || len(qCtx.R().Answer) != 0 {
+		t.Fatal("HTTPS should be replied with an empty response")
+	}
+	if qCtx := run(dns.TypeAAAA); !qCtx.HasMark(1) || qCtx.HasMark(2) {
+		t.Fatal("AAAA should go to its route")
+	}
+	if qCtx := run(dns.TypeA); qCtx.HasMark(1) || !qCtx.HasMark(2) {
+		t.Fatal("A should go to default")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_summary
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/dns_event"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const defaultSearchLimit = 100
+
+type record struct {
+	*dns_event.Event
+	Elapsed int64  `json:"elapsed"` // ms
+	Err     string `json:"error,omitempty"`
+}
+
+func newRecord(qCtx *query_context.Context, elapsed time.Duration, err error) *record {
+	r := &record{
+		Event:   dns_event.FromContext(qCtx, ""),
+		Elapsed: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	return r
+}
+
+// history is a ring buffer of recent records.
+type history struct {
+	m    sync.Mutex
+	rs   []*record
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{rs: make([]*record, size)}
+}
+
+func (h *history) add(r *record) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.rs[h.next] = r
+	h.next++
+	if h.next == len(h.rs) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// search returns at most limit records that match f, newest first.
+func (h *history) search(f func(r *record) bool, limit int) []*record {
+	h.m.Lock()
+	defer h.m.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.rs)
+	}
+	res := make([]*record, 0)
+	for i := 0; i < n && len(res) < limit; i++ {
+		r := h.rs[(h.next-1-i+len(h.rs))%len(h.rs)]
+		if f(r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// ServeHTTP searches recent queries.
+// Query params (all optional): "q" (sub string of qname), "client"
+// (address or name), "rcode", "limit" (default 100).
+func (l *logger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if l.history == nil {
+		http.Error(w, "query history is disabled", http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	limit := defaultSearchLimit
+	if s := query.Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	qname := strings.ToLower(query.Get("q"))
+	client := query.Get("client")
+	rcode := strings.ToUpper(query.Get("rcode"))
+
+	rs := l.history.search(func(r *record) bool {
+		return strings.Contains(strings.ToLower(r.QName), qname) &&
+			(len(client) == 0 || r.Client == client || r.ClientName == client) &&
+			(len(rcode) == 0 || r.Rcode == rcode)
+	}, limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rs); err != nil {
+		l.L().Warn("failed to write query history", zap.Error(err))
+	}
+}
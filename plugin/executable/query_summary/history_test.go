@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_summary
+
+import (
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/dns_event"
+)
+
+func Test_history(t *testing.T) {
+	h := newHistory(3)
+	for _, name := range []string{"a.", "b.", "c.", "d."} {
+		h.add(&record{Event: &dns_event.Event{QName: name}})
+	}
+	all := func(*record) bool { return true }
+
+	rs := h.search(all, 10)
+	var got string
+	for _, r := range rs {
+		got += r.QName
+	}
+	if want := "d.c.b."; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if rs := h.search(all, 2); len(rs) != 2 {
+		t.Fatalf("limit: got %d records", len(rs))
+	}
+	if rs := h.search(func(r *record) bool { return r.QName == "c." }, 10); len(rs) != 1 {
+		t.Fatalf("filter: got %d records", len(rs))
+	}
+	if rs := newHistory(2).search(all, 10); len(rs) != 0 {
+		t.Fatalf("empty: got %d records", len(rs))
+	}
+}
@@ -35,7 +35,7 @@ const (
 )
 
 func init() {
-	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(*Args) })
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 	coremain.RegNewPersetPluginFunc("_query_summary", func(bp *coremain.BP) (coremain.Plugin, error) {
 		return newLogger(bp, &Args{}), nil
 	})
@@ -45,6 +45,9 @@ var _ coremain.ExecutablePlugin = (*logger)(nil)
 
 type Args struct {
 	Msg string `yaml:"msg"`
+	// History is the number of recent queries that are kept in memory
+	// and can be searched through the plugin api. Zero disables it.
+	History int `yaml:"history"`
 }
 
 func (a *Args) init() {
@@ -56,6 +59,7 @@ func (a *Args) init() {
 type logger struct {
 	args *Args
 	*coremain.BP
+	history *history // maybe nil
 }
 
 // Init is a handler.NewPluginFunc.
@@ -65,7 +69,11 @@ func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 
 func newLogger(bp *coremain.BP, args *Args) coremain.Plugin {
 	args.init()
-	return &logger{BP: bp, args: args}
+	l := &logger{BP: bp, args: args}
+	if args.History > 0 {
+		l.history = newHistory(args.History)
+	}
+	return l
 }
 
 func (l *logger) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
@@ -81,6 +89,15 @@ func (l *logger) Exec(ctx context.Context, qCtx *query_context.Context, next exe
 		respRcode = r.Rcode
 	}
 
+	elapsed := time.Since(qCtx.StartTime())
+	if l.history != nil {
+		l.history.add(newRecord(qCtx, elapsed, err))
+	}
+
+	clientName := zap.Skip()
+	if name := qCtx.ReqMeta().GetClientName(); len(name) > 0 {
+		clientName = zap.String("client_name", name)
+	}
 	l.BP.L().Info(
 		l.args.Msg,
 		zap.Uint32("uqid", qCtx.Id()),
@@ -88,8 +105,9 @@ func (l *logger) Exec(ctx context.Context, qCtx *query_context.Context, next exe
 		zap.Uint16("qtype", question.Qtype),
 		zap.Uint16("qclass", question.Qclass),
 		zap.Stringer("client", qCtx.ReqMeta().GetClientAddr()),
+		clientName,
 		zap.Int("resp_rcode", respRcode),
-		zap.Duration("elapsed", time.Now().Sub(qCtx.StartTime())),
+		zap.Duration("elapsed", elapsed),
 		zap.Error(err),
 	)
 	return err
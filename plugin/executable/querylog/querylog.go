@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package querylog
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	randv2 "math/rand/v2"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/dns_event"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+	"github.com/pmkol/mosdns-x/plugin/executable/cache"
+)
+
+const PluginType = "querylog"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*queryLog)(nil)
+
+type Args struct {
+	File string `yaml:"file"` // required
+
+	// MaxSize (MB) and RotateInterval (sec) rotate the file to
+	// "<file>.<time>". Default MaxSize is 100, negative disables.
+	// Default RotateInterval is 0 (disabled).
+	MaxSize        int `yaml:"max_size"`
+	RotateInterval int `yaml:"rotate_interval"`
+	// MaxBackups is the number of rotated files to keep. Default is 5.
+	// Negative keeps all of them.
+	MaxBackups int `yaml:"max_backups"`
+
+	// SampleRate is the fraction of queries that are logged, in (0, 1].
+	// Default is 1.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// ClientIP is how client ips are logged. "" logs them as is.
+	// "truncate" logs the /24 (ipv4) or /48 (ipv6) network. "hash" logs
+	// a keyed hash, so queries of a client can be correlated without
+	// revealing its ip. "omit" doesn't log them.
+	ClientIP string `yaml:"client_ip"`
+	// HashKey is the key of "hash". Default is a random key, which
+	// changes every start.
+	HashKey string `yaml:"hash_key"`
+
+	// QueueSize is the number of buffered lines. Lines are dropped if
+	// the file can't be written fast enough. Default is 4096.
+	QueueSize int `yaml:"queue_size"`
+}
+
+func (a *Args) init() error {
+	if len(a.File) == 0 {
+		return errors.New("missing file")
+	}
+	utils.SetDefaultNum(&a.MaxSize, 100)
+	utils.SetDefaultNum(&a.MaxBackups, 5)
+	utils.SetDefaultNum(&a.QueueSize, 4096)
+	if a.SampleRate == 0 {
+		a.SampleRate = 1
+	}
+	if a.SampleRate < 0 || a.SampleRate > 1 {
+		return fmt.Errorf("invalid sample rate %v", a.SampleRate)
+	}
+	switch a.ClientIP {
+	case "", "truncate", "hash", "omit":
+	default:
+		return fmt.Errorf("invalid client_ip %s", a.ClientIP)
+	}
+	return nil
+}
+
+type queryLog struct {
+	*coremain.BP
+	args    *Args
+	hashKey []byte
+
+	queue  chan []byte
+	closed chan struct{}
+	done   chan struct{}
+
+	dropped atomic.Uint64
+}
+
+// entry is a line of the log.
+type entry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	// ClientName is only logged if client ips are logged as is.
+	ClientName string   `json:"client_name,omitempty"`
+	QName      string   `json:"qname"`
+	QType      string   `json:"qtype"`
+	Rcode      string   `json:"rcode,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+	Upstream   string   `json:"upstream,omitempty"`
+	Duration   float64  `json:"duration_ms"`
+	CacheHit   bool     `json:"cache_hit,omitempty"`
+	Err        string   `json:"error,omitempty"`
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newQueryLog(bp, args.(*Args))
+}
+
+func newQueryLog(bp *coremain.BP, args *Args) (*queryLog, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	w, err := newRotateWriter(args.File, int64(args.MaxSize)<<20, time.Duration(args.RotateInterval)*time.Second, args.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file, %w", err)
+	}
+	l := &queryLog{
+		BP:     bp,
+		args:   args,
+		queue:  make(chan []byte, args.QueueSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if args.ClientIP == "hash" {
+		l.hashKey = []byte(args.HashKey)
+		if len(l.hashKey) == 0 {
+			l.hashKey = make([]byte, 32)
+			rand.Read(l.hashKey)
+		}
+	}
+	bp.GetMetricsReg().MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "dropped_total",
+		Help: "The total number of log lines dropped by a full queue",
+	}, func() float64 { return float64(l.dropped.Load()) }))
+	go l.run(w)
+	return l, nil
+}
+
+// run writes queued lines to w until l is closed.
+func (l *queryLog) run(w *rotateWriter) {
+	defer close(l.done)
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+	write := func(b []byte) {
+		if _, err := bw.Write(b); err != nil {
+			l.L().Warn("failed to write query log", zap.Error(err))
+		}
+	}
+	for {
+		select {
+		case b := <-l.queue:
+			write(b)
+			// Flush once the queue is drained, so lines are batched
+			// under load.
+			if len(l.queue) == 0 {
+				if err := bw.Flush(); err != nil {
+					l.L().Warn("failed to write query log", zap.Error(err))
+				}
+			}
+		case <-l.closed:
+			for len(l.queue) > 0 {
+				write(<-l.queue)
+			}
+			if err := bw.Flush(); err != nil {
+				l.L().Warn("failed to write query log", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// Exec executes next, then logs the query.
+func (l *queryLog) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+	if l.args.SampleRate < 1 && randv2.Float64() >= l.args.SampleRate {
+		return err
+	}
+	e := l.newEntry(qCtx, err)
+	b, merr := json.Marshal(e)
+	if merr != nil {
+		l.L().Warn("failed to marshal query log", zap.Error(merr))
+		return err
+	}
+	select {
+	case l.queue <- append(b, '\n'):
+	default:
+		l.dropped.Add(1)
+	}
+	return err
+}
+
+func (l *queryLog) newEntry(qCtx *query_context.Context, err error) *entry {
+	ev := dns_event.FromContext(qCtx, "")
+	e := &entry{
+		Time:     qCtx.StartTime(),
+		Client:   l.formatClient(qCtx.ReqMeta().GetClientAddr()),
+		QName:    ev.QName,
+		QType:    ev.QType,
+		Rcode:    ev.Rcode,
+		IPs:      ev.IPs,
+		Duration: float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+	}
+	if len(l.args.ClientIP) == 0 {
+		e.ClientName = ev.ClientName
+	}
+	e.Upstream, _ = query_context.GetValue(qCtx, bundled_upstream.KeyUpstream)
+	e.CacheHit, _ = query_context.GetValue(qCtx, cache.KeyHit)
+	if err != nil {
+		e.Err = err.Error()
+	}
+	return e
+}
+
+// formatClient formats addr by the client_ip option.
+func (l *queryLog) formatClient(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+	switch l.args.ClientIP {
+	case "truncate":
+		bits := 24
+		if addr.Is6() {
+			bits = 48
+		}
+		p, _ := addr.Prefix(bits)
+		return p.String()
+	case "hash":
+		h := hmac.New(sha256.New, l.hashKey)
+		h.Write(addr.AsSlice())
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	case "omit":
+		return ""
+	}
+	return addr.String()
+}
+
+// Close flushes queued lines and closes the file.
+func (l *queryLog) Close() error {
+	close(l.closed)
+	<-l.done
+	return nil
+}
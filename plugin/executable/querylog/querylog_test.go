@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package querylog
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func Test_queryLog_formatClient(t *testing.T) {
+	tests := []struct {
+		mode string
+		addr string
+		want string
+	}{
+		{"", "192.168.1.2", "192.168.1.2"},
+		{"", "::ffff:192.168.1.2", "192.168.1.2"},
+		{"truncate", "192.168.1.2", "192.168.1.0/24"},
+		{"truncate", "2001:db8:1:2::1", "2001:db8:1::/48"},
+		{"omit", "192.168.1.2", ""},
+	}
+	for _, tt := range tests {
+		l := &queryLog{args: &Args{ClientIP: tt.mode}}
+		if got := l.formatClient(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.mode, tt.addr, got, tt.want)
+		}
+	}
+
+	l := &queryLog{args: &Args{ClientIP: "hash"}, hashKey: []byte("key")}
+	a := l.formatClient(netip.MustParseAddr("192.168.1.2"))
+	if len(a) != 16 || a == "192.168.1.2" {
+		t.Fatalf("unexpected hash %s", a)
+	}
+	if b := l.formatClient(netip.MustParseAddr("192.168.1.2")); a != b {
+		t.Fatal("hash should be stable")
+	}
+	if b := l.formatClient(netip.MustParseAddr("192.168.1.3")); a == b {
+		t.Fatal("hashes of different ips should differ")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package querylog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// rotateWriter writes to a file and renames it to "<path>.<time>" when
+// it grows over maxSize or is older than interval. It is not safe for
+// concurrent use.
+type rotateWriter struct {
+	path       string
+	maxSize    int64         // <= 0 means no limit
+	interval   time.Duration // <= 0 means no limit
+	maxBackups int           // <= 0 keeps all backups
+
+	f        *os.File // nil if the file failed to reopen
+	size     int64
+	openedAt time.Time
+}
+
+func newRotateWriter(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotateWriter, error) {
+	w := &rotateWriter{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+func (w *rotateWriter) Write(b []byte) (int, error) {
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return 0, fmt.Errorf("failed to reopen log file, %w", err)
+		}
+	}
+	if w.needRotate(len(b)) {
+		if err := w.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate log file, %w", err)
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) needRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	return (w.maxSize > 0 && w.size+int64(n) > w.maxSize) ||
+		(w.interval > 0 && time.Since(w.openedAt) >= w.interval)
+}
+
+// rotate always reopens the file, even if it fails to be renamed. So
+// a failed rotation won't stop later writes. If the file can't be
+// reopened, w.f is nil and Write tries again.
+func (w *rotateWriter) rotate() error {
+	err := w.f.Close()
+	w.f = nil
+	if err == nil {
+		backup := w.path + "." + time.Now().Format(backupTimeFormat)
+		err = os.Rename(w.path, backup)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return w.removeOldBackups()
+}
+
+func (w *rotateWriter) removeOldBackups() error {
+	if w.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return err
+	}
+	backups = slices.DeleteFunc(backups, func(s string) bool {
+		_, err := time.Parse(backupTimeFormat, strings.TrimPrefix(s, w.path+"."))
+		return err != nil
+	})
+	if len(backups) <= w.maxBackups {
+		return nil
+	}
+	slices.Sort(backups) // oldest first
+	for _, s := range backups[:len(backups)-w.maxBackups] {
+		if err := os.Remove(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *rotateWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_rotateWriter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "query.log")
+	w, err := newRotateWriter(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 2) // unique backup names
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups, want 2", len(backups))
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" {
+		t.Fatalf("unexpected content %q", b)
+	}
+
+	// An empty file is never rotated.
+	w2, err := newRotateWriter(filepath.Join(dir, "other.log"), 0, time.Nanosecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if w2.needRotate(1) {
+		t.Fatal("empty file should not be rotated")
+	}
+	w2.Write([]byte("x"))
+	if !w2.needRotate(1) {
+		t.Fatal("old file should be rotated")
+	}
+}
+
+func Test_rotateWriter_renameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	w, err := newRotateWriter(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file can't be renamed if it was removed.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("a")); err == nil {
+		t.Fatal("rotation should fail")
+	}
+	if _, err := w.Write([]byte("b")); err != nil {
+		t.Fatalf("write after a failed rotation, %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "b" {
+		t.Fatalf("unexpected content %q", b)
+	}
+}
@@ -132,3 +132,8 @@ func (r *redirectPlugin) Close() error {
 	_ = r.m.Close()
 	return nil
 }
+
+// MemoryUsage implements coremain.MemoryReporter.
+func (r *redirectPlugin) MemoryUsage() int64 {
+	return r.m.MemoryUsage()
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package response_limit
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "response_limit"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+// Args limits responses for clients that can't handle large RRsets.
+// Records are always dropped from the end, so the result only depends
+// on the order of the response.
+type Args struct {
+	// MaxAnswers limits the number of answer records of the query type.
+	// Other records, e.g. CNAMEs, are kept. Zero means no limit.
+	MaxAnswers int `yaml:"max_answers"`
+
+	// MaxSize (bytes) limits the size of the response. The additional
+	// and authority sections are dropped first, then answers of the
+	// query type. The first answer is always kept. Zero means no limit.
+	MaxSize int `yaml:"max_size"`
+
+	// MaxCNAMEChain limits the number of CNAMEs followed from the query
+	// name. Responses with longer chains or CNAME loops are replaced by
+	// SERVFAIL with an extended dns error (Invalid Data) if the query has
+	// EDNS0. Zero means no limit.
+	MaxCNAMEChain int `yaml:"max_cname_chain"`
+}
+
+var _ coremain.ExecutablePlugin = (*responseLimit)(nil)
+
+type responseLimit struct {
+	*coremain.BP
+	args *Args
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return &responseLimit{BP: bp, args: args.(*Args)}, nil
+}
+
+func (l *responseLimit) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	if r := qCtx.R(); r != nil && len(qCtx.Q().Question) == 1 {
+		qtype := qCtx.Q().Question[0].Qtype
+		if l.args.MaxCNAMEChain > 0 {
+			if reason := checkCNAMEChain(r, qCtx.Q().Question[0].Name, l.args.MaxCNAMEChain); len(reason) > 0 {
+				qCtx.SetResponse(servfail(qCtx.Q(), reason))
+				return executable_seq.ExecChainNode(ctx, qCtx, next)
+			}
+		}
+		if l.args.MaxAnswers > 0 {
+			limitAnswers(r, qtype, l.args.MaxAnswers)
+		}
+		if l.args.MaxSize > 0 {
+			limitSize(r, qtype, l.args.MaxSize)
+		}
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, next)
+}
+
+// limitAnswers keeps the first n answers of qtype.
+func limitAnswers(r *dns.Msg, qtype uint16, n int) {
+	kept := r.Answer[:0]
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == qtype {
+			if n == 0 {
+				continue
+			}
+			n--
+		}
+		kept = append(kept, rr)
+	}
+	r.Answer = kept
+}
+
+// limitSize drops records from r until it's not larger than size.
+func limitSize(r *dns.Msg, qtype uint16, size int) {
+	if r.Len() <= size {
+		return
+	}
+
+	// Keep the OPT record, it's not data.
+	var extra []dns.RR
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	r.Extra = extra
+	if r.Len() <= size {
+		return
+	}
+	r.Ns = nil
+
+	n := 0
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == qtype {
+			n++
+		}
+	}
+	for r.Len() > size && n > 1 {
+		n--
+		limitAnswers(r, qtype, n)
+	}
+}
+
+// checkCNAMEChain follows CNAMEs in r from name. It returns the reason
+// if the chain is longer than n or has a loop, or "" if it's fine.
+func checkCNAMEChain(r *dns.Msg, name string, n int) string {
+	targets := make(map[string]string)
+	for _, rr := range r.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[dns.CanonicalName(cname.Hdr.Name)] = dns.CanonicalName(cname.Target)
+		}
+	}
+	if len(targets) == 0 {
+		return ""
+	}
+
+	name = dns.CanonicalName(name)
+	seen := map[string]struct{}{name: {}}
+	for depth := 0; ; depth++ {
+		target, ok := targets[name]
+		if !ok {
+			return ""
+		}
+		if _, loop := seen[target]; loop {
+			return "CNAME loop"
+		}
+		if depth == n {
+			return "CNAME chain too long"
+		}
+		seen[target] = struct{}{}
+		name = target
+	}
+}
+
+// servfail returns a SERVFAIL response of q with an extended dns error.
+func servfail(q *dns.Msg, reason string) *dns.Msg {
+	r := dnsutils.GenEmptyReply(q, dns.RcodeServerFailure)
+	if qOpt := q.IsEdns0(); qOpt != nil {
+		opt := dnsutils.UpgradeEDNS0(r)
+		opt.SetUDPSize(qOpt.UDPSize())
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData, ExtraText: reason})
+	}
+	return r
+}
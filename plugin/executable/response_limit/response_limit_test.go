@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package response_limit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newResponse(n int) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: "cdn.example.net.",
+	})
+	for i := 0; i < n; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("cdn.example.net. 300 IN A 192.0.2.%d", i+1))
+		r.Answer = append(r.Answer, rr)
+	}
+	r.Ns = append(r.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+		Ns:  "ns.example.net.",
+	})
+	r.Extra = append(r.Extra, &dns.A{
+		Hdr: dns.RR_Header{Name: "ns.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{192, 0, 2, 255},
+	})
+	r.SetEdns0(1232, false)
+	return r
+}
+
+func countA(r *dns.Msg) int {
+	n := 0
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeA {
+			n++
+		}
+	}
+	return n
+}
+
+func Test_limitAnswers(t *testing.T) {
+	r := newResponse(10)
+	limitAnswers(r, dns.TypeA, 3)
+	if len(r.Answer) != 4 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("want the cname and 3 A records, got %v", r.Answer)
+	}
+	if a := r.Answer[3].(*dns.A).A.String(); a != "192.0.2.3" {
+		t.Fatalf("want the first records, got last %s", a)
+	}
+}
+
+func Test_limitSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantA     int
+		wantNs    int
+		wantExtra int // including OPT
+	}{
+		{"no limit", 1000, 20, 1, 2},
+		{"drop additional", newResponse(20).Len() - 1, 20, 1, 1},
+		{"drop answers", 200, 0, 0, 1},
+		{"keep one answer", 10, 1, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResponse(20)
+			limitSize(r, dns.TypeA, tt.size)
+			if tt.wantA > 0 && countA(r) != tt.wantA {
+				t.Fatalf("want %d A records, got %d", tt.wantA, countA(r))
+			}
+			if tt.wantA == 0 && (r.Len() > tt.size || countA(r) == 0) {
+				t.Fatalf("response size %d > %d", r.Len(), tt.size)
+			}
+			if len(r.Ns) != tt.wantNs || len(r.Extra) != tt.wantExtra {
+				t.Fatalf("want %d ns and %d extra, got %d and %d", tt.wantNs, tt.wantExtra, len(r.Ns), len(r.Extra))
+			}
+			if r.IsEdns0() == nil {
+				t.Fatal("OPT is dropped")
+			}
+		})
+	}
+}
+
+func Test_checkCNAMEChain(t *testing.T) {
+	newChain := func(links ...string) *dns.Msg {
+		r := new(dns.Msg)
+		for i := 0; i+1 < len(links); i++ {
+			r.Answer = append(r.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: links[i], Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+				Target: links[i+1],
+			})
+		}
+		return r
+	}
+	tests := []struct {
+		name  string
+		r     *dns.Msg
+		qName string
+		n     int
+		want  string
+	}{
+		{"no cname", new(dns.Msg), "example.com.", 1, ""},
+		{"one cname", newResponse(1), "example.com.", 1, ""},
+		{"within limit", newChain("a.", "b.", "c."), "a.", 2, ""},
+		{"too long", newChain("a.", "b.", "c.", "d."), "a.", 2, "CNAME chain too long"},
+		{"loop", newChain("a.", "b.", "A."), "a.", 8, "CNAME loop"},
+		{"self loop", newChain("a.", "a."), "a.", 8, "CNAME loop"},
+		{"other owner", newChain("x.", "y.", "z."), "a.", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkCNAMEChain(tt.r, tt.qName, tt.n); got != tt.want {
+				t.Fatalf("checkCNAMEChain() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_servfail(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	r := servfail(q, "CNAME loop")
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+	}
+	ede, ok := r.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeInvalidData {
+		t.Fatalf("want an Invalid Data ede, got %v", r.IsEdns0().Option)
+	}
+}
@@ -209,3 +209,18 @@ func as16(n netip.Addr) netip.Addr {
 	}
 	return netip.AddrFrom16(n.As16())
 }
+
+// MemoryUsage implements coremain.MemoryReporter.
+func (p *reverseLookup) MemoryUsage() int64 {
+	if mr, ok := p.c.(coremain.MemoryReporter); ok {
+		return mr.MemoryUsage()
+	}
+	return 0
+}
+
+// ShrinkMemory implements coremain.MemoryShrinker.
+func (p *reverseLookup) ShrinkMemory() {
+	if s, ok := p.c.(interface{ Shrink(keep float64) }); ok {
+		s.Shrink(0.5)
+	}
+}
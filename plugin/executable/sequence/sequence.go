@@ -21,9 +21,13 @@ package sequence
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
@@ -40,11 +44,19 @@ func init() {
 type sequence struct {
 	*coremain.BP
 
-	ecs executable_seq.ExecutableChainNode
+	ecs     executable_seq.ExecutableChainNode
+	limiter *concurrent_limiter.ConcurrencyLimiter // maybe nil
 }
 
 type Args struct {
 	Exec interface{} `yaml:"exec"`
+
+	// MaxConcurrent limits concurrent queries in Exec, so a slow branch
+	// can't hold all queries. Queries over the limit wait in a queue of
+	// MaxQueue queries. If the queue is full, the query fails. Default
+	// is no limit.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	MaxQueue      int `yaml:"max_queue"`
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -57,20 +69,54 @@ func newSequencePlugin(bp *coremain.BP, args *Args) (*sequence, error) {
 		return nil, fmt.Errorf("cannot build sequence: %w", err)
 	}
 
-	return &sequence{
+	s := &sequence{
 		BP:  bp,
 		ecs: ecs,
-	}, nil
+	}
+	if args.MaxConcurrent < 0 || args.MaxQueue < 0 {
+		return nil, errors.New("negative max_concurrent or max_queue")
+	}
+	if args.MaxConcurrent > 0 {
+		l := concurrent_limiter.NewConcurrencyLimiter(args.MaxConcurrent, args.MaxQueue)
+		s.limiter = l
+		bp.GetMetricsReg().MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "running",
+				Help: "Queries running in the sequence",
+			}, func() float64 { return float64(l.Running()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "queued",
+				Help: "Queries waiting for the concurrency limit",
+			}, func() float64 { return float64(l.Queued()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "rejected_total",
+				Help: "Queries rejected by the full queue",
+			}, func() float64 { return float64(l.Rejected()) }),
+		)
+	}
+	return s, nil
 }
 
 func (s *sequence) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
-	if err := executable_seq.ExecChainNode(ctx, qCtx, s.ecs); err != nil {
+	if err := s.execLimited(ctx, qCtx); err != nil {
 		return err
 	}
 
 	return executable_seq.ExecChainNode(ctx, qCtx, next)
 }
 
+// execLimited runs s.ecs. The limiter is released before the next node,
+// which is not a part of s.
+func (s *sequence) execLimited(ctx context.Context, qCtx *query_context.Context) error {
+	if s.limiter != nil {
+		if err := s.limiter.Acquire(ctx); err != nil {
+			return fmt.Errorf("sequence %s is busy, %w", s.Tag(), err)
+		}
+		defer s.limiter.Release()
+	}
+	return executable_seq.ExecChainNode(ctx, qCtx, s.ecs)
+}
+
 var _ coremain.ExecutablePlugin = (*_return)(nil)
 
 type _return struct {
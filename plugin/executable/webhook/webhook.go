@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dns_event"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "webhook"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*webhook)(nil)
+
+type Args struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"` // Default is "POST".
+	Headers map[string]string `yaml:"headers"`
+	// Template is a go text/template of the payload. See dns_event.NewTemplate.
+	// Default is a json object of the event.
+	Template string `yaml:"template"`
+	// Rule is a user defined label that will be sent as "rule".
+	Rule string `yaml:"rule"`
+
+	// BatchSize > 1 sends events as a json array of payloads.
+	BatchSize     int `yaml:"batch_size"`     // Default is 1.
+	BatchInterval int `yaml:"batch_interval"` // (ms) Default is 1000.
+	Retry         int `yaml:"retry"`          // Default is 3. Negative disables retries.
+	Timeout       int `yaml:"timeout"`        // (sec) Default is 5.
+	QueueSize     int `yaml:"queue_size"`     // Default is 1024.
+}
+
+func (a *Args) init() {
+	if len(a.Method) == 0 {
+		a.Method = http.MethodPost
+	}
+	utils.SetDefaultNum(&a.BatchSize, 1)
+	utils.SetDefaultNum(&a.BatchInterval, 1000)
+	utils.SetDefaultNum(&a.Retry, 3)
+	utils.SetDefaultNum(&a.Timeout, 5)
+	utils.SetDefaultNum(&a.QueueSize, 1024)
+}
+
+type webhook struct {
+	*coremain.BP
+	args   *Args
+	tmpl   *dns_event.Template
+	hc     *http.Client
+	queue  chan []byte
+	cancel context.CancelFunc
+}
+
+func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
+	return newWebhook(bp, args.(*Args))
+}
+
+func newWebhook(bp *coremain.BP, args *Args) (*webhook, error) {
+	args.init()
+	if len(args.URL) == 0 {
+		return nil, errors.New("missing url")
+	}
+	tmpl, err := dns_event.NewTemplate(args.Template)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		BP:     bp,
+		args:   args,
+		tmpl:   tmpl,
+		hc:     &http.Client{Timeout: time.Duration(args.Timeout) * time.Second},
+		queue:  make(chan []byte, args.QueueSize),
+		cancel: cancel,
+	}
+	go w.sendLoop(ctx)
+	return w, nil
+}
+
+// Exec executes next first, then queues an event of the query and
+// its response. It never blocks the query.
+func (w *webhook) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecutableChainNode) error {
+	err := executable_seq.ExecChainNode(ctx, qCtx, next)
+
+	b, rErr := w.tmpl.Render(dns_event.FromContext(qCtx, w.args.Rule))
+	if rErr != nil {
+		w.L().Warn("failed to render payload", qCtx.InfoField(), zap.Error(rErr))
+		return err
+	}
+	select {
+	case w.queue <- b:
+	default:
+		w.L().Warn("webhook queue is full, event dropped", qCtx.InfoField())
+	}
+	return err
+}
+
+func (w *webhook) sendLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(w.args.BatchInterval) * time.Millisecond)
+	defer ticker.Stop()
+	var batch [][]byte
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		var body []byte
+		if w.args.BatchSize > 1 {
+			body = append([]byte{'['}, bytes.Join(batch, []byte{','})...)
+			body = append(body, ']')
+		} else {
+			body = batch[0]
+		}
+		if err := w.sendWithRetry(ctx, body); err != nil && ctx.Err() == nil {
+			w.L().Warn("failed to send webhook", zap.Int("events", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case b := <-w.queue:
+			batch = append(batch, b)
+			if len(batch) >= w.args.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *webhook) sendWithRetry(ctx context.Context, body []byte) error {
+	var err error
+	backoff := time.Second
+	for i := 0; i <= max(w.args.Retry, 0); i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = w.send(ctx, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *webhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, w.args.Method, w.args.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.args.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *webhook) Close() error {
+	w.cancel()
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pmkol/mosdns-x/coremain"
+)
+
+func Test_webhook_sendWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		retry     int
+		wantCalls int32
+	}{
+		{"no retry", -1, 1},
+		{"one retry", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer s.Close()
+
+			w, err := newWebhook(coremain.NewBP("webhook", PluginType, nil, nil), &Args{URL: s.URL, Retry: tt.retry})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			if err := w.sendWithRetry(context.Background(), []byte("{}")); err == nil {
+				t.Fatal("sendWithRetry should fail")
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("want %d calls, got %d", tt.wantCalls, got)
+			}
+		})
+	}
+}
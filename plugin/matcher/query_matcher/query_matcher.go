@@ -59,6 +59,12 @@ func init() {
 			return &queryIsEDNS0{BP: bp}, nil
 		},
 	)
+	coremain.RegNewPersetPluginFunc(
+		"_query_encrypted",
+		func(bp *coremain.BP) (coremain.Plugin, error) {
+			return &queryIsEncrypted{BP: bp}, nil
+		},
+	)
 }
 
 var _ coremain.MatcherPlugin = (*queryMatcher)(nil)
@@ -69,6 +75,29 @@ type Args struct {
 	Domain   []string `yaml:"domain"`
 	QType    []int    `yaml:"qtype"`
 	QClass   []int    `yaml:"qclass"`
+
+	// ClientCert matches identities (subject CN and SANs) of the client
+	// certificate. See server listener's client_ca.
+	ClientCert []string `yaml:"client_cert"`
+	// ClientID matches the client (device) id in the edns0 option 65074,
+	// which is added by dnsmasq --add-cpe-id or the client_id plugin.
+	// Patterns support wildcards.
+	ClientID []string `yaml:"client_id"`
+
+	// Attributes of DoH requests. Patterns support wildcards. HTTPHeader
+	// is a list of "Key: pattern", e.g. "X-Device: kids-*". Patterns of
+	// the same key are or'ed.
+	HTTPPath   []string `yaml:"http_path"`
+	UserAgent  []string `yaml:"user_agent"`
+	HTTPHeader []string `yaml:"http_header"`
+	SNI        []string `yaml:"sni"`
+
+	// Attributes of the connection. Patterns support wildcards.
+	// Listener matches tags of server listeners. Transport is one of "udp",
+	// "tcp", "dot", "doh", "http", "doq" and "doh3".
+	Listener  []string `yaml:"listener"`
+	Transport []string `yaml:"transport"`
+	ALPN      []string `yaml:"alpn"`
 	// TODO: Add PTR matcher.
 }
 
@@ -84,6 +113,17 @@ func (m *queryMatcher) Match(ctx context.Context, qCtx *query_context.Context) (
 	return executable_seq.LogicalAndMatcherGroup(ctx, qCtx, m.matcherGroup)
 }
 
+// MemoryUsage implements coremain.MemoryReporter.
+func (m *queryMatcher) MemoryUsage() int64 {
+	var n int64
+	for _, closer := range m.closer {
+		if mr, ok := closer.(coremain.MemoryReporter); ok {
+			n += mr.MemoryUsage()
+		}
+	}
+	return n
+}
+
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 	return newQueryMatcher(bp, args.(*Args))
 }
@@ -97,7 +137,7 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientIPMatcher(l))
+		m.addMatcher("client_ip", msg_matcher.NewClientIPMatcher(l))
 		m.closer = append(m.closer, l)
 		bp.L().Info("client ip matcher loaded", zap.Int("length", l.Len()))
 	}
@@ -106,7 +146,7 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientECSMatcher(l))
+		m.addMatcher("ecs", msg_matcher.NewClientECSMatcher(l))
 		m.closer = append(m.closer, l)
 		bp.L().Info("ecs ip matcher loaded", zap.Int("length", l.Len()))
 	}
@@ -118,17 +158,83 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQNameMatcher(mg))
+		m.addMatcher("domain", msg_matcher.NewQNameMatcher(mg))
 		m.closer = append(m.closer, mg)
 		bp.L().Info("domain matcher loaded", zap.Int("length", mg.Len()))
 	}
 	if len(args.QType) > 0 {
 		elemMatcher := elem.NewIntMatcher(args.QType)
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQTypeMatcher(elemMatcher))
+		m.addMatcher("qtype", msg_matcher.NewQTypeMatcher(elemMatcher))
 	}
 	if len(args.QClass) > 0 {
 		elemMatcher := elem.NewIntMatcher(args.QClass)
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewQClassMatcher(elemMatcher))
+		m.addMatcher("qclass", msg_matcher.NewQClassMatcher(elemMatcher))
+	}
+	if len(args.ClientCert) > 0 {
+		cm, err := msg_matcher.NewClientCertMatcher(args.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher("client_cert", cm)
+	}
+	if len(args.ClientID) > 0 {
+		im, err := msg_matcher.NewClientIDMatcher(args.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher("client_id", im)
+	}
+	if len(args.HTTPPath) > 0 {
+		hm, err := msg_matcher.NewHTTPPathMatcher(args.HTTPPath)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher("http_path", hm)
+	}
+	if len(args.UserAgent) > 0 {
+		hm, err := msg_matcher.NewUserAgentMatcher(args.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher("user_agent", hm)
+	}
+	if len(args.HTTPHeader) > 0 {
+		headers, err := msg_matcher.ParseHTTPHeaderPatterns(args.HTTPHeader)
+		if err != nil {
+			return nil, err
+		}
+		for k, patterns := range headers {
+			hm, err := msg_matcher.NewHTTPHeaderMatcher(k, patterns)
+			if err != nil {
+				return nil, err
+			}
+			m.addMatcher("http_header "+k, hm)
+		}
+	}
+	if len(args.SNI) > 0 {
+		hm, err := msg_matcher.NewSNIMatcher(args.SNI)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher("sni", hm)
+	}
+	for _, c := range []struct {
+		name     string
+		patterns []string
+		f        func([]string) (*msg_matcher.ConnMatcher, error)
+	}{
+		{"listener", args.Listener, msg_matcher.NewListenerMatcher},
+		{"transport", args.Transport, msg_matcher.NewTransportMatcher},
+		{"alpn", args.ALPN, msg_matcher.NewALPNMatcher},
+	} {
+		if len(c.patterns) == 0 {
+			continue
+		}
+		cm, err := c.f(c.patterns)
+		if err != nil {
+			return nil, err
+		}
+		m.addMatcher(c.name, cm)
 	}
 
 	return m, nil
@@ -143,3 +249,14 @@ type queryIsEDNS0 struct {
 func (q *queryIsEDNS0) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
 	return qCtx.Q().IsEdns0() != nil, nil
 }
+
+type queryIsEncrypted struct {
+	*coremain.BP
+	msg_matcher.EncryptedMatcher
+}
+
+// addMatcher appends mt to the matcher group. Its result is traced
+// with name.
+func (m *queryMatcher) addMatcher(name string, mt executable_seq.Matcher) {
+	m.matcherGroup = append(m.matcherGroup, &executable_seq.TracedMatcher{Name: m.Tag() + " " + name, Matcher: mt})
+}
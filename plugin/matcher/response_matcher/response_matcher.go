@@ -72,6 +72,17 @@ func (m *responseMatcher) Close() error {
 	return nil
 }
 
+// MemoryUsage implements coremain.MemoryReporter.
+func (m *responseMatcher) MemoryUsage() int64 {
+	var n int64
+	for _, closer := range m.closer {
+		if mr, ok := closer.(coremain.MemoryReporter); ok {
+			n += mr.MemoryUsage()
+		}
+	}
+	return n
+}
+
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
 	return newResponseMatcher(bp, args.(*Args))
 }
@@ -82,7 +93,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 	m.args = args
 
 	if len(args.RCode) > 0 {
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewRCodeMatcher(elem.NewIntMatcher(args.RCode)))
+		m.addMatcher("rcode", msg_matcher.NewRCodeMatcher(elem.NewIntMatcher(args.RCode)))
 	}
 
 	if len(args.CNAME) > 0 {
@@ -93,7 +104,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewCNameMatcher(mg))
+		m.addMatcher("cname", msg_matcher.NewCNameMatcher(mg))
 		m.closer = append(m.closer, mg)
 		bp.L().Info("cname matcher loaded", zap.Int("length", mg.Len()))
 	}
@@ -103,7 +114,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 		if err != nil {
 			return nil, err
 		}
-		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewAAAAAIPMatcher(l))
+		m.addMatcher("ip", msg_matcher.NewAAAAAIPMatcher(l))
 		m.closer = append(m.closer, l)
 		bp.L().Info("ip matcher loaded", zap.Int("length", l.Len()))
 	}
@@ -147,3 +158,9 @@ func (e *hasValidAnswer) match(qCtx *query_context.Context) (matched bool) {
 func (e *hasValidAnswer) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
 	return e.match(qCtx), nil
 }
+
+// addMatcher appends mt to the matcher group. Its result is traced
+// with name.
+func (m *responseMatcher) addMatcher(name string, mt executable_seq.Matcher) {
+	m.matcherGroup = append(m.matcherGroup, &executable_seq.TracedMatcher{Name: m.Tag() + " " + name, Matcher: mt})
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package china_split
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pmkol/mosdns-x/coremain"
+)
+
+const PresetType = "china_split"
+
+func init() {
+	coremain.RegPipelinePreset(PresetType, Expand, func() interface{} { return new(Args) })
+}
+
+// Args of the china_split preset. Queries of local domains are sent to
+// the local upstreams, others to the remote upstreams.
+type Args struct {
+	LocalUpstream  []string `yaml:"local_upstream"`  // required
+	RemoteUpstream []string `yaml:"remote_upstream"` // required
+
+	// LocalDomains and RemoteDomains are domain matcher expressions,
+	// e.g. "ext:./geosite_cn.txt". LocalIPs are ip matcher expressions of
+	// local addresses, e.g. "ext:./geoip_cn.txt".
+	LocalDomains  []string `yaml:"local_domains"`
+	RemoteDomains []string `yaml:"remote_domains"`
+	LocalIPs      []string `yaml:"local_ips"`
+
+	// Unknown is how domains in neither list are resolved.
+	// "remote" (default): send to the remote upstreams, without ecs. If
+	// the answer has local ips, query the local upstreams again for
+	// nearer addresses.
+	// "local": send to the local upstreams, and fall back to the remote
+	// upstreams if the answer has no local ip.
+	Unknown string `yaml:"unknown"`
+
+	NoCache    bool `yaml:"no_cache"`
+	PreferIPv4 bool `yaml:"prefer_ipv4"`
+
+	// Args overrides of the generated plugins. Keys are merged into the
+	// generated args.
+	LocalArgs  map[string]interface{} `yaml:"local_args"`  // fast_forward
+	RemoteArgs map[string]interface{} `yaml:"remote_args"` // fast_forward
+	CacheArgs  map[string]interface{} `yaml:"cache_args"`  // cache
+}
+
+// Expand implements coremain.PipelinePresetFunc. The entry is a sequence
+// with the tag, other plugins have tags prefixed by "<tag>_".
+func Expand(tag string, args interface{}) ([]coremain.PluginConfig, error) {
+	a := args.(*Args)
+	if len(a.LocalUpstream) == 0 || len(a.RemoteUpstream) == 0 {
+		return nil, errors.New("missing local_upstream or remote_upstream")
+	}
+	switch a.Unknown {
+	case "":
+		a.Unknown = "remote"
+	case "remote", "local":
+	default:
+		return nil, fmt.Errorf("invalid unknown mode %s", a.Unknown)
+	}
+	if a.Unknown == "local" && len(a.LocalIPs) == 0 {
+		return nil, errors.New("unknown mode local requires local_ips")
+	}
+
+	var (
+		pcs  []coremain.PluginConfig
+		exec []interface{}
+	)
+	add := func(suffix, typ string, args map[string]interface{}) string {
+		t := tag + "_" + suffix
+		pcs = append(pcs, coremain.PluginConfig{Tag: t, Type: typ, Args: args})
+		return t
+	}
+
+	local := add("local", "fast_forward", merge(forwardArgs(a.LocalUpstream), a.LocalArgs))
+	remote := add("remote", "fast_forward", merge(forwardArgs(a.RemoteUpstream), a.RemoteArgs))
+	if a.PreferIPv4 {
+		exec = append(exec, "_prefer_ipv4")
+	}
+	if !a.NoCache {
+		exec = append(exec, add("cache", "cache", merge(map[string]interface{}{}, a.CacheArgs)))
+	}
+	if len(a.LocalDomains) > 0 {
+		m := add("local_domain", "query_matcher", map[string]interface{}{"domain": toAny(a.LocalDomains)})
+		exec = append(exec, ifBlock(m, local, "_return"))
+	}
+	if len(a.RemoteDomains) > 0 {
+		m := add("remote_domain", "query_matcher", map[string]interface{}{"domain": toAny(a.RemoteDomains)})
+		exec = append(exec, ifBlock(m, "_no_ecs", remote, "_return"))
+	}
+	var localIP string
+	if len(a.LocalIPs) > 0 {
+		localIP = add("local_ip", "response_matcher", map[string]interface{}{"ip": toAny(a.LocalIPs)})
+	}
+	switch a.Unknown {
+	case "remote":
+		exec = append(exec, "_no_ecs", remote)
+		if len(localIP) > 0 {
+			exec = append(exec, ifBlock(localIP, local))
+		}
+	case "local":
+		exec = append(exec, map[string]interface{}{
+			"primary":        []interface{}{local, ifBlock("! "+localIP, "_drop_response")},
+			"secondary":      []interface{}{"_no_ecs", remote},
+			"fast_fallback":  200,
+			"always_standby": true,
+		})
+	}
+
+	entry := coremain.PluginConfig{Tag: tag, Type: "sequence", Args: map[string]interface{}{"exec": exec}}
+	return append(pcs, entry), nil
+}
+
+func forwardArgs(addrs []string) map[string]interface{} {
+	u := make([]interface{}, 0, len(addrs))
+	for _, addr := range addrs {
+		u = append(u, map[string]interface{}{"addr": addr})
+	}
+	return map[string]interface{}{"upstream": u}
+}
+
+func ifBlock(cond string, exec ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"if": cond, "exec": exec}
+}
+
+// merge copies keys of o into m, and returns m.
+func merge(m, o map[string]interface{}) map[string]interface{} {
+	for k, v := range o {
+		m[k] = v
+	}
+	return m
+}
+
+func toAny(s []string) []interface{} {
+	out := make([]interface{}, 0, len(s))
+	for _, e := range s {
+		out = append(out, e)
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package china_split
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     *Args
+		wantTags []string
+		wantErr  bool
+	}{
+		{"no upstream", &Args{LocalUpstream: []string{"127.0.0.1"}}, nil, true},
+		{"invalid unknown", &Args{LocalUpstream: []string{"a"}, RemoteUpstream: []string{"b"}, Unknown: "x"}, nil, true},
+		{"local without ips", &Args{LocalUpstream: []string{"a"}, RemoteUpstream: []string{"b"}, Unknown: "local"}, nil, true},
+		{
+			"minimal",
+			&Args{LocalUpstream: []string{"a"}, RemoteUpstream: []string{"b"}},
+			[]string{"s_local", "s_remote", "s_cache", "s"},
+			false,
+		},
+		{
+			"full",
+			&Args{
+				LocalUpstream:  []string{"a"},
+				RemoteUpstream: []string{"b"},
+				LocalDomains:   []string{"cn"},
+				RemoteDomains:  []string{"google.com"},
+				LocalIPs:       []string{"1.0.1.0/24"},
+				Unknown:        "local",
+				NoCache:        true,
+			},
+			[]string{"s_local", "s_remote", "s_local_domain", "s_remote_domain", "s_local_ip", "s"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcs, err := Expand("s", tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var tags []string
+			for _, pc := range pcs {
+				tags = append(tags, pc.Tag)
+			}
+			if !reflect.DeepEqual(tags, tt.wantTags) {
+				t.Fatalf("Expand() tags = %v, want %v", tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestExpand_overrides(t *testing.T) {
+	pcs, err := Expand("s", &Args{
+		LocalUpstream:  []string{"a"},
+		RemoteUpstream: []string{"b"},
+		LocalArgs:      map[string]interface{}{"ca": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := pcs[0].Args.(map[string]interface{})
+	if args["ca"] != "x" || args["upstream"] == nil {
+		t.Fatalf("unexpected local args %v", args)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+
+	"github.com/pmkol/mosdns-x/mlog"
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
+)
+
+func newDnstapListenCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "listen {unix|tcp}://addr",
+		Args:  cobra.ExactArgs(1),
+		Short: "Receive dnstap messages and print them.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := ListenDnstap(args[0], os.Stdout); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+// ListenDnstap accepts Frame Streams connections on addr and prints
+// received dnstap messages to w, one per line.
+func ListenDnstap(addr string, w io.Writer) error {
+	network, a, ok := strings.Cut(addr, "://")
+	if !ok {
+		network, a = "unix", addr
+	}
+	if network != "unix" && network != "tcp" {
+		return fmt.Errorf("unsupported network %s", network)
+	}
+	if network == "unix" {
+		os.Remove(a) // remove the stale socket file
+	}
+	l, err := net.Listen(network, a)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	mlog.S().Infof("dnstap receiver is listening on %s", l.Addr())
+
+	out := make(chan string, 64)
+	go func() {
+		for s := range out {
+			fmt.Fprintln(w, s)
+		}
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			if err := readDnstap(c, out); err != nil && !errors.Is(err, io.EOF) {
+				mlog.S().Warnf("dnstap connection from %s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func readDnstap(c net.Conn, out chan<- string) error {
+	fr, err := dnstap.NewFrameReader(c, dnstap.ContentType)
+	if err != nil {
+		return fmt.Errorf("handshake failed, %w", err)
+	}
+	for {
+		b, err := fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		m, err := dnstap.Unmarshal(b)
+		if err != nil {
+			return fmt.Errorf("invalid message, %w", err)
+		}
+		out <- formatDnstap(m)
+	}
+}
+
+// formatDnstap returns a line like
+// "12:00:00.000 CLIENT_QUERY udp 127.0.0.1:1234 example.com. A".
+func formatDnstap(m *dnstap.Message) string {
+	sb := new(strings.Builder)
+	t := m.QueryTime
+	if !m.Type.IsQuery() && !m.ResponseTime.IsZero() {
+		t = m.ResponseTime
+	}
+	fmt.Fprintf(sb, "%s %s %s", t.Format("15:04:05.000"), m.Type, m.Protocol)
+
+	peer := m.QueryAddress
+	if m.Type == dnstap.ForwarderQuery || m.Type == dnstap.ForwarderResponse {
+		peer = m.ResponseAddress
+	}
+	if peer.IsValid() {
+		fmt.Fprintf(sb, " %s", peer)
+	} else {
+		sb.WriteString(" -")
+	}
+
+	b := m.QueryMessage
+	if !m.Type.IsQuery() && len(m.ResponseMessage) > 0 {
+		b = m.ResponseMessage
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		sb.WriteString(" <invalid message>")
+		return sb.String()
+	}
+	if len(msg.Question) > 0 {
+		q := msg.Question[0]
+		fmt.Fprintf(sb, " %s %s", q.Name, dns.TypeToString[q.Qtype])
+	}
+	if msg.Response {
+		fmt.Fprintf(sb, " %s %d answers", dns.RcodeToString[msg.Rcode], len(msg.Answer))
+		if !m.ResponseTime.IsZero() && !m.QueryTime.IsZero() {
+			fmt.Fprintf(sb, " %s", m.ResponseTime.Sub(m.QueryTime).Round(time.Microsecond*100))
+		}
+	}
+	return sb.String()
+}
@@ -53,4 +53,11 @@ func init() {
 	}
 	configCmd.AddCommand(newGenCmd(), newConvCmd())
 	coremain.AddSubCmd(configCmd)
+
+	dnstapCmd := &cobra.Command{
+		Use:   "dnstap",
+		Short: "Tools that can receive dnstap messages.",
+	}
+	dnstapCmd.AddCommand(newDnstapListenCmd())
+	coremain.AddSubCmd(dnstapCmd)
 }